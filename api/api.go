@@ -0,0 +1,162 @@
+// Package api embeds the azuretls REST and WebSocket API in an existing Go
+// service, served by its own listener instead of a separate server.
+//
+//	handler, err := api.Handler(api.DefaultConfig(), nil)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer handler.(io.Closer).Close()
+//
+//	mux.Handle("/tls/", http.StripPrefix("/tls", handler))
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/auth"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/rest"
+	"github.com/Noooste/azuretls-api/internal/server"
+)
+
+type (
+	// Config configures the API. Host, Port and the ReadTimeout,
+	// WriteTimeout, IdleTimeout and ReadHeaderTimeout timeouts only apply to
+	// the standalone server.
+	Config = common.ServerConfig
+	// Server is a standalone server, started with Start and stopped with Stop
+	Server                  = server.Server
+	SessionManager          = common.SessionManager
+	SessionManagerLifecycle = common.SessionManagerLifecycle
+	SessionResetter         = common.SessionResetter
+	SessionForker           = common.SessionForker
+	ProfileCatalog          = common.ProfileCatalog
+	SessionConfig           = common.SessionConfig
+	SessionPoolConfig       = common.SessionPoolConfig
+	APIKeyConfig            = common.APIKeyConfig
+	Rule                    = common.Rule
+	Probe                   = common.Probe
+	FaultInjectionConfig    = common.FaultInjectionConfig
+	IPInfo                  = common.IPInfo
+	DNSCacheEntry           = common.DNSCacheEntry
+	SentRequest             = common.SentRequest
+	Middleware              = common.Middleware
+	MiddlewareStage         = common.MiddlewareStage
+	MiddlewareConfig        = common.MiddlewareConfig
+	SessionConnection       = common.SessionConnection
+	Profile                 = common.Profile
+	QUICConfig              = common.QUICConfig
+	RotationPolicy          = common.RotationPolicy
+	DoTConfig               = common.DoTConfig
+	DialConfig              = common.DialConfig
+	ProxyAuthConfig         = common.ProxyAuthConfig
+	BandwidthConfig         = common.BandwidthConfig
+	ConnectionAgeConfig     = common.ConnectionAgeConfig
+	ScriptLimits            = common.ScriptLimits
+	RuleMatch               = common.RuleMatch
+	URLRewrite              = common.URLRewrite
+	RequestOptions          = common.RequestOptions
+	DownloadOptions         = common.DownloadOptions
+	ExtractOptions          = common.ExtractOptions
+	SignOptions             = common.SignOptions
+	AWSSigV4Options         = common.AWSSigV4Options
+	HMACSignOptions         = common.HMACSignOptions
+)
+
+const (
+	// BeforeAuth middlewares run before API key authentication. Auth
+	// adapters run there, setting the X-API-Key header of the requests
+	// they accept.
+	BeforeAuth = common.BeforeAuth
+	// AfterAuth middlewares run once the API key of the request is known
+	AfterAuth = common.AfterAuth
+)
+
+// DefaultConfig returns the configuration of a server started without flags
+func DefaultConfig() Config {
+	return Config{
+		Host:                  "localhost",
+		Port:                  8080,
+		MaxSessions:           1000,
+		MaxConcurrentRequests: 100,
+		ReadTimeout:           30 * time.Second,
+		WriteTimeout:          30 * time.Second,
+		IdleTimeout:           2 * time.Minute,
+		ReadHeaderTimeout:     10 * time.Second,
+		WSMaxMessageSize:      512 * 1024,
+		WSDrainTimeout:        5 * time.Second,
+		WSPersistTTL:          time.Hour,
+		QueueTimeout:          30 * time.Second,
+		BodyRefTTL:            5 * time.Minute,
+		DownloadTTL:           time.Hour,
+		LogLevel:              "info",
+		HealthCheckTimeout:    10 * time.Second,
+		IPEchoURL:             "https://api.ipify.org",
+		IPCacheTTL:            5 * time.Minute,
+	}
+}
+
+// NewServer creates a standalone server listening on the configured host and
+// port. A nil session manager uses the default one. It fails when the
+// request rules are invalid or the session manager fails to start.
+func NewServer(config Config, sessionManager SessionManager) (*Server, error) {
+	return server.NewServer(config, sessionManager)
+}
+
+// NewSessionManager returns the default session manager, for custom
+// managers to wrap. It implements SessionManagerLifecycle, SessionResetter
+// and SessionForker.
+func NewSessionManager() SessionManager {
+	return server.NewSessionManager()
+}
+
+// Handler returns the whole API, REST and WebSocket, rooted at "/". Mounted
+// under a path prefix, the prefix must be stripped, as with
+// http.StripPrefix. A nil session manager uses the default one. It fails
+// when the request rules are invalid or the session manager fails to start.
+//
+// The handler runs background tasks, such as keepalives, probes and
+// downloads, until closed: it implements io.Closer, closing which also
+// deletes the sessions.
+func Handler(config Config, sessionManager SessionManager) (http.Handler, error) {
+	handler, err := server.New(config, sessionManager)
+	if err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+// RegisterMiddleware adds a middleware to the chain of every server and
+// handler created afterwards, before the middlewares of their config.
+// Plugins compiled into the binary call it from their init function:
+//
+//	func init() {
+//		api.RegisterMiddleware(api.MiddlewareConfig{
+//			Name:       "tenant",
+//			Stage:      api.AfterAuth,
+//			Middleware: tenantMiddleware,
+//		})
+//	}
+//
+// It panics when the middleware is nil or its name already registered.
+func RegisterMiddleware(middleware MiddlewareConfig) {
+	rest.RegisterMiddleware(middleware)
+}
+
+// RequestID returns the ID the API gave to a request, as sent back in the
+// X-Request-ID header
+func RequestID(r *http.Request) string {
+	return rest.GetRequestID(r.Context())
+}
+
+// APIKeyName returns the name of the API key a request was authenticated
+// with, and false for requests that were not, such as all of them when no
+// API keys are configured or the ones seen by BeforeAuth middlewares
+func APIKeyName(r *http.Request) (string, bool) {
+	key := auth.FromContext(r.Context())
+	if key == nil {
+		return "", false
+	}
+	return key.Name(), true
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+func loadAPIKeys(path string) ([]common.APIKeyConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %w", err)
+	}
+
+	var keys []common.APIKeyConfig
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool, len(keys))
+	for i, key := range keys {
+		if key.Key == "" {
+			return nil, fmt.Errorf("API key %d has an empty key", i)
+		}
+		if seen[key.Key] {
+			return nil, fmt.Errorf("API key %d (%s) is defined twice", i, key.Name)
+		}
+		seen[key.Key] = true
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// serverFlags are the flags of the server, also accepted by validate-config
+type serverFlags struct {
+	configFile            *string
+	host                  *string
+	port                  *int
+	maxSessions           *int
+	maxConcurrentRequests *int
+	maxRequestsPerKey     *int
+	readTimeout           *int
+	writeTimeout          *int
+	idleTimeout           *int
+	readHeaderTimeout     *int
+	wsMaxMessageSize      *int64
+	wsDrainTimeout        *int
+	wsPersistTTL          *int
+	wsReconnectTo         *string
+	maxOutgoingRequests   *int
+	queueTimeout          *int
+	logLevel              *string
+	healthCheckURL        *string
+	healthCheckTimeout    *int
+	ipEchoURL             *string
+	ipCacheTTL            *int
+	geoIPDatabase         *string
+	disableDNSCache       *bool
+	dotAddress            *string
+	dotServerName         *string
+	maxBandwidth          *int64
+	faultLatencyPercent   *float64
+	faultLatencyMs        *int
+	faultLatencyJitterMs  *int
+	faultErrorPercent     *float64
+	faultErrorCodes       *string
+	faultResetPercent     *float64
+	apiKeysFile           *string
+	adminKey              *string
+	rulesFile             *string
+	profilesDir           *string
+	poolSize              *int
+	poolProfiles          *string
+	poolProxies           *string
+	downloadDir           *string
+	bodyStoreDir          *string
+	bodyRefTTL            *int
+	downloadTTL           *int
+	dashboard             *bool
+	probesFile            *string
+	pluginsDir            *string
+	scriptsDir            *string
+	scriptTimeoutMs       *int
+	scriptMaxStack        *int
+	scriptMaxCallDepth    *int
+}
+
+// pathFlags hold paths, resolved relative to the config file that sets them
+var pathFlags = map[string]bool{
+	"geoip_db":       true,
+	"api_keys":       true,
+	"rules":          true,
+	"profiles_dir":   true,
+	"pool_profiles":  true,
+	"pool_proxies":   true,
+	"download_dir":   true,
+	"body_store_dir": true,
+	"probes":         true,
+	"plugins_dir":    true,
+	"scripts_dir":    true,
+}
+
+func registerServerFlags(fs *flag.FlagSet) *serverFlags {
+	return &serverFlags{
+		configFile:            fs.String("config", "", "YAML or JSON file setting the flags by name, flags given on the command line taking precedence"),
+		host:                  fs.String("host", "localhost", "Server host address"),
+		port:                  fs.Int("port", 8080, "Server port"),
+		maxSessions:           fs.Int("max_sessions", 1000, "Maximum concurrent sessions"),
+		maxConcurrentRequests: fs.Int("max_concurrent_requests", 100, "Maximum concurrent requests per session"),
+		maxRequestsPerKey:     fs.Int("max_concurrent_requests_per_key", 0, "Maximum concurrent requests per API key, within -max_concurrent_requests (0 for no limit per key)"),
+		readTimeout:           fs.Int("read_timeout", 30, "Server read timeout (seconds)"),
+		writeTimeout:          fs.Int("write_timeout", 30, "Server write timeout (seconds)"),
+		idleTimeout:           fs.Int("idle_timeout", 120, "Time an idle keep-alive connection is kept open (seconds, 0 uses -read_timeout)"),
+		readHeaderTimeout:     fs.Int("read_header_timeout", 10, "Time allowed to read the headers of an API request (seconds, 0 uses -read_timeout)"),
+		wsMaxMessageSize:      fs.Int64("ws_max_message_size", 512*1024, "Maximum size of a WebSocket message sent by a client (bytes), larger ones closing the connection"),
+		wsDrainTimeout:        fs.Int("ws_drain_timeout", 5, "Time given on shutdown to the WebSocket messages being handled before closing the connections (seconds)"),
+		wsPersistTTL:          fs.Int("ws_persist_ttl", 3600, "Time a persisted WebSocket session is kept once no connection holds it (seconds)"),
+		wsReconnectTo:         fs.String("ws_reconnect_to", "", "URL WebSocket clients are told to reconnect to on shutdown, for clustered deployments"),
+		maxOutgoingRequests:   fs.Int("max_outgoing_requests", 0, "Maximum requests sent to targets at the same time, the others waiting by priority (0 for no limit)"),
+		queueTimeout:          fs.Int("queue_timeout", 30, "Time a request waits for -max_outgoing_requests before failing (seconds, 0 waits indefinitely)"),
+		logLevel:              fs.String("log_level", "info", "Log level (debug, info, warn, error)"),
+		healthCheckURL:        fs.String("health_check_url", "", "URL requested by the deep health check egress probe"),
+		healthCheckTimeout:    fs.Int("health_check_timeout", 10, "Deep health check egress probe timeout (seconds)"),
+		ipEchoURL:             fs.String("ip_echo_url", "https://api.ipify.org", "Echo service used to discover the public IP of sessions"),
+		ipCacheTTL:            fs.Int("ip_cache_ttl", 300, "Public IP cache duration per session and proxy (seconds, negative disables caching)"),
+		geoIPDatabase:         fs.String("geoip_db", "", "Comma-separated MaxMind database paths used to add geolocation/ASN to IP lookups"),
+		disableDNSCache:       fs.Bool("disable_dns_cache", false, "Disable per-session DNS caching"),
+		dotAddress:            fs.String("dot_address", "", "DNS over TLS resolver (host[:port], port 853 by default) used instead of the system name servers"),
+		dotServerName:         fs.String("dot_server_name", "", "Name the -dot_address certificate is verified against, its host by default"),
+		maxBandwidth:          fs.Int64("max_bandwidth", 0, "Maximum bytes per second sent by all sessions together (0 for no limit)"),
+		faultLatencyPercent:   fs.Float64("fault_latency_percent", 0, "Testing only: percentage of requests delayed by -fault_latency_ms"),
+		faultLatencyMs:        fs.Int("fault_latency_ms", 1000, "Testing only: latency injected into delayed requests (milliseconds)"),
+		faultLatencyJitterMs:  fs.Int("fault_latency_jitter_ms", 0, "Testing only: random extra latency added to delayed requests (milliseconds)"),
+		faultErrorPercent:     fs.Float64("fault_error_percent", 0, "Testing only: percentage of requests answered with an injected error status"),
+		faultErrorCodes:       fs.String("fault_error_codes", "503", "Testing only: comma-separated status codes used for injected errors"),
+		faultResetPercent:     fs.Float64("fault_reset_percent", 0, "Testing only: percentage of requests failed with an injected connection reset"),
+		apiKeysFile:           fs.String("api_keys", "", "JSON file listing the accepted API keys and their default session configs"),
+		adminKey:              fs.String("admin_key", os.Getenv("AZURETLS_ADMIN_KEY"), "Key granting access to the admin endpoints, metrics and dashboard (defaults to $AZURETLS_ADMIN_KEY)"),
+		rulesFile:             fs.String("rules", "", "JSON file listing the transformation rules applied to outgoing requests"),
+		profilesDir:           fs.String("profiles_dir", "", "Directory of JSON/YAML profile files, reloaded on SIGHUP"),
+		poolSize:              fs.Int("pool_size", 0, "Number of sessions pre-created at startup and handed out by /api/v1/session/acquire"),
+		poolProfiles:          fs.String("pool_profiles", "", "JSON file holding the session configs assigned round-robin to pooled sessions"),
+		poolProxies:           fs.String("pool_proxies", "", "File listing one proxy per line, assigned round-robin to pooled sessions"),
+		downloadDir:           fs.String("download_dir", "", "Directory where downloads requested with save_as are written"),
+		bodyStoreDir:          fs.String("body_store_dir", "", "Directory holding the artifacts of managed downloads (a temporary directory when empty)"),
+		bodyRefTTL:            fs.Int("body_ref_ttl", 300, "Time response bodies stored with the body_ref option can be fetched (seconds)"),
+		downloadTTL:           fs.Int("download_ttl", 3600, "Time managed downloads that are not running are kept after their last update (seconds)"),
+		dashboard:             fs.Bool("dashboard", false, "Serve the operator dashboard on /dashboard, restricted to admin API keys"),
+		probesFile:            fs.String("probes", "", "JSON file listing the target health probes checked periodically"),
+		pluginsDir:            fs.String("plugins_dir", "", "Directory of plugin executables started with the server"),
+		scriptsDir:            fs.String("scripts_dir", "", "Directory of Lua scripts (.lua) loaded at startup, named after their file"),
+		scriptTimeoutMs:       fs.Int("script_timeout_ms", 1000, "Maximum run time of a script hook (milliseconds)"),
+		scriptMaxStack:        fs.Int("script_max_stack", 65536, "Maximum number of values on the stack of a script"),
+		scriptMaxCallDepth:    fs.Int("script_max_call_depth", 200, "Maximum function call depth of a script"),
+	}
+}
+
+// applyConfigFile sets the flags left unset on the command line from the
+// -config file, whose keys are flag names
+func (f *serverFlags) applyConfigFile(fs *flag.FlagSet) []config.Error {
+	path := *f.configFile
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []config.Error{{Source: "config", Message: err.Error()}}
+	}
+
+	// YAML being a superset of JSON, both formats are read alike
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return []config.Error{{Source: "config", Message: fmt.Sprintf("failed to parse %s: %v", path, err)}}
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		explicit[fl.Name] = true
+	})
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []config.Error
+	for _, name := range names {
+		value := values[name]
+
+		if name == "config" || fs.Lookup(name) == nil {
+			errs = append(errs, config.Error{Source: "config", Field: name, Message: "unknown setting"})
+			continue
+		}
+		if explicit[name] || value == nil {
+			continue
+		}
+
+		var text string
+		switch v := value.(type) {
+		case map[string]any, []any:
+			errs = append(errs, config.Error{Source: "config", Field: name, Message: "expected a single value"})
+			continue
+		case string:
+			text = v
+		default:
+			encoded, _ := json.Marshal(v)
+			text = string(encoded)
+		}
+
+		if pathFlags[name] {
+			text = resolvePaths(filepath.Dir(path), text)
+		}
+
+		if err := fs.Set(name, text); err != nil {
+			errs = append(errs, config.Error{Source: "config", Field: name, Message: err.Error()})
+		}
+	}
+
+	return errs
+}
+
+// resolvePaths makes the comma-separated relative paths of a config file
+// value relative to the directory of the file
+func resolvePaths(dir, value string) string {
+	if value == "" {
+		return value
+	}
+
+	paths := strings.Split(value, ",")
+	for i, path := range paths {
+		path = strings.TrimSpace(path)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		paths[i] = path
+	}
+	return strings.Join(paths, ",")
+}
+
+// serverConfig loads the files the flags point to and builds the server
+// configuration, returning the problems of every file
+func (f *serverFlags) serverConfig() (common.ServerConfig, []config.Error) {
+	var errs []config.Error
+	fail := func(source string, err error) {
+		errs = append(errs, config.Error{Source: source, Message: err.Error()})
+	}
+
+	sessionPool, err := loadSessionPoolConfig(*f.poolSize, *f.poolProfiles, *f.poolProxies)
+	if err != nil {
+		fail("session_pool", err)
+	}
+
+	apiKeys, err := loadAPIKeys(*f.apiKeysFile)
+	if err != nil {
+		fail("api_keys", err)
+	}
+
+	requestRules, err := loadRules(*f.rulesFile)
+	if err != nil {
+		fail("rules", err)
+	}
+
+	probes, err := loadProbes(*f.probesFile)
+	if err != nil {
+		fail("probes", err)
+	}
+
+	errorStatusCodes, err := parseStatusCodes(*f.faultErrorCodes)
+	if err != nil {
+		fail("fault_error_codes", err)
+	}
+
+	return common.ServerConfig{
+		Host:                        *f.host,
+		Port:                        *f.port,
+		MaxSessions:                 *f.maxSessions,
+		MaxConcurrentRequests:       *f.maxConcurrentRequests,
+		MaxConcurrentRequestsPerKey: *f.maxRequestsPerKey,
+		ReadTimeout:                 time.Duration(*f.readTimeout) * time.Second,
+		WriteTimeout:                time.Duration(*f.writeTimeout) * time.Second,
+		IdleTimeout:                 time.Duration(*f.idleTimeout) * time.Second,
+		ReadHeaderTimeout:           time.Duration(*f.readHeaderTimeout) * time.Second,
+		WSMaxMessageSize:            *f.wsMaxMessageSize,
+		WSDrainTimeout:              time.Duration(*f.wsDrainTimeout) * time.Second,
+		WSPersistTTL:                time.Duration(*f.wsPersistTTL) * time.Second,
+		WSReconnectTo:               *f.wsReconnectTo,
+		MaxOutgoingRequests:         *f.maxOutgoingRequests,
+		QueueTimeout:                time.Duration(*f.queueTimeout) * time.Second,
+		LogLevel:                    *f.logLevel,
+		HealthCheckURL:              *f.healthCheckURL,
+		HealthCheckTimeout:          time.Duration(*f.healthCheckTimeout) * time.Second,
+		IPEchoURL:                   *f.ipEchoURL,
+		IPCacheTTL:                  time.Duration(*f.ipCacheTTL) * time.Second,
+		GeoIPDatabase:               *f.geoIPDatabase,
+		DisableDNSCache:             *f.disableDNSCache,
+		DoTAddress:                  *f.dotAddress,
+		DoTServerName:               *f.dotServerName,
+		MaxBandwidth:                *f.maxBandwidth,
+		FaultInjection: common.FaultInjectionConfig{
+			LatencyPercent:   *f.faultLatencyPercent,
+			Latency:          time.Duration(*f.faultLatencyMs) * time.Millisecond,
+			LatencyJitter:    time.Duration(*f.faultLatencyJitterMs) * time.Millisecond,
+			ErrorPercent:     *f.faultErrorPercent,
+			ErrorStatusCodes: errorStatusCodes,
+			ResetPercent:     *f.faultResetPercent,
+		},
+		SessionPool:  sessionPool,
+		ProfilesDir:  *f.profilesDir,
+		APIKeys:      apiKeys,
+		AdminKey:     *f.adminKey,
+		Rules:        requestRules,
+		DownloadDir:  *f.downloadDir,
+		BodyStoreDir: *f.bodyStoreDir,
+		BodyRefTTL:   time.Duration(*f.bodyRefTTL) * time.Second,
+		DownloadTTL:  time.Duration(*f.downloadTTL) * time.Second,
+		Dashboard:    *f.dashboard,
+		Probes:       probes,
+		PluginsDir:   *f.pluginsDir,
+		ScriptsDir:   *f.scriptsDir,
+		ScriptLimits: common.ScriptLimits{
+			Timeout:      time.Duration(*f.scriptTimeoutMs) * time.Millisecond,
+			MaxStack:     *f.scriptMaxStack,
+			MaxCallDepth: *f.scriptMaxCallDepth,
+		},
+	}, errs
+}
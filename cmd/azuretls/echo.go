@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/echo"
+)
+
+// runEchoServer starts a server reporting the TLS and HTTP fingerprints of
+// its callers, used to self-test sessions without third-party services
+func runEchoServer(args []string) {
+	flags := flag.NewFlagSet("echo-server", flag.ExitOnError)
+	var (
+		host     = flags.String("host", "localhost", "Echo server host address")
+		port     = flags.Int("port", 8443, "Echo server port")
+		certFile = flags.String("cert", "", "TLS certificate file (a self-signed certificate is generated when empty)")
+		keyFile  = flags.String("key", "", "TLS private key file")
+		logLevel = flags.String("log_level", "info", "Log level (debug, info, warn, error)")
+	)
+	_ = flags.Parse(args)
+
+	common.SetLogLevel(*logLevel)
+
+	srv, err := echo.NewServer(echo.Config{
+		Addr:     fmt.Sprintf("%s:%d", *host, *port),
+		CertFile: *certFile,
+		KeyFile:  *keyFile,
+	})
+	if err != nil {
+		log.Fatalf("Echo server failed to start: %v", err)
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigChan
+		log.Println("Received shutdown signal")
+		_ = srv.Close()
+	}()
+
+	log.Printf("Starting AzureTLS echo server on https://%s:%d", *host, *port)
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatalf("Echo server failed: %v", err)
+	}
+
+	log.Println("Echo server stopped gracefully")
+}
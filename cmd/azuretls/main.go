@@ -2,39 +2,54 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
-	"time"
 
-	"github.com/Noooste/azuretls-api/internal/common"
 	"github.com/Noooste/azuretls-api/internal/server"
 )
 
 func main() {
-	var (
-		host                  = flag.String("host", "localhost", "Server host address")
-		port                  = flag.Int("port", 8080, "Server port")
-		maxSessions           = flag.Int("max_sessions", 1000, "Maximum concurrent sessions")
-		maxConcurrentRequests = flag.Int("max_concurrent_requests", 100, "Maximum concurrent requests per session")
-		readTimeout           = flag.Int("read_timeout", 30, "Server read timeout (seconds)")
-		writeTimeout          = flag.Int("write_timeout", 30, "Server write timeout (seconds)")
-		logLevel              = flag.String("log_level", "info", "Log level (debug, info, warn, error)")
-	)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "echo-server":
+			runEchoServer(os.Args[2:])
+			return
+		case "mock":
+			runMockServer(os.Args[2:])
+			return
+		case "top":
+			runTop(os.Args[2:])
+			return
+		case "shell":
+			runShell(os.Args[2:])
+			return
+		case "validate-config":
+			runValidateConfig(os.Args[2:])
+			return
+		}
+	}
+
+	flags := registerServerFlags(flag.CommandLine)
 	flag.Parse()
 
-	config := common.ServerConfig{
-		Host:                  *host,
-		Port:                  *port,
-		MaxSessions:           *maxSessions,
-		MaxConcurrentRequests: *maxConcurrentRequests,
-		ReadTimeout:           time.Duration(*readTimeout) * time.Second,
-		WriteTimeout:          time.Duration(*writeTimeout) * time.Second,
-		LogLevel:              *logLevel,
+	errs := flags.applyConfigFile(flag.CommandLine)
+	config, loadErrs := flags.serverConfig()
+	if errs = append(errs, loadErrs...); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Invalid configuration: %v", err)
+		}
+		os.Exit(1)
 	}
 
-	srv := server.NewServer(config)
+	srv, err := server.NewServer(config, nil)
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -45,10 +60,36 @@ func main() {
 		srv.Stop()
 	}()
 
-	log.Printf("Starting AzureTLS server on %s:%d", *host, *port)
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+
+	go func() {
+		for range reloadChan {
+			srv.ReloadProfiles()
+		}
+	}()
+
+	log.Printf("Starting AzureTLS server on %s:%d", config.Host, config.Port)
 	if err := srv.Start(); err != nil {
 		log.Fatalf("Server failed to start: %v", err)
 	}
 
 	log.Println("Server stopped gracefully")
 }
+
+func parseStatusCodes(value string) ([]int, error) {
+	var codes []int
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		code, err := strconv.Atoi(part)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code %q", part)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
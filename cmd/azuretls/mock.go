@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/certs"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+// runMockServer starts the mock target used by integration tests
+func runMockServer(args []string) {
+	flags := flag.NewFlagSet("mock", flag.ExitOnError)
+	var (
+		host     = flags.String("host", "localhost", "Mock server host address")
+		port     = flags.Int("port", 8081, "Mock server port")
+		useTLS   = flags.Bool("tls", false, "Serve HTTPS (and HTTP/2) instead of plain HTTP")
+		certFile = flags.String("cert", "", "TLS certificate file (a self-signed certificate is generated when empty)")
+		keyFile  = flags.String("key", "", "TLS private key file")
+	)
+	_ = flags.Parse(args)
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", *host, *port),
+		Handler:           mock.NewHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	scheme := "http"
+	if *useTLS {
+		cert, err := certs.Load(*certFile, *keyFile, "azuretls mock server")
+		if err != nil {
+			log.Fatalf("Mock server failed to load certificate: %v", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		scheme = "https"
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigChan
+		log.Println("Received shutdown signal")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}()
+
+	log.Printf("Starting AzureTLS mock server on %s://%s:%d", scheme, *host, *port)
+
+	var err error
+	if *useTLS {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("Mock server failed: %v", err)
+	}
+
+	log.Println("Mock server stopped gracefully")
+}
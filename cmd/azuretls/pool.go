@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+func loadSessionPoolConfig(size int, profilesFile, proxiesFile string) (common.SessionPoolConfig, error) {
+	config := common.SessionPoolConfig{Size: size}
+
+	if size < 0 {
+		return config, fmt.Errorf("pool size must not be negative")
+	}
+
+	if profilesFile != "" {
+		data, err := os.ReadFile(profilesFile)
+		if err != nil {
+			return config, fmt.Errorf("failed to read profiles: %w", err)
+		}
+
+		if err := json.Unmarshal(data, &config.Profiles); err != nil {
+			return config, fmt.Errorf("failed to parse profiles %s: %w", profilesFile, err)
+		}
+	}
+
+	if proxiesFile != "" {
+		proxies, err := readLines(proxiesFile)
+		if err != nil {
+			return config, fmt.Errorf("failed to read proxies: %w", err)
+		}
+		config.Proxies = proxies
+	}
+
+	return config, nil
+}
+
+// readLines returns the non-empty lines of a file, skipping # comments
+func readLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, scanner.Err()
+}
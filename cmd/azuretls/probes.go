@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/probe"
+)
+
+func loadProbes(path string) ([]common.Probe, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read probes: %w", err)
+	}
+
+	var loaded []common.Probe
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("failed to parse probes %s: %w", path, err)
+	}
+
+	for i := range loaded {
+		if err := probe.Validate(&loaded[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return loaded, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/Noooste/azuretls-api/internal/shell"
+)
+
+// runShell opens an interactive prompt driving a session of a running
+// server over its WebSocket API
+func runShell(args []string) {
+	flags := flag.NewFlagSet("shell", flag.ExitOnError)
+	var (
+		serverURL      = flags.String("url", "http://localhost:8080", "URL of the server to connect to")
+		apiKey         = flags.String("api_key", os.Getenv("AZURETLS_API_KEY"), "API key (defaults to $AZURETLS_API_KEY)")
+		fingerprintURL = flags.String("fingerprint_url", shell.DefaultFingerprintURL, "Fingerprint echo service requested by the fingerprint command")
+		historyFile    = flags.String("history", defaultHistoryFile(), "File keeping the command history (empty disables it)")
+	)
+	_ = flags.Parse(args)
+
+	client, err := shell.Dial(*serverURL, *apiKey)
+	if err != nil {
+		log.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	sh := shell.New(client, shell.Config{
+		FingerprintURL: *fingerprintURL,
+		HistoryFile:    *historyFile,
+	}, os.Stdout)
+
+	if err := sh.Run(os.Stdin); err != nil {
+		log.Fatalf("Shell failed: %v", err)
+	}
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".azuretls_history")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/top"
+)
+
+// runTop live-displays the state of a running server from its admin
+// endpoints, refreshing the terminal like htop
+func runTop(args []string) {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	var (
+		serverURL = flags.String("url", "http://localhost:8080", "URL of the server to monitor")
+		apiKey    = flags.String("api_key", os.Getenv("AZURETLS_API_KEY"), "Admin API key (defaults to $AZURETLS_API_KEY)")
+		interval  = flags.Int("interval", 2, "Refresh interval (seconds)")
+		rows      = flags.Int("rows", 15, "Maximum hosts and sessions listed (0 lists them all)")
+		once      = flags.Bool("once", false, "Print a single snapshot without clearing the terminal and exit")
+	)
+	_ = flags.Parse(args)
+
+	if *interval <= 0 {
+		log.Fatalf("Invalid refresh interval: %d", *interval)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	client := &top.Client{
+		BaseURL:    *serverURL,
+		APIKey:     *apiKey,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	if *once {
+		snapshot, err := client.Fetch(ctx)
+		if err != nil {
+			log.Fatalf("Failed to fetch stats: %v", err)
+		}
+		top.Render(os.Stdout, *serverURL, nil, snapshot, *rows)
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(*interval) * time.Second)
+	defer ticker.Stop()
+
+	var prev *top.Snapshot
+	for {
+		// The screen is rendered before being written to avoid flickering
+		var screen bytes.Buffer
+		screen.WriteString(top.ClearScreen)
+
+		snapshot, err := client.Fetch(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Fprintf(&screen, "azuretls top - %s - %s\n\nFailed to fetch stats: %v\n", *serverURL, time.Now().Format("15:04:05"), err)
+		} else {
+			top.Render(&screen, *serverURL, prev, snapshot, *rows)
+			prev = snapshot
+		}
+		_, _ = os.Stdout.Write(screen.Bytes())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Noooste/azuretls-api/internal/config"
+)
+
+// runValidateConfig loads the configuration the server would start with,
+// checks it and prints every problem found, exiting with status 1 when
+// there is one
+func runValidateConfig(args []string) {
+	fs := flag.NewFlagSet("validate-config", flag.ExitOnError)
+	flags := registerServerFlags(fs)
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	_ = fs.Parse(args)
+
+	errs := flags.applyConfigFile(fs)
+	serverConfig, loadErrs := flags.serverConfig()
+	errs = append(errs, loadErrs...)
+
+	// Settings that failed to load are left empty, and not checked again
+	failed := make(map[string]bool, len(errs))
+	for _, err := range errs {
+		failed[err.Source] = true
+	}
+	for _, err := range config.Validate(serverConfig) {
+		if !failed[err.Source] {
+			errs = append(errs, err)
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(map[string]any{
+			"valid":  len(errs) == 0,
+			"errors": append([]config.Error{}, errs...),
+		})
+	} else {
+		for _, err := range errs {
+			fmt.Println(err.Error())
+		}
+		if len(errs) == 0 {
+			fmt.Println("Configuration is valid")
+		} else {
+			fmt.Printf("%d problems found\n", len(errs))
+		}
+	}
+
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+}
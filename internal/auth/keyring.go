@@ -0,0 +1,329 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+type contextKey struct{}
+
+// ErrEnforced is returned when a client changes a session setting its API
+// key enforces
+var ErrEnforced = errors.New("the API key enforces the settings of its sessions")
+
+// Key is an API key along with the session defaults attached to it
+type Key struct {
+	config    common.APIKeyConfig
+	digest    [sha256.Size]byte
+	nextProxy atomic.Uint64
+}
+
+func newKey(config common.APIKeyConfig) *Key {
+	return &Key{config: config, digest: sha256.Sum256([]byte(config.Key))}
+}
+
+func (k *Key) Name() string {
+	if k.config.Name != "" {
+		return k.config.Name
+	}
+	return "unnamed"
+}
+
+func (k *Key) Admin() bool {
+	return k.config.Admin
+}
+
+// ID identifies the key without revealing it, as the owner of the sessions
+// created with it
+func (k *Key) ID() string {
+	return hex.EncodeToString(k.digest[:8])
+}
+
+// CheckSessionChange returns ErrEnforced when the key enforces its
+// defaults, which setting the proxy or fingerprint of a session would
+// bypass
+func (k *Key) CheckSessionChange() error {
+	if k != nil && k.config.Enforce {
+		return ErrEnforced
+	}
+	return nil
+}
+
+// CheckRequestOptions returns ErrEnforced when the options override, for a
+// single request, settings the key enforces
+func (k *Key) CheckRequestOptions(options *common.RequestOptions) error {
+	if k == nil || !k.config.Enforce {
+		return nil
+	}
+	if options.Proxy != "" || options.Browser != "" || options.InsecureSkipVerify {
+		return ErrEnforced
+	}
+	return nil
+}
+
+// CookieJarOwners records the API key that created each shared cookie jar
+type CookieJarOwners interface {
+	OwnsCookieJar(owner, name string) bool
+}
+
+// ReachesCookieJar reports whether the key may use a shared cookie jar: the
+// jars it created and the one named in its defaults, admin keys reaching
+// every jar. Without a key, authentication is disabled and so is the check.
+func (k *Key) ReachesCookieJar(name string, owners CookieJarOwners) bool {
+	if k == nil || k.config.Admin || k.config.Defaults.CookieJar == name {
+		return true
+	}
+	return owners.OwnsCookieJar(k.ID(), name)
+}
+
+// MaxConcurrentRequests returns the number of requests of the key processed
+// at the same time, fallback unless the key sets its own limit
+func (k *Key) MaxConcurrentRequests(fallback int) int {
+	if k.config.MaxConcurrentRequests > 0 {
+		return k.config.MaxConcurrentRequests
+	}
+	return fallback
+}
+
+// SessionConfig returns the configuration of a session created with the
+// key, from the configuration requested by the client (which may be nil)
+func (k *Key) SessionConfig(requested *common.SessionConfig) *common.SessionConfig {
+	var config common.SessionConfig
+	if requested != nil {
+		config = *requested
+	}
+
+	defaults := k.config.Defaults
+	enforce := k.config.Enforce
+
+	config.Profile = pick(config.Profile, defaults.Profile, enforce)
+	config.Browser = pick(config.Browser, defaults.Browser, enforce)
+	config.UserAgent = pick(config.UserAgent, defaults.UserAgent, enforce)
+	config.Proxy = pick(config.Proxy, defaults.Proxy, enforce)
+	config.TimeoutMs = pick(config.TimeoutMs, defaults.TimeoutMs, enforce)
+	config.MaxRedirects = pick(config.MaxRedirects, defaults.MaxRedirects, enforce)
+	config.QUIC = pick(config.QUIC, defaults.QUIC, enforce)
+	config.CookieJar = pick(config.CookieJar, defaults.CookieJar, enforce)
+	config.DoT = pick(config.DoT, defaults.DoT, enforce)
+	config.Dial = pick(config.Dial, defaults.Dial, enforce)
+	config.ProxyAuth = pick(config.ProxyAuth, defaults.ProxyAuth, enforce)
+	config.Bandwidth = pick(config.Bandwidth, defaults.Bandwidth, enforce)
+	config.MaxConnectionAge = pick(config.MaxConnectionAge, defaults.MaxConnectionAge, enforce)
+
+	if enforce {
+		config.InsecureSkipVerify = defaults.InsecureSkipVerify
+		config.TLSResumption = defaults.TLSResumption
+
+		// The proxy credentials go with the proxy of the key
+		if defaults.Proxy != "" || len(k.config.Proxies) > 0 {
+			config.ProxyAuth = defaults.ProxyAuth
+		}
+
+		// Replacements keep the settings of the key rather than rotating
+		// through the browsers, profiles and proxies of the client
+		if config.Rotation != nil {
+			rotation := *config.Rotation
+			rotation.Browsers, rotation.Profiles, rotation.Proxies = nil, nil, nil
+			config.Rotation = &rotation
+		}
+	} else {
+		config.InsecureSkipVerify = config.InsecureSkipVerify || defaults.InsecureSkipVerify
+		config.TLSResumption = config.TLSResumption || defaults.TLSResumption
+	}
+
+	if len(defaults.OrderedHeaders) > 0 && (enforce || len(config.OrderedHeaders) == 0) {
+		config.OrderedHeaders = defaults.OrderedHeaders
+	}
+
+	if len(defaults.Headers) > 0 {
+		headers := make(map[string]string, len(defaults.Headers)+len(config.Headers))
+		for k, v := range config.Headers {
+			headers[k] = v
+		}
+		for k, v := range defaults.Headers {
+			if _, exists := headers[k]; enforce || !exists {
+				headers[k] = v
+			}
+		}
+		config.Headers = headers
+	}
+
+	if len(defaults.Tags) > 0 {
+		config.Tags = slices.Clone(config.Tags)
+	}
+	for _, tag := range defaults.Tags {
+		if !slices.Contains(config.Tags, tag) {
+			config.Tags = append(config.Tags, tag)
+		}
+	}
+
+	if len(defaults.Scripts) > 0 {
+		config.Scripts = slices.Clone(config.Scripts)
+	}
+	for _, script := range defaults.Scripts {
+		if !slices.Contains(config.Scripts, script) {
+			config.Scripts = append(config.Scripts, script)
+		}
+	}
+
+	if proxies := k.config.Proxies; len(proxies) > 0 && (enforce || config.Proxy == "") {
+		config.Proxy = proxies[(k.nextProxy.Add(1)-1)%uint64(len(proxies))]
+	}
+
+	return &config
+}
+
+// pick returns the default when it is set and either enforced or the
+// requested value is unset
+func pick[T comparable](requested, fallback T, enforce bool) T {
+	var zero T
+	if fallback != zero && (enforce || requested == zero) {
+		return fallback
+	}
+	return requested
+}
+
+// Keyring authenticates requests by API key. An empty keyring lets every
+// request through, except to the admin endpoints which always require an
+// admin key.
+type Keyring struct {
+	keys  []*Key
+	admin *Key
+}
+
+// NewKeyring returns a keyring of the given keys, along with adminKey, an
+// admin key accepted even when no API keys are configured
+func NewKeyring(keys []common.APIKeyConfig, adminKey string) *Keyring {
+	keyring := &Keyring{
+		keys: make([]*Key, 0, len(keys)),
+	}
+
+	for _, config := range keys {
+		keyring.keys = append(keyring.keys, newKey(config))
+	}
+
+	if adminKey != "" {
+		keyring.admin = newKey(common.APIKeyConfig{Key: adminKey, Name: "admin", Admin: true})
+	}
+
+	return keyring
+}
+
+func (k *Keyring) Enabled() bool {
+	return len(k.keys) > 0
+}
+
+// Lookup returns the key of a token. Digests of the token and of every key
+// are compared in constant time, so that the time taken does not tell how
+// close the token is to a key.
+func (k *Keyring) Lookup(token string) (*Key, bool) {
+	if token == "" {
+		return nil, false
+	}
+	digest := sha256.Sum256([]byte(token))
+
+	if k.admin != nil && subtle.ConstantTimeCompare(digest[:], k.admin.digest[:]) == 1 {
+		return k.admin, true
+	}
+
+	// The last key wins when a token is listed twice
+	var found *Key
+	for _, key := range k.keys {
+		if subtle.ConstantTimeCompare(digest[:], key.digest[:]) == 1 {
+			found = key
+		}
+	}
+	return found, found != nil
+}
+
+// adminConfigured reports whether any key may use the admin endpoints
+func (k *Keyring) adminConfigured() bool {
+	if k.admin != nil {
+		return true
+	}
+	for _, key := range k.keys {
+		if key.Admin() {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware rejects requests without a valid API key, read from the
+// X-API-Key header, a bearer token or the api_key query parameter, the
+// latter for WebSocket clients unable to set headers. The liveness check is
+// always allowed, unlike the deep health check which reports internals.
+func (k *Keyring) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, exists := k.Lookup(tokenFromRequest(r))
+
+		if !k.Enabled() || r.URL.Path == "/health" {
+			// The key is still needed by the admin endpoints
+			if exists {
+				r = r.WithContext(context.WithValue(r.Context(), contextKey{}, key))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !exists {
+			common.LogWarn("Rejected request with a missing or invalid API key: %s %s", r.Method, r.URL.Path)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"Missing or invalid API key"}`))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, key)))
+	})
+}
+
+// RequireAdmin rejects requests made without a key with admin rights,
+// including every request when no such key is configured. It must run after
+// Middleware.
+func (k *Keyring) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := FromContext(r.Context()); key == nil || !key.Admin() {
+			message := `{"error":"Admin API key required"}`
+			if !k.adminConfigured() {
+				message = `{"error":"Admin endpoints are disabled until an admin API key is configured"}`
+			}
+			common.LogWarn("Rejected admin request without an admin API key: %s %s", r.Method, r.URL.Path)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(message))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// FromContext returns the API key of a request, or nil when it has none
+func FromContext(ctx context.Context) *Key {
+	key, _ := ctx.Value(contextKey{}).(*Key)
+	return key
+}
+
+func tokenFromRequest(r *http.Request) string {
+	if token := r.Header.Get("X-API-Key"); token != "" {
+		return token
+	}
+
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return strings.TrimSpace(token)
+	}
+
+	return r.URL.Query().Get("api_key")
+}
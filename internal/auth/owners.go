@@ -0,0 +1,41 @@
+package auth
+
+import "sync"
+
+// Owners records the key owning each session
+type Owners struct {
+	mu     sync.RWMutex
+	owners map[string]string
+}
+
+func NewOwners() *Owners {
+	return &Owners{owners: make(map[string]string)}
+}
+
+func (o *Owners) Claim(sessionID, owner string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.owners[sessionID] = owner
+}
+
+func (o *Owners) Owner(sessionID string) (string, bool) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	owner, exists := o.owners[sessionID]
+	return owner, exists
+}
+
+func (o *Owners) Move(fromSessionID, toSessionID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if owner, exists := o.owners[fromSessionID]; exists {
+		o.owners[toSessionID] = owner
+		delete(o.owners, fromSessionID)
+	}
+}
+
+func (o *Owners) Forget(sessionID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.owners, sessionID)
+}
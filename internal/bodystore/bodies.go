@@ -0,0 +1,147 @@
+package bodystore
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// Bodies keeps the response bodies fetched out of band in a store, each one
+// being deleted ttl after it was stored. Only the bodies it stored can be
+// opened, not the other artifacts of the store.
+type Bodies struct {
+	store *Store
+	ttl   time.Duration
+
+	mu     sync.Mutex
+	bodies map[string]common.StoredBody
+
+	stop chan struct{}
+	once sync.Once
+}
+
+// NewBodies keeps bodies in store for ttl, expired ones being deleted every
+// interval
+func NewBodies(store *Store, ttl, interval time.Duration) *Bodies {
+	b := &Bodies{
+		store:  store,
+		ttl:    ttl,
+		bodies: make(map[string]common.StoredBody),
+		stop:   make(chan struct{}),
+	}
+
+	go b.run(interval)
+	return b
+}
+
+func (b *Bodies) Put(body []byte, contentType string) (common.StoredBody, error) {
+	ref, file, err := b.store.Create()
+	if err != nil {
+		return common.StoredBody{}, err
+	}
+
+	_, err = file.Write(body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = b.store.Delete(ref)
+		return common.StoredBody{}, fmt.Errorf("failed to write body: %w", err)
+	}
+
+	entry, err := b.store.Commit(ref, contentType)
+	if err != nil {
+		_ = b.store.Delete(ref)
+		return common.StoredBody{}, err
+	}
+
+	stored := common.StoredBody{
+		Ref:         ref,
+		Size:        entry.Size,
+		ContentType: contentType,
+		CreatedAt:   entry.CreatedAt,
+		ExpiresAt:   entry.CreatedAt.Add(b.ttl),
+	}
+
+	b.mu.Lock()
+	b.bodies[ref] = stored
+	b.mu.Unlock()
+
+	return stored, nil
+}
+
+// Check verifies that the store accepts new bodies
+func (b *Bodies) Check() error {
+	return b.store.Check()
+}
+
+func (b *Bodies) Open(ref string) (*os.File, common.StoredBody, error) {
+	b.mu.Lock()
+	stored, exists := b.bodies[ref]
+	b.mu.Unlock()
+
+	if !exists || time.Now().After(stored.ExpiresAt) {
+		return nil, common.StoredBody{}, common.ErrBodyNotFound
+	}
+
+	file, _, err := b.store.Open(ref)
+	if err != nil {
+		return nil, common.StoredBody{}, err
+	}
+	return file, stored, nil
+}
+
+func (b *Bodies) Delete(ref string) error {
+	b.mu.Lock()
+	_, exists := b.bodies[ref]
+	delete(b.bodies, ref)
+	b.mu.Unlock()
+
+	if !exists {
+		return common.ErrBodyNotFound
+	}
+	return b.store.Delete(ref)
+}
+
+// Close stops deleting expired bodies. The bodies left are removed along
+// with the store.
+func (b *Bodies) Close() {
+	b.once.Do(func() { close(b.stop) })
+}
+
+func (b *Bodies) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case now := <-ticker.C:
+			b.expire(now)
+		}
+	}
+}
+
+// expire deletes the bodies expired at now
+func (b *Bodies) expire(now time.Time) {
+	var expired []string
+
+	b.mu.Lock()
+	for ref, stored := range b.bodies {
+		if now.After(stored.ExpiresAt) {
+			expired = append(expired, ref)
+			delete(b.bodies, ref)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, ref := range expired {
+		if err := b.store.Delete(ref); err != nil {
+			common.LogWarn("Failed to delete expired body %s: %v", ref, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package bodystore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for unknown or uncommitted bodies
+var ErrNotFound = errors.New("body not found")
+
+// Entry describes a stored body
+type Entry struct {
+	Ref         string
+	Size        int64
+	ContentType string
+	CreatedAt   time.Time
+}
+
+// Store keeps response bodies on disk so that large bodies are served
+// without being held in memory. A body is written to the file returned by
+// Create and becomes readable once committed.
+type Store struct {
+	dir string
+	// temporary is set when the directory was created by the store, which
+	// removes it on Close
+	temporary bool
+
+	entries map[string]Entry
+	mu      sync.Mutex
+}
+
+// New opens a store in dir, or in a new temporary directory when empty
+func New(dir string) (*Store, error) {
+	store := &Store{
+		dir:     dir,
+		entries: make(map[string]Entry),
+	}
+
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "azuretls-bodies-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create body store directory: %w", err)
+		}
+		store.dir = tmp
+		store.temporary = true
+	} else if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create body store directory: %w", err)
+	}
+
+	return store, nil
+}
+
+// Dir returns the directory holding the bodies
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Create returns the reference and the file of a new body
+func (s *Store) Create() (string, *os.File, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", nil, fmt.Errorf("failed to generate body reference: %w", err)
+	}
+	ref := hex.EncodeToString(bytes)
+
+	file, err := os.OpenFile(s.path(ref), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create body file: %w", err)
+	}
+
+	return ref, file, nil
+}
+
+// Commit makes a body created with Create readable. Its file must be
+// closed beforehand.
+func (s *Store) Commit(ref, contentType string) (Entry, error) {
+	info, err := os.Stat(s.path(ref))
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to commit body: %w", err)
+	}
+
+	entry := Entry{
+		Ref:         ref,
+		Size:        info.Size(),
+		ContentType: contentType,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	s.entries[ref] = entry
+	s.mu.Unlock()
+
+	return entry, nil
+}
+
+// Open returns a committed body, which the caller must close
+func (s *Store) Open(ref string) (*os.File, Entry, error) {
+	s.mu.Lock()
+	entry, exists := s.entries[ref]
+	s.mu.Unlock()
+
+	// Committed references are valid by construction
+	if !exists {
+		return nil, Entry{}, ErrNotFound
+	}
+
+	file, err := os.Open(s.path(ref))
+	if err != nil {
+		return nil, Entry{}, fmt.Errorf("failed to open body: %w", err)
+	}
+
+	return file, entry, nil
+}
+
+// Check writes and removes a probe body, verifying that bodies can be
+// stored
+func (s *Store) Check() error {
+	ref, file, err := s.Create()
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write([]byte("probe"))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if deleteErr := s.Delete(ref); err == nil {
+		err = deleteErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write probe body: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a body, committed or not
+func (s *Store) Delete(ref string) error {
+	if !isRef(ref) {
+		return ErrNotFound
+	}
+
+	s.mu.Lock()
+	delete(s.entries, ref)
+	s.mu.Unlock()
+
+	if err := os.Remove(s.path(ref)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete body: %w", err)
+	}
+	return nil
+}
+
+// Close forgets every body, removing the directory when it is temporary
+func (s *Store) Close() error {
+	s.mu.Lock()
+	s.entries = make(map[string]Entry)
+	s.mu.Unlock()
+
+	if s.temporary {
+		return os.RemoveAll(s.dir)
+	}
+	return nil
+}
+
+func (s *Store) path(ref string) string {
+	return filepath.Join(s.dir, ref)
+}
+
+// isRef reports whether a reference, which may come from clients, has the
+// shape of the generated ones and cannot escape the directory
+func isRef(ref string) bool {
+	_, err := hex.DecodeString(ref)
+	return len(ref) == 32 && err == nil
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+)
+
+// DecodeText transcodes a text body to UTF-8 according to the charset of
+// its Content-Type header or, for HTML without one, its BOM or meta tag.
+// It returns the original charset when the body was transcoded, and an
+// empty string when it is already UTF-8 or the charset is unknown.
+func DecodeText(header http.Header, body []byte) ([]byte, string) {
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+
+	var enc encoding.Encoding
+	var name string
+	switch {
+	case params["charset"] != "":
+		// The declared label is reported rather than the encoding WHATWG
+		// maps it to, e.g. windows-1252 for iso-8859-1
+		enc, name = charset.Lookup(params["charset"])
+		if name != "utf-8" {
+			name = strings.ToLower(strings.TrimSpace(params["charset"]))
+		}
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		// Honors a BOM or <meta> declaration, and falls back to windows-1252
+		// for invalid UTF-8 without one, as browsers do. The detection only
+		// looks at the first KB, so the whole body is checked before
+		// falling back.
+		enc, name, _ = charset.DetermineEncoding(body, mediaType)
+		if name == "windows-1252" && utf8.Valid(body) {
+			enc = nil
+		}
+	}
+
+	if enc == nil || name == "utf-8" {
+		return body, ""
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		LogWarn("Failed to transcode %s body to UTF-8: %v", name, err)
+		return body, ""
+	}
+
+	return decoded, name
+}
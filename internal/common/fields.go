@@ -0,0 +1,186 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// responseFields maps the selectable fields to the JSON keys they include
+var responseFields = map[string][]string{
+	"status_code":   {"status_code"},
+	"status":        {"status"},
+	"headers":       {"headers"},
+	"trailers":      {"trailers"},
+	"body":          {"body", "body_b64", "body_ref"},
+	"body_b64":      {"body_b64"},
+	"cookies":       {"cookies"},
+	"url":           {"url"},
+	"protocol":      {"protocol"},
+	"charset":       {"charset"},
+	"fault":         {"fault"},
+	"applied_rules": {"applied_rules"},
+	"rate_limit":    {"rate_limit"},
+}
+
+// FieldSelection narrows a response to the fields a client asked for, the
+// id, error, dry run, extracted values, download status, trace, curl
+// command, session rotation and coalescing being always included. A nil selection
+// includes every field.
+type FieldSelection struct {
+	keys    map[string]bool
+	headers []string
+}
+
+// ParseFields parses a list of response fields such as "status_code",
+// "body" or "headers.set-cookie". It returns nil for an empty list.
+func ParseFields(fields []string) (*FieldSelection, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	selection := &FieldSelection{keys: make(map[string]bool)}
+
+	for _, field := range fields {
+		if name, found := strings.CutPrefix(field, "headers."); found && name != "" {
+			selection.headers = append(selection.headers, name)
+			continue
+		}
+
+		keys, exists := responseFields[field]
+		if !exists {
+			return nil, fmt.Errorf("unknown response field %q", field)
+		}
+		for _, key := range keys {
+			selection.keys[key] = true
+		}
+	}
+
+	return selection, nil
+}
+
+// Includes reports whether a response field is selected
+func (s *FieldSelection) Includes(field string) bool {
+	if s == nil {
+		return true
+	}
+
+	if field == "headers" && len(s.headers) > 0 {
+		return true
+	}
+
+	for _, key := range responseFields[field] {
+		if s.keys[key] {
+			return true
+		}
+	}
+	return s.keys[field]
+}
+
+// filterHeaders keeps the selected headers, matched case-insensitively
+func (s *FieldSelection) filterHeaders(headers map[string][]string) map[string][]string {
+	if s.keys["headers"] {
+		return headers
+	}
+
+	filtered := make(map[string][]string)
+	for key, values := range headers {
+		for _, name := range s.headers {
+			if strings.EqualFold(key, name) {
+				filtered[key] = values
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+type serverResponseAlias ServerResponse
+
+// MarshalJSON encodes only the selected fields when the response has a
+// field selection. Fields tagged omitempty stay omitted when empty.
+func (r ServerResponse) MarshalJSON() ([]byte, error) {
+	if r.OmitHeaders {
+		r.Headers, r.Cookies = nil, nil
+	}
+
+	if r.Selection == nil {
+		return json.Marshal(serverResponseAlias(r))
+	}
+
+	keys := r.Selection.keys
+	selected := map[string]any{"id": r.ID}
+
+	if r.Error != "" {
+		selected["error"] = r.Error
+	}
+	if r.DryRun != nil {
+		selected["dry_run"] = r.DryRun
+	}
+	if len(r.Extracted) > 0 {
+		selected["extracted"] = r.Extracted
+	}
+	if len(r.ExtractErrors) > 0 {
+		selected["extract_errors"] = r.ExtractErrors
+	}
+	if r.Download != nil {
+		selected["download"] = r.Download
+	}
+	if r.Trace != nil {
+		selected["trace"] = r.Trace
+	}
+	if r.Curl != "" {
+		selected["curl"] = r.Curl
+	}
+	if r.Rotation != nil {
+		selected["rotation"] = r.Rotation
+	}
+	if r.Coalesced {
+		selected["coalesced"] = true
+	}
+	if keys["status_code"] {
+		selected["status_code"] = r.StatusCode
+	}
+	if keys["status"] {
+		selected["status"] = r.Status
+	}
+	if keys["headers"] || len(r.Selection.headers) > 0 {
+		selected["headers"] = r.Selection.filterHeaders(r.Headers)
+	}
+	if keys["trailers"] && len(r.Trailers) > 0 {
+		selected["trailers"] = r.Trailers
+	}
+	if keys["body"] {
+		selected["body"] = r.Body
+	}
+	if keys["body_b64"] {
+		selected["body_b64"] = r.BodyB64
+	}
+	if keys["body_ref"] && r.BodyRef != "" {
+		selected["body_ref"] = r.BodyRef
+		selected["body_size"] = r.BodySize
+	}
+	if keys["cookies"] && len(r.Cookies) > 0 {
+		selected["cookies"] = r.Cookies
+	}
+	if keys["url"] {
+		selected["url"] = r.URL
+	}
+	if keys["protocol"] && r.Protocol != "" {
+		selected["protocol"] = r.Protocol
+	}
+	if keys["charset"] && r.Charset != "" {
+		selected["charset"] = r.Charset
+	}
+	if keys["fault"] && r.Fault != "" {
+		selected["fault"] = r.Fault
+	}
+	if keys["applied_rules"] && len(r.AppliedRules) > 0 {
+		selected["applied_rules"] = r.AppliedRules
+	}
+	if keys["rate_limit"] && r.RateLimit != nil {
+		selected["rate_limit"] = r.RateLimit
+	}
+
+	return json.Marshal(selected)
+}
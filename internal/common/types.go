@@ -1,6 +1,13 @@
 package common
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
 	"time"
 
 	"github.com/Noooste/azuretls-api/internal/utils"
@@ -16,32 +23,317 @@ type ServerRequest struct {
 	Body           string           `json:"body,omitempty"`
 	BodyB64        []byte           `json:"body_b64,omitempty"`
 	Options        RequestOptions   `json:"options,omitempty"`
+
+	// Trailers are sent after the body, chunked over HTTP/1.1
+	Trailers map[string][]string `json:"trailers,omitempty"`
+
+	// BodyStream is streamed as the request body when set, instead of Body
+	BodyStream io.Reader `json:"-"`
+
+	// OnProgress is called as downloads progress
+	OnProgress func(DownloadStatus) `json:"-"`
 }
 
 type RequestOptions struct {
-	TimeoutMs          int    `json:"timeout_ms,omitempty"`
-	FollowRedirects    bool   `json:"follow_redirects,omitempty"`
-	DisableRedirects   bool   `json:"disable_redirects,omitempty"`
-	MaxRedirects       uint   `json:"max_redirects,omitempty"`
-	Proxy              string `json:"proxy,omitempty"`
-	NoCookie           bool   `json:"no_cookie,omitempty"`
-	Browser            string `json:"browser,omitempty"`
-	ForceHTTP1         bool   `json:"force_http1,omitempty"`
-	ForceHTTP3         bool   `json:"force_http3,omitempty"`
-	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
-	IgnoreBody         bool   `json:"ignore_body,omitempty"`
+	TimeoutMs          int             `json:"timeout_ms,omitempty"`
+	FollowRedirects    bool            `json:"follow_redirects,omitempty"`
+	DisableRedirects   bool            `json:"disable_redirects,omitempty"`
+	MaxRedirects       uint            `json:"max_redirects,omitempty"`
+	Proxy              string          `json:"proxy,omitempty"`
+	NoCookie           bool            `json:"no_cookie,omitempty"`
+	Browser            string          `json:"browser,omitempty"`
+	ForceHTTP1         bool            `json:"force_http1,omitempty"`
+	ForceHTTP3         bool            `json:"force_http3,omitempty"`
+	InsecureSkipVerify bool            `json:"insecure_skip_verify,omitempty"`
+	IgnoreBody         bool            `json:"ignore_body,omitempty"`
+	DryRun             bool            `json:"dry_run,omitempty"`
+	Fields             []string        `json:"fields,omitempty"`
+	Extract            *ExtractOptions `json:"extract,omitempty"`
+	// AcceptEncoding replaces the advertised content encodings, in order
+	AcceptEncoding []string         `json:"accept_encoding,omitempty"`
+	Download       *DownloadOptions `json:"download,omitempty"`
+	// Trace records the timings of every request of the redirect chain
+	Trace bool `json:"trace,omitempty"`
+	// Curl renders the request as sent as a curl command
+	Curl bool `json:"curl,omitempty"`
+	// Priority orders the requests waiting for the request scheduler: high,
+	// normal (the default) or low
+	Priority string `json:"priority,omitempty"`
+	// BodyRef stores the response body for GET /api/v1/bodies/{ref}
+	// instead of returning it in the response
+	BodyRef bool `json:"body_ref,omitempty"`
+	// HeaderMerge combines the ordered headers of the request with those of
+	// the session: replace (the default), prepend or append
+	HeaderMerge string `json:"header_merge,omitempty"`
+	// ALPN replaces the protocols offered in the ClientHello, sending the
+	// request over a new connection
+	ALPN []string `json:"alpn,omitempty"`
+	// Coalesce shares the response of an identical GET already in flight
+	// on the same session, or stateless configuration, instead of sending
+	// it again
+	Coalesce bool `json:"coalesce,omitempty"`
+	// Sign signs the request just before it is sent, once rules and
+	// scripts ran
+	Sign *SignOptions `json:"sign,omitempty"`
+	// IncludeHeaders returns the headers and cookies of text responses,
+	// which only binary responses carry otherwise
+	IncludeHeaders bool `json:"include_headers,omitempty"`
+}
+
+// SignOptions signs a request with AWS Signature Version 4 or with an HMAC
+// recipe, exactly one of them being set
+type SignOptions struct {
+	AWS  *AWSSigV4Options `json:"aws,omitempty"`
+	HMAC *HMACSignOptions `json:"hmac,omitempty"`
+}
+
+// AWSSigV4Options holds the credentials and scope of an AWS SigV4
+// signature. UnsignedPayload leaves the body out of the signature, as
+// streamed bodies always are.
+type AWSSigV4Options struct {
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token,omitempty"`
+	Region          string `json:"region"`
+	Service         string `json:"service"`
+	UnsignedPayload bool   `json:"unsigned_payload,omitempty"`
+}
+
+// HMACSignOptions computes the HMAC of StringToSign, a template of
+// {placeholders}, with Key, or KeyB64 for binary keys. The signature, hex
+// encoded by default, goes in Header, rendered through HeaderValue, or in
+// the Query parameter. Headers are set, rendered, before the string to
+// sign is, so that it can refer to them.
+type HMACSignOptions struct {
+	Key          string            `json:"key,omitempty"`
+	KeyB64       []byte            `json:"key_b64,omitempty"`
+	Algorithm    string            `json:"algorithm,omitempty"`
+	StringToSign string            `json:"string_to_sign"`
+	Encoding     string            `json:"encoding,omitempty"`
+	Header       string            `json:"header,omitempty"`
+	HeaderValue  string            `json:"header_value,omitempty"`
+	Query        string            `json:"query,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+}
+
+// Request priorities, the requests waiting for a slot of the request
+// scheduler being served from the most urgent
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// Header merge modes, combining the ordered headers of a request with
+// those of its session for that request only
+const (
+	HeaderMergeReplace = "replace"
+	HeaderMergePrepend = "prepend"
+	HeaderMergeAppend  = "append"
+)
+
+// DownloadOptions turn a request into a download made of ranged requests,
+// resumed where they stopped when interrupted
+type DownloadOptions struct {
+	ChunkSize  int64 `json:"chunk_size,omitempty"`
+	MaxRetries int   `json:"max_retries,omitempty"`
+	// SaveAs is the name of the file saved in the download directory, the
+	// body being returned when empty
+	SaveAs string `json:"save_as,omitempty"`
+}
+
+// DownloadStatus reports the progress of a download
+type DownloadStatus struct {
+	Downloaded int64 `json:"downloaded"`
+	// Total is -1 while the size is unknown
+	Total    int64  `json:"total"`
+	Chunks   int    `json:"chunks"`
+	Retries  int    `json:"retries"`
+	Ranged   bool   `json:"ranged"`
+	ETag     string `json:"etag,omitempty"`
+	Path     string `json:"path,omitempty"`
+	Complete bool   `json:"complete"`
+}
+
+// RequestTrace holds the timings of a request and its redirects, in
+// milliseconds
+type RequestTrace struct {
+	Hops  []TraceHop `json:"hops"`
+	Total float64    `json:"total_ms"`
+}
+
+// TraceHop holds the timings of one request of a redirect chain, in
+// milliseconds. Phases that did not happen, e.g. the DNS lookup and the
+// connection on a reused connection, are 0.
+type TraceHop struct {
+	Method     string `json:"method"`
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Protocol   string `json:"protocol,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Reused     bool   `json:"reused_connection"`
+	// Start is relative to the start of the first request
+	Start   float64 `json:"start_ms"`
+	DNS     float64 `json:"dns_ms"`
+	Connect float64 `json:"connect_ms"`
+	TLS     float64 `json:"tls_ms"`
+	// TTFB is the time waited for the response once the request is sent
+	TTFB     float64 `json:"ttfb_ms"`
+	Download float64 `json:"content_download_ms"`
+	Total    float64 `json:"total_ms"`
+}
+
+// Download states
+const (
+	DownloadRunning   = "running"
+	DownloadPaused    = "paused"
+	DownloadCompleted = "completed"
+	DownloadFailed    = "failed"
+)
+
+// DownloadJob describes a download run in the background by the download
+// manager
+type DownloadJob struct {
+	ID        string         `json:"id"`
+	SessionID string         `json:"session_id"`
+	URL       string         `json:"url"`
+	State     string         `json:"state"`
+	Progress  DownloadStatus `json:"progress"`
+	// StatusCode is set when the server answered with something else than
+	// the resource, e.g. a 404
+	StatusCode  int    `json:"status_code,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// ScriptData and ScriptErrors are reported by the on_response hooks
+	// once the download completes
+	ScriptData   map[string]any    `json:"script_data,omitempty"`
+	ScriptErrors map[string]string `json:"script_errors,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+// ExtractOptions names values to extract server-side from the response body
+type ExtractOptions struct {
+	JSONPath map[string]string `json:"jsonpath,omitempty"`
+	Regex    map[string]string `json:"regex,omitempty"`
+	CSS      map[string]string `json:"css,omitempty"`
+	DropBody bool              `json:"drop_body,omitempty"`
+	// All returns every regex and CSS match instead of the first one
+	All bool `json:"all,omitempty"`
 }
 
 type ServerResponse struct {
-	ID         string              `json:"id"`
-	StatusCode int                 `json:"status_code"`
-	Status     string              `json:"status"`
-	Headers    map[string][]string `json:"headers"`
-	Body       string              `json:"body"`
-	BodyB64    string              `json:"body_b64"`
-	Cookies    []Cookie            `json:"cookies,omitempty"`
-	Error      string              `json:"error,omitempty"`
-	URL        string              `json:"url"`
+	ID           string              `json:"id"`
+	StatusCode   int                 `json:"status_code"`
+	Status       string              `json:"status"`
+	Headers      map[string][]string `json:"headers"`
+	Trailers     map[string][]string `json:"trailers,omitempty"`
+	Body         string              `json:"body"`
+	BodyB64      string              `json:"body_b64"`
+	BodyRef      string              `json:"body_ref,omitempty"`
+	BodySize     int64               `json:"body_size,omitempty"`
+	Cookies      []Cookie            `json:"cookies,omitempty"`
+	Error        string              `json:"error,omitempty"`
+	URL          string              `json:"url"`
+	Protocol     string              `json:"protocol,omitempty"`
+	Charset      string              `json:"charset,omitempty"`
+	Fault        string              `json:"fault,omitempty"`
+	DryRun       *DryRunResult       `json:"dry_run,omitempty"`
+	AppliedRules []string            `json:"applied_rules,omitempty"`
+
+	Extracted     map[string]any    `json:"extracted,omitempty"`
+	ExtractErrors map[string]string `json:"extract_errors,omitempty"`
+	ScriptData    map[string]any    `json:"script_data,omitempty"`
+	ScriptErrors  map[string]string `json:"script_errors,omitempty"`
+	Download      *DownloadStatus   `json:"download,omitempty"`
+	Trace         *RequestTrace     `json:"trace,omitempty"`
+	Curl          string            `json:"curl,omitempty"`
+	RateLimit     *RateLimit        `json:"rate_limit,omitempty"`
+	Rotation      *SessionRotation  `json:"rotation,omitempty"`
+	// Coalesced tells the response is the one of an identical request in
+	// flight
+	Coalesced bool `json:"coalesced,omitempty"`
+
+	// Selection narrows the encoded fields to the ones requested
+	Selection *FieldSelection `json:"-"`
+	// OmitHeaders leaves the headers and cookies out of the encoded
+	// response, as for text responses without include_headers
+	OmitHeaders bool `json:"-"`
+}
+
+// DryRunResult describes a request exactly as it would be sent, without contacting the target
+type DryRunResult struct {
+	Method            string              `json:"method"`
+	URL               string              `json:"url"`
+	Headers           [][]string          `json:"headers"`
+	PseudoHeaderOrder []string            `json:"pseudo_header_order,omitempty"`
+	Body              string              `json:"body,omitempty"`
+	BodyB64           string              `json:"body_b64,omitempty"`
+	Proxy             string              `json:"proxy,omitempty"`
+	ClientHello       *ClientHelloSummary `json:"client_hello,omitempty"`
+}
+
+// RateLimit holds the rate limit signals of a response, normalized from its
+// Retry-After, RateLimit-* and X-RateLimit-* headers. SuggestedDelayMs is
+// the delay to wait before the next request to the same target: the
+// Retry-After delay, the time until the window resets once no request is
+// left, or the remaining window spread over the remaining requests.
+type RateLimit struct {
+	Limited          bool       `json:"limited"`
+	Limit            *int       `json:"limit,omitempty"`
+	Remaining        *int       `json:"remaining,omitempty"`
+	ResetAt          *time.Time `json:"reset_at,omitempty"`
+	SuggestedDelayMs int64      `json:"suggested_delay_ms"`
+}
+
+// SentRequest is a request as a session sent it, headers in wire order.
+// Streamed bodies and bodies over the history limit are not kept.
+type SentRequest struct {
+	Time               time.Time  `json:"time"`
+	Method             string     `json:"method"`
+	URL                string     `json:"url"`
+	Headers            [][]string `json:"headers"`
+	Body               string     `json:"body,omitempty"`
+	BodyB64            string     `json:"body_b64,omitempty"`
+	BodyOmitted        bool       `json:"body_omitted,omitempty"`
+	Proxy              string     `json:"proxy,omitempty"`
+	ForceHTTP1         bool       `json:"force_http1,omitempty"`
+	ForceHTTP3         bool       `json:"force_http3,omitempty"`
+	InsecureSkipVerify bool       `json:"insecure_skip_verify,omitempty"`
+	StatusCode         int        `json:"status_code,omitempty"`
+	Error              string     `json:"error,omitempty"`
+}
+
+type ClientHelloSummary struct {
+	ServerName        string   `json:"server_name,omitempty"`
+	SupportedVersions []string `json:"supported_versions,omitempty"`
+	CipherSuites      []string `json:"cipher_suites"`
+	Extensions        []uint16 `json:"extensions"`
+	SupportedGroups   []uint16 `json:"supported_groups,omitempty"`
+	ALPN              []string `json:"alpn,omitempty"`
+	JA3               string   `json:"ja3"`
+	JA3Hash           string   `json:"ja3_hash"`
+	JA4               string   `json:"ja4"`
+}
+
+// FingerprintCapture is a capture of a real browser to derive a fingerprint
+// from: a HAR file for the headers, the hex-encoded ClientHello for the TLS
+// fingerprint and the hex-encoded client HTTP/2 frames for the HTTP/2 one.
+// URL picks the HAR entry, the first one by default.
+type FingerprintCapture struct {
+	HAR         json.RawMessage `json:"har,omitempty"`
+	URL         string          `json:"url,omitempty"`
+	ClientHello string          `json:"client_hello,omitempty"`
+	HTTP2Frames string          `json:"http2_frames,omitempty"`
+}
+
+// DerivedFingerprint is the fingerprint of a capture. Profile holds what
+// reproduces it, to save as profile file or send to the session endpoints.
+type DerivedFingerprint struct {
+	Profile           Profile             `json:"profile"`
+	ClientHello       *ClientHelloSummary `json:"client_hello,omitempty"`
+	AkamaiHash        string              `json:"akamai_hash,omitempty"`
+	PseudoHeaderOrder []string            `json:"pseudo_header_order,omitempty"`
 }
 
 type Cookie struct {
@@ -56,16 +348,180 @@ type Cookie struct {
 }
 
 type ServerConfig struct {
-	Host                  string        `json:"host"`
-	Port                  int           `json:"port"`
-	MaxSessions           int           `json:"max_sessions"`
-	MaxConcurrentRequests int           `json:"max_concurrent_requests"`
-	ReadTimeout           time.Duration `json:"read_timeout"`
-	WriteTimeout          time.Duration `json:"write_timeout"`
-	LogLevel              string        `json:"log_level"`
+	Host                        string               `json:"host"`
+	Port                        int                  `json:"port"`
+	MaxSessions                 int                  `json:"max_sessions"`
+	MaxConcurrentRequests       int                  `json:"max_concurrent_requests"`
+	MaxConcurrentRequestsPerKey int                  `json:"max_concurrent_requests_per_key,omitempty"`
+	ReadTimeout                 time.Duration        `json:"read_timeout"`
+	WriteTimeout                time.Duration        `json:"write_timeout"`
+	IdleTimeout                 time.Duration        `json:"idle_timeout,omitempty"`
+	ReadHeaderTimeout           time.Duration        `json:"read_header_timeout,omitempty"`
+	WSMaxMessageSize            int64                `json:"ws_max_message_size,omitempty"`
+	WSDrainTimeout              time.Duration        `json:"ws_drain_timeout,omitempty"`
+	WSPersistTTL                time.Duration        `json:"ws_persist_ttl,omitempty"`
+	WSReconnectTo               string               `json:"ws_reconnect_to,omitempty"`
+	MaxOutgoingRequests         int                  `json:"max_outgoing_requests,omitempty"`
+	QueueTimeout                time.Duration        `json:"queue_timeout,omitempty"`
+	LogLevel                    string               `json:"log_level"`
+	HealthCheckURL              string               `json:"health_check_url,omitempty"`
+	HealthCheckTimeout          time.Duration        `json:"health_check_timeout,omitempty"`
+	IPEchoURL                   string               `json:"ip_echo_url,omitempty"`
+	IPCacheTTL                  time.Duration        `json:"ip_cache_ttl,omitempty"`
+	GeoIPDatabase               string               `json:"geoip_database,omitempty"`
+	DisableDNSCache             bool                 `json:"disable_dns_cache,omitempty"`
+	DoTAddress                  string               `json:"dot_address,omitempty"`
+	DoTServerName               string               `json:"dot_server_name,omitempty"`
+	MaxBandwidth                int64                `json:"max_bandwidth,omitempty"`
+	FaultInjection              FaultInjectionConfig `json:"fault_injection,omitempty"`
+	SessionPool                 SessionPoolConfig    `json:"session_pool,omitempty"`
+	ProfilesDir                 string               `json:"profiles_dir,omitempty"`
+	APIKeys                     []APIKeyConfig       `json:"api_keys,omitempty"`
+	AdminKey                    string               `json:"-"`
+	Rules                       []Rule               `json:"rules,omitempty"`
+	DownloadDir                 string               `json:"download_dir,omitempty"`
+	BodyStoreDir                string               `json:"body_store_dir,omitempty"`
+	BodyRefTTL                  time.Duration        `json:"body_ref_ttl,omitempty"`
+	DownloadTTL                 time.Duration        `json:"download_ttl,omitempty"`
+	Dashboard                   bool                 `json:"dashboard,omitempty"`
+	Probes                      []Probe              `json:"probes,omitempty"`
+	PluginsDir                  string               `json:"plugins_dir,omitempty"`
+	ScriptsDir                  string               `json:"scripts_dir,omitempty"`
+	ScriptLimits                ScriptLimits         `json:"script_limits,omitempty"`
+	Middlewares                 []MiddlewareConfig   `json:"-"`
+}
+
+// Middleware wraps the HTTP handler of the API
+type Middleware func(http.Handler) http.Handler
+
+// MiddlewareStage places an extra middleware in the chain of the API
+type MiddlewareStage int
+
+const (
+	// BeforeAuth middlewares run before API key authentication. Auth
+	// adapters run there, setting the X-API-Key header of the requests
+	// they accept.
+	BeforeAuth MiddlewareStage = iota
+	// AfterAuth middlewares run once the API key of the request is known,
+	// before the concurrency limit applies
+	AfterAuth
+)
+
+// MiddlewareConfig is an extra middleware added to the chain of the API,
+// after the request ID, recovery and logging middlewares
+type MiddlewareConfig struct {
+	Name       string
+	Stage      MiddlewareStage
+	Middleware Middleware
+}
+
+// Rule transforms the outgoing requests matching all of its conditions.
+// Rules apply in order, so a later rule sees the changes of earlier ones.
+type Rule struct {
+	Name          string            `json:"name,omitempty"`
+	Match         RuleMatch         `json:"match"`
+	RewriteURL    *URLRewrite       `json:"rewrite_url,omitempty"`
+	SetHeaders    map[string]string `json:"set_headers,omitempty"`
+	AddHeaders    map[string]string `json:"add_headers,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty"`
+	Options       *RequestOptions   `json:"options,omitempty"`
+	Scripts       []string          `json:"scripts,omitempty"`
+}
+
+// RuleMatch holds the conditions of a rule. Empty conditions match any
+// request. Host is a glob pattern such as "*.example.com".
+type RuleMatch struct {
+	Host       string `json:"host,omitempty"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	Method     string `json:"method,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+}
+
+// URLRewrite replaces the matches of a regular expression in the request URL
+type URLRewrite struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// APIKeyConfig attaches default session settings to an API key. Sessions
+// created with the key inherit Defaults and get a proxy from Proxies,
+// round-robin, when they set none. With Enforce, the defaults override the
+// settings sent by clients instead.
+type APIKeyConfig struct {
+	Key      string        `json:"key"`
+	Name     string        `json:"name,omitempty"`
+	Defaults SessionConfig `json:"defaults,omitempty"`
+	Proxies  []string      `json:"proxies,omitempty"`
+	Enforce  bool          `json:"enforce,omitempty"`
+	// Admin grants access to the admin endpoints and the dashboard
+	Admin bool `json:"admin,omitempty"`
+	// MaxConcurrentRequests bounds the requests of the key processed at the
+	// same time, overriding MaxConcurrentRequestsPerKey
+	MaxConcurrentRequests int `json:"max_concurrent_requests,omitempty"`
+}
+
+// FaultInjectionConfig configures the test-only fault injection mode.
+// Percentages are expressed between 0 and 100.
+type FaultInjectionConfig struct {
+	LatencyPercent   float64       `json:"latency_percent,omitempty"`
+	Latency          time.Duration `json:"latency,omitempty"`
+	LatencyJitter    time.Duration `json:"latency_jitter,omitempty"`
+	ErrorPercent     float64       `json:"error_percent,omitempty"`
+	ErrorStatusCodes []int         `json:"error_status_codes,omitempty"`
+	ResetPercent     float64       `json:"reset_percent,omitempty"`
+}
+
+func (c FaultInjectionConfig) Enabled() bool {
+	return c.LatencyPercent > 0 || c.ErrorPercent > 0 || c.ResetPercent > 0
+}
+
+// SessionPoolConfig configures the sessions created at startup and handed
+// out by the session pool. Profiles and proxies are assigned to pooled
+// sessions round-robin, a proxy overriding the one of its profile.
+type SessionPoolConfig struct {
+	Size     int             `json:"size,omitempty"`
+	Profiles []SessionConfig `json:"profiles,omitempty"`
+	Proxies  []string        `json:"proxies,omitempty"`
+}
+
+type PoolStats struct {
+	Size  int `json:"size"`
+	Idle  int `json:"idle"`
+	InUse int `json:"in_use"`
+}
+
+type IPInfo struct {
+	IP           string `json:"ip"`
+	Country      string `json:"country,omitempty"`
+	City         string `json:"city,omitempty"`
+	ASN          uint   `json:"asn,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	Cached       bool   `json:"cached,omitempty"`
+}
+
+type DNSCacheEntry struct {
+	Host       string    `json:"host"`
+	Addresses  []string  `json:"addresses"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	TTLSeconds int       `json:"ttl_seconds"`
+}
+
+// SessionConnection describes a connection a session holds open, idle
+// ones waiting to be reused by the next requests to their host
+type SessionConnection struct {
+	Host       string    `json:"host"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Protocol   string    `json:"protocol,omitempty"`
+	OpenedAt   time.Time `json:"opened_at"`
+	AgeMs      int64     `json:"age_ms"`
+	Requests   int       `json:"requests"`
+	Reused     int       `json:"reused"`
+	Idle       bool      `json:"idle"`
+	IdleMs     int64     `json:"idle_ms,omitempty"`
 }
 
 type SessionConfig struct {
+	Profile            string            `json:"profile,omitempty"`
 	Browser            string            `json:"browser,omitempty"`
 	UserAgent          string            `json:"user_agent,omitempty"`
 	Proxy              string            `json:"proxy,omitempty"`
@@ -74,8 +530,158 @@ type SessionConfig struct {
 	InsecureSkipVerify bool              `json:"insecure_skip_verify,omitempty"`
 	OrderedHeaders     [][]string        `json:"ordered_headers,omitempty"`
 	Headers            map[string]string `json:"headers,omitempty"`
+	Tags               []string          `json:"tags,omitempty"`
+	QUIC               *QUICConfig       `json:"quic,omitempty"`
+	// TLSResumption caches TLS session tickets to resume later connections
+	TLSResumption bool `json:"tls_resumption,omitempty"`
+	// History keeps the last requests of the session, credentials
+	// redacted, for the history endpoints
+	History bool `json:"history,omitempty"`
+	// Rotation replaces the session with a fresh one when due
+	Rotation *RotationPolicy `json:"rotation,omitempty"`
+	// CookieJar binds the session to a shared cookie jar created with
+	// POST /api/v1/cookiejars
+	CookieJar string `json:"cookie_jar,omitempty"`
+	// Scripts run on every request of the session, before the scripts of
+	// the matching rules
+	Scripts []string `json:"scripts,omitempty"`
+	// DoT resolves the names of the session over TLS instead of the
+	// server-wide resolver
+	DoT *DoTConfig `json:"dot,omitempty"`
+	// Dial controls how direct connections pick between IPv4 and IPv6
+	Dial *DialConfig `json:"dial,omitempty"`
+	// ProxyAuth authenticates to the HTTP proxy of the session with a
+	// challenge handshake, for proxies not offering Basic authentication
+	ProxyAuth *ProxyAuthConfig `json:"proxy_auth,omitempty"`
+	// Bandwidth limits the traffic of the session on the wire
+	Bandwidth *BandwidthConfig `json:"bandwidth,omitempty"`
+	// MaxConnectionAge closes the connections of the session past an age,
+	// the next requests opening new ones
+	MaxConnectionAge *ConnectionAgeConfig `json:"max_connection_age,omitempty"`
+}
+
+// ConnectionAgeConfig retires connections once Seconds old, as soon as no
+// request uses them. RenewTicket drops the TLS session ticket of the server
+// with them, so that the next handshake is a full one issuing a new ticket.
+type ConnectionAgeConfig struct {
+	Seconds     int  `json:"seconds"`
+	RenewTicket bool `json:"renew_ticket,omitempty"`
+}
+
+// BandwidthConfig caps the bytes a session sends and receives per second,
+// TLS and proxy overhead included. Zero means no limit.
+type BandwidthConfig struct {
+	UploadBytesPerSec   int64 `json:"upload_bytes_per_sec,omitempty"`
+	DownloadBytesPerSec int64 `json:"download_bytes_per_sec,omitempty"`
 }
 
+// Proxy authentication schemes of ProxyAuthConfig.Scheme
+const (
+	ProxyAuthNTLM      = "ntlm"
+	ProxyAuthNegotiate = "negotiate"
+)
+
+// ProxyAuthConfig holds the credentials of a proxy authenticating with
+// NTLM, or with Negotiate carrying NTLM tokens or, when Realm is set,
+// Kerberos tickets. Username may be given as DOMAIN\user, Domain then
+// being ignored. KDC defaults to the SRV records of the realm and SPN to
+// HTTP/<proxy host>.
+type ProxyAuthConfig struct {
+	Scheme      string `json:"scheme"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	Domain      string `json:"domain,omitempty"`
+	Workstation string `json:"workstation,omitempty"`
+	Realm       string `json:"realm,omitempty"`
+	KDC         string `json:"kdc,omitempty"`
+	SPN         string `json:"spn,omitempty"`
+}
+
+// Address families of DialConfig.PreferFamily
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// DialConfig controls dual-stack dialing (Happy Eyeballs, RFC 8305). The
+// addresses of the preferred family, by default the family of the first
+// resolved address, are dialed first, those of the other family being
+// raced after FallbackDelayMs (300 ms by default), or only tried once the
+// preferred ones failed when DisableFallback is set.
+type DialConfig struct {
+	FallbackDelayMs int    `json:"fallback_delay_ms,omitempty"`
+	DisableFallback bool   `json:"disable_fallback,omitempty"`
+	PreferFamily    string `json:"prefer_family,omitempty"`
+}
+
+// DoTConfig is a DNS over TLS resolver. Address is host[:port], port 853
+// by default, and ServerName the name its certificate is verified against,
+// the address host by default.
+type DoTConfig struct {
+	Address    string `json:"address"`
+	ServerName string `json:"server_name,omitempty"`
+}
+
+// BulkSessionRequest creates one session per proxy, all sharing the rest of
+// the config, typically a profile
+type BulkSessionRequest struct {
+	SessionConfig
+	Proxies []string `json:"proxies"`
+}
+
+// BulkSessionResult maps a proxy to the session created for it, or to the
+// error creating it
+type BulkSessionResult struct {
+	Proxy     string `json:"proxy"`
+	SessionID string `json:"session_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// RotationPolicy discards a session and recreates it, without its cookies
+// and connections, after MaxRequests requests, MaxAgeSeconds seconds or a
+// challenge page. Replacements cycle through the listed browsers, profiles
+// and proxies, keeping the rest of the session config.
+type RotationPolicy struct {
+	MaxRequests   int      `json:"max_requests,omitempty"`
+	MaxAgeSeconds int      `json:"max_age_seconds,omitempty"`
+	OnChallenge   bool     `json:"on_challenge,omitempty"`
+	Browsers      []string `json:"browsers,omitempty"`
+	Profiles      []string `json:"profiles,omitempty"`
+	Proxies       []string `json:"proxies,omitempty"`
+}
+
+const (
+	RotationMaxRequests = "max_requests"
+	RotationMaxAge      = "max_age"
+	RotationChallenge   = "challenge"
+)
+
+// SessionRotation reports that a session was replaced
+type SessionRotation struct {
+	SessionID         string `json:"session_id"`
+	PreviousSessionID string `json:"previous_session_id"`
+	Reason            string `json:"reason"`
+}
+
+// QUICConfig tunes the QUIC transport parameters advertised by the HTTP/3
+// connections of a session. Zero values keep the browser defaults.
+type QUICConfig struct {
+	IdleTimeoutMs         uint64 `json:"idle_timeout_ms,omitempty"`
+	InitialMaxStreamsBidi uint64 `json:"initial_max_streams_bidi,omitempty"`
+	InitialMaxStreamsUni  uint64 `json:"initial_max_streams_uni,omitempty"`
+	// Datagrams advertises (or not) support for QUIC datagrams (RFC 9221)
+	Datagrams *bool `json:"datagrams,omitempty"`
+	// ZeroRTT is rejected: azuretls does not resume QUIC sessions, so 0-RTT
+	// early data is never sent
+	ZeroRTT bool `json:"zero_rtt,omitempty"`
+}
+
+// SessionManager stores the sessions of the server. Embedders may provide
+// their own, adding quotas or custom storage, often by wrapping the default
+// one. Methods are called concurrently. Methods taking the ID of a missing
+// session return an error, GetSession reporting it with false instead.
+// Creating a session fails for an ID in use, and CleanupSessions deletes
+// them all at shutdown.
 type SessionManager interface {
 	CreateSession(sessionID string) (*azuretls.Session, error)
 	CreateSessionWithConfig(sessionID string, config *SessionConfig) (*azuretls.Session, error)
@@ -90,10 +696,553 @@ type SessionManager interface {
 	ClearProxy(sessionID string) error
 	AddPins(sessionID, urlStr string, pins []string) error
 	ClearPins(sessionID, urlStr string) error
-	GetIP(sessionID string) (string, error)
+	GetIP(sessionID string) (*IPInfo, error)
+	GetDNSCache(sessionID string) ([]DNSCacheEntry, error)
+	FlushDNSCache(sessionID string) (int, error)
+	ClearTLSTickets(sessionID string) (int, error)
+	GetConnections(sessionID string) ([]SessionConnection, error)
+	GetSessionTags(sessionID string) ([]string, error)
+	// RecordRequest adds a request to the history of a session
+	RecordRequest(sessionID string, req SentRequest)
+	// GetRequestHistory returns the last requests of a session, newest first
+	GetRequestHistory(sessionID string) ([]SentRequest, error)
+}
+
+// SessionManagerLifecycle is implemented by session managers needing to be
+// set up by the server. Start is called once by the server constructor,
+// before any session is created, with the profile catalog, nil without
+// profiles directory. Stop is called once at shutdown, after
+// CleanupSessions. Wrappers forward both to the manager they wrap.
+type SessionManagerLifecycle interface {
+	Start(config ServerConfig, profiles ProfileCatalog) error
+	Stop() error
+}
+
+// SessionResetter is implemented by session managers able to bring a
+// session back to the config it was created with, dropping its cookies and
+// restoring its proxy and headers. The session pool resets the released
+// sessions with it, and replaces them under managers without it.
+type SessionResetter interface {
+	ResetSession(sessionID string) error
+}
+
+// SessionForker is implemented by session managers keeping the sessions
+// derived from a session, such as the forks offering other ALPN protocols,
+// along with it. Fork returns the fork of a session under key, created the
+// first time and replaced when current reports it out of date, along with
+// the function releasing it once the request is sent. Forks are never
+// changed once made, since concurrent requests send through them, and are
+// closed with the session or dropped when its fingerprint or proxy changes,
+// only once released. Without it, forks are created per request.
+type SessionForker interface {
+	Fork(sessionID, key string, create func() (*azuretls.Session, error), current func(*azuretls.Session) bool) (*azuretls.Session, func(), error)
+}
+
+// DownloadHooks run around the transfer of a managed download
+type DownloadHooks struct {
+	// Acquire is called before each run of the transfer, the function it
+	// returns once the run stops
+	Acquire func(ctx context.Context) (func(), error)
+	// OnComplete is given the assembled response of a completed download,
+	// without body, and returns the errors reported with the job
+	OnComplete func(resp *ScriptResponse) map[string]string
+}
+
+// DownloadManager runs downloads in the background and keeps the finished
+// artifacts in the body store. Downloads belong to the session they were
+// started with.
+type DownloadManager interface {
+	Start(sessionID string, session *azuretls.Session, req *azuretls.Request, options DownloadOptions, hooks DownloadHooks) (DownloadJob, error)
+	Get(sessionID, downloadID string) (DownloadJob, error)
+	List(sessionID string) []DownloadJob
+	Pause(sessionID, downloadID string) (DownloadJob, error)
+	Resume(sessionID, downloadID string) (DownloadJob, error)
+	// Cancel stops a download and deletes its artifact
+	Cancel(sessionID, downloadID string) error
+	// CancelSession cancels every download of a session and returns how
+	// many there were
+	CancelSession(sessionID string) int
+	// Open returns the artifact of a completed download, which the caller
+	// must close
+	Open(sessionID, downloadID string) (*os.File, DownloadJob, error)
+	// Check verifies that new artifacts can be written, for the deep health
+	// check
+	Check() error
+}
+
+// Monitor counts the requests executed by the server and keeps the most
+// recent ones, for the admin endpoints
+type Monitor interface {
+	Record(record RequestRecord)
+	Stats() RequestStats
+	// Recent returns the last requests, newest first
+	Recent() []RequestRecord
+}
+
+// RequestRecord describes a request executed by the server
+type RequestRecord struct {
+	Time       time.Time `json:"time"`
+	SessionID  string    `json:"session_id,omitempty"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Host       string    `json:"host"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Duration   float64   `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// RequestStats counts the requests executed since Since. Errors are the
+// requests that failed or got a server error.
+type RequestStats struct {
+	Since     time.Time   `json:"since"`
+	Requests  uint64      `json:"requests"`
+	Errors    uint64      `json:"errors"`
+	ErrorRate float64     `json:"error_rate"`
+	Hosts     []HostStats `json:"hosts"`
+}
+
+type HostStats struct {
+	Host      string  `json:"host"`
+	Requests  uint64  `json:"requests"`
+	Errors    uint64  `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// AdminStats is the server-wide state reported by the admin stats endpoint
+type AdminStats struct {
+	Timestamp            time.Time       `json:"timestamp"`
+	Sessions             int             `json:"sessions"`
+	WebSocketConnections int             `json:"websocket_connections"`
+	Limiter              LimiterStats    `json:"limiter"`
+	Requests             *RequestStats   `json:"requests,omitempty"`
+	SessionPool          *PoolStats      `json:"session_pool,omitempty"`
+	Scheduler            *SchedulerStats `json:"scheduler,omitempty"`
+}
+
+// SchedulerStats reports the requests sent to targets and the ones waiting
+// for a slot, by priority
+type SchedulerStats struct {
+	InFlight int            `json:"in_flight"`
+	Capacity int            `json:"capacity"`
+	Waiting  map[string]int `json:"waiting"`
+	TimedOut uint64         `json:"timed_out"`
+}
+
+// LimiterStats reports the requests holding a slot of the concurrency
+// limiter, along with the slots of each API key with a limit
+type LimiterStats struct {
+	InFlight int                     `json:"in_flight"`
+	Capacity int                     `json:"capacity"`
+	Keys     map[string]LimiterStats `json:"keys,omitempty"`
+}
+
+// SessionInfo describes an active session for the admin endpoints
+type SessionInfo struct {
+	ID        string   `json:"id"`
+	Browser   string   `json:"browser,omitempty"`
+	UserAgent string   `json:"user_agent,omitempty"`
+	Proxy     string   `json:"proxy,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Pooled    bool     `json:"pooled,omitempty"`
+}
+
+// ConnectionInfo describes an open WebSocket connection
+type ConnectionInfo struct {
+	ID           string    `json:"id"`
+	RemoteAddr   string    `json:"remote_addr"`
+	APIKey       string    `json:"api_key,omitempty"`
+	SessionID    string    `json:"session_id,omitempty"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	LastActivity time.Time `json:"last_activity"`
+	Messages     uint64    `json:"messages"`
+	MessagesSent uint64    `json:"messages_sent"`
+	InFlight     int64     `json:"in_flight"`
+}
+
+// Profile is a named browser fingerprint. Sessions created with a profile
+// inherit its settings, explicit session settings taking precedence.
+type Profile struct {
+	Name           string            `json:"name"`
+	Description    string            `json:"description,omitempty"`
+	Browser        string            `json:"browser,omitempty"`
+	UserAgent      string            `json:"user_agent,omitempty"`
+	JA3            string            `json:"ja3,omitempty"`
+	Navigator      string            `json:"navigator,omitempty"`
+	HTTP2          string            `json:"http2,omitempty"`
+	HTTP3          string            `json:"http3,omitempty"`
+	QUIC           *QUICConfig       `json:"quic,omitempty"`
+	TLSResumption  bool              `json:"tls_resumption,omitempty"`
+	OrderedHeaders [][]string        `json:"ordered_headers,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Source         string            `json:"source,omitempty"`
+}
+
+// ProfileCatalog holds the profiles loaded from the profile directory
+type ProfileCatalog interface {
+	Get(name string) (Profile, bool)
+	List() []Profile
+	Reload() (int, error)
+}
+
+var (
+	ErrPoolDisabled  = errors.New("session pool is disabled")
+	ErrPoolExhausted = errors.New("no idle session left in the pool")
+
+	ErrProfilesDisabled = errors.New("no profile directory configured")
+
+	ErrDownloadsDisabled = errors.New("download manager is disabled")
+	ErrDownloadNotFound  = errors.New("download not found")
+	ErrDownloadState     = errors.New("invalid download state")
+
+	ErrHistoryNotFound = errors.New("request not found in the session history")
+	ErrHistoryDisabled = errors.New("request history is disabled for the session, created without history")
+
+	ErrTLSResumptionDisabled = errors.New("TLS resumption is disabled for the session")
+
+	ErrKeepalivesDisabled = errors.New("keepalives are disabled")
+	ErrKeepaliveNotFound  = errors.New("no keepalive registered for the session")
+
+	ErrProbesDisabled = errors.New("probes are disabled")
+	ErrProbeNotFound  = errors.New("probe not found")
+
+	ErrScriptsDisabled = errors.New("scripts are disabled")
+	ErrScriptNotFound  = errors.New("script not found")
+
+	ErrConnectionNotFound = errors.New("WebSocket connection not found")
+
+	ErrInvalidPriority = errors.New("invalid priority, expected high, normal or low")
+	ErrQueueTimeout    = errors.New("timed out waiting for a request slot")
+
+	ErrInvalidHeaderMerge = errors.New("invalid header_merge, expected replace, prepend or append")
+
+	ErrInvalidALPN  = errors.New("invalid alpn, protocols must be 1 to 255 bytes long")
+	ErrALPNConflict = errors.New("alpn cannot be set with force_http1 or force_http3")
+
+	ErrBodyStoreDisabled = errors.New("body references are disabled, the body store could not be opened")
+	ErrBodyNotFound      = errors.New("body not found or expired")
+
+	ErrCookieJarsDisabled   = errors.New("shared cookie jars are disabled")
+	ErrCookieJarNotFound    = errors.New("cookie jar not found")
+	ErrCookieJarExists      = errors.New("cookie jar already exists")
+	ErrCookieJarNotBound    = errors.New("session is not bound to a cookie jar")
+	ErrCookieJarUnsupported = errors.New("the session manager does not support shared cookie jars")
+
+	ErrPluginsDisabled = errors.New("no plugins directory configured")
+	ErrPluginNotFound  = errors.New("plugin not found or without endpoints")
+)
+
+// SessionPool hands out pre-created sessions
+type SessionPool interface {
+	Acquire() (string, error)
+	Release(sessionID string, discard bool) error
+	// Remove replaces a pooled session deleted by its holder
+	Remove(sessionID string)
+	Contains(sessionID string) bool
+	Stats() PoolStats
 }
 
 type Server interface {
 	GetConfig() ServerConfig
 	GetSessionManager() SessionManager
+	// GetSessionPool returns nil when no pool is configured
+	GetSessionPool() SessionPool
+	// GetProfileCatalog returns nil when no profile directory is configured
+	GetProfileCatalog() ProfileCatalog
+	// GetDownloadManager returns nil when downloads are disabled
+	GetDownloadManager() DownloadManager
+	// GetMonitor returns nil when requests are not monitored
+	GetMonitor() Monitor
+	// GetSessionRotator returns nil when sessions are never rotated
+	GetSessionRotator() SessionRotator
+	// GetKeepaliveScheduler returns nil when keepalives are disabled
+	GetKeepaliveScheduler() KeepaliveScheduler
+	// GetProber returns nil when probes are disabled
+	GetProber() Prober
+	// GetPluginManager returns nil when no plugins directory is configured
+	GetPluginManager() PluginManager
+	// GetScriptRunner returns nil when scripts are disabled
+	GetScriptRunner() ScriptRunner
+	// GetRequestScheduler returns nil when outgoing requests are not limited
+	GetRequestScheduler() RequestScheduler
+	// GetBodyStore returns nil when the body store could not be opened
+	GetBodyStore() BodyStore
+	GetCookieJars() CookieJarRegistry
+	GetSessionOwners() SessionOwners
+}
+
+// SessionOwners records the API key each session belongs to, so that keys
+// only reach their own sessions. Owners are opaque key identifiers.
+type SessionOwners interface {
+	Claim(sessionID, owner string)
+	// Owner returns the owner of a session, false when it has none
+	Owner(sessionID string) (string, bool)
+	Move(fromSessionID, toSessionID string)
+	Forget(sessionID string)
+}
+
+// CookieJarRegistry keeps the named cookie jars shared by sessions, so that
+// differently fingerprinted sessions act as one logged-in identity.
+// Methods taking the name of a missing jar return ErrCookieJarNotFound.
+type CookieJarRegistry interface {
+	// Create adds a jar owned by owner, the API key creating it or empty
+	// without authentication
+	Create(name, owner string) (CookieJarInfo, error)
+	Get(name string) (CookieJarInfo, error)
+	Owner(name string) (string, error)
+	// List returns the jars sorted by name
+	List() []CookieJarInfo
+	// Delete removes a jar, the sessions bound to it keeping a copy of its
+	// cookies
+	Delete(name string) error
+	// Cookies returns the cookies of a jar sent to a URL
+	Cookies(name string, u *url.URL) ([]Cookie, error)
+
+	// Bind replaces the cookie jar of a session with a shared one, failing
+	// with ErrCookieJarUnsupported for sessions whose jar cannot be swapped
+	// under running requests
+	Bind(sessionID string, session *azuretls.Session, name string) error
+	// Unbind gives a bound session a private copy of the shared jar
+	Unbind(sessionID string) error
+	// Bound returns the name of the jar of a session, empty when unbound
+	Bound(sessionID string) string
+	// Move binds a replacement session to the jar of the session it
+	// replaces
+	Move(fromSessionID, toSessionID string, session *azuretls.Session)
+	Forget(sessionID string)
+}
+
+// CookieJarInfo describes a shared cookie jar and the sessions bound to it
+type CookieJarInfo struct {
+	Name      string    `json:"name"`
+	Sessions  []string  `json:"sessions"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BodyStore keeps the response bodies fetched out of band, each one
+// expiring some time after it was stored
+type BodyStore interface {
+	Put(body []byte, contentType string) (StoredBody, error)
+	// Open returns a stored body, which the caller must close
+	Open(ref string) (*os.File, StoredBody, error)
+	Delete(ref string) error
+	// Check verifies that new bodies can be written, for the deep health
+	// check
+	Check() error
+}
+
+// StoredBody describes a response body fetched out of band
+type StoredBody struct {
+	Ref         string    `json:"ref"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// RequestScheduler bounds the requests sent to targets at the same time,
+// the waiting ones being served by priority
+type RequestScheduler interface {
+	// Acquire waits for a slot, returning the function releasing it
+	Acquire(ctx context.Context, priority string) (release func(), err error)
+	Stats() SchedulerStats
+}
+
+// SessionRotator tracks the sessions created with a rotation policy
+type SessionRotator interface {
+	Track(sessionID string, config *SessionConfig)
+	Forget(sessionID string)
+	// Due returns why a session must be replaced, "" when it must not. resp
+	// is nil before a request is sent, and counts as a request otherwise.
+	Due(sessionID string, resp *ServerResponse) string
+	// Replacement returns the config of the next replacement of a session
+	Replacement(sessionID string) (*SessionConfig, bool)
+	// Replace hands the policy of a session over to its replacement. It
+	// returns false when the session was replaced or forgotten meanwhile.
+	Replace(sessionID, replacementID string) bool
+}
+
+// KeepaliveConfig is a request sent automatically once a session has been
+// idle for the interval, to keep its cookies and anti-bot tokens fresh
+type KeepaliveConfig struct {
+	URL             string     `json:"url"`
+	Method          string     `json:"method,omitempty"`
+	IntervalSeconds int        `json:"interval_seconds"`
+	OrderedHeaders  [][]string `json:"ordered_headers,omitempty"`
+}
+
+// KeepaliveEvent reports a failed keepalive request
+type KeepaliveEvent struct {
+	SessionID string    `json:"session_id"`
+	URL       string    `json:"url"`
+	Time      time.Time `json:"time"`
+	// StatusCode is 0 when no response was received
+	StatusCode          int    `json:"status_code,omitempty"`
+	Error               string `json:"error"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+}
+
+// KeepaliveStatus describes the keepalive of a session
+type KeepaliveStatus struct {
+	KeepaliveConfig
+	NextRunAt           time.Time  `json:"next_run_at"`
+	LastRunAt           *time.Time `json:"last_run_at,omitempty"`
+	LastStatusCode      int        `json:"last_status_code,omitempty"`
+	Runs                int        `json:"runs"`
+	Failures            int        `json:"failures"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	// Events holds the most recent failures, oldest first
+	Events []KeepaliveEvent `json:"events"`
+}
+
+// KeepaliveRunner sends the keepalive request of a session
+type KeepaliveRunner func(sessionID string, req *ServerRequest) *ServerResponse
+
+// KeepaliveScheduler sends the keepalive requests of idle sessions
+type KeepaliveScheduler interface {
+	// Register replaces the keepalive of a session
+	Register(sessionID string, config KeepaliveConfig, run KeepaliveRunner) (KeepaliveStatus, error)
+	// Stop returns false when the session had no keepalive
+	Stop(sessionID string) bool
+	Status(sessionID string) (KeepaliveStatus, bool)
+	// Touch postpones the keepalive of a session that was just used
+	Touch(sessionID string)
+	// Move hands the keepalive of a session over to its replacement
+	Move(sessionID, replacementID string)
+	// Subscribe calls fn with every failure
+	Subscribe(fn func(KeepaliveEvent))
+}
+
+// Probe is a target checked periodically through a fresh session, to notice
+// early when it changes its defenses
+type Probe struct {
+	Name            string     `json:"name"`
+	URL             string     `json:"url"`
+	Method          string     `json:"method,omitempty"`
+	IntervalSeconds int        `json:"interval_seconds,omitempty"`
+	TimeoutMs       int        `json:"timeout_ms,omitempty"`
+	Profile         string     `json:"profile,omitempty"`
+	Browser         string     `json:"browser,omitempty"`
+	Proxy           string     `json:"proxy,omitempty"`
+	OrderedHeaders  [][]string `json:"ordered_headers,omitempty"`
+	// ExpectStatus lists the healthy status codes, any status below 400
+	// being healthy when empty
+	ExpectStatus []int `json:"expect_status,omitempty"`
+}
+
+// ProbeResult is the outcome of a probe check
+type ProbeResult struct {
+	Time       time.Time `json:"time"`
+	Healthy    bool      `json:"healthy"`
+	StatusCode int       `json:"status_code,omitempty"`
+	LatencyMs  int64     `json:"latency_ms"`
+	Challenge  bool      `json:"challenge"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// ProbeStatus describes a probe and its checks
+type ProbeStatus struct {
+	Probe
+	Last       *ProbeResult `json:"last,omitempty"`
+	Checks     int          `json:"checks"`
+	Failures   int          `json:"failures"`
+	Challenges int          `json:"challenges"`
+	// HealthySince is the time of the first of the consecutive healthy
+	// checks, nil when the last check failed
+	HealthySince *time.Time `json:"healthy_since,omitempty"`
+}
+
+// ProbeRunner sends the request of a probe through a fresh session
+type ProbeRunner func(req *ServerRequest, config *SessionConfig) *ServerResponse
+
+// Prober runs the probes registered by operators
+type Prober interface {
+	// Add registers a probe, replacing the one with the same name. Its
+	// first check starts right away.
+	Add(probe Probe) (ProbeStatus, error)
+	Remove(name string) bool
+	Get(name string) (ProbeStatus, bool)
+	// List returns the probes sorted by name
+	List() []ProbeStatus
+}
+
+// PluginInfo describes an external plugin and its process
+type PluginInfo struct {
+	Name         string   `json:"name"`
+	Path         string   `json:"path"`
+	Version      string   `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities"`
+	Running      bool     `json:"running"`
+	PID          int      `json:"pid,omitempty"`
+	Restarts     int      `json:"restarts"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// PluginManager runs the external plugins found in the plugins directory
+type PluginManager interface {
+	// MutateRequest passes an outgoing request through the request
+	// mutators, in plugin name order
+	MutateRequest(req *ServerRequest, sessionID string, tags []string) error
+	// Endpoints returns the handler of the custom endpoints of a plugin,
+	// rooted at "/"
+	Endpoints(name string) (http.Handler, error)
+	// List returns the plugins sorted by name
+	List() []PluginInfo
+}
+
+// ScriptLimits bound each run of a script hook. Timeout bounds its CPU
+// time, MaxStack the slots of its data stack and MaxCallDepth its nested
+// calls.
+type ScriptLimits struct {
+	Timeout      time.Duration `json:"timeout,omitempty"`
+	MaxStack     int           `json:"max_stack,omitempty"`
+	MaxCallDepth int           `json:"max_call_depth,omitempty"`
+}
+
+// Script is a Lua script defining on_request and on_response hooks
+type Script struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+// ScriptInfo describes a script and its runs
+type ScriptInfo struct {
+	Name      string    `json:"name"`
+	Hooks     []string  `json:"hooks"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Runs      int64     `json:"runs"`
+	Errors    int64     `json:"errors"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// ScriptResponse is the response handed to on_response hooks, which may
+// change its headers and body and fill Data
+type ScriptResponse struct {
+	StatusCode int
+	URL        string
+	Headers    http.Header
+	Body       []byte
+	Data       map[string]any
+}
+
+// ScriptRunner stores the scripts and runs their hooks
+type ScriptRunner interface {
+	// Put compiles and stores a script, replacing the one with the same name
+	Put(name, source string) (ScriptInfo, error)
+	Get(name string) (Script, bool)
+	Remove(name string) bool
+	// List returns the scripts sorted by name
+	List() []ScriptInfo
+
+	// Attach sets the scripts run on the requests of a session
+	Attach(sessionID string, names []string) error
+	SessionScripts(sessionID string) []string
+	Move(fromSessionID, toSessionID string)
+	Forget(sessionID string)
+
+	// OnRequest runs the on_request hook of the scripts, in order, on a
+	// request about to be sent. Errors fail the request.
+	OnRequest(names []string, req *azuretls.Request, session *azuretls.Session, sessionID string, tags []string) error
+	// OnResponse runs the on_response hook of the scripts, in order, and
+	// returns their errors by script name
+	OnResponse(names []string, resp *ScriptResponse, sessionID string) map[string]string
 }
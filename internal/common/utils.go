@@ -10,6 +10,7 @@ import (
 	mathRand "math/rand"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/Noooste/azuretls-api/internal/protocol"
@@ -24,49 +25,55 @@ const (
 	LogLevelError
 )
 
-var currentLogLevel = LogLevelInfo
+// currentLogLevel is read by loggers running concurrently with
+// SetLogLevel
+var currentLogLevel atomic.Int32
+
+func init() {
+	currentLogLevel.Store(int32(LogLevelInfo))
+}
 
 // SetLogLevel sets the global log level
 func SetLogLevel(level string) {
 	switch strings.ToLower(level) {
 	case "debug":
-		currentLogLevel = LogLevelDebug
+		currentLogLevel.Store(int32(LogLevelDebug))
 	case "info":
-		currentLogLevel = LogLevelInfo
+		currentLogLevel.Store(int32(LogLevelInfo))
 	case "warn", "warning":
-		currentLogLevel = LogLevelWarn
+		currentLogLevel.Store(int32(LogLevelWarn))
 	case "error":
-		currentLogLevel = LogLevelError
+		currentLogLevel.Store(int32(LogLevelError))
 	default:
 		log.Printf("Unknown log level '%s', defaulting to 'info'", level)
-		currentLogLevel = LogLevelInfo
+		currentLogLevel.Store(int32(LogLevelInfo))
 	}
 }
 
 // LogDebug logs a debug message
 func LogDebug(format string, v ...interface{}) {
-	if currentLogLevel <= LogLevelDebug {
+	if LogLevel(currentLogLevel.Load()) <= LogLevelDebug {
 		log.Printf("[DEBUG] "+format, v...)
 	}
 }
 
 // LogInfo logs an info message
 func LogInfo(format string, v ...interface{}) {
-	if currentLogLevel <= LogLevelInfo {
+	if LogLevel(currentLogLevel.Load()) <= LogLevelInfo {
 		log.Printf("[INFO] "+format, v...)
 	}
 }
 
 // LogWarn logs a warning message
 func LogWarn(format string, v ...interface{}) {
-	if currentLogLevel <= LogLevelWarn {
+	if LogLevel(currentLogLevel.Load()) <= LogLevelWarn {
 		log.Printf("[WARN] "+format, v...)
 	}
 }
 
 // LogError logs an error message
 func LogError(format string, v ...interface{}) {
-	if currentLogLevel <= LogLevelError {
+	if LogLevel(currentLogLevel.Load()) <= LogLevelError {
 		log.Printf("[ERROR] "+format, v...)
 	}
 }
@@ -187,6 +194,10 @@ func (om *OrderedMap) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// SupportedEncodings are the content encodings response bodies can be
+// decoded from
+var SupportedEncodings = []string{"gzip", "deflate", "br", "zstd", "identity"}
+
 func IsBinaryContent(contentType http.Header, body []byte) bool {
 	contentTypeHeader := contentType.Get("Content-Type")
 	if contentTypeHeader == "" {
@@ -0,0 +1,421 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/probe"
+	"github.com/Noooste/azuretls-api/internal/profile"
+	"github.com/Noooste/azuretls-api/internal/proxyauth"
+	"github.com/Noooste/azuretls-api/internal/rules"
+	"github.com/Noooste/azuretls-api/internal/scripts"
+	"github.com/Noooste/azuretls-client"
+)
+
+// Error is a configuration problem. Source names the setting the problem
+// comes from, usually a flag, and Field locates it in the loaded file.
+type Error struct {
+	Source  string `json:"source"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e Error) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %s", e.Source, e.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Source, e.Field, e.Message)
+}
+
+var browsers = []string{azuretls.Chrome, azuretls.Firefox, azuretls.Opera, azuretls.Safari, azuretls.Edge, azuretls.Ios}
+
+var proxySchemes = []string{"http", "https", azuretls.Socks4, azuretls.Socks4A, azuretls.Socks5, azuretls.Socks5H}
+
+var logLevels = []string{"debug", "info", "warn", "warning", "error"}
+
+type validator struct {
+	catalog *profile.Catalog
+	errors  []Error
+}
+
+func (v *validator) add(source, field, format string, args ...any) {
+	v.errors = append(v.errors, Error{Source: source, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks a loaded server configuration, including the profiles it
+// references, and returns every problem found
+func Validate(config common.ServerConfig) []Error {
+	v := &validator{}
+
+	if config.Port < 1 || config.Port > 65535 {
+		v.add("port", "", "must be between 1 and 65535, got %d", config.Port)
+	}
+	if config.MaxSessions < 0 {
+		v.add("max_sessions", "", "must not be negative")
+	}
+	if config.MaxConcurrentRequests < 1 {
+		v.add("max_concurrent_requests", "", "must be positive")
+	}
+	if config.MaxConcurrentRequestsPerKey < 0 {
+		v.add("max_concurrent_requests_per_key", "", "must not be negative")
+	}
+	if config.ReadTimeout < 0 {
+		v.add("read_timeout", "", "must not be negative")
+	}
+	if config.WriteTimeout < 0 {
+		v.add("write_timeout", "", "must not be negative")
+	}
+	if config.IdleTimeout < 0 {
+		v.add("idle_timeout", "", "must not be negative")
+	}
+	if config.ReadHeaderTimeout < 0 {
+		v.add("read_header_timeout", "", "must not be negative")
+	}
+	if config.WSMaxMessageSize < 0 {
+		v.add("ws_max_message_size", "", "must not be negative")
+	}
+	if config.MaxOutgoingRequests < 0 {
+		v.add("max_outgoing_requests", "", "must not be negative")
+	}
+	if config.MaxBandwidth < 0 {
+		v.add("max_bandwidth", "", "must not be negative")
+	}
+	if config.QueueTimeout < 0 {
+		v.add("queue_timeout", "", "must not be negative")
+	}
+	if config.WSDrainTimeout < 0 {
+		v.add("ws_drain_timeout", "", "must not be negative")
+	}
+	if config.WSPersistTTL < 0 {
+		v.add("ws_persist_ttl", "", "must not be negative")
+	}
+	if config.WSReconnectTo != "" {
+		u, err := url.Parse(config.WSReconnectTo)
+		if err != nil || !slices.Contains([]string{"ws", "wss", "http", "https"}, u.Scheme) || u.Host == "" {
+			v.add("ws_reconnect_to", "", "invalid URL %q", config.WSReconnectTo)
+		}
+	}
+	if !slices.Contains(logLevels, strings.ToLower(config.LogLevel)) {
+		v.add("log_level", "", "unknown level %q, expected debug, info, warn or error", config.LogLevel)
+	}
+
+	v.dot("dot_address", "", config.DoTAddress)
+	if config.DoTAddress != "" && config.DisableDNSCache {
+		v.add("dot_address", "", "cannot be combined with disable_dns_cache, the resolver filling the DNS cache")
+	}
+	if config.DoTServerName != "" && config.DoTAddress == "" {
+		v.add("dot_server_name", "", "requires dot_address")
+	}
+
+	v.url("health_check_url", config.HealthCheckURL)
+	v.url("ip_echo_url", config.IPEchoURL)
+
+	if config.GeoIPDatabase != "" {
+		for _, path := range strings.Split(config.GeoIPDatabase, ",") {
+			if _, err := os.Stat(strings.TrimSpace(path)); err != nil {
+				v.add("geoip_db", "", "%v", err)
+			}
+		}
+	}
+
+	v.faults(config.FaultInjection)
+	v.directory("download_dir", config.DownloadDir)
+	v.directory("body_store_dir", config.BodyStoreDir)
+	if config.BodyRefTTL < 0 {
+		v.add("body_ref_ttl", "", "must not be negative")
+	}
+	if config.DownloadTTL < 0 {
+		v.add("download_ttl", "", "must not be negative")
+	}
+
+	if config.PluginsDir != "" {
+		if info, err := os.Stat(config.PluginsDir); err != nil {
+			v.add("plugins_dir", "", "%v", err)
+		} else if !info.IsDir() {
+			v.add("plugins_dir", "", "%s is not a directory", config.PluginsDir)
+		}
+	}
+
+	v.scripts(config.ScriptsDir, config.ScriptLimits)
+
+	if config.ProfilesDir != "" {
+		catalog := profile.NewCatalog(config.ProfilesDir)
+		if _, err := catalog.Reload(); err != nil {
+			v.add("profiles_dir", "", "%v", err)
+		} else {
+			v.catalog = catalog
+		}
+	}
+
+	for i, key := range config.APIKeys {
+		v.sessionConfig("api_keys", fmt.Sprintf("[%d].defaults", i), key.Defaults)
+		if key.MaxConcurrentRequests < 0 {
+			v.add("api_keys", fmt.Sprintf("[%d].max_concurrent_requests", i), "must not be negative")
+		}
+		for k, proxy := range key.Proxies {
+			v.proxy("api_keys", fmt.Sprintf("[%d].proxies[%d]", i, k), proxy)
+		}
+	}
+
+	if _, err := rules.NewEngine(config.Rules); err != nil {
+		v.add("rules", "", "%v", err)
+	}
+
+	v.pool(config.SessionPool)
+	v.probes(config.Probes)
+
+	return v.errors
+}
+
+func (v *validator) scripts(dir string, limits common.ScriptLimits) {
+	if limits.Timeout < 0 {
+		v.add("script_timeout_ms", "", "must not be negative")
+	}
+	if limits.MaxStack < 0 {
+		v.add("script_max_stack", "", "must not be negative")
+	}
+	if limits.MaxCallDepth < 0 {
+		v.add("script_max_call_depth", "", "must not be negative")
+	}
+
+	if dir == "" {
+		return
+	}
+	if info, err := os.Stat(dir); err != nil {
+		v.add("scripts_dir", "", "%v", err)
+		return
+	} else if !info.IsDir() {
+		v.add("scripts_dir", "", "%s is not a directory", dir)
+		return
+	}
+
+	if _, err := scripts.NewEngine(limits).LoadDir(dir); err != nil {
+		v.add("scripts_dir", "", "%v", err)
+	}
+}
+
+func (v *validator) faults(faults common.FaultInjectionConfig) {
+	for _, fault := range []struct {
+		source  string
+		percent float64
+	}{
+		{"fault_latency_percent", faults.LatencyPercent},
+		{"fault_error_percent", faults.ErrorPercent},
+		{"fault_reset_percent", faults.ResetPercent},
+	} {
+		if fault.percent < 0 || fault.percent > 100 {
+			v.add(fault.source, "", "must be between 0 and 100, got %g", fault.percent)
+		}
+	}
+
+	if faults.Latency < 0 {
+		v.add("fault_latency_ms", "", "must not be negative")
+	}
+	if faults.LatencyJitter < 0 {
+		v.add("fault_latency_jitter_ms", "", "must not be negative")
+	}
+	if faults.ErrorPercent > 0 && len(faults.ErrorStatusCodes) == 0 {
+		v.add("fault_error_codes", "", "required when fault_error_percent is set")
+	}
+}
+
+func (v *validator) pool(pool common.SessionPoolConfig) {
+	if pool.Size < 0 {
+		v.add("pool_size", "", "must not be negative")
+	}
+
+	for i, config := range pool.Profiles {
+		v.sessionConfig("pool_profiles", fmt.Sprintf("[%d]", i), config)
+	}
+	for i, proxy := range pool.Proxies {
+		v.proxy("pool_proxies", fmt.Sprintf("line %d", i+1), proxy)
+	}
+}
+
+func (v *validator) probes(probes []common.Probe) {
+	seen := make(map[string]bool, len(probes))
+
+	for i, p := range probes {
+		field := fmt.Sprintf("[%d]", i)
+		if p.Name != "" {
+			field = fmt.Sprintf("[%d] (%s)", i, p.Name)
+		}
+
+		if err := probe.Validate(&p); err != nil {
+			v.add("probes", field, "%v", err)
+		}
+		if seen[p.Name] {
+			v.add("probes", field, "probe %s is defined twice", p.Name)
+		}
+		seen[p.Name] = true
+
+		v.sessionConfig("probes", field, common.SessionConfig{
+			Profile: p.Profile,
+			Browser: p.Browser,
+			Proxy:   p.Proxy,
+		})
+	}
+}
+
+// sessionConfig checks the references of a session config: its profile,
+// browser, proxy, proxy auth, bandwidth, connection age and rotation
+// policy
+func (v *validator) sessionConfig(source, field string, config common.SessionConfig) {
+	v.profile(source, field+".profile", config.Profile)
+	v.browser(source, field+".browser", config.Browser)
+	v.proxy(source, field+".proxy", config.Proxy)
+
+	if config.TimeoutMs < 0 {
+		v.add(source, field+".timeout_ms", "must not be negative")
+	}
+	if config.DoT != nil {
+		if config.DoT.Address == "" {
+			v.add(source, field+".dot.address", "must be set")
+		}
+		v.dot(source, field+".dot.address", config.DoT.Address)
+		if config.Proxy != "" {
+			v.add(source, field+".dot", "cannot be combined with a proxy, which resolves names outside DNS over TLS")
+		}
+		if config.QUIC != nil {
+			v.add(source, field+".dot", "cannot be combined with quic, HTTP/3 resolving names outside DNS over TLS")
+		}
+	}
+	if config.QUIC != nil && config.QUIC.ZeroRTT {
+		v.add(source, field+".quic.zero_rtt", "is not supported, HTTP/3 connections are never resumed")
+	}
+	if dial := config.Dial; dial != nil {
+		if dial.FallbackDelayMs < 0 {
+			v.add(source, field+".dial.fallback_delay_ms", "must not be negative")
+		}
+		if dial.PreferFamily != "" && dial.PreferFamily != common.FamilyIPv4 && dial.PreferFamily != common.FamilyIPv6 {
+			v.add(source, field+".dial.prefer_family", "unknown family %q, expected %s or %s", dial.PreferFamily, common.FamilyIPv4, common.FamilyIPv6)
+		}
+	}
+	if bandwidth := config.Bandwidth; bandwidth != nil {
+		if bandwidth.UploadBytesPerSec < 0 || bandwidth.DownloadBytesPerSec < 0 {
+			v.add(source, field+".bandwidth", "limits must not be negative")
+		}
+	}
+	if age := config.MaxConnectionAge; age != nil && age.Seconds < 0 {
+		v.add(source, field+".max_connection_age.seconds", "must not be negative")
+	}
+	if config.ProxyAuth != nil {
+		if err := proxyauth.Validate(*config.ProxyAuth); err != nil {
+			v.add(source, field+".proxy_auth", "%v", err)
+		}
+		if strings.HasPrefix(config.Proxy, "socks") {
+			v.add(source, field+".proxy_auth", "requires an HTTP or HTTPS proxy")
+		}
+	}
+
+	rotation := config.Rotation
+	if rotation == nil {
+		return
+	}
+
+	if rotation.MaxRequests < 0 || rotation.MaxAgeSeconds < 0 {
+		v.add(source, field+".rotation", "max_requests and max_age_seconds must not be negative")
+	}
+	for i, name := range rotation.Profiles {
+		v.profile(source, fmt.Sprintf("%s.rotation.profiles[%d]", field, i), name)
+	}
+	for i, browser := range rotation.Browsers {
+		v.browser(source, fmt.Sprintf("%s.rotation.browsers[%d]", field, i), browser)
+	}
+	for i, proxy := range rotation.Proxies {
+		v.proxy(source, fmt.Sprintf("%s.rotation.proxies[%d]", field, i), proxy)
+	}
+}
+
+func (v *validator) profile(source, field, name string) {
+	if name == "" {
+		return
+	}
+
+	if v.catalog == nil {
+		v.add(source, field, "profile %s not found: no profiles_dir configured", name)
+		return
+	}
+	if _, exists := v.catalog.Get(name); !exists {
+		v.add(source, field, "profile %s not found", name)
+	}
+}
+
+func (v *validator) browser(source, field, browser string) {
+	if browser != "" && !slices.Contains(browsers, strings.ToLower(browser)) {
+		v.add(source, field, "unknown browser %q, expected one of %s", browser, strings.Join(browsers, ", "))
+	}
+}
+
+// proxy checks a proxy URL. Proxies without scheme use the shorthand forms
+// of the client, such as host:port or host:port:user:password. Messages
+// never quote the proxy, which may hold credentials.
+func (v *validator) proxy(source, field, proxy string) {
+	if proxy == "" {
+		return
+	}
+
+	if !strings.Contains(proxy, "://") {
+		parts := strings.Split(proxy, ":")
+		if len(parts) > 4 || slices.Contains(parts, "") {
+			v.add(source, field, "invalid proxy, expected a URL, host:port or host:port:user:password")
+		}
+		return
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		v.add(source, field, "invalid proxy URL")
+		return
+	}
+	if !slices.Contains(proxySchemes, u.Scheme) {
+		v.add(source, field, "unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		v.add(source, field, "proxy has no host")
+	}
+}
+
+// dot checks the host[:port] address of a DNS over TLS resolver
+func (v *validator) dot(source, field, address string) {
+	if address == "" {
+		return
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = strings.Trim(address, "[]"), "853"
+	}
+	if n, err := strconv.Atoi(port); host == "" || strings.ContainsAny(host, "/ ") || err != nil || n < 1 || n > 65535 {
+		v.add(source, field, "invalid address %q, expected host[:port]", address)
+	}
+}
+
+func (v *validator) url(source, value string) {
+	if value == "" {
+		return
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add(source, "", "invalid URL %q", value)
+	}
+}
+
+// directory checks that a path is a directory when it exists, the server
+// creating it otherwise
+func (v *validator) directory(source, path string) {
+	if path == "" {
+		return
+	}
+
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		v.add(source, "", "%s is not a directory", path)
+	}
+}
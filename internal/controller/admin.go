@@ -0,0 +1,77 @@
+package controller
+
+import (
+	"slices"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/monitor"
+	"github.com/Noooste/azuretls-client"
+)
+
+// record reports a request sent to the monitor
+func (c *SessionController) record(sessionID string, req *azuretls.Request, start time.Time, resp *azuretls.Response, err error) {
+	if c.monitor == nil {
+		return
+	}
+
+	var statusCode int
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+
+	var errorMessage string
+	if err != nil {
+		errorMessage = err.Error()
+	}
+
+	c.monitor.Record(monitor.NewRecord(sessionID, req.Method, req.Url, start, statusCode, errorMessage))
+}
+
+// DescribeSessions returns the active sessions, sorted by ID, with their
+// fingerprint and proxy, the proxy password being redacted
+func (c *SessionController) DescribeSessions() []common.SessionInfo {
+	ids := c.ListSessions()
+	slices.Sort(ids)
+
+	sessions := make([]common.SessionInfo, 0, len(ids))
+	for _, id := range ids {
+		session, exists := c.sessionManager.GetSession(id)
+		if !exists {
+			// Deleted in the meantime
+			continue
+		}
+
+		tags, _ := c.sessionManager.GetSessionTags(id)
+
+		sessions = append(sessions, common.SessionInfo{
+			ID:        id,
+			Browser:   session.Browser,
+			UserAgent: session.UserAgent,
+			Proxy:     redactProxy(session.Proxy),
+			Tags:      tags,
+			Pooled:    c.IsPooledSession(id),
+		})
+	}
+
+	return sessions
+}
+
+// RequestStats returns the request counters, or nil when requests are not
+// monitored
+func (c *SessionController) RequestStats() *common.RequestStats {
+	if c.monitor == nil {
+		return nil
+	}
+
+	stats := c.monitor.Stats()
+	return &stats
+}
+
+// RecentRequests returns the last requests, newest first
+func (c *SessionController) RecentRequests() []common.RequestRecord {
+	if c.monitor == nil {
+		return []common.RequestRecord{}
+	}
+	return c.monitor.Recent()
+}
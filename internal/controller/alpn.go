@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/fingerprint"
+	"github.com/Noooste/azuretls-client"
+	tls "github.com/Noooste/utls"
+)
+
+// validateALPN checks the protocols a request offers. Forcing a protocol
+// already decides the offer.
+func validateALPN(options *common.RequestOptions) error {
+	if len(options.ALPN) == 0 {
+		return nil
+	}
+	if options.ForceHTTP1 || options.ForceHTTP3 {
+		return common.ErrALPNConflict
+	}
+
+	for _, protocol := range options.ALPN {
+		if protocol == "" || len(protocol) > 255 {
+			return common.ErrInvalidALPN
+		}
+	}
+	return nil
+}
+
+// alpnSession returns the fork of a session offering the given ALPN
+// protocols, kept by the session manager when it supports it. The returned
+// function releases the fork once the request is sent.
+func (c *SessionController) alpnSession(sessionID string, session *azuretls.Session, alpn []string) (*azuretls.Session, func(), error) {
+	forker, ok := c.sessionManager.(common.SessionForker)
+	if !ok || sessionID == "" {
+		fork, err := forkSession(session, alpn)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fork, fork.Close, nil
+	}
+
+	// Request options may have changed the session since the fork was made
+	return forker.Fork(sessionID, fmt.Sprintf("alpn %q", alpn), func() (*azuretls.Session, error) {
+		return forkSession(session, alpn)
+	}, func(fork *azuretls.Session) bool {
+		return forkCurrent(fork, session)
+	})
+}
+
+// forkSession returns a session sending requests like session does, but
+// over its own connections offering the given ALPN protocols. Cookies and
+// TLS session tickets are shared with session, its connections are dialed
+// by session, and the fork never upgrades to HTTP/3.
+func forkSession(session *azuretls.Session, alpn []string) (*azuretls.Session, error) {
+	fork := azuretls.NewSessionWithContext(session.Context())
+
+	fork.CookieJar = session.CookieJar
+	fork.DisableAutoDecompression = session.DisableAutoDecompression
+	fork.PinManager = session.PinManager
+	fork.VerifyPins = session.VerifyPins
+	fork.ModifyConfig = session.ModifyConfig
+	fork.ModifyDialer = session.ModifyDialer
+	fork.Dial = session.Dial
+	fork.PreHook = session.PreHook
+	fork.PreHookWithContext = session.PreHookWithContext
+	fork.Callback = session.Callback
+	fork.CallbackWithContext = session.CallbackWithContext
+	fork.CheckRedirect = session.CheckRedirect
+	fork.ProxyHeader = session.ProxyHeader
+	fork.H2Proxy = session.H2Proxy
+
+	if chain := session.GetProxyChain(); len(chain) > 1 {
+		proxies := make([]string, len(chain))
+		for i, proxy := range chain {
+			proxies[i] = proxy.String()
+		}
+		if err := fork.SetProxyChain(proxies); err != nil {
+			fork.Close()
+			return nil, err
+		}
+	}
+	if err := syncFork(fork, session); err != nil {
+		fork.Close()
+		return nil, err
+	}
+
+	// The HTTP/2 settings live on the transport of the session, set up on
+	// its first request
+	if tr := session.HTTP2Transport; tr != nil {
+		if err := fork.ApplyHTTP2(http2Fingerprint(session)); err != nil {
+			fork.Close()
+			return nil, err
+		}
+		fork.HTTP2Transport.HeaderPriority = tr.HeaderPriority
+	}
+
+	// Read on every handshake, following the JA3 and browser of session
+	fork.GetClientHelloSpec = func() *tls.ClientHelloSpec {
+		getSpec := session.GetClientHelloSpec
+		if getSpec == nil {
+			getSpec = azuretls.GetBrowserClientHelloFunc(session.Browser)
+		}
+		return withALPN(getSpec(), alpn)
+	}
+
+	return fork, nil
+}
+
+// forkCurrent reports whether a fork still has the settings of session
+// that requests may change, as copied by syncFork
+func forkCurrent(fork, session *azuretls.Session) bool {
+	return fork.Browser == session.Browser &&
+		fork.UserAgent == session.UserAgent &&
+		slices.EqualFunc(fork.OrderedHeaders, session.OrderedHeaders, slices.Equal[[]string]) &&
+		maps.EqualFunc(fork.Header, session.Header, slices.Equal[[]string]) &&
+		slices.Equal(fork.HeaderOrder, session.HeaderOrder) &&
+		fork.HeaderPriority == session.HeaderPriority &&
+		fork.MaxRedirects == session.MaxRedirects &&
+		fork.TimeOut == session.TimeOut &&
+		fork.InsecureSkipVerify == session.InsecureSkipVerify &&
+		(len(fork.GetProxyChain()) > 1 || fork.Proxy == session.Proxy)
+}
+
+// syncFork copies the settings of session that requests may change onto
+// its fork, before the fork is used
+func syncFork(fork, session *azuretls.Session) error {
+	fork.Browser = session.Browser
+	fork.UserAgent = session.UserAgent
+	fork.OrderedHeaders = session.OrderedHeaders.Clone()
+	fork.Header = session.Header.Clone()
+	fork.HeaderOrder = session.HeaderOrder
+	fork.HeaderPriority = session.HeaderPriority
+	fork.MaxRedirects = session.MaxRedirects
+	fork.SetTimeout(session.TimeOut)
+	fork.InsecureSkipVerify = session.InsecureSkipVerify
+
+	// Proxy chains are only set when the fork is made, the session manager
+	// dropping forks when the proxy changes
+	if len(fork.GetProxyChain()) > 1 || fork.Proxy == session.Proxy {
+		return nil
+	}
+	if session.Proxy == "" {
+		fork.ClearProxy()
+		return nil
+	}
+	return fork.SetProxy(session.Proxy)
+}
+
+// withALPN replaces the protocols offered by a ClientHello, adding the
+// extension when it has none
+func withALPN(spec *tls.ClientHelloSpec, alpn []string) *tls.ClientHelloSpec {
+	for _, ext := range spec.Extensions {
+		if extension, ok := ext.(*tls.ALPNExtension); ok {
+			extension.AlpnProtocols = alpn
+			return spec
+		}
+	}
+
+	// Padding and pre_shared_key must stay last
+	extension := &tls.ALPNExtension{AlpnProtocols: alpn}
+	at := len(spec.Extensions)
+	for at > 0 {
+		switch spec.Extensions[at-1].(type) {
+		case *tls.UtlsPaddingExtension, tls.PreSharedKeyExtension:
+			at--
+			continue
+		}
+		break
+	}
+	spec.Extensions = append(spec.Extensions[:at:at], append([]tls.TLSExtension{extension}, spec.Extensions[at:]...)...)
+
+	return spec
+}
+
+// http2Fingerprint renders the HTTP/2 settings of a session in the Akamai
+// format ApplyHTTP2 takes
+func http2Fingerprint(session *azuretls.Session) string {
+	tr := session.HTTP2Transport
+
+	fp := fingerprint.HTTP2{
+		WindowUpdate:      tr.ConnectionFlow,
+		PseudoHeaderOrder: pseudoHeaderOrder(session, session.Browser),
+	}
+	for _, id := range tr.SettingsOrder {
+		fp.Settings = append(fp.Settings, fingerprint.HTTP2Setting{ID: uint16(id), Value: tr.Settings[id]})
+	}
+	for _, priority := range tr.Priorities {
+		fp.Priorities = append(fp.Priorities, fingerprint.HTTP2Priority{
+			StreamID:  priority.StreamID,
+			Exclusive: priority.PriorityParam.Exclusive,
+			DependsOn: priority.PriorityParam.StreamDep,
+			Weight:    uint16(priority.PriorityParam.Weight) + 1,
+		})
+	}
+
+	return fp.Akamai()
+}
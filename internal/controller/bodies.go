@@ -0,0 +1,43 @@
+package controller
+
+import (
+	"mime"
+	"net/http"
+	"os"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// OpenBody returns a response body stored for out-of-band retrieval
+func (c *SessionController) OpenBody(ref string) (*os.File, common.StoredBody, error) {
+	if c.bodies == nil {
+		return nil, common.StoredBody{}, common.ErrBodyStoreDisabled
+	}
+
+	return c.bodies.Open(ref)
+}
+
+// DeleteBody deletes a stored response body before it expires
+func (c *SessionController) DeleteBody(ref string) error {
+	if c.bodies == nil {
+		return common.ErrBodyStoreDisabled
+	}
+
+	return c.bodies.Delete(ref)
+}
+
+// storeBody stores a response body for out-of-band retrieval. Text bodies
+// were transcoded to UTF-8, which their content type then says.
+func (c *SessionController) storeBody(header http.Header, body []byte, transcoded bool) (common.StoredBody, error) {
+	if c.bodies == nil {
+		return common.StoredBody{}, common.ErrBodyStoreDisabled
+	}
+
+	contentType := header.Get("Content-Type")
+	if mediaType, params, err := mime.ParseMediaType(contentType); err == nil && transcoded {
+		params["charset"] = "utf-8"
+		contentType = mime.FormatMediaType(mediaType, params)
+	}
+
+	return c.bodies.Put(body, contentType)
+}
@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/utils"
+)
+
+// coalescer sends identical requests in flight once, the callers arriving
+// while a request is sent sharing its response
+type coalescer struct {
+	calls map[string]*coalescedCall
+	mu    sync.Mutex
+}
+
+type coalescedCall struct {
+	done chan struct{}
+	resp *common.ServerResponse
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// do runs send unless a request with the same key is in flight, in which
+// case it waits for that request and returns a copy of its response
+func (c *coalescer) do(key string, serverReq *common.ServerRequest, send func() *common.ServerResponse) *common.ServerResponse {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+
+		if call.resp == nil {
+			return &common.ServerResponse{ID: serverReq.ID, Error: "coalesced request failed"}
+		}
+		resp := *call.resp
+		resp.ID = serverReq.ID
+		resp.Coalesced = true
+
+		// Callers get headers and cookies of their own, so that changing
+		// them does not race with the other callers
+		resp.Headers = http.Header(resp.Headers).Clone()
+		resp.Trailers = http.Header(resp.Trailers).Clone()
+		resp.Cookies = slices.Clone(resp.Cookies)
+		return &resp
+	}
+
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.resp = send()
+	return call.resp
+}
+
+// coalesceKey returns the key identical requests of a session, or of
+// stateless requests with the same configuration, share. It returns "" when
+// the request can not be coalesced: only GETs without body asking for it are.
+func coalesceKey(sessionID string, config *common.SessionConfig, serverReq *common.ServerRequest) string {
+	options := serverReq.Options
+	if !options.Coalesce || options.DryRun || options.Download != nil {
+		return ""
+	}
+	if serverReq.Method != "" && !strings.EqualFold(serverReq.Method, http.MethodGet) {
+		return ""
+	}
+	if serverReq.Body != "" || len(serverReq.BodyB64) > 0 || serverReq.BodyStream != nil || serverReq.OnProgress != nil {
+		return ""
+	}
+
+	encoded, err := json.Marshal(struct {
+		SessionID      string                `json:"session_id"`
+		Config         *common.SessionConfig `json:"config"`
+		URL            string                `json:"url"`
+		Headers        utils.OrderedMap      `json:"headers"`
+		OrderedHeaders [][]string            `json:"ordered_headers"`
+		Options        common.RequestOptions `json:"options"`
+	}{sessionID, config, serverReq.URL, serverReq.Headers, serverReq.OrderedHeaders, options})
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
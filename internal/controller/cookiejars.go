@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// CreateCookieJar creates a shared cookie jar owned by owner
+func (c *SessionController) CreateCookieJar(name, owner string) (common.CookieJarInfo, error) {
+	if c.cookieJars == nil {
+		return common.CookieJarInfo{}, common.ErrCookieJarsDisabled
+	}
+
+	return c.cookieJars.Create(name, owner)
+}
+
+// OwnsCookieJar reports whether owner created a shared cookie jar
+func (c *SessionController) OwnsCookieJar(owner, name string) bool {
+	if c.cookieJars == nil {
+		return false
+	}
+
+	current, err := c.cookieJars.Owner(name)
+	return err == nil && current == owner
+}
+
+func (c *SessionController) GetCookieJar(name string) (common.CookieJarInfo, error) {
+	if c.cookieJars == nil {
+		return common.CookieJarInfo{}, common.ErrCookieJarsDisabled
+	}
+
+	return c.cookieJars.Get(name)
+}
+
+func (c *SessionController) ListCookieJars() []common.CookieJarInfo {
+	if c.cookieJars == nil {
+		return []common.CookieJarInfo{}
+	}
+
+	return c.cookieJars.List()
+}
+
+// DeleteCookieJar deletes a shared cookie jar, the sessions bound to it
+// keeping a copy of its cookies
+func (c *SessionController) DeleteCookieJar(name string) error {
+	if c.cookieJars == nil {
+		return common.ErrCookieJarsDisabled
+	}
+
+	return c.cookieJars.Delete(name)
+}
+
+// CookieJarCookies returns the cookies a shared jar would send to a URL
+func (c *SessionController) CookieJarCookies(name, rawURL string) ([]common.Cookie, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", rawURL)
+	}
+
+	if c.cookieJars == nil {
+		return nil, common.ErrCookieJarsDisabled
+	}
+
+	return c.cookieJars.Cookies(name, u)
+}
+
+// BindCookieJar makes a session use a shared cookie jar, dropping its own
+// cookies
+func (c *SessionController) BindCookieJar(sessionID, name string) error {
+	session, err := c.GetSession(sessionID)
+	if err != nil {
+		return err
+	}
+
+	if c.cookieJars == nil {
+		return common.ErrCookieJarsDisabled
+	}
+
+	return c.cookieJars.Bind(sessionID, session, name)
+}
+
+// UnbindCookieJar gives a session bound to a shared cookie jar a private
+// copy of it
+func (c *SessionController) UnbindCookieJar(sessionID string) error {
+	if _, err := c.GetSession(sessionID); err != nil {
+		return err
+	}
+
+	if c.cookieJars == nil {
+		return common.ErrCookieJarNotBound
+	}
+
+	return c.cookieJars.Unbind(sessionID)
+}
+
+// SessionCookieJar returns the name of the shared cookie jar of a session,
+// empty when it has its own
+func (c *SessionController) SessionCookieJar(sessionID string) (string, error) {
+	if _, err := c.GetSession(sessionID); err != nil {
+		return "", err
+	}
+
+	if c.cookieJars == nil {
+		return "", nil
+	}
+
+	return c.cookieJars.Bound(sessionID), nil
+}
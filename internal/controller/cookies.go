@@ -0,0 +1,38 @@
+package controller
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// GetCookies returns the cookies a session would send to a URL, including
+// the ones set during redirects
+func (c *SessionController) GetCookies(sessionID, rawURL string) ([]common.Cookie, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", rawURL)
+	}
+
+	session, err := c.GetSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	cookies := make([]common.Cookie, 0)
+	if session.CookieJar == nil {
+		return cookies, nil
+	}
+
+	// The jar only keeps the name and value of the cookies it returns
+	for _, cookie := range session.CookieJar.Cookies(u) {
+		cookies = append(cookies, common.Cookie{
+			Name:   cookie.Name,
+			Value:  cookie.Value,
+			Domain: u.Hostname(),
+		})
+	}
+
+	return cookies, nil
+}
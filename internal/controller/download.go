@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/download"
+	"github.com/Noooste/azuretls-api/internal/signing"
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// download runs the request as a ranged download, its chunk requests
+// carrying ctx. The returned response holds the assembled body, or none when
+// the download is saved to a file. A first response that is not a download,
+// e.g. an error page, is returned as is without status.
+func (c *SessionController) download(ctx context.Context, session *azuretls.Session, req *azuretls.Request, options *common.DownloadOptions, onProgress func(common.DownloadStatus)) (*azuretls.Response, *common.DownloadStatus, error) {
+	var path string
+	if options.SaveAs != "" {
+		var err error
+		if path, err = c.downloadPath(options.SaveAs); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	transfer := download.NewTransfer(session, req, *options)
+	transfer.OnProgress = onProgress
+
+	var buffer bytes.Buffer
+	var w io.Writer = &buffer
+
+	if path != "" {
+		// An existing file is never overwritten
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create download file: %w", err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	resp, err := transfer.Run(ctx, w)
+	status := transfer.Status()
+
+	if err != nil || !status.Complete {
+		if path != "" {
+			_ = os.Remove(path)
+		}
+		if err != nil {
+			return nil, &status, err
+		}
+		return resp, nil, nil
+	}
+
+	assembled := &azuretls.Response{
+		StatusCode:   fhttp.StatusOK,
+		Status:       fmt.Sprintf("%d %s", fhttp.StatusOK, fhttp.StatusText(fhttp.StatusOK)),
+		Header:       transfer.Header().Clone(),
+		Cookies:      resp.Cookies,
+		Url:          transfer.URL(),
+		HttpResponse: resp.HttpResponse,
+	}
+	assembled.Header.Del("Content-Range")
+	assembled.Header.Set("Content-Length", strconv.FormatInt(status.Downloaded, 10))
+
+	if path != "" {
+		status.Path = path
+	} else {
+		assembled.Body = buffer.Bytes()
+	}
+
+	return assembled, &status, nil
+}
+
+// downloadPath returns the path of a file in the download directory
+func (c *SessionController) downloadPath(name string) (string, error) {
+	if c.downloadDir == "" {
+		return "", fmt.Errorf("no download directory configured")
+	}
+
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid download file name %q", name)
+	}
+
+	if err := os.MkdirAll(c.downloadDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create download directory: %w", err)
+	}
+
+	return filepath.Join(c.downloadDir, name), nil
+}
+
+// StartDownload starts a managed download with a session. Its artifact is
+// retrieved with OpenDownload once completed.
+func (c *SessionController) StartDownload(sessionID string, serverReq *common.ServerRequest) (common.DownloadJob, error) {
+	if c.downloads == nil {
+		return common.DownloadJob{}, common.ErrDownloadsDisabled
+	}
+	if len(serverReq.Trailers) > 0 {
+		return common.DownloadJob{}, fmt.Errorf("`trailers` cannot be sent with managed downloads, which repeat the request")
+	}
+
+	session, err := c.GetSession(sessionID)
+	if err != nil {
+		return common.DownloadJob{}, err
+	}
+
+	tags, err := c.sessionManager.GetSessionTags(sessionID)
+	if err != nil {
+		return common.DownloadJob{}, err
+	}
+
+	var scripts []string
+	if c.scripts != nil {
+		scripts = c.scripts.SessionScripts(sessionID)
+	}
+
+	req, scripts, _, err := c.prepareRequest(sessionID, session, serverReq, tags, scripts)
+	if err != nil {
+		return common.DownloadJob{}, err
+	}
+	if err := signing.Sign(req, session, serverReq.Options.Sign, time.Now()); err != nil {
+		return common.DownloadJob{}, err
+	}
+
+	var options common.DownloadOptions
+	if serverReq.Options.Download != nil {
+		options = *serverReq.Options.Download
+	}
+
+	// Each run of the transfer takes a slot of the scheduler, as the
+	// requests of the session do
+	var hooks common.DownloadHooks
+	if c.scheduler != nil {
+		priority := serverReq.Options.Priority
+		hooks.Acquire = func(ctx context.Context) (func(), error) {
+			return c.scheduler.Acquire(ctx, priority)
+		}
+	}
+	if len(scripts) > 0 {
+		hooks.OnComplete = func(resp *common.ScriptResponse) map[string]string {
+			return c.scripts.OnResponse(scripts, resp, sessionID)
+		}
+	}
+
+	return c.downloads.Start(sessionID, session, req, options, hooks)
+}
+
+// ListDownloads returns the managed downloads of a session
+func (c *SessionController) ListDownloads(sessionID string) ([]common.DownloadJob, error) {
+	if c.downloads == nil {
+		return nil, common.ErrDownloadsDisabled
+	}
+
+	return c.downloads.List(sessionID), nil
+}
+
+// GetDownload returns a managed download of a session
+func (c *SessionController) GetDownload(sessionID, downloadID string) (common.DownloadJob, error) {
+	if c.downloads == nil {
+		return common.DownloadJob{}, common.ErrDownloadsDisabled
+	}
+
+	return c.downloads.Get(sessionID, downloadID)
+}
+
+// PauseDownload stops a running download until it is resumed
+func (c *SessionController) PauseDownload(sessionID, downloadID string) (common.DownloadJob, error) {
+	if c.downloads == nil {
+		return common.DownloadJob{}, common.ErrDownloadsDisabled
+	}
+
+	return c.downloads.Pause(sessionID, downloadID)
+}
+
+// ResumeDownload restarts a paused download where it stopped
+func (c *SessionController) ResumeDownload(sessionID, downloadID string) (common.DownloadJob, error) {
+	if c.downloads == nil {
+		return common.DownloadJob{}, common.ErrDownloadsDisabled
+	}
+
+	return c.downloads.Resume(sessionID, downloadID)
+}
+
+// CancelDownload stops a download and deletes its artifact
+func (c *SessionController) CancelDownload(sessionID, downloadID string) error {
+	if c.downloads == nil {
+		return common.ErrDownloadsDisabled
+	}
+
+	return c.downloads.Cancel(sessionID, downloadID)
+}
+
+// OpenDownload returns the artifact of a completed download
+func (c *SessionController) OpenDownload(sessionID, downloadID string) (*os.File, common.DownloadJob, error) {
+	if c.downloads == nil {
+		return nil, common.DownloadJob{}, common.ErrDownloadsDisabled
+	}
+
+	return c.downloads.Open(sessionID, downloadID)
+}
@@ -0,0 +1,292 @@
+package controller
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/fingerprint"
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+	tls "github.com/Noooste/utls"
+)
+
+// acceptEncoding is the value azuretls sets when no Accept-Encoding header is given
+const acceptEncoding = "gzip, deflate, br"
+
+// renderRequest builds the dry-run view of a request, applying the same
+// header merge and ordering rules azuretls uses when sending it
+func renderRequest(session *azuretls.Session, req *azuretls.Request, serverReq *common.ServerRequest) (*common.DryRunResult, error) {
+	u, err := url.Parse(req.Url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL: %s", req.Url)
+	}
+
+	method := strings.ToUpper(req.Method)
+	if method == "" {
+		method = fhttp.MethodGet
+	}
+
+	result := &common.DryRunResult{
+		Method:  method,
+		URL:     u.String(),
+		Headers: renderHeaders(session, req, u),
+	}
+
+	if serverReq.BodyB64 != nil {
+		result.BodyB64 = base64.StdEncoding.EncodeToString(serverReq.BodyB64)
+	} else {
+		result.Body = serverReq.Body
+	}
+
+	// The proxy and browser options are not applied to the session
+	proxy, browser := session.Proxy, session.Browser
+	if serverReq.Options.Proxy != "" {
+		proxy = serverReq.Options.Proxy
+	}
+	if serverReq.Options.Browser != "" {
+		browser = serverReq.Options.Browser
+	}
+
+	if proxy != "" {
+		result.Proxy = redactProxy(proxy)
+	}
+
+	if u.Scheme == "https" || u.Scheme == "wss" {
+		if !req.ForceHTTP1 {
+			result.PseudoHeaderOrder = pseudoHeaderOrder(session, browser)
+		}
+
+		result.ClientHello, err = summarizeClientHello(session, browser, u.Hostname(), req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build ClientHello: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// renderHeaders returns the headers in wire order: headers listed in the
+// header order come first, the others follow sorted by name
+func renderHeaders(session *azuretls.Session, req *azuretls.Request, u *url.URL) [][]string {
+	var (
+		header            = make(map[string][]string)
+		order             []string
+		setUserAgent      = true
+		setAcceptEncoding = true
+	)
+
+	orderedHeaders := req.OrderedHeaders
+	if orderedHeaders == nil && len(session.OrderedHeaders) > 0 {
+		orderedHeaders = session.OrderedHeaders
+	}
+
+	if len(orderedHeaders) > 0 {
+		for _, el := range orderedHeaders {
+			if len(el) == 0 {
+				continue
+			}
+			order = append(order, strings.ToLower(el[0]))
+
+			key := fhttp.CanonicalHeaderKey(el[0])
+			switch {
+			case el[0] == azuretls.SensitiveHeaders, key == "Content-Length":
+				continue
+			case key == "Accept-Encoding":
+				setAcceptEncoding = false
+			case key == "User-Agent" && len(el) > 1:
+				setUserAgent = false
+			}
+
+			header[key] = append(header[key], el[1:]...)
+		}
+	} else {
+		reqHeader := req.Header
+		headerOrder := req.HeaderOrder
+		if reqHeader == nil {
+			reqHeader = session.Header
+			if headerOrder == nil {
+				headerOrder = session.HeaderOrder
+			}
+		}
+
+		for key, values := range reqHeader {
+			switch key {
+			case fhttp.HeaderOrderKey:
+				order = append(order, values...)
+				continue
+			case fhttp.PHeaderOrderKey, azuretls.SensitiveHeaders:
+				continue
+			}
+
+			if fhttp.CanonicalHeaderKey(key) == "User-Agent" {
+				setUserAgent = false
+			}
+			header[key] = values
+		}
+		order = append(order, headerOrder...)
+	}
+
+	if setUserAgent && session.UserAgent != "" {
+		header["User-Agent"] = []string{session.UserAgent}
+	}
+
+	if setAcceptEncoding && !session.DisableAutoDecompression {
+		header["Accept-Encoding"] = []string{acceptEncoding}
+	}
+
+	if !req.NoCookie && session.CookieJar != nil {
+		if cookies := session.CookieJar.Cookies(u); len(cookies) > 0 {
+			cookie := azuretls.CookiesToString(cookies)
+			if existing := header["Cookie"]; len(existing) > 0 && existing[0] != "" {
+				cookie = existing[0] + "; " + cookie
+			}
+			header["Cookie"] = []string{cookie}
+		}
+	}
+
+	index := make(map[string]int, len(order))
+	for i, key := range order {
+		if _, exists := index[key]; !exists {
+			index[key] = i
+		}
+	}
+
+	keys := make([]string, 0, len(header))
+	for key, values := range header {
+		if len(values) > 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		idxi, iok := index[strings.ToLower(keys[i])]
+		idxj, jok := index[strings.ToLower(keys[j])]
+		if iok && jok {
+			return idxi < idxj
+		}
+		if iok != jok {
+			return iok
+		}
+		return keys[i] < keys[j]
+	})
+
+	headers := make([][]string, len(keys))
+	for i, key := range keys {
+		headers[i] = append([]string{key}, header[key]...)
+	}
+
+	return headers
+}
+
+// pseudoHeaderOrder returns the pseudo-header order of the session, the one
+// of browser unless set
+func pseudoHeaderOrder(session *azuretls.Session, browser string) []string {
+	if session.PHeader != nil {
+		order := make([]string, len(session.PHeader))
+		for i, el := range session.PHeader {
+			if !strings.HasPrefix(el, ":") {
+				el = ":" + el
+			}
+			order[i] = el
+		}
+		return order
+	}
+
+	switch browser {
+	case azuretls.Firefox:
+		return []string{azuretls.Method, azuretls.Path, azuretls.Authority, azuretls.Scheme}
+	case azuretls.Ios, azuretls.Safari:
+		return []string{azuretls.Method, azuretls.Scheme, azuretls.Authority, azuretls.Path}
+	default:
+		order := azuretls.GetDefaultPseudoHeaders()
+		return order[:]
+	}
+}
+
+// summarizeClientHello builds the ClientHello of the session, as browser,
+// offline and describes it, including its JA3 and JA4 fingerprints
+func summarizeClientHello(session *azuretls.Session, browser, serverName string, req *azuretls.Request) (*common.ClientHelloSummary, error) {
+	getSpec := session.GetClientHelloSpec
+	if req.ForceHTTP3 {
+		getSpec = session.GetClientHelloSpecHTTP3
+		if getSpec == nil {
+			switch browser {
+			case azuretls.Chrome, azuretls.Edge, azuretls.Opera:
+				getSpec = azuretls.GetLastChromeVersionForHTTP3
+			default:
+				return nil, fmt.Errorf("HTTP/3 is not supported for browser %s", browser)
+			}
+		}
+	} else if getSpec == nil {
+		getSpec = azuretls.GetBrowserClientHelloFunc(browser)
+	}
+
+	spec := getSpec()
+	if req.ForceHTTP1 {
+		for _, ext := range spec.Extensions {
+			if alpn, ok := ext.(*tls.ALPNExtension); ok {
+				alpn.AlpnProtocols = []string{"http/1.1"}
+			}
+		}
+	}
+
+	uconn := tls.UClient(nil, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}, tls.HelloCustom)
+	if err := uconn.ApplyPreset(spec); err != nil {
+		return nil, err
+	}
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+
+	hello, err := fingerprint.ParseClientHello(uconn.HandshakeState.Hello.Raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientHelloSummary(hello), nil
+}
+
+// clientHelloSummary names the cipher suites and versions of a ClientHello
+func clientHelloSummary(hello *fingerprint.ClientHello) *common.ClientHelloSummary {
+	summary := &common.ClientHelloSummary{
+		ServerName:      hello.ServerName,
+		Extensions:      hello.Extensions,
+		SupportedGroups: hello.SupportedGroups,
+		ALPN:            hello.ALPN,
+		JA3:             hello.JA3(),
+		JA3Hash:         hello.JA3Hash(),
+		JA4:             hello.JA4(),
+	}
+
+	for _, suite := range hello.CipherSuites {
+		if fingerprint.IsGREASE(suite) {
+			summary.CipherSuites = append(summary.CipherSuites, "GREASE")
+		} else {
+			summary.CipherSuites = append(summary.CipherSuites, tls.CipherSuiteName(suite))
+		}
+	}
+
+	for _, version := range hello.SupportedVersions {
+		if !fingerprint.IsGREASE(version) {
+			summary.SupportedVersions = append(summary.SupportedVersions, tls.VersionName(version))
+		}
+	}
+
+	return summary
+}
+
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil || u.User == nil {
+		return proxy
+	}
+
+	return u.Redacted()
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/fingerprint"
+	"github.com/Noooste/azuretls-client"
+)
+
+// recordTypeHandshake starts a TLS record holding a handshake message
+const recordTypeHandshake = 0x16
+
+// requestHeaders are tied to the captured request rather than to the
+// browser, and are left out of the derived ordered headers
+var requestHeaders = map[string]bool{
+	"cookie":         true,
+	"content-length": true,
+	"content-type":   true,
+	"host":           true,
+	"origin":         true,
+	"referer":        true,
+}
+
+// DeriveFingerprint derives the settings reproducing the fingerprint of a
+// browser capture. The HAR headers take precedence over the ones of the
+// HTTP/2 frames, which only fill in what the HAR lacks.
+func (c *SessionController) DeriveFingerprint(capture *common.FingerprintCapture) (*common.DerivedFingerprint, error) {
+	if len(capture.HAR) == 0 && capture.ClientHello == "" && capture.HTTP2Frames == "" {
+		return nil, errors.New("a HAR, ClientHello or HTTP/2 frames capture is required")
+	}
+
+	var (
+		derived common.DerivedFingerprint
+		headers [][]string
+		http2   *fingerprint.HTTP2
+	)
+
+	if len(capture.HAR) > 0 {
+		request, err := fingerprint.ParseHAR(capture.HAR, capture.URL)
+		if err != nil {
+			return nil, err
+		}
+		headers = request.Headers
+	}
+
+	if capture.ClientHello != "" {
+		raw, err := decodeHexCapture(capture.ClientHello)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ClientHello: %w", err)
+		}
+		if len(raw) > 5 && raw[0] == recordTypeHandshake {
+			raw = raw[5:]
+		}
+
+		hello, err := fingerprint.ParseClientHello(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ClientHello: %w", err)
+		}
+		derived.ClientHello = clientHelloSummary(hello)
+		derived.Profile.JA3 = hello.JA3()
+	}
+
+	if capture.HTTP2Frames != "" {
+		raw, err := decodeHexCapture(capture.HTTP2Frames)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP/2 frames: %w", err)
+		}
+
+		var frameHeaders [][]string
+		if http2, frameHeaders, err = fingerprint.ParseHTTP2Frames(raw); err != nil {
+			return nil, err
+		}
+		if headers == nil {
+			headers = frameHeaders
+		}
+	}
+
+	var pseudoHeaderOrder []string
+	for _, header := range headers {
+		name := header[0]
+		switch {
+		case strings.HasPrefix(name, ":"):
+			pseudoHeaderOrder = append(pseudoHeaderOrder, name)
+			continue
+		case name == "user-agent":
+			derived.Profile.UserAgent = header[1]
+		case requestHeaders[name]:
+			continue
+		}
+		derived.Profile.OrderedHeaders = append(derived.Profile.OrderedHeaders, header)
+	}
+
+	if http2 != nil {
+		if len(http2.PseudoHeaderOrder) == 0 {
+			http2.PseudoHeaderOrder = pseudoHeaderOrder
+		}
+		pseudoHeaderOrder = http2.PseudoHeaderOrder
+		derived.Profile.HTTP2 = http2.Akamai()
+		derived.AkamaiHash = http2.AkamaiHash()
+	}
+	derived.PseudoHeaderOrder = pseudoHeaderOrder
+
+	if derived.Profile.UserAgent != "" {
+		derived.Profile.Browser = navigatorOf(derived.Profile.UserAgent)
+		derived.Profile.Navigator = derived.Profile.Browser
+	}
+
+	return &derived, nil
+}
+
+// decodeHexCapture decodes a hex dump, ignoring whitespace and the colons
+// some tools separate bytes with
+func decodeHexCapture(dump string) ([]byte, error) {
+	dump = strings.Map(func(r rune) rune {
+		if r == ':' || r == ' ' || r == '\t' || r == '\n' || r == '\r' {
+			return -1
+		}
+		return r
+	}, strings.TrimPrefix(dump, "0x"))
+
+	return hex.DecodeString(dump)
+}
+
+// navigatorOf returns the azuretls navigator matching a User-Agent
+func navigatorOf(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "Firefox/"):
+		return azuretls.Firefox
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		return azuretls.Ios
+	case strings.Contains(userAgent, "Edg/"):
+		return azuretls.Edge
+	case strings.Contains(userAgent, "OPR/"):
+		return azuretls.Opera
+	case strings.Contains(userAgent, "Chrome/"):
+		return azuretls.Chrome
+	case strings.Contains(userAgent, "Safari/"):
+		return azuretls.Safari
+	default:
+		return azuretls.Chrome
+	}
+}
@@ -0,0 +1,238 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/utils"
+	"github.com/Noooste/azuretls-client"
+)
+
+const (
+	HealthStatusHealthy   = "healthy"
+	HealthStatusDegraded  = "degraded"
+	HealthStatusUnhealthy = "unhealthy"
+	HealthStatusSkipped   = "skipped"
+
+	// degradedRatio is the usage ratio above which a bounded resource is reported as degraded
+	degradedRatio = 0.9
+
+	defaultHealthCheckTimeout = 10 * time.Second
+)
+
+// ComponentHealth describes the state of a single server component
+type ComponentHealth struct {
+	Status  string         `json:"status"`
+	Message string         `json:"message,omitempty"`
+	Details map[string]any `json:"details,omitempty"`
+}
+
+// CheckSessions reports session usage against the configured maximum
+func (c *SessionController) CheckSessions(maxSessions int) ComponentHealth {
+	count := len(c.ListSessions())
+
+	component := ComponentHealth{
+		Status: HealthStatusHealthy,
+		Details: map[string]any{
+			"active": count,
+			"max":    maxSessions,
+		},
+	}
+
+	if maxSessions > 0 && float64(count) >= float64(maxSessions)*degradedRatio {
+		component.Status = HealthStatusDegraded
+		component.Message = "session count is close to the configured maximum"
+	}
+
+	return component
+}
+
+// CheckLimiter reports concurrent request usage against the limiter capacity
+func (c *SessionController) CheckLimiter(inFlight, capacity int) ComponentHealth {
+	if inFlight < 0 {
+		inFlight = 0
+	}
+
+	component := ComponentHealth{
+		Status: HealthStatusHealthy,
+		Details: map[string]any{
+			"in_flight": inFlight,
+			"capacity":  capacity,
+		},
+	}
+
+	if capacity > 0 && float64(inFlight) >= float64(capacity)*degradedRatio {
+		component.Status = HealthStatusDegraded
+		component.Message = "concurrent request limit is nearly saturated"
+	}
+
+	return component
+}
+
+// CheckStore verifies that the body store and the download manager can
+// write new bodies and artifacts
+func (c *SessionController) CheckStore() ComponentHealth {
+	if c.bodies == nil && c.downloads == nil {
+		return ComponentHealth{
+			Status:  HealthStatusSkipped,
+			Message: "body store and downloads are disabled",
+		}
+	}
+
+	details := map[string]any{
+		"bodies":    c.bodies != nil,
+		"downloads": c.downloads != nil,
+	}
+
+	if c.bodies != nil {
+		if err := c.bodies.Check(); err != nil {
+			return ComponentHealth{
+				Status:  HealthStatusUnhealthy,
+				Message: fmt.Sprintf("body store check failed: %v", err),
+				Details: details,
+			}
+		}
+	}
+
+	if c.downloads != nil {
+		if err := c.downloads.Check(); err != nil {
+			return ComponentHealth{
+				Status:  HealthStatusUnhealthy,
+				Message: fmt.Sprintf("download store check failed: %v", err),
+				Details: details,
+			}
+		}
+	}
+
+	return ComponentHealth{
+		Status:  HealthStatusHealthy,
+		Details: details,
+	}
+}
+
+// CheckEgress performs a real outbound request through a throwaway session,
+// verifying the DNS, proxy and TLS paths used by regular requests
+func (c *SessionController) CheckEgress(targetURL, proxy string, timeout time.Duration) ComponentHealth {
+	if targetURL == "" {
+		return ComponentHealth{
+			Status:  HealthStatusSkipped,
+			Message: "no health check URL configured",
+		}
+	}
+
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+
+	parsedURL, err := url.Parse(targetURL)
+	if err != nil || parsedURL.Hostname() == "" {
+		return ComponentHealth{
+			Status:  HealthStatusUnhealthy,
+			Message: fmt.Sprintf("invalid health check URL: %s", targetURL),
+		}
+	}
+
+	details := map[string]any{
+		"url": targetURL,
+	}
+
+	// When a proxy is used, name resolution for the target happens on the proxy side
+	if proxy == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		dnsStart := time.Now()
+		if _, err := net.DefaultResolver.LookupHost(ctx, parsedURL.Hostname()); err != nil {
+			return ComponentHealth{
+				Status:  HealthStatusUnhealthy,
+				Message: fmt.Sprintf("dns lookup failed: %v", err),
+				Details: details,
+			}
+		}
+		details["dns_ms"] = time.Since(dnsStart).Milliseconds()
+	} else {
+		details["proxy"] = true
+	}
+
+	tempSessionID := common.GenerateSessionID()
+	session, err := c.sessionManager.CreateSession(tempSessionID)
+	if err != nil {
+		return ComponentHealth{
+			Status:  HealthStatusUnhealthy,
+			Message: fmt.Sprintf("failed to create probe session: %v", err),
+			Details: details,
+		}
+	}
+	defer func() {
+		_ = c.sessionManager.DeleteSession(tempSessionID)
+	}()
+
+	if proxy != "" {
+		if err := session.SetProxy(proxy); err != nil {
+			return ComponentHealth{
+				Status:  HealthStatusUnhealthy,
+				Message: fmt.Sprintf("invalid proxy: %v", err),
+				Details: details,
+			}
+		}
+	}
+
+	start := time.Now()
+	resp, err := session.Do(&azuretls.Request{
+		Method:  "GET",
+		Url:     targetURL,
+		TimeOut: timeout,
+	})
+	latency := time.Since(start)
+	details["latency_ms"] = latency.Milliseconds()
+
+	if err != nil {
+		return ComponentHealth{
+			Status:  HealthStatusUnhealthy,
+			Message: fmt.Sprintf("egress request failed: %v", err),
+			Details: details,
+		}
+	}
+	details["status_code"] = resp.StatusCode
+
+	component := ComponentHealth{
+		Status:  HealthStatusHealthy,
+		Details: details,
+	}
+
+	if resp.StatusCode >= 500 {
+		component.Status = HealthStatusDegraded
+		component.Message = fmt.Sprintf("health check URL answered with status %d", resp.StatusCode)
+	} else if latency > timeout/2 {
+		component.Status = HealthStatusDegraded
+		component.Message = "egress latency is high"
+	}
+
+	return component
+}
+
+// GetDeepHealthInfo aggregates component health into an overall status
+func (c *SessionController) GetDeepHealthInfo(components map[string]ComponentHealth) map[string]any {
+	status := HealthStatusHealthy
+	for _, component := range components {
+		switch component.Status {
+		case HealthStatusUnhealthy:
+			status = HealthStatusUnhealthy
+		case HealthStatusDegraded:
+			if status == HealthStatusHealthy {
+				status = HealthStatusDegraded
+			}
+		}
+	}
+
+	return map[string]any{
+		"status":           status,
+		"components":       components,
+		"timestamp":        time.Now().UTC(),
+		"azuretls_version": utils.GetAzureTLSVersion(),
+	}
+}
@@ -0,0 +1,133 @@
+package controller
+
+import (
+	"encoding/base64"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/curl"
+	"github.com/Noooste/azuretls-api/internal/signing"
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// sentRequest describes a request as the session is about to send it, with
+// the cookies the jar holds at that time. Streamed bodies are omitted.
+func sentRequest(session *azuretls.Session, req *azuretls.Request) *common.SentRequest {
+	u, err := url.Parse(req.Url)
+	if err != nil {
+		return nil
+	}
+
+	method := strings.ToUpper(req.Method)
+	if method == "" {
+		method = fhttp.MethodGet
+	}
+
+	sent := &common.SentRequest{
+		Time:               time.Now().UTC(),
+		Method:             method,
+		URL:                u.String(),
+		Headers:            renderHeaders(session, req, u),
+		ForceHTTP1:         req.ForceHTTP1,
+		ForceHTTP3:         req.ForceHTTP3,
+		InsecureSkipVerify: req.InsecureSkipVerify,
+	}
+
+	switch body := req.Body.(type) {
+	case nil:
+	case string:
+		sent.Body = body
+	case []byte:
+		sent.BodyB64 = base64.StdEncoding.EncodeToString(body)
+	default:
+		sent.BodyOmitted = true
+	}
+
+	if session.Proxy != "" {
+		sent.Proxy = redactProxy(session.Proxy)
+	}
+
+	return sent
+}
+
+// sensitiveHeaders carry credentials, redacted from the history along with
+// the signatures
+var sensitiveHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+const redacted = "[REDACTED]"
+
+// recordSent completes a sent request with its outcome and adds it to the
+// history of the session, credentials redacted. Stateless requests have no
+// history.
+func (c *SessionController) recordSent(sessionID string, sent *common.SentRequest, sign *common.SignOptions, resp *azuretls.Response, err error) {
+	if sent == nil {
+		return
+	}
+
+	if resp != nil {
+		sent.StatusCode = resp.StatusCode
+	}
+	if err != nil {
+		sent.Error = err.Error()
+	}
+
+	if sessionID != "" {
+		c.sessionManager.RecordRequest(sessionID, redactSent(*sent, sign))
+	}
+}
+
+// redactSent returns a copy of a sent request without its credentials
+func redactSent(sent common.SentRequest, sign *common.SignOptions) common.SentRequest {
+	secrets, query := signing.Secrets(sign)
+	secrets = append(secrets, sensitiveHeaders...)
+
+	headers := make([][]string, len(sent.Headers))
+	for i, header := range sent.Headers {
+		headers[i] = header
+		if len(header) > 1 && slices.ContainsFunc(secrets, func(name string) bool {
+			return strings.EqualFold(name, header[0])
+		}) {
+			headers[i] = []string{header[0], redacted}
+		}
+	}
+	sent.Headers = headers
+
+	if query != "" {
+		if u, err := url.Parse(sent.URL); err == nil && u.Query().Has(query) {
+			values := u.Query()
+			values.Set(query, redacted)
+			u.RawQuery = values.Encode()
+			sent.URL = u.String()
+		}
+	}
+
+	return sent
+}
+
+// RequestHistory returns the last requests sent by a session, newest first
+func (c *SessionController) RequestHistory(sessionID string) ([]common.SentRequest, error) {
+	if _, err := c.GetSession(sessionID); err != nil {
+		return nil, err
+	}
+
+	return c.sessionManager.GetRequestHistory(sessionID)
+}
+
+// HistoryCurl renders the nth last request of a session, 0 being the most
+// recent, as a curl command
+func (c *SessionController) HistoryCurl(sessionID string, n int) (string, error) {
+	history, err := c.RequestHistory(sessionID)
+	if err != nil {
+		return "", err
+	}
+
+	if n < 0 || n >= len(history) {
+		return "", common.ErrHistoryNotFound
+	}
+
+	return curl.Command(history[n]), nil
+}
@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// SetKeepalive registers the keepalive request of a session, replacing the
+// previous one
+func (c *SessionController) SetKeepalive(sessionID string, config common.KeepaliveConfig) (common.KeepaliveStatus, error) {
+	if c.keepalives == nil {
+		return common.KeepaliveStatus{}, common.ErrKeepalivesDisabled
+	}
+
+	if _, err := c.GetSession(sessionID); err != nil {
+		return common.KeepaliveStatus{}, err
+	}
+
+	return c.keepalives.Register(sessionID, config, c.executeSessionRequest)
+}
+
+// GetKeepalive returns the keepalive of a session and its recent failures
+func (c *SessionController) GetKeepalive(sessionID string) (common.KeepaliveStatus, error) {
+	if c.keepalives == nil {
+		return common.KeepaliveStatus{}, common.ErrKeepalivesDisabled
+	}
+
+	status, exists := c.keepalives.Status(sessionID)
+	if !exists {
+		return common.KeepaliveStatus{}, common.ErrKeepaliveNotFound
+	}
+	return status, nil
+}
+
+// DeleteKeepalive stops the keepalive of a session
+func (c *SessionController) DeleteKeepalive(sessionID string) error {
+	if c.keepalives == nil {
+		return common.ErrKeepalivesDisabled
+	}
+
+	if !c.keepalives.Stop(sessionID) {
+		return common.ErrKeepaliveNotFound
+	}
+	return nil
+}
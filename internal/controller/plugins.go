@@ -0,0 +1,26 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// ListPlugins returns the external plugins sorted by name, none when
+// plugins are disabled
+func (c *SessionController) ListPlugins() []common.PluginInfo {
+	if c.plugins == nil {
+		return []common.PluginInfo{}
+	}
+
+	return c.plugins.List()
+}
+
+// PluginEndpoints returns the handler of the custom endpoints of a plugin
+func (c *SessionController) PluginEndpoints(name string) (http.Handler, error) {
+	if c.plugins == nil {
+		return nil, common.ErrPluginsDisabled
+	}
+
+	return c.plugins.Endpoints(name)
+}
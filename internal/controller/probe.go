@@ -0,0 +1,50 @@
+package controller
+
+import (
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// AddProbe registers a target health probe, replacing the one with the same
+// name
+func (c *SessionController) AddProbe(probe common.Probe) (common.ProbeStatus, error) {
+	if c.prober == nil {
+		return common.ProbeStatus{}, common.ErrProbesDisabled
+	}
+
+	return c.prober.Add(probe)
+}
+
+// RemoveProbe stops a probe
+func (c *SessionController) RemoveProbe(name string) error {
+	if c.prober == nil {
+		return common.ErrProbesDisabled
+	}
+
+	if !c.prober.Remove(name) {
+		return common.ErrProbeNotFound
+	}
+	return nil
+}
+
+// GetProbe returns a probe and the result of its last check
+func (c *SessionController) GetProbe(name string) (common.ProbeStatus, error) {
+	if c.prober == nil {
+		return common.ProbeStatus{}, common.ErrProbesDisabled
+	}
+
+	status, exists := c.prober.Get(name)
+	if !exists {
+		return common.ProbeStatus{}, common.ErrProbeNotFound
+	}
+	return status, nil
+}
+
+// ListProbes returns the probes sorted by name, none when probes are
+// disabled
+func (c *SessionController) ListProbes() []common.ProbeStatus {
+	if c.prober == nil {
+		return []common.ProbeStatus{}
+	}
+
+	return c.prober.List()
+}
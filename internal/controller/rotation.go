@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// rotateIfDue replaces a session whose rotation policy is due with a fresh
+// one. It returns nil when no rotation is due or the replacement could not
+// be created, the session being kept in that case.
+func (c *SessionController) rotateIfDue(sessionID string, resp *common.ServerResponse) *common.SessionRotation {
+	if c.rotator == nil {
+		return nil
+	}
+
+	reason := c.rotator.Due(sessionID, resp)
+	if reason == "" {
+		return nil
+	}
+
+	config, ok := c.rotator.Replacement(sessionID)
+	if !ok {
+		return nil
+	}
+
+	replacementID := common.GenerateSessionID()
+	replacement, err := c.sessionManager.CreateSessionWithConfig(replacementID, config)
+	if err != nil {
+		common.LogError("SessionController: Failed to create the replacement of session %s: %v", sessionID, err)
+		return nil
+	}
+
+	// A concurrent request may have rotated the session first
+	if !c.rotator.Replace(sessionID, replacementID) {
+		_ = c.sessionManager.DeleteSession(replacementID)
+		return nil
+	}
+
+	if c.keepalives != nil {
+		c.keepalives.Move(sessionID, replacementID)
+	}
+	if c.scripts != nil {
+		c.scripts.Move(sessionID, replacementID)
+	}
+	if c.cookieJars != nil {
+		c.cookieJars.Move(sessionID, replacementID, replacement)
+	}
+	if c.owners != nil {
+		c.owners.Move(sessionID, replacementID)
+	}
+
+	if err := c.DeleteSession(sessionID); err != nil {
+		common.LogWarn("SessionController: Failed to delete rotated session %s: %v", sessionID, err)
+	}
+
+	common.LogInfo("SessionController: Rotated session %s to %s (%s)", sessionID, replacementID, reason)
+
+	return &common.SessionRotation{
+		SessionID:         replacementID,
+		PreviousSessionID: sessionID,
+		Reason:            reason,
+	}
+}
@@ -0,0 +1,103 @@
+package controller
+
+import (
+	"slices"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// ListScripts returns the scripts sorted by name, none when scripts are
+// disabled
+func (c *SessionController) ListScripts() []common.ScriptInfo {
+	if c.scripts == nil {
+		return []common.ScriptInfo{}
+	}
+
+	return c.scripts.List()
+}
+
+// GetScript returns a script with its source
+func (c *SessionController) GetScript(name string) (common.Script, error) {
+	if c.scripts == nil {
+		return common.Script{}, common.ErrScriptsDisabled
+	}
+
+	script, exists := c.scripts.Get(name)
+	if !exists {
+		return common.Script{}, common.ErrScriptNotFound
+	}
+	return script, nil
+}
+
+// PutScript compiles and stores a script, replacing the one with the same
+// name
+func (c *SessionController) PutScript(name, source string) (common.ScriptInfo, error) {
+	if c.scripts == nil {
+		return common.ScriptInfo{}, common.ErrScriptsDisabled
+	}
+
+	return c.scripts.Put(name, source)
+}
+
+// RemoveScript deletes a script, failing the requests of the sessions and
+// rules still running it
+func (c *SessionController) RemoveScript(name string) error {
+	if c.scripts == nil {
+		return common.ErrScriptsDisabled
+	}
+
+	if !c.scripts.Remove(name) {
+		return common.ErrScriptNotFound
+	}
+	return nil
+}
+
+// GetSessionScripts returns the scripts run on the requests of a session
+func (c *SessionController) GetSessionScripts(sessionID string) ([]string, error) {
+	if _, err := c.GetSession(sessionID); err != nil {
+		return nil, err
+	}
+	if c.scripts == nil {
+		return nil, common.ErrScriptsDisabled
+	}
+
+	scripts := c.scripts.SessionScripts(sessionID)
+	if scripts == nil {
+		scripts = []string{}
+	}
+	return scripts, nil
+}
+
+// SetSessionScripts replaces the scripts run on the requests of a session
+func (c *SessionController) SetSessionScripts(sessionID string, names []string) error {
+	if _, err := c.GetSession(sessionID); err != nil {
+		return err
+	}
+
+	return c.attachScripts(sessionID, names)
+}
+
+func (c *SessionController) attachScripts(sessionID string, names []string) error {
+	if c.scripts == nil {
+		return common.ErrScriptsDisabled
+	}
+
+	return c.scripts.Attach(sessionID, names)
+}
+
+// requestScripts adds the scripts of the applied rules to the scripts of
+// the session, without repeats
+func (c *SessionController) requestScripts(scripts, applied []string) []string {
+	if c.scripts == nil {
+		return nil
+	}
+
+	if c.rules != nil {
+		for _, name := range c.rules.Scripts(applied) {
+			if !slices.Contains(scripts, name) {
+				scripts = append(scripts, name)
+			}
+		}
+	}
+	return scripts
+}
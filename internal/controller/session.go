@@ -1,23 +1,80 @@
 package controller
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"github.com/Noooste/azuretls-api/internal/utils"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/curl"
+	"github.com/Noooste/azuretls-api/internal/extract"
+	"github.com/Noooste/azuretls-api/internal/fault"
+	"github.com/Noooste/azuretls-api/internal/ratelimit"
+	"github.com/Noooste/azuretls-api/internal/rules"
+	"github.com/Noooste/azuretls-api/internal/scheduler"
+	"github.com/Noooste/azuretls-api/internal/signing"
+	"github.com/Noooste/azuretls-api/internal/trace"
 	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
 )
 
 type SessionController struct {
 	sessionManager common.SessionManager
+	sessionPool    common.SessionPool
+	profiles       common.ProfileCatalog
+	faultInjector  *fault.Injector
+	rules          *rules.Engine
+	rulesErr       error
+	downloadDir    string
+	downloads      common.DownloadManager
+	monitor        common.Monitor
+	rotator        common.SessionRotator
+	keepalives     common.KeepaliveScheduler
+	prober         common.Prober
+	plugins        common.PluginManager
+	scripts        common.ScriptRunner
+	scheduler      common.RequestScheduler
+	bodies         common.BodyStore
+	cookieJars     common.CookieJarRegistry
+	owners         common.SessionOwners
+	coalescer      *coalescer
 }
 
-func NewSessionController(sessionManager common.SessionManager) *SessionController {
+func NewSessionController(server common.Server) *SessionController {
+	config := server.GetConfig()
+
+	// Servers reject invalid rules on creation, other servers fail the
+	// requests rather than sending them untransformed
+	engine, err := rules.NewEngine(config.Rules)
+	if err != nil {
+		common.LogError("SessionController: Invalid request rules, requests will fail: %v", err)
+	}
+
 	return &SessionController{
-		sessionManager: sessionManager,
+		sessionManager: server.GetSessionManager(),
+		sessionPool:    server.GetSessionPool(),
+		profiles:       server.GetProfileCatalog(),
+		faultInjector:  fault.NewInjector(config.FaultInjection),
+		rules:          engine,
+		rulesErr:       err,
+		downloadDir:    config.DownloadDir,
+		downloads:      server.GetDownloadManager(),
+		monitor:        server.GetMonitor(),
+		rotator:        server.GetSessionRotator(),
+		keepalives:     server.GetKeepaliveScheduler(),
+		prober:         server.GetProber(),
+		plugins:        server.GetPluginManager(),
+		scripts:        server.GetScriptRunner(),
+		scheduler:      server.GetRequestScheduler(),
+		bodies:         server.GetBodyStore(),
+		cookieJars:     server.GetCookieJars(),
+		owners:         server.GetSessionOwners(),
+		coalescer:      newCoalescer(),
 	}
 }
 
@@ -41,9 +98,45 @@ func (c *SessionController) CreateSession(config *common.SessionConfig) (string,
 		return "", nil, fmt.Errorf("session creation returned nil")
 	}
 
+	if config != nil && len(config.Scripts) > 0 {
+		if err := c.attachScripts(sessionID, config.Scripts); err != nil {
+			_ = c.sessionManager.DeleteSession(sessionID)
+			return "", nil, fmt.Errorf("failed to create session: %w", err)
+		}
+	}
+
+	if config != nil && config.CookieJar != "" {
+		if err := c.BindCookieJar(sessionID, config.CookieJar); err != nil {
+			_ = c.DeleteSession(sessionID)
+			return "", nil, fmt.Errorf("failed to create session: %w", err)
+		}
+	}
+
+	if c.rotator != nil {
+		c.rotator.Track(sessionID, config)
+	}
+
 	return sessionID, session, nil
 }
 
+// CreateSessions creates one session per config, carrying on past the
+// failing ones, and returns a result per config in the same order
+func (c *SessionController) CreateSessions(configs []*common.SessionConfig) []common.BulkSessionResult {
+	results := make([]common.BulkSessionResult, len(configs))
+	for i, config := range configs {
+		results[i].Proxy = redactProxy(config.Proxy)
+
+		sessionID, _, err := c.CreateSession(config)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].SessionID = sessionID
+	}
+
+	return results
+}
+
 // GetSession retrieves a session by ID
 func (c *SessionController) GetSession(sessionID string) (*azuretls.Session, error) {
 	if sessionID == "" {
@@ -64,9 +157,46 @@ func (c *SessionController) DeleteSession(sessionID string) error {
 		return fmt.Errorf("session ID required")
 	}
 
+	c.forget(sessionID)
+
+	// The pool replaces the sessions deleted by their holder
+	if c.sessionPool != nil && c.sessionPool.Contains(sessionID) {
+		c.sessionPool.Remove(sessionID)
+	}
+
 	return c.sessionManager.DeleteSession(sessionID)
 }
 
+// forget drops what the server keeps about a session besides the session
+// manager
+func (c *SessionController) forget(sessionID string) {
+	if c.downloads != nil {
+		if canceled := c.downloads.CancelSession(sessionID); canceled > 0 {
+			common.LogDebug("SessionController: Canceled %d downloads of session %s", canceled, sessionID)
+		}
+	}
+
+	if c.rotator != nil {
+		c.rotator.Forget(sessionID)
+	}
+
+	if c.keepalives != nil {
+		c.keepalives.Stop(sessionID)
+	}
+
+	if c.scripts != nil {
+		c.scripts.Forget(sessionID)
+	}
+
+	if c.cookieJars != nil {
+		c.cookieJars.Forget(sessionID)
+	}
+
+	if c.owners != nil {
+		c.owners.Forget(sessionID)
+	}
+}
+
 // ListSessions returns all active session IDs
 func (c *SessionController) ListSessions() []string {
 	return c.sessionManager.ListSessions()
@@ -74,6 +204,45 @@ func (c *SessionController) ListSessions() []string {
 
 // ExecuteRequest processes a request using the specified session
 func (c *SessionController) ExecuteRequest(sessionID string, serverReq *common.ServerRequest) *common.ServerResponse {
+	if serverReq.Options.DryRun {
+		return c.executeSessionRequest(sessionID, serverReq)
+	}
+
+	if key := coalesceKey(sessionID, nil, serverReq); key != "" {
+		return c.coalescer.do(key, serverReq, func() *common.ServerResponse {
+			return c.rotateAndExecute(sessionID, serverReq)
+		})
+	}
+	return c.rotateAndExecute(sessionID, serverReq)
+}
+
+// rotateAndExecute executes a request, rotating the session when due
+func (c *SessionController) rotateAndExecute(sessionID string, serverReq *common.ServerRequest) *common.ServerResponse {
+	// Sessions past their age are replaced before the request, the others
+	// once its response tells whether the rotation is due
+	rotation := c.rotateIfDue(sessionID, nil)
+	if rotation != nil {
+		sessionID = rotation.SessionID
+	}
+
+	if c.keepalives != nil {
+		c.keepalives.Touch(sessionID)
+	}
+
+	serverResp := c.executeSessionRequest(sessionID, serverReq)
+
+	if after := c.rotateIfDue(sessionID, serverResp); after != nil {
+		if rotation != nil {
+			after.PreviousSessionID = rotation.PreviousSessionID
+		}
+		rotation = after
+	}
+	serverResp.Rotation = rotation
+
+	return serverResp
+}
+
+func (c *SessionController) executeSessionRequest(sessionID string, serverReq *common.ServerRequest) *common.ServerResponse {
 	serverResp := &common.ServerResponse{
 		ID: serverReq.ID,
 	}
@@ -84,13 +253,41 @@ func (c *SessionController) ExecuteRequest(sessionID string, serverReq *common.S
 		return serverResp
 	}
 
-	return c.executeRequestWithSession(session, serverReq)
+	tags, err := c.sessionManager.GetSessionTags(sessionID)
+	if err != nil {
+		serverResp.Error = err.Error()
+		return serverResp
+	}
+
+	var scripts []string
+	if c.scripts != nil {
+		scripts = c.scripts.SessionScripts(sessionID)
+	}
+
+	return c.executeRequestWithSession(sessionID, session, serverReq, tags, scripts)
+}
+
+// ExecuteStatelessRequest creates a temporary session, with the optional
+// configuration, and executes the request
+func (c *SessionController) ExecuteStatelessRequest(serverReq *common.ServerRequest, config *common.SessionConfig) *common.ServerResponse {
+	if key := coalesceKey("", config, serverReq); key != "" {
+		return c.coalescer.do(key, serverReq, func() *common.ServerResponse {
+			return c.executeStatelessRequest(serverReq, config)
+		})
+	}
+	return c.executeStatelessRequest(serverReq, config)
 }
 
-// ExecuteStatelessRequest creates a temporary session and executes the request
-func (c *SessionController) ExecuteStatelessRequest(serverReq *common.ServerRequest) *common.ServerResponse {
+func (c *SessionController) executeStatelessRequest(serverReq *common.ServerRequest, config *common.SessionConfig) *common.ServerResponse {
 	tempSessionID := common.GenerateSessionID()
-	session, err := c.sessionManager.CreateSession(tempSessionID)
+
+	var session *azuretls.Session
+	var err error
+	if config != nil {
+		session, err = c.sessionManager.CreateSessionWithConfig(tempSessionID, config)
+	} else {
+		session, err = c.sessionManager.CreateSession(tempSessionID)
+	}
 	if err != nil {
 		return &common.ServerResponse{
 			ID:    serverReq.ID,
@@ -105,64 +302,157 @@ func (c *SessionController) ExecuteStatelessRequest(serverReq *common.ServerRequ
 		}
 	}(c.sessionManager, tempSessionID)
 
-	return c.executeRequestWithSession(session, serverReq)
+	var tags, scripts []string
+	if config != nil {
+		tags = config.Tags
+		scripts = config.Scripts
+
+		if config.CookieJar != "" {
+			if c.cookieJars == nil {
+				return &common.ServerResponse{ID: serverReq.ID, Error: common.ErrCookieJarsDisabled.Error()}
+			}
+			if err := c.cookieJars.Bind(tempSessionID, session, config.CookieJar); err != nil {
+				return &common.ServerResponse{ID: serverReq.ID, Error: fmt.Sprintf("Failed to bind cookie jar: %v", err)}
+			}
+			defer c.cookieJars.Forget(tempSessionID)
+		}
+	}
+
+	return c.executeRequestWithSession("", session, serverReq, tags, scripts)
 }
 
-// executeRequestWithSession handles the actual request execution
-func (c *SessionController) executeRequestWithSession(session *azuretls.Session, serverReq *common.ServerRequest) *common.ServerResponse {
+// executeRequestWithSession handles the actual request execution, running
+// the given scripts before the ones of the matching rules
+func (c *SessionController) executeRequestWithSession(sessionID string, session *azuretls.Session, serverReq *common.ServerRequest, tags, scripts []string) *common.ServerResponse {
 	serverResp := &common.ServerResponse{
 		ID: serverReq.ID,
 	}
 
-	if serverReq.Body != "" && serverReq.BodyB64 != nil {
-		serverResp.Error = "Both `body` and `body_b64` cannot be set"
+	selection, err := common.ParseFields(serverReq.Options.Fields)
+	if err != nil {
+		serverResp.Error = err.Error()
 		return serverResp
 	}
+	serverResp.Selection = selection
 
-	azureReq := &azuretls.Request{
-		Method: serverReq.Method,
-		Url:    serverReq.URL,
-		Body:   serverReq.Body,
+	extractor, err := extract.New(serverReq.Options.Extract)
+	if err != nil {
+		serverResp.Error = fmt.Sprintf("Invalid extract option: %v", err)
+		return serverResp
 	}
 
-	// Handle base64 encoded body
-	if serverReq.BodyB64 != nil {
-		azureReq.Body = serverReq.BodyB64
-	} else if serverReq.Body != "" {
-		azureReq.Body = serverReq.Body
+	azureReq, scripts, applied, err := c.prepareRequest(sessionID, session, serverReq, tags, scripts)
+	serverResp.AppliedRules = applied
+	if err != nil {
+		serverResp.Error = err.Error()
+		return serverResp
 	}
 
-	// Handle headers
-	if len(serverReq.OrderedHeaders) > 0 {
-		azureReq.OrderedHeaders = make(azuretls.OrderedHeaders, len(serverReq.OrderedHeaders))
-		for i, header := range serverReq.OrderedHeaders {
-			azureReq.OrderedHeaders[i] = header
+	if len(serverReq.Options.ALPN) > 0 {
+		fork, release, err := c.alpnSession(sessionID, session, serverReq.Options.ALPN)
+		if err != nil {
+			serverResp.Error = fmt.Sprintf("Failed to set up ALPN: %v", err)
+			return serverResp
 		}
-	} else if len(serverReq.Headers.Keys) > 0 {
-		azureReq.Header = make(map[string][]string)
-		for _, value := range serverReq.Headers.Keys {
-			if value == "Keys" || value == "Values" {
-				continue
-			}
+		defer release()
+		session = fork
+	}
 
-			switch v := serverReq.Headers.Values[value].(type) {
-			case string:
-				azureReq.Header[value] = []string{v}
-			case []string:
-				azureReq.Header[value] = v
-			default:
-				serverResp.Error = fmt.Sprintf("Invalid header value type for key %s of type %T", value, v)
-				return serverResp
+	if len(serverReq.Trailers) > 0 {
+		fork, release, err := c.trailersSession(sessionID, session)
+		if err != nil {
+			serverResp.Error = fmt.Sprintf("Failed to set up trailers: %v", err)
+			return serverResp
+		}
+		defer release()
+		session = fork
+	}
+
+	if serverReq.Options.DryRun {
+		if err := signing.Sign(azureReq, session, serverReq.Options.Sign, time.Now()); err != nil {
+			serverResp.Error = fmt.Sprintf("Failed to sign request: %v", err)
+			return serverResp
+		}
+
+		dryRun, err := renderRequest(session, azureReq, serverReq)
+		if err != nil {
+			serverResp.Error = fmt.Sprintf("Failed to render request: %v", err)
+			return serverResp
+		}
+
+		serverResp.DryRun = dryRun
+		if serverReq.Options.Curl {
+			if sent := sentRequest(session, azureReq); sent != nil {
+				serverResp.Curl = curl.Command(*sent)
 			}
 		}
+		return serverResp
 	}
 
-	if err := c.applyRequestOptions(azureReq, session, &serverReq.Options); err != nil {
-		serverResp.Error = fmt.Sprintf("Failed to apply request options: %v", err)
+	injected, delay := c.faultInjector.Apply(serverReq.ID)
+	if injected != nil {
+		return injected
+	}
+	if delay > 0 {
+		serverResp.Fault = fault.KindLatency
+	}
+
+	release := func() {}
+	if c.scheduler != nil {
+		ctx := session.Context()
+		if ctx == nil {
+			ctx = context.Background()
+		}
+
+		release, err = c.scheduler.Acquire(ctx, serverReq.Options.Priority)
+		if err != nil {
+			serverResp.Error = fmt.Sprintf("Failed to schedule request: %v", err)
+			return serverResp
+		}
+	}
+
+	// Signed last, as signatures usually expire
+	if err := signing.Sign(azureReq, session, serverReq.Options.Sign, time.Now()); err != nil {
+		release()
+		serverResp.Error = fmt.Sprintf("Failed to sign request: %v", err)
 		return serverResp
 	}
 
-	resp, err := session.Do(azureReq)
+	sent := sentRequest(session, azureReq)
+	start := time.Now()
+
+	var recorder *trace.Recorder
+	ctx := session.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if serverReq.Options.Trace {
+		recorder = trace.NewRecorder()
+		ctx = recorder.WithContext(ctx)
+	}
+	if len(serverReq.Trailers) > 0 {
+		ctx = withTrailers(ctx, serverReq.Trailers)
+	}
+
+	var resp *azuretls.Response
+	if serverReq.Options.Download != nil {
+		// Every chunk request of the download is traced
+		resp, serverResp.Download, err = c.download(ctx, session, azureReq, serverReq.Options.Download, serverReq.OnProgress)
+	} else {
+		if recorder != nil || len(serverReq.Trailers) > 0 {
+			azureReq.SetContext(ctx)
+		}
+		resp, err = session.Do(azureReq)
+	}
+	if recorder != nil {
+		serverResp.Trace = recorder.Result()
+	}
+	release()
+	c.record(sessionID, azureReq, start, resp, err)
+	c.recordSent(sessionID, sent, serverReq.Options.Sign, resp, err)
+	if serverReq.Options.Curl && sent != nil {
+		serverResp.Curl = curl.Command(*sent)
+	}
 	if err != nil {
 		serverResp.Error = err.Error()
 		return serverResp
@@ -171,18 +461,62 @@ func (c *SessionController) executeRequestWithSession(session *azuretls.Session,
 	serverResp.StatusCode = resp.StatusCode
 	serverResp.Status = resp.Status
 	serverResp.URL = resp.Url
+	if resp.HttpResponse != nil {
+		serverResp.Protocol = resp.HttpResponse.Proto
+	}
 
-	// Handle response body
-	if resp.Body != nil {
-		if !common.IsBinaryContent(http.Header(resp.Header), resp.Body) {
-			serverResp.Body = string(resp.Body)
-			return serverResp
+	// Text bodies are transcoded to UTF-8 so that clients and extractions
+	// do not have to deal with the original charset
+	body := resp.Body
+	binary := body != nil && common.IsBinaryContent(http.Header(resp.Header), body)
+	if body != nil && !binary {
+		body, serverResp.Charset = common.DecodeText(http.Header(resp.Header), body)
+	}
+
+	if len(scripts) > 0 {
+		scriptResp := &common.ScriptResponse{
+			StatusCode: resp.StatusCode,
+			URL:        resp.Url,
+			Headers:    http.Header(resp.Header),
+			Body:       body,
+		}
+		serverResp.ScriptErrors = c.scripts.OnResponse(scripts, scriptResp, sessionID)
+		serverResp.ScriptData = scriptResp.Data
+		resp.Header = fhttp.Header(scriptResp.Headers)
+		if body != nil || len(scriptResp.Body) > 0 {
+			body = scriptResp.Body
 		}
+	}
+
+	if extractor != nil {
+		serverResp.Extracted, serverResp.ExtractErrors = extractor.Apply(body)
+	}
 
-		// For binary content, encode body as base64
-		serverResp.BodyB64 = base64.StdEncoding.EncodeToString(resp.Body)
+	// Serializing the body is skipped when the client does not want it
+	dropBody := serverReq.Options.Extract != nil && serverReq.Options.Extract.DropBody
+	if body != nil && selection.Includes("body") && !dropBody {
+		switch {
+		case serverReq.Options.BodyRef:
+			// The body is stored for GET /api/v1/bodies/{ref} instead
+			stored, err := c.storeBody(http.Header(resp.Header), body, serverResp.Charset != "")
+			if err != nil {
+				serverResp.Error = fmt.Sprintf("Failed to store body: %v", err)
+				return serverResp
+			}
+			serverResp.BodyRef = stored.Ref
+			serverResp.BodySize = stored.Size
+		case !binary:
+			serverResp.Body = string(body)
+		default:
+			// For binary content, encode body as base64
+			serverResp.BodyB64 = base64.StdEncoding.EncodeToString(body)
+		}
 	}
 
+	// Text responses only return headers and cookies on demand, binary ones
+	// always did. They are kept for rotation and probes all the same.
+	serverResp.OmitHeaders = body != nil && !binary && !serverReq.Options.BodyRef && !serverReq.Options.IncludeHeaders && selection == nil
+
 	if resp.Header != nil {
 		serverResp.Headers = make(map[string][]string)
 		for key, values := range resp.Header {
@@ -190,9 +524,29 @@ func (c *SessionController) executeRequestWithSession(session *azuretls.Session,
 		}
 	}
 
-	if len(resp.Cookies) > 0 {
-		serverResp.Cookies = make([]common.Cookie, len(resp.Cookies))
-		for i, cookie := range resp.HttpResponse.Cookies() {
+	serverResp.RateLimit = ratelimit.Parse(http.Header(resp.Header), resp.StatusCode, time.Now())
+
+	// Trailers are only known once the body has been read, which azuretls
+	// does before returning. Declared trailers the target did not send are
+	// left out.
+	if resp.HttpResponse != nil {
+		for key, values := range resp.HttpResponse.Trailer {
+			if len(values) == 0 {
+				continue
+			}
+			if serverResp.Trailers == nil {
+				serverResp.Trailers = make(map[string][]string)
+			}
+			serverResp.Trailers[key] = values
+		}
+	}
+
+	// Responses assembled by the server, such as downloads, may not carry
+	// the response they were built from
+	if len(resp.Cookies) > 0 && resp.HttpResponse != nil {
+		cookies := resp.HttpResponse.Cookies()
+		serverResp.Cookies = make([]common.Cookie, len(cookies))
+		for i, cookie := range cookies {
 			serverResp.Cookies[i] = common.Cookie{
 				Name:     cookie.Name,
 				Value:    cookie.Value,
@@ -219,18 +573,195 @@ func (c *SessionController) executeRequestWithSession(session *azuretls.Session,
 	return serverResp
 }
 
-func (c *SessionController) applyRequestOptions(req *azuretls.Request, sess *azuretls.Session, options *common.RequestOptions) error {
+// prepareRequest runs the steps every request goes through before being
+// sent: the plugins, the request rules and options, then the on_request
+// hooks of the given scripts and of the rules applied. It returns the
+// request, the scripts to run on its response and the rules applied.
+func (c *SessionController) prepareRequest(sessionID string, session *azuretls.Session, serverReq *common.ServerRequest, tags, scripts []string) (*azuretls.Request, []string, []string, error) {
+	if c.plugins != nil {
+		if err := c.plugins.MutateRequest(serverReq, sessionID, tags); err != nil {
+			return nil, nil, nil, fmt.Errorf("Failed to apply plugins: %v", err)
+		}
+	}
+
+	azureReq, applied, err := c.buildRequest(sessionID, session, serverReq, tags)
+	if err != nil {
+		return nil, nil, applied, err
+	}
+
+	// Rules may set the priority
+	if _, err := scheduler.Level(serverReq.Options.Priority); err != nil {
+		return nil, nil, applied, err
+	}
+
+	scripts = c.requestScripts(scripts, applied)
+	if len(scripts) > 0 {
+		if err := c.scripts.OnRequest(scripts, azureReq, session, sessionID, tags); err != nil {
+			return nil, nil, applied, fmt.Errorf("Failed to run scripts: %v", err)
+		}
+	}
+
+	return azureReq, scripts, applied, nil
+}
+
+// buildRequest converts a server request to an azuretls request, applying
+// the request rules and options. It returns the names of the rules applied.
+func (c *SessionController) buildRequest(sessionID string, session *azuretls.Session, serverReq *common.ServerRequest, tags []string) (*azuretls.Request, []string, error) {
+	if serverReq.Body != "" && serverReq.BodyB64 != nil {
+		return nil, nil, fmt.Errorf("Both `body` and `body_b64` cannot be set")
+	}
+
+	if serverReq.BodyStream != nil && serverReq.Options.Download != nil {
+		return nil, nil, fmt.Errorf("A streamed body cannot be sent with the `download` option, which repeats the request")
+	}
+
+	azureReq := &azuretls.Request{
+		Method: serverReq.Method,
+		Url:    serverReq.URL,
+		Body:   serverReq.Body,
+	}
+
+	// Handle base64 encoded body
+	if serverReq.BodyStream != nil {
+		azureReq.Body = serverReq.BodyStream
+	} else if serverReq.BodyB64 != nil {
+		azureReq.Body = serverReq.BodyB64
+	} else if serverReq.Body != "" {
+		azureReq.Body = serverReq.Body
+	}
+
+	// Handle headers
+	if len(serverReq.OrderedHeaders) > 0 {
+		headers, err := mergeOrderedHeaders(session, serverReq.OrderedHeaders, serverReq.Options.HeaderMerge)
+		if err != nil {
+			return nil, nil, err
+		}
+		azureReq.OrderedHeaders = headers
+	} else if len(serverReq.Headers.Keys) > 0 {
+		azureReq.Header = make(map[string][]string)
+		for _, value := range serverReq.Headers.Keys {
+			if value == "Keys" || value == "Values" {
+				continue
+			}
+
+			switch v := serverReq.Headers.Values[value].(type) {
+			case string:
+				azureReq.Header[value] = []string{v}
+			case []string:
+				azureReq.Header[value] = v
+			default:
+				return nil, nil, fmt.Errorf("Invalid header value type for key %s of type %T", value, v)
+			}
+		}
+	}
+
+	if c.rulesErr != nil {
+		return nil, nil, fmt.Errorf("Failed to apply request rules: %v", c.rulesErr)
+	}
+
+	var applied []string
+	if c.rules != nil {
+		var err error
+		if applied, err = c.rules.Apply(azureReq, session, &serverReq.Options, tags); err != nil {
+			return nil, nil, fmt.Errorf("Failed to apply request rules: %v", err)
+		}
+	}
+
+	if err := c.applyRequestOptions(sessionID, azureReq, session, &serverReq.Options); err != nil {
+		return nil, applied, fmt.Errorf("Failed to apply request options: %v", err)
+	}
+
+	// Rules may set the options trailers cannot be sent with
+	if err := validateTrailers(serverReq); err != nil {
+		return nil, applied, err
+	}
+
+	return azureReq, applied, nil
+}
+
+// mergeOrderedHeaders combines the ordered headers of a request with those
+// of the session into the headers of that request, leaving the session
+// untouched. Prepended headers come first, followed by the session ones
+// the request does not set. Appended headers follow the session ones,
+// those the session also sets taking their place. Empty entries are
+// skipped, as azuretls does.
+func mergeOrderedHeaders(session *azuretls.Session, headers [][]string, mode string) (azuretls.OrderedHeaders, error) {
+	headers = nonEmptyHeaders(headers)
+	merged := make(azuretls.OrderedHeaders, 0, len(headers))
+
+	switch mode {
+	case "", common.HeaderMergeReplace:
+		return append(merged, headers...), nil
+
+	case common.HeaderMergePrepend:
+		merged = append(merged, headers...)
+		for _, header := range nonEmptyHeaders(rules.Headers(&azuretls.Request{}, session)) {
+			if headerIndex(headers, header[0]) < 0 {
+				merged = append(merged, header)
+			}
+		}
+
+	case common.HeaderMergeAppend:
+		sessionHeaders := nonEmptyHeaders(rules.Headers(&azuretls.Request{}, session))
+		for _, header := range sessionHeaders {
+			if i := headerIndex(headers, header[0]); i >= 0 {
+				header = headers[i]
+			}
+			merged = append(merged, header)
+		}
+		for _, header := range headers {
+			if headerIndex(sessionHeaders, header[0]) < 0 {
+				merged = append(merged, header)
+			}
+		}
+
+	default:
+		return nil, common.ErrInvalidHeaderMerge
+	}
+
+	return merged, nil
+}
+
+func nonEmptyHeaders(headers [][]string) [][]string {
+	return slices.DeleteFunc(slices.Clone(headers), func(header []string) bool {
+		return len(header) == 0
+	})
+}
+
+// headerIndex returns the position of a header, -1 when missing
+func headerIndex(headers [][]string, name string) int {
+	return slices.IndexFunc(headers, func(header []string) bool {
+		return len(header) > 0 && strings.EqualFold(header[0], name)
+	})
+}
+
+// applyRequestOptions applies the options to the request, and the proxy and
+// browser options to sess, the session stored as sessionID unless empty.
+// Dry runs leave sess as it is, rendering those two options instead.
+func (c *SessionController) applyRequestOptions(sessionID string, req *azuretls.Request, sess *azuretls.Session, options *common.RequestOptions) error {
 	if options.TimeoutMs > 0 {
 		req.TimeOut = time.Duration(options.TimeoutMs) * time.Millisecond
 	}
 
-	if options.Proxy != "" {
-		if sess.Proxy == "" || sess.Proxy != options.Proxy {
-			err := sess.SetProxy(options.Proxy)
-			if err != nil {
-				return err
-			}
+	if options.Proxy != "" && sess.Proxy != options.Proxy && !options.DryRun {
+		// The session manager refuses the proxies a session cannot use,
+		// such as those of DNS over TLS sessions
+		var err error
+		if sessionID != "" {
+			err = c.sessionManager.SetProxy(sessionID, options.Proxy)
+		} else {
+			err = sess.SetProxy(options.Proxy)
 		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := validateALPN(options); err != nil {
+		return err
+	}
+	if err := signing.Validate(options.Sign); err != nil {
+		return err
 	}
 
 	req.ForceHTTP1 = options.ForceHTTP1
@@ -244,12 +775,21 @@ func (c *SessionController) applyRequestOptions(req *azuretls.Request, sess *azu
 		req.MaxRedirects = options.MaxRedirects
 	}
 
-	if options.Browser != "" {
+	if options.Browser != "" && !options.DryRun {
 		if sess.Browser != options.Browser {
 			sess.Browser = options.Browser
 		}
 	}
 
+	if len(options.AcceptEncoding) > 0 {
+		for _, encoding := range options.AcceptEncoding {
+			if !slices.Contains(common.SupportedEncodings, encoding) {
+				return fmt.Errorf("unsupported content encoding %q (supported: %s)", encoding, strings.Join(common.SupportedEncodings, ", "))
+			}
+		}
+		rules.SetHeader(req, sess, "Accept-Encoding", strings.Join(options.AcceptEncoding, ", "))
+	}
+
 	return nil
 }
 
@@ -293,18 +833,138 @@ func (c *SessionController) ClearPins(sessionID, urlStr string) error {
 }
 
 // GetIP gets the IP address used by a session
-func (c *SessionController) GetIP(sessionID string) (string, error) {
+func (c *SessionController) GetIP(sessionID string) (*common.IPInfo, error) {
 	return c.sessionManager.GetIP(sessionID)
 }
 
+// GetDNSCache returns the DNS entries cached by a session
+func (c *SessionController) GetDNSCache(sessionID string) ([]common.DNSCacheEntry, error) {
+	return c.sessionManager.GetDNSCache(sessionID)
+}
+
+// FlushDNSCache drops the DNS entries cached by a session
+func (c *SessionController) FlushDNSCache(sessionID string) (int, error) {
+	return c.sessionManager.FlushDNSCache(sessionID)
+}
+
+// ClearTLSTickets drops the TLS session tickets cached by a session
+func (c *SessionController) ClearTLSTickets(sessionID string) (int, error) {
+	return c.sessionManager.ClearTLSTickets(sessionID)
+}
+
+// GetConnections returns the connections a session holds open
+func (c *SessionController) GetConnections(sessionID string) ([]common.SessionConnection, error) {
+	return c.sessionManager.GetConnections(sessionID)
+}
+
+// AcquireSession hands out an idle session from the pool
+func (c *SessionController) AcquireSession() (string, error) {
+	if c.sessionPool == nil {
+		return "", common.ErrPoolDisabled
+	}
+
+	return c.sessionPool.Acquire()
+}
+
+// ReleaseSession returns an acquired session to the pool, or replaces it
+// with a fresh one when discard is set
+func (c *SessionController) ReleaseSession(sessionID string, discard bool) error {
+	if c.sessionPool == nil {
+		return common.ErrPoolDisabled
+	}
+
+	if sessionID == "" {
+		return fmt.Errorf("session ID required")
+	}
+
+	if !c.sessionPool.Contains(sessionID) {
+		return fmt.Errorf("session with ID %s does not belong to the pool", sessionID)
+	}
+
+	// The next holder gets none of the state of the previous one, which
+	// registers its own keepalive, scripts and rotation
+	c.forget(sessionID)
+
+	return c.sessionPool.Release(sessionID, discard)
+}
+
+// ClaimSession records owner as the owner of a session
+func (c *SessionController) ClaimSession(sessionID, owner string) {
+	if c.owners != nil {
+		c.owners.Claim(sessionID, owner)
+	}
+}
+
+// OwnsSession reports whether owner owns a session. Sessions without an
+// owner, such as the idle pooled ones, belong to nobody.
+func (c *SessionController) OwnsSession(owner, sessionID string) bool {
+	if c.owners == nil {
+		return false
+	}
+
+	current, exists := c.owners.Owner(sessionID)
+	return exists && current == owner
+}
+
+// IsPooledSession reports whether the session belongs to the pool
+func (c *SessionController) IsPooledSession(sessionID string) bool {
+	return c.sessionPool != nil && c.sessionPool.Contains(sessionID)
+}
+
+// PoolStats returns the pool occupancy, or nil when no pool is configured
+func (c *SessionController) PoolStats() *common.PoolStats {
+	if c.sessionPool == nil {
+		return nil
+	}
+
+	stats := c.sessionPool.Stats()
+	return &stats
+}
+
+// SchedulerStats returns the state of the request scheduler, nil when
+// outgoing requests are not limited
+func (c *SessionController) SchedulerStats() *common.SchedulerStats {
+	if c.scheduler == nil {
+		return nil
+	}
+
+	stats := c.scheduler.Stats()
+	return &stats
+}
+
+// ListProfiles returns the profiles of the catalog
+func (c *SessionController) ListProfiles() ([]common.Profile, error) {
+	if c.profiles == nil {
+		return nil, common.ErrProfilesDisabled
+	}
+
+	return c.profiles.List(), nil
+}
+
+// ReloadProfiles reads the profile directory again and returns the number
+// of profiles loaded
+func (c *SessionController) ReloadProfiles() (int, error) {
+	if c.profiles == nil {
+		return 0, common.ErrProfilesDisabled
+	}
+
+	return c.profiles.Reload()
+}
+
 // GetHealthInfo returns health information including session count
 func (c *SessionController) GetHealthInfo() map[string]any {
 	sessions := c.ListSessions()
 
-	return map[string]any{
+	info := map[string]any{
 		"status":           "healthy",
 		"sessions":         len(sessions),
 		"timestamp":        time.Now().UTC(),
 		"azuretls_version": utils.GetAzureTLSVersion(),
 	}
+
+	if stats := c.PoolStats(); stats != nil {
+		info["session_pool"] = stats
+	}
+
+	return info
 }
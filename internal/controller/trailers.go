@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+// http1Settings sets up the HTTP/2 transport of a fork that never
+// negotiates HTTP/2, so its settings are never sent
+const http1Settings = "0|0|0|m,a,s,p"
+
+type trailersKey struct{}
+
+// withTrailers returns a context carrying the trailers of a request, sent by
+// the fork of trailersSession
+func withTrailers(ctx context.Context, trailers map[string][]string) context.Context {
+	header := make(fhttp.Header, len(trailers))
+	for key, values := range trailers {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	return context.WithValue(ctx, trailersKey{}, header)
+}
+
+// validateTrailers checks a request carrying trailers can send them: after
+// a chunked body, over HTTP/1.1 and only once
+func validateTrailers(serverReq *common.ServerRequest) error {
+	if len(serverReq.Trailers) == 0 {
+		return nil
+	}
+	if serverReq.Body == "" && serverReq.BodyB64 == nil && serverReq.BodyStream == nil {
+		return fmt.Errorf("`trailers` are sent after the body, which the request does not have")
+	}
+
+	options := &serverReq.Options
+	if len(options.ALPN) > 0 || options.ForceHTTP3 {
+		return fmt.Errorf("`trailers` are sent over HTTP/1.1, which the `alpn` and `force_http3` options replace")
+	}
+	if options.Download != nil {
+		return fmt.Errorf("`trailers` cannot be sent with the `download` option, which repeats the request")
+	}
+	return nil
+}
+
+// trailersSession returns the fork of a session sending request trailers,
+// kept by the session manager when it supports it. The returned function
+// releases the fork once the request is sent.
+func (c *SessionController) trailersSession(sessionID string, session *azuretls.Session) (*azuretls.Session, func(), error) {
+	forker, ok := c.sessionManager.(common.SessionForker)
+	if !ok || sessionID == "" {
+		fork, err := forkTrailersSession(session)
+		if err != nil {
+			return nil, nil, err
+		}
+		return fork, fork.Close, nil
+	}
+
+	return forker.Fork(sessionID, "trailers", func() (*azuretls.Session, error) {
+		return forkTrailersSession(session)
+	}, func(fork *azuretls.Session) bool {
+		return forkCurrent(fork, session)
+	})
+}
+
+// forkTrailersSession returns a fork of session writing the trailers carried
+// by the context of its requests after their body. azuretls builds the
+// requests it sends without trailers, which the fork sets as the transport
+// looks up the proxy of each request, before writing it. Only HTTP/1.1 is
+// offered, HTTP/2 requests being sent on cached connections without that
+// lookup.
+func forkTrailersSession(session *azuretls.Session) (*azuretls.Session, error) {
+	fork, err := forkSession(session, []string{"http/1.1"})
+	if err != nil {
+		return nil, err
+	}
+
+	// The transport is otherwise set up on the first request, too late
+	if fork.Transport == nil {
+		if err := fork.ApplyHTTP2(http1Settings); err != nil {
+			fork.Close()
+			return nil, err
+		}
+	}
+
+	// Proxies are dialed by azuretls, never through the transport
+	fork.Transport.Proxy = func(req *fhttp.Request) (*url.URL, error) {
+		trailers, ok := req.Context().Value(trailersKey{}).(fhttp.Header)
+		if ok && req.Body != nil && req.Body != fhttp.NoBody {
+			req.TransferEncoding = []string{"chunked"}
+			req.Trailer = trailers.Clone()
+		}
+		return nil, nil
+	}
+
+	return fork, nil
+}
@@ -0,0 +1,102 @@
+package cookiejars
+
+import (
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/cookiejar"
+)
+
+// record is the last cookie set under a name, domain and path, along with
+// the URL that set it
+type record struct {
+	url    *url.URL
+	cookie http.Cookie
+}
+
+// Jar is a cookie jar shared by sessions. The cookies are kept by a
+// standard jar, which cannot list them, so the jar also records the last
+// cookie set under each name, domain and path: setting them again in a new
+// jar gives a copy.
+type Jar struct {
+	name      string
+	owner     string
+	createdAt time.Time
+	jar       *cookiejar.Jar
+
+	mu      sync.Mutex
+	records map[string]record
+}
+
+func newJar(name string) *Jar {
+	jar, _ := cookiejar.New(nil)
+	return &Jar{
+		name:      name,
+		createdAt: time.Now().UTC(),
+		jar:       jar,
+		records:   make(map[string]record),
+	}
+}
+
+func (j *Jar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, cookie := range cookies {
+		c := *cookie
+		// Max-Age is relative to the time the cookie is set, not copied
+		if c.MaxAge > 0 {
+			c.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+			c.MaxAge = 0
+		}
+
+		key := u.Hostname() + ";" + c.Domain + ";" + cookiePath(u, c.Path) + ";" + c.Name
+
+		if c.MaxAge < 0 || (!c.Expires.IsZero() && !c.Expires.After(now)) {
+			delete(j.records, key)
+			continue
+		}
+		j.records[key] = record{url: u, cookie: c}
+	}
+}
+
+func (j *Jar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// clone returns a private jar holding the cookies of the shared one
+func (j *Jar) clone() http.CookieJar {
+	jar, _ := cookiejar.New(nil)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := time.Now()
+	for key, r := range j.records {
+		if !r.cookie.Expires.IsZero() && !r.cookie.Expires.After(now) {
+			delete(j.records, key)
+			continue
+		}
+		cookie := r.cookie
+		jar.SetCookies(r.url, []*http.Cookie{&cookie})
+	}
+	return jar
+}
+
+// cookiePath returns the path of a cookie, defaulting to the directory of
+// the URL that set it as in RFC 6265
+func cookiePath(u *url.URL, p string) string {
+	if p != "" && p[0] == '/' {
+		return p
+	}
+	if dir := path.Dir(u.Path); dir != "." {
+		return dir
+	}
+	return "/"
+}
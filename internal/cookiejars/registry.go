@@ -0,0 +1,212 @@
+package cookiejars
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-client"
+)
+
+type binding struct {
+	jar     *Jar
+	session *SessionJar
+}
+
+// Registry keeps the shared cookie jars and the sessions bound to them
+type Registry struct {
+	mu       sync.Mutex
+	jars     map[string]*Jar
+	bindings map[string]binding
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		jars:     make(map[string]*Jar),
+		bindings: make(map[string]binding),
+	}
+}
+
+func (r *Registry) Create(name, owner string) (common.CookieJarInfo, error) {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return common.CookieJarInfo{}, fmt.Errorf("invalid cookie jar name %q", name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.jars[name]; exists {
+		return common.CookieJarInfo{}, common.ErrCookieJarExists
+	}
+
+	jar := newJar(name)
+	jar.owner = owner
+	r.jars[name] = jar
+	return r.info(jar), nil
+}
+
+func (r *Registry) Get(name string) (common.CookieJarInfo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jar, exists := r.jars[name]
+	if !exists {
+		return common.CookieJarInfo{}, common.ErrCookieJarNotFound
+	}
+	return r.info(jar), nil
+}
+
+func (r *Registry) Owner(name string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jar, exists := r.jars[name]
+	if !exists {
+		return "", common.ErrCookieJarNotFound
+	}
+	return jar.owner, nil
+}
+
+func (r *Registry) List() []common.CookieJarInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	infos := make([]common.CookieJarInfo, 0, len(r.jars))
+	for _, jar := range r.jars {
+		infos = append(infos, r.info(jar))
+	}
+	slices.SortFunc(infos, func(a, b common.CookieJarInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return infos
+}
+
+func (r *Registry) Delete(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jar, exists := r.jars[name]
+	if !exists {
+		return common.ErrCookieJarNotFound
+	}
+
+	for sessionID, b := range r.bindings {
+		if b.jar == jar {
+			b.session.store(jar.clone())
+			delete(r.bindings, sessionID)
+		}
+	}
+	delete(r.jars, name)
+	return nil
+}
+
+func (r *Registry) Cookies(name string, u *url.URL) ([]common.Cookie, error) {
+	r.mu.Lock()
+	jar, exists := r.jars[name]
+	r.mu.Unlock()
+
+	if !exists {
+		return nil, common.ErrCookieJarNotFound
+	}
+
+	// The jar only keeps the name and value of the cookies it returns
+	cookies := make([]common.Cookie, 0)
+	for _, cookie := range jar.Cookies(u) {
+		cookies = append(cookies, common.Cookie{
+			Name:   cookie.Name,
+			Value:  cookie.Value,
+			Domain: u.Hostname(),
+		})
+	}
+	return cookies, nil
+}
+
+// Bind drops the cookies of the session, which uses the shared jar from
+// then on. Binding a session to another jar moves it without a copy. Only
+// sessions whose jar is a SessionJar can be bound.
+func (r *Registry) Bind(sessionID string, session *azuretls.Session, name string) error {
+	sessionJar, ok := session.CookieJar.(*SessionJar)
+	if !ok {
+		return common.ErrCookieJarUnsupported
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jar, exists := r.jars[name]
+	if !exists {
+		return common.ErrCookieJarNotFound
+	}
+
+	sessionJar.store(jar)
+	r.bindings[sessionID] = binding{jar: jar, session: sessionJar}
+	return nil
+}
+
+func (r *Registry) Unbind(sessionID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, exists := r.bindings[sessionID]
+	if !exists {
+		return common.ErrCookieJarNotBound
+	}
+
+	b.session.store(b.jar.clone())
+	delete(r.bindings, sessionID)
+	return nil
+}
+
+func (r *Registry) Bound(sessionID string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if b, exists := r.bindings[sessionID]; exists {
+		return b.jar.name
+	}
+	return ""
+}
+
+func (r *Registry) Move(fromSessionID, toSessionID string, session *azuretls.Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, exists := r.bindings[fromSessionID]
+	if !exists {
+		return
+	}
+	delete(r.bindings, fromSessionID)
+
+	sessionJar, ok := session.CookieJar.(*SessionJar)
+	if !ok {
+		common.LogWarn("CookieJars: Session %s cannot be bound to cookie jar %s: %v", toSessionID, b.jar.name, common.ErrCookieJarUnsupported)
+		return
+	}
+	sessionJar.store(b.jar)
+	r.bindings[toSessionID] = binding{jar: b.jar, session: sessionJar}
+}
+
+func (r *Registry) Forget(sessionID string) {
+	r.mu.Lock()
+	delete(r.bindings, sessionID)
+	r.mu.Unlock()
+}
+
+// info describes a jar, the registry being locked
+func (r *Registry) info(jar *Jar) common.CookieJarInfo {
+	info := common.CookieJarInfo{
+		Name:      jar.name,
+		Sessions:  make([]string, 0),
+		CreatedAt: jar.createdAt,
+	}
+	for sessionID, b := range r.bindings {
+		if b.jar == jar {
+			info.Sessions = append(info.Sessions, sessionID)
+		}
+	}
+	slices.Sort(info.Sessions)
+	return info
+}
@@ -0,0 +1,46 @@
+package cookiejars
+
+import (
+	"net/url"
+	"sync/atomic"
+
+	http "github.com/Noooste/fhttp"
+	"github.com/Noooste/fhttp/cookiejar"
+)
+
+// SessionJar is the cookie jar of a session, forwarding to a jar of its
+// own or to a shared one. Requests read the jar of their session without
+// lock, so binding a session swaps the jar SessionJar forwards to rather
+// than the jar of the session.
+type SessionJar struct {
+	inner atomic.Pointer[innerJar]
+}
+
+type innerJar struct {
+	http.CookieJar
+}
+
+// NewSessionJar returns a jar forwarding to a new private jar
+func NewSessionJar() *SessionJar {
+	j := &SessionJar{}
+	j.Reset()
+	return j
+}
+
+func (j *SessionJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.inner.Load().SetCookies(u, cookies)
+}
+
+func (j *SessionJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.inner.Load().Cookies(u)
+}
+
+// Reset drops the cookies, forwarding to a new private jar
+func (j *SessionJar) Reset() {
+	jar, _ := cookiejar.New(nil)
+	j.store(jar)
+}
+
+func (j *SessionJar) store(jar http.CookieJar) {
+	j.inner.Store(&innerJar{jar})
+}
@@ -0,0 +1,341 @@
+package curl
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// ignoredFlags do not change the request sent, only how curl reports it
+var ignoredFlags = map[string]bool{
+	"-s": true, "--silent": true,
+	"-S": true, "--show-error": true,
+	"-v": true, "--verbose": true,
+	"-i": true, "--include": true,
+	"-f": true, "--fail": true,
+	"-N": true, "--no-buffer": true,
+	"-g": true, "--globoff": true,
+	"-#": true, "--progress-bar": true,
+	"--compressed":            true,
+	"--http2":                 true,
+	"--http2-prior-knowledge": true,
+}
+
+// ignoredValueFlags are ignored along with their value
+var ignoredValueFlags = map[string]bool{
+	"-o": true, "--output": true,
+	"-w": true, "--write-out": true,
+	"--connect-timeout": true,
+	"--retry":           true,
+}
+
+// valueFlags take a value, given as the next argument or attached to the
+// short flag, e.g. -XPOST
+var valueFlags = map[string]bool{
+	"-X": true, "--request": true,
+	"-H": true, "--header": true,
+	"-d": true, "--data": true, "--data-raw": true, "--data-binary": true, "--data-ascii": true,
+	"--data-urlencode": true,
+	"-b":               true, "--cookie": true,
+	"-A": true, "--user-agent": true,
+	"-e": true, "--referer": true,
+	"-u": true, "--user": true,
+	"-x": true, "--proxy": true,
+	"-U": true, "--proxy-user": true,
+	"--socks4": true, "--socks4a": true, "--socks5": true, "--socks5-hostname": true,
+	"-m": true, "--max-time": true,
+	"--max-redirs": true,
+	"--url":        true,
+}
+
+// Parse converts a curl command line into a ServerRequest. Headers keep
+// the order of the command, and options without an equivalent are rejected
+// so the conversion never silently drops part of the request.
+func Parse(command string) (*common.ServerRequest, error) {
+	args, err := splitArgs(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) > 0 && (args[0] == "curl" || strings.HasSuffix(args[0], "/curl") || args[0] == "curl.exe") {
+		args = args[1:]
+	}
+
+	var (
+		req       = &common.ServerRequest{}
+		data      []string
+		hasData   bool
+		getData   bool
+		head      bool
+		userAgent string
+		referer   string
+		cookies   []string
+		user      string
+		proxyUser string
+	)
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			if req.URL != "" {
+				return nil, fmt.Errorf("multiple URLs are not supported")
+			}
+			req.URL = arg
+			continue
+		}
+
+		flag, value, hasValue := splitFlag(arg)
+
+		if !hasValue && (valueFlags[flag] || ignoredValueFlags[flag]) {
+			i++
+			if i >= len(args) {
+				return nil, fmt.Errorf("option %s requires a value", flag)
+			}
+			value = args[i]
+		}
+
+		switch flag {
+		case "-X", "--request":
+			req.Method = strings.ToUpper(value)
+		case "-H", "--header":
+			header, err := parseHeader(value)
+			if err != nil {
+				return nil, err
+			}
+			if header != nil {
+				req.OrderedHeaders = append(req.OrderedHeaders, header)
+			}
+		case "-d", "--data", "--data-ascii", "--data-binary":
+			if strings.HasPrefix(value, "@") {
+				return nil, fmt.Errorf("option %s reading %s from a file is not supported", flag, value[1:])
+			}
+			data = append(data, value)
+			hasData = true
+		case "--data-raw":
+			data = append(data, value)
+			hasData = true
+		case "--data-urlencode":
+			encoded, err := urlEncodeData(value)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, encoded)
+			hasData = true
+		case "-G", "--get":
+			getData = true
+		case "-I", "--head":
+			head = true
+		case "-b", "--cookie":
+			if !strings.Contains(value, "=") {
+				return nil, fmt.Errorf("option %s reading cookies from a file is not supported", flag)
+			}
+			cookies = append(cookies, value)
+		case "-A", "--user-agent":
+			userAgent = value
+		case "-e", "--referer":
+			referer = value
+		case "-u", "--user":
+			user = value
+		case "-x", "--proxy":
+			req.Options.Proxy = value
+		case "-U", "--proxy-user":
+			proxyUser = value
+		case "--socks4", "--socks4a", "--socks5", "--socks5-hostname":
+			scheme := strings.TrimPrefix(flag, "--")
+			if scheme == "socks5-hostname" {
+				scheme = "socks5h"
+			}
+			req.Options.Proxy = scheme + "://" + value
+		case "-L", "--location":
+			req.Options.FollowRedirects = true
+		case "--max-redirs":
+			redirects, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s value: %s", flag, value)
+			}
+			req.Options.MaxRedirects = uint(redirects)
+		case "-k", "--insecure":
+			req.Options.InsecureSkipVerify = true
+		case "-m", "--max-time":
+			seconds, err := strconv.ParseFloat(value, 64)
+			if err != nil || seconds < 0 {
+				return nil, fmt.Errorf("invalid %s value: %s", flag, value)
+			}
+			req.Options.TimeoutMs = int(seconds * 1000)
+		case "--http1.1", "--http1.0":
+			req.Options.ForceHTTP1 = true
+		case "--http3", "--http3-only":
+			req.Options.ForceHTTP3 = true
+		case "--url":
+			if req.URL != "" {
+				return nil, fmt.Errorf("multiple URLs are not supported")
+			}
+			req.URL = value
+		default:
+			if ignoredFlags[flag] || ignoredValueFlags[flag] {
+				continue
+			}
+			if expanded, ok := expandShortFlags(flag); ok {
+				args = append(args[:i+1], append(expanded, args[i+1:]...)...)
+				continue
+			}
+			return nil, fmt.Errorf("unsupported curl option: %s", flag)
+		}
+	}
+
+	if req.URL == "" {
+		return nil, fmt.Errorf("no URL found in the curl command")
+	}
+	if !strings.Contains(req.URL, "://") {
+		// curl defaults to HTTP for URLs without a scheme
+		req.URL = "http://" + req.URL
+	}
+
+	body := strings.Join(data, "&")
+	if getData && hasData {
+		separator := "?"
+		if strings.Contains(req.URL, "?") {
+			separator = "&"
+		}
+		req.URL += separator + body
+		hasData = false
+	} else if hasData {
+		req.Body = body
+		if !hasHeader(req.OrderedHeaders, "Content-Type") {
+			req.OrderedHeaders = append(req.OrderedHeaders, []string{"Content-Type", "application/x-www-form-urlencoded"})
+		}
+	}
+
+	if req.Method == "" {
+		switch {
+		case head:
+			req.Method = http.MethodHead
+		case hasData:
+			req.Method = http.MethodPost
+		default:
+			req.Method = http.MethodGet
+		}
+	}
+
+	// Options given outside -H are added after the explicit headers unless
+	// these set them already
+	for _, header := range [][]string{
+		{"User-Agent", userAgent},
+		{"Referer", referer},
+		{"Cookie", strings.Join(cookies, "; ")},
+	} {
+		if header[1] != "" && !hasHeader(req.OrderedHeaders, header[0]) {
+			req.OrderedHeaders = append(req.OrderedHeaders, header)
+		}
+	}
+
+	if user != "" && !hasHeader(req.OrderedHeaders, "Authorization") {
+		req.OrderedHeaders = append(req.OrderedHeaders, []string{"Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte(user))})
+	}
+
+	if proxyUser != "" {
+		if req.Options.Proxy == "" {
+			return nil, fmt.Errorf("option --proxy-user requires a proxy")
+		}
+		proxy, err := withProxyUser(req.Options.Proxy, proxyUser)
+		if err != nil {
+			return nil, err
+		}
+		req.Options.Proxy = proxy
+	}
+
+	return req, nil
+}
+
+// splitFlag separates the value attached to a short flag, as in
+// -HName:value
+func splitFlag(arg string) (string, string, bool) {
+	if !strings.HasPrefix(arg, "--") && len(arg) > 2 && (valueFlags[arg[:2]] || ignoredValueFlags[arg[:2]]) {
+		return arg[:2], arg[2:], true
+	}
+	return arg, "", false
+}
+
+// expandShortFlags splits grouped short flags such as -sSL, the last one
+// alone being allowed to take a value
+func expandShortFlags(flag string) ([]string, bool) {
+	if strings.HasPrefix(flag, "--") || len(flag) <= 2 {
+		return nil, false
+	}
+
+	expanded := make([]string, 0, len(flag)-1)
+	for i, r := range flag[1:] {
+		short := "-" + string(r)
+		if valueFlags[short] || ignoredValueFlags[short] {
+			// The rest of the group is the value of this flag
+			return append(expanded, short+flag[i+2:]), true
+		}
+		expanded = append(expanded, short)
+	}
+	return expanded, true
+}
+
+// parseHeader parses a -H value. "Name;" sends an empty header, while
+// "Name:" only removes a header curl would add, and is dropped.
+func parseHeader(value string) ([]string, error) {
+	if name, found := strings.CutSuffix(strings.TrimSpace(value), ";"); found && !strings.Contains(name, ":") {
+		return []string{name, ""}, nil
+	}
+
+	name, headerValue, found := strings.Cut(value, ":")
+	if !found || strings.TrimSpace(name) == "" {
+		return nil, fmt.Errorf("invalid header: %s", value)
+	}
+
+	headerValue = strings.TrimSpace(headerValue)
+	if headerValue == "" {
+		return nil, nil
+	}
+	return []string{strings.TrimSpace(name), headerValue}, nil
+}
+
+// urlEncodeData encodes a --data-urlencode value, "name=content" encoding
+// only the content
+func urlEncodeData(value string) (string, error) {
+	if strings.Contains(value, "@") && !strings.Contains(value, "=") {
+		return "", fmt.Errorf("option --data-urlencode reading from a file is not supported")
+	}
+
+	name, content, found := strings.Cut(value, "=")
+	if !found {
+		return url.QueryEscape(value), nil
+	}
+	if name == "" {
+		return url.QueryEscape(content), nil
+	}
+	return name + "=" + url.QueryEscape(content), nil
+}
+
+func withProxyUser(proxy, proxyUser string) (string, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "", fmt.Errorf("invalid proxy: %w", err)
+	}
+
+	username, password, _ := strings.Cut(proxyUser, ":")
+	u.User = url.UserPassword(username, password)
+	return u.String(), nil
+}
+
+func hasHeader(headers [][]string, name string) bool {
+	for _, header := range headers {
+		if strings.EqualFold(header[0], name) {
+			return true
+		}
+	}
+	return false
+}
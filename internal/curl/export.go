@@ -0,0 +1,142 @@
+package curl
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// Command renders a sent request as a curl command, one option per line.
+// Values are quoted for POSIX shells, binary bodies and control characters
+// using $'...' quotes.
+func Command(req common.SentRequest) string {
+	var (
+		args        []string
+		compressed  bool
+		body        = []byte(req.Body)
+		hasBody     = req.Body != "" || req.BodyB64 != ""
+		method      = strings.ToUpper(req.Method)
+		implicitGet = method == http.MethodGet && !hasBody
+	)
+
+	if req.BodyB64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(req.BodyB64)
+		if err == nil {
+			body = decoded
+		}
+	}
+
+	switch {
+	case method == http.MethodHead:
+		args = append(args, "-I")
+	case implicitGet, method == http.MethodPost && hasBody:
+	default:
+		args = append(args, "-X "+quote(method))
+	}
+
+	for _, header := range req.Headers {
+		if len(header) == 0 {
+			continue
+		}
+		if strings.EqualFold(header[0], "Accept-Encoding") {
+			compressed = true
+		}
+
+		values := header[1:]
+		if len(values) == 0 {
+			values = []string{""}
+		}
+		for _, value := range values {
+			if value == "" {
+				// "Name;" is how curl sends an empty header
+				args = append(args, "-H "+quote(header[0]+";"))
+			} else {
+				args = append(args, "-H "+quote(header[0]+": "+value))
+			}
+		}
+	}
+
+	if hasBody {
+		// Unlike --data-binary, --data-raw does not read bodies starting
+		// with "@" from a file
+		args = append(args, "--data-raw "+quote(string(body)))
+	}
+
+	if compressed {
+		args = append(args, "--compressed")
+	}
+	if req.Proxy != "" {
+		args = append(args, "-x "+quote(req.Proxy))
+	}
+	if req.ForceHTTP1 {
+		args = append(args, "--http1.1")
+	}
+	if req.ForceHTTP3 {
+		args = append(args, "--http3")
+	}
+	if req.InsecureSkipVerify {
+		args = append(args, "-k")
+	}
+
+	var command strings.Builder
+	command.WriteString("curl " + quote(req.URL))
+	for _, arg := range args {
+		command.WriteString(" \\\n  " + arg)
+	}
+	return command.String()
+}
+
+// quote quotes a value for POSIX shells, using $'...' when it contains
+// control characters or invalid UTF-8
+func quote(value string) string {
+	if value != "" && strings.IndexFunc(value, needsQuote) < 0 {
+		return value
+	}
+
+	if !needsANSIQuote(value) {
+		return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+	}
+
+	var quoted strings.Builder
+	quoted.WriteString("$'")
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == '\n':
+			quoted.WriteString(`\n`)
+		case c == '\r':
+			quoted.WriteString(`\r`)
+		case c == '\t':
+			quoted.WriteString(`\t`)
+		case c == '\\' || c == '\'':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&quoted, `\x%02x`, c)
+		default:
+			quoted.WriteByte(c)
+		}
+	}
+	quoted.WriteByte('\'')
+	return quoted.String()
+}
+
+func needsQuote(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:@%+=,", r))
+}
+
+func needsANSIQuote(value string) bool {
+	if !utf8.ValidString(value) {
+		return true
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] == 0x7f {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package curl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// splitArgs splits a command line the way a POSIX shell would, handling
+// single, double and $'...' quotes, backslash escapes and line
+// continuations, including the "^" continuations of cmd.exe copies
+func splitArgs(command string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inArg   bool
+	)
+
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+
+		switch {
+		case r == '\\' || (r == '^' && i+1 < len(runes) && isNewline(runes[i+1])):
+			if i+1 >= len(runes) {
+				current.WriteRune(r)
+				inArg = true
+				continue
+			}
+			i++
+			if runes[i] == '\r' && i+1 < len(runes) && runes[i+1] == '\n' {
+				i++
+			}
+			if isNewline(runes[i]) {
+				continue
+			}
+			current.WriteRune(runes[i])
+			inArg = true
+
+		case r == '\'':
+			end := indexRune(runes, i+1, '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote")
+			}
+			current.WriteString(string(runes[i+1 : end]))
+			i = end
+			inArg = true
+
+		case r == '$' && i+1 < len(runes) && runes[i+1] == '\'':
+			value, end, err := readANSIQuote(runes, i+2)
+			if err != nil {
+				return nil, err
+			}
+			current.WriteString(value)
+			i = end
+			inArg = true
+
+		case r == '"':
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`\n", runes[i+1]) {
+					i++
+					if runes[i] == '\n' {
+						continue
+					}
+				}
+				current.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated double quote")
+			}
+			inArg = true
+
+		case r == ' ' || r == '\t' || isNewline(r):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+// readANSIQuote reads the content of a $'...' quote starting at start and
+// returns it with the index of the closing quote
+func readANSIQuote(runes []rune, start int) (string, int, error) {
+	var value strings.Builder
+
+	for i := start; i < len(runes); i++ {
+		r := runes[i]
+		if r == '\'' {
+			return value.String(), i, nil
+		}
+		if r != '\\' || i+1 >= len(runes) {
+			value.WriteRune(r)
+			continue
+		}
+
+		i++
+		switch runes[i] {
+		case 'n':
+			value.WriteByte('\n')
+		case 'r':
+			value.WriteByte('\r')
+		case 't':
+			value.WriteByte('\t')
+		case 'x', 'u', 'U':
+			digits := map[rune]int{'x': 2, 'u': 4, 'U': 8}[runes[i]]
+			end := i + 1
+			for end < len(runes) && end-i-1 < digits && isHex(runes[end]) {
+				end++
+			}
+			code, err := strconv.ParseUint(string(runes[i+1:end]), 16, 32)
+			if err != nil {
+				return "", 0, fmt.Errorf("invalid escape sequence in $'...' quote")
+			}
+			if runes[i] == 'x' {
+				value.WriteByte(byte(code))
+			} else {
+				value.WriteRune(rune(code))
+			}
+			i = end - 1
+		default:
+			// \\, \' and \" stand for themselves
+			value.WriteRune(runes[i])
+		}
+	}
+
+	return "", 0, fmt.Errorf("unterminated $'...' quote")
+}
+
+func indexRune(runes []rune, start int, r rune) int {
+	for i := start; i < len(runes); i++ {
+		if runes[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+func isNewline(r rune) bool {
+	return r == '\n' || r == '\r'
+}
+
+func isHex(r rune) bool {
+	return (r >= '0' && r <= '9') || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
@@ -0,0 +1,9 @@
+package dashboard
+
+import _ "embed"
+
+// Page is the operator UI served on /dashboard. It is self-contained and
+// reads the admin endpoints from the browser.
+//
+//go:embed index.html
+var Page []byte
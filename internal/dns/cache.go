@@ -0,0 +1,102 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+type cacheEntry struct {
+	ips       []net.IP
+	expiresAt time.Time
+}
+
+// Cache memoizes lookups of a Resolver for as long as the records' TTL allows
+type Cache struct {
+	resolver Resolver
+	entries  map[string]cacheEntry
+	mu       sync.RWMutex
+}
+
+func NewCache(resolver Resolver) *Cache {
+	return &Cache{
+		resolver: resolver,
+		entries:  make(map[string]cacheEntry),
+	}
+}
+
+// LookupIP returns the addresses of host, resolving it only when no
+// unexpired entry is cached. IP literals are returned as is.
+func (c *Cache) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	c.mu.RLock()
+	entry, exists := c.entries[host]
+	c.mu.RUnlock()
+
+	if exists && time.Now().Before(entry.expiresAt) {
+		return entry.ips, nil
+	}
+
+	ips, ttl, err := c.resolver.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl > 0 {
+		c.mu.Lock()
+		c.entries[host] = cacheEntry{ips: ips, expiresAt: time.Now().Add(ttl)}
+		c.mu.Unlock()
+	}
+
+	return ips, nil
+}
+
+// Entries returns the unexpired cached entries sorted by host
+func (c *Cache) Entries() []common.DNSCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	entries := make([]common.DNSCacheEntry, 0, len(c.entries))
+	for host, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, host)
+			continue
+		}
+
+		addresses := make([]string, len(entry.ips))
+		for i, ip := range entry.ips {
+			addresses[i] = ip.String()
+		}
+
+		entries = append(entries, common.DNSCacheEntry{
+			Host:       host,
+			Addresses:  addresses,
+			ExpiresAt:  entry.expiresAt.UTC(),
+			TTLSeconds: int(entry.expiresAt.Sub(now).Seconds()),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Host < entries[j].Host
+	})
+
+	return entries
+}
+
+// Flush drops every cached entry and returns how many were removed
+func (c *Cache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := len(c.entries)
+	c.entries = make(map[string]cacheEntry)
+	return count
+}
@@ -0,0 +1,358 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	queryTimeout = 5 * time.Second
+
+	// fallbackTTL is used when records are resolved through the operating
+	// system, which does not expose record TTLs
+	fallbackTTL = 30 * time.Second
+
+	maxUDPMessageSize = 1232
+)
+
+var ErrNoAddresses = errors.New("no addresses found")
+
+// Resolver resolves a host name into IP addresses along with the time
+// the answer may be cached for
+type Resolver interface {
+	LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+}
+
+// dialFunc opens a connection to a DNS server, framed reports whether
+// messages must be prefixed by their length (TCP and TLS transports)
+type dialFunc func(ctx context.Context, server string) (conn net.Conn, framed bool, err error)
+
+// WireResolver queries DNS servers directly so that record TTLs are known.
+// Unless encrypted, lookups failing on the wire are retried through the
+// operating system resolver, which also covers hosts files and local name
+// services.
+type WireResolver struct {
+	servers  []string
+	dial     dialFunc
+	fallback bool
+}
+
+// NewSystemResolver creates a resolver querying the name servers listed in
+// /etc/resolv.conf
+func NewSystemResolver() *WireResolver {
+	return NewUDPResolver(systemNameservers("/etc/resolv.conf")...)
+}
+
+// NewUDPResolver creates a resolver querying the given name servers
+// (host:port) over UDP, falling back to TCP for truncated answers
+func NewUDPResolver(servers ...string) *WireResolver {
+	return &WireResolver{
+		servers: servers,
+		dial: func(ctx context.Context, server string) (net.Conn, bool, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "udp", server)
+			return conn, false, err
+		},
+		fallback: true,
+	}
+}
+
+// NewTLSResolver creates a resolver querying the given name servers
+// (host:port) over TLS (RFC 7858), verifying their certificate with config.
+// Failed lookups are not retried through the operating system, which would
+// send them in plaintext.
+func NewTLSResolver(config *tls.Config, servers ...string) *WireResolver {
+	return &WireResolver{
+		servers: servers,
+		dial: func(ctx context.Context, server string) (net.Conn, bool, error) {
+			d := tls.Dialer{Config: config}
+			conn, err := d.DialContext(ctx, "tcp", server)
+			return conn, true, err
+		},
+	}
+}
+
+func (r *WireResolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if !r.fallback {
+		return r.lookupWire(ctx, host)
+	}
+
+	if len(r.servers) > 0 {
+		ips, ttl, err := r.lookupWire(ctx, host)
+		if err == nil {
+			return ips, ttl, nil
+		}
+	}
+
+	return lookupSystem(ctx, host)
+}
+
+func (r *WireResolver) lookupWire(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var (
+		ips     []net.IP
+		ttl     time.Duration
+		lastErr error
+	)
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answer, answerTTL, err := r.query(ctx, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(answer) == 0 {
+			continue
+		}
+
+		if ips == nil || answerTTL < ttl {
+			ttl = answerTTL
+		}
+		ips = append(ips, answer...)
+	}
+
+	if len(ips) == 0 {
+		if lastErr != nil {
+			return nil, 0, lastErr
+		}
+		return nil, 0, ErrNoAddresses
+	}
+
+	return ips, ttl, nil
+}
+
+func (r *WireResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var lastErr error
+
+	for _, server := range r.servers {
+		ips, ttl, err := r.queryServer(ctx, server, host, qtype)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		lastErr = err
+	}
+
+	return nil, 0, lastErr
+}
+
+func (r *WireResolver) queryServer(ctx context.Context, server, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+	defer cancel()
+
+	conn, framed, err := r.dial(ctx, server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	ips, ttl, truncated, err := exchange(conn, framed, host, qtype)
+	if err != nil || !truncated {
+		return ips, ttl, err
+	}
+
+	// The answer did not fit in a datagram, retry over TCP
+	var d net.Dialer
+	tcpConn, err := d.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tcpConn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = tcpConn.SetDeadline(deadline)
+	}
+
+	ips, ttl, _, err = exchange(tcpConn, true, host, qtype)
+	return ips, ttl, err
+}
+
+func exchange(conn net.Conn, framed bool, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, bool, error) {
+	id, query, err := buildQuery(host, qtype)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if framed {
+		query = append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, false, err
+	}
+
+	var response []byte
+	if framed {
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, 0, false, err
+		}
+		response = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return nil, 0, false, err
+		}
+	} else {
+		response = make([]byte, maxUDPMessageSize)
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		response = response[:n]
+	}
+
+	return parseResponse(response, id)
+}
+
+func buildQuery(host string, qtype dnsmessage.Type) (uint16, []byte, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return 0, nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	msg, err := build(host, qtype, id)
+	return id, msg, err
+}
+
+func build(host string, qtype dnsmessage.Type, id uint16) ([]byte, error) {
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+
+	name, err := dnsmessage.NewName(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host name %q: %w", host, err)
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+
+	return builder.Finish()
+}
+
+func parseResponse(msg []byte, id uint16) ([]net.IP, time.Duration, bool, error) {
+	var parser dnsmessage.Parser
+
+	header, err := parser.Start(msg)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if header.ID != id {
+		return nil, 0, false, errors.New("mismatched DNS response ID")
+	}
+	if header.Truncated {
+		return nil, 0, true, nil
+	}
+	if header.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, false, fmt.Errorf("DNS server answered %s", header.RCode)
+	}
+
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, 0, false, err
+	}
+
+	var (
+		ips    []net.IP
+		minTTL uint32
+		seen   bool
+	)
+
+	for {
+		answer, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, false, err
+		}
+
+		if !seen || answer.TTL < minTTL {
+			minTTL = answer.TTL
+			seen = true
+		}
+
+		switch answer.Type {
+		case dnsmessage.TypeA:
+			resource, err := parser.AResource()
+			if err != nil {
+				return nil, 0, false, err
+			}
+			ips = append(ips, net.IP(resource.A[:]))
+		case dnsmessage.TypeAAAA:
+			resource, err := parser.AAAAResource()
+			if err != nil {
+				return nil, 0, false, err
+			}
+			ips = append(ips, net.IP(resource.AAAA[:]))
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, 0, false, err
+			}
+		}
+	}
+
+	return ips, time.Duration(minTTL) * time.Second, false, nil
+}
+
+func lookupSystem(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(addrs) == 0 {
+		return nil, 0, ErrNoAddresses
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+
+	return ips, fallbackTTL, nil
+}
+
+func systemNameservers(path string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+
+		// Strip IPv6 zone identifiers which cannot be dialed as is
+		addr := strings.SplitN(fields[1], "%", 2)[0]
+		if net.ParseIP(addr) == nil {
+			continue
+		}
+		servers = append(servers, net.JoinHostPort(addr, "53"))
+	}
+
+	return servers
+}
@@ -0,0 +1,393 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/bodystore"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-client"
+)
+
+var (
+	errPaused   = errors.New("download paused")
+	errCanceled = errors.New("download canceled")
+)
+
+type job struct {
+	info     common.DownloadJob
+	transfer *Transfer
+	hooks    common.DownloadHooks
+	// file receives the body until the download completes
+	file   *os.File
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// Manager runs transfers in the background, writing them to the body store.
+// Downloads that are not running are removed, with their artifact, ttl
+// after their last update.
+type Manager struct {
+	store *bodystore.Store
+	ttl   time.Duration
+	jobs  map[string]*job
+	mu    sync.Mutex
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewManager keeps the downloads left without update for ttl, expired ones
+// being removed every interval
+func NewManager(store *bodystore.Store, ttl, interval time.Duration) *Manager {
+	m := &Manager{
+		store:  store,
+		ttl:    ttl,
+		jobs:   make(map[string]*job),
+		closed: make(chan struct{}),
+	}
+
+	go m.expireEvery(interval)
+	return m
+}
+
+// Check verifies that the store accepts new artifacts
+func (m *Manager) Check() error {
+	return m.store.Check()
+}
+
+// Start begins the download of a request, its ID being the reference of the
+// artifact in the body store
+func (m *Manager) Start(sessionID string, session *azuretls.Session, req *azuretls.Request, options common.DownloadOptions, hooks common.DownloadHooks) (common.DownloadJob, error) {
+	if options.SaveAs != "" {
+		return common.DownloadJob{}, fmt.Errorf("save_as is not supported by managed downloads, retrieve the artifact instead")
+	}
+
+	ref, file, err := m.store.Create()
+	if err != nil {
+		return common.DownloadJob{}, err
+	}
+
+	now := time.Now().UTC()
+	j := &job{
+		info: common.DownloadJob{
+			ID:        ref,
+			SessionID: sessionID,
+			URL:       req.Url,
+			State:     common.DownloadRunning,
+			Progress:  common.DownloadStatus{Total: -1},
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+		transfer: NewTransfer(session, req, options),
+		hooks:    hooks,
+		file:     file,
+	}
+
+	j.transfer.OnProgress = func(status common.DownloadStatus) {
+		m.mu.Lock()
+		j.info.Progress = status
+		j.info.UpdatedAt = time.Now().UTC()
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	m.jobs[ref] = j
+	m.run(j)
+	info := j.info
+	m.mu.Unlock()
+
+	common.LogDebug("Download: Started %s for session %s: %s", ref, sessionID, req.Url)
+	return info, nil
+}
+
+// run starts the transfer of a job, with the lock held
+func (m *Manager) run(j *job) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	j.cancel = cancel
+	j.done = make(chan struct{})
+	j.info.State = common.DownloadRunning
+	j.info.Error = ""
+
+	go func(done chan struct{}) {
+		defer close(done)
+
+		release := func() {}
+		if j.hooks.Acquire != nil {
+			var err error
+			if release, err = j.hooks.Acquire(ctx); err != nil {
+				m.finish(j, nil, err, context.Cause(ctx), nil)
+				return
+			}
+		}
+
+		resp, err := j.transfer.Run(ctx, j.file)
+		release()
+
+		// The hooks see the assembled response once the artifact is
+		// complete, too late to change it
+		var scripted *scriptResult
+		if err == nil && j.transfer.Status().Complete && j.hooks.OnComplete != nil {
+			scriptResp := &common.ScriptResponse{
+				StatusCode: http.StatusOK,
+				URL:        j.transfer.URL(),
+				Headers:    http.Header(j.transfer.Header().Clone()),
+			}
+			scripted = &scriptResult{errors: j.hooks.OnComplete(scriptResp), data: scriptResp.Data}
+		}
+		m.finish(j, resp, err, context.Cause(ctx), scripted)
+	}(j.done)
+}
+
+// scriptResult holds what the on_response hooks reported on a download
+type scriptResult struct {
+	errors map[string]string
+	data   map[string]any
+}
+
+func (m *Manager) finish(j *job, resp *azuretls.Response, err, cause error, scripted *scriptResult) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := j.transfer.Status()
+	j.info.Progress = status
+	j.info.UpdatedAt = time.Now().UTC()
+	if header := j.transfer.Header(); header != nil {
+		j.info.ContentType = header.Get("Content-Type")
+	}
+
+	switch {
+	case errors.Is(cause, errPaused):
+		// The partial body is kept to be resumed
+		j.info.State = common.DownloadPaused
+		return
+
+	case errors.Is(cause, errCanceled):
+		// Cancel removes the job
+		return
+
+	case err != nil:
+		j.info.Error = err.Error()
+
+	case !status.Complete:
+		j.info.StatusCode = resp.StatusCode
+		j.info.Error = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+
+	_ = j.file.Close()
+
+	if j.info.Error != "" {
+		j.info.State = common.DownloadFailed
+		_ = m.store.Delete(j.info.ID)
+		common.LogWarn("Download: %s failed: %s", j.info.ID, j.info.Error)
+		return
+	}
+
+	if _, err := m.store.Commit(j.info.ID, j.info.ContentType); err != nil {
+		j.info.State = common.DownloadFailed
+		j.info.Error = err.Error()
+		_ = m.store.Delete(j.info.ID)
+		return
+	}
+
+	if scripted != nil {
+		j.info.ScriptErrors = scripted.errors
+		j.info.ScriptData = scripted.data
+	}
+	j.info.State = common.DownloadCompleted
+	common.LogDebug("Download: %s completed with %d bytes", j.info.ID, status.Downloaded)
+}
+
+func (m *Manager) lookup(sessionID, downloadID string) (*job, error) {
+	j, exists := m.jobs[downloadID]
+	if !exists || j.info.SessionID != sessionID {
+		return nil, common.ErrDownloadNotFound
+	}
+	return j, nil
+}
+
+// Get returns a download of a session
+func (m *Manager) Get(sessionID, downloadID string) (common.DownloadJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, err := m.lookup(sessionID, downloadID)
+	if err != nil {
+		return common.DownloadJob{}, err
+	}
+	return j.info, nil
+}
+
+// List returns the downloads of a session, oldest first
+func (m *Manager) List(sessionID string) []common.DownloadJob {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	jobs := make([]common.DownloadJob, 0)
+	for _, j := range m.jobs {
+		if j.info.SessionID == sessionID {
+			jobs = append(jobs, j.info)
+		}
+	}
+
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].CreatedAt.Before(jobs[k].CreatedAt)
+	})
+	return jobs
+}
+
+// Pause stops a running download, aborting the chunk in flight. The
+// download is resumed from the last chunk written.
+func (m *Manager) Pause(sessionID, downloadID string) (common.DownloadJob, error) {
+	m.mu.Lock()
+	j, err := m.lookup(sessionID, downloadID)
+	if err == nil && j.info.State != common.DownloadRunning {
+		err = fmt.Errorf("%w: download is %s", common.ErrDownloadState, j.info.State)
+	}
+	if err != nil {
+		m.mu.Unlock()
+		return common.DownloadJob{}, err
+	}
+
+	j.cancel(errPaused)
+	done := j.done
+	m.mu.Unlock()
+
+	<-done
+	return m.Get(sessionID, downloadID)
+}
+
+// Resume restarts a paused download
+func (m *Manager) Resume(sessionID, downloadID string) (common.DownloadJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, err := m.lookup(sessionID, downloadID)
+	if err != nil {
+		return common.DownloadJob{}, err
+	}
+
+	if j.info.State != common.DownloadPaused {
+		return common.DownloadJob{}, fmt.Errorf("%w: download is %s", common.ErrDownloadState, j.info.State)
+	}
+
+	m.run(j)
+	return j.info, nil
+}
+
+// Cancel stops a download and deletes its artifact
+func (m *Manager) Cancel(sessionID, downloadID string) error {
+	m.mu.Lock()
+	j, err := m.lookup(sessionID, downloadID)
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+
+	delete(m.jobs, downloadID)
+	m.mu.Unlock()
+
+	m.stop(j)
+	return nil
+}
+
+// CancelSession cancels every download of a session
+func (m *Manager) CancelSession(sessionID string) int {
+	m.mu.Lock()
+	var jobs []*job
+	for id, j := range m.jobs {
+		if j.info.SessionID == sessionID {
+			jobs = append(jobs, j)
+			delete(m.jobs, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, j := range jobs {
+		m.stop(j)
+	}
+	return len(jobs)
+}
+
+// Close cancels every download
+func (m *Manager) Close() {
+	m.once.Do(func() { close(m.closed) })
+
+	m.mu.Lock()
+	jobs := m.jobs
+	m.jobs = make(map[string]*job)
+	m.mu.Unlock()
+
+	for _, j := range jobs {
+		m.stop(j)
+	}
+}
+
+func (m *Manager) expireEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.closed:
+			return
+		case now := <-ticker.C:
+			m.expire(now)
+		}
+	}
+}
+
+// expire removes the downloads that are not running and were last updated
+// more than ttl before now
+func (m *Manager) expire(now time.Time) {
+	var expired []*job
+
+	m.mu.Lock()
+	for id, j := range m.jobs {
+		if j.info.State != common.DownloadRunning && now.Sub(j.info.UpdatedAt) > m.ttl {
+			expired = append(expired, j)
+			delete(m.jobs, id)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, j := range expired {
+		m.stop(j)
+		common.LogDebug("Download: %s expired, %s", j.info.ID, j.info.State)
+	}
+}
+
+// stop cancels a job removed from the manager and deletes its artifact
+func (m *Manager) stop(j *job) {
+	j.cancel(errCanceled)
+	<-j.done
+
+	_ = j.file.Close()
+	if err := m.store.Delete(j.info.ID); err != nil {
+		common.LogWarn("Download: Failed to delete artifact of %s: %v", j.info.ID, err)
+	}
+}
+
+// Open returns the artifact of a completed download
+func (m *Manager) Open(sessionID, downloadID string) (*os.File, common.DownloadJob, error) {
+	info, err := m.Get(sessionID, downloadID)
+	if err != nil {
+		return nil, info, err
+	}
+
+	if info.State != common.DownloadCompleted {
+		return nil, info, fmt.Errorf("%w: download is %s", common.ErrDownloadState, info.State)
+	}
+
+	file, _, err := m.store.Open(downloadID)
+	if err != nil {
+		return nil, info, err
+	}
+	return file, info, nil
+}
@@ -0,0 +1,277 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/rules"
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+const (
+	DefaultChunkSize  = 8 * 1024 * 1024
+	DefaultMaxRetries = 3
+
+	retryDelay = 500 * time.Millisecond
+)
+
+// ErrChanged is returned when the resource changes between two chunks
+var ErrChanged = errors.New("resource changed during the download")
+
+// Transfer downloads a resource in ranged chunks. When interrupted, Run can
+// be called again to resume from the last byte written.
+type Transfer struct {
+	session  *azuretls.Session
+	template *azuretls.Request
+	options  common.DownloadOptions
+
+	// OnProgress is called after each chunk
+	OnProgress func(common.DownloadStatus)
+
+	url          string
+	header       fhttp.Header
+	etag         string
+	lastModified string
+	status       common.DownloadStatus
+}
+
+// NewTransfer prepares the download of a request, which is used as the
+// template of every chunk request
+func NewTransfer(session *azuretls.Session, template *azuretls.Request, options common.DownloadOptions) *Transfer {
+	if options.ChunkSize <= 0 {
+		options.ChunkSize = DefaultChunkSize
+	}
+	if options.MaxRetries <= 0 {
+		options.MaxRetries = DefaultMaxRetries
+	}
+
+	return &Transfer{
+		session:  session,
+		template: template,
+		options:  options,
+		url:      template.Url,
+		status:   common.DownloadStatus{Total: -1},
+	}
+}
+
+// Status returns the progress of the transfer
+func (t *Transfer) Status() common.DownloadStatus {
+	return t.status
+}
+
+// Header returns the headers of the first response
+func (t *Transfer) Header() fhttp.Header {
+	return t.header
+}
+
+// URL returns the URL chunks are requested from, after redirects
+func (t *Transfer) URL() string {
+	return t.url
+}
+
+// Run writes the resource to w, starting where the previous run stopped.
+// It returns the last response received: when the first response is
+// neither a success nor a range, it is returned as is and the transfer is
+// not complete.
+func (t *Transfer) Run(ctx context.Context, w io.Writer) (*azuretls.Response, error) {
+	var resp *azuretls.Response
+
+	for !t.status.Complete {
+		if err := ctx.Err(); err != nil {
+			return resp, err
+		}
+
+		var err error
+		if resp, err = t.fetch(ctx); err != nil {
+			return nil, err
+		}
+
+		first := t.status.Chunks == 0 && t.status.Downloaded == 0
+		if first {
+			t.url = resp.Url
+			t.header = resp.Header
+		}
+
+		switch resp.StatusCode {
+		case fhttp.StatusPartialContent:
+			if err := t.writeRange(resp, w, first); err != nil {
+				return resp, err
+			}
+
+		case fhttp.StatusOK:
+			// The server ignored the range, or If-Range did not match
+			if !first {
+				return resp, ErrChanged
+			}
+
+			if _, err := w.Write(resp.Body); err != nil {
+				return resp, err
+			}
+			t.status.Downloaded = int64(len(resp.Body))
+			t.status.Total = t.status.Downloaded
+			t.status.Chunks++
+			t.status.Complete = true
+
+		case fhttp.StatusRequestedRangeNotSatisfiable:
+			// Reached the end of a resource of unknown size, or empty
+			if first {
+				t.status.Total = 0
+			} else if t.status.Total >= 0 && t.status.Downloaded != t.status.Total {
+				return resp, fmt.Errorf("range at offset %d not satisfiable", t.status.Downloaded)
+			}
+			t.status.Total = t.status.Downloaded
+			t.status.Complete = true
+
+		default:
+			if first {
+				return resp, nil
+			}
+			return resp, fmt.Errorf("unexpected status %d at offset %d", resp.StatusCode, t.status.Downloaded)
+		}
+
+		if t.OnProgress != nil {
+			t.OnProgress(t.status)
+		}
+	}
+
+	return resp, nil
+}
+
+func (t *Transfer) writeRange(resp *azuretls.Response, w io.Writer, first bool) error {
+	start, end, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+
+	if start != t.status.Downloaded {
+		return fmt.Errorf("received range starting at %d, expected %d", start, t.status.Downloaded)
+	}
+
+	etag := resp.Header.Get("ETag")
+	if first {
+		t.status.Ranged = true
+		t.status.Total = total
+		t.status.ETag = etag
+		t.etag = etag
+		t.lastModified = resp.Header.Get("Last-Modified")
+	} else if total != t.status.Total || (t.etag != "" && etag != "" && etag != t.etag) {
+		return ErrChanged
+	}
+
+	body := resp.Body
+	if int64(len(body)) > end-start+1 {
+		return fmt.Errorf("received %d bytes for a range of %d", len(body), end-start+1)
+	}
+
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+
+	// A short body is resumed from where it stopped by the next range
+	t.status.Downloaded += int64(len(body))
+	t.status.Chunks++
+
+	if t.status.Total >= 0 && t.status.Downloaded >= t.status.Total {
+		t.status.Complete = true
+	}
+	return nil
+}
+
+// fetch requests the next chunk, retrying on errors and server failures
+func (t *Transfer) fetch(ctx context.Context) (*azuretls.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req := t.chunkRequest()
+		req.SetContext(ctx)
+
+		resp, err := t.session.Do(req)
+		if err == nil && resp.StatusCode < fhttp.StatusInternalServerError {
+			return resp, nil
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		if attempt > t.options.MaxRetries {
+			if err != nil {
+				return nil, fmt.Errorf("chunk at offset %d failed after %d attempts: %w", t.status.Downloaded, attempt, err)
+			}
+			return resp, nil
+		}
+
+		t.status.Retries++
+		common.LogDebug("Download: Retrying chunk at offset %d of %s (attempt %d): %v", t.status.Downloaded, t.url, attempt, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * retryDelay):
+		}
+	}
+}
+
+func (t *Transfer) chunkRequest() *azuretls.Request {
+	req := *t.template
+	req.Url = t.url
+	if t.template.OrderedHeaders != nil {
+		req.OrderedHeaders = t.template.OrderedHeaders.Clone()
+	}
+	if t.template.Header != nil {
+		req.Header = t.template.Header.Clone()
+	}
+
+	offset := t.status.Downloaded
+	rules.SetHeader(&req, t.session, "Range", fmt.Sprintf("bytes=%d-%d", offset, offset+t.options.ChunkSize-1))
+	// Ranges apply to the encoded body, which must not be compressed
+	// chunk by chunk
+	rules.SetHeader(&req, t.session, "Accept-Encoding", "identity")
+
+	if offset > 0 {
+		// Weak ETags cannot be used with If-Range
+		if t.etag != "" && !strings.HasPrefix(t.etag, "W/") {
+			rules.SetHeader(&req, t.session, "If-Range", t.etag)
+		} else if t.lastModified != "" {
+			rules.SetHeader(&req, t.session, "If-Range", t.lastModified)
+		}
+	}
+
+	return &req
+}
+
+// parseContentRange parses "bytes start-end/total", total being -1 when
+// the server sends "*"
+func parseContentRange(value string) (start, end, total int64, err error) {
+	spec, found := strings.CutPrefix(value, "bytes ")
+	if !found {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+
+	bounds, size, found := strings.Cut(spec, "/")
+	first, last, found2 := strings.Cut(bounds, "-")
+	if !found || !found2 {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+	}
+
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", value)
+		}
+	}
+
+	return start, end, total, nil
+}
@@ -0,0 +1,125 @@
+package echo
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+const maxHeaderSize = 64 * 1024
+
+func (s *Server) serveHTTP1(conn net.Conn, tlsReport *TLSReport) {
+	reader := bufio.NewReader(conn)
+
+	for {
+		head, headers, err := readHead(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				common.LogDebug("Echo: Failed to read request from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+		if err != nil {
+			common.LogDebug("Echo: Invalid request from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		if err := discardBody(reader, req); err != nil {
+			common.LogDebug("Echo: Failed to read request body from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		body := marshalReport(&Report{
+			RemoteAddr: conn.RemoteAddr().String(),
+			Protocol:   req.Proto,
+			Method:     req.Method,
+			Path:       req.RequestURI,
+			Headers:    headers,
+			TLS:        tlsReport,
+		})
+
+		connection := "keep-alive"
+		if req.Close {
+			connection = "close"
+		}
+
+		if _, err := fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\nConnection: %s\r\n\r\n", len(body), connection); err != nil {
+			return
+		}
+		if _, err := conn.Write(body); err != nil || req.Close {
+			return
+		}
+
+		_ = conn.SetDeadline(time.Now().Add(idleTimeout))
+	}
+}
+
+// readHead reads the request line and headers, returning the raw bytes and
+// the headers in the order and case they were sent
+func readHead(reader *bufio.Reader) ([]byte, [][]string, error) {
+	var (
+		head    []byte
+		headers [][]string
+	)
+
+	for first := true; ; first = false {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+
+		head = append(head, line...)
+		if len(head) > maxHeaderSize {
+			return nil, nil, errors.New("request header too large")
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return head, headers, nil
+		}
+		if first {
+			continue
+		}
+
+		if name, value, ok := strings.Cut(line, ":"); ok {
+			headers = append(headers, []string{name, strings.TrimSpace(value)})
+		}
+	}
+}
+
+func discardBody(reader *bufio.Reader, req *http.Request) error {
+	if len(req.TransferEncoding) > 0 && req.TransferEncoding[0] == "chunked" {
+		if _, err := io.Copy(io.Discard, httputil.NewChunkedReader(reader)); err != nil {
+			return err
+		}
+
+		// Skip the trailer section
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return err
+			}
+			if strings.TrimRight(line, "\r\n") == "" {
+				return nil
+			}
+		}
+	}
+
+	if req.ContentLength > 0 {
+		_, err := io.CopyN(io.Discard, reader, req.ContentLength)
+		return err
+	}
+
+	return nil
+}
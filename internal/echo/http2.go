@@ -0,0 +1,222 @@
+package echo
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/fingerprint"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// maxRecordedPriorities bounds the PRIORITY frames kept for the fingerprint
+	maxRecordedPriorities = 64
+
+	defaultMaxFrameSize = 16384
+)
+
+type http2Stream struct {
+	method  string
+	path    string
+	headers [][]string
+	pseudo  []string
+}
+
+// http2Conn is a minimal HTTP/2 server connection recording the frames
+// that make up the client fingerprint
+type http2Conn struct {
+	conn      net.Conn
+	framer    *http2.Framer
+	tlsReport *TLSReport
+
+	preface       fingerprint.HTTP2
+	settingsSeen  bool
+	headersSeen   bool
+	streams       map[uint32]*http2Stream
+	encoderBuffer bytes.Buffer
+	encoder       *hpack.Encoder
+}
+
+func (s *Server) serveHTTP2(conn net.Conn, tlsReport *TLSReport) {
+	reader := bufio.NewReader(conn)
+
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(reader, preface); err != nil || string(preface) != http2.ClientPreface {
+		common.LogDebug("Echo: Invalid HTTP/2 preface from %s", conn.RemoteAddr())
+		return
+	}
+
+	c := &http2Conn{
+		conn:      conn,
+		framer:    http2.NewFramer(conn, reader),
+		tlsReport: tlsReport,
+		streams:   make(map[uint32]*http2Stream),
+	}
+	c.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	c.encoder = hpack.NewEncoder(&c.encoderBuffer)
+
+	if err := c.framer.WriteSettings(); err != nil {
+		return
+	}
+
+	for {
+		frame, err := c.framer.ReadFrame()
+		if err != nil {
+			if err != io.EOF {
+				common.LogDebug("Echo: Failed to read HTTP/2 frame from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		if err := c.handleFrame(frame); err != nil {
+			common.LogDebug("Echo: Failed to handle HTTP/2 frame from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		_ = conn.SetDeadline(time.Now().Add(idleTimeout))
+	}
+}
+
+func (c *http2Conn) handleFrame(frame http2.Frame) error {
+	switch f := frame.(type) {
+	case *http2.SettingsFrame:
+		if f.IsAck() {
+			return nil
+		}
+		if !c.settingsSeen {
+			c.settingsSeen = true
+			_ = f.ForeachSetting(func(setting http2.Setting) error {
+				c.preface.Settings = append(c.preface.Settings, fingerprint.HTTP2Setting{
+					ID:    uint16(setting.ID),
+					Value: setting.Val,
+				})
+				return nil
+			})
+		}
+		return c.framer.WriteSettingsAck()
+
+	case *http2.WindowUpdateFrame:
+		if f.StreamID == 0 && c.preface.WindowUpdate == 0 {
+			c.preface.WindowUpdate = f.Increment
+		}
+
+	case *http2.PriorityFrame:
+		if len(c.preface.Priorities) < maxRecordedPriorities {
+			c.preface.Priorities = append(c.preface.Priorities, fingerprint.NewHTTP2Priority(f.StreamID, f.PriorityParam))
+		}
+
+	case *http2.MetaHeadersFrame:
+		// A second HEADERS frame on an open stream carries trailers
+		if stream, exists := c.streams[f.StreamID]; exists {
+			if f.StreamEnded() {
+				delete(c.streams, f.StreamID)
+				return c.respond(f.StreamID, stream)
+			}
+			return nil
+		}
+
+		stream := &http2Stream{}
+		for _, field := range f.Fields {
+			if field.IsPseudo() {
+				stream.pseudo = append(stream.pseudo, field.Name)
+				switch field.Name {
+				case ":method":
+					stream.method = field.Value
+				case ":path":
+					stream.path = field.Value
+				}
+				continue
+			}
+			stream.headers = append(stream.headers, []string{field.Name, field.Value})
+		}
+
+		if !c.headersSeen {
+			c.headersSeen = true
+			if f.HasPriority() {
+				priority := fingerprint.NewHTTP2Priority(f.StreamID, f.Priority)
+				c.preface.HeadersPriority = &priority
+			}
+		}
+
+		if f.StreamEnded() {
+			return c.respond(f.StreamID, stream)
+		}
+		c.streams[f.StreamID] = stream
+
+	case *http2.DataFrame:
+		if n := uint32(len(f.Data())); n > 0 {
+			if err := c.framer.WriteWindowUpdate(0, n); err != nil {
+				return err
+			}
+		}
+
+		if stream, exists := c.streams[f.StreamID]; exists && f.StreamEnded() {
+			delete(c.streams, f.StreamID)
+			return c.respond(f.StreamID, stream)
+		}
+
+	case *http2.RSTStreamFrame:
+		delete(c.streams, f.StreamID)
+
+	case *http2.PingFrame:
+		if !f.IsAck() {
+			return c.framer.WritePing(true, f.Data)
+		}
+
+	case *http2.GoAwayFrame:
+		return io.EOF
+	}
+
+	return nil
+}
+
+func (c *http2Conn) respond(streamID uint32, stream *http2Stream) error {
+	fp := c.preface
+	fp.PseudoHeaderOrder = stream.pseudo
+
+	body := marshalReport(&Report{
+		RemoteAddr: c.conn.RemoteAddr().String(),
+		Protocol:   "HTTP/2.0",
+		Method:     stream.method,
+		Path:       stream.path,
+		Headers:    stream.headers,
+		TLS:        c.tlsReport,
+		HTTP2:      &fp,
+		Akamai:     fp.Akamai(),
+		AkamaiHash: fp.AkamaiHash(),
+	})
+
+	c.encoderBuffer.Reset()
+	for _, field := range []hpack.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "content-type", Value: "application/json"},
+		{Name: "content-length", Value: strconv.Itoa(len(body))},
+	} {
+		if err := c.encoder.WriteField(field); err != nil {
+			return err
+		}
+	}
+
+	if err := c.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      streamID,
+		BlockFragment: c.encoderBuffer.Bytes(),
+		EndHeaders:    true,
+	}); err != nil {
+		return err
+	}
+
+	for len(body) > defaultMaxFrameSize {
+		if err := c.framer.WriteData(streamID, false, body[:defaultMaxFrameSize]); err != nil {
+			return err
+		}
+		body = body[defaultMaxFrameSize:]
+	}
+
+	return c.framer.WriteData(streamID, true, body)
+}
@@ -0,0 +1,268 @@
+package echo
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/certs"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/fingerprint"
+)
+
+const (
+	idleTimeout = 30 * time.Second
+
+	// maxClientHelloSize bounds the handshake bytes buffered before the TLS handshake
+	maxClientHelloSize = 64 * 1024
+
+	recordTypeHandshake = 22
+)
+
+// Config configures the fingerprint echo server
+type Config struct {
+	Addr     string
+	CertFile string
+	KeyFile  string
+}
+
+// Report describes how a request reached the echo server
+type Report struct {
+	RemoteAddr string             `json:"remote_addr"`
+	Protocol   string             `json:"protocol"`
+	Method     string             `json:"method"`
+	Path       string             `json:"path"`
+	Headers    [][]string         `json:"headers"`
+	TLS        *TLSReport         `json:"tls"`
+	HTTP2      *fingerprint.HTTP2 `json:"http2,omitempty"`
+	Akamai     string             `json:"akamai_fingerprint,omitempty"`
+	AkamaiHash string             `json:"akamai_fingerprint_hash,omitempty"`
+}
+
+type TLSReport struct {
+	Version            string                   `json:"version"`
+	CipherSuite        string                   `json:"cipher_suite"`
+	NegotiatedProtocol string                   `json:"negotiated_protocol,omitempty"`
+	JA3                string                   `json:"ja3"`
+	JA3Hash            string                   `json:"ja3_hash"`
+	JA4                string                   `json:"ja4"`
+	ClientHello        *fingerprint.ClientHello `json:"client_hello"`
+}
+
+// Server answers every request with a Report of the caller's TLS and HTTP
+// fingerprints. It speaks HTTP/1.1 and HTTP/2 itself so that header order
+// and HTTP/2 frames can be observed as sent.
+type Server struct {
+	config    Config
+	tlsConfig *tls.Config
+
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	closed   bool
+}
+
+// NewServer creates an echo server, generating a self-signed certificate
+// when no certificate is configured
+func NewServer(config Config) (*Server, error) {
+	cert, err := certs.Load(config.CertFile, config.KeyFile, "azuretls echo server")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	return &Server{
+		config: config,
+		tlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		},
+		conns: make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// ListenAndServe listens on the configured address and serves connections
+// until Close is called
+func (s *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.config.Addr)
+	if err != nil {
+		return err
+	}
+
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on the listener until Close is called
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = listener.Close()
+		return net.ErrClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		if !s.track(conn) {
+			_ = conn.Close()
+			return nil
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.untrack(conn)
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// Close stops the listener, closes open connections and waits for their
+// handlers to return
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	_ = conn.Close()
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	_ = conn.SetDeadline(time.Now().Add(idleTimeout))
+
+	consumed, msg, err := readClientHello(conn)
+	if err != nil {
+		common.LogDebug("Echo: Failed to read ClientHello from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	hello, err := fingerprint.ParseClientHello(msg)
+	if err != nil {
+		common.LogDebug("Echo: Failed to parse ClientHello from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	tlsConn := tls.Server(&replayConn{Conn: conn, reader: io.MultiReader(bytes.NewReader(consumed), conn)}, s.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		common.LogDebug("Echo: TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	state := tlsConn.ConnectionState()
+	tlsReport := &TLSReport{
+		Version:            tls.VersionName(state.Version),
+		CipherSuite:        tls.CipherSuiteName(state.CipherSuite),
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		JA3:                hello.JA3(),
+		JA3Hash:            hello.JA3Hash(),
+		JA4:                hello.JA4(),
+		ClientHello:        hello,
+	}
+
+	if state.NegotiatedProtocol == "h2" {
+		s.serveHTTP2(tlsConn, tlsReport)
+	} else {
+		s.serveHTTP1(tlsConn, tlsReport)
+	}
+}
+
+func marshalReport(report *Report) []byte {
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		common.LogError("Echo: Failed to encode report: %v", err)
+		return []byte("{}")
+	}
+	return body
+}
+
+// readClientHello reads TLS records until a full ClientHello handshake
+// message is buffered. It returns the raw bytes consumed from the
+// connection, which must be replayed to the TLS server, and the message.
+func readClientHello(r io.Reader) ([]byte, []byte, error) {
+	var consumed, handshake []byte
+
+	for len(consumed) < maxClientHelloSize {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, nil, err
+		}
+		consumed = append(consumed, header...)
+
+		if header[0] != recordTypeHandshake {
+			return nil, nil, fmt.Errorf("unexpected TLS record type %d", header[0])
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, nil, err
+		}
+		consumed = append(consumed, payload...)
+		handshake = append(handshake, payload...)
+
+		if len(handshake) >= 4 {
+			length := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if len(handshake) >= 4+length {
+				return consumed, handshake[:4+length], nil
+			}
+		}
+	}
+
+	return nil, nil, errors.New("ClientHello too large")
+}
+
+// replayConn serves the bytes consumed while reading the ClientHello
+// before reading from the connection again
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
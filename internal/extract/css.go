@@ -0,0 +1,107 @@
+package extract
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+)
+
+type cssExtractor struct {
+	selector cascadia.Sel
+
+	// attribute is the attribute to return, the text content being
+	// returned when empty
+	attribute string
+	all       bool
+}
+
+// compileCSS compiles a selector, optionally suffixed with ::attr(name) to
+// return an attribute or ::text to return the text content
+func compileCSS(expression string, all bool) (*cssExtractor, error) {
+	extractor := &cssExtractor{all: all}
+
+	selector := strings.TrimSpace(expression)
+	if rest, found := strings.CutSuffix(selector, "::text"); found {
+		selector = rest
+	} else if index := strings.LastIndex(selector, "::attr("); index >= 0 && strings.HasSuffix(selector, ")") {
+		extractor.attribute = strings.TrimSpace(selector[index+len("::attr(") : len(selector)-1])
+		if extractor.attribute == "" {
+			return nil, fmt.Errorf("empty attribute name")
+		}
+		selector = selector[:index]
+	}
+
+	compiled, err := cascadia.Parse(selector)
+	if err != nil {
+		return nil, err
+	}
+	extractor.selector = compiled
+
+	return extractor, nil
+}
+
+// evaluate returns the value of the first matching element, nil when there
+// is none, or the list of values of every matching element. Elements
+// without the attribute are skipped.
+func (c *cssExtractor) evaluate(document *html.Node) any {
+	results := []any{}
+
+	for _, node := range cascadia.QueryAll(document, c.selector) {
+		value, exists := c.value(node)
+		if !exists {
+			continue
+		}
+		if !c.all {
+			return value
+		}
+		results = append(results, value)
+	}
+
+	if !c.all {
+		return nil
+	}
+	return results
+}
+
+func (c *cssExtractor) value(node *html.Node) (string, bool) {
+	if c.attribute == "" {
+		return text(node), true
+	}
+
+	for _, attr := range node.Attr {
+		if strings.EqualFold(attr.Key, c.attribute) {
+			return attr.Val, true
+		}
+	}
+	return "", false
+}
+
+// text returns the text content of a node, as textContent in browsers,
+// with whitespace collapsed
+func text(node *html.Node) string {
+	var builder strings.Builder
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			builder.WriteString(n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(node)
+
+	return strings.Join(strings.Fields(builder.String()), " ")
+}
+
+func parseHTML(body []byte) (*html.Node, error) {
+	document, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("response body is not HTML: %w", err)
+	}
+	return document, nil
+}
@@ -0,0 +1,105 @@
+package extract
+
+import (
+	"fmt"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// Extractor evaluates the extraction options of a request against the
+// response body
+type Extractor struct {
+	jsonPaths map[string]*jsonPath
+	regexes   map[string]*regexExtractor
+	selectors map[string]*cssExtractor
+}
+
+// New compiles the extraction options, returning nil when there is nothing
+// to extract
+func New(options *common.ExtractOptions) (*Extractor, error) {
+	if options == nil || len(options.JSONPath)+len(options.Regex)+len(options.CSS) == 0 {
+		return nil, nil
+	}
+
+	extractor := &Extractor{
+		jsonPaths: make(map[string]*jsonPath, len(options.JSONPath)),
+		regexes:   make(map[string]*regexExtractor, len(options.Regex)),
+		selectors: make(map[string]*cssExtractor, len(options.CSS)),
+	}
+
+	for name, expression := range options.JSONPath {
+		path, err := compileJSONPath(expression)
+		if err != nil {
+			return nil, fmt.Errorf("jsonpath %s: %w", name, err)
+		}
+		extractor.jsonPaths[name] = path
+	}
+
+	for name, pattern := range options.Regex {
+		if extractor.defines(name) {
+			return nil, fmt.Errorf("regex %s: name already used by another extraction", name)
+		}
+
+		regex, err := compileRegex(pattern, options.All)
+		if err != nil {
+			return nil, fmt.Errorf("regex %s: %w", name, err)
+		}
+		extractor.regexes[name] = regex
+	}
+
+	for name, expression := range options.CSS {
+		if extractor.defines(name) {
+			return nil, fmt.Errorf("css %s: name already used by another extraction", name)
+		}
+
+		selector, err := compileCSS(expression, options.All)
+		if err != nil {
+			return nil, fmt.Errorf("css %s: %w", name, err)
+		}
+		extractor.selectors[name] = selector
+	}
+
+	return extractor, nil
+}
+
+// Apply returns the extracted values by name, and the reason of each
+// extraction that could not be evaluated
+func (e *Extractor) Apply(body []byte) (map[string]any, map[string]string) {
+	extracted := make(map[string]any)
+	errors := make(map[string]string)
+
+	if len(e.jsonPaths) > 0 {
+		document, err := parseJSON(body)
+		for name, path := range e.jsonPaths {
+			if err != nil {
+				errors[name] = err.Error()
+				continue
+			}
+			extracted[name] = path.evaluate(document)
+		}
+	}
+
+	for name, regex := range e.regexes {
+		extracted[name] = regex.evaluate(body)
+	}
+
+	if len(e.selectors) > 0 {
+		document, err := parseHTML(body)
+		for name, selector := range e.selectors {
+			if err != nil {
+				errors[name] = err.Error()
+				continue
+			}
+			extracted[name] = selector.evaluate(document)
+		}
+	}
+
+	return extracted, errors
+}
+
+func (e *Extractor) defines(name string) bool {
+	_, jsonPath := e.jsonPaths[name]
+	_, regex := e.regexes[name]
+	_, selector := e.selectors[name]
+	return jsonPath || regex || selector
+}
@@ -0,0 +1,56 @@
+package extract
+
+import (
+	"fmt"
+
+	"github.com/ohler55/ojg/jp"
+	"github.com/ohler55/ojg/oj"
+)
+
+type jsonPath struct {
+	expr jp.Expr
+
+	// definite paths select at most one value, returned as is rather than
+	// in a list
+	definite bool
+}
+
+func compileJSONPath(expression string) (*jsonPath, error) {
+	expr, err := jp.ParseString(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	definite := true
+	for _, fragment := range expr {
+		switch fragment.(type) {
+		case jp.Root, jp.At, jp.Child, jp.Nth, jp.Bracket:
+		default:
+			definite = false
+		}
+	}
+
+	return &jsonPath{expr: expr, definite: definite}, nil
+}
+
+// evaluate returns the single value of a definite path, nil when missing,
+// and the list of matches otherwise
+func (p *jsonPath) evaluate(document any) any {
+	if p.definite {
+		return p.expr.First(document)
+	}
+
+	matches := p.expr.Get(document)
+	if matches == nil {
+		return []any{}
+	}
+	return matches
+}
+
+func parseJSON(body []byte) (any, error) {
+	document, err := oj.Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("response body is not JSON: %w", err)
+	}
+	return document, nil
+}
@@ -0,0 +1,64 @@
+package extract
+
+import (
+	"regexp"
+)
+
+type regexExtractor struct {
+	pattern *regexp.Regexp
+	all     bool
+}
+
+func compileRegex(pattern string, all bool) (*regexExtractor, error) {
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &regexExtractor{pattern: compiled, all: all}, nil
+}
+
+// evaluate returns the first match, nil when there is none, or the list of
+// every match. A match is the whole match without capture groups, the group
+// with one, the groups by name when all are named and the list of groups
+// otherwise.
+func (r *regexExtractor) evaluate(body []byte) any {
+	if !r.all {
+		match := r.pattern.FindSubmatch(body)
+		if match == nil {
+			return nil
+		}
+		return r.shape(match)
+	}
+
+	matches := r.pattern.FindAllSubmatch(body, -1)
+	results := make([]any, len(matches))
+	for i, match := range matches {
+		results[i] = r.shape(match)
+	}
+	return results
+}
+
+func (r *regexExtractor) shape(match [][]byte) any {
+	switch len(match) {
+	case 1:
+		return string(match[0])
+	case 2:
+		return string(match[1])
+	}
+
+	names := r.pattern.SubexpNames()
+	groups := make([]string, len(match)-1)
+	named := make(map[string]string, len(groups))
+	for i, group := range match[1:] {
+		groups[i] = string(group)
+		if names[i+1] != "" {
+			named[names[i+1]] = groups[i]
+		}
+	}
+
+	if len(named) == len(groups) {
+		return named
+	}
+	return groups
+}
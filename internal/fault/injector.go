@@ -0,0 +1,88 @@
+package fault
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+const (
+	KindLatency = "latency"
+	KindError   = "error"
+	KindReset   = "reset"
+
+	// HeaderName marks responses synthesized by the injector
+	HeaderName = "X-Azuretls-Fault"
+)
+
+var defaultErrorStatusCodes = []int{http.StatusServiceUnavailable}
+
+// Injector randomly degrades outgoing requests according to a
+// FaultInjectionConfig. It is meant for testing client retry logic only.
+type Injector struct {
+	config common.FaultInjectionConfig
+}
+
+func NewInjector(config common.FaultInjectionConfig) *Injector {
+	if len(config.ErrorStatusCodes) == 0 {
+		config.ErrorStatusCodes = defaultErrorStatusCodes
+	}
+
+	return &Injector{config: config}
+}
+
+// Enabled reports whether any fault can be injected
+func (i *Injector) Enabled() bool {
+	return i != nil && i.config.Enabled()
+}
+
+// Apply rolls for each fault kind. Latency is applied in place and the
+// delay is returned, while an error or reset short-circuits the request
+// with a synthetic response that must be returned without contacting the target.
+func (i *Injector) Apply(requestID string) (*common.ServerResponse, time.Duration) {
+	if !i.Enabled() {
+		return nil, 0
+	}
+
+	var delay time.Duration
+	if roll(i.config.LatencyPercent) {
+		delay = i.config.Latency
+		if i.config.LatencyJitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(i.config.LatencyJitter)))
+		}
+		common.LogDebug("Fault injection: delaying request %s by %v", requestID, delay)
+		time.Sleep(delay)
+	}
+
+	if roll(i.config.ResetPercent) {
+		common.LogDebug("Fault injection: resetting request %s", requestID)
+		return &common.ServerResponse{
+			ID:    requestID,
+			Error: "read: connection reset by peer",
+			Fault: KindReset,
+		}, delay
+	}
+
+	if roll(i.config.ErrorPercent) {
+		statusCode := i.config.ErrorStatusCodes[rand.Intn(len(i.config.ErrorStatusCodes))]
+		common.LogDebug("Fault injection: answering request %s with status %d", requestID, statusCode)
+		return &common.ServerResponse{
+			ID:         requestID,
+			StatusCode: statusCode,
+			Status:     fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+			Headers: map[string][]string{
+				HeaderName: {KindError},
+			},
+			Fault: KindError,
+		}, delay
+	}
+
+	return nil, delay
+}
+
+func roll(percent float64) bool {
+	return percent > 0 && rand.Float64()*100 < percent
+}
@@ -0,0 +1,323 @@
+package fingerprint
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+const (
+	extensionServerName          uint16 = 0
+	extensionSupportedGroups     uint16 = 10
+	extensionPointFormats        uint16 = 11
+	extensionSignatureAlgorithms uint16 = 13
+	extensionALPN                uint16 = 16
+	extensionSupportedVersions   uint16 = 43
+
+	handshakeTypeClientHello uint8 = 1
+)
+
+var errMalformed = errors.New("malformed ClientHello")
+
+// ClientHello holds the fingerprint-relevant fields of a TLS ClientHello,
+// in the order they were sent
+type ClientHello struct {
+	Version             uint16   `json:"version"`
+	CipherSuites        []uint16 `json:"cipher_suites"`
+	Extensions          []uint16 `json:"extensions"`
+	ServerName          string   `json:"server_name,omitempty"`
+	SupportedGroups     []uint16 `json:"supported_groups,omitempty"`
+	PointFormats        []uint8  `json:"point_formats,omitempty"`
+	SignatureAlgorithms []uint16 `json:"signature_algorithms,omitempty"`
+	ALPN                []string `json:"alpn,omitempty"`
+	SupportedVersions   []uint16 `json:"supported_versions,omitempty"`
+}
+
+// ParseClientHello parses a ClientHello handshake message, including its
+// 4-byte handshake header
+func ParseClientHello(msg []byte) (*ClientHello, error) {
+	var (
+		s                            = cryptobyte.String(msg)
+		msgType                      uint8
+		body, sessionID, compression cryptobyte.String
+		ciphers, extensions          cryptobyte.String
+		hello                        ClientHello
+	)
+
+	if !s.ReadUint8(&msgType) || msgType != handshakeTypeClientHello ||
+		!s.ReadUint24LengthPrefixed(&body) ||
+		!body.ReadUint16(&hello.Version) ||
+		!body.Skip(32) ||
+		!body.ReadUint8LengthPrefixed(&sessionID) ||
+		!body.ReadUint16LengthPrefixed(&ciphers) ||
+		!body.ReadUint8LengthPrefixed(&compression) {
+		return nil, errMalformed
+	}
+
+	for !ciphers.Empty() {
+		var suite uint16
+		if !ciphers.ReadUint16(&suite) {
+			return nil, errMalformed
+		}
+		hello.CipherSuites = append(hello.CipherSuites, suite)
+	}
+
+	if body.Empty() {
+		return &hello, nil
+	}
+
+	if !body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errMalformed
+	}
+
+	for !extensions.Empty() {
+		var (
+			id   uint16
+			data cryptobyte.String
+		)
+		if !extensions.ReadUint16(&id) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errMalformed
+		}
+
+		hello.Extensions = append(hello.Extensions, id)
+		if err := hello.parseExtension(id, data); err != nil {
+			return nil, fmt.Errorf("extension %d: %w", id, err)
+		}
+	}
+
+	return &hello, nil
+}
+
+func (h *ClientHello) parseExtension(id uint16, data cryptobyte.String) error {
+	switch id {
+	case extensionServerName:
+		var names cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&names) {
+			return errMalformed
+		}
+		for !names.Empty() {
+			var (
+				nameType uint8
+				name     cryptobyte.String
+			)
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return errMalformed
+			}
+			if nameType == 0 {
+				h.ServerName = string(name)
+			}
+		}
+
+	case extensionSupportedGroups:
+		values, err := readUint16List(data)
+		if err != nil {
+			return err
+		}
+		h.SupportedGroups = values
+
+	case extensionPointFormats:
+		var formats cryptobyte.String
+		if !data.ReadUint8LengthPrefixed(&formats) {
+			return errMalformed
+		}
+		h.PointFormats = append([]uint8{}, formats...)
+
+	case extensionSignatureAlgorithms:
+		values, err := readUint16List(data)
+		if err != nil {
+			return err
+		}
+		h.SignatureAlgorithms = values
+
+	case extensionALPN:
+		var protocols cryptobyte.String
+		if !data.ReadUint16LengthPrefixed(&protocols) {
+			return errMalformed
+		}
+		for !protocols.Empty() {
+			var protocol cryptobyte.String
+			if !protocols.ReadUint8LengthPrefixed(&protocol) {
+				return errMalformed
+			}
+			h.ALPN = append(h.ALPN, string(protocol))
+		}
+
+	case extensionSupportedVersions:
+		var versions cryptobyte.String
+		if !data.ReadUint8LengthPrefixed(&versions) {
+			return errMalformed
+		}
+		for !versions.Empty() {
+			var version uint16
+			if !versions.ReadUint16(&version) {
+				return errMalformed
+			}
+			h.SupportedVersions = append(h.SupportedVersions, version)
+		}
+	}
+
+	return nil
+}
+
+func readUint16List(data cryptobyte.String) ([]uint16, error) {
+	var list cryptobyte.String
+	if !data.ReadUint16LengthPrefixed(&list) {
+		return nil, errMalformed
+	}
+
+	var values []uint16
+	for !list.Empty() {
+		var value uint16
+		if !list.ReadUint16(&value) {
+			return nil, errMalformed
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// JA3 returns the JA3 string of the ClientHello, GREASE values excluded
+func (h *ClientHello) JA3() string {
+	points := make([]string, len(h.PointFormats))
+	for i, point := range h.PointFormats {
+		points[i] = strconv.Itoa(int(point))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinDecimal(h.CipherSuites),
+		joinDecimal(h.Extensions),
+		joinDecimal(h.SupportedGroups),
+		strings.Join(points, "-"),
+	}, ",")
+}
+
+// JA3Hash returns the MD5 hash of the JA3 string
+func (h *ClientHello) JA3Hash() string {
+	hash := md5.Sum([]byte(h.JA3()))
+	return hex.EncodeToString(hash[:])
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello sent over TCP
+func (h *ClientHello) JA4() string {
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+
+	prefix := fmt.Sprintf("t%s%s%02d%02d%s",
+		ja4Version(h), sni, min(len(ciphers), 99), min(len(extensions), 99), ja4ALPN(h.ALPN))
+
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+
+	sortedExtensions := make([]uint16, 0, len(extensions))
+	for _, ext := range extensions {
+		if ext != extensionServerName && ext != extensionALPN {
+			sortedExtensions = append(sortedExtensions, ext)
+		}
+	}
+	sort.Slice(sortedExtensions, func(i, j int) bool { return sortedExtensions[i] < sortedExtensions[j] })
+
+	extensionsPart := joinHex(sortedExtensions)
+	if len(h.SignatureAlgorithms) > 0 {
+		extensionsPart += "_" + joinHex(h.SignatureAlgorithms)
+	}
+
+	return prefix + "_" + ja4Hash(joinHex(ciphers), len(ciphers) == 0) + "_" + ja4Hash(extensionsPart, len(sortedExtensions) == 0)
+}
+
+func ja4Version(h *ClientHello) string {
+	version := h.Version
+	for _, v := range h.SupportedVersions {
+		if !IsGREASE(v) && v > version {
+			version = v
+		}
+	}
+
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+func ja4ALPN(protocols []string) string {
+	if len(protocols) == 0 || protocols[0] == "" {
+		return "00"
+	}
+
+	protocol := protocols[0]
+	first, last := protocol[0], protocol[len(protocol)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+
+	encoded := hex.EncodeToString([]byte(protocol))
+	return encoded[:1] + encoded[len(encoded)-1:]
+}
+
+func ja4Hash(value string, empty bool) string {
+	if empty {
+		return "000000000000"
+	}
+
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// IsGREASE reports whether v is a GREASE value (RFC 8701)
+func IsGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	filtered := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !IsGREASE(v) {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if !IsGREASE(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
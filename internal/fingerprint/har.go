@@ -0,0 +1,72 @@
+package fingerprint
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// HARRequest is a request recorded in a HAR file, with its headers in the
+// order the browser sent them, pseudo-headers included for HTTP/2
+type HARRequest struct {
+	Method      string     `json:"method"`
+	URL         string     `json:"url"`
+	HTTPVersion string     `json:"http_version"`
+	Headers     [][]string `json:"headers"`
+}
+
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method      string `json:"method"`
+				URL         string `json:"url"`
+				HTTPVersion string `json:"httpVersion"`
+				Headers     []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// ParseHAR returns the request of the HAR entry for url, or of the first
+// HTTP(S) entry when url is empty
+func ParseHAR(data []byte, url string) (*HARRequest, error) {
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("invalid HAR: %w", err)
+	}
+	if len(har.Log.Entries) == 0 {
+		return nil, errors.New("invalid HAR: no entry")
+	}
+
+	for _, entry := range har.Log.Entries {
+		req := entry.Request
+		if url != "" && req.URL != url {
+			continue
+		}
+		if url == "" && !strings.HasPrefix(req.URL, "http://") && !strings.HasPrefix(req.URL, "https://") {
+			continue
+		}
+
+		request := &HARRequest{
+			Method:      req.Method,
+			URL:         req.URL,
+			HTTPVersion: req.HTTPVersion,
+			Headers:     make([][]string, len(req.Headers)),
+		}
+		for i, header := range req.Headers {
+			request.Headers[i] = []string{strings.ToLower(header.Name), header.Value}
+		}
+
+		return request, nil
+	}
+
+	if url != "" {
+		return nil, fmt.Errorf("no HAR entry for %s", url)
+	}
+	return nil, errors.New("no HTTP(S) entry in the HAR")
+}
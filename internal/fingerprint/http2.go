@@ -0,0 +1,161 @@
+package fingerprint
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP2Setting is a SETTINGS parameter as sent by the client
+type HTTP2Setting struct {
+	ID    uint16 `json:"id"`
+	Value uint32 `json:"value"`
+}
+
+// HTTP2Priority is a stream priority, sent either in a PRIORITY frame or
+// along a HEADERS frame. Weight is the effective weight (1-256).
+type HTTP2Priority struct {
+	StreamID  uint32 `json:"stream_id"`
+	Exclusive bool   `json:"exclusive"`
+	DependsOn uint32 `json:"depends_on"`
+	Weight    uint16 `json:"weight"`
+}
+
+// NewHTTP2Priority returns the priority of a PRIORITY or HEADERS frame
+func NewHTTP2Priority(streamID uint32, param http2.PriorityParam) HTTP2Priority {
+	return HTTP2Priority{
+		StreamID:  streamID,
+		Exclusive: param.Exclusive,
+		DependsOn: param.StreamDep,
+		Weight:    uint16(param.Weight) + 1,
+	}
+}
+
+// HTTP2 holds the connection preface of an HTTP/2 client along with the
+// pseudo-header order of its requests
+type HTTP2 struct {
+	Settings          []HTTP2Setting  `json:"settings"`
+	WindowUpdate      uint32          `json:"window_update"`
+	Priorities        []HTTP2Priority `json:"priorities,omitempty"`
+	HeadersPriority   *HTTP2Priority  `json:"headers_priority,omitempty"`
+	PseudoHeaderOrder []string        `json:"pseudo_header_order"`
+}
+
+// Akamai returns the Akamai HTTP/2 fingerprint:
+// SETTINGS|WINDOW_UPDATE|PRIORITY|PSEUDO_HEADER_ORDER
+func (h *HTTP2) Akamai() string {
+	settings := make([]string, len(h.Settings))
+	for i, setting := range h.Settings {
+		settings[i] = fmt.Sprintf("%d:%d", setting.ID, setting.Value)
+	}
+
+	windowUpdate := "00"
+	if h.WindowUpdate > 0 {
+		windowUpdate = strconv.FormatUint(uint64(h.WindowUpdate), 10)
+	}
+
+	priorities := "0"
+	if len(h.Priorities) > 0 {
+		parts := make([]string, len(h.Priorities))
+		for i, p := range h.Priorities {
+			exclusive := 0
+			if p.Exclusive {
+				exclusive = 1
+			}
+			parts[i] = fmt.Sprintf("%d:%d:%d:%d", p.StreamID, exclusive, p.DependsOn, p.Weight)
+		}
+		priorities = strings.Join(parts, ",")
+	}
+
+	pseudoHeaders := make([]string, 0, len(h.PseudoHeaderOrder))
+	for _, name := range h.PseudoHeaderOrder {
+		if name = strings.TrimPrefix(name, ":"); name != "" {
+			pseudoHeaders = append(pseudoHeaders, name[:1])
+		}
+	}
+
+	return strings.Join([]string{
+		strings.Join(settings, ";"),
+		windowUpdate,
+		priorities,
+		strings.Join(pseudoHeaders, ","),
+	}, "|")
+}
+
+// AkamaiHash returns the MD5 hash of the Akamai fingerprint
+func (h *HTTP2) AkamaiHash() string {
+	hash := md5.Sum([]byte(h.Akamai()))
+	return hex.EncodeToString(hash[:])
+}
+
+// ParseHTTP2Frames parses the frames an HTTP/2 client sent, with or without
+// the connection preface, up to the end of its first HEADERS frame. The
+// regular headers of that request are returned in order.
+func ParseHTTP2Frames(data []byte) (*HTTP2, [][]string, error) {
+	framer := http2.NewFramer(io.Discard, bytes.NewReader(bytes.TrimPrefix(data, []byte(http2.ClientPreface))))
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+
+	var (
+		fp           HTTP2
+		headers      [][]string
+		settingsSeen bool
+	)
+	for {
+		frame, err := framer.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid HTTP/2 frames: %w", err)
+		}
+
+		switch f := frame.(type) {
+		case *http2.SettingsFrame:
+			if f.IsAck() || settingsSeen {
+				continue
+			}
+			settingsSeen = true
+			_ = f.ForeachSetting(func(setting http2.Setting) error {
+				fp.Settings = append(fp.Settings, HTTP2Setting{ID: uint16(setting.ID), Value: setting.Val})
+				return nil
+			})
+
+		case *http2.WindowUpdateFrame:
+			if f.StreamID == 0 && fp.WindowUpdate == 0 {
+				fp.WindowUpdate = f.Increment
+			}
+
+		case *http2.PriorityFrame:
+			fp.Priorities = append(fp.Priorities, NewHTTP2Priority(f.StreamID, f.PriorityParam))
+
+		case *http2.MetaHeadersFrame:
+			if f.HasPriority() {
+				priority := NewHTTP2Priority(f.StreamID, f.Priority)
+				fp.HeadersPriority = &priority
+			}
+			for _, field := range f.Fields {
+				if field.IsPseudo() {
+					fp.PseudoHeaderOrder = append(fp.PseudoHeaderOrder, field.Name)
+				} else {
+					headers = append(headers, []string{field.Name, field.Value})
+				}
+			}
+
+			return &fp, headers, nil
+		}
+	}
+
+	if !settingsSeen {
+		return nil, nil, errors.New("invalid HTTP/2 frames: no SETTINGS frame")
+	}
+
+	return &fp, nil, nil
+}
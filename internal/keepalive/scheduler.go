@@ -0,0 +1,248 @@
+package keepalive
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// maxEvents is the number of failures kept per session
+const maxEvents = 10
+
+type task struct {
+	sessionID string
+	run       common.KeepaliveRunner
+	status    common.KeepaliveStatus
+	// lastUsed is the time of the last request of the session, keepalives
+	// included
+	lastUsed time.Time
+	timer    *time.Timer
+}
+
+// Scheduler sends the keepalive request of a session once it has been idle
+// for the keepalive interval
+type Scheduler struct {
+	tasks     map[string]*task
+	listeners []func(common.KeepaliveEvent)
+	mu        sync.Mutex
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{tasks: make(map[string]*task)}
+}
+
+func (s *Scheduler) Register(sessionID string, config common.KeepaliveConfig, run common.KeepaliveRunner) (common.KeepaliveStatus, error) {
+	if err := normalize(&config); err != nil {
+		return common.KeepaliveStatus{}, err
+	}
+
+	interval := time.Duration(config.IntervalSeconds) * time.Second
+	now := time.Now()
+
+	t := &task{
+		sessionID: sessionID,
+		run:       run,
+		status: common.KeepaliveStatus{
+			KeepaliveConfig: config,
+			NextRunAt:       now.Add(interval).UTC(),
+		},
+		lastUsed: now,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if previous, exists := s.tasks[sessionID]; exists {
+		previous.timer.Stop()
+	}
+	s.tasks[sessionID] = t
+	t.timer = time.AfterFunc(interval, func() { s.fire(t) })
+
+	common.LogDebug("Keepalive: Registered %s %s every %ds for session %s", config.Method, config.URL, config.IntervalSeconds, sessionID)
+	return snapshot(t), nil
+}
+
+func (s *Scheduler) Stop(sessionID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, exists := s.tasks[sessionID]
+	if !exists {
+		return false
+	}
+
+	t.timer.Stop()
+	delete(s.tasks, sessionID)
+	return true
+}
+
+func (s *Scheduler) Status(sessionID string) (common.KeepaliveStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, exists := s.tasks[sessionID]
+	if !exists {
+		return common.KeepaliveStatus{}, false
+	}
+	return snapshot(t), true
+}
+
+func (s *Scheduler) Touch(sessionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, exists := s.tasks[sessionID]; exists {
+		t.lastUsed = time.Now()
+		t.status.NextRunAt = t.lastUsed.Add(time.Duration(t.status.IntervalSeconds) * time.Second).UTC()
+	}
+}
+
+func (s *Scheduler) Move(sessionID, replacementID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, exists := s.tasks[sessionID]
+	if !exists {
+		return
+	}
+
+	delete(s.tasks, sessionID)
+	t.sessionID = replacementID
+	s.tasks[replacementID] = t
+}
+
+func (s *Scheduler) Subscribe(fn func(common.KeepaliveEvent)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listeners = append(s.listeners, fn)
+}
+
+// Close stops every keepalive
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sessionID, t := range s.tasks {
+		t.timer.Stop()
+		delete(s.tasks, sessionID)
+	}
+}
+
+// fire sends the keepalive request of a task, unless its session was used
+// since the timer was set
+func (s *Scheduler) fire(t *task) {
+	s.mu.Lock()
+	if s.tasks[t.sessionID] != t {
+		s.mu.Unlock()
+		return
+	}
+
+	interval := time.Duration(t.status.IntervalSeconds) * time.Second
+	if wait := time.Until(t.lastUsed.Add(interval)); wait > 0 {
+		t.timer.Reset(wait)
+		s.mu.Unlock()
+		return
+	}
+
+	sessionID := t.sessionID
+	req := &common.ServerRequest{
+		Method:         t.status.Method,
+		URL:            t.status.URL,
+		OrderedHeaders: t.status.OrderedHeaders,
+		Options:        common.RequestOptions{IgnoreBody: true},
+	}
+	s.mu.Unlock()
+
+	resp := t.run(sessionID, req)
+
+	s.mu.Lock()
+	now := time.Now()
+	t.lastUsed = now
+	t.status.Runs++
+	t.status.LastRunAt = &now
+	t.status.LastStatusCode = resp.StatusCode
+	t.status.NextRunAt = now.Add(interval).UTC()
+
+	var event *common.KeepaliveEvent
+	if failure := failure(resp); failure != "" {
+		t.status.Failures++
+		t.status.ConsecutiveFailures++
+
+		event = &common.KeepaliveEvent{
+			SessionID:           t.sessionID,
+			URL:                 t.status.URL,
+			Time:                now.UTC(),
+			StatusCode:          resp.StatusCode,
+			Error:               failure,
+			ConsecutiveFailures: t.status.ConsecutiveFailures,
+		}
+		t.status.Events = append(t.status.Events, *event)
+		if len(t.status.Events) > maxEvents {
+			t.status.Events = t.status.Events[len(t.status.Events)-maxEvents:]
+		}
+	} else {
+		t.status.ConsecutiveFailures = 0
+	}
+
+	// A keepalive stopped during the request neither runs again nor reports
+	current := s.tasks[t.sessionID] == t
+	if current {
+		t.timer.Reset(interval)
+	}
+	listeners := s.listeners
+	s.mu.Unlock()
+
+	if event == nil || !current {
+		return
+	}
+
+	common.LogWarn("Keepalive: %s failed for session %s: %s", event.URL, event.SessionID, event.Error)
+	for _, listener := range listeners {
+		listener(*event)
+	}
+}
+
+// failure returns why a keepalive response is a failure, "" when it is not
+func failure(resp *common.ServerResponse) string {
+	if resp.Error != "" {
+		return resp.Error
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Sprintf("unexpected status %d", resp.StatusCode)
+	}
+	return ""
+}
+
+func normalize(config *common.KeepaliveConfig) error {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid keepalive URL %q", config.URL)
+	}
+
+	if config.IntervalSeconds <= 0 {
+		return fmt.Errorf("keepalive interval_seconds must be positive")
+	}
+
+	config.Method = strings.ToUpper(config.Method)
+	if config.Method == "" {
+		config.Method = http.MethodGet
+	}
+	return nil
+}
+
+// snapshot copies the status of a task, with the lock held
+func snapshot(t *task) common.KeepaliveStatus {
+	status := t.status
+	status.Events = append([]common.KeepaliveEvent{}, t.status.Events...)
+	if status.LastRunAt != nil {
+		lastRunAt := status.LastRunAt.UTC()
+		status.LastRunAt = &lastRunAt
+	}
+	return status
+}
@@ -0,0 +1,425 @@
+package kerberos
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKDCPort = "88"
+
+	// ticketLifetime is the lifetime asked for tickets, KDCs capping it to
+	// their policy
+	ticketLifetime = 10 * time.Hour
+
+	// renewBefore is how long before their end tickets stop being used
+	renewBefore = time.Minute
+
+	maxMessageSize = 1 << 20
+)
+
+var ErrNoSupportedEType = errors.New("KDC offered no supported encryption type")
+
+// Client obtains service tickets for a user authenticating with a password,
+// caching its ticket granting ticket and the service tickets until they
+// expire. It only talks to KDCs over TCP.
+type Client struct {
+	username string
+	realm    string
+	password string
+	kdc      string
+
+	mu      sync.Mutex
+	tgt     *credentials
+	tickets map[string]*credentials
+}
+
+type credentials struct {
+	ticket []byte
+	key    Key
+	end    time.Time
+}
+
+// NewClient returns a client for username in realm. kdc is the host[:port]
+// of the KDC, looked up from the _kerberos._tcp SRV records of the realm
+// when empty.
+func NewClient(username, realm, password, kdc string) *Client {
+	return &Client{
+		username: username,
+		realm:    realm,
+		password: password,
+		kdc:      kdc,
+		tickets:  make(map[string]*credentials),
+	}
+}
+
+// APReq returns an AP-REQ for spn, a service principal such as
+// HTTP/proxy.example.com, whose authenticator carries cksum
+func (c *Client) APReq(ctx context.Context, spn string, cksum Checksum) ([]byte, error) {
+	creds, err := c.serviceTicket(ctx, spn)
+	if err != nil {
+		return nil, err
+	}
+	return c.apReq(creds, UsageAPReqAuthenticator, cksum)
+}
+
+func (c *Client) serviceTicket(ctx context.Context, spn string) (*credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if creds := c.tickets[spn]; creds.valid() {
+		return creds, nil
+	}
+
+	if !c.tgt.valid() {
+		tgt, err := c.asExchange(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.tgt = tgt
+	}
+
+	creds, err := c.tgsExchange(ctx, spn)
+	if err != nil {
+		return nil, err
+	}
+	c.tickets[spn] = creds
+	return creds, nil
+}
+
+func (creds *credentials) valid() bool {
+	return creds != nil && time.Now().Add(renewBefore).Before(creds.end)
+}
+
+// asExchange obtains a ticket granting ticket. KDCs requiring
+// pre-authentication answer the first request with the salt of the
+// password, which is then proven with an encrypted timestamp.
+func (c *Client) asExchange(ctx context.Context) (*credentials, error) {
+	rep, nonce, err := c.asRequest(ctx, nil)
+
+	var krbErr *KRBError
+	if !errors.As(err, &krbErr) || krbErr.ErrorCode != ErrPreauthRequired {
+		if err != nil {
+			return nil, err
+		}
+
+		entry, err := etypeInfo(rep.PAData)
+		if errors.Is(err, ErrNoSupportedEType) {
+			entry = ETypeInfo2Entry{EType: rep.EncPart.EType}
+		} else if err != nil {
+			return nil, err
+		}
+
+		key, err := c.key(entry)
+		if err != nil {
+			return nil, err
+		}
+		return decryptRep(rep, key, UsageASRepEncPart, nonce)
+	}
+
+	var methods []PAData
+	if _, err := asn1.Unmarshal(krbErr.EData, &methods); err != nil {
+		return nil, fmt.Errorf("invalid pre-authentication methods: %w", err)
+	}
+
+	entry, err := etypeInfo(methods)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := c.key(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := encTimestamp(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if rep, nonce, err = c.asRequest(ctx, []PAData{timestamp}); err != nil {
+		return nil, err
+	}
+	return decryptRep(rep, key, UsageASRepEncPart, nonce)
+}
+
+func (c *Client) asRequest(ctx context.Context, padata []PAData) (*KDCRep, int, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	body, err := marshal(KDCReqBody{
+		KDCOptions: flags(),
+		CName:      principal(NameTypePrincipal, c.username),
+		Realm:      c.realm,
+		SName:      principal(NameTypeSrvInst, "krbtgt", c.realm),
+		Till:       till(),
+		Nonce:      nonce,
+		EType:      SupportedETypes,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rep, err := c.request(ctx, KDCReq{PAData: padata, ReqBody: Field(4, body)}, TagASReq, TagASRep)
+	return rep, nonce, err
+}
+
+// tgsExchange obtains a ticket for spn with the ticket granting ticket,
+// the request body being checksummed by its authenticator
+func (c *Client) tgsExchange(ctx context.Context, spn string) (*credentials, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := marshal(KDCReqBody{
+		KDCOptions: flags(),
+		Realm:      c.realm,
+		SName:      principal(NameTypeSrvInst, strings.Split(spn, "/")...),
+		Till:       till(),
+		Nonce:      nonce,
+		EType:      SupportedETypes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sum, err := c.tgt.key.Checksum(UsageTGSReqChecksum, body)
+	if err != nil {
+		return nil, err
+	}
+
+	apReq, err := c.apReq(c.tgt, UsageTGSReqAuthenticator, Checksum{Type: c.tgt.key.ChecksumType(), Checksum: sum})
+	if err != nil {
+		return nil, err
+	}
+
+	req := KDCReq{
+		PAData:  []PAData{{Type: PATGSReq, Value: apReq}},
+		ReqBody: Field(4, body),
+	}
+	rep, err := c.request(ctx, req, TagTGSReq, TagTGSRep)
+	if err != nil {
+		return nil, err
+	}
+	return decryptRep(rep, c.tgt.key, UsageTGSRepEncPart, nonce)
+}
+
+func (c *Client) apReq(creds *credentials, usage uint32, cksum Checksum) ([]byte, error) {
+	now, usec := kerberosTime(time.Now())
+	authenticator, err := Marshal(Authenticator{
+		AuthenticatorVNO: protocolVersion,
+		CRealm:           c.realm,
+		CName:            principal(NameTypePrincipal, c.username),
+		Checksum:         cksum,
+		CUSec:            usec,
+		CTime:            now,
+	}, TagAuthenticator)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher, err := creds.key.Encrypt(usage, authenticator)
+	if err != nil {
+		return nil, err
+	}
+
+	return Marshal(APReq{
+		PVNO:          protocolVersion,
+		MsgType:       TagAPReq,
+		APOptions:     flags(),
+		Ticket:        Field(3, creds.ticket),
+		Authenticator: EncryptedData{EType: creds.key.Type, Cipher: cipher},
+	}, TagAPReq)
+}
+
+// request sends a KDC request, returning its reply or the KRBError the KDC
+// answered with
+func (c *Client) request(ctx context.Context, req KDCReq, reqTag, repTag int) (*KDCRep, error) {
+	req.PVNO = protocolVersion
+	req.MsgType = reqTag
+
+	msg, err := Marshal(req, reqTag)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.exchange(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if tag, err := ApplicationTag(resp); err == nil && tag == TagKRBError {
+		krbErr := new(KRBError)
+		if _, err := Unmarshal(resp, krbErr, TagKRBError); err != nil {
+			return nil, err
+		}
+		return nil, krbErr
+	}
+
+	rep := new(KDCRep)
+	if _, err := Unmarshal(resp, rep, repTag); err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// exchange sends msg to the KDC over TCP, where messages are prefixed with
+// their length
+func (c *Client) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	addr, err := c.kdcAddr(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(binary.BigEndian.AppendUint32(nil, uint32(len(msg)))); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [4]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("KDC reply of %d bytes too large", size)
+	}
+
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) kdcAddr(ctx context.Context) (string, error) {
+	if c.kdc != "" {
+		if _, _, err := net.SplitHostPort(c.kdc); err == nil {
+			return c.kdc, nil
+		}
+		return net.JoinHostPort(c.kdc, defaultKDCPort), nil
+	}
+
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "kerberos", "tcp", strings.ToLower(c.realm))
+	if err != nil {
+		return "", fmt.Errorf("failed to find the KDC of %s: %w", c.realm, err)
+	}
+	if len(records) == 0 {
+		return "", fmt.Errorf("no KDC found for %s", c.realm)
+	}
+	return net.JoinHostPort(strings.TrimSuffix(records[0].Target, "."), fmt.Sprint(records[0].Port)), nil
+}
+
+// key derives the key of the password for an ETYPE-INFO2 entry, salted by
+// default with the realm and the username
+func (c *Client) key(entry ETypeInfo2Entry) (Key, error) {
+	salt := entry.Salt
+	if salt == "" {
+		salt = c.realm + c.username
+	}
+	return StringToKey(entry.EType, c.password, salt, entry.S2KParams)
+}
+
+// etypeInfo returns the first entry of the PA-ETYPE-INFO2 of padata whose
+// encryption type is supported
+func etypeInfo(padata []PAData) (ETypeInfo2Entry, error) {
+	for _, pa := range padata {
+		if pa.Type != PAETypeInfo2 {
+			continue
+		}
+
+		var entries []ETypeInfo2Entry
+		if _, err := asn1.Unmarshal(pa.Value, &entries); err != nil {
+			return ETypeInfo2Entry{}, fmt.Errorf("invalid ETYPE-INFO2: %w", err)
+		}
+		for _, entry := range entries {
+			if slices.Contains(SupportedETypes, entry.EType) {
+				return entry, nil
+			}
+		}
+	}
+	return ETypeInfo2Entry{}, ErrNoSupportedEType
+}
+
+func encTimestamp(key Key) (PAData, error) {
+	now, usec := kerberosTime(time.Now())
+	timestamp, err := marshal(PAEncTSEnc{Timestamp: now, Microseconds: usec})
+	if err != nil {
+		return PAData{}, err
+	}
+
+	cipher, err := key.Encrypt(UsageASReqTimestamp, timestamp)
+	if err != nil {
+		return PAData{}, err
+	}
+
+	value, err := marshal(EncryptedData{EType: key.Type, Cipher: cipher})
+	if err != nil {
+		return PAData{}, err
+	}
+	return PAData{Type: PAEncTimestamp, Value: value}, nil
+}
+
+// decryptRep decrypts the encrypted part of a reply, checking that it
+// answers the request with nonce
+func decryptRep(rep *KDCRep, key Key, usage uint32, nonce int) (*credentials, error) {
+	if rep.EncPart.EType != key.Type {
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedEType, rep.EncPart.EType)
+	}
+
+	plain, err := key.Decrypt(usage, rep.EncPart.Cipher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt KDC reply: %w", err)
+	}
+
+	var part EncKDCRepPart
+	if _, err := Unmarshal(plain, &part, TagEncASRepPart, TagEncTGSRepPart); err != nil {
+		return nil, err
+	}
+	if part.Nonce != nonce {
+		return nil, fmt.Errorf("KDC reply does not match the request")
+	}
+
+	return &credentials{ticket: rep.Ticket.Bytes, key: part.Key, end: part.EndTime}, nil
+}
+
+// newNonce returns a random nonce, kept positive as encoding/asn1 has no
+// unsigned integers
+func newNonce() (int, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(b[:]) & 0x7fffffff), nil
+}
+
+func till() time.Time {
+	t, _ := kerberosTime(time.Now().Add(ticketLifetime))
+	return t
+}
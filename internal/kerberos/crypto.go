@@ -0,0 +1,328 @@
+package kerberos
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Encryption types (RFC 3962)
+const (
+	AES128CTSHMACSHA196 int32 = 17
+	AES256CTSHMACSHA196 int32 = 18
+)
+
+// Checksum types of the encryption types, and the one of GSS-API
+// authenticators (RFC 4121)
+const (
+	HMACSHA196AES128 int32 = 15
+	HMACSHA196AES256 int32 = 16
+	GSSAPIChecksum   int32 = 0x8003
+)
+
+const (
+	// defaultIterations is the PBKDF2 iteration count of the AES string to
+	// key function without parameters
+	defaultIterations = 4096
+
+	confounderSize = aes.BlockSize
+	macSize        = 12
+)
+
+var (
+	ErrUnsupportedEType = errors.New("unsupported encryption type")
+	ErrIntegrity        = errors.New("integrity check failed")
+)
+
+// SupportedETypes are the encryption types offered to the KDC, by
+// preference
+var SupportedETypes = []int32{AES256CTSHMACSHA196, AES128CTSHMACSHA196}
+
+// Key is an encryption key along with its type, the EncryptionKey of
+// RFC 4120
+type Key struct {
+	Type  int32  `asn1:"explicit,tag:0"`
+	Value []byte `asn1:"explicit,tag:1"`
+}
+
+func keySize(etype int32) (int, error) {
+	switch etype {
+	case AES128CTSHMACSHA196:
+		return 16, nil
+	case AES256CTSHMACSHA196:
+		return 32, nil
+	default:
+		return 0, fmt.Errorf("%w %d", ErrUnsupportedEType, etype)
+	}
+}
+
+// StringToKey derives the key of a password, salted with the realm and
+// name of the principal by default. params holds the iteration count, 4096
+// when empty.
+func StringToKey(etype int32, password, salt string, params []byte) (Key, error) {
+	size, err := keySize(etype)
+	if err != nil {
+		return Key{}, err
+	}
+
+	iterations := defaultIterations
+	if len(params) == 4 {
+		iterations = int(binary.BigEndian.Uint32(params))
+	} else if len(params) != 0 {
+		return Key{}, fmt.Errorf("invalid string to key parameters")
+	}
+
+	tkey, err := pbkdf2.Key(sha1.New, password, []byte(salt), iterations, size)
+	if err != nil {
+		return Key{}, err
+	}
+
+	value, err := deriveKey(tkey, []byte("kerberos"))
+	if err != nil {
+		return Key{}, err
+	}
+	return Key{Type: etype, Value: value}, nil
+}
+
+// NewKey returns a random key, as KDCs generate for sessions
+func NewKey(etype int32) (Key, error) {
+	size, err := keySize(etype)
+	if err != nil {
+		return Key{}, err
+	}
+
+	value := make([]byte, size)
+	if _, err := rand.Read(value); err != nil {
+		return Key{}, err
+	}
+	return Key{Type: etype, Value: value}, nil
+}
+
+// ChecksumType returns the checksum type computed with the key
+func (k Key) ChecksumType() int32 {
+	if k.Type == AES128CTSHMACSHA196 {
+		return HMACSHA196AES128
+	}
+	return HMACSHA196AES256
+}
+
+// Encrypt encrypts plaintext for a key usage, prefixed with a random
+// confounder and followed by its HMAC
+func (k Key) Encrypt(usage uint32, plaintext []byte) ([]byte, error) {
+	ke, ki, err := k.usageKeys(usage)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, confounderSize, confounderSize+len(plaintext))
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	data = append(data, plaintext...)
+
+	ciphertext, err := EncryptCTS(ke, data)
+	if err != nil {
+		return nil, err
+	}
+	return append(ciphertext, hmacSHA1(ki, data)[:macSize]...), nil
+}
+
+// Decrypt reverses Encrypt, failing with ErrIntegrity when the ciphertext
+// was not encrypted with the key for the usage
+func (k Key) Decrypt(usage uint32, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < confounderSize+macSize {
+		return nil, ErrIntegrity
+	}
+
+	ke, ki, err := k.usageKeys(usage)
+	if err != nil {
+		return nil, err
+	}
+
+	split := len(ciphertext) - macSize
+	data, err := DecryptCTS(ke, ciphertext[:split])
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(hmacSHA1(ki, data)[:macSize], ciphertext[split:]) {
+		return nil, ErrIntegrity
+	}
+	return data[confounderSize:], nil
+}
+
+// Checksum returns the keyed checksum of data for a key usage
+func (k Key) Checksum(usage uint32, data []byte) ([]byte, error) {
+	kc, err := deriveKey(k.Value, usageConstant(usage, 0x99))
+	if err != nil {
+		return nil, err
+	}
+	return hmacSHA1(kc, data)[:macSize], nil
+}
+
+func (k Key) usageKeys(usage uint32) (ke, ki []byte, err error) {
+	if _, err := keySize(k.Type); err != nil {
+		return nil, nil, err
+	}
+	if ke, err = deriveKey(k.Value, usageConstant(usage, 0xAA)); err != nil {
+		return nil, nil, err
+	}
+	if ki, err = deriveKey(k.Value, usageConstant(usage, 0x55)); err != nil {
+		return nil, nil, err
+	}
+	return ke, ki, nil
+}
+
+func usageConstant(usage uint32, kind byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, usage), kind)
+}
+
+// deriveKey is the DK function of RFC 3961, encrypting the n-folded
+// constant with the base key until enough bytes are produced
+func deriveKey(base, constant []byte) ([]byte, error) {
+	block, err := aes.NewCipher(base)
+	if err != nil {
+		return nil, err
+	}
+
+	derived := make([]byte, 0, len(base)+aes.BlockSize)
+	input := NFold(constant, aes.BlockSize*8)
+	for len(derived) < len(base) {
+		output := make([]byte, aes.BlockSize)
+		block.Encrypt(output, input)
+		derived = append(derived, output...)
+		input = output
+	}
+	return derived[:len(base)], nil
+}
+
+// NFold stretches or shrinks input to n bits, as RFC 3961 defines it
+func NFold(input []byte, n int) []byte {
+	inBytes := len(input)
+	outBytes := n / 8
+
+	lcm := outBytes * inBytes / gcd(outBytes, inBytes)
+	out := make([]byte, outBytes)
+	inBits := inBytes * 8
+
+	carry := 0
+	for i := lcm - 1; i >= 0; i-- {
+		// The byte of the i-th copy of input, each copy rotated 13 bits to
+		// the right of the previous one
+		msbit := ((inBits - 1) + ((inBits + 13) * (i / inBytes)) + ((inBytes - i%inBytes) * 8)) % inBits
+		b := ((int(input[((inBytes-1)-(msbit>>3))%inBytes]) << 8) |
+			int(input[(inBytes-(msbit>>3))%inBytes])) >> ((msbit & 7) + 1) & 0xff
+
+		carry += int(out[i%outBytes]) + b
+		out[i%outBytes] = byte(carry)
+		carry >>= 8
+	}
+
+	// Add the remaining carry back in, ones' complement style
+	for i := outBytes - 1; carry != 0 && i >= 0; i-- {
+		carry += int(out[i])
+		out[i] = byte(carry)
+		carry >>= 8
+	}
+	return out
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// EncryptCTS encrypts data with AES in CBC mode with ciphertext stealing
+// (CBC-CS3) and a zero IV, the cipher of the AES encryption types
+func EncryptCTS(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aes.BlockSize {
+		return nil, fmt.Errorf("data shorter than a block")
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if len(data) == aes.BlockSize {
+		out := make([]byte, aes.BlockSize)
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, data)
+		return out, nil
+	}
+
+	// Pad to whole blocks, encrypt in CBC mode, then swap the last two
+	// blocks and truncate the final one to the length of the last input
+	// block
+	tail := len(data) % aes.BlockSize
+	if tail == 0 {
+		tail = aes.BlockSize
+	}
+	padded := make([]byte, len(data)+aes.BlockSize-tail)
+	copy(padded, data)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+
+	last := len(padded) - aes.BlockSize
+	out := make([]byte, 0, len(data))
+	out = append(out, padded[:last-aes.BlockSize]...)
+	out = append(out, padded[last:]...)
+	return append(out, padded[last-aes.BlockSize:last-aes.BlockSize+tail]...), nil
+}
+
+// DecryptCTS reverses EncryptCTS
+func DecryptCTS(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aes.BlockSize {
+		return nil, ErrIntegrity
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if len(data) == aes.BlockSize {
+		out := make([]byte, aes.BlockSize)
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+		return out, nil
+	}
+
+	tail := len(data) % aes.BlockSize
+	if tail == 0 {
+		tail = aes.BlockSize
+	}
+	// prefix ends before the full second to last block, which was the
+	// final block of the CBC encryption
+	prefix := len(data) - tail - aes.BlockSize
+	full := data[prefix : prefix+aes.BlockSize]
+	partial := data[prefix+aes.BlockSize:]
+
+	// Decrypting the full block without chaining gives the last plaintext
+	// block XOR the stolen tail of the ciphertext block before it
+	decrypted := make([]byte, aes.BlockSize)
+	block.Decrypt(decrypted, full)
+
+	stolen := make([]byte, aes.BlockSize)
+	copy(stolen, partial)
+	copy(stolen[tail:], decrypted[tail:])
+
+	chained := make([]byte, 0, prefix+2*aes.BlockSize)
+	chained = append(chained, data[:prefix]...)
+	chained = append(chained, stolen...)
+	chained = append(chained, full...)
+
+	out := make([]byte, len(chained))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, chained)
+	return out[:len(data)], nil
+}
+
+func hmacSHA1(key, data []byte) []byte {
+	mac := hmac.New(sha1.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,330 @@
+package kerberos
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"time"
+)
+
+// Application tags of the messages (RFC 4120), which are also the message
+// types of the requests, replies and errors
+const (
+	TagTicket        = 1
+	TagAuthenticator = 2
+	TagEncTicketPart = 3
+	TagASReq         = 10
+	TagASRep         = 11
+	TagTGSReq        = 12
+	TagTGSRep        = 13
+	TagAPReq         = 14
+	TagEncASRepPart  = 25
+	TagEncTGSRepPart = 26
+	TagKRBError      = 30
+)
+
+// Pre-authentication data types
+const (
+	PATGSReq       int32 = 1
+	PAEncTimestamp int32 = 2
+	PAETypeInfo2   int32 = 19
+)
+
+// Principal name types
+const (
+	NameTypePrincipal int32 = 1
+	NameTypeSrvInst   int32 = 2
+)
+
+// Error codes of KRB-ERROR
+const (
+	ErrPreauthFailed   int32 = 24
+	ErrPreauthRequired int32 = 25
+)
+
+// Key usages of the encryptions and checksums
+const (
+	UsageASReqTimestamp      uint32 = 1
+	UsageTicket              uint32 = 2
+	UsageASRepEncPart        uint32 = 3
+	UsageTGSReqChecksum      uint32 = 6
+	UsageTGSReqAuthenticator uint32 = 7
+	UsageTGSRepEncPart       uint32 = 8
+	UsageAPReqAuthenticator  uint32 = 11
+)
+
+const protocolVersion = 5
+
+type PrincipalName struct {
+	NameType   int32    `asn1:"explicit,tag:0"`
+	NameString []string `asn1:"explicit,tag:1"`
+}
+
+type EncryptedData struct {
+	EType  int32  `asn1:"explicit,tag:0"`
+	KVNO   int    `asn1:"optional,explicit,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+type Checksum struct {
+	Type     int32  `asn1:"explicit,tag:0"`
+	Checksum []byte `asn1:"explicit,tag:1"`
+}
+
+type PAData struct {
+	Type  int32  `asn1:"explicit,tag:1"`
+	Value []byte `asn1:"explicit,tag:2"`
+}
+
+type ETypeInfo2Entry struct {
+	EType     int32  `asn1:"explicit,tag:0"`
+	Salt      string `asn1:"optional,explicit,tag:1"`
+	S2KParams []byte `asn1:"optional,explicit,tag:2"`
+}
+
+type PAEncTSEnc struct {
+	Timestamp    time.Time `asn1:"generalized,explicit,tag:0"`
+	Microseconds int       `asn1:"optional,explicit,tag:1"`
+}
+
+// Ticket is marshalled under TagTicket
+type Ticket struct {
+	TktVNO  int           `asn1:"explicit,tag:0"`
+	Realm   string        `asn1:"explicit,tag:1"`
+	SName   PrincipalName `asn1:"explicit,tag:2"`
+	EncPart EncryptedData `asn1:"explicit,tag:3"`
+}
+
+type TransitedEncoding struct {
+	Type     int32  `asn1:"explicit,tag:0"`
+	Contents []byte `asn1:"explicit,tag:1"`
+}
+
+// EncTicketPart is marshalled under TagEncTicketPart, then encrypted with
+// the key of the service
+type EncTicketPart struct {
+	Flags     asn1.BitString    `asn1:"explicit,tag:0"`
+	Key       Key               `asn1:"explicit,tag:1"`
+	CRealm    string            `asn1:"explicit,tag:2"`
+	CName     PrincipalName     `asn1:"explicit,tag:3"`
+	Transited TransitedEncoding `asn1:"explicit,tag:4"`
+	AuthTime  time.Time         `asn1:"generalized,explicit,tag:5"`
+	StartTime time.Time         `asn1:"generalized,optional,explicit,tag:6"`
+	EndTime   time.Time         `asn1:"generalized,explicit,tag:7"`
+}
+
+// KDCReq is an AS-REQ or a TGS-REQ, marshalled under TagASReq or TagTGSReq.
+// ReqBody holds the marshalled KDCReqBody, which TGS-REQs checksum.
+type KDCReq struct {
+	PVNO    int           `asn1:"explicit,tag:1"`
+	MsgType int           `asn1:"explicit,tag:2"`
+	PAData  []PAData      `asn1:"optional,explicit,tag:3"`
+	ReqBody asn1.RawValue `asn1:"explicit,tag:4"`
+}
+
+type KDCReqBody struct {
+	KDCOptions asn1.BitString `asn1:"explicit,tag:0"`
+	CName      PrincipalName  `asn1:"optional,explicit,tag:1"`
+	Realm      string         `asn1:"explicit,tag:2"`
+	SName      PrincipalName  `asn1:"optional,explicit,tag:3"`
+	Till       time.Time      `asn1:"generalized,explicit,tag:5"`
+	Nonce      int            `asn1:"explicit,tag:7"`
+	EType      []int32        `asn1:"explicit,tag:8"`
+}
+
+// KDCRep is an AS-REP or a TGS-REP, marshalled under TagASRep or
+// TagTGSRep. Ticket holds the marshalled Ticket.
+type KDCRep struct {
+	PVNO    int           `asn1:"explicit,tag:0"`
+	MsgType int           `asn1:"explicit,tag:1"`
+	PAData  []PAData      `asn1:"optional,explicit,tag:2"`
+	CRealm  string        `asn1:"explicit,tag:3"`
+	CName   PrincipalName `asn1:"explicit,tag:4"`
+	Ticket  asn1.RawValue `asn1:"explicit,tag:5"`
+	EncPart EncryptedData `asn1:"explicit,tag:6"`
+}
+
+type LastReq struct {
+	Type  int32     `asn1:"explicit,tag:0"`
+	Value time.Time `asn1:"generalized,explicit,tag:1"`
+}
+
+// EncKDCRepPart is the encrypted part of a KDCRep, marshalled under
+// TagEncASRepPart or TagEncTGSRepPart
+type EncKDCRepPart struct {
+	Key           Key            `asn1:"explicit,tag:0"`
+	LastReq       []LastReq      `asn1:"explicit,tag:1"`
+	Nonce         int            `asn1:"explicit,tag:2"`
+	KeyExpiration time.Time      `asn1:"generalized,optional,explicit,tag:3"`
+	Flags         asn1.BitString `asn1:"explicit,tag:4"`
+	AuthTime      time.Time      `asn1:"generalized,explicit,tag:5"`
+	StartTime     time.Time      `asn1:"generalized,optional,explicit,tag:6"`
+	EndTime       time.Time      `asn1:"generalized,explicit,tag:7"`
+	RenewTill     time.Time      `asn1:"generalized,optional,explicit,tag:8"`
+	SRealm        string         `asn1:"explicit,tag:9"`
+	SName         PrincipalName  `asn1:"explicit,tag:10"`
+}
+
+// APReq is marshalled under TagAPReq. Ticket holds the marshalled Ticket.
+type APReq struct {
+	PVNO          int            `asn1:"explicit,tag:0"`
+	MsgType       int            `asn1:"explicit,tag:1"`
+	APOptions     asn1.BitString `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue  `asn1:"explicit,tag:3"`
+	Authenticator EncryptedData  `asn1:"explicit,tag:4"`
+}
+
+// Authenticator is marshalled under TagAuthenticator, then encrypted with
+// the session key of the ticket it goes with
+type Authenticator struct {
+	AuthenticatorVNO int           `asn1:"explicit,tag:0"`
+	CRealm           string        `asn1:"explicit,tag:1"`
+	CName            PrincipalName `asn1:"explicit,tag:2"`
+	Checksum         Checksum      `asn1:"optional,explicit,tag:3"`
+	CUSec            int           `asn1:"explicit,tag:4"`
+	CTime            time.Time     `asn1:"generalized,explicit,tag:5"`
+}
+
+// KRBError is marshalled under TagKRBError
+type KRBError struct {
+	PVNO      int           `asn1:"explicit,tag:0"`
+	MsgType   int           `asn1:"explicit,tag:1"`
+	CTime     time.Time     `asn1:"generalized,optional,explicit,tag:2"`
+	CUSec     int           `asn1:"optional,explicit,tag:3"`
+	STime     time.Time     `asn1:"generalized,explicit,tag:4"`
+	SUSec     int           `asn1:"explicit,tag:5"`
+	ErrorCode int32         `asn1:"explicit,tag:6"`
+	CRealm    string        `asn1:"optional,explicit,tag:7"`
+	CName     PrincipalName `asn1:"optional,explicit,tag:8"`
+	Realm     string        `asn1:"explicit,tag:9"`
+	SName     PrincipalName `asn1:"explicit,tag:10"`
+	EText     string        `asn1:"optional,explicit,tag:11"`
+	EData     []byte        `asn1:"optional,explicit,tag:12"`
+}
+
+func (e *KRBError) Error() string {
+	if e.EText != "" {
+		return fmt.Sprintf("kerberos error %d: %s", e.ErrorCode, e.EText)
+	}
+	return fmt.Sprintf("kerberos error %d", e.ErrorCode)
+}
+
+// Field returns der as the value of a field explicitly tagged with tag,
+// the form of the asn1.RawValue fields of the messages, which
+// encoding/asn1 marshals without their tag
+func Field(tag int, der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: der}
+}
+
+// Marshal encodes a message under its application tag. Strings are
+// encoded as the GeneralStrings Kerberos expects, which encoding/asn1 does
+// not produce.
+func Marshal(v any, tag int) ([]byte, error) {
+	return marshalWithParams(v, fmt.Sprintf("application,explicit,tag:%d", tag))
+}
+
+// marshal encodes a value nested in a message, such as an encrypted or
+// checksummed part
+func marshal(v any) ([]byte, error) {
+	return marshalWithParams(v, "")
+}
+
+func marshalWithParams(v any, params string) ([]byte, error) {
+	der, err := asn1.MarshalWithParams(v, params)
+	if err != nil {
+		return nil, err
+	}
+	if err := generalStrings(der); err != nil {
+		return nil, err
+	}
+	return der, nil
+}
+
+// Unmarshal decodes a message marshalled under one of tags, returning the
+// tag it had
+func Unmarshal(der []byte, v any, tags ...int) (int, error) {
+	tag, err := ApplicationTag(der)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, expected := range tags {
+		if tag != expected {
+			continue
+		}
+
+		rest, err := asn1.UnmarshalWithParams(der, v, fmt.Sprintf("application,explicit,tag:%d", tag))
+		if err != nil {
+			return 0, err
+		}
+		if len(rest) > 0 {
+			return 0, fmt.Errorf("trailing data after kerberos message")
+		}
+		return tag, nil
+	}
+	return 0, fmt.Errorf("unexpected kerberos message %d", tag)
+}
+
+// ApplicationTag returns the application tag of a marshalled message
+func ApplicationTag(der []byte) (int, error) {
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &raw); err != nil {
+		return 0, err
+	}
+	if raw.Class != asn1.ClassApplication {
+		return 0, fmt.Errorf("not a kerberos message")
+	}
+	return raw.Tag, nil
+}
+
+// generalStrings retags in place the PrintableStrings and UTF8Strings of
+// der as GeneralStrings, which have the same contents
+func generalStrings(der []byte) error {
+	for len(der) > 0 {
+		if len(der) < 2 || der[0]&0x1f == 0x1f {
+			return fmt.Errorf("invalid DER encoding")
+		}
+
+		header, length := 2, int(der[1])
+		if der[1]&0x80 != 0 {
+			n := int(der[1] & 0x7f)
+			if n == 0 || n > 4 || len(der) < 2+n {
+				return fmt.Errorf("invalid DER encoding")
+			}
+			length = 0
+			for _, b := range der[2 : 2+n] {
+				length = length<<8 | int(b)
+			}
+			header += n
+		}
+		if length < 0 || len(der)-header < length {
+			return fmt.Errorf("invalid DER encoding")
+		}
+
+		switch {
+		case der[0] == asn1.TagPrintableString || der[0] == asn1.TagUTF8String:
+			der[0] = asn1.TagGeneralString
+		case der[0]&0x20 != 0:
+			if err := generalStrings(der[header : header+length]); err != nil {
+				return err
+			}
+		}
+		der = der[header+length:]
+	}
+	return nil
+}
+
+func principal(nameType int32, name ...string) PrincipalName {
+	return PrincipalName{NameType: nameType, NameString: name}
+}
+
+// kerberosTime returns t as Kerberos times are exchanged, in UTC and to the
+// second, along with its microseconds
+func kerberosTime(t time.Time) (time.Time, int) {
+	t = t.UTC()
+	return t.Truncate(time.Second), t.Nanosecond() / int(time.Microsecond)
+}
+
+// flags returns the 32 bits flags of a message, all unset
+func flags() asn1.BitString {
+	return asn1.BitString{Bytes: make([]byte, 4), BitLength: 32}
+}
@@ -0,0 +1,94 @@
+package kerberos
+
+import (
+	"context"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+)
+
+var (
+	// OIDKerberos is the GSS-API mechanism of Kerberos (RFC 1964)
+	OIDKerberos = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+
+	// OIDSPNEGO is the pseudo mechanism negotiating the mechanism of HTTP
+	// Negotiate (RFC 4178)
+	OIDSPNEGO = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+)
+
+// GSS-API context flags of the authenticator checksum (RFC 4121)
+const (
+	gssConfFlag  = 16
+	gssIntegFlag = 32
+)
+
+// NegTokenInit is the initial SPNEGO token, marshalled explicitly tagged
+// with 0 in an initial context token
+type NegTokenInit struct {
+	MechTypes []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+	MechToken []byte                  `asn1:"optional,explicit,tag:2"`
+}
+
+// Negotiate returns the initial SPNEGO token of the HTTP Negotiate scheme
+// for spn, offering Kerberos with an AP-REQ for the service
+func (c *Client) Negotiate(ctx context.Context, spn string) ([]byte, error) {
+	// The checksum of GSS-API authenticators carries the channel bindings,
+	// none here, and the context flags
+	cksum := binary.LittleEndian.AppendUint32(nil, 16)
+	cksum = append(cksum, make([]byte, 16)...)
+	cksum = binary.LittleEndian.AppendUint32(cksum, gssConfFlag|gssIntegFlag)
+
+	apReq, err := c.APReq(ctx, spn, Checksum{Type: GSSAPIChecksum, Checksum: cksum})
+	if err != nil {
+		return nil, err
+	}
+
+	// 01 00 identifies the AP-REQ in the Kerberos token
+	mechToken, err := initialContextToken(OIDKerberos, append([]byte{0x01, 0x00}, apReq...))
+	if err != nil {
+		return nil, err
+	}
+
+	negTokenInit, err := asn1.MarshalWithParams(NegTokenInit{
+		MechTypes: []asn1.ObjectIdentifier{OIDKerberos},
+		MechToken: mechToken,
+	}, "explicit,tag:0")
+	if err != nil {
+		return nil, err
+	}
+	return initialContextToken(OIDSPNEGO, negTokenInit)
+}
+
+// initialContextToken frames an inner token with the OID of its mechanism,
+// as GSS-API initial context tokens are (RFC 2743)
+func initialContextToken(mech asn1.ObjectIdentifier, inner []byte) ([]byte, error) {
+	oid, err := asn1.Marshal(mech)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassApplication,
+		Tag:        0,
+		IsCompound: true,
+		Bytes:      append(oid, inner...),
+	})
+}
+
+// ParseInitialContextToken returns the mechanism and the inner token of a
+// GSS-API initial context token
+func ParseInitialContextToken(token []byte) (asn1.ObjectIdentifier, []byte, error) {
+	var raw asn1.RawValue
+	if rest, err := asn1.Unmarshal(token, &raw); err != nil || len(rest) > 0 {
+		return nil, nil, fmt.Errorf("invalid initial context token")
+	}
+	if raw.Class != asn1.ClassApplication || raw.Tag != 0 {
+		return nil, nil, fmt.Errorf("invalid initial context token")
+	}
+
+	var mech asn1.ObjectIdentifier
+	inner, err := asn1.Unmarshal(raw.Bytes, &mech)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid initial context token: %w", err)
+	}
+	return mech, inner, nil
+}
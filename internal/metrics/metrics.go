@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the content type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+const (
+	Gauge   = "gauge"
+	Counter = "counter"
+)
+
+// Sample is a value of a metric with its labels
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Writer renders metrics in the Prometheus text exposition format
+type Writer struct {
+	w *bufio.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Metric writes a metric family. Families without samples are skipped.
+func (m *Writer) Metric(name, kind, help string, samples ...Sample) {
+	if len(samples) == 0 {
+		return
+	}
+
+	fmt.Fprintf(m.w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(m.w, "# TYPE %s %s\n", name, kind)
+
+	for _, sample := range samples {
+		m.w.WriteString(name)
+		writeLabels(m.w, sample.Labels)
+		m.w.WriteByte(' ')
+		m.w.WriteString(strconv.FormatFloat(sample.Value, 'g', -1, 64))
+		m.w.WriteByte('\n')
+	}
+}
+
+func (m *Writer) Flush() error {
+	return m.w.Flush()
+}
+
+// Bool returns 1 for true and 0 for false
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeLabels(w *bufio.Writer, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		fmt.Fprintf(w, `%s="%s"`, name, labelEscaper.Replace(labels[name]))
+	}
+	w.WriteByte('}')
+}
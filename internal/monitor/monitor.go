@@ -0,0 +1,147 @@
+package monitor
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/ring"
+)
+
+const (
+	DefaultRecentRequests = 100
+
+	// maxHosts bounds the per-host counters, requests to further hosts only
+	// being counted in the totals
+	maxHosts = 1000
+)
+
+type hostCounters struct {
+	requests, errors uint64
+}
+
+// Monitor keeps the counters and the most recent requests executed by the
+// server, for the admin endpoints
+type Monitor struct {
+	since time.Time
+
+	requests, errors uint64
+	hosts            map[string]*hostCounters
+
+	recent *ring.Ring[common.RequestRecord]
+
+	mu sync.Mutex
+}
+
+func New(recentRequests int) *Monitor {
+	if recentRequests <= 0 {
+		recentRequests = DefaultRecentRequests
+	}
+
+	return &Monitor{
+		since:  time.Now().UTC(),
+		hosts:  make(map[string]*hostCounters),
+		recent: ring.New[common.RequestRecord](recentRequests),
+	}
+}
+
+// Record counts a request. Requests that failed or got a server error
+// count as errors.
+func (m *Monitor) Record(record common.RequestRecord) {
+	failed := record.Error != "" || record.StatusCode >= 500
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests++
+	if failed {
+		m.errors++
+	}
+
+	counters, exists := m.hosts[record.Host]
+	if !exists && len(m.hosts) < maxHosts {
+		counters = &hostCounters{}
+		m.hosts[record.Host] = counters
+	}
+	if counters != nil {
+		counters.requests++
+		if failed {
+			counters.errors++
+		}
+	}
+
+	m.recent.Add(record)
+}
+
+// Stats returns the counters, hosts with the most requests first
+func (m *Monitor) Stats() common.RequestStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := common.RequestStats{
+		Since:     m.since,
+		Requests:  m.requests,
+		Errors:    m.errors,
+		ErrorRate: rate(m.errors, m.requests),
+		Hosts:     make([]common.HostStats, 0, len(m.hosts)),
+	}
+
+	for host, counters := range m.hosts {
+		stats.Hosts = append(stats.Hosts, common.HostStats{
+			Host:      host,
+			Requests:  counters.requests,
+			Errors:    counters.errors,
+			ErrorRate: rate(counters.errors, counters.requests),
+		})
+	}
+
+	sort.Slice(stats.Hosts, func(i, k int) bool {
+		if stats.Hosts[i].Requests != stats.Hosts[k].Requests {
+			return stats.Hosts[i].Requests > stats.Hosts[k].Requests
+		}
+		return stats.Hosts[i].Host < stats.Hosts[k].Host
+	})
+
+	return stats
+}
+
+// Recent returns the last requests, newest first
+func (m *Monitor) Recent() []common.RequestRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.recent.List()
+}
+
+// NewRecord describes a request for Record. The query string is left out of
+// the URL, as it often carries tokens.
+func NewRecord(sessionID, method, rawURL string, start time.Time, statusCode int, errorMessage string) common.RequestRecord {
+	record := common.RequestRecord{
+		Time:       start.UTC(),
+		SessionID:  sessionID,
+		Method:     method,
+		URL:        rawURL,
+		StatusCode: statusCode,
+		Duration:   float64(time.Since(start).Microseconds()) / 1000,
+		Error:      errorMessage,
+	}
+
+	if u, err := url.Parse(rawURL); err == nil {
+		u.RawQuery = ""
+		u.Fragment = ""
+		u.User = nil
+		record.URL = u.String()
+		record.Host = u.Hostname()
+	}
+
+	return record
+}
+
+func rate(errors, requests uint64) float64 {
+	if requests == 0 {
+		return 0
+	}
+	return float64(errors) / float64(requests)
+}
@@ -0,0 +1,518 @@
+package plugins
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+const (
+	// HandshakeTimeout bounds the time a plugin takes to print its handshake
+	HandshakeTimeout = 10 * time.Second
+	// CallTimeout bounds the calls made to plugins
+	CallTimeout = 10 * time.Second
+	// RestartDelay is waited before restarting a plugin that exited
+	RestartDelay = 5 * time.Second
+	// StopTimeout is given to plugins to exit once their input is closed,
+	// before they are killed
+	StopTimeout = 5 * time.Second
+)
+
+type plugin struct {
+	info    common.PluginInfo
+	process *process
+	base    *url.URL
+	proxy   *httputil.ReverseProxy
+}
+
+// process is a started plugin executable
+type process struct {
+	cmd    *exec.Cmd
+	stdin  io.Closer
+	exited chan struct{}
+	err    error
+}
+
+// Manager starts the executables of a directory as plugins, restarting the
+// ones that exit, and calls them over HTTP on the loopback interface
+type Manager struct {
+	token   string
+	client  *http.Client
+	plugins map[string]*plugin
+	names   []string
+	mu      sync.RWMutex
+
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// Load starts the executables found in dir, waiting for their handshake.
+// Plugins failing to start are listed with their error and retried later.
+func Load(dir string) (*Manager, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plugins directory: %w", err)
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		token:   hex.EncodeToString(token),
+		client:  &http.Client{Timeout: CallTimeout},
+		plugins: make(map[string]*plugin),
+		closed:  make(chan struct{}),
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") || !executable(info) {
+			continue
+		}
+
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		if _, exists := m.plugins[name]; exists {
+			common.LogWarn("Plugins: Skipping %s, another plugin is named %s", entry.Name(), name)
+			continue
+		}
+
+		path, err := filepath.Abs(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		p := &plugin{info: common.PluginInfo{Name: name, Path: path, Capabilities: []string{}}}
+		m.plugins[name] = p
+		m.names = append(m.names, name)
+	}
+	sort.Strings(m.names)
+
+	for _, name := range m.names {
+		p := m.plugins[name]
+		if err := m.launch(p); err != nil {
+			common.LogError("Plugins: Failed to start %s: %v", name, err)
+		} else {
+			common.LogInfo("Plugins: Started %s %s with %s", name, p.info.Version, strings.Join(p.info.Capabilities, ", "))
+		}
+
+		m.wg.Add(1)
+		go m.supervise(p)
+	}
+
+	return m, nil
+}
+
+// executable tells whether a file may be run as a plugin. Windows has no
+// executable bit, so every file is.
+func executable(info os.FileInfo) bool {
+	return filepath.Separator == '\\' || info.Mode()&0o111 != 0
+}
+
+// launch starts the process of a plugin and reads its handshake and manifest
+func (m *Manager) launch(p *plugin) error {
+	handshake := make(chan string, 1)
+
+	cmd := exec.Command(p.info.Path)
+	cmd.Env = append(os.Environ(), MagicEnv+"=1", TokenEnv+"="+m.token)
+	cmd.Stdout = &lineWriter{line: func(line string) {
+		if strings.HasPrefix(line, HandshakePrefix+"|") {
+			select {
+			case handshake <- line:
+				return
+			default:
+			}
+		}
+		common.LogInfo("Plugin %s: %s", p.info.Name, line)
+	}}
+	cmd.Stderr = &lineWriter{line: func(line string) {
+		common.LogWarn("Plugin %s: %s", p.info.Name, line)
+	}}
+	// Plugins are not waited for once their input is closed, when they
+	// leave children holding their output
+	cmd.WaitDelay = StopTimeout
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return m.fail(p, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return m.fail(p, err)
+	}
+
+	proc := &process{cmd: cmd, stdin: stdin, exited: make(chan struct{})}
+	go func() {
+		proc.err = cmd.Wait()
+		close(proc.exited)
+	}()
+
+	abort := func(err error) error {
+		_ = cmd.Process.Kill()
+		<-proc.exited
+		return m.fail(p, err)
+	}
+
+	var line string
+	select {
+	case line = <-handshake:
+	case <-proc.exited:
+		return m.fail(p, fmt.Errorf("exited before its handshake: %v", cmd.ProcessState))
+	case <-time.After(HandshakeTimeout):
+		return abort(errors.New("no handshake received"))
+	}
+
+	base, err := parseHandshake(line)
+	if err != nil {
+		return abort(err)
+	}
+
+	var manifest Manifest
+	if err := m.do(base, http.MethodGet, "/manifest", nil, &manifest); err != nil {
+		return abort(fmt.Errorf("failed to read manifest: %w", err))
+	}
+
+	m.mu.Lock()
+	p.process = proc
+	p.base = base
+	p.proxy = m.newProxy(base)
+	p.info.Version = manifest.Version
+	p.info.Capabilities = append([]string{}, manifest.Capabilities...)
+	p.info.Running = true
+	p.info.PID = cmd.Process.Pid
+	p.info.Error = ""
+	m.mu.Unlock()
+
+	// Plugins started while closing are stopped right away
+	select {
+	case <-m.closed:
+		m.mu.RLock()
+		m.stop(p)
+		m.mu.RUnlock()
+	default:
+	}
+
+	return nil
+}
+
+func (m *Manager) fail(p *plugin, err error) error {
+	m.mu.Lock()
+	p.info.Running = false
+	p.info.PID = 0
+	p.info.Error = err.Error()
+	m.mu.Unlock()
+	return err
+}
+
+func parseHandshake(line string) (*url.URL, error) {
+	parts := strings.Split(line, "|")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid handshake %q", line)
+	}
+	if version, err := strconv.Atoi(parts[1]); err != nil || version != ProtocolVersion {
+		return nil, fmt.Errorf("unsupported protocol version %s, expected %d", parts[1], ProtocolVersion)
+	}
+
+	host, _, err := net.SplitHostPort(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid handshake address %q", parts[2])
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return nil, fmt.Errorf("plugins must listen on a loopback address, got %s", parts[2])
+	}
+
+	return &url.URL{Scheme: "http", Host: parts[2]}, nil
+}
+
+// supervise waits for the process of a plugin, restarting it when it exits
+// until the manager is closed
+func (m *Manager) supervise(p *plugin) {
+	defer m.wg.Done()
+
+	for {
+		m.mu.RLock()
+		proc := p.process
+		m.mu.RUnlock()
+
+		if proc != nil {
+			<-proc.exited
+			err := proc.err
+
+			select {
+			case <-m.closed:
+				return
+			default:
+			}
+
+			if err == nil {
+				err = errors.New("exited")
+			}
+			common.LogError("Plugins: %s stopped: %v, restarting in %s", p.info.Name, err, RestartDelay)
+			_ = m.fail(p, fmt.Errorf("stopped: %w", err))
+		}
+
+		select {
+		case <-m.closed:
+			return
+		case <-time.After(RestartDelay):
+		}
+
+		m.mu.Lock()
+		p.process = nil
+		p.info.Restarts++
+		m.mu.Unlock()
+
+		if err := m.launch(p); err != nil {
+			common.LogError("Plugins: Failed to restart %s: %v", p.info.Name, err)
+		}
+	}
+}
+
+// Close stops the plugins, closing their input and killing the ones still
+// running after StopTimeout
+func (m *Manager) Close() {
+	select {
+	case <-m.closed:
+		return
+	default:
+		close(m.closed)
+	}
+
+	m.mu.RLock()
+	for _, p := range m.plugins {
+		m.stop(p)
+	}
+	m.mu.RUnlock()
+
+	m.wg.Wait()
+}
+
+// stop closes the input of a plugin, killing it if it outlives StopTimeout
+func (m *Manager) stop(p *plugin) {
+	proc := p.process
+	if proc == nil {
+		return
+	}
+
+	_ = proc.stdin.Close()
+	go func() {
+		select {
+		case <-proc.exited:
+		case <-time.After(StopTimeout):
+			_ = proc.cmd.Process.Kill()
+		}
+	}()
+}
+
+func (m *Manager) List() []common.PluginInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	list := make([]common.PluginInfo, 0, len(m.names))
+	for _, name := range m.names {
+		info := m.plugins[name].info
+		info.Capabilities = slices.Clone(info.Capabilities)
+		list = append(list, info)
+	}
+	return list
+}
+
+// capable returns the running plugins with a capability, sorted by name
+func (m *Manager) capable(capability string) []*plugin {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var plugins []*plugin
+	for _, name := range m.names {
+		p := m.plugins[name]
+		if slices.Contains(p.info.Capabilities, capability) {
+			plugins = append(plugins, p)
+		}
+	}
+	return plugins
+}
+
+// call sends a call to a running plugin
+func (m *Manager) call(p *plugin, path string, request, response any) error {
+	m.mu.RLock()
+	base, running := p.base, p.info.Running
+	m.mu.RUnlock()
+
+	if !running {
+		return fmt.Errorf("plugin %s is not running", p.info.Name)
+	}
+	if err := m.do(base, http.MethodPost, path, request, response); err != nil {
+		return fmt.Errorf("plugin %s: %w", p.info.Name, err)
+	}
+	return nil
+}
+
+func (m *Manager) do(base *url.URL, method, path string, request, response any) error {
+	var body io.Reader
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, base.String()+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(TokenHeader, m.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&errResp) == nil && errResp.Error != "" {
+			return errors.New(errResp.Error)
+		}
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// MutateRequest sends the request to each request mutator in turn. The
+// body stream of the request, which plugins never see, is kept.
+func (m *Manager) MutateRequest(req *common.ServerRequest, sessionID string, tags []string) error {
+	for _, p := range m.capable(CapabilityMutateRequest) {
+		var resp MutateResponse
+		if err := m.call(p, "/mutate_request", MutateRequest{SessionID: sessionID, Tags: tags, DryRun: req.Options.DryRun, Request: *req}, &resp); err != nil {
+			return err
+		}
+
+		mutated := resp.Request
+		mutated.ID = req.ID
+		mutated.BodyStream = req.BodyStream
+		mutated.OnProgress = req.OnProgress
+		*req = mutated
+	}
+	return nil
+}
+
+// Middleware asks the auth providers about each request but the liveness check,
+// before API key authentication. The first provider accepting a request
+// sets its API key, and any of them may reject it. A provider failing to
+// answer, or not running, rejects the request too.
+func (m *Manager) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Providers verify their own credentials, never the API keys
+		header := r.Header.Clone()
+		header.Del("X-API-Key")
+
+		for _, p := range m.capable(CapabilityAuthenticate) {
+			var resp AuthenticateResponse
+			err := m.call(p, "/authenticate", AuthenticateRequest{
+				Method:     r.Method,
+				Path:       r.URL.Path,
+				Header:     header,
+				RemoteAddr: r.RemoteAddr,
+			}, &resp)
+			if err != nil {
+				common.LogError("Plugins: Failed to authenticate %s %s: %v", r.Method, r.URL.Path, err)
+				writeError(w, "auth provider unavailable", http.StatusServiceUnavailable)
+				return
+			}
+
+			if resp.Deny != "" {
+				common.LogWarn("Plugins: %s rejected %s %s: %s", p.info.Name, r.Method, r.URL.Path, resp.Deny)
+				writeError(w, resp.Deny, http.StatusUnauthorized)
+				return
+			}
+			if resp.APIKey != "" {
+				r.Header.Set("X-API-Key", resp.APIKey)
+				break
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *Manager) Endpoints(name string) (http.Handler, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	p, exists := m.plugins[name]
+	if !exists || !slices.Contains(p.info.Capabilities, CapabilityEndpoints) {
+		return nil, common.ErrPluginNotFound
+	}
+	if !p.info.Running {
+		return nil, fmt.Errorf("plugin %s is not running", name)
+	}
+	return p.proxy, nil
+}
+
+// newProxy forwards requests to the custom endpoints of a plugin
+func (m *Manager) newProxy(base *url.URL) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(base)
+			r.Out.URL.Path = "/endpoints" + r.In.URL.Path
+			r.Out.URL.RawPath = ""
+			r.Out.Header.Set(TokenHeader, m.token)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			common.LogError("Plugins: Failed to reach endpoint %s: %v", r.URL.Path, err)
+			writeError(w, "plugin unavailable", http.StatusBadGateway)
+		},
+	}
+}
+
+func writeError(w http.ResponseWriter, message string, code int) {
+	data, _ := json.Marshal(ErrorResponse{Error: message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(data)
+}
+
+// lineWriter hands each line written to it to line
+type lineWriter struct {
+	buf  []byte
+	line func(string)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.line(strings.TrimRight(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+}
@@ -0,0 +1,86 @@
+package plugins
+
+import (
+	"net/http"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// A plugin is an executable started by the server with MagicEnv set to "1"
+// and TokenEnv to a random token. It listens on a loopback address, prints
+// the handshake "azuretls-plugin|1|127.0.0.1:PORT" as the first line of its
+// standard output, and serves:
+//
+//	GET  /manifest        Manifest
+//	POST /mutate_request  MutateRequest, answered with MutateResponse
+//	POST /authenticate    AuthenticateRequest, answered with AuthenticateResponse
+//	*    /endpoints/...   the custom endpoints, mounted on /api/v1/plugins/{name}/...
+//
+// Every call carries the token in the TokenHeader header. Calls failing are
+// answered with a non-200 status and an ErrorResponse. The plugin exits
+// when its standard input is closed.
+//
+// The protocol is plain JSON over HTTP rather than hashicorp/go-plugin or
+// gRPC: plugins in any language need no more than an HTTP server, and the
+// server no generated code nor RPC dependencies.
+const (
+	HandshakePrefix = "azuretls-plugin"
+	ProtocolVersion = 1
+
+	MagicEnv = "AZURETLS_PLUGIN"
+	TokenEnv = "AZURETLS_PLUGIN_TOKEN"
+
+	TokenHeader = "X-AzureTLS-Plugin-Token"
+	// KeyNameHeader holds the name of the API key of the requests sent to
+	// custom endpoints, when authenticated
+	KeyNameHeader = "X-AzureTLS-Key-Name"
+)
+
+// Capabilities declared in the manifest of a plugin
+const (
+	CapabilityEndpoints     = "endpoints"
+	CapabilityMutateRequest = "mutate_request"
+	CapabilityAuthenticate  = "authenticate"
+)
+
+type Manifest struct {
+	Version      string   `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// MutateRequest is sent before each outgoing request, ahead of the request
+// rules. SessionID is empty for stateless requests. DryRun is set for the
+// requests rendered without being sent, whose side effects, such as
+// consuming a one-time token, plugins should skip.
+type MutateRequest struct {
+	SessionID string               `json:"session_id,omitempty"`
+	Tags      []string             `json:"tags,omitempty"`
+	DryRun    bool                 `json:"dry_run,omitempty"`
+	Request   common.ServerRequest `json:"request"`
+}
+
+// MutateResponse holds the request to send instead, whose id is kept
+type MutateResponse struct {
+	Request common.ServerRequest `json:"request"`
+}
+
+// AuthenticateRequest is sent for each API request but health checks,
+// before API key authentication
+type AuthenticateRequest struct {
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Header     http.Header `json:"headers"`
+	RemoteAddr string      `json:"remote_addr"`
+}
+
+// AuthenticateResponse accepts the request as made with APIKey, one of the
+// configured keys, or rejects it with the reason in Deny. Empty responses
+// leave the request to the next auth provider and the API keys.
+type AuthenticateResponse struct {
+	APIKey string `json:"api_key,omitempty"`
+	Deny   string `json:"deny,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,246 @@
+package probe
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/rotation"
+)
+
+const DefaultInterval = 60 * time.Second
+
+type probe struct {
+	status common.ProbeStatus
+	stop   chan struct{}
+}
+
+// Prober checks each probe on its own schedule, through a fresh session
+// every time so that the checks look like first visits
+type Prober struct {
+	run    common.ProbeRunner
+	probes map[string]*probe
+	mu     sync.Mutex
+}
+
+func NewProber(run common.ProbeRunner) *Prober {
+	return &Prober{
+		run:    run,
+		probes: make(map[string]*probe),
+	}
+}
+
+// Validate checks a probe and fills its defaults
+func Validate(p *common.Probe) error {
+	if p.Name == "" {
+		return fmt.Errorf("probe name required")
+	}
+
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("probe %s: invalid URL %q", p.Name, p.URL)
+	}
+
+	if p.IntervalSeconds < 0 || p.TimeoutMs < 0 {
+		return fmt.Errorf("probe %s: interval and timeout must not be negative", p.Name)
+	}
+	if p.IntervalSeconds == 0 {
+		p.IntervalSeconds = int(DefaultInterval / time.Second)
+	}
+
+	p.Method = strings.ToUpper(p.Method)
+	if p.Method == "" {
+		p.Method = http.MethodGet
+	}
+	return nil
+}
+
+func (p *Prober) Add(config common.Probe) (common.ProbeStatus, error) {
+	if err := Validate(&config); err != nil {
+		return common.ProbeStatus{}, err
+	}
+
+	pr := &probe{
+		status: common.ProbeStatus{Probe: config},
+		stop:   make(chan struct{}),
+	}
+
+	p.mu.Lock()
+	if previous, exists := p.probes[config.Name]; exists {
+		close(previous.stop)
+	}
+	p.probes[config.Name] = pr
+	status := snapshot(pr)
+	p.mu.Unlock()
+
+	go p.loop(pr)
+
+	common.LogInfo("Probe: Checking %s (%s) every %ds", config.Name, config.URL, config.IntervalSeconds)
+	return status, nil
+}
+
+func (p *Prober) Remove(name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pr, exists := p.probes[name]
+	if !exists {
+		return false
+	}
+
+	close(pr.stop)
+	delete(p.probes, name)
+	return true
+}
+
+func (p *Prober) Get(name string) (common.ProbeStatus, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pr, exists := p.probes[name]
+	if !exists {
+		return common.ProbeStatus{}, false
+	}
+	return snapshot(pr), true
+}
+
+func (p *Prober) List() []common.ProbeStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	probes := make([]common.ProbeStatus, 0, len(p.probes))
+	for _, pr := range p.probes {
+		probes = append(probes, snapshot(pr))
+	}
+
+	sort.Slice(probes, func(i, k int) bool {
+		return probes[i].Name < probes[k].Name
+	})
+	return probes
+}
+
+// Close stops every probe
+func (p *Prober) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for name, pr := range p.probes {
+		close(pr.stop)
+		delete(p.probes, name)
+	}
+}
+
+func (p *Prober) loop(pr *probe) {
+	p.check(pr)
+
+	ticker := time.NewTicker(time.Duration(pr.status.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pr.stop:
+			return
+		case <-ticker.C:
+			p.check(pr)
+		}
+	}
+}
+
+// check sends the request of a probe and records its result
+func (p *Prober) check(pr *probe) {
+	config := pr.status.Probe
+
+	req := &common.ServerRequest{
+		Method:         config.Method,
+		URL:            config.URL,
+		OrderedHeaders: config.OrderedHeaders,
+		Options:        common.RequestOptions{TimeoutMs: config.TimeoutMs},
+	}
+	sessionConfig := &common.SessionConfig{
+		Profile: config.Profile,
+		Browser: config.Browser,
+		Proxy:   config.Proxy,
+	}
+
+	start := time.Now()
+	resp := p.run(req, sessionConfig)
+
+	result := common.ProbeResult{
+		Time:       start.UTC(),
+		StatusCode: resp.StatusCode,
+		LatencyMs:  time.Since(start).Milliseconds(),
+		Error:      resp.Error,
+	}
+	if result.Error == "" {
+		result.Challenge = rotation.IsChallenge(resp.StatusCode, resp.Headers, resp.Body)
+		result.Healthy = !result.Challenge && expected(config, resp.StatusCode)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The probe may have been removed or replaced during the check
+	select {
+	case <-pr.stop:
+		return
+	default:
+	}
+
+	wasHealthy := pr.status.Last == nil || pr.status.Last.Healthy
+	pr.status.Last = &result
+	pr.status.Checks++
+
+	switch {
+	case result.Healthy:
+		if pr.status.HealthySince == nil {
+			pr.status.HealthySince = &result.Time
+		}
+	default:
+		pr.status.Failures++
+		pr.status.HealthySince = nil
+	}
+	if result.Challenge {
+		pr.status.Challenges++
+	}
+
+	if wasHealthy && !result.Healthy {
+		common.LogWarn("Probe: %s is unhealthy: %s", config.Name, reason(result))
+	} else if !wasHealthy && result.Healthy {
+		common.LogInfo("Probe: %s is healthy again", config.Name)
+	}
+}
+
+// reason describes why a check was unhealthy
+func reason(result common.ProbeResult) string {
+	switch {
+	case result.Error != "":
+		return result.Error
+	case result.Challenge:
+		return fmt.Sprintf("challenge detected (status %d)", result.StatusCode)
+	default:
+		return fmt.Sprintf("unexpected status %d", result.StatusCode)
+	}
+}
+
+func expected(config common.Probe, statusCode int) bool {
+	if len(config.ExpectStatus) == 0 {
+		return statusCode < http.StatusBadRequest
+	}
+	return slices.Contains(config.ExpectStatus, statusCode)
+}
+
+// snapshot copies the status of a probe, with the lock held
+func snapshot(pr *probe) common.ProbeStatus {
+	status := pr.status
+	if status.Last != nil {
+		last := *status.Last
+		status.Last = &last
+	}
+	return status
+}
@@ -0,0 +1,145 @@
+package profile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"gopkg.in/yaml.v3"
+)
+
+// Catalog holds the profiles defined by the JSON and YAML files of a
+// directory. Each file holds either one profile, named after the file
+// when it has no name, or a list of profiles.
+type Catalog struct {
+	dir      string
+	profiles map[string]common.Profile
+	mu       sync.RWMutex
+}
+
+func NewCatalog(dir string) *Catalog {
+	return &Catalog{
+		dir:      dir,
+		profiles: make(map[string]common.Profile),
+	}
+}
+
+// Reload reads the directory again and returns the number of profiles
+// loaded. On error the previously loaded profiles are kept.
+func (c *Catalog) Reload() (int, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read profile directory: %w", err)
+	}
+
+	profiles := make(map[string]common.Profile)
+	for _, entry := range entries {
+		if entry.IsDir() || !isProfileFile(entry.Name()) {
+			continue
+		}
+
+		loaded, err := loadFile(filepath.Join(c.dir, entry.Name()))
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+
+		for _, profile := range loaded {
+			if existing, exists := profiles[profile.Name]; exists {
+				return 0, fmt.Errorf("%s: profile %s already defined in %s", entry.Name(), profile.Name, existing.Source)
+			}
+			profiles[profile.Name] = profile
+		}
+	}
+
+	c.mu.Lock()
+	c.profiles = profiles
+	c.mu.Unlock()
+
+	return len(profiles), nil
+}
+
+func (c *Catalog) Get(name string) (common.Profile, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	profile, exists := c.profiles[name]
+	return profile, exists
+}
+
+// List returns the profiles sorted by name
+func (c *Catalog) List() []common.Profile {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	profiles := make([]common.Profile, 0, len(c.profiles))
+	for _, profile := range c.profiles {
+		profiles = append(profiles, profile)
+	}
+
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+
+	return profiles
+}
+
+func isProfileFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+func loadFile(path string) ([]common.Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// YAML is converted to JSON so that both formats share the json tags
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".json" {
+		var document any
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, err
+		}
+
+		if data, err = json.Marshal(document); err != nil {
+			return nil, err
+		}
+	}
+
+	source := filepath.Base(path)
+	data = bytes.TrimSpace(data)
+
+	var profiles []common.Profile
+	if bytes.HasPrefix(data, []byte("[")) {
+		if err := json.Unmarshal(data, &profiles); err != nil {
+			return nil, err
+		}
+	} else {
+		var profile common.Profile
+		if err := json.Unmarshal(data, &profile); err != nil {
+			return nil, err
+		}
+		if profile.Name == "" {
+			profile.Name = strings.TrimSuffix(source, filepath.Ext(source))
+		}
+		profiles = append(profiles, profile)
+	}
+
+	for i := range profiles {
+		if profiles[i].Name == "" {
+			return nil, fmt.Errorf("profile %d has no name", i)
+		}
+		profiles[i].Source = source
+	}
+
+	return profiles, nil
+}
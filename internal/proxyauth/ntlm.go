@@ -0,0 +1,186 @@
+package proxyauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// NTLM message flags (MS-NLMP 2.2.2.5)
+const (
+	flagUnicode                 = 0x00000001
+	flagOEM                     = 0x00000002
+	flagRequestTarget           = 0x00000004
+	flagNTLM                    = 0x00000200
+	flagAlwaysSign              = 0x00008000
+	flagExtendedSessionSecurity = 0x00080000
+	flag128                     = 0x20000000
+	flag56                      = 0x80000000
+
+	negotiateFlags = flagUnicode | flagOEM | flagRequestTarget | flagNTLM | flagAlwaysSign |
+		flagExtendedSessionSecurity | flag128 | flag56
+)
+
+const (
+	// avTimestamp is the AV_PAIR of the challenge holding the server time
+	avTimestamp = 7
+
+	// windowsEpoch is the number of 100 ns intervals between 1601 and 1970
+	windowsEpoch = 116444736000000000
+)
+
+var (
+	ntlmSignature = []byte("NTLMSSP\x00")
+
+	ErrInvalidChallenge = errors.New("invalid NTLM challenge")
+)
+
+// negotiateMessage returns the NTLM NEGOTIATE_MESSAGE opening a handshake,
+// without domain nor workstation
+func negotiateMessage() []byte {
+	msg := make([]byte, 32)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], negotiateFlags)
+	return msg
+}
+
+// challenge is the part of a CHALLENGE_MESSAGE the answer depends on
+type challenge struct {
+	flags       uint32
+	serverNonce []byte
+	targetInfo  []byte
+}
+
+func parseChallenge(msg []byte) (*challenge, error) {
+	if len(msg) < 32 || !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 2 {
+		return nil, ErrInvalidChallenge
+	}
+
+	c := &challenge{
+		flags:       binary.LittleEndian.Uint32(msg[20:]),
+		serverNonce: msg[24:32],
+	}
+
+	if len(msg) >= 48 {
+		length := int(binary.LittleEndian.Uint16(msg[40:]))
+		offset := int(binary.LittleEndian.Uint32(msg[44:]))
+		if offset+length > len(msg) {
+			return nil, ErrInvalidChallenge
+		}
+		c.targetInfo = msg[offset : offset+length]
+	}
+
+	return c, nil
+}
+
+// timestamp returns the server time of the challenge, as a FILETIME, or
+// the current time when the challenge does not carry it
+func (c *challenge) timestamp() []byte {
+	info := c.targetInfo
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if 4+length > len(info) {
+			break
+		}
+		if id == avTimestamp && length == 8 {
+			return info[4:12]
+		}
+		info = info[4+length:]
+	}
+
+	stamp := make([]byte, 8)
+	binary.LittleEndian.PutUint64(stamp, uint64(time.Now().UnixNano()/100+windowsEpoch))
+	return stamp
+}
+
+// authenticateMessage answers a challenge with an NTLMv2 AUTHENTICATE_MESSAGE
+func authenticateMessage(c *challenge, user, password, domain, workstation string) ([]byte, error) {
+	clientNonce := make([]byte, 8)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return nil, err
+	}
+
+	ntResponse, lmResponse := NTLMv2Responses(NTOWFv2(user, password, domain), c.serverNonce, clientNonce, c.timestamp(), c.targetInfo)
+
+	fields := [][]byte{
+		lmResponse,
+		ntResponse,
+		encodeString(domain),
+		encodeString(user),
+		encodeString(workstation),
+		nil, // EncryptedRandomSessionKey, no key exchange being negotiated
+	}
+
+	const headerSize = 64
+	msg := make([]byte, headerSize)
+	copy(msg, ntlmSignature)
+	binary.LittleEndian.PutUint32(msg[8:], 3)
+
+	offset := headerSize
+	for i, field := range fields {
+		at := 12 + i*8
+		binary.LittleEndian.PutUint16(msg[at:], uint16(len(field)))
+		binary.LittleEndian.PutUint16(msg[at+2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(msg[at+4:], uint32(offset))
+		offset += len(field)
+	}
+	binary.LittleEndian.PutUint32(msg[60:], c.flags&negotiateFlags|flagUnicode)
+
+	for _, field := range fields {
+		msg = append(msg, field...)
+	}
+	return msg, nil
+}
+
+// NTOWFv2 derives the NTLMv2 key of a user (MS-NLMP 3.3.2)
+func NTOWFv2(user, password, domain string) []byte {
+	hash := md4.New()
+	hash.Write(encodeString(password))
+	return hmacMD5(hash.Sum(nil), encodeString(strings.ToUpper(user)+domain))
+}
+
+// NTLMv2Responses returns the NtChallengeResponse and LmChallengeResponse
+// of an NTLMv2 key to a challenge (MS-NLMP 3.3.2), the timestamp being a
+// FILETIME and targetInfo the AV_PAIRs of the challenge
+func NTLMv2Responses(key, serverChallenge, clientChallenge, timestamp, targetInfo []byte) (nt, lm []byte) {
+	// NTLMv2_CLIENT_CHALLENGE (MS-NLMP 2.2.2.7)
+	var blob bytes.Buffer
+	blob.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	blob.Write(timestamp)
+	blob.Write(clientChallenge)
+	blob.Write([]byte{0, 0, 0, 0})
+	blob.Write(targetInfo)
+	blob.Write([]byte{0, 0, 0, 0})
+
+	nt = append(hmacMD5(key, serverChallenge, blob.Bytes()), blob.Bytes()...)
+	lm = append(hmacMD5(key, serverChallenge, clientChallenge), clientChallenge...)
+	return nt, lm
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// encodeString encodes s in UTF-16LE, the encoding of Unicode NTLM messages
+func encodeString(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	encoded := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(encoded[2*i:], unit)
+	}
+	return encoded
+}
@@ -0,0 +1,238 @@
+// Package proxyauth opens tunnels through HTTP proxies authenticating with
+// NTLM, a connection-bound challenge handshake, under the NTLM or the
+// Negotiate scheme, or with Kerberos under Negotiate when a realm is
+// configured.
+package proxyauth
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/kerberos"
+)
+
+var ErrRejected = errors.New("proxy rejected the credentials")
+
+// Validate checks the scheme and credentials of a proxy auth config
+func Validate(config common.ProxyAuthConfig) error {
+	if config.Scheme != common.ProxyAuthNTLM && config.Scheme != common.ProxyAuthNegotiate {
+		return fmt.Errorf("unknown proxy_auth scheme %q, expected %s or %s", config.Scheme, common.ProxyAuthNTLM, common.ProxyAuthNegotiate)
+	}
+	if config.Username == "" {
+		return fmt.Errorf("proxy_auth username required")
+	}
+
+	if config.Realm == "" && config.KDC == "" && config.SPN == "" {
+		return nil
+	}
+	if config.Scheme != common.ProxyAuthNegotiate {
+		return fmt.Errorf("proxy_auth realm, kdc and spn require the %s scheme", common.ProxyAuthNegotiate)
+	}
+	if config.Realm == "" {
+		return fmt.Errorf("proxy_auth kdc and spn require a realm")
+	}
+	if config.Password == "" {
+		return fmt.Errorf("proxy_auth password required for Kerberos")
+	}
+	return nil
+}
+
+// Authenticator runs the handshake of a proxy auth config. With Kerberos,
+// it keeps the tickets obtained for the proxy across connections.
+type Authenticator struct {
+	config   common.ProxyAuthConfig
+	kerberos *kerberos.Client
+}
+
+// New returns the authenticator of a valid proxy auth config
+func New(config common.ProxyAuthConfig) *Authenticator {
+	a := &Authenticator{config: config}
+	if config.Realm != "" {
+		user, _ := splitUser(config)
+		a.kerberos = kerberos.NewClient(user, strings.ToUpper(config.Realm), config.Password, config.KDC)
+	}
+	return a
+}
+
+// Connect opens a tunnel to addr over conn, a connection to the proxy at
+// proxyHost, authenticating to it. The handshake must complete on conn,
+// which is returned ready for the tunneled traffic.
+func (a *Authenticator) Connect(ctx context.Context, conn net.Conn, proxyHost, addr string, header http.Header) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	reader := bufio.NewReader(conn)
+	if a.kerberos != nil {
+		return a.connectKerberos(ctx, conn, reader, proxyHost, addr, header)
+	}
+	return a.connectNTLM(conn, reader, addr, header)
+}
+
+// connectKerberos sends a Kerberos ticket for the proxy with the first
+// CONNECT request, the proxy answering without challenge
+func (a *Authenticator) connectKerberos(ctx context.Context, conn net.Conn, reader *bufio.Reader, proxyHost, addr string, header http.Header) (net.Conn, error) {
+	spn := a.config.SPN
+	if spn == "" {
+		spn = "HTTP/" + proxyHost
+	}
+
+	token, err := a.kerberos.Negotiate(ctx, spn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a Kerberos ticket for %s: %w", spn, err)
+	}
+
+	resp, err := connect(conn, reader, addr, header, "Negotiate "+base64.StdEncoding.EncodeToString(token))
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return tunnel(conn, reader), nil
+	case http.StatusProxyAuthRequired:
+		return nil, ErrRejected
+	default:
+		return nil, fmt.Errorf("proxy tunnel failed: %s", resp.Status)
+	}
+}
+
+func (a *Authenticator) connectNTLM(conn net.Conn, reader *bufio.Reader, addr string, header http.Header) (net.Conn, error) {
+	scheme := "NTLM"
+	if a.config.Scheme == common.ProxyAuthNegotiate {
+		scheme = "Negotiate"
+	}
+
+	user, domain := splitUser(a.config)
+
+	resp, err := connect(conn, reader, addr, header, scheme+" "+base64.StdEncoding.EncodeToString(negotiateMessage()))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return tunnel(conn, reader), nil
+	}
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		return nil, fmt.Errorf("proxy tunnel failed: %s", resp.Status)
+	}
+
+	token := challengeToken(resp.Header, scheme)
+	if token == nil {
+		return nil, fmt.Errorf("proxy did not answer with an NTLM challenge under the %s scheme", scheme)
+	}
+	if resp.Close {
+		return nil, fmt.Errorf("proxy closed the connection during the %s handshake", scheme)
+	}
+
+	// Negotiate proxies answer with a Kerberos token when they do not
+	// accept NTLM, which needs a realm to be configured
+	c, err := parseChallenge(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w, set a realm to authenticate with Kerberos under the %s scheme", err, scheme)
+	}
+	msg, err := authenticateMessage(c, user, a.config.Password, domain, a.config.Workstation)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err = connect(conn, reader, addr, header, scheme+" "+base64.StdEncoding.EncodeToString(msg))
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return tunnel(conn, reader), nil
+	case http.StatusProxyAuthRequired:
+		return nil, ErrRejected
+	default:
+		return nil, fmt.Errorf("proxy tunnel failed: %s", resp.Status)
+	}
+}
+
+// splitUser returns the user and domain of a config, the username taking
+// precedence when given as DOMAIN\user
+func splitUser(config common.ProxyAuthConfig) (string, string) {
+	if before, after, found := strings.Cut(config.Username, `\`); found {
+		return after, before
+	}
+	return config.Username, config.Domain
+}
+
+// connect sends a CONNECT request and reads its response, discarding the
+// body of a refusal so that the connection can carry the next request. The
+// tunnel starts right after a successful response.
+func connect(conn net.Conn, reader *bufio.Reader, addr string, header http.Header, authorization string) (*http.Response, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: addr},
+		Host:   addr,
+		Header: header.Clone(),
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Proxy-Authorization", authorization)
+	req.Header.Set("Proxy-Connection", "keep-alive")
+
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// challengeToken returns the decoded token of the scheme's challenge, or
+// nil when the proxy sent none
+func challengeToken(header http.Header, scheme string) []byte {
+	for _, value := range header.Values("Proxy-Authenticate") {
+		name, token, _ := strings.Cut(strings.TrimSpace(value), " ")
+		if !strings.EqualFold(name, scheme) || token == "" {
+			continue
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token))
+		if err == nil {
+			return decoded
+		}
+	}
+	return nil
+}
+
+// tunnel returns conn, reading first what the proxy sent past its response
+func tunnel(conn net.Conn, reader *bufio.Reader) net.Conn {
+	if reader.Buffered() == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, reader: reader}
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,150 @@
+package ratelimit
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// headerPrefixes are the prefixes of the limit, remaining and reset
+// headers, the IETF draft ones first
+var headerPrefixes = []string{"RateLimit-", "X-RateLimit-", "X-Rate-Limit-"}
+
+// Parse normalizes the rate limit headers of a response. It returns nil
+// when the response carries none and is not a 429.
+//
+// Reset values are read as a delay in seconds, or as a Unix timestamp in
+// seconds or milliseconds when large enough to be one.
+func Parse(header http.Header, statusCode int, now time.Time) *common.RateLimit {
+	rateLimit := &common.RateLimit{
+		Limited: statusCode == http.StatusTooManyRequests,
+	}
+	found := rateLimit.Limited
+
+	var reset string
+	for _, prefix := range headerPrefixes {
+		if value, ok := parseInt(header.Get(prefix + "Limit")); ok && rateLimit.Limit == nil {
+			rateLimit.Limit = &value
+			found = true
+		}
+		if value, ok := parseInt(header.Get(prefix + "Remaining")); ok && rateLimit.Remaining == nil {
+			rateLimit.Remaining = &value
+			found = true
+		}
+		if value := header.Get(prefix + "Reset"); value != "" && reset == "" {
+			reset = value
+			found = true
+		}
+	}
+
+	// Structured form of the IETF draft: RateLimit: limit=100, remaining=50, reset=30
+	if value := header.Get("RateLimit"); value != "" {
+		for _, item := range strings.Split(value, ",") {
+			key, param, _ := strings.Cut(strings.TrimSpace(item), "=")
+			param, _, _ = strings.Cut(param, ";")
+			n, ok := parseInt(param)
+			if !ok {
+				continue
+			}
+
+			switch strings.ToLower(key) {
+			case "limit":
+				rateLimit.Limit = &n
+			case "remaining":
+				rateLimit.Remaining = &n
+			case "reset":
+				reset = param
+			default:
+				continue
+			}
+			found = true
+		}
+	}
+
+	if resetAt, ok := parseReset(reset, now); ok {
+		rateLimit.ResetAt = &resetAt
+	}
+
+	// Retry-After is also sent with redirects and accepted jobs, where it
+	// says nothing about rate limits
+	retryAfter, hasRetryAfter := parseRetryAfter(header.Get("Retry-After"), now)
+	hasRetryAfter = hasRetryAfter && (rateLimit.Limited || statusCode == http.StatusServiceUnavailable)
+	found = found || hasRetryAfter
+
+	if !found {
+		return nil
+	}
+
+	var delay time.Duration
+	switch {
+	case hasRetryAfter:
+		delay = retryAfter
+	case rateLimit.ResetAt != nil && rateLimit.Remaining != nil && *rateLimit.Remaining <= 0:
+		delay = rateLimit.ResetAt.Sub(now)
+	case rateLimit.ResetAt != nil && rateLimit.Remaining != nil:
+		// Spread the remaining requests until the window resets
+		delay = rateLimit.ResetAt.Sub(now) / time.Duration(*rateLimit.Remaining)
+	}
+	rateLimit.SuggestedDelayMs = max(delay.Milliseconds(), 0)
+
+	return rateLimit
+}
+
+// parseRetryAfter reads a Retry-After header, either a delay in seconds or
+// an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+
+	return 0, false
+}
+
+func parseReset(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		if date, err := http.ParseTime(value); err == nil {
+			return date.UTC(), true
+		}
+		return time.Time{}, false
+	}
+
+	switch {
+	case n >= 1e12:
+		return time.UnixMilli(int64(n)).UTC(), true
+	case n >= 1e9:
+		return time.Unix(int64(n), 0).UTC(), true
+	default:
+		return now.Add(time.Duration(n * float64(time.Second))).UTC(), true
+	}
+}
+
+// parseInt reads the first number of a header value, as in "100" or
+// "100, 100;w=60"
+func parseInt(value string) (int, bool) {
+	value, _, _ = strings.Cut(value, ",")
+	value, _, _ = strings.Cut(value, ";")
+
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,77 @@
+package rest
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/auth"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/dashboard"
+	"github.com/gorilla/mux"
+)
+
+// Admin endpoints, restricted to admin API keys
+
+func (h *Handler) AdminStats(w http.ResponseWriter, r *http.Request) {
+	keys := h.limiter.KeyStats()
+	if key := auth.FromContext(r.Context()); key != nil {
+		if stats, exists := keys[key.Name()]; exists {
+			stats.InFlight = max(stats.InFlight-1, 0)
+			keys[key.Name()] = stats
+		}
+	}
+
+	response := common.AdminStats{
+		Timestamp:            time.Now().UTC(),
+		Sessions:             len(h.controller.ListSessions()),
+		WebSocketConnections: len(h.connections.Describe()),
+		Limiter: common.LimiterStats{
+			// The stats request itself holds one slot
+			InFlight: max(h.limiter.InFlight()-1, 0),
+			Capacity: h.limiter.Capacity(),
+			Keys:     keys,
+		},
+		Requests:    h.controller.RequestStats(),
+		SessionPool: h.controller.PoolStats(),
+		Scheduler:   h.controller.SchedulerStats(),
+	}
+
+	h.writer.WriteJSONResponse(w, response, http.StatusOK)
+}
+
+func (h *Handler) AdminSessions(w http.ResponseWriter, r *http.Request) {
+	h.writer.WriteJSONResponse(w, map[string]any{"sessions": h.controller.DescribeSessions()}, http.StatusOK)
+}
+
+func (h *Handler) AdminRequests(w http.ResponseWriter, r *http.Request) {
+	h.writer.WriteJSONResponse(w, map[string]any{"requests": h.controller.RecentRequests()}, http.StatusOK)
+}
+
+func (h *Handler) AdminConnections(w http.ResponseWriter, r *http.Request) {
+	h.writer.WriteJSONResponse(w, map[string]any{"connections": h.connections.Describe()}, http.StatusOK)
+}
+
+// CloseConnection force-closes a WebSocket connection, the optional reason
+// query parameter being sent in the close frame
+func (h *Handler) CloseConnection(w http.ResponseWriter, r *http.Request) {
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "closed by an administrator"
+	}
+
+	if err := h.connections.CloseConnection(mux.Vars(r)["id"], reason); err != nil {
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Dashboard serves the operator UI, which reads the admin endpoints with
+// the API key of the page URL
+func (h *Handler) Dashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(dashboard.Page)
+}
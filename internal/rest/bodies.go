@@ -0,0 +1,51 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/gorilla/mux"
+)
+
+func bodyErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, common.ErrBodyStoreDisabled), errors.Is(err, common.ErrBodyNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// GetBody serves a response body stored with the body_ref option, supporting
+// range and conditional requests
+func (h *Handler) GetBody(w http.ResponseWriter, r *http.Request) {
+	ref := mux.Vars(r)["ref"]
+
+	file, stored, err := h.controller.OpenBody(ref)
+	if err != nil {
+		h.writer.WriteErrorResponse(w, err.Error(), bodyErrorStatus(err), nil)
+		return
+	}
+	defer file.Close()
+
+	contentType := stored.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+stored.Ref+`"`)
+	w.Header().Set("Expires", stored.ExpiresAt.Format(http.TimeFormat))
+
+	http.ServeContent(w, r, "", stored.CreatedAt, file)
+}
+
+// DeleteBody deletes a stored response body before it expires
+func (h *Handler) DeleteBody(w http.ResponseWriter, r *http.Request) {
+	if err := h.controller.DeleteBody(mux.Vars(r)["ref"]); err != nil {
+		h.writer.WriteErrorResponse(w, err.Error(), bodyErrorStatus(err), nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
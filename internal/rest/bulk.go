@@ -0,0 +1,130 @@
+package rest
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/Noooste/azuretls-api/internal/auth"
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// parseProxyCSV reads one proxy per record from the first column, skipping
+// an optional "proxy" header row and lines starting with #
+func parseProxyCSV(body io.Reader) ([]string, error) {
+	reader := csv.NewReader(body)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var proxies []string
+	for line := 0; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return proxies, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV: %w", err)
+		}
+
+		proxy := strings.TrimSpace(record[0])
+		if line == 0 && strings.EqualFold(proxy, "proxy") {
+			continue
+		}
+		proxies = append(proxies, proxy)
+	}
+}
+
+// parseBulkSessionRequest reads a JSON request, or a CSV list of proxies
+// with the profile given as query parameter
+func parseBulkSessionRequest(r *http.Request, request *common.BulkSessionRequest) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "text/csv" {
+		_, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), request)
+		return err
+	}
+
+	proxies, err := parseProxyCSV(r.Body)
+	if err != nil {
+		return err
+	}
+	request.Proxies = proxies
+	request.Profile = r.URL.Query().Get("profile")
+
+	return nil
+}
+
+func (h *Handler) CreateSessions(w http.ResponseWriter, r *http.Request) {
+	var request common.BulkSessionRequest
+	if err := parseBulkSessionRequest(r, &request); err != nil {
+		common.LogError("CreateSessions: Failed to parse request body: %v", err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+
+	var err error
+	switch {
+	case len(request.Proxies) == 0:
+		err = errors.New("at least one proxy is required")
+	case request.Proxy != "":
+		err = errors.New("`proxy` cannot be set with `proxies`")
+	case h.config.MaxSessions > 0 && len(request.Proxies) > h.config.MaxSessions:
+		err = fmt.Errorf("at most %d sessions can be created at once", h.config.MaxSessions)
+	case slices.Contains(request.Proxies, ""):
+		err = errors.New("proxies must not be empty")
+	}
+	if err != nil {
+		common.LogError("CreateSessions: Invalid bulk session request: %v", err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+
+	key := auth.FromContext(r.Context())
+	configs := make([]*common.SessionConfig, len(request.Proxies))
+	for i, proxy := range request.Proxies {
+		config := request.SessionConfig
+		config.Proxy = proxy
+		configs[i] = &config
+		if key != nil {
+			configs[i] = key.SessionConfig(configs[i])
+		}
+	}
+
+	if jar := configs[0].CookieJar; jar != "" && !h.reachesCookieJar(w, r, jar) {
+		return
+	}
+
+	results := h.controller.CreateSessions(configs)
+	if key != nil {
+		for _, result := range results {
+			if result.Error == "" {
+				h.controller.ClaimSession(result.SessionID, key.ID())
+			}
+		}
+	}
+
+	created := 0
+	for _, result := range results {
+		if result.Error == "" {
+			created++
+		}
+	}
+	if created == 0 {
+		common.LogError("CreateSessions: Failed to create any of %d sessions: %s", len(results), results[0].Error)
+		h.writer.WriteErrorResponse(w, "failed to create sessions: "+results[0].Error, http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{
+		"sessions": results,
+		"created":  created,
+		"failed":   len(results) - created,
+	}
+
+	h.writer.WriteJSONResponse(w, response, http.StatusCreated)
+}
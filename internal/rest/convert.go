@@ -0,0 +1,67 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/curl"
+)
+
+// ConvertCurl turns a pasted curl command into the equivalent request body
+// for the request endpoints
+func (h *Handler) ConvertCurl(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Command string `json:"command"`
+	}
+
+	_, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &payload)
+	if err != nil {
+		common.LogError("ConvertCurl: Failed to parse request body: %v", err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+
+	serverReq, err := curl.Parse(payload.Command)
+	if err != nil {
+		common.LogWarn("ConvertCurl: Failed to convert curl command: %v", err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusUnprocessableEntity, nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, serverReq, http.StatusOK)
+}
+
+// DeriveFingerprint returns the profile settings reproducing the fingerprint
+// of a browser capture
+func (h *Handler) DeriveFingerprint(w http.ResponseWriter, r *http.Request) {
+	// A HAR file can be posted as is, its entry picked with ?url=
+	var payload struct {
+		common.FingerprintCapture
+		Log json.RawMessage `json:"log,omitempty"`
+	}
+
+	_, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &payload)
+	if err != nil {
+		common.LogError("DeriveFingerprint: Failed to parse request body: %v", err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+
+	capture := payload.FingerprintCapture
+	if len(payload.Log) > 0 {
+		capture.HAR = json.RawMessage(`{"log":` + string(payload.Log) + `}`)
+	}
+	if capture.URL == "" {
+		capture.URL = r.URL.Query().Get("url")
+	}
+
+	derived, err := h.controller.DeriveFingerprint(&capture)
+	if err != nil {
+		common.LogWarn("DeriveFingerprint: Failed to derive fingerprint: %v", err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusUnprocessableEntity, nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, derived, http.StatusOK)
+}
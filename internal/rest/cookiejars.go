@@ -0,0 +1,189 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/Noooste/azuretls-api/internal/auth"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/gorilla/mux"
+)
+
+func cookieJarErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, common.ErrCookieJarsDisabled), errors.Is(err, common.ErrCookieJarNotFound), errors.Is(err, common.ErrCookieJarNotBound):
+		return http.StatusNotFound
+	case errors.Is(err, common.ErrCookieJarExists), errors.Is(err, common.ErrCookieJarUnsupported):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// reachesCookieJar writes a not found error and returns false when the API
+// key of the request may not use a shared cookie jar, which it did not create
+func (h *Handler) reachesCookieJar(w http.ResponseWriter, r *http.Request, name string) bool {
+	key := auth.FromContext(r.Context())
+	if key.ReachesCookieJar(name, h.controller) {
+		return true
+	}
+
+	common.LogWarn("Rejected access of API key %s to cookie jar %q", key.Name(), name)
+	h.writer.WriteErrorResponse(w, common.ErrCookieJarNotFound.Error(), http.StatusNotFound, nil)
+	return false
+}
+
+func (h *Handler) CreateCookieJar(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+	}
+	if _, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &body); err != nil {
+		common.LogError("CreateCookieJar: Failed to parse request body: %v", err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+
+	var owner string
+	if key := auth.FromContext(r.Context()); key != nil {
+		owner = key.ID()
+	}
+
+	info, err := h.controller.CreateCookieJar(body.Name, owner)
+	if err != nil {
+		common.LogWarn("CreateCookieJar: Failed to create cookie jar %q: %v", body.Name, err)
+		h.writer.WriteErrorResponse(w, err.Error(), cookieJarErrorStatus(err), nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, info, http.StatusCreated)
+}
+
+// ListCookieJars lists the shared cookie jars the API key of the request
+// reaches
+func (h *Handler) ListCookieJars(w http.ResponseWriter, r *http.Request) {
+	key := auth.FromContext(r.Context())
+
+	jars := make([]common.CookieJarInfo, 0)
+	for _, info := range h.controller.ListCookieJars() {
+		if key.ReachesCookieJar(info.Name, h.controller) {
+			jars = append(jars, info)
+		}
+	}
+
+	h.writer.WriteJSONResponse(w, map[string]any{"cookie_jars": jars}, http.StatusOK)
+}
+
+func (h *Handler) GetCookieJar(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !h.reachesCookieJar(w, r, name) {
+		return
+	}
+
+	info, err := h.controller.GetCookieJar(name)
+	if err != nil {
+		h.writer.WriteErrorResponse(w, err.Error(), cookieJarErrorStatus(err), nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, info, http.StatusOK)
+}
+
+// DeleteCookieJar deletes a shared cookie jar, the sessions bound to it
+// keeping a copy of its cookies
+func (h *Handler) DeleteCookieJar(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !h.reachesCookieJar(w, r, name) {
+		return
+	}
+
+	if err := h.controller.DeleteCookieJar(name); err != nil {
+		h.writer.WriteErrorResponse(w, err.Error(), cookieJarErrorStatus(err), nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetCookieJarCookies lists the cookies a shared jar would send to the url
+// query parameter
+func (h *Handler) GetCookieJarCookies(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if !h.reachesCookieJar(w, r, name) {
+		return
+	}
+
+	target := r.URL.Query().Get("url")
+	if u, err := url.Parse(target); err != nil || u.Host == "" {
+		h.writer.WriteErrorResponse(w, "url query parameter required", http.StatusBadRequest, nil)
+		return
+	}
+
+	cookies, err := h.controller.CookieJarCookies(name, target)
+	if err != nil {
+		h.writer.WriteErrorResponse(w, err.Error(), cookieJarErrorStatus(err), nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, map[string]any{"cookies": cookies}, http.StatusOK)
+}
+
+// ManageSessionCookieJar reports, binds or unbinds the shared cookie jar of
+// a session
+func (h *Handler) ManageSessionCookieJar(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+
+	if _, err := h.controller.GetSession(sessionID); err != nil {
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+		return
+	}
+
+	if r.Method != http.MethodGet && h.rejectEnforced(w, r, auth.FromContext(r.Context()).CheckSessionChange()) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		name, err := h.controller.SessionCookieJar(sessionID)
+		if err != nil {
+			h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+			return
+		}
+
+		h.writer.WriteJSONResponse(w, map[string]any{"cookie_jar": name}, http.StatusOK)
+
+	case http.MethodPut:
+		var body struct {
+			Name string `json:"name"`
+		}
+		if _, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &body); err != nil {
+			common.LogError("ManageSessionCookieJar: Failed to parse request body for session %s: %v", sessionID, err)
+			h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+			return
+		}
+
+		if !h.reachesCookieJar(w, r, body.Name) {
+			return
+		}
+
+		if err := h.controller.BindCookieJar(sessionID, body.Name); err != nil {
+			common.LogWarn("ManageSessionCookieJar: Failed to bind session %s to cookie jar %q: %v", sessionID, body.Name, err)
+			h.writer.WriteErrorResponse(w, err.Error(), cookieJarErrorStatus(err), nil)
+			return
+		}
+
+		h.writer.WriteJSONResponse(w, map[string]any{"cookie_jar": body.Name}, http.StatusOK)
+
+	case http.MethodDelete:
+		if err := h.controller.UnbindCookieJar(sessionID); err != nil {
+			h.writer.WriteErrorResponse(w, err.Error(), cookieJarErrorStatus(err), nil)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		common.LogWarn("ManageSessionCookieJar: Method not allowed for session %s: %s", sessionID, r.Method)
+		h.writer.WriteErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed, nil)
+	}
+}
@@ -0,0 +1,34 @@
+package rest
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/gorilla/mux"
+)
+
+// GetCookies lists the cookies the session would send to the url query
+// parameter
+func (h *Handler) GetCookies(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+
+	target := r.URL.Query().Get("url")
+	if u, err := url.Parse(target); err != nil || u.Host == "" {
+		h.writer.WriteErrorResponse(w, "url query parameter required", http.StatusBadRequest, nil)
+		return
+	}
+
+	cookies, err := h.controller.GetCookies(sessionID, target)
+	if err != nil {
+		common.LogWarn("GetCookies: Failed to get cookies of session %s: %v", sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+		return
+	}
+
+	response := map[string]any{
+		"cookies": cookies,
+	}
+
+	h.writer.WriteJSONResponse(w, response, http.StatusOK)
+}
@@ -1,26 +1,73 @@
 package rest
 
 import (
+	"errors"
 	http "net/http"
+	"strings"
 
+	"github.com/Noooste/azuretls-api/internal/auth"
 	"github.com/Noooste/azuretls-api/internal/common"
 	"github.com/Noooste/azuretls-api/internal/controller"
+	"github.com/Noooste/azuretls-api/internal/protocol"
 	"github.com/Noooste/azuretls-api/internal/view"
+	"github.com/Noooste/azuretls-api/internal/websocket"
 	"github.com/gorilla/mux"
 )
 
 type Handler struct {
 	controller *controller.SessionController
 	writer     *view.ResponseWriter
+	config     common.ServerConfig
+	limiter    *ConcurrencyLimiter
+	// connections are the WebSocket connections, reported by the admin
+	// endpoints
+	connections *websocket.ConnectionManager
 }
 
-func NewRESTHandler(server common.Server) *Handler {
+func NewRESTHandler(server common.Server, limiter *ConcurrencyLimiter) *Handler {
 	return &Handler{
-		controller: controller.NewSessionController(server.GetSessionManager()),
+		controller: controller.NewSessionController(server),
 		writer:     view.NewResponseWriter(),
+		config:     server.GetConfig(),
+		limiter:    limiter,
 	}
 }
 
+// SessionOwnerMiddleware restricts the session routes to the API key that
+// created or acquired the session, admin keys reaching every session. The
+// sessions of other keys are reported as not found.
+func (h *Handler) SessionOwnerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := auth.FromContext(r.Context())
+		if key == nil || key.Admin() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		template, _ := mux.CurrentRoute(r).GetPathTemplate()
+		sessionID := mux.Vars(r)["id"]
+		if strings.HasPrefix(template, "/api/v1/session/{id}") && !h.controller.OwnsSession(key.ID(), sessionID) {
+			common.LogWarn("Rejected access of API key %s to session %s", key.Name(), sessionID)
+			h.writer.WriteErrorResponse(w, "session not found", http.StatusNotFound, nil)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectEnforced writes an error and returns true when the API key of the
+// request enforces the session settings about to be changed
+func (h *Handler) rejectEnforced(w http.ResponseWriter, r *http.Request, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	common.LogWarn("Rejected %s %s: %v", r.Method, r.URL.Path, err)
+	h.writer.WriteErrorResponse(w, err.Error(), http.StatusForbidden, nil)
+	return true
+}
+
 func (h *Handler) CreateSession(w http.ResponseWriter, r *http.Request) {
 	var config common.SessionConfig
 	encoder, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &config)
@@ -30,13 +77,27 @@ func (h *Handler) CreateSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionID, _, err := h.controller.CreateSession(&config)
+	key := auth.FromContext(r.Context())
+	sessionConfig := &config
+	if key != nil {
+		sessionConfig = key.SessionConfig(sessionConfig)
+	}
+
+	if sessionConfig.CookieJar != "" && !h.reachesCookieJar(w, r, sessionConfig.CookieJar) {
+		return
+	}
+
+	sessionID, _, err := h.controller.CreateSession(sessionConfig)
 	if err != nil {
 		common.LogError("CreateSession: Failed to create session: %v", err)
 		h.writer.WriteErrorResponse(w, err.Error(), http.StatusInternalServerError, encoder)
 		return
 	}
 
+	if key != nil {
+		h.controller.ClaimSession(sessionID, key.ID())
+	}
+
 	response := map[string]string{
 		"session_id": sessionID,
 		"status":     "created",
@@ -58,18 +119,83 @@ func (h *Handler) DeleteSession(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (h *Handler) AcquireSession(w http.ResponseWriter, r *http.Request) {
+	// Pooled sessions are created without the defaults of the key
+	key := auth.FromContext(r.Context())
+	if h.rejectEnforced(w, r, key.CheckSessionChange()) {
+		return
+	}
+
+	sessionID, err := h.controller.AcquireSession()
+	if err != nil {
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, common.ErrPoolDisabled) {
+			status = http.StatusNotFound
+		}
+
+		common.LogWarn("AcquireSession: Failed to acquire session: %v", err)
+		h.writer.WriteErrorResponse(w, err.Error(), status, nil)
+		return
+	}
+
+	if key != nil {
+		h.controller.ClaimSession(sessionID, key.ID())
+	}
+
+	response := map[string]any{
+		"session_id": sessionID,
+		"status":     "acquired",
+		"pool":       h.controller.PoolStats(),
+	}
+
+	h.writer.WriteJSONResponse(w, response, http.StatusOK)
+}
+
+func (h *Handler) ReleaseSession(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["id"]
+
+	var payload struct {
+		Discard bool `json:"discard,omitempty"`
+	}
+
+	_, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &payload)
+	if err != nil {
+		common.LogError("ReleaseSession: Failed to parse request body for session %s: %v", sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+
+	if err := h.controller.ReleaseSession(sessionID, payload.Discard); err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, common.ErrPoolDisabled) {
+			status = http.StatusNotFound
+		}
+
+		common.LogError("ReleaseSession: Failed to release session %s: %v", sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), status, nil)
+		return
+	}
+
+	h.writer.WriteSuccessResponse(w)
+}
+
 func (h *Handler) SessionRequest(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sessionID := vars["id"]
 
 	var serverReq common.ServerRequest
-	encoder, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &serverReq)
+	encoder, err := h.parseServerRequest(r, &serverReq)
 	if err != nil {
 		common.LogError("SessionRequest: Failed to parse request body for session %s: %v", sessionID, err)
 		h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
 		return
 	}
 
+	if h.rejectEnforced(w, r, auth.FromContext(r.Context()).CheckRequestOptions(&serverReq.Options)) {
+		return
+	}
+
 	serverResp := h.controller.ExecuteRequest(sessionID, &serverReq)
 
 	statusCode := http.StatusOK
@@ -84,14 +210,24 @@ func (h *Handler) SessionRequest(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) StatelessRequest(w http.ResponseWriter, r *http.Request) {
 	var serverReq common.ServerRequest
-	encoder, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &serverReq)
+	encoder, err := h.parseServerRequest(r, &serverReq)
 	if err != nil {
 		common.LogError("StatelessRequest: Failed to parse request body: %v", err)
 		h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
 		return
 	}
 
-	serverResp := h.controller.ExecuteStatelessRequest(&serverReq)
+	key := auth.FromContext(r.Context())
+	if h.rejectEnforced(w, r, key.CheckRequestOptions(&serverReq.Options)) {
+		return
+	}
+
+	var sessionConfig *common.SessionConfig
+	if key != nil {
+		sessionConfig = key.SessionConfig(nil)
+	}
+
+	serverResp := h.controller.ExecuteStatelessRequest(&serverReq, sessionConfig)
 
 	statusCode := http.StatusOK
 	if serverResp.Error != "" {
@@ -103,17 +239,76 @@ func (h *Handler) StatelessRequest(w http.ResponseWriter, r *http.Request) {
 	h.writer.WriteResponse(w, serverResp, statusCode, encoder)
 }
 
+// parseServerRequest decodes a request to execute, either encoded as a
+// whole or as a multipart upload streaming its body
+func (h *Handler) parseServerRequest(r *http.Request, serverReq *common.ServerRequest) (protocol.MessageEncoder, error) {
+	if isMultipart(r) {
+		return nil, parseMultipartRequest(r, serverReq)
+	}
+
+	return common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), serverReq)
+}
+
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
 	response := h.controller.GetHealthInfo()
 	h.writer.WriteJSONResponse(w, response, http.StatusOK)
 }
 
+// DeepHealth reports the state of each server component. Only admin keys
+// may point the egress probe to another URL or proxy, which would send
+// requests anywhere otherwise.
+func (h *Handler) DeepHealth(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	overrides := query.Get("url") != "" || query.Get("proxy") != ""
+	if key := auth.FromContext(r.Context()); overrides && key != nil && !key.Admin() {
+		common.LogWarn("DeepHealth: Rejected the egress overrides of API key %s", key.Name())
+		h.writer.WriteErrorResponse(w, "the url and proxy parameters require an admin API key", http.StatusForbidden, nil)
+		return
+	}
+
+	targetURL := h.config.HealthCheckURL
+	if u := query.Get("url"); u != "" {
+		targetURL = u
+	}
+
+	components := map[string]controller.ComponentHealth{
+		"sessions": h.controller.CheckSessions(h.config.MaxSessions),
+		"limiter":  h.limiterHealth(),
+		"egress":   h.controller.CheckEgress(targetURL, query.Get("proxy"), h.config.HealthCheckTimeout),
+		"store":    h.controller.CheckStore(),
+	}
+
+	response := h.controller.GetDeepHealthInfo(components)
+
+	statusCode := http.StatusOK
+	if response["status"] == controller.HealthStatusUnhealthy {
+		common.LogWarn("DeepHealth: Server reported unhealthy: %v", components)
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	h.writer.WriteJSONResponse(w, response, statusCode)
+}
+
+func (h *Handler) limiterHealth() controller.ComponentHealth {
+	if h.limiter == nil {
+		return controller.ComponentHealth{Status: controller.HealthStatusSkipped}
+	}
+
+	// The health request itself holds one slot
+	return h.controller.CheckLimiter(h.limiter.InFlight()-1, h.limiter.Capacity())
+}
+
 // Advanced session management endpoints
 
 func (h *Handler) ApplyJA3(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sessionID := vars["id"]
 
+	if h.rejectEnforced(w, r, auth.FromContext(r.Context()).CheckSessionChange()) {
+		return
+	}
+
 	var payload struct {
 		JA3       string `json:"ja3"`
 		Navigator string `json:"navigator,omitempty"`
@@ -139,6 +334,10 @@ func (h *Handler) ApplyHTTP2(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sessionID := vars["id"]
 
+	if h.rejectEnforced(w, r, auth.FromContext(r.Context()).CheckSessionChange()) {
+		return
+	}
+
 	var payload struct {
 		Fingerprint string `json:"fingerprint"`
 	}
@@ -163,6 +362,10 @@ func (h *Handler) ApplyHTTP3(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sessionID := vars["id"]
 
+	if h.rejectEnforced(w, r, auth.FromContext(r.Context()).CheckSessionChange()) {
+		return
+	}
+
 	var payload struct {
 		Fingerprint string `json:"fingerprint"`
 	}
@@ -187,6 +390,10 @@ func (h *Handler) ManageProxy(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sessionID := vars["id"]
 
+	if h.rejectEnforced(w, r, auth.FromContext(r.Context()).CheckSessionChange()) {
+		return
+	}
+
 	switch r.Method {
 	case http.MethodPost:
 		var payload struct {
@@ -279,16 +486,263 @@ func (h *Handler) GetIP(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	sessionID := vars["id"]
 
-	ip, err := h.controller.GetIP(sessionID)
+	info, err := h.controller.GetIP(sessionID)
 	if err != nil {
 		common.LogError("GetIP: Failed to get IP for session %s: %v", sessionID, err)
 		h.writer.WriteErrorResponse(w, err.Error(), http.StatusInternalServerError, nil)
 		return
 	}
 
-	response := map[string]string{
-		"ip": ip,
+	h.writer.WriteJSONResponse(w, info, http.StatusOK)
+}
+
+func (h *Handler) GetDNSCache(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["id"]
+
+	entries, err := h.controller.GetDNSCache(sessionID)
+	if err != nil {
+		common.LogError("GetDNSCache: Failed to get DNS cache for session %s: %v", sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{
+		"entries": entries,
 	}
 
 	h.writer.WriteJSONResponse(w, response, http.StatusOK)
 }
+
+func (h *Handler) FlushDNSCache(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["id"]
+
+	flushed, err := h.controller.FlushDNSCache(sessionID)
+	if err != nil {
+		common.LogError("FlushDNSCache: Failed to flush DNS cache for session %s: %v", sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusInternalServerError, nil)
+		return
+	}
+
+	response := map[string]any{
+		"status":  "success",
+		"flushed": flushed,
+	}
+
+	h.writer.WriteJSONResponse(w, response, http.StatusOK)
+}
+
+func (h *Handler) ClearTLSTickets(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["id"]
+
+	cleared, err := h.controller.ClearTLSTickets(sessionID)
+	if err != nil {
+		status := http.StatusNotFound
+		if errors.Is(err, common.ErrTLSResumptionDisabled) {
+			status = http.StatusConflict
+		}
+
+		common.LogError("ClearTLSTickets: Failed to clear TLS tickets for session %s: %v", sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), status, nil)
+		return
+	}
+
+	response := map[string]any{
+		"status":  "success",
+		"cleared": cleared,
+	}
+
+	h.writer.WriteJSONResponse(w, response, http.StatusOK)
+}
+
+func (h *Handler) GetConnections(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["id"]
+
+	connections, err := h.controller.GetConnections(sessionID)
+	if err != nil {
+		common.LogError("GetConnections: Failed to get connections for session %s: %v", sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+		return
+	}
+
+	response := map[string]any{
+		"connections": connections,
+	}
+
+	h.writer.WriteJSONResponse(w, response, http.StatusOK)
+}
+
+func (h *Handler) ListProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := h.controller.ListProfiles()
+	if err != nil {
+		common.LogWarn("ListProfiles: Failed to list profiles: %v", err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+		return
+	}
+
+	response := map[string]any{
+		"profiles": profiles,
+	}
+
+	h.writer.WriteJSONResponse(w, response, http.StatusOK)
+}
+
+func (h *Handler) ReloadProfiles(w http.ResponseWriter, r *http.Request) {
+	count, err := h.controller.ReloadProfiles()
+	if err != nil {
+		status := http.StatusUnprocessableEntity
+		if errors.Is(err, common.ErrProfilesDisabled) {
+			status = http.StatusNotFound
+		}
+
+		common.LogError("ReloadProfiles: Failed to reload profiles: %v", err)
+		h.writer.WriteErrorResponse(w, err.Error(), status, nil)
+		return
+	}
+
+	response := map[string]any{
+		"status":   "success",
+		"profiles": count,
+	}
+
+	h.writer.WriteJSONResponse(w, response, http.StatusOK)
+}
+
+// Managed downloads
+
+func downloadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, common.ErrDownloadsDisabled), errors.Is(err, common.ErrDownloadNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, common.ErrDownloadState):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (h *Handler) StartDownload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["id"]
+
+	var serverReq common.ServerRequest
+	_, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &serverReq)
+	if err != nil {
+		common.LogError("StartDownload: Failed to parse request body for session %s: %v", sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+
+	if h.rejectEnforced(w, r, auth.FromContext(r.Context()).CheckRequestOptions(&serverReq.Options)) {
+		return
+	}
+
+	job, err := h.controller.StartDownload(sessionID, &serverReq)
+	if err != nil {
+		common.LogError("StartDownload: Failed to start download for session %s: %v", sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), downloadErrorStatus(err), nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, job, http.StatusAccepted)
+}
+
+func (h *Handler) ListDownloads(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["id"]
+
+	jobs, err := h.controller.ListDownloads(sessionID)
+	if err != nil {
+		common.LogWarn("ListDownloads: Failed to list downloads for session %s: %v", sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), downloadErrorStatus(err), nil)
+		return
+	}
+
+	response := map[string]any{
+		"downloads": jobs,
+	}
+
+	h.writer.WriteJSONResponse(w, response, http.StatusOK)
+}
+
+func (h *Handler) GetDownload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID, downloadID := vars["id"], vars["download"]
+
+	job, err := h.controller.GetDownload(sessionID, downloadID)
+	if err != nil {
+		common.LogWarn("GetDownload: Failed to get download %s of session %s: %v", downloadID, sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), downloadErrorStatus(err), nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, job, http.StatusOK)
+}
+
+func (h *Handler) PauseDownload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID, downloadID := vars["id"], vars["download"]
+
+	job, err := h.controller.PauseDownload(sessionID, downloadID)
+	if err != nil {
+		common.LogWarn("PauseDownload: Failed to pause download %s of session %s: %v", downloadID, sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), downloadErrorStatus(err), nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, job, http.StatusOK)
+}
+
+func (h *Handler) ResumeDownload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID, downloadID := vars["id"], vars["download"]
+
+	job, err := h.controller.ResumeDownload(sessionID, downloadID)
+	if err != nil {
+		common.LogWarn("ResumeDownload: Failed to resume download %s of session %s: %v", downloadID, sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), downloadErrorStatus(err), nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, job, http.StatusOK)
+}
+
+func (h *Handler) CancelDownload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID, downloadID := vars["id"], vars["download"]
+
+	if err := h.controller.CancelDownload(sessionID, downloadID); err != nil {
+		common.LogWarn("CancelDownload: Failed to cancel download %s of session %s: %v", downloadID, sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), downloadErrorStatus(err), nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DownloadContent serves the artifact of a completed download, supporting
+// range and conditional requests
+func (h *Handler) DownloadContent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID, downloadID := vars["id"], vars["download"]
+
+	file, job, err := h.controller.OpenDownload(sessionID, downloadID)
+	if err != nil {
+		common.LogWarn("DownloadContent: Failed to open download %s of session %s: %v", downloadID, sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), downloadErrorStatus(err), nil)
+		return
+	}
+	defer file.Close()
+
+	contentType := job.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+job.ID+`"`)
+
+	http.ServeContent(w, r, "", job.UpdatedAt, file)
+}
@@ -0,0 +1,59 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/gorilla/mux"
+)
+
+func (h *Handler) RequestHistory(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+
+	history, err := h.controller.RequestHistory(sessionID)
+	if err != nil {
+		common.LogWarn("RequestHistory: Failed to get history of session %s: %v", sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), historyStatus(err), nil)
+		return
+	}
+
+	response := map[string]any{
+		"requests": history,
+	}
+
+	h.writer.WriteJSONResponse(w, response, http.StatusOK)
+}
+
+// HistoryCurl renders a request of the session history as a curl command,
+// 0 being the most recent request
+func (h *Handler) HistoryCurl(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID := vars["id"]
+
+	n, err := strconv.Atoi(vars["n"])
+	if err != nil {
+		h.writer.WriteErrorResponse(w, "invalid history index", http.StatusBadRequest, nil)
+		return
+	}
+
+	command, err := h.controller.HistoryCurl(sessionID, n)
+	if err != nil {
+		common.LogWarn("HistoryCurl: Failed to render request %d of session %s: %v", n, sessionID, err)
+		h.writer.WriteErrorResponse(w, err.Error(), historyStatus(err), nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(command + "\n"))
+}
+
+// historyStatus answers 409 for sessions created without history
+func historyStatus(err error) int {
+	if errors.Is(err, common.ErrHistoryDisabled) {
+		return http.StatusConflict
+	}
+	return http.StatusNotFound
+}
@@ -0,0 +1,62 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/gorilla/mux"
+)
+
+func (h *Handler) ManageKeepalive(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+
+	switch r.Method {
+	case http.MethodGet:
+		status, err := h.controller.GetKeepalive(sessionID)
+		if err != nil {
+			h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+			return
+		}
+
+		h.writer.WriteJSONResponse(w, status, http.StatusOK)
+
+	case http.MethodPut:
+		if _, err := h.controller.GetSession(sessionID); err != nil {
+			h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+			return
+		}
+
+		var config common.KeepaliveConfig
+		if _, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &config); err != nil {
+			common.LogError("ManageKeepalive: Failed to parse request body for session %s: %v", sessionID, err)
+			h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+			return
+		}
+
+		status, err := h.controller.SetKeepalive(sessionID, config)
+		if err != nil {
+			common.LogWarn("ManageKeepalive: Failed to set keepalive for session %s: %v", sessionID, err)
+			code := http.StatusBadRequest
+			if errors.Is(err, common.ErrKeepalivesDisabled) {
+				code = http.StatusNotFound
+			}
+			h.writer.WriteErrorResponse(w, err.Error(), code, nil)
+			return
+		}
+
+		h.writer.WriteJSONResponse(w, status, http.StatusOK)
+
+	case http.MethodDelete:
+		if err := h.controller.DeleteKeepalive(sessionID); err != nil {
+			h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		common.LogWarn("ManageKeepalive: Method not allowed for session %s: %s", sessionID, r.Method)
+		h.writer.WriteErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed, nil)
+	}
+}
@@ -0,0 +1,89 @@
+package rest
+
+import (
+	"net/http"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/metrics"
+)
+
+// Metrics exposes the server metrics in the Prometheus text format
+func (h *Handler) Metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.WriteHeader(http.StatusOK)
+
+	m := metrics.NewWriter(w)
+	h.writeProbeMetrics(m)
+	h.writeConnectionMetrics(m)
+	h.writeSchedulerMetrics(m)
+	_ = m.Flush()
+}
+
+func (h *Handler) writeSchedulerMetrics(m *metrics.Writer) {
+	stats := h.controller.SchedulerStats()
+	if stats == nil {
+		return
+	}
+
+	var waiting []metrics.Sample
+	for _, priority := range []string{common.PriorityHigh, common.PriorityNormal, common.PriorityLow} {
+		waiting = append(waiting, metrics.Sample{Labels: map[string]string{"priority": priority}, Value: float64(stats.Waiting[priority])})
+	}
+
+	m.Metric("azuretls_scheduler_in_flight", metrics.Gauge, "Requests being sent to targets.", metrics.Sample{Value: float64(stats.InFlight)})
+	m.Metric("azuretls_scheduler_capacity", metrics.Gauge, "Requests sent to targets at the same time at most.", metrics.Sample{Value: float64(stats.Capacity)})
+	m.Metric("azuretls_scheduler_waiting", metrics.Gauge, "Requests waiting for a slot, by priority.", waiting...)
+	m.Metric("azuretls_scheduler_timeouts_total", metrics.Counter, "Requests that gave up waiting for a slot.", metrics.Sample{Value: float64(stats.TimedOut)})
+}
+
+func (h *Handler) writeConnectionMetrics(m *metrics.Writer) {
+	connections := h.connections.Describe()
+
+	var received, sent, inFlight, lastActivity []metrics.Sample
+	for _, conn := range connections {
+		labels := map[string]string{"connection": conn.ID, "session": conn.SessionID}
+
+		received = append(received, metrics.Sample{Labels: labels, Value: float64(conn.Messages)})
+		sent = append(sent, metrics.Sample{Labels: labels, Value: float64(conn.MessagesSent)})
+		inFlight = append(inFlight, metrics.Sample{Labels: labels, Value: float64(conn.InFlight)})
+		lastActivity = append(lastActivity, metrics.Sample{Labels: labels, Value: float64(conn.LastActivity.Unix())})
+	}
+
+	m.Metric("azuretls_ws_connections", metrics.Gauge, "Open WebSocket connections.", metrics.Sample{Value: float64(len(connections))})
+	m.Metric("azuretls_ws_messages_received_total", metrics.Counter, "Messages received on the connection.", received...)
+	m.Metric("azuretls_ws_messages_sent_total", metrics.Counter, "Messages sent on the connection.", sent...)
+	m.Metric("azuretls_ws_in_flight", metrics.Gauge, "Messages of the connection being handled.", inFlight...)
+	m.Metric("azuretls_ws_last_activity_timestamp_seconds", metrics.Gauge, "Unix time of the last message received or sent on the connection.", lastActivity...)
+}
+
+func (h *Handler) writeProbeMetrics(m *metrics.Writer) {
+	var up, statusCodes, latencies, challenge, lastCheck, checks, failures, challenges []metrics.Sample
+
+	for _, probe := range h.controller.ListProbes() {
+		labels := map[string]string{"probe": probe.Name, "url": probe.URL}
+
+		checks = append(checks, metrics.Sample{Labels: labels, Value: float64(probe.Checks)})
+		failures = append(failures, metrics.Sample{Labels: labels, Value: float64(probe.Failures)})
+		challenges = append(challenges, metrics.Sample{Labels: labels, Value: float64(probe.Challenges)})
+
+		last := probe.Last
+		if last == nil {
+			continue
+		}
+
+		up = append(up, metrics.Sample{Labels: labels, Value: metrics.Bool(last.Healthy)})
+		statusCodes = append(statusCodes, metrics.Sample{Labels: labels, Value: float64(last.StatusCode)})
+		latencies = append(latencies, metrics.Sample{Labels: labels, Value: float64(last.LatencyMs) / 1000})
+		challenge = append(challenge, metrics.Sample{Labels: labels, Value: metrics.Bool(last.Challenge)})
+		lastCheck = append(lastCheck, metrics.Sample{Labels: labels, Value: float64(last.Time.Unix())})
+	}
+
+	m.Metric("azuretls_probe_up", metrics.Gauge, "Whether the last check of the probe was healthy.", up...)
+	m.Metric("azuretls_probe_status_code", metrics.Gauge, "Status code of the last check, 0 when it failed without response.", statusCodes...)
+	m.Metric("azuretls_probe_latency_seconds", metrics.Gauge, "Duration of the last check.", latencies...)
+	m.Metric("azuretls_probe_challenge", metrics.Gauge, "Whether the last check was answered with a bot protection challenge.", challenge...)
+	m.Metric("azuretls_probe_last_check_timestamp_seconds", metrics.Gauge, "Unix time of the last check.", lastCheck...)
+	m.Metric("azuretls_probe_checks_total", metrics.Counter, "Checks of the probe.", checks...)
+	m.Metric("azuretls_probe_failures_total", metrics.Counter, "Unhealthy checks of the probe.", failures...)
+	m.Metric("azuretls_probe_challenges_total", metrics.Counter, "Checks of the probe answered with a challenge.", challenges...)
+}
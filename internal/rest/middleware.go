@@ -15,6 +15,7 @@ import (
 
 	"net/http"
 
+	"github.com/Noooste/azuretls-api/internal/auth"
 	"github.com/Noooste/azuretls-api/internal/common"
 )
 
@@ -22,7 +23,7 @@ type contextKey string
 
 const requestIDKey contextKey = "request_id"
 
-type Middleware func(http.Handler) http.Handler
+type Middleware = common.Middleware
 
 func ChainMiddleware(middlewares ...Middleware) Middleware {
 	return func(next http.Handler) http.Handler {
@@ -94,24 +95,113 @@ func LoggingMiddleware(next http.Handler) http.Handler {
 }
 
 func ConcurrentRequestLimiter(maxConcurrent int) Middleware {
-	semaphore := make(chan struct{}, maxConcurrent)
+	return NewConcurrencyLimiter(maxConcurrent, 0).Middleware
+}
 
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// ConcurrencyLimiter bounds the number of requests processed at the same
+// time, both overall and for each API key, so that one tenant saturating
+// the server leaves slots to the others
+type ConcurrencyLimiter struct {
+	semaphore chan struct{}
+	perKey    int
+
+	mu   sync.Mutex
+	keys map[*auth.Key]chan struct{}
+}
+
+// NewConcurrencyLimiter creates a limiter of maxConcurrent requests, each API
+// key being limited to perKey of them unless it sets its own limit (0 for
+// no limit per key)
+func NewConcurrencyLimiter(maxConcurrent, perKey int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		semaphore: make(chan struct{}, maxConcurrent),
+		perKey:    perKey,
+		keys:      make(map[*auth.Key]chan struct{}),
+	}
+}
+
+func (l *ConcurrencyLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := auth.FromContext(r.Context())
+		if semaphore := l.keySemaphore(key); semaphore != nil {
 			select {
 			case semaphore <- struct{}{}:
 				defer func() { <-semaphore }()
-				next.ServeHTTP(w, r)
 			default:
-				requestID := GetRequestID(r.Context())
-				log.Printf("Request limit exceeded [%s] %s %s", requestID, r.Method, r.URL.Path)
-
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(http.StatusTooManyRequests)
-				_, _ = w.Write([]byte(`{"error":"Too many concurrent requests","request_id":"` + requestID + `"}`))
+				limitExceeded(w, r, "Too many concurrent requests for this API key")
+				return
 			}
-		})
+		}
+
+		select {
+		case l.semaphore <- struct{}{}:
+			defer func() { <-l.semaphore }()
+			next.ServeHTTP(w, r)
+		default:
+			limitExceeded(w, r, "Too many concurrent requests")
+		}
+	})
+}
+
+// keySemaphore returns the semaphore of an API key, created on first use,
+// or nil when the key has no limit
+func (l *ConcurrencyLimiter) keySemaphore(key *auth.Key) chan struct{} {
+	if key == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	semaphore, exists := l.keys[key]
+	if !exists {
+		if capacity := key.MaxConcurrentRequests(l.perKey); capacity > 0 {
+			semaphore = make(chan struct{}, capacity)
+		}
+		l.keys[key] = semaphore
+	}
+	return semaphore
+}
+
+func limitExceeded(w http.ResponseWriter, r *http.Request, message string) {
+	requestID := GetRequestID(r.Context())
+	log.Printf("Request limit exceeded [%s] %s %s", requestID, r.Method, r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, _ = w.Write([]byte(`{"error":"` + message + `","request_id":"` + requestID + `"}`))
+}
+
+// InFlight returns the number of requests currently holding a slot
+func (l *ConcurrencyLimiter) InFlight() int {
+	return len(l.semaphore)
+}
+
+// Capacity returns the maximum number of concurrent requests
+func (l *ConcurrencyLimiter) Capacity() int {
+	return cap(l.semaphore)
+}
+
+// KeyStats returns the slots of the API keys with a limit that sent
+// requests, by key name
+func (l *ConcurrencyLimiter) KeyStats() map[string]common.LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var stats map[string]common.LimiterStats
+	for key, semaphore := range l.keys {
+		if semaphore == nil {
+			continue
+		}
+		if stats == nil {
+			stats = make(map[string]common.LimiterStats)
+		}
+		stats[key.Name()] = common.LimiterStats{
+			InFlight: len(semaphore),
+			Capacity: cap(semaphore),
+		}
 	}
+	return stats
 }
 
 func GetRequestID(ctx context.Context) string {
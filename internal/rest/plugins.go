@@ -0,0 +1,52 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/Noooste/azuretls-api/internal/auth"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/plugins"
+	"github.com/gorilla/mux"
+)
+
+// ListPlugins lists the external plugins, restricted to admin API keys
+func (h *Handler) ListPlugins(w http.ResponseWriter, r *http.Request) {
+	h.writer.WriteJSONResponse(w, map[string]any{"plugins": h.controller.ListPlugins()}, http.StatusOK)
+}
+
+// PluginEndpoint forwards the requests made to /api/v1/plugins/{plugin}/...
+// to the custom endpoints of the plugin
+func (h *Handler) PluginEndpoint(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["plugin"]
+
+	endpoints, err := h.controller.PluginEndpoints(name)
+	if err != nil {
+		code := http.StatusBadGateway
+		if errors.Is(err, common.ErrPluginsDisabled) || errors.Is(err, common.ErrPluginNotFound) {
+			code = http.StatusNotFound
+		}
+		h.writer.WriteErrorResponse(w, err.Error(), code, nil)
+		return
+	}
+
+	// The plugin sees the path below its prefix, the request ID and the
+	// name of the API key, never one set by the client nor the key itself
+	out := r.Clone(r.Context())
+	out.URL.Path = "/" + strings.TrimPrefix(r.URL.Path, "/api/v1/plugins/"+name+"/")
+	out.URL.RawPath = ""
+	if query := out.URL.Query(); query.Has("api_key") {
+		query.Del("api_key")
+		out.URL.RawQuery = query.Encode()
+	}
+	out.Header.Del("X-API-Key")
+	out.Header.Del("Authorization")
+	out.Header.Set("X-Request-ID", GetRequestID(r.Context()))
+	out.Header.Del(plugins.KeyNameHeader)
+	if key := auth.FromContext(r.Context()); key != nil {
+		out.Header.Set(plugins.KeyNameHeader, key.Name())
+	}
+
+	endpoints.ServeHTTP(w, out)
+}
@@ -0,0 +1,60 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/gorilla/mux"
+)
+
+// Target health probes, restricted to admin API keys
+
+func (h *Handler) ListProbes(w http.ResponseWriter, r *http.Request) {
+	h.writer.WriteJSONResponse(w, map[string]any{"probes": h.controller.ListProbes()}, http.StatusOK)
+}
+
+func (h *Handler) AddProbe(w http.ResponseWriter, r *http.Request) {
+	var probe common.Probe
+	if _, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &probe); err != nil {
+		common.LogError("AddProbe: Failed to parse request body: %v", err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+
+	status, err := h.controller.AddProbe(probe)
+	if err != nil {
+		common.LogWarn("AddProbe: Failed to add probe %s: %v", probe.Name, err)
+		code := http.StatusBadRequest
+		if errors.Is(err, common.ErrProbesDisabled) {
+			code = http.StatusNotFound
+		}
+		h.writer.WriteErrorResponse(w, err.Error(), code, nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, status, http.StatusOK)
+}
+
+func (h *Handler) GetProbe(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	status, err := h.controller.GetProbe(name)
+	if err != nil {
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, status, http.StatusOK)
+}
+
+func (h *Handler) RemoveProbe(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if err := h.controller.RemoveProbe(name); err != nil {
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
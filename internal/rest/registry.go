@@ -0,0 +1,47 @@
+package rest
+
+import (
+	"sync"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+var (
+	registeredMiddlewares []common.MiddlewareConfig
+	registryMu            sync.RWMutex
+)
+
+// RegisterMiddleware adds a middleware to the chain of every server set up
+// afterwards. Plugins compiled into the binary call it from their init
+// function. It panics when the middleware is nil or its name already taken.
+func RegisterMiddleware(middleware common.MiddlewareConfig) {
+	if middleware.Middleware == nil {
+		panic("rest: RegisterMiddleware with a nil middleware")
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, registered := range registeredMiddlewares {
+		if middleware.Name != "" && registered.Name == middleware.Name {
+			panic("rest: RegisterMiddleware called twice for " + middleware.Name)
+		}
+	}
+	registeredMiddlewares = append(registeredMiddlewares, middleware)
+}
+
+// stageMiddlewares returns the registered middlewares of a stage followed
+// by the ones of the config
+func stageMiddlewares(config common.ServerConfig, stage common.MiddlewareStage) []Middleware {
+	registryMu.RLock()
+	all := append(append([]common.MiddlewareConfig(nil), registeredMiddlewares...), config.Middlewares...)
+	registryMu.RUnlock()
+
+	var middlewares []Middleware
+	for _, middleware := range all {
+		if middleware.Stage == stage && middleware.Middleware != nil {
+			middlewares = append(middlewares, middleware.Middleware)
+		}
+	}
+	return middlewares
+}
@@ -2,33 +2,67 @@ package rest
 
 import (
 	"net/http"
+	"time"
 
+	"github.com/Noooste/azuretls-api/internal/auth"
 	"github.com/Noooste/azuretls-api/internal/common"
 	"github.com/Noooste/azuretls-api/internal/websocket"
 	"github.com/gorilla/mux"
 )
 
-func SetupRoutes(server common.Server) http.Handler {
+// Routes serves the REST and WebSocket API
+type Routes struct {
+	http.Handler
+	websocket *websocket.WSHandler
+}
+
+// CloseWebSockets closes the WebSocket connections gracefully, giving the
+// messages being handled up to timeout to complete
+func (r *Routes) CloseWebSockets(notice websocket.CloseNotice, timeout time.Duration) {
+	r.websocket.CloseAllConnections(notice, timeout)
+}
+
+func SetupRoutes(server common.Server) *Routes {
+	config := server.GetConfig()
+	limiter := NewConcurrencyLimiter(config.MaxConcurrentRequests, config.MaxConcurrentRequestsPerKey)
+	keyring := auth.NewKeyring(config.APIKeys, config.AdminKey)
+
 	r := mux.NewRouter()
-	handler := NewRESTHandler(server)
+	handler := NewRESTHandler(server, limiter)
 	wsHandler := websocket.NewWSHandler(server)
+	handler.connections = wsHandler.GetConnectionManager()
+	r.Use(handler.SessionOwnerMiddleware)
 
 	// Health check
 	r.HandleFunc("/health", handler.Health).Methods(http.MethodGet)
+	r.HandleFunc("/health/deep", handler.DeepHealth).Methods(http.MethodGet)
 
 	// WebSocket endpoint
 	r.HandleFunc("/ws", wsHandler.ServeHTTP)
 
 	// Session management
 	r.HandleFunc("/api/v1/session/create", handler.CreateSession).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/sessions/bulk", handler.CreateSessions).Methods(http.MethodPost)
 	r.HandleFunc("/api/v1/session/{id}", handler.DeleteSession).Methods(http.MethodDelete)
 
+	// Session pool
+	r.HandleFunc("/api/v1/session/acquire", handler.AcquireSession).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/session/{id}/release", handler.ReleaseSession).Methods(http.MethodPost)
+
 	// Session request
 	r.HandleFunc("/api/v1/session/{id}/request", handler.SessionRequest).Methods(http.MethodPost)
 
 	// Stateless request
 	r.HandleFunc("/api/v1/request", handler.StatelessRequest).Methods(http.MethodPost)
 
+	// Response bodies fetched out of band
+	r.HandleFunc("/api/v1/bodies/{ref}", handler.GetBody).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/api/v1/bodies/{ref}", handler.DeleteBody).Methods(http.MethodDelete)
+
+	// Conversions
+	r.HandleFunc("/api/v1/convert/curl", handler.ConvertCurl).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/fingerprint/derive", handler.DeriveFingerprint).Methods(http.MethodPost)
+
 	// Advanced session management endpoints
 	r.HandleFunc("/api/v1/session/{id}/ja3", handler.ApplyJA3).Methods(http.MethodPost)
 	r.HandleFunc("/api/v1/session/{id}/http2", handler.ApplyHTTP2).Methods(http.MethodPost)
@@ -43,14 +77,89 @@ func SetupRoutes(server common.Server) http.Handler {
 	// Get IP
 	r.HandleFunc("/api/v1/session/{id}/ip", handler.GetIP).Methods(http.MethodGet)
 
-	config := server.GetConfig()
-	middleware := ChainMiddleware(
+	// DNS cache
+	r.HandleFunc("/api/v1/session/{id}/dns", handler.GetDNSCache).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/session/{id}/dns/flush", handler.FlushDNSCache).Methods(http.MethodPost)
+
+	// TLS session tickets
+	r.HandleFunc("/api/v1/session/{id}/tls/tickets", handler.ClearTLSTickets).Methods(http.MethodDelete)
+
+	// Connection pool
+	r.HandleFunc("/api/v1/session/{id}/connections", handler.GetConnections).Methods(http.MethodGet)
+
+	// Managed downloads
+	r.HandleFunc("/api/v1/session/{id}/downloads", handler.StartDownload).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/session/{id}/downloads", handler.ListDownloads).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/session/{id}/downloads/{download}", handler.GetDownload).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/session/{id}/downloads/{download}", handler.CancelDownload).Methods(http.MethodDelete)
+	r.HandleFunc("/api/v1/session/{id}/downloads/{download}/pause", handler.PauseDownload).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/session/{id}/downloads/{download}/resume", handler.ResumeDownload).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/session/{id}/downloads/{download}/content", handler.DownloadContent).Methods(http.MethodGet)
+
+	// Request history
+	r.HandleFunc("/api/v1/session/{id}/history", handler.RequestHistory).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/session/{id}/history/{n:[0-9]+}/curl", handler.HistoryCurl).Methods(http.MethodGet)
+
+	// Cookie jar
+	r.HandleFunc("/api/v1/session/{id}/cookies", handler.GetCookies).Methods(http.MethodGet)
+
+	// Shared cookie jars
+	r.HandleFunc("/api/v1/cookiejars", handler.CreateCookieJar).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/cookiejars", handler.ListCookieJars).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/cookiejars/{name}", handler.GetCookieJar).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/cookiejars/{name}", handler.DeleteCookieJar).Methods(http.MethodDelete)
+	r.HandleFunc("/api/v1/cookiejars/{name}/cookies", handler.GetCookieJarCookies).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/session/{id}/cookiejar", handler.ManageSessionCookieJar).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+
+	// Keepalive
+	r.HandleFunc("/api/v1/session/{id}/keepalive", handler.ManageKeepalive).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+
+	// Scripts
+	r.HandleFunc("/api/v1/session/{id}/scripts", handler.ManageSessionScripts).Methods(http.MethodGet, http.MethodPut)
+
+	// Profile catalog
+	r.HandleFunc("/api/v1/profiles", handler.ListProfiles).Methods(http.MethodGet)
+	r.HandleFunc("/api/v1/profiles/reload", handler.ReloadProfiles).Methods(http.MethodPost)
+
+	// Custom endpoints of the external plugins
+	r.PathPrefix("/api/v1/plugins/{plugin}/").HandlerFunc(handler.PluginEndpoint)
+
+	// Admin endpoints
+	admin := r.NewRoute().Subrouter()
+	admin.Use(keyring.RequireAdmin)
+	admin.HandleFunc("/api/v1/admin/stats", handler.AdminStats).Methods(http.MethodGet)
+	admin.HandleFunc("/api/v1/admin/sessions", handler.AdminSessions).Methods(http.MethodGet)
+	admin.HandleFunc("/api/v1/admin/requests", handler.AdminRequests).Methods(http.MethodGet)
+	admin.HandleFunc("/api/v1/admin/connections", handler.AdminConnections).Methods(http.MethodGet)
+	admin.HandleFunc("/api/v1/ws/connections", handler.AdminConnections).Methods(http.MethodGet)
+	admin.HandleFunc("/api/v1/ws/connections/{id}", handler.CloseConnection).Methods(http.MethodDelete)
+	admin.HandleFunc("/api/v1/admin/probes", handler.ListProbes).Methods(http.MethodGet)
+	admin.HandleFunc("/api/v1/admin/probes", handler.AddProbe).Methods(http.MethodPost)
+	admin.HandleFunc("/api/v1/admin/probes/{name}", handler.GetProbe).Methods(http.MethodGet)
+	admin.HandleFunc("/api/v1/admin/probes/{name}", handler.RemoveProbe).Methods(http.MethodDelete)
+	admin.HandleFunc("/api/v1/admin/plugins", handler.ListPlugins).Methods(http.MethodGet)
+	admin.HandleFunc("/api/v1/admin/scripts", handler.ListScripts).Methods(http.MethodGet)
+	admin.HandleFunc("/api/v1/admin/scripts/{name}", handler.GetScript).Methods(http.MethodGet)
+	admin.HandleFunc("/api/v1/admin/scripts/{name}", handler.PutScript).Methods(http.MethodPut)
+	admin.HandleFunc("/api/v1/admin/scripts/{name}", handler.RemoveScript).Methods(http.MethodDelete)
+	admin.HandleFunc("/metrics", handler.Metrics).Methods(http.MethodGet)
+
+	if config.Dashboard {
+		admin.HandleFunc("/dashboard", handler.Dashboard).Methods(http.MethodGet)
+	}
+
+	chain := []Middleware{
 		RequestIDMiddleware,
 		RecoveryMiddleware,
 		LoggingMiddleware,
 		JSONContentTypeMiddleware,
-		ConcurrentRequestLimiter(config.MaxConcurrentRequests),
-	)
+	}
+	chain = append(chain, stageMiddlewares(config, common.BeforeAuth)...)
+	chain = append(chain, keyring.Middleware)
+	chain = append(chain, stageMiddlewares(config, common.AfterAuth)...)
+	chain = append(chain, limiter.Middleware)
+
+	middleware := ChainMiddleware(chain...)
 
-	return middleware(r)
+	return &Routes{Handler: middleware(r), websocket: wsHandler}
 }
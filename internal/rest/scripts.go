@@ -0,0 +1,113 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/gorilla/mux"
+)
+
+// Script management, restricted to admin API keys
+
+func (h *Handler) ListScripts(w http.ResponseWriter, r *http.Request) {
+	h.writer.WriteJSONResponse(w, map[string]any{"scripts": h.controller.ListScripts()}, http.StatusOK)
+}
+
+func (h *Handler) GetScript(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	script, err := h.controller.GetScript(name)
+	if err != nil {
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, script, http.StatusOK)
+}
+
+func (h *Handler) PutScript(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var body struct {
+		Source string `json:"source"`
+	}
+	if _, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &body); err != nil {
+		common.LogError("PutScript: Failed to parse request body: %v", err)
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+		return
+	}
+
+	info, err := h.controller.PutScript(name, body.Source)
+	if err != nil {
+		common.LogWarn("PutScript: Failed to store script %s: %v", name, err)
+		code := http.StatusBadRequest
+		if errors.Is(err, common.ErrScriptsDisabled) {
+			code = http.StatusNotFound
+		}
+		h.writer.WriteErrorResponse(w, err.Error(), code, nil)
+		return
+	}
+
+	h.writer.WriteJSONResponse(w, info, http.StatusOK)
+}
+
+func (h *Handler) RemoveScript(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if err := h.controller.RemoveScript(name); err != nil {
+		h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) ManageSessionScripts(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+
+	switch r.Method {
+	case http.MethodGet:
+		scripts, err := h.controller.GetSessionScripts(sessionID)
+		if err != nil {
+			h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+			return
+		}
+
+		h.writer.WriteJSONResponse(w, map[string]any{"scripts": scripts}, http.StatusOK)
+
+	case http.MethodPut:
+		if _, err := h.controller.GetSession(sessionID); err != nil {
+			h.writer.WriteErrorResponse(w, err.Error(), http.StatusNotFound, nil)
+			return
+		}
+
+		var body struct {
+			Scripts []string `json:"scripts"`
+		}
+		if _, err := common.ParseRequestBody(r.Body, r.Header.Get("Content-Type"), &body); err != nil {
+			common.LogError("ManageSessionScripts: Failed to parse request body for session %s: %v", sessionID, err)
+			h.writer.WriteErrorResponse(w, err.Error(), http.StatusBadRequest, nil)
+			return
+		}
+
+		if err := h.controller.SetSessionScripts(sessionID, body.Scripts); err != nil {
+			common.LogWarn("ManageSessionScripts: Failed to set scripts for session %s: %v", sessionID, err)
+			code := http.StatusBadRequest
+			if errors.Is(err, common.ErrScriptsDisabled) {
+				code = http.StatusNotFound
+			}
+			h.writer.WriteErrorResponse(w, err.Error(), code, nil)
+			return
+		}
+
+		if body.Scripts == nil {
+			body.Scripts = []string{}
+		}
+		h.writer.WriteJSONResponse(w, map[string]any{"scripts": body.Scripts}, http.StatusOK)
+
+	default:
+		common.LogWarn("ManageSessionScripts: Method not allowed for session %s: %s", sessionID, r.Method)
+		h.writer.WriteErrorResponse(w, "Method not allowed", http.StatusMethodNotAllowed, nil)
+	}
+}
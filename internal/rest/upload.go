@@ -0,0 +1,112 @@
+package rest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// maxSizedUpload bounds the body parts read in memory to be sent with their
+// Content-Length, larger ones being streamed
+const maxSizedUpload = 16 << 20
+
+var errBodyReplayed = errors.New("streamed request body cannot be sent twice, e.g. on a 307/308 redirect")
+
+// isMultipart reports whether the request uses the streaming upload mode
+func isMultipart(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "multipart/form-data"
+}
+
+// parseMultipartRequest reads a request made of a "request" part holding
+// the JSON server request, optionally followed by a "body" part streamed as
+// is into the outgoing request, without being buffered. A body part
+// declaring its Content-Length, up to maxSizedUpload, is read beforehand
+// instead, azuretls only sending the length of bodies held in memory.
+func parseMultipartRequest(r *http.Request, serverReq *common.ServerRequest) error {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return fmt.Errorf("invalid multipart request: %w", err)
+	}
+
+	part, err := reader.NextPart()
+	if err != nil {
+		return fmt.Errorf("invalid multipart request: %w", err)
+	}
+	if part.FormName() != "request" {
+		return fmt.Errorf("the first part must be named \"request\", got %q", part.FormName())
+	}
+
+	if _, err := common.ParseRequestBody(part, part.Header.Get("Content-Type"), serverReq); err != nil {
+		return err
+	}
+
+	part, err = reader.NextPart()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("invalid multipart request: %w", err)
+	}
+	if part.FormName() != "body" {
+		return fmt.Errorf("the second part must be named \"body\", got %q", part.FormName())
+	}
+
+	if serverReq.Body != "" || serverReq.BodyB64 != nil {
+		return fmt.Errorf("`body` and `body_b64` cannot be set with a body part")
+	}
+
+	upload := &uploadReader{part: part, expected: -1}
+	if length := part.Header.Get("Content-Length"); length != "" {
+		if upload.expected, err = strconv.ParseInt(length, 10, 64); err != nil || upload.expected < 0 {
+			return fmt.Errorf("invalid Content-Length %q of the body part", length)
+		}
+	}
+
+	if upload.expected >= 0 && upload.expected <= maxSizedUpload {
+		body, err := io.ReadAll(upload)
+		if err != nil {
+			return err
+		}
+		serverReq.BodyB64 = body
+		return nil
+	}
+	serverReq.BodyStream = upload
+
+	return nil
+}
+
+// uploadReader streams the body part, checking its declared length. Being
+// read from the incoming connection, it can only be sent once.
+type uploadReader struct {
+	part     io.Reader
+	expected int64
+	read     int64
+	done     bool
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	if u.done {
+		return 0, errBodyReplayed
+	}
+
+	n, err := u.part.Read(p)
+	u.read += int64(n)
+
+	if u.expected >= 0 && u.read > u.expected {
+		return n, fmt.Errorf("body part is longer than its Content-Length of %d bytes", u.expected)
+	}
+
+	if err == io.EOF {
+		if u.expected >= 0 && u.read != u.expected {
+			return n, fmt.Errorf("body part is %d bytes long, Content-Length declared %d", u.read, u.expected)
+		}
+		u.done = true
+	}
+	return n, err
+}
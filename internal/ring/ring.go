@@ -0,0 +1,56 @@
+package ring
+
+// Ring keeps the last values added to it, up to its size. It is not safe
+// for concurrent use.
+type Ring[T any] struct {
+	values []T
+	// next is the slot of the next value, the oldest being count slots
+	// before it
+	next  int
+	count int
+}
+
+func New[T any](size int) *Ring[T] {
+	return &Ring[T]{values: make([]T, size)}
+}
+
+// Add appends a value, returning the oldest one when it was overwritten
+func (r *Ring[T]) Add(value T) (evicted T, ok bool) {
+	if r.count == len(r.values) {
+		evicted, ok = r.values[r.next], true
+	} else {
+		r.count++
+	}
+
+	r.values[r.next] = value
+	r.next = (r.next + 1) % len(r.values)
+	return evicted, ok
+}
+
+// RemoveOldest removes and returns the oldest value
+func (r *Ring[T]) RemoveOldest() (oldest T, ok bool) {
+	if r.count == 0 {
+		return oldest, false
+	}
+
+	i := (r.next - r.count + len(r.values)) % len(r.values)
+	oldest = r.values[i]
+
+	var zero T
+	r.values[i] = zero
+	r.count--
+	return oldest, true
+}
+
+func (r *Ring[T]) Len() int {
+	return r.count
+}
+
+// List returns the values, newest first
+func (r *Ring[T]) List() []T {
+	values := make([]T, 0, r.count)
+	for i := 1; i <= r.count; i++ {
+		values = append(values, r.values[(r.next-i+len(r.values))%len(r.values)])
+	}
+	return values
+}
@@ -0,0 +1,52 @@
+package rotation
+
+import (
+	"net/http"
+	"strings"
+)
+
+// challengeHeaders mark the challenge pages of common bot protections
+var challengeHeaders = map[string]string{
+	"Cf-Mitigated":      "challenge",
+	"X-Amzn-Waf-Action": "captcha",
+}
+
+// challengeMarkers are found in the body of challenge pages
+var challengeMarkers = []string{
+	"Just a moment...",
+	"cf-chl-",
+	"challenge-platform",
+	"_Incapsula_Resource",
+	"px-captcha",
+	"captcha-delivery.com",
+	"g-recaptcha",
+	"h-captcha",
+}
+
+// IsChallenge reports whether a response is the challenge page of a bot
+// protection rather than the content asked for. Only 403, 429 and 503
+// responses are considered, the statuses these pages are served with.
+func IsChallenge(statusCode int, headers map[string][]string, body string) bool {
+	switch statusCode {
+	case http.StatusForbidden, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+	default:
+		return false
+	}
+
+	header := http.Header(headers)
+	for name, value := range challengeHeaders {
+		if strings.EqualFold(header.Get(name), value) {
+			return true
+		}
+	}
+	if header.Get("X-Datadome") != "" {
+		return true
+	}
+
+	for _, marker := range challengeMarkers {
+		if strings.Contains(body, marker) {
+			return true
+		}
+	}
+	return false
+}
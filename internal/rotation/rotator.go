@@ -0,0 +1,129 @@
+package rotation
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+type state struct {
+	config    common.SessionConfig
+	createdAt time.Time
+	requests  int
+	// generation counts the replacements, selecting the next browser,
+	// profile and proxy
+	generation int
+}
+
+// Rotator tracks the sessions created with a rotation policy and tells when
+// to replace them
+type Rotator struct {
+	sessions map[string]*state
+	mu       sync.Mutex
+}
+
+func NewRotator() *Rotator {
+	return &Rotator{sessions: make(map[string]*state)}
+}
+
+// Track starts tracking a session created with config, when it has a
+// rotation policy
+func (r *Rotator) Track(sessionID string, config *common.SessionConfig) {
+	if config == nil || config.Rotation == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[sessionID] = &state{config: *config, createdAt: time.Now()}
+}
+
+func (r *Rotator) Forget(sessionID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, sessionID)
+}
+
+// Due returns why a session must be replaced, "" when it must not. The age
+// is checked before requests, the request count and challenges after.
+func (r *Rotator) Due(sessionID string, resp *common.ServerResponse) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, exists := r.sessions[sessionID]
+	if !exists {
+		return ""
+	}
+	policy := s.config.Rotation
+
+	if resp == nil {
+		if policy.MaxAgeSeconds > 0 && time.Since(s.createdAt) >= time.Duration(policy.MaxAgeSeconds)*time.Second {
+			return common.RotationMaxAge
+		}
+		return ""
+	}
+
+	s.requests++
+
+	if policy.OnChallenge && IsChallenge(resp.StatusCode, resp.Headers, resp.Body) {
+		return common.RotationChallenge
+	}
+	if policy.MaxRequests > 0 && s.requests >= policy.MaxRequests {
+		return common.RotationMaxRequests
+	}
+	return ""
+}
+
+// Replacement returns the config of the next replacement of a session: the
+// original config with the next browser, profile and proxy of the policy
+func (r *Rotator) Replacement(sessionID string) (*common.SessionConfig, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, exists := r.sessions[sessionID]
+	if !exists {
+		return nil, false
+	}
+
+	config := s.config
+	policy := config.Rotation
+	next := s.generation + 1
+
+	if len(policy.Browsers) > 0 {
+		config.Browser = policy.Browsers[next%len(policy.Browsers)]
+		// The User-Agent follows the browser
+		config.UserAgent = ""
+	}
+	if len(policy.Profiles) > 0 {
+		config.Profile = policy.Profiles[next%len(policy.Profiles)]
+	}
+	if len(policy.Proxies) > 0 {
+		config.Proxy = policy.Proxies[next%len(policy.Proxies)]
+	}
+
+	return &config, true
+}
+
+// Replace hands the policy of a session over to its replacement, whose age
+// and request count start from zero. It returns false when the session was
+// replaced or forgotten meanwhile.
+func (r *Rotator) Replace(sessionID, replacementID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, exists := r.sessions[sessionID]
+	if !exists {
+		return false
+	}
+
+	delete(r.sessions, sessionID)
+	r.sessions[replacementID] = &state{
+		config:     s.config,
+		createdAt:  time.Now(),
+		generation: s.generation + 1,
+	}
+	return true
+}
@@ -0,0 +1,331 @@
+package rules
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/scheduler"
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+type compiledRule struct {
+	common.Rule
+	rewrite *regexp.Regexp
+}
+
+// Engine applies the configured transformation rules to outgoing requests
+type Engine struct {
+	rules []compiledRule
+}
+
+// NewEngine validates and compiles the rules, naming unnamed rules after
+// their position
+func NewEngine(rules []common.Rule) (*Engine, error) {
+	engine := &Engine{
+		rules: make([]compiledRule, len(rules)),
+	}
+
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+
+		if _, err := path.Match(rule.Match.Host, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid host pattern %q: %w", rule.Name, rule.Match.Host, err)
+		}
+
+		if rule.Options != nil {
+			if _, err := scheduler.Level(rule.Options.Priority); err != nil {
+				return nil, fmt.Errorf("%s: %w", rule.Name, err)
+			}
+		}
+
+		compiled := compiledRule{Rule: rule}
+		if rule.RewriteURL != nil {
+			pattern, err := regexp.Compile(rule.RewriteURL.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid URL pattern: %w", rule.Name, err)
+			}
+			compiled.rewrite = pattern
+		}
+
+		engine.rules[i] = compiled
+	}
+
+	return engine, nil
+}
+
+// Apply transforms the request and its options in place and returns the
+// names of the rules that matched
+func (e *Engine) Apply(req *azuretls.Request, session *azuretls.Session, options *common.RequestOptions, tags []string) ([]string, error) {
+	var applied []string
+
+	for _, rule := range e.rules {
+		u, err := url.Parse(req.Url)
+		if err != nil {
+			return applied, fmt.Errorf("invalid URL: %w", err)
+		}
+
+		if !rule.matches(req, u, tags) {
+			continue
+		}
+		applied = append(applied, rule.Name)
+
+		if rule.rewrite != nil {
+			req.Url = rule.rewrite.ReplaceAllString(req.Url, rule.RewriteURL.Replacement)
+		}
+
+		if len(rule.SetHeaders) > 0 || len(rule.AddHeaders) > 0 || len(rule.RemoveHeaders) > 0 {
+			materializeHeaders(req, session)
+
+			for _, name := range sortedKeys(rule.SetHeaders) {
+				setHeader(req, name, rule.SetHeaders[name], true)
+			}
+			for _, name := range sortedKeys(rule.AddHeaders) {
+				setHeader(req, name, rule.AddHeaders[name], false)
+			}
+			for _, name := range rule.RemoveHeaders {
+				removeHeader(req, name)
+			}
+		}
+
+		if rule.Options != nil {
+			mergeOptions(options, rule.Options)
+		}
+	}
+
+	return applied, nil
+}
+
+// Scripts returns the scripts of the applied rules, in rule order and
+// without repeats
+func (e *Engine) Scripts(applied []string) []string {
+	var scripts []string
+	for _, rule := range e.rules {
+		if !slices.Contains(applied, rule.Name) {
+			continue
+		}
+		for _, name := range rule.Scripts {
+			if !slices.Contains(scripts, name) {
+				scripts = append(scripts, name)
+			}
+		}
+	}
+	return scripts
+}
+
+func (r *compiledRule) matches(req *azuretls.Request, u *url.URL, tags []string) bool {
+	if r.Match.Host != "" {
+		if matched, _ := path.Match(strings.ToLower(r.Match.Host), strings.ToLower(u.Hostname())); !matched {
+			return false
+		}
+	}
+
+	if r.Match.PathPrefix != "" {
+		requestPath := u.Path
+		if requestPath == "" {
+			requestPath = "/"
+		}
+		if !strings.HasPrefix(requestPath, r.Match.PathPrefix) {
+			return false
+		}
+	}
+
+	if r.Match.Method != "" {
+		method := req.Method
+		if method == "" {
+			method = fhttp.MethodGet
+		}
+		if !strings.EqualFold(method, r.Match.Method) {
+			return false
+		}
+	}
+
+	if r.Match.Tag != "" && !slices.Contains(tags, r.Match.Tag) {
+		return false
+	}
+
+	return true
+}
+
+// materializeHeaders copies the session headers into a request that has
+// none, as azuretls would when sending it, so that rules can edit them
+func materializeHeaders(req *azuretls.Request, session *azuretls.Session) {
+	if req.OrderedHeaders != nil || req.Header != nil {
+		return
+	}
+
+	switch {
+	case len(session.OrderedHeaders) > 0:
+		req.OrderedHeaders = session.OrderedHeaders.Clone()
+	case session.Header != nil:
+		req.Header = session.Header.Clone()
+	default:
+		req.Header = make(fhttp.Header)
+	}
+}
+
+// SetHeader replaces every value of a request header, starting from the
+// session headers when the request has none
+func SetHeader(req *azuretls.Request, session *azuretls.Session, name, value string) {
+	materializeHeaders(req, session)
+	setHeader(req, name, value, true)
+}
+
+// RemoveHeader removes every value of a request header, starting from the
+// session headers when the request has none
+func RemoveHeader(req *azuretls.Request, session *azuretls.Session, name string) {
+	materializeHeaders(req, session)
+	removeHeader(req, name)
+}
+
+// Headers returns the headers of a request in their order, starting from
+// the session headers when the request has none
+func Headers(req *azuretls.Request, session *azuretls.Session) [][]string {
+	materializeHeaders(req, session)
+
+	headers := req.OrderedHeaders
+	if headers == nil {
+		headers = orderedHeaders(req.Header)
+	}
+	return slices.Clone(headers)
+}
+
+// setHeader replaces every value of the header, or only adds it when it is
+// missing if override is false
+func setHeader(req *azuretls.Request, name, value string, override bool) {
+	// azuretls replaces the Accept-Encoding of header maps with its own,
+	// only ordered headers keep it
+	if req.OrderedHeaders == nil && strings.EqualFold(name, "Accept-Encoding") {
+		req.OrderedHeaders = orderedHeaders(req.Header)
+		req.Header = nil
+	}
+
+	if req.OrderedHeaders == nil {
+		if override || len(req.Header.Values(name)) == 0 {
+			req.Header.Set(name, value)
+		}
+		return
+	}
+
+	index := slices.IndexFunc(req.OrderedHeaders, func(header []string) bool {
+		return len(header) > 0 && strings.EqualFold(header[0], name)
+	})
+
+	if index < 0 {
+		req.OrderedHeaders = append(req.OrderedHeaders, []string{name, value})
+		return
+	}
+	if !override {
+		return
+	}
+
+	// Keep the position and case of the first occurrence
+	req.OrderedHeaders[index] = []string{req.OrderedHeaders[index][0], value}
+	req.OrderedHeaders = slices.Concat(req.OrderedHeaders[:index+1], withoutHeader(req.OrderedHeaders[index+1:], name))
+}
+
+// orderedHeaders converts a header map, following its header order when
+// it has one
+func orderedHeaders(header fhttp.Header) azuretls.OrderedHeaders {
+	order := header[fhttp.HeaderOrderKey]
+	names := make([]string, 0, len(header))
+	for name := range header {
+		if name != fhttp.HeaderOrderKey && name != fhttp.PHeaderOrderKey {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	sort.SliceStable(names, func(i, j int) bool {
+		return orderIndex(order, names[i]) < orderIndex(order, names[j])
+	})
+
+	ordered := make(azuretls.OrderedHeaders, 0, len(names))
+	for _, name := range names {
+		ordered = append(ordered, append([]string{name}, header[name]...))
+	}
+	return ordered
+}
+
+// orderIndex returns the position of a header in the order, headers
+// missing from it coming last
+func orderIndex(order []string, name string) int {
+	index := slices.IndexFunc(order, func(ordered string) bool {
+		return strings.EqualFold(ordered, name)
+	})
+	if index < 0 {
+		return len(order)
+	}
+	return index
+}
+
+func removeHeader(req *azuretls.Request, name string) {
+	if req.OrderedHeaders == nil {
+		req.Header.Del(name)
+		return
+	}
+
+	req.OrderedHeaders = withoutHeader(req.OrderedHeaders, name)
+}
+
+func withoutHeader(headers azuretls.OrderedHeaders, name string) azuretls.OrderedHeaders {
+	return slices.DeleteFunc(slices.Clone(headers), func(header []string) bool {
+		return len(header) > 0 && strings.EqualFold(header[0], name)
+	})
+}
+
+// mergeOptions sets the options the rule defines, leaving the others as
+// requested
+func mergeOptions(options *common.RequestOptions, rule *common.RequestOptions) {
+	if rule.TimeoutMs > 0 {
+		options.TimeoutMs = rule.TimeoutMs
+	}
+	if rule.MaxRedirects > 0 {
+		options.MaxRedirects = rule.MaxRedirects
+	}
+	if rule.Proxy != "" {
+		options.Proxy = rule.Proxy
+	}
+	if rule.Browser != "" {
+		options.Browser = rule.Browser
+	}
+	if len(rule.AcceptEncoding) > 0 {
+		options.AcceptEncoding = rule.AcceptEncoding
+	}
+	if rule.Priority != "" {
+		options.Priority = rule.Priority
+	}
+	if len(rule.ALPN) > 0 {
+		options.ALPN = rule.ALPN
+	}
+	if rule.Sign != nil {
+		options.Sign = rule.Sign
+	}
+
+	options.FollowRedirects = options.FollowRedirects || rule.FollowRedirects
+	options.DisableRedirects = options.DisableRedirects || rule.DisableRedirects
+	options.NoCookie = options.NoCookie || rule.NoCookie
+	options.ForceHTTP1 = options.ForceHTTP1 || rule.ForceHTTP1
+	options.ForceHTTP3 = options.ForceHTTP3 || rule.ForceHTTP3
+	options.InsecureSkipVerify = options.InsecureSkipVerify || rule.InsecureSkipVerify
+	options.IgnoreBody = options.IgnoreBody || rule.IgnoreBody
+	options.DryRun = options.DryRun || rule.DryRun
+	options.BodyRef = options.BodyRef || rule.BodyRef
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
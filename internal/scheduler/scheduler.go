@@ -0,0 +1,152 @@
+package scheduler
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// priorities are ordered from the most urgent
+var priorities = []string{common.PriorityHigh, common.PriorityNormal, common.PriorityLow}
+
+// Level returns the rank of a priority, 0 being the most urgent. An empty
+// priority is normal.
+func Level(priority string) (int, error) {
+	if priority == "" {
+		priority = common.PriorityNormal
+	}
+
+	level := slices.Index(priorities, priority)
+	if level < 0 {
+		return 0, common.ErrInvalidPriority
+	}
+	return level, nil
+}
+
+type waiter struct {
+	ready chan struct{}
+}
+
+// Scheduler hands out a fixed number of slots. Once they are all taken,
+// requests wait in a queue per priority, a released slot going to the
+// oldest request of the most urgent queue, so low priority requests wait as
+// long as more urgent ones are queued.
+type Scheduler struct {
+	capacity int
+	timeout  time.Duration
+
+	mu       sync.Mutex
+	inFlight int
+	queues   [][]*waiter
+	timedOut uint64
+}
+
+// New creates a scheduler with the given number of slots, requests giving
+// up after waiting timeout, or never when not positive
+func New(capacity int, timeout time.Duration) *Scheduler {
+	return &Scheduler{
+		capacity: capacity,
+		timeout:  timeout,
+		queues:   make([][]*waiter, len(priorities)),
+	}
+}
+
+func (s *Scheduler) Acquire(ctx context.Context, priority string) (func(), error) {
+	level, err := Level(priority)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.inFlight < s.capacity && s.waiting() == 0 {
+		s.inFlight++
+		s.mu.Unlock()
+		return s.releaser(), nil
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	s.queues[level] = append(s.queues[level], w)
+	s.mu.Unlock()
+
+	var expired <-chan time.Time
+	if s.timeout > 0 {
+		timer := time.NewTimer(s.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-w.ready:
+		return s.releaser(), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-expired:
+		err = common.ErrQueueTimeout
+	}
+
+	s.mu.Lock()
+	index := slices.Index(s.queues[level], w)
+	if index >= 0 {
+		s.queues[level] = slices.Delete(s.queues[level], index, index+1)
+	}
+	if err == common.ErrQueueTimeout {
+		s.timedOut++
+	}
+	s.mu.Unlock()
+
+	// The slot handed over while giving up goes to the next request
+	if index < 0 {
+		s.release()
+	}
+	return nil, err
+}
+
+// releaser returns a function releasing a slot once
+func (s *Scheduler) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(s.release)
+	}
+}
+
+// release hands the slot over to the next waiting request, or frees it
+func (s *Scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for level, queue := range s.queues {
+		if len(queue) > 0 {
+			close(queue[0].ready)
+			s.queues[level] = queue[1:]
+			return
+		}
+	}
+	s.inFlight--
+}
+
+func (s *Scheduler) waiting() int {
+	n := 0
+	for _, queue := range s.queues {
+		n += len(queue)
+	}
+	return n
+}
+
+func (s *Scheduler) Stats() common.SchedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := common.SchedulerStats{
+		InFlight: s.inFlight,
+		Capacity: s.capacity,
+		Waiting:  make(map[string]int, len(priorities)),
+		TimedOut: s.timedOut,
+	}
+	for level, priority := range priorities {
+		stats.Waiting[priority] = len(s.queues[level])
+	}
+	return stats
+}
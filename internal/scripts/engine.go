@@ -0,0 +1,470 @@
+package scripts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/rules"
+	"github.com/Noooste/azuretls-client"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const (
+	HookRequest  = "on_request"
+	HookResponse = "on_response"
+)
+
+// DefaultLimits apply to the limits left unset
+var DefaultLimits = common.ScriptLimits{
+	Timeout:      time.Second,
+	MaxStack:     64 * 1024,
+	MaxCallDepth: 200,
+}
+
+type script struct {
+	info   common.ScriptInfo
+	source string
+	proto  *lua.FunctionProto
+}
+
+// Engine stores compiled Lua scripts and runs their hooks, each run in a
+// fresh sandboxed state so that runs share nothing
+type Engine struct {
+	limits   common.ScriptLimits
+	scripts  map[string]*script
+	sessions map[string][]string
+	mu       sync.RWMutex
+}
+
+func NewEngine(limits common.ScriptLimits) *Engine {
+	if limits.Timeout <= 0 {
+		limits.Timeout = DefaultLimits.Timeout
+	}
+	if limits.MaxStack <= 0 {
+		limits.MaxStack = DefaultLimits.MaxStack
+	}
+	if limits.MaxCallDepth <= 0 {
+		limits.MaxCallDepth = DefaultLimits.MaxCallDepth
+	}
+
+	return &Engine{
+		limits:   limits,
+		scripts:  make(map[string]*script),
+		sessions: make(map[string][]string),
+	}
+}
+
+// LoadDir stores the .lua files of a directory, named after their file
+// without extension, and returns how many were loaded
+func (e *Engine) LoadDir(dir string) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.lua"))
+	if err != nil {
+		return 0, err
+	}
+
+	var errs []error
+	loaded := 0
+	for _, path := range paths {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if _, err := e.Put(name, string(source)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		loaded++
+	}
+
+	return loaded, errors.Join(errs...)
+}
+
+// Compile checks the syntax of a script
+func Compile(name, source string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, fmt.Errorf("script %s: %w", name, err)
+	}
+
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, fmt.Errorf("script %s: %w", name, err)
+	}
+	return proto, nil
+}
+
+// hooks runs the top level of a script and returns the hooks it defines
+func (e *Engine) hooks(name string, proto *lua.FunctionProto) (hooks []string, err error) {
+	L := e.newState(name)
+	defer L.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.limits.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("script %s: %v", name, r)
+		}
+	}()
+
+	L.Push(L.NewFunctionFromProto(proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		return nil, fmt.Errorf("script %s: %w", name, limitError(ctx, err))
+	}
+
+	hooks = []string{}
+	for _, hook := range []string{HookRequest, HookResponse} {
+		if _, ok := L.GetGlobal(hook).(*lua.LFunction); ok {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks, nil
+}
+
+func (e *Engine) Put(name, source string) (common.ScriptInfo, error) {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return common.ScriptInfo{}, fmt.Errorf("invalid script name %q", name)
+	}
+
+	proto, err := Compile(name, source)
+	if err != nil {
+		return common.ScriptInfo{}, err
+	}
+
+	hooks, err := e.hooks(name, proto)
+	if err != nil {
+		return common.ScriptInfo{}, err
+	}
+
+	s := &script{
+		info: common.ScriptInfo{
+			Name:      name,
+			Hooks:     hooks,
+			UpdatedAt: time.Now(),
+		},
+		source: source,
+		proto:  proto,
+	}
+
+	e.mu.Lock()
+	e.scripts[name] = s
+	e.mu.Unlock()
+
+	common.LogInfo("Scripts: Stored %s with hooks %s", name, strings.Join(hooks, ", "))
+	return s.info, nil
+}
+
+func (e *Engine) Get(name string) (common.Script, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	s, exists := e.scripts[name]
+	if !exists {
+		return common.Script{}, false
+	}
+	return common.Script{Name: name, Source: s.source}, true
+}
+
+func (e *Engine) Remove(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if _, exists := e.scripts[name]; !exists {
+		return false
+	}
+	delete(e.scripts, name)
+	return true
+}
+
+func (e *Engine) List() []common.ScriptInfo {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	list := make([]common.ScriptInfo, 0, len(e.scripts))
+	for _, s := range e.scripts {
+		list = append(list, s.info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (e *Engine) Attach(sessionID string, names []string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, name := range names {
+		if _, exists := e.scripts[name]; !exists {
+			return fmt.Errorf("%w: %s", common.ErrScriptNotFound, name)
+		}
+	}
+
+	if len(names) == 0 {
+		delete(e.sessions, sessionID)
+	} else {
+		e.sessions[sessionID] = slices.Clone(names)
+	}
+	return nil
+}
+
+func (e *Engine) SessionScripts(sessionID string) []string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return slices.Clone(e.sessions[sessionID])
+}
+
+// Move hands the scripts of a session over to its replacement
+func (e *Engine) Move(fromSessionID, toSessionID string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if names, exists := e.sessions[fromSessionID]; exists {
+		e.sessions[toSessionID] = names
+		delete(e.sessions, fromSessionID)
+	}
+}
+
+func (e *Engine) Forget(sessionID string) {
+	e.mu.Lock()
+	delete(e.sessions, sessionID)
+	e.mu.Unlock()
+}
+
+// run calls a hook of a script with a table built by the caller, which
+// reads the table back once the hook returns. Scripts without the hook are
+// skipped.
+func (e *Engine) run(name, hook string, build func(L *lua.LState) *lua.LTable, read func(table *lua.LTable) error) error {
+	e.mu.RLock()
+	s, exists := e.scripts[name]
+	e.mu.RUnlock()
+	if !exists {
+		return fmt.Errorf("%w: %s", common.ErrScriptNotFound, name)
+	}
+	if !slices.Contains(s.info.Hooks, hook) {
+		return nil
+	}
+
+	err := e.call(s, hook, build, read)
+
+	e.mu.Lock()
+	s.info.Runs++
+	if err != nil {
+		s.info.Errors++
+		s.info.LastError = err.Error()
+	}
+	e.mu.Unlock()
+
+	return err
+}
+
+func (e *Engine) call(s *script, hook string, build func(L *lua.LState) *lua.LTable, read func(table *lua.LTable) error) (err error) {
+	L := e.newState(s.info.Name)
+	defer L.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.limits.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+
+	// Stack overflows panic instead of raising Lua errors
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: %v", hook, r)
+		}
+	}()
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		return limitError(ctx, err)
+	}
+
+	fn, ok := L.GetGlobal(hook).(*lua.LFunction)
+	if !ok {
+		return nil
+	}
+
+	table := build(L)
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, table); err != nil {
+		return limitError(ctx, fmt.Errorf("%s: %w", hook, err))
+	}
+
+	return read(table)
+}
+
+func limitError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("time limit exceeded: %w", err)
+	}
+	return err
+}
+
+// OnRequest exposes the request to the hooks as a table holding its method,
+// url, headers by name, body, session_id and tags, and applies their
+// changes to the method, url, headers and body. Streamed bodies are left
+// out and cannot be changed.
+func (e *Engine) OnRequest(names []string, req *azuretls.Request, session *azuretls.Session, sessionID string, tags []string) error {
+	for _, name := range names {
+		headers := headerValues(rules.Headers(req, session))
+		body, hasBody := requestBody(req.Body)
+
+		build := func(L *lua.LState) *lua.LTable {
+			table := L.NewTable()
+			table.RawSetString("method", lua.LString(req.Method))
+			table.RawSetString("url", lua.LString(req.Url))
+			table.RawSetString("headers", toLua(L, headers))
+			if hasBody && body != "" {
+				table.RawSetString("body", lua.LString(body))
+			}
+			table.RawSetString("session_id", lua.LString(sessionID))
+			table.RawSetString("tags", toLua(L, tags))
+			return table
+		}
+
+		read := func(table *lua.LTable) error {
+			req.Method = lua.LVAsString(table.RawGetString("method"))
+			req.Url = lua.LVAsString(table.RawGetString("url"))
+
+			if hasBody {
+				if value := table.RawGetString("body"); value != lua.LNil {
+					req.Body = lua.LVAsString(value)
+				} else if body != "" {
+					req.Body = nil
+				}
+			}
+
+			updated, ok := table.RawGetString("headers").(*lua.LTable)
+			if !ok {
+				return errors.New("on_request: headers must be a table")
+			}
+			applyHeaders(req, session, headers, updated)
+			return nil
+		}
+
+		if err := e.run(name, HookRequest, build, read); err != nil {
+			return fmt.Errorf("script %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// OnResponse exposes the response to the hooks as a table holding its
+// status_code, url, headers by name, body and a data table, and applies
+// their changes to the headers, body and data
+func (e *Engine) OnResponse(names []string, resp *common.ScriptResponse, sessionID string) map[string]string {
+	var errs map[string]string
+
+	for _, name := range names {
+		build := func(L *lua.LState) *lua.LTable {
+			headers := make(map[string]any, len(resp.Headers))
+			for key, values := range resp.Headers {
+				headers[key] = strings.Join(values, ", ")
+			}
+
+			table := L.NewTable()
+			table.RawSetString("status_code", lua.LNumber(resp.StatusCode))
+			table.RawSetString("url", lua.LString(resp.URL))
+			table.RawSetString("headers", toLua(L, headers))
+			table.RawSetString("body", lua.LString(resp.Body))
+			table.RawSetString("session_id", lua.LString(sessionID))
+			table.RawSetString("data", toLua(L, resp.Data))
+			return table
+		}
+
+		read := func(table *lua.LTable) error {
+			resp.Body = []byte(lua.LVAsString(table.RawGetString("body")))
+
+			if headers, ok := table.RawGetString("headers").(*lua.LTable); ok {
+				resp.Headers = make(map[string][]string)
+				headers.ForEach(func(key, value lua.LValue) {
+					resp.Headers[key.String()] = []string{value.String()}
+				})
+			}
+
+			value, err := toGo(table.RawGetString("data"))
+			if err != nil {
+				return fmt.Errorf("on_response: data: %w", err)
+			}
+			if data, ok := value.(map[string]any); ok && len(data) > 0 {
+				resp.Data = data
+			}
+			return nil
+		}
+
+		if err := e.run(name, HookResponse, build, read); err != nil {
+			if errs == nil {
+				errs = make(map[string]string)
+			}
+			errs[name] = err.Error()
+		}
+	}
+
+	return errs
+}
+
+// headerValues maps the headers by name, joining repeated values
+func headerValues(headers [][]string) map[string]any {
+	values := make(map[string]any, len(headers))
+	for _, header := range headers {
+		if len(header) > 0 {
+			values[header[0]] = strings.Join(header[1:], ", ")
+		}
+	}
+	return values
+}
+
+// applyHeaders sets the headers a hook added or changed and removes the
+// ones it deleted, keeping the order of the others
+func applyHeaders(req *azuretls.Request, session *azuretls.Session, before map[string]any, after *lua.LTable) {
+	updated := make(map[string]string)
+	after.ForEach(func(key, value lua.LValue) {
+		updated[key.String()] = value.String()
+	})
+
+	for name := range before {
+		if _, exists := updated[name]; !exists {
+			rules.RemoveHeader(req, session, name)
+		}
+	}
+
+	names := make([]string, 0, len(updated))
+	for name := range updated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if previous, exists := before[name]; !exists || previous != updated[name] {
+			rules.SetHeader(req, session, name, updated[name])
+		}
+	}
+}
+
+// requestBody returns the body of a request as a string, unless it is
+// streamed
+func requestBody(body any) (string, bool) {
+	switch b := body.(type) {
+	case nil:
+		return "", true
+	case string:
+		return b, true
+	case []byte:
+		return string(b), true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,250 @@
+package scripts
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	lua "github.com/yuin/gopher-lua"
+)
+
+const (
+	// maxStringSize bounds the strings built by string.rep
+	maxStringSize = 16 << 20
+
+	// maxTableDepth bounds the nesting of the tables converted to Go values
+	maxTableDepth = 100
+)
+
+// unsafeGlobals reach the file system or load code outside the sandbox
+var unsafeGlobals = []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "collectgarbage"}
+
+// newState creates a state with the safe standard libraries, the base,
+// table, string and math ones, and the azuretls helpers
+func (e *Engine) newState(script string) *lua.LState {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:        true,
+		CallStackSize:       e.limits.MaxCallDepth,
+		RegistrySize:        min(1024, e.limits.MaxStack),
+		RegistryMaxSize:     e.limits.MaxStack,
+		MinimizeStackMemory: true,
+	})
+
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+
+	for _, name := range unsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	L.SetGlobal("print", L.NewFunction(func(L *lua.LState) int {
+		values := make([]string, L.GetTop())
+		for i := range values {
+			values[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		common.LogInfo("Script %s: %s", script, strings.Join(values, "\t"))
+		return 0
+	}))
+
+	if str, ok := L.GetGlobal("string").(*lua.LTable); ok {
+		rep := str.RawGetString("rep")
+		str.RawSetString("rep", L.NewFunction(func(L *lua.LState) int {
+			// Compared by division, as the product may overflow
+			if size, n := len(L.CheckString(1)), L.CheckInt(2); size > 0 && n > maxStringSize/size {
+				L.RaiseError("string.rep: result exceeds the limit of %d bytes", maxStringSize)
+			}
+			L.Push(rep)
+			L.Push(L.Get(1))
+			L.Push(L.Get(2))
+			L.Call(2, 1)
+			return 1
+		}))
+	}
+
+	L.SetGlobal("azuretls", L.SetFuncs(L.NewTable(), helpers))
+
+	return L
+}
+
+// helpers are the functions of the azuretls table, covering the usual needs
+// of request signing
+var helpers = map[string]lua.LGFunction{
+	"md5":    digest(md5.New),
+	"sha1":   digest(sha1.New),
+	"sha256": digest(sha256.New),
+	"hmac_sha256": func(L *lua.LState) int {
+		mac := hmac.New(sha256.New, []byte(L.CheckString(1)))
+		mac.Write([]byte(L.CheckString(2)))
+		L.Push(lua.LString(hex.EncodeToString(mac.Sum(nil))))
+		return 1
+	},
+	"base64_encode": func(L *lua.LState) int {
+		L.Push(lua.LString(base64.StdEncoding.EncodeToString([]byte(L.CheckString(1)))))
+		return 1
+	},
+	"base64_decode": func(L *lua.LState) int {
+		data, err := base64.StdEncoding.DecodeString(L.CheckString(1))
+		if err != nil {
+			L.RaiseError("base64_decode: %v", err)
+		}
+		L.Push(lua.LString(data))
+		return 1
+	},
+	"hex_encode": func(L *lua.LState) int {
+		L.Push(lua.LString(hex.EncodeToString([]byte(L.CheckString(1)))))
+		return 1
+	},
+	"random_hex": func(L *lua.LState) int {
+		n := L.CheckInt(1)
+		if n < 0 || n > 1024 {
+			L.ArgError(1, "must be between 0 and 1024")
+		}
+		data := make([]byte, n)
+		_, _ = rand.Read(data)
+		L.Push(lua.LString(hex.EncodeToString(data)))
+		return 1
+	},
+	"json_encode": func(L *lua.LState) int {
+		value, err := toGo(L.CheckAny(1))
+		if err != nil {
+			L.RaiseError("json_encode: %v", err)
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			L.RaiseError("json_encode: %v", err)
+		}
+		L.Push(lua.LString(data))
+		return 1
+	},
+	"json_decode": func(L *lua.LState) int {
+		var value any
+		if err := json.Unmarshal([]byte(L.CheckString(1)), &value); err != nil {
+			L.RaiseError("json_decode: %v", err)
+		}
+		L.Push(toLua(L, value))
+		return 1
+	},
+	"time_ms": func(L *lua.LState) int {
+		L.Push(lua.LNumber(time.Now().UnixMilli()))
+		return 1
+	},
+}
+
+// digest returns a helper hashing its argument to hex
+func digest(h func() hash.Hash) lua.LGFunction {
+	return func(L *lua.LState) int {
+		sum := h()
+		sum.Write([]byte(L.CheckString(1)))
+		L.Push(lua.LString(hex.EncodeToString(sum.Sum(nil))))
+		return 1
+	}
+}
+
+// toGo converts a Lua value, tables with only consecutive integer keys
+// from 1 becoming slices and other tables maps. Cyclic tables and tables
+// nested deeper than maxTableDepth are rejected.
+func toGo(value lua.LValue) (any, error) {
+	return convert(value, make(map[*lua.LTable]bool), 0)
+}
+
+func convert(value lua.LValue, visiting map[*lua.LTable]bool, depth int) (any, error) {
+	switch v := value.(type) {
+	case lua.LBool:
+		return bool(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LString:
+		return string(v), nil
+	case *lua.LTable:
+		if visiting[v] {
+			return nil, errors.New("cyclic table")
+		}
+		if depth >= maxTableDepth {
+			return nil, fmt.Errorf("tables nested deeper than %d", maxTableDepth)
+		}
+		visiting[v] = true
+		defer delete(visiting, v)
+
+		if n := v.Len(); n > 0 {
+			values := make([]any, 0, n)
+			for i := 1; i <= n; i++ {
+				item, err := convert(v.RawGetInt(i), visiting, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, item)
+			}
+			return values, nil
+		}
+
+		values := make(map[string]any)
+		var err error
+		v.ForEach(func(key, value lua.LValue) {
+			if err != nil {
+				return
+			}
+			values[key.String()], err = convert(value, visiting, depth+1)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return values, nil
+	default:
+		return nil, nil
+	}
+}
+
+func toLua(L *lua.LState, value any) lua.LValue {
+	switch v := value.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case int:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []any:
+		table := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			table.Append(toLua(L, item))
+		}
+		return table
+	case []string:
+		table := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			table.Append(lua.LString(item))
+		}
+		return table
+	case map[string]any:
+		table := L.CreateTable(0, len(v))
+		for key, item := range v {
+			table.RawSetString(key, toLua(L, item))
+		}
+		return table
+	default:
+		return lua.LNil
+	}
+}
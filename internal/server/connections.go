@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-client"
+	"github.com/Noooste/fhttp/httptrace"
+	tls "github.com/Noooste/utls"
+)
+
+type connRequestsKey struct{}
+
+// retireRetry is the delay before retiring again a connection the
+// transport did not close, still finishing a request or taken by a new one
+const retireRetry = 100 * time.Millisecond
+
+// connTracker keeps the connections a session dialed until they are
+// closed, along with the requests they carried. HTTP/3 connections are not
+// tracked.
+type connTracker struct {
+	conns map[*trackedConn]struct{}
+	mu    sync.Mutex
+
+	// maxAge retires the connections past it once they are idle, calling
+	// retired with their host first. closeIdle closes the idle connections
+	// of the session.
+	maxAge    time.Duration
+	retired   func(host string)
+	closeIdle func()
+}
+
+// trackedConn is a connection of a session, its fields past net.Conn being
+// guarded by the tracker
+type trackedConn struct {
+	net.Conn
+	tracker *connTracker
+	host    string
+	opened  time.Time
+
+	protocol string
+	requests int
+	reused   int
+	// active counts the requests in flight, several for HTTP/2
+	active   int
+	lastUsed time.Time
+	expired  bool
+	timer    *time.Timer
+
+	closeOnce sync.Once
+}
+
+// connRequests holds the connections a request got, released once its
+// response, or the one of each redirect, is read
+type connRequests struct {
+	conns []*trackedConn
+	mu    sync.Mutex
+}
+
+// newConnTracker wraps the dial function of a session, which must be set,
+// and hooks its requests to follow the use of the connections
+func newConnTracker(session *azuretls.Session) *connTracker {
+	t := &connTracker{conns: make(map[*trackedConn]struct{})}
+
+	dial := session.Dial
+	session.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// The transport is set up by the first request, the HTTP/2 one
+		// being configured from it
+		t.mu.Lock()
+		if t.closeIdle == nil && session.Transport != nil {
+			t.closeIdle = session.Transport.CloseIdleConnections
+		}
+		t.mu.Unlock()
+
+		return t.add(conn, addr), nil
+	}
+
+	preHook := session.PreHookWithContext
+	session.PreHookWithContext = func(ctx *azuretls.Context) error {
+		if preHook != nil {
+			if err := preHook(ctx); err != nil {
+				return err
+			}
+		}
+
+		// Redirects carry the context of the first request
+		reqCtx := ctx.Request.Context()
+		if reqCtx == nil {
+			reqCtx = session.Context()
+		}
+		if reqCtx.Value(connRequestsKey{}) == nil {
+			ctx.Request.SetContext(t.withContext(reqCtx))
+		}
+		return nil
+	}
+
+	callback := session.CallbackWithContext
+	session.CallbackWithContext = func(ctx *azuretls.Context) {
+		if callback != nil {
+			callback(ctx)
+		}
+
+		if ctx.Request == nil || ctx.Request.Context() == nil {
+			return
+		}
+		if requests, ok := ctx.Request.Context().Value(connRequestsKey{}).(*connRequests); ok {
+			t.release(requests)
+		}
+	}
+
+	return t
+}
+
+func (t *connTracker) add(conn net.Conn, addr string) *trackedConn {
+	tracked := &trackedConn{
+		Conn:    conn,
+		tracker: t,
+		host:    addr,
+		opened:  time.Now(),
+	}
+
+	t.mu.Lock()
+	t.conns[tracked] = struct{}{}
+	if t.maxAge > 0 {
+		tracked.timer = time.AfterFunc(t.maxAge, func() { t.expire(tracked) })
+	}
+	t.mu.Unlock()
+
+	return tracked
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.tracker.mu.Lock()
+		delete(c.tracker.conns, c)
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		c.tracker.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// limitAge retires the connections dialed afterward once older than
+// maxAge, as soon as no request uses them
+func (t *connTracker) limitAge(maxAge time.Duration, retired func(host string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.maxAge = maxAge
+	t.retired = retired
+}
+
+// expire marks a connection as past its age, retiring it when idle
+func (t *connTracker) expire(conn *trackedConn) {
+	t.mu.Lock()
+	conn.expired = true
+	idle := conn.active == 0
+	t.mu.Unlock()
+
+	if idle {
+		t.retire(conn)
+	}
+}
+
+// retire has the transport close the idle connections, the one past its
+// age among them, the next requests dialing anew. Unlike closing the
+// connection itself, this never closes one the transport just handed to a
+// request: such a connection stays open until that request releases it.
+// The other idle connections of the session are closed along, being
+// redialed on demand.
+func (t *connTracker) retire(conn *trackedConn) {
+	if t.retired != nil {
+		t.retired(conn.host)
+	}
+	t.mu.Lock()
+	closeIdle := t.closeIdle
+	t.mu.Unlock()
+	if closeIdle != nil {
+		closeIdle()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, open := t.conns[conn]; open && conn.active == 0 {
+		conn.timer = time.AfterFunc(retireRetry, func() { t.expire(conn) })
+	}
+}
+
+// withContext returns a context reporting the connections its requests get
+func (t *connTracker) withContext(ctx context.Context) context.Context {
+	requests := &connRequests{}
+	ctx = context.WithValue(ctx, connRequestsKey{}, requests)
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.got(requests, info)
+		},
+	})
+}
+
+func (t *connTracker) got(requests *connRequests, info httptrace.GotConnInfo) {
+	conn := info.Conn
+	protocol := "http/1.1"
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if negotiated := tlsConn.ConnectionState().NegotiatedProtocol; negotiated != "" {
+			protocol = negotiated
+		}
+		conn = tlsConn.NetConn()
+	}
+
+	tracked, ok := conn.(*trackedConn)
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	tracked.protocol = protocol
+	tracked.requests++
+	if info.Reused {
+		tracked.reused++
+	}
+	tracked.active++
+	tracked.lastUsed = time.Now()
+	t.mu.Unlock()
+
+	requests.mu.Lock()
+	requests.conns = append(requests.conns, tracked)
+	requests.mu.Unlock()
+}
+
+// release marks the connections of a request as done with it
+func (t *connTracker) release(requests *connRequests) {
+	requests.mu.Lock()
+	conns := requests.conns
+	requests.conns = nil
+	requests.mu.Unlock()
+
+	var retired []*trackedConn
+
+	t.mu.Lock()
+	now := time.Now()
+	for _, conn := range conns {
+		if conn.active > 0 {
+			conn.active--
+		}
+		conn.lastUsed = now
+
+		if conn.expired && conn.active == 0 {
+			retired = append(retired, conn)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, conn := range retired {
+		t.retire(conn)
+	}
+}
+
+// List returns the open connections, oldest first
+func (t *connTracker) List() []common.SessionConnection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	conns := make([]common.SessionConnection, 0, len(t.conns))
+	for conn := range t.conns {
+		info := common.SessionConnection{
+			Host:     conn.host,
+			Protocol: conn.protocol,
+			OpenedAt: conn.opened,
+			AgeMs:    now.Sub(conn.opened).Milliseconds(),
+			Requests: conn.requests,
+			Reused:   conn.reused,
+			Idle:     conn.active == 0,
+		}
+		if addr := conn.RemoteAddr(); addr != nil {
+			info.RemoteAddr = addr.String()
+		}
+		if info.Idle {
+			since := conn.lastUsed
+			if since.IsZero() {
+				since = conn.opened
+			}
+			info.IdleMs = now.Sub(since).Milliseconds()
+		}
+		conns = append(conns, info)
+	}
+
+	slices.SortFunc(conns, func(a, b common.SessionConnection) int {
+		return a.OpenedAt.Compare(b.OpenedAt)
+	})
+	return conns
+}
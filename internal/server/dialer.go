@@ -0,0 +1,427 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/dns"
+	"github.com/Noooste/azuretls-api/internal/proxyauth"
+	"github.com/Noooste/azuretls-api/internal/trace"
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+)
+
+const (
+	// defaultDoTPort is the port of DNS over TLS servers
+	defaultDoTPort = "853"
+
+	// defaultFallbackDelay is the Happy Eyeballs delay of net.Dialer, also
+	// used by browsers
+	defaultFallbackDelay = 300 * time.Millisecond
+)
+
+var errProxyAuthScheme = errors.New("proxy_auth requires a single HTTP or HTTPS proxy")
+
+// userAgentKey carries the User-Agent of a request down to the proxy
+// dialer, which sends it in the CONNECT request
+type userAgentKey struct{}
+
+// sessionDialer replaces the default azuretls dial function so that
+// connections go through the session's DNS cache and dial config. It keeps
+// the default behavior for proxied sessions, where names are resolved by
+// the proxy, and for sessions with neither.
+type sessionDialer struct {
+	session   *azuretls.Session
+	dnsCache  *dns.Cache
+	dial      common.DialConfig
+	proxyAuth *proxyauth.Authenticator
+}
+
+func newSessionDialer(session *azuretls.Session, dnsCache *dns.Cache, dial *common.DialConfig, proxyAuth *common.ProxyAuthConfig) *sessionDialer {
+	d := &sessionDialer{
+		session:  session,
+		dnsCache: dnsCache,
+	}
+	if dial != nil {
+		d.dial = *dial
+	}
+	if proxyAuth != nil {
+		d.proxyAuth = proxyauth.New(*proxyAuth)
+	}
+	session.Dial = d.Dial
+
+	preHook := session.PreHookWithContext
+	session.PreHookWithContext = func(ctx *azuretls.Context) error {
+		if preHook != nil {
+			if err := preHook(ctx); err != nil {
+				return err
+			}
+		}
+
+		reqCtx := ctx.Request.Context()
+		if reqCtx == nil {
+			reqCtx = session.Context()
+		}
+		ctx.Request.SetContext(context.WithValue(reqCtx, userAgentKey{}, requestUserAgent(ctx.Request)))
+		return nil
+	}
+
+	return d
+}
+
+func (d *sessionDialer) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	s := d.session
+
+	if s.ProxyDialer != nil && d.proxyAuth == nil {
+		return s.ProxyDialer.DialContext(ctx, d.userAgent(ctx), network, addr)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   s.TimeOut,
+		KeepAlive: 30 * time.Second,
+	}
+
+	if s.ModifyDialer != nil {
+		if err := s.ModifyDialer(dialer); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.ProxyDialer != nil {
+		return d.dialProxyAuth(ctx, dialer, network, addr)
+	}
+
+	if d.dnsCache == nil && d.dial == (common.DialConfig{}) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := d.lookupIP(ctx, host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	primary, fallback := splitFamilies(filterAddressFamily(ips, network), d.dial.PreferFamily)
+	if d.dial.DisableFallback || len(primary) == 0 || len(fallback) == 0 {
+		return dialSerial(ctx, dialer, network, append(primary, fallback...), port)
+	}
+
+	delay := defaultFallbackDelay
+	if d.dial.FallbackDelayMs > 0 {
+		delay = time.Duration(d.dial.FallbackDelayMs) * time.Millisecond
+	}
+
+	return dialParallel(ctx, dialer, network, primary, fallback, port, delay)
+}
+
+func (d *sessionDialer) userAgent(ctx context.Context) string {
+	if ua, ok := ctx.Value(userAgentKey{}).(string); ok && ua != "" {
+		return ua
+	}
+	return d.session.UserAgent
+}
+
+// requestUserAgent returns the User-Agent header of a request, taken like
+// azuretls from its ordered headers when it has some
+func requestUserAgent(req *azuretls.Request) string {
+	if len(req.OrderedHeaders) > 0 {
+		for _, header := range req.OrderedHeaders {
+			if len(header) > 1 && strings.EqualFold(header[0], "User-Agent") {
+				return header[1]
+			}
+		}
+		return ""
+	}
+	return req.Header.Get("User-Agent")
+}
+
+// dialProxyAuth tunnels to addr through the proxy of the session, running
+// the challenge handshake of its proxy auth config. Every tunnel goes
+// through CONNECT, plain HTTP targets included, the handshake
+// authenticating a connection rather than a request.
+func (d *sessionDialer) dialProxyAuth(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	chain := d.session.ProxyDialer.ProxyChain
+	if len(chain) != 1 || (chain[0].Scheme != "http" && chain[0].Scheme != "https") {
+		return nil, errProxyAuthScheme
+	}
+	proxyURL := chain[0]
+
+	conn, err := dialer.DialContext(ctx, network, proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         proxyURL.Hostname(),
+			NextProtos:         []string{"http/1.1"},
+			InsecureSkipVerify: d.session.InsecureSkipVerify,
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	header := http.Header{"User-Agent": {d.userAgent(ctx)}}
+	for key, values := range d.session.ProxyHeader {
+		if key != fhttp.HeaderOrderKey && key != fhttp.PHeaderOrderKey {
+			header[key] = values
+		}
+	}
+
+	tunnel, err := d.proxyAuth.Connect(ctx, conn, proxyURL.Hostname(), addr, header)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// lookupIP resolves host through the DNS cache, or the system resolver for
+// sessions without cache
+func (d *sessionDialer) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	if d.dnsCache == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		ips := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP
+		}
+		return ips, nil
+	}
+
+	// The cache resolves names on the wire, without reporting to the
+	// standard trace
+	recorder := trace.FromContext(ctx)
+	if recorder != nil {
+		recorder.DNSStart()
+	}
+	ips, err := d.dnsCache.LookupIP(ctx, host)
+	if recorder != nil {
+		recorder.DNSDone()
+	}
+
+	return ips, err
+}
+
+// dialSerial dials the addresses one after another until one connects
+func dialSerial(ctx context.Context, dialer *net.Dialer, network string, ips []net.IP, port string) (net.Conn, error) {
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = &net.OpError{Op: "dial", Net: network, Err: dns.ErrNoAddresses}
+	}
+
+	return nil, lastErr
+}
+
+// dialParallel races the fallback addresses against the primary ones once
+// delay elapsed or the primary ones failed, returning the first connection
+// and the primary error when both fail
+func dialParallel(ctx context.Context, dialer *net.Dialer, network string, primary, fallback []net.IP, port string, delay time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan dialResult, 2)
+	race := func(ips []net.IP, primary bool) {
+		conn, err := dialSerial(ctx, dialer, network, ips, port)
+		results <- dialResult{conn: conn, err: err, primary: primary}
+	}
+
+	go race(primary, true)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var (
+		pending         = 1
+		fallbackStarted bool
+		primaryErr      error
+		fallbackErr     error
+	)
+	startFallback := func() {
+		if !fallbackStarted {
+			fallbackStarted = true
+			pending++
+			go race(fallback, false)
+		}
+	}
+
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			startFallback()
+
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// The losing dial is canceled, but may still connect
+				if pending > 0 {
+					go func() {
+						if lost := <-results; lost.conn != nil {
+							_ = lost.conn.Close()
+						}
+					}()
+				}
+				return result.conn, nil
+			}
+
+			if result.primary {
+				primaryErr = result.err
+				startFallback()
+			} else {
+				fallbackErr = result.err
+			}
+		}
+	}
+
+	if primaryErr != nil {
+		return nil, primaryErr
+	}
+	return nil, fallbackErr
+}
+
+// splitFamilies splits addresses into those of the preferred family, by
+// default the family of the first address, and the others
+func splitFamilies(ips []net.IP, prefer string) (primary, fallback []net.IP) {
+	if len(ips) == 0 {
+		return nil, nil
+	}
+
+	preferIPv4 := ips[0].To4() != nil
+	switch prefer {
+	case common.FamilyIPv4:
+		preferIPv4 = true
+	case common.FamilyIPv6:
+		preferIPv4 = false
+	}
+
+	for _, ip := range ips {
+		if (ip.To4() != nil) == preferIPv4 {
+			primary = append(primary, ip)
+		} else {
+			fallback = append(fallback, ip)
+		}
+	}
+
+	return primary, fallback
+}
+
+// validateProxyAuth checks the proxy auth config of a session, which needs
+// a single HTTP or HTTPS proxy
+func validateProxyAuth(config common.ProxyAuthConfig, proxy string) error {
+	if err := proxyauth.Validate(config); err != nil {
+		return err
+	}
+	if proxy == "" || strings.HasPrefix(proxy, "socks") {
+		return errProxyAuthScheme
+	}
+	return nil
+}
+
+// validateDialConfig checks a dial config before a session is created
+// with it
+func validateDialConfig(config common.DialConfig) error {
+	if config.FallbackDelayMs < 0 {
+		return fmt.Errorf("dial fallback_delay_ms must not be negative")
+	}
+	if config.PreferFamily != "" && config.PreferFamily != common.FamilyIPv4 && config.PreferFamily != common.FamilyIPv6 {
+		return fmt.Errorf("unknown dial prefer_family %q, expected %s or %s", config.PreferFamily, common.FamilyIPv4, common.FamilyIPv6)
+	}
+	return nil
+}
+
+func filterAddressFamily(ips []net.IP, network string) []net.IP {
+	switch network {
+	case "tcp4", "udp4":
+		filtered := make([]net.IP, 0, len(ips))
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				filtered = append(filtered, ip)
+			}
+		}
+		return filtered
+	case "tcp6", "udp6":
+		filtered := make([]net.IP, 0, len(ips))
+		for _, ip := range ips {
+			if ip.To4() == nil {
+				filtered = append(filtered, ip)
+			}
+		}
+		return filtered
+	default:
+		return ips
+	}
+}
+
+// errDoTBypass is returned by the requests of sessions configured with DNS
+// over TLS that would resolve names outside the resolver: the proxy dialer
+// and the QUIC transport of azuretls look names up through the system
+var errDoTBypass = errors.New("sessions resolving over DNS over TLS cannot use a proxy or HTTP/3")
+
+// refuseDoTBypass fails the requests of a session that would resolve names
+// outside its DNS over TLS resolver, before a connection is dialed. The
+// session is left as is, SetProxy refusing to give it a proxy in the first
+// place.
+func refuseDoTBypass(session *azuretls.Session) {
+	preHook := session.PreHookWithContext
+	session.PreHookWithContext = func(ctx *azuretls.Context) error {
+		if ctx.Session.Proxy != "" || ctx.Request.ForceHTTP3 {
+			return errDoTBypass
+		}
+		if preHook != nil {
+			return preHook(ctx)
+		}
+		return nil
+	}
+}
+
+// newDoTResolver creates the resolver of a DNS over TLS config, verifying
+// the server certificate against the address host unless a server name is
+// given
+func newDoTResolver(config common.DoTConfig) dns.Resolver {
+	address := config.Address
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = strings.Trim(address, "[]")
+		address = net.JoinHostPort(host, defaultDoTPort)
+	}
+
+	serverName := config.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+
+	return dns.NewTLSResolver(&tls.Config{ServerName: serverName}, address)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Noooste/azuretls-client"
+)
+
+// fork is a session derived from a session, along with the requests using it
+type fork struct {
+	session *azuretls.Session
+	users   int
+	retired bool
+}
+
+// sessionForks keeps the sessions derived from a session, closed along
+// with it. Forks are closed once the last request using them releases
+// them, so that dropping them leaves the requests in flight running.
+type sessionForks struct {
+	mu    sync.Mutex
+	forks map[string]*fork
+}
+
+func (f *sessionForks) get(key string, create func() (*azuretls.Session, error), current func(*azuretls.Session) bool) (*azuretls.Session, func(), error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry, exists := f.forks[key]
+	if exists && !current(entry.session) {
+		f.retire(key, entry)
+		exists = false
+	}
+
+	if !exists {
+		session, err := create()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if f.forks == nil {
+			f.forks = make(map[string]*fork)
+		}
+		entry = &fork{session: session}
+		f.forks[key] = entry
+	}
+
+	entry.users++
+	return entry.session, sync.OnceFunc(func() { f.release(entry) }), nil
+}
+
+func (f *sessionForks) release(entry *fork) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	entry.users--
+	if entry.retired && entry.users == 0 {
+		entry.session.Close()
+	}
+}
+
+// retire removes a fork, closing it unless requests still use it. Must be
+// called with f.mu held.
+func (f *sessionForks) retire(key string, entry *fork) {
+	delete(f.forks, key)
+	entry.retired = true
+	if entry.users == 0 {
+		entry.session.Close()
+	}
+}
+
+// drop retires the forks, for the next requests to derive them again from
+// the session
+func (f *sessionForks) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, entry := range f.forks {
+		f.retire(key, entry)
+	}
+}
+
+// Fork returns the fork of a session under key, created the first time and
+// replaced once current reports it out of date with the session. Forks are
+// closed with the session, and dropped when its fingerprint or proxy
+// changes, both once released by the requests using them.
+func (sm *DefaultSessionManager) Fork(sessionID, key string, create func() (*azuretls.Session, error), current func(*azuretls.Session) bool) (*azuretls.Session, func(), error) {
+	sm.mu.RLock()
+	entry, exists := sm.sessions[sessionID]
+	sm.mu.RUnlock()
+
+	if !exists {
+		return nil, nil, fmt.Errorf("session with ID %s not found", sessionID)
+	}
+
+	return entry.forks.get(key, create, current)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/ring"
+)
+
+const (
+	// DefaultRequestHistory is the number of requests kept per session
+	DefaultRequestHistory = 20
+
+	// maxHistoryBody bounds the bodies kept in the history, larger bodies
+	// being omitted
+	maxHistoryBody = 1 << 20
+
+	// maxHistoryBytes bounds the requests kept per session, the oldest
+	// being dropped first
+	maxHistoryBytes = 4 << 20
+)
+
+// requestHistory keeps the last requests sent by a session
+type requestHistory struct {
+	requests *ring.Ring[common.SentRequest]
+	size     int
+
+	mu sync.Mutex
+}
+
+func newRequestHistory(count int) *requestHistory {
+	return &requestHistory{requests: ring.New[common.SentRequest](count)}
+}
+
+func (h *requestHistory) add(req common.SentRequest) {
+	if len(req.Body) > maxHistoryBody || len(req.BodyB64) > maxHistoryBody {
+		req.Body, req.BodyB64 = "", ""
+		req.BodyOmitted = true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if evicted, ok := h.requests.Add(req); ok {
+		h.size -= sentSize(evicted)
+	}
+	h.size += sentSize(req)
+
+	for h.size > maxHistoryBytes && h.requests.Len() > 1 {
+		oldest, _ := h.requests.RemoveOldest()
+		h.size -= sentSize(oldest)
+	}
+}
+
+// list returns the requests, newest first
+func (h *requestHistory) list() []common.SentRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.requests.List()
+}
+
+// sentSize estimates the memory held by a request
+func sentSize(req common.SentRequest) int {
+	size := len(req.URL) + len(req.Body) + len(req.BodyB64) + len(req.Error)
+	for _, header := range req.Headers {
+		for _, value := range header {
+			size += len(value)
+		}
+	}
+	return size
+}
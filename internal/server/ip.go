@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-client"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+const (
+	DefaultIPEchoURL  = "https://api.ipify.org"
+	DefaultIPCacheTTL = 5 * time.Minute
+)
+
+// geoRecord covers the fields of the GeoLite2/GeoIP2 City, Country and ASN databases
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN          uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+type ipCacheEntry struct {
+	info      common.IPInfo
+	expiresAt time.Time
+}
+
+// IPResolver looks up the public IP of sessions through an echo service,
+// caching results per session and proxy
+type IPResolver struct {
+	echoURL   string
+	ttl       time.Duration
+	databases []*maxminddb.Reader
+
+	cache map[string]ipCacheEntry
+	mu    sync.Mutex
+}
+
+// NewIPResolver creates a resolver using the given echo URL and cache TTL.
+// geoIPPaths is an optional comma-separated list of MaxMind databases used to
+// enrich results with geolocation and ASN information.
+func NewIPResolver(echoURL string, ttl time.Duration, geoIPPaths string) (*IPResolver, error) {
+	if echoURL == "" {
+		echoURL = DefaultIPEchoURL
+	}
+
+	resolver := &IPResolver{
+		echoURL: echoURL,
+		ttl:     ttl,
+		cache:   make(map[string]ipCacheEntry),
+	}
+
+	for _, path := range strings.Split(geoIPPaths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		db, err := maxminddb.Open(path)
+		if err != nil {
+			_ = resolver.Close()
+			return nil, fmt.Errorf("failed to open GeoIP database %s: %w", path, err)
+		}
+		resolver.databases = append(resolver.databases, db)
+	}
+
+	return resolver, nil
+}
+
+// Lookup returns the public IP information of a session, from cache when possible
+func (r *IPResolver) Lookup(sessionID string, session *azuretls.Session) (*common.IPInfo, error) {
+	key := sessionID + "|" + session.Proxy
+
+	r.mu.Lock()
+	entry, exists := r.cache[key]
+	r.mu.Unlock()
+
+	if exists && time.Now().Before(entry.expiresAt) {
+		info := entry.info
+		info.Cached = true
+		return &info, nil
+	}
+
+	resp, err := session.Get(r.echoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := strings.TrimSpace(string(resp.Body))
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return nil, fmt.Errorf("IP echo service returned an invalid address: %q", ip)
+	}
+
+	info := common.IPInfo{IP: ip}
+	r.enrich(&info, parsedIP)
+
+	if r.ttl > 0 {
+		r.mu.Lock()
+		r.cache[key] = ipCacheEntry{info: info, expiresAt: time.Now().Add(r.ttl)}
+		r.mu.Unlock()
+	}
+
+	return &info, nil
+}
+
+func (r *IPResolver) enrich(info *common.IPInfo, ip net.IP) {
+	for _, db := range r.databases {
+		var record geoRecord
+		if err := db.Lookup(ip, &record); err != nil {
+			common.LogWarn("GeoIP lookup failed for %s: %v", ip, err)
+			continue
+		}
+
+		if record.Country.ISOCode != "" {
+			info.Country = record.Country.ISOCode
+		}
+		if name := record.City.Names["en"]; name != "" {
+			info.City = name
+		}
+		if record.ASN != 0 {
+			info.ASN = record.ASN
+		}
+		if record.Organization != "" {
+			info.Organization = record.Organization
+		}
+	}
+}
+
+// Forget drops every cached entry belonging to a session
+func (r *IPResolver) Forget(sessionID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := sessionID + "|"
+	for key := range r.cache {
+		if strings.HasPrefix(key, prefix) {
+			delete(r.cache, key)
+		}
+	}
+}
+
+// Close releases the GeoIP databases
+func (r *IPResolver) Close() error {
+	var firstErr error
+	for _, db := range r.databases {
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	r.databases = nil
+	return firstErr
+}
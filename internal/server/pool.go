@@ -0,0 +1,199 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// SessionPool keeps pre-created sessions registered in the session manager
+// and hands them out on demand, so that hot paths skip session creation.
+type SessionPool struct {
+	manager common.SessionManager
+	config  common.SessionPoolConfig
+
+	// members maps each pooled session to the slot it was created for
+	members map[string]int
+	inUse   map[string]bool
+	idle    []string
+	mu      sync.Mutex
+}
+
+func NewSessionPool(manager common.SessionManager, config common.SessionPoolConfig) *SessionPool {
+	return &SessionPool{
+		manager: manager,
+		config:  config,
+		members: make(map[string]int),
+		inUse:   make(map[string]bool),
+	}
+}
+
+// Fill creates the configured number of sessions. Slots that fail are
+// logged and left empty, and the first error is returned.
+func (p *SessionPool) Fill() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var firstErr error
+	for slot := 0; slot < p.config.Size; slot++ {
+		if err := p.create(slot); err != nil {
+			common.LogError("SessionPool: Failed to create session for slot %d: %v", slot, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// Acquire hands out an idle session, replacing any that was deleted while idle
+func (p *SessionPool) Acquire() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(p.idle) > 0 {
+		sessionID := p.idle[0]
+		p.idle = p.idle[1:]
+
+		if _, exists := p.manager.GetSession(sessionID); !exists {
+			p.replace(sessionID)
+			continue
+		}
+
+		p.inUse[sessionID] = true
+		return sessionID, nil
+	}
+
+	return "", common.ErrPoolExhausted
+}
+
+// Release returns an acquired session to the pool, reset so that the next
+// holder gets none of the cookies, proxy or headers of the previous one. A
+// discarded session, or one that cannot be reset, is deleted and replaced
+// by a fresh one created from the same profile.
+func (p *SessionPool) Release(sessionID string, discard bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, exists := p.members[sessionID]; !exists {
+		return fmt.Errorf("session with ID %s does not belong to the pool", sessionID)
+	}
+
+	if !p.inUse[sessionID] {
+		return fmt.Errorf("session with ID %s is not acquired", sessionID)
+	}
+	delete(p.inUse, sessionID)
+
+	_, exists := p.manager.GetSession(sessionID)
+	if exists && !discard {
+		resetter, ok := p.manager.(common.SessionResetter)
+		if !ok {
+			discard = true
+		} else if err := resetter.ResetSession(sessionID); err != nil {
+			common.LogWarn("SessionPool: Failed to reset session %s, replacing it: %v", sessionID, err)
+			discard = true
+		}
+	}
+
+	if !exists || discard {
+		if exists {
+			if err := p.manager.DeleteSession(sessionID); err != nil {
+				common.LogWarn("SessionPool: Failed to delete discarded session %s: %v", sessionID, err)
+			}
+		}
+		p.replace(sessionID)
+		return nil
+	}
+
+	p.idle = append(p.idle, sessionID)
+	return nil
+}
+
+// Remove takes a session out of the pool, idle or acquired, and creates a
+// fresh one from the same profile in its slot. The session itself is left
+// to the caller to delete.
+func (p *SessionPool) Remove(sessionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, exists := p.members[sessionID]; !exists {
+		return
+	}
+
+	delete(p.inUse, sessionID)
+	if i := slices.Index(p.idle, sessionID); i >= 0 {
+		p.idle = slices.Delete(p.idle, i, i+1)
+	}
+	p.replace(sessionID)
+}
+
+// Contains reports whether the session was created by the pool
+func (p *SessionPool) Contains(sessionID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, exists := p.members[sessionID]
+	return exists
+}
+
+func (p *SessionPool) Stats() common.PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return common.PoolStats{
+		Size:  p.config.Size,
+		Idle:  len(p.idle),
+		InUse: len(p.inUse),
+	}
+}
+
+// replace must be called with p.mu held
+func (p *SessionPool) replace(sessionID string) {
+	slot := p.members[sessionID]
+	delete(p.members, sessionID)
+
+	if err := p.create(slot); err != nil {
+		common.LogError("SessionPool: Failed to replace session %s: %v", sessionID, err)
+	}
+}
+
+// create must be called with p.mu held
+func (p *SessionPool) create(slot int) error {
+	sessionID := common.GenerateSessionID()
+
+	var err error
+	if config := p.profile(slot); config != nil {
+		_, err = p.manager.CreateSessionWithConfig(sessionID, config)
+	} else {
+		_, err = p.manager.CreateSession(sessionID)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	p.members[sessionID] = slot
+	p.idle = append(p.idle, sessionID)
+	return nil
+}
+
+// profile returns the configuration of a slot, or nil when neither a
+// profile nor a proxy applies to it
+func (p *SessionPool) profile(slot int) *common.SessionConfig {
+	if len(p.config.Profiles) == 0 && len(p.config.Proxies) == 0 {
+		return nil
+	}
+
+	var config common.SessionConfig
+	if len(p.config.Profiles) > 0 {
+		config = p.config.Profiles[slot%len(p.config.Profiles)]
+	}
+	if len(p.config.Proxies) > 0 {
+		config.Proxy = p.config.Proxies[slot%len(p.config.Proxies)]
+	}
+
+	return &config
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-client"
+	tls "github.com/Noooste/utls"
+)
+
+// defaultDatagramFrameSize is the max_datagram_frame_size Chrome advertises
+const defaultDatagramFrameSize = 65536
+
+// errZeroRTT rejects 0-RTT, which needs the QUIC sessions to be resumed,
+// something azuretls does not do
+var errZeroRTT = errors.New("quic zero_rtt is not supported: HTTP/3 connections are never resumed, so 0-RTT early data cannot be sent")
+
+// validateQUICConfig checks a QUIC config before a session is created
+func validateQUICConfig(config common.QUICConfig) error {
+	if config.ZeroRTT {
+		return errZeroRTT
+	}
+	return nil
+}
+
+// applyQUICConfig rewrites the QUIC transport parameters of the HTTP/3
+// ClientHello of the session, on top of any custom spec already set.
+// HTTP/3 is only implemented for Chromium browsers, whose spec is the
+// default.
+func applyQUICConfig(session *azuretls.Session, config common.QUICConfig) {
+	base := session.GetClientHelloSpecHTTP3
+
+	session.GetClientHelloSpecHTTP3 = func() *tls.ClientHelloSpec {
+		var spec *tls.ClientHelloSpec
+		if base != nil {
+			spec = base()
+		} else {
+			spec = azuretls.GetLastChromeVersionForHTTP3()
+		}
+
+		for _, extension := range spec.Extensions {
+			if parameters, ok := extension.(*tls.QUICTransportParametersExtension); ok {
+				parameters.TransportParameters = tuneTransportParameters(parameters.TransportParameters, config)
+			}
+		}
+
+		return spec
+	}
+}
+
+func tuneTransportParameters(parameters tls.TransportParameters, config common.QUICConfig) tls.TransportParameters {
+	if config.IdleTimeoutMs > 0 {
+		parameters = setTransportParameter(parameters, tls.MaxIdleTimeout(config.IdleTimeoutMs))
+	}
+	if config.InitialMaxStreamsBidi > 0 {
+		parameters = setTransportParameter(parameters, tls.InitialMaxStreamsBidi(config.InitialMaxStreamsBidi))
+	}
+	if config.InitialMaxStreamsUni > 0 {
+		parameters = setTransportParameter(parameters, tls.InitialMaxStreamsUni(config.InitialMaxStreamsUni))
+	}
+
+	if config.Datagrams != nil {
+		if *config.Datagrams {
+			if !hasTransportParameter(parameters, tls.MaxDatagramFrameSize(0).ID()) {
+				parameters = append(parameters, tls.MaxDatagramFrameSize(defaultDatagramFrameSize))
+			}
+		} else {
+			parameters = removeTransportParameter(parameters, tls.MaxDatagramFrameSize(0).ID())
+		}
+	}
+
+	return parameters
+}
+
+// setTransportParameter replaces the parameter in place, keeping the
+// order of the spec, or appends it when missing
+func setTransportParameter(parameters tls.TransportParameters, parameter tls.TransportParameter) tls.TransportParameters {
+	for i, existing := range parameters {
+		if existing.ID() == parameter.ID() {
+			parameters[i] = parameter
+			return parameters
+		}
+	}
+	return append(parameters, parameter)
+}
+
+func hasTransportParameter(parameters tls.TransportParameters, id uint64) bool {
+	return slices.ContainsFunc(parameters, func(parameter tls.TransportParameter) bool {
+		return parameter.ID() == id
+	})
+}
+
+func removeTransportParameter(parameters tls.TransportParameters, id uint64) tls.TransportParameters {
+	return slices.DeleteFunc(parameters, func(parameter tls.TransportParameter) bool {
+		return parameter.ID() == id
+	})
+}
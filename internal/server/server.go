@@ -9,49 +9,210 @@ import (
 
 	"net/http"
 
+	"github.com/Noooste/azuretls-api/internal/auth"
+	"github.com/Noooste/azuretls-api/internal/bodystore"
 	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/controller"
+	"github.com/Noooste/azuretls-api/internal/cookiejars"
+	"github.com/Noooste/azuretls-api/internal/download"
+	"github.com/Noooste/azuretls-api/internal/keepalive"
+	"github.com/Noooste/azuretls-api/internal/monitor"
+	"github.com/Noooste/azuretls-api/internal/plugins"
+	"github.com/Noooste/azuretls-api/internal/probe"
+	"github.com/Noooste/azuretls-api/internal/profile"
 	"github.com/Noooste/azuretls-api/internal/rest"
+	"github.com/Noooste/azuretls-api/internal/rotation"
+	"github.com/Noooste/azuretls-api/internal/rules"
+	"github.com/Noooste/azuretls-api/internal/scheduler"
+	"github.com/Noooste/azuretls-api/internal/scripts"
+	"github.com/Noooste/azuretls-api/internal/websocket"
 )
 
+// defaultBodyRefTTL is how long bodies fetched out of band are kept when the
+// configuration leaves it unset
+const defaultBodyRefTTL = 5 * time.Minute
+
+// defaultDownloadTTL is how long managed downloads that are not running are
+// kept when the configuration leaves it unset
+const defaultDownloadTTL = time.Hour
+
 type Server struct {
 	config         common.ServerConfig
 	sessionManager common.SessionManager
+	sessionPool    *SessionPool
+	profiles       *profile.Catalog
+	bodyStore      *bodystore.Store
+	bodies         *bodystore.Bodies
+	cookieJars     *cookiejars.Registry
+	owners         *auth.Owners
+	downloads      *download.Manager
+	monitor        *monitor.Monitor
+	rotator        *rotation.Rotator
+	keepalives     *keepalive.Scheduler
+	prober         *probe.Prober
+	plugins        *plugins.Manager
+	scripts        *scripts.Engine
+	scheduler      *scheduler.Scheduler
+	handler        *rest.Routes
 	httpServer     *http.Server
 	ctx            context.Context
 	cancel         context.CancelFunc
 }
 
-func NewServer(config common.ServerConfig) *Server {
+// NewServer creates a server listening on the configured host and port. A
+// nil session manager is replaced by the default one.
+func NewServer(config common.ServerConfig, sessionManager common.SessionManager) (*Server, error) {
+	server, err := New(config, sessionManager)
+	if err != nil {
+		return nil, err
+	}
+
+	server.httpServer = &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", config.Host, config.Port),
+		Handler:           server.handler,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+	}
+
+	return server, nil
+}
+
+// New creates the components of a server and its routes, without listener,
+// for the API to be served by the caller. A nil session manager is replaced
+// by the default one. It fails when the request rules are invalid or the
+// session manager fails to start.
+func New(config common.ServerConfig, sessionManager common.SessionManager) (*Server, error) {
+	if _, err := rules.NewEngine(config.Rules); err != nil {
+		return nil, fmt.Errorf("invalid request rules: %w", err)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Set log level from config
 	common.SetLogLevel(config.LogLevel)
 
-	sessionManager := NewSessionManager()
+	if sessionManager == nil {
+		sessionManager = NewSessionManager()
+	}
 
 	server := &Server{
 		config:         config,
 		sessionManager: sessionManager,
+		monitor:        monitor.New(monitor.DefaultRecentRequests),
+		rotator:        rotation.NewRotator(),
+		keepalives:     keepalive.NewScheduler(),
+		scripts:        scripts.NewEngine(config.ScriptLimits),
+		cookieJars:     cookiejars.NewRegistry(),
+		owners:         auth.NewOwners(),
 		ctx:            ctx,
 		cancel:         cancel,
 	}
 
-	handler := rest.SetupRoutes(server)
+	if config.ProfilesDir != "" {
+		server.profiles = profile.NewCatalog(config.ProfilesDir)
+		if count, err := server.profiles.Reload(); err != nil {
+			common.LogError("Failed to load profiles from %s: %v", config.ProfilesDir, err)
+		} else {
+			common.LogInfo("Loaded %d profiles from %s", count, config.ProfilesDir)
+		}
+	}
 
-	server.httpServer = &http.Server{
-		Addr:         fmt.Sprintf("%s:%d", config.Host, config.Port),
-		Handler:      handler,
-		ReadTimeout:  config.ReadTimeout,
-		WriteTimeout: config.WriteTimeout,
+	// The session manager is set up before the pool creates sessions
+	if lifecycle, ok := sessionManager.(common.SessionManagerLifecycle); ok {
+		if err := lifecycle.Start(config, server.GetProfileCatalog()); err != nil {
+			cancel()
+			return nil, fmt.Errorf("failed to start session manager: %w", err)
+		}
+	}
+
+	if config.SessionPool.Size > 0 {
+		server.sessionPool = NewSessionPool(sessionManager, config.SessionPool)
+		if err := server.sessionPool.Fill(); err != nil {
+			common.LogError("Failed to pre-create some pooled sessions: %v", err)
+		}
+		common.LogInfo("Session pool ready with %d idle sessions", server.sessionPool.Stats().Idle)
+	}
+
+	bodyStore, err := bodystore.New(config.BodyStoreDir)
+	if err != nil {
+		common.LogError("Failed to open body store, downloads disabled: %v", err)
+	} else {
+		server.bodyStore = bodyStore
+		downloadTTL := config.DownloadTTL
+		if downloadTTL <= 0 {
+			downloadTTL = defaultDownloadTTL
+		}
+		server.downloads = download.NewManager(bodyStore, downloadTTL, min(downloadTTL, time.Minute))
+
+		ttl := config.BodyRefTTL
+		if ttl <= 0 {
+			ttl = defaultBodyRefTTL
+		}
+		server.bodies = bodystore.NewBodies(bodyStore, ttl, min(ttl, time.Minute))
 	}
 
-	return server
+	if config.MaxOutgoingRequests > 0 {
+		server.scheduler = scheduler.New(config.MaxOutgoingRequests, config.QueueTimeout)
+	}
+
+	if config.FaultInjection.Enabled() {
+		common.LogWarn("Fault injection is enabled, requests will be randomly delayed or failed: %+v", config.FaultInjection)
+	}
+
+	if config.PluginsDir != "" {
+		manager, err := plugins.Load(config.PluginsDir)
+		if err != nil {
+			common.LogError("Failed to load plugins, plugins disabled: %v", err)
+		} else {
+			server.plugins = manager
+
+			// Auth providers run first, ahead of the middlewares of the config
+			server.config.Middlewares = append([]common.MiddlewareConfig{{
+				Name:       "plugins",
+				Stage:      common.BeforeAuth,
+				Middleware: manager.Middleware,
+			}}, config.Middlewares...)
+		}
+	}
+
+	if config.ScriptsDir != "" {
+		if count, err := server.scripts.LoadDir(config.ScriptsDir); err != nil {
+			common.LogError("Failed to load scripts from %s: %v", config.ScriptsDir, err)
+		} else {
+			common.LogInfo("Loaded %d scripts from %s", count, config.ScriptsDir)
+		}
+	}
+
+	// Probes run through a controller of their own, the server being ready
+	// to hand out its components
+	server.prober = probe.NewProber(controller.NewSessionController(server).ExecuteStatelessRequest)
+	for _, p := range config.Probes {
+		if _, err := server.prober.Add(p); err != nil {
+			common.LogError("Failed to register probe: %v", err)
+		}
+	}
+
+	server.handler = rest.SetupRoutes(server)
+
+	return server, nil
+}
+
+// ServeHTTP serves the REST and WebSocket API
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
 }
 
 func (s *Server) Start() error {
 	log.Printf("Starting server on %s:%d", s.config.Host, s.config.Port)
 
+	// ListenAndServe returns as soon as the listener closes, so Start waits
+	// for the WebSocket connections to drain and the sessions to close
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
+
 		<-s.ctx.Done()
 		log.Println("Shutting down server...")
 
@@ -62,16 +223,47 @@ func (s *Server) Start() error {
 			log.Printf("Server shutdown error: %v", err)
 		}
 
-		err := s.sessionManager.CleanupSessions()
-		if err != nil {
-			return
-		}
+		_ = s.Close()
 	}()
 
 	if err := s.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("server failed to start: %w", err)
 	}
 
+	<-done
+	return nil
+}
+
+// Close stops the background tasks of the server and deletes its sessions.
+// Servers created with New are closed by their owner.
+func (s *Server) Close() error {
+	s.handler.CloseWebSockets(websocket.CloseNotice{
+		Reason:      "server shutting down",
+		ReconnectTo: s.config.WSReconnectTo,
+	}, s.config.WSDrainTimeout)
+
+	s.keepalives.Close()
+	s.prober.Close()
+
+	if s.plugins != nil {
+		s.plugins.Close()
+	}
+
+	if s.downloads != nil {
+		s.downloads.Close()
+		s.bodies.Close()
+		if err := s.bodyStore.Close(); err != nil {
+			log.Printf("Body store shutdown error: %v", err)
+		}
+	}
+
+	if err := s.sessionManager.CleanupSessions(); err != nil {
+		return err
+	}
+
+	if lifecycle, ok := s.sessionManager.(common.SessionManagerLifecycle); ok {
+		return lifecycle.Stop()
+	}
 	return nil
 }
 
@@ -87,3 +279,92 @@ func (s *Server) GetConfig() common.ServerConfig {
 func (s *Server) GetSessionManager() common.SessionManager {
 	return s.sessionManager
 }
+
+func (s *Server) GetSessionPool() common.SessionPool {
+	// Avoid returning a non-nil interface wrapping a nil pointer
+	if s.sessionPool == nil {
+		return nil
+	}
+	return s.sessionPool
+}
+
+func (s *Server) GetProfileCatalog() common.ProfileCatalog {
+	if s.profiles == nil {
+		return nil
+	}
+	return s.profiles
+}
+
+func (s *Server) GetDownloadManager() common.DownloadManager {
+	if s.downloads == nil {
+		return nil
+	}
+	return s.downloads
+}
+
+func (s *Server) GetMonitor() common.Monitor {
+	return s.monitor
+}
+
+func (s *Server) GetSessionRotator() common.SessionRotator {
+	return s.rotator
+}
+
+func (s *Server) GetKeepaliveScheduler() common.KeepaliveScheduler {
+	return s.keepalives
+}
+
+func (s *Server) GetProber() common.Prober {
+	if s.prober == nil {
+		return nil
+	}
+	return s.prober
+}
+
+func (s *Server) GetPluginManager() common.PluginManager {
+	if s.plugins == nil {
+		return nil
+	}
+	return s.plugins
+}
+
+func (s *Server) GetScriptRunner() common.ScriptRunner {
+	return s.scripts
+}
+
+func (s *Server) GetRequestScheduler() common.RequestScheduler {
+	if s.scheduler == nil {
+		return nil
+	}
+	return s.scheduler
+}
+
+func (s *Server) GetBodyStore() common.BodyStore {
+	if s.bodies == nil {
+		return nil
+	}
+	return s.bodies
+}
+
+func (s *Server) GetCookieJars() common.CookieJarRegistry {
+	return s.cookieJars
+}
+
+func (s *Server) GetSessionOwners() common.SessionOwners {
+	return s.owners
+}
+
+// ReloadProfiles reads the profile directory again, keeping the previous
+// profiles when it fails
+func (s *Server) ReloadProfiles() {
+	if s.profiles == nil {
+		return
+	}
+
+	count, err := s.profiles.Reload()
+	if err != nil {
+		common.LogError("Failed to reload profiles from %s: %v", s.config.ProfilesDir, err)
+		return
+	}
+	common.LogInfo("Reloaded %d profiles from %s", count, s.config.ProfilesDir)
+}
@@ -3,82 +3,130 @@ package server
 import (
 	"fmt"
 	"net/url"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/cookiejars"
+	"github.com/Noooste/azuretls-api/internal/dns"
+	"github.com/Noooste/azuretls-api/internal/trace"
 	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
 )
 
 type DefaultSessionManager struct {
-	sessions map[string]*azuretls.Session
-	mu       sync.RWMutex
+	sessions    map[string]*sessionEntry
+	ipResolver  *IPResolver
+	dnsResolver dns.Resolver
+	profiles    common.ProfileCatalog
+	bandwidth   *bandwidthLimiter
+	mu          sync.RWMutex
+}
+
+// sessionEntry holds a session along with the server-side state attached to it
+type sessionEntry struct {
+	session  *azuretls.Session
+	dnsCache *dns.Cache
+	tickets  *ticketCache
+	conns    *connTracker
+	tags     []string
+	history  *requestHistory
+	// forks are the sessions derived from session, such as its ALPN forks
+	forks sessionForks
+	// dot is set when the session resolves names over DNS over TLS, rather
+	// than the server as a whole
+	dot bool
+	// config is the config the session was created with, nil without one
+	config *common.SessionConfig
 }
 
 func (sm *DefaultSessionManager) ApplyJA3(sessionID, ja3, navigator string) error {
 	sm.mu.RLock()
-	session, exists := sm.sessions[sessionID]
+	entry, exists := sm.sessions[sessionID]
 	sm.mu.RUnlock()
 
 	if !exists {
 		return fmt.Errorf("session with ID %s not found", sessionID)
 	}
 
-	return session.ApplyJa3(ja3, navigator)
+	if err := entry.session.ApplyJa3(ja3, navigator); err != nil {
+		return err
+	}
+
+	if entry.tickets != nil {
+		offerPreSharedKey(entry.session)
+	}
+	entry.forks.drop()
+	return nil
 }
 
 func (sm *DefaultSessionManager) ApplyHTTP2(sessionID, fingerprint string) error {
 	sm.mu.RLock()
-	session, exists := sm.sessions[sessionID]
+	entry, exists := sm.sessions[sessionID]
 	sm.mu.RUnlock()
 
 	if !exists {
 		return fmt.Errorf("session with ID %s not found", sessionID)
 	}
 
-	return session.ApplyHTTP2(fingerprint)
+	if err := entry.session.ApplyHTTP2(fingerprint); err != nil {
+		return err
+	}
+
+	entry.forks.drop()
+	return nil
 }
 
 func (sm *DefaultSessionManager) ApplyHTTP3(sessionID, fingerprint string) error {
 	sm.mu.RLock()
-	session, exists := sm.sessions[sessionID]
+	entry, exists := sm.sessions[sessionID]
 	sm.mu.RUnlock()
 
 	if !exists {
 		return fmt.Errorf("session with ID %s not found", sessionID)
 	}
 
-	return session.ApplyHTTP3(fingerprint)
+	return entry.session.ApplyHTTP3(fingerprint)
 }
 
 func (sm *DefaultSessionManager) SetProxy(sessionID, proxy string) error {
 	sm.mu.RLock()
-	session, exists := sm.sessions[sessionID]
+	entry, exists := sm.sessions[sessionID]
 	sm.mu.RUnlock()
 
 	if !exists {
 		return fmt.Errorf("session with ID %s not found", sessionID)
 	}
+	if entry.dot {
+		return errDoTBypass
+	}
 
-	return session.SetProxy(proxy)
+	if err := entry.session.SetProxy(proxy); err != nil {
+		return err
+	}
+
+	entry.forks.drop()
+	return nil
 }
 
 func (sm *DefaultSessionManager) ClearProxy(sessionID string) error {
 	sm.mu.RLock()
-	session, exists := sm.sessions[sessionID]
+	entry, exists := sm.sessions[sessionID]
 	sm.mu.RUnlock()
 
 	if !exists {
 		return fmt.Errorf("session with ID %s not found", sessionID)
 	}
 
-	session.ClearProxy()
+	entry.session.ClearProxy()
+	entry.forks.drop()
 	return nil
 }
 
 func (sm *DefaultSessionManager) AddPins(sessionID, urlStr string, pins []string) error {
 	sm.mu.RLock()
-	session, exists := sm.sessions[sessionID]
+	entry, exists := sm.sessions[sessionID]
 	sm.mu.RUnlock()
 
 	if !exists {
@@ -90,12 +138,12 @@ func (sm *DefaultSessionManager) AddPins(sessionID, urlStr string, pins []string
 		return fmt.Errorf("invalid URL: %w", err)
 	}
 
-	return session.AddPins(parsedURL, pins)
+	return entry.session.AddPins(parsedURL, pins)
 }
 
 func (sm *DefaultSessionManager) ClearPins(sessionID, urlStr string) error {
 	sm.mu.RLock()
-	session, exists := sm.sessions[sessionID]
+	entry, exists := sm.sessions[sessionID]
 	sm.mu.RUnlock()
 
 	if !exists {
@@ -107,25 +155,138 @@ func (sm *DefaultSessionManager) ClearPins(sessionID, urlStr string) error {
 		return fmt.Errorf("invalid URL: %w", err)
 	}
 
-	return session.ClearPins(parsedURL)
+	return entry.session.ClearPins(parsedURL)
 }
 
-func (sm *DefaultSessionManager) GetIP(sessionID string) (string, error) {
+func (sm *DefaultSessionManager) GetIP(sessionID string) (*common.IPInfo, error) {
 	sm.mu.RLock()
-	session, exists := sm.sessions[sessionID]
+	entry, exists := sm.sessions[sessionID]
+	ipResolver := sm.ipResolver
 	sm.mu.RUnlock()
 
 	if !exists {
-		return "", fmt.Errorf("session with ID %s not found", sessionID)
+		return nil, fmt.Errorf("session with ID %s not found", sessionID)
 	}
 
-	return session.Ip()
+	return ipResolver.Lookup(sessionID, entry.session)
 }
 
 func NewSessionManager() *DefaultSessionManager {
+	ipResolver, _ := NewIPResolver(DefaultIPEchoURL, DefaultIPCacheTTL, "")
+
 	return &DefaultSessionManager{
-		sessions: make(map[string]*azuretls.Session),
+		sessions:   make(map[string]*sessionEntry),
+		ipResolver: ipResolver,
+	}
+}
+
+// SetDNSResolver enables per-session DNS caching for sessions created
+// afterward, resolving names with the given resolver. A nil resolver
+// disables caching.
+func (sm *DefaultSessionManager) SetDNSResolver(resolver dns.Resolver) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.dnsResolver = resolver
+}
+
+// SetBandwidthLimit caps the bytes per second sent by the sessions created
+// afterward, all together. Zero removes the cap.
+func (sm *DefaultSessionManager) SetBandwidthLimit(bytesPerSec int64) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.bandwidth = newBandwidthLimiter(bytesPerSec)
+}
+
+// SetProfileCatalog sets the catalog resolving the profile of sessions
+// created afterward. A nil catalog rejects sessions naming a profile.
+func (sm *DefaultSessionManager) SetProfileCatalog(catalog common.ProfileCatalog) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.profiles = catalog
+}
+
+// newEntry must be called with sm.mu held. A nil resolver disables the DNS
+// cache of the session, whose dialing follows config when set.
+func (sm *DefaultSessionManager) newEntry(session *azuretls.Session, resolver dns.Resolver, config *common.SessionConfig) *sessionEntry {
+	entry := &sessionEntry{
+		session: session,
+		config:  config,
+	}
+	if config != nil && config.History {
+		entry.history = newRequestHistory(DefaultRequestHistory)
+	}
+	trace.Install(session)
+	// Shared jars are swapped in behind the jar of the session, which
+	// requests read unlocked
+	session.CookieJar = cookiejars.NewSessionJar()
+
+	if resolver != nil {
+		entry.dnsCache = dns.NewCache(resolver)
+	}
+	if entry.dot = config != nil && config.DoT != nil; entry.dot {
+		refuseDoTBypass(session)
+	}
+
+	var (
+		dial      *common.DialConfig
+		proxyAuth *common.ProxyAuthConfig
+		bandwidth *common.BandwidthConfig
+	)
+	if config != nil {
+		dial, proxyAuth, bandwidth = config.Dial, config.ProxyAuth, config.Bandwidth
 	}
+	newSessionDialer(session, entry.dnsCache, dial, proxyAuth)
+	throttle(session, bandwidth, sm.bandwidth)
+	entry.conns = newConnTracker(session)
+
+	return entry
+}
+
+// Start sets the IP and DNS resolvers, the bandwidth limit and the profile
+// catalog up from the server configuration
+func (sm *DefaultSessionManager) Start(config common.ServerConfig, profiles common.ProfileCatalog) error {
+	ipCacheTTL := config.IPCacheTTL
+	if ipCacheTTL == 0 {
+		ipCacheTTL = DefaultIPCacheTTL
+	}
+
+	ipResolver, err := NewIPResolver(config.IPEchoURL, ipCacheTTL, config.GeoIPDatabase)
+	if err != nil {
+		common.LogError("Failed to initialize IP resolver, GeoIP lookups disabled: %v", err)
+		ipResolver, _ = NewIPResolver(config.IPEchoURL, ipCacheTTL, "")
+	}
+	sm.SetIPResolver(ipResolver)
+
+	switch {
+	case config.DoTAddress != "":
+		sm.SetDNSResolver(newDoTResolver(common.DoTConfig{Address: config.DoTAddress, ServerName: config.DoTServerName}))
+	case !config.DisableDNSCache:
+		sm.SetDNSResolver(dns.NewSystemResolver())
+	}
+	sm.SetBandwidthLimit(config.MaxBandwidth)
+	sm.SetProfileCatalog(profiles)
+
+	return nil
+}
+
+// Stop closes the IP resolver and its GeoIP databases
+func (sm *DefaultSessionManager) Stop() error {
+	sm.mu.RLock()
+	ipResolver := sm.ipResolver
+	sm.mu.RUnlock()
+
+	return ipResolver.Close()
+}
+
+// SetIPResolver replaces the resolver used by GetIP
+func (sm *DefaultSessionManager) SetIPResolver(resolver *IPResolver) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.ipResolver = resolver
 }
 
 func (sm *DefaultSessionManager) CreateSession(sessionID string) (*azuretls.Session, error) {
@@ -141,7 +302,7 @@ func (sm *DefaultSessionManager) CreateSession(sessionID string) (*azuretls.Sess
 	}
 
 	session := azuretls.NewSession()
-	sm.sessions[sessionID] = session
+	sm.sessions[sessionID] = sm.newEntry(session, sm.dnsResolver, nil)
 
 	return session, nil
 }
@@ -150,21 +311,26 @@ func (sm *DefaultSessionManager) GetSession(sessionID string) (*azuretls.Session
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 
-	session, exists := sm.sessions[sessionID]
-	return session, exists
+	entry, exists := sm.sessions[sessionID]
+	if !exists {
+		return nil, false
+	}
+	return entry.session, true
 }
 
 func (sm *DefaultSessionManager) DeleteSession(sessionID string) error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	session, exists := sm.sessions[sessionID]
+	entry, exists := sm.sessions[sessionID]
 	if !exists {
 		return fmt.Errorf("session with ID %s not found", sessionID)
 	}
 
-	session.Close()
+	entry.forks.drop()
+	entry.session.Close()
 	delete(sm.sessions, sessionID)
+	sm.ipResolver.Forget(sessionID)
 
 	return nil
 }
@@ -185,14 +351,61 @@ func (sm *DefaultSessionManager) CleanupSessions() error {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	for id, session := range sm.sessions {
-		session.Close()
+	for id, entry := range sm.sessions {
+		entry.forks.drop()
+		entry.session.Close()
 		delete(sm.sessions, id)
+		sm.ipResolver.Forget(id)
+	}
+
+	return nil
+}
+
+// ResetSession brings a session back to the config it was created with,
+// replacing it with a new session created from that config under the same
+// ID. Nothing of its use survives: cookies, proxy, headers, fingerprints,
+// history, TLS tickets, DNS cache and connections.
+func (sm *DefaultSessionManager) ResetSession(sessionID string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	old, exists := sm.sessions[sessionID]
+	if !exists {
+		return fmt.Errorf("session with ID %s not found", sessionID)
 	}
 
+	entry, err := sm.createEntry(old.config)
+	if err != nil {
+		return err
+	}
+
+	old.forks.drop()
+	old.session.Close()
+	sm.sessions[sessionID] = entry
+	sm.ipResolver.Forget(sessionID)
+
 	return nil
 }
 
+// applyHeaders sets the headers of a session config on the session
+func applyHeaders(session *azuretls.Session, config *common.SessionConfig) {
+	if len(config.OrderedHeaders) > 0 {
+		session.OrderedHeaders = make(azuretls.OrderedHeaders, len(config.OrderedHeaders))
+		for i, header := range config.OrderedHeaders {
+			session.OrderedHeaders[i] = slices.Clone(header)
+		}
+	}
+
+	if len(config.Headers) > 0 {
+		if session.Header == nil {
+			session.Header = make(fhttp.Header, len(config.Headers))
+		}
+		for k, v := range config.Headers {
+			session.Header.Set(k, v)
+		}
+	}
+}
+
 func (sm *DefaultSessionManager) CreateSessionWithConfig(sessionID string, config *common.SessionConfig) (*azuretls.Session, error) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
@@ -205,6 +418,74 @@ func (sm *DefaultSessionManager) CreateSessionWithConfig(sessionID string, confi
 		return nil, fmt.Errorf("session with ID %s already exists", sessionID)
 	}
 
+	entry, err := sm.createEntry(config)
+	if err != nil {
+		return nil, err
+	}
+
+	sm.sessions[sessionID] = entry
+	return entry.session, nil
+}
+
+// createEntry creates a session from its config, with sm.mu held
+func (sm *DefaultSessionManager) createEntry(config *common.SessionConfig) (*sessionEntry, error) {
+	if config != nil && config.DoT != nil && config.DoT.Address == "" {
+		return nil, fmt.Errorf("dot address required")
+	}
+	if config != nil && config.Dial != nil {
+		if err := validateDialConfig(*config.Dial); err != nil {
+			return nil, err
+		}
+	}
+	if config != nil && config.ProxyAuth != nil {
+		if err := validateProxyAuth(*config.ProxyAuth, config.Proxy); err != nil {
+			return nil, err
+		}
+	}
+	if config != nil && config.MaxConnectionAge != nil && config.MaxConnectionAge.Seconds < 0 {
+		return nil, fmt.Errorf("max_connection_age seconds must not be negative")
+	}
+	if config != nil && config.Bandwidth != nil {
+		if err := validateBandwidthConfig(*config.Bandwidth); err != nil {
+			return nil, err
+		}
+	}
+
+	var profile *common.Profile
+	if config != nil && config.Profile != "" {
+		if sm.profiles == nil {
+			return nil, fmt.Errorf("profile %s not found: no profile directory configured", config.Profile)
+		}
+
+		found, exists := sm.profiles.Get(config.Profile)
+		if !exists {
+			return nil, fmt.Errorf("profile %s not found", config.Profile)
+		}
+
+		merged := applyProfile(*config, found)
+		config, profile = &merged, &found
+	}
+
+	// Checked once merged, as profiles may tune QUIC too
+	if config != nil && config.QUIC != nil {
+		if err := validateQUICConfig(*config.QUIC); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only sessions asking for DNS over TLS refuse what resolves names
+	// outside it, the resolver of the server serving direct connections
+	resolver := sm.dnsResolver
+	if config != nil && config.DoT != nil {
+		if config.Proxy != "" {
+			return nil, fmt.Errorf("dot cannot be combined with a proxy, which resolves names outside DNS over TLS")
+		}
+		if config.QUIC != nil {
+			return nil, fmt.Errorf("dot cannot be combined with quic, HTTP/3 resolving names outside DNS over TLS")
+		}
+		resolver = newDoTResolver(*config.DoT)
+	}
+
 	session := azuretls.NewSession()
 
 	// Apply configuration if provided
@@ -217,6 +498,7 @@ func (sm *DefaultSessionManager) CreateSessionWithConfig(sessionID string, confi
 		}
 		if config.Proxy != "" {
 			if err := session.SetProxy(config.Proxy); err != nil {
+				session.Close()
 				return nil, fmt.Errorf("failed to set proxy: %w", err)
 			}
 		}
@@ -228,22 +510,201 @@ func (sm *DefaultSessionManager) CreateSessionWithConfig(sessionID string, confi
 		}
 		session.InsecureSkipVerify = config.InsecureSkipVerify
 
-		if len(config.OrderedHeaders) > 0 {
-			session.OrderedHeaders = make(azuretls.OrderedHeaders, len(config.OrderedHeaders))
-			for i, header := range config.OrderedHeaders {
-				session.OrderedHeaders[i] = header
-			}
+		applyHeaders(session, config)
+
+		if config.QUIC != nil {
+			applyQUICConfig(session, *config.QUIC)
+		}
+	}
+
+	if profile != nil {
+		if err := applyProfileFingerprints(session, *profile); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("failed to apply profile %s: %w", profile.Name, err)
 		}
+	}
+
+	entry := sm.newEntry(session, resolver, config)
+	if config != nil {
+		entry.tags = append([]string(nil), config.Tags...)
 
-		if len(config.Headers) > 0 {
-			for k, v := range config.Headers {
-				session.Header.Set(k, v)
+		// Enabled last, on top of the ClientHello of the profile
+		if config.TLSResumption {
+			entry.tickets = newTicketCache()
+			enableTLSResumption(session, entry.tickets)
+		}
+
+		if age := config.MaxConnectionAge; age != nil && age.Seconds > 0 {
+			var retired func(addr string)
+			if age.RenewTicket && entry.tickets != nil {
+				retired = entry.tickets.Forget
 			}
+			entry.conns.limitAge(time.Duration(age.Seconds)*time.Second, retired)
 		}
 	}
 
-	sm.sessions[sessionID] = session
-	return session, nil
+	return entry, nil
+}
+
+func (sm *DefaultSessionManager) GetDNSCache(sessionID string) ([]common.DNSCacheEntry, error) {
+	sm.mu.RLock()
+	entry, exists := sm.sessions[sessionID]
+	sm.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("session with ID %s not found", sessionID)
+	}
+
+	if entry.dnsCache == nil {
+		return nil, fmt.Errorf("DNS cache is disabled")
+	}
+
+	return entry.dnsCache.Entries(), nil
+}
+
+func (sm *DefaultSessionManager) FlushDNSCache(sessionID string) (int, error) {
+	sm.mu.RLock()
+	entry, exists := sm.sessions[sessionID]
+	sm.mu.RUnlock()
+
+	if !exists {
+		return 0, fmt.Errorf("session with ID %s not found", sessionID)
+	}
+
+	if entry.dnsCache == nil {
+		return 0, fmt.Errorf("DNS cache is disabled")
+	}
+
+	return entry.dnsCache.Flush(), nil
+}
+
+// ClearTLSTickets drops the TLS session tickets cached by a session, so
+// that its next connections perform full handshakes
+func (sm *DefaultSessionManager) ClearTLSTickets(sessionID string) (int, error) {
+	sm.mu.RLock()
+	entry, exists := sm.sessions[sessionID]
+	sm.mu.RUnlock()
+
+	if !exists {
+		return 0, fmt.Errorf("session with ID %s not found", sessionID)
+	}
+
+	if entry.tickets == nil {
+		return 0, common.ErrTLSResumptionDisabled
+	}
+
+	return entry.tickets.Clear(), nil
+}
+
+// GetSessionTags returns the tags the session was created with
+func (sm *DefaultSessionManager) GetSessionTags(sessionID string) ([]string, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	entry, exists := sm.sessions[sessionID]
+	if !exists {
+		return nil, fmt.Errorf("session with ID %s not found", sessionID)
+	}
+
+	return entry.tags, nil
+}
+
+// GetConnections returns the connections a session holds open
+func (sm *DefaultSessionManager) GetConnections(sessionID string) ([]common.SessionConnection, error) {
+	sm.mu.RLock()
+	entry, exists := sm.sessions[sessionID]
+	sm.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("session with ID %s not found", sessionID)
+	}
+
+	return entry.conns.List(), nil
+}
+
+// RecordRequest adds a request to the history of the session. Requests of
+// sessions without history, or deleted meanwhile, are dropped.
+func (sm *DefaultSessionManager) RecordRequest(sessionID string, req common.SentRequest) {
+	sm.mu.RLock()
+	entry, exists := sm.sessions[sessionID]
+	sm.mu.RUnlock()
+
+	if exists && entry.history != nil {
+		entry.history.add(req)
+	}
+}
+
+// GetRequestHistory returns the last requests of the session, newest first
+func (sm *DefaultSessionManager) GetRequestHistory(sessionID string) ([]common.SentRequest, error) {
+	sm.mu.RLock()
+	entry, exists := sm.sessions[sessionID]
+	sm.mu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("session with ID %s not found", sessionID)
+	}
+	if entry.history == nil {
+		return nil, common.ErrHistoryDisabled
+	}
+
+	return entry.history.list(), nil
+}
+
+// applyProfile fills the settings left unset by the configuration with the
+// profile's. Headers are merged, the configuration winning on conflicts.
+func applyProfile(config common.SessionConfig, profile common.Profile) common.SessionConfig {
+	if config.Browser == "" {
+		config.Browser = profile.Browser
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = profile.UserAgent
+	}
+	if len(config.OrderedHeaders) == 0 {
+		config.OrderedHeaders = profile.OrderedHeaders
+	}
+	if config.QUIC == nil {
+		config.QUIC = profile.QUIC
+	}
+	config.TLSResumption = config.TLSResumption || profile.TLSResumption
+
+	if len(profile.Headers) > 0 {
+		headers := make(map[string]string, len(profile.Headers)+len(config.Headers))
+		for k, v := range profile.Headers {
+			headers[k] = v
+		}
+		for k, v := range config.Headers {
+			headers[k] = v
+		}
+		config.Headers = headers
+	}
+
+	return config
+}
+
+func applyProfileFingerprints(session *azuretls.Session, profile common.Profile) error {
+	if profile.JA3 != "" {
+		navigator := profile.Navigator
+		if navigator == "" {
+			navigator = session.Browser
+		}
+		if err := session.ApplyJa3(profile.JA3, navigator); err != nil {
+			return fmt.Errorf("invalid JA3: %w", err)
+		}
+	}
+
+	if profile.HTTP2 != "" {
+		if err := session.ApplyHTTP2(profile.HTTP2); err != nil {
+			return fmt.Errorf("invalid HTTP/2 fingerprint: %w", err)
+		}
+	}
+
+	if profile.HTTP3 != "" {
+		if err := session.ApplyHTTP3(profile.HTTP3); err != nil {
+			return fmt.Errorf("invalid HTTP/3 fingerprint: %w", err)
+		}
+	}
+
+	return nil
 }
 
 // GenerateSessionID is deprecated, use common.GenerateSessionID instead
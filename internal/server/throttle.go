@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-client"
+)
+
+const (
+	// bandwidthBurst is the share of a second of traffic a limiter lets
+	// through at once
+	bandwidthBurst = 10
+
+	// minBandwidthChunk keeps low limits from moving a few bytes at a time
+	minBandwidthChunk = 512
+)
+
+// bandwidthLimiter is a token bucket of bytes, shared by the connections it
+// limits
+type bandwidthLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// newBandwidthLimiter returns a limiter of bytesPerSec, or nil for no limit
+func newBandwidthLimiter(bytesPerSec int64) *bandwidthLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+
+	burst := max(float64(bytesPerSec)/bandwidthBurst, minBandwidthChunk)
+	return &bandwidthLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n bytes from the bucket, returning how long to wait before
+// they may go
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// throttledConn moves its bytes at the pace of its limiters, in chunks no
+// larger than their bursts so that large writes and reads are spread out.
+// Waits end early when the connection is closed or its deadline passes.
+type throttledConn struct {
+	net.Conn
+	read  []*bandwidthLimiter
+	write []*bandwidthLimiter
+
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// throttle wraps the dial function of a session, which must be set, to
+// limit its connections to the bandwidth of the session and their egress
+// to the server-wide one, each being optional. HTTP/3 connections are not
+// limited.
+func throttle(session *azuretls.Session, config *common.BandwidthConfig, global *bandwidthLimiter) {
+	var read, write []*bandwidthLimiter
+	if config != nil {
+		if limiter := newBandwidthLimiter(config.DownloadBytesPerSec); limiter != nil {
+			read = append(read, limiter)
+		}
+		if limiter := newBandwidthLimiter(config.UploadBytesPerSec); limiter != nil {
+			write = append(write, limiter)
+		}
+	}
+	if global != nil {
+		write = append(write, global)
+	}
+	if len(read) == 0 && len(write) == 0 {
+		return
+	}
+
+	dial := session.Dial
+	session.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &throttledConn{Conn: conn, read: read, write: write, closed: make(chan struct{})}, nil
+	}
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if len(c.read) == 0 {
+		return c.Conn.Read(p)
+	}
+
+	n, err := c.Conn.Read(p[:min(len(p), chunkSize(c.read))])
+	if waitErr := c.wait(c.read, n, c.deadline(&c.readDeadline)); err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	if len(c.write) == 0 {
+		return c.Conn.Write(p)
+	}
+
+	chunk := chunkSize(c.write)
+	written := 0
+	for written < len(p) {
+		n := min(len(p)-written, chunk)
+		if err := c.wait(c.write, n, c.deadline(&c.writeDeadline)); err != nil {
+			return written, err
+		}
+
+		n, err := c.Conn.Write(p[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func chunkSize(limiters []*bandwidthLimiter) int {
+	chunk := limiters[0].burst
+	for _, limiter := range limiters[1:] {
+		chunk = min(chunk, limiter.burst)
+	}
+	return int(chunk)
+}
+
+func (c *throttledConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *throttledConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *throttledConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *throttledConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *throttledConn) deadline(t *time.Time) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return *t
+}
+
+// wait takes n bytes from every limiter, waiting as long as the slowest
+// one requires, unless the connection is closed or deadline passes first
+func (c *throttledConn) wait(limiters []*bandwidthLimiter, n int, deadline time.Time) error {
+	if n <= 0 {
+		return nil
+	}
+
+	var delay time.Duration
+	for _, limiter := range limiters {
+		delay = max(delay, limiter.reserve(n))
+	}
+	if delay <= 0 {
+		return nil
+	}
+
+	var expire <-chan time.Time
+	if !deadline.IsZero() {
+		deadlineTimer := time.NewTimer(time.Until(deadline))
+		defer deadlineTimer.Stop()
+		expire = deadlineTimer.C
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-expire:
+		return os.ErrDeadlineExceeded
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+func validateBandwidthConfig(config common.BandwidthConfig) error {
+	if config.UploadBytesPerSec < 0 || config.DownloadBytesPerSec < 0 {
+		return fmt.Errorf("bandwidth limits must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"net"
+	"sync"
+
+	"github.com/Noooste/azuretls-client"
+	tls "github.com/Noooste/utls"
+)
+
+// maxTickets bounds the number of servers a session keeps tickets for
+const maxTickets = 256
+
+// ticketCache holds the TLS session tickets of a session, one per server
+type ticketCache struct {
+	sessions map[string]*tls.ClientSessionState
+	mu       sync.Mutex
+}
+
+func newTicketCache() *ticketCache {
+	return &ticketCache{
+		sessions: make(map[string]*tls.ClientSessionState),
+	}
+}
+
+func (c *ticketCache) Get(key string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state, exists := c.sessions[key]
+	return state, exists
+}
+
+func (c *ticketCache) Put(key string, state *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if state == nil {
+		delete(c.sessions, key)
+		return
+	}
+
+	if _, exists := c.sessions[key]; !exists && len(c.sessions) >= maxTickets {
+		for evicted := range c.sessions {
+			delete(c.sessions, evicted)
+			break
+		}
+	}
+	c.sessions[key] = state
+}
+
+// Forget drops the ticket of the server at addr, keyed like crypto/tls by
+// its name
+func (c *ticketCache) Forget(addr string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	c.Put(host, nil)
+}
+
+// Clear drops every ticket and returns how many there were
+func (c *ticketCache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cleared := len(c.sessions)
+	c.sessions = make(map[string]*tls.ClientSessionState)
+	return cleared
+}
+
+// enableTLSResumption stores the tickets the servers issue and offers them
+// on new connections, through session tickets for TLS 1.2 and PSK for
+// TLS 1.3
+func enableTLSResumption(session *azuretls.Session, cache *ticketCache) {
+	modify := session.ModifyConfig
+
+	session.ModifyConfig = func(config *tls.Config) error {
+		if modify != nil {
+			if err := modify(config); err != nil {
+				return err
+			}
+		}
+
+		config.ClientSessionCache = cache
+		// Like browsers, only send pre_shared_key when there is a ticket
+		config.OmitEmptyPsk = true
+		return nil
+	}
+
+	offerPreSharedKey(session)
+}
+
+// offerPreSharedKey adds the pre_shared_key extension to the ClientHello
+// of the session. It must be called again when the spec is replaced, e.g.
+// by a JA3.
+func offerPreSharedKey(session *azuretls.Session) {
+	base := session.GetClientHelloSpec
+
+	session.GetClientHelloSpec = func() *tls.ClientHelloSpec {
+		var spec *tls.ClientHelloSpec
+		if base != nil {
+			spec = base()
+		} else {
+			spec = azuretls.GetBrowserClientHelloFunc(session.Browser)()
+		}
+
+		for _, extension := range spec.Extensions {
+			if _, ok := extension.(tls.PreSharedKeyExtension); ok {
+				return spec
+			}
+		}
+
+		// pre_shared_key must be the last extension (RFC 8446)
+		spec.Extensions = append(spec.Extensions, &tls.UtlsPreSharedKeyExtension{})
+		return spec
+	}
+}
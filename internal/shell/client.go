@@ -0,0 +1,172 @@
+package shell
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ws "github.com/Noooste/azuretls-api/internal/websocket"
+	"github.com/gorilla/websocket"
+)
+
+// Client sends messages to a server over its WebSocket API and waits for
+// their responses. Messages the server sends on its own, other than pings,
+// are handed to Notify.
+type Client struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+
+	pending map[string]chan *ws.WSMessage
+	nextID  int
+	mu      sync.Mutex
+
+	done chan struct{}
+	err  error
+
+	Notify func(message *ws.WSMessage)
+}
+
+// Dial connects to the WebSocket API of the server at baseURL, such as
+// http://localhost:8080
+func Dial(baseURL, apiKey string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return nil, fmt.Errorf("invalid server URL %q", baseURL)
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/ws"
+
+	header := http.Header{}
+	if apiKey != "" {
+		header.Set("X-API-Key", apiKey)
+	}
+
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, resp, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %s", u, resp.Status)
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %w", u, err)
+	}
+
+	c := &Client{
+		conn:    conn,
+		pending: make(map[string]chan *ws.WSMessage),
+		done:    make(chan struct{}),
+	}
+	go c.read()
+
+	return c, nil
+}
+
+// Call sends a message and decodes the payload of its response into result,
+// which may be nil. Error messages are returned as errors.
+func (c *Client) Call(msgType ws.WSMessageType, payload, result any) error {
+	message := &ws.WSMessage{Type: msgType}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		message.Payload = data
+	}
+
+	responses := make(chan *ws.WSMessage, 1)
+
+	c.mu.Lock()
+	c.nextID++
+	message.ID = "shell-" + strconv.Itoa(c.nextID)
+	c.pending[message.ID] = responses
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, message.ID)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(message); err != nil {
+		return err
+	}
+
+	select {
+	case response := <-responses:
+		if response.Type == ws.ErrorMessage {
+			var errResp struct {
+				Error string `json:"error"`
+			}
+			_ = json.Unmarshal(response.Payload, &errResp)
+			return errors.New(errResp.Error)
+		}
+		if result == nil || len(response.Payload) == 0 {
+			return nil
+		}
+		return json.Unmarshal(response.Payload, result)
+	case <-c.done:
+		return c.err
+	}
+}
+
+func (c *Client) Close() error {
+	c.writeMu.Lock()
+	_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.writeMu.Unlock()
+
+	return c.conn.Close()
+}
+
+func (c *Client) write(message *ws.WSMessage) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.conn.WriteJSON(message)
+}
+
+// read dispatches the messages of the server until the connection closes
+func (c *Client) read() {
+	defer close(c.done)
+
+	for {
+		var message ws.WSMessage
+		if err := c.conn.ReadJSON(&message); err != nil {
+			c.err = fmt.Errorf("connection closed: %w", err)
+			return
+		}
+
+		switch message.Type {
+		case ws.PingMessage:
+			// The server drops connections that stay silent
+			_ = c.write(&ws.WSMessage{Type: ws.PongMessage})
+			continue
+		case ws.ResponseMessage, ws.ErrorMessage:
+			c.mu.Lock()
+			responses, exists := c.pending[message.ID]
+			c.mu.Unlock()
+
+			if exists {
+				responses <- &message
+				continue
+			}
+		}
+
+		if c.Notify != nil {
+			c.Notify(&message)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package shell
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Completer returns the completions of the word ending the line
+type Completer func(line string) []string
+
+// Editor reads lines with history and tab completion when its input is a
+// terminal, and plainly otherwise
+type Editor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int
+	terminal *term.Terminal
+
+	Prompt   string
+	Complete Completer
+	History  []string
+}
+
+func NewEditor(in io.Reader, out io.Writer) *Editor {
+	e := &Editor{
+		in:  bufio.NewReader(in),
+		out: out,
+	}
+
+	if f, ok := in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		e.fd = int(f.Fd())
+		e.terminal = term.NewTerminal(struct {
+			io.Reader
+			io.Writer
+		}{f, out}, "")
+		e.terminal.History = editorHistory{e}
+		e.terminal.AutoCompleteCallback = e.autoComplete
+	}
+
+	return e
+}
+
+// Interactive tells whether the input is a terminal
+func (e *Editor) Interactive() bool {
+	return e.terminal != nil
+}
+
+// ReadLine reads a line, returning io.EOF at the end of the input, or when
+// Ctrl-C or Ctrl-D is pressed on a terminal
+func (e *Editor) ReadLine() (string, error) {
+	if e.terminal == nil {
+		line, err := e.in.ReadString('\n')
+		if err != nil && (line == "" || !errors.Is(err, io.EOF)) {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	state, err := term.MakeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = term.Restore(e.fd, state) }()
+
+	if width, height, err := term.GetSize(e.fd); err == nil && width > 0 {
+		_ = e.terminal.SetSize(width, height)
+	}
+	e.terminal.SetPrompt(e.Prompt)
+
+	line, err := e.terminal.ReadLine()
+	if errors.Is(err, term.ErrPasteIndicator) {
+		err = nil
+	}
+	if errors.Is(err, io.EOF) {
+		fmt.Fprint(e.out, "\r\n")
+	}
+	return line, err
+}
+
+// AddHistory appends a line to the history, skipping repeats, and tells
+// whether it was added
+func (e *Editor) AddHistory(line string) bool {
+	if line == "" || (len(e.History) > 0 && e.History[len(e.History)-1] == line) {
+		return false
+	}
+	e.History = append(e.History, line)
+	return true
+}
+
+// editorHistory browses the history of an editor from the terminal. The
+// lines read are left to AddHistory, once trimmed.
+type editorHistory struct {
+	e *Editor
+}
+
+func (h editorHistory) Add(string) {}
+
+func (h editorHistory) Len() int {
+	return len(h.e.History)
+}
+
+func (h editorHistory) At(i int) string {
+	return h.e.History[len(h.e.History)-1-i]
+}
+
+// autoComplete completes the word before the cursor on Tab, listing the
+// candidates when they share no longer prefix
+func (e *Editor) autoComplete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' || e.Complete == nil {
+		return "", 0, false
+	}
+
+	before, after := line[:pos], line[pos:]
+	word := before[strings.LastIndex(before, " ")+1:]
+
+	insert := func(completion string) (string, int, bool) {
+		return before + completion + after, pos + len(completion), true
+	}
+
+	candidates := e.Complete(before)
+	switch len(candidates) {
+	case 0:
+		return "", 0, false
+	case 1:
+		return insert(strings.TrimPrefix(candidates[0], word) + " ")
+	}
+
+	if prefix := commonPrefix(candidates); len(prefix) > len(word) {
+		return insert(strings.TrimPrefix(prefix, word))
+	}
+
+	// The terminal prints the prompt and line again below the candidates
+	_, _ = e.terminal.Write([]byte(strings.Join(candidates, "  ") + "\n"))
+	return "", 0, false
+}
+
+func commonPrefix(values []string) string {
+	prefix := values[0]
+	for _, value := range values[1:] {
+		for !strings.HasPrefix(value, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
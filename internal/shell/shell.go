@@ -0,0 +1,545 @@
+package shell
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	ws "github.com/Noooste/azuretls-api/internal/websocket"
+	"github.com/Noooste/azuretls-client"
+)
+
+const (
+	// DefaultFingerprintURL reports the fingerprints of its callers
+	DefaultFingerprintURL = "https://tls.peet.ws/api/all"
+
+	maxHistory  = 500
+	bodyPreview = 1024
+)
+
+var browsers = []string{azuretls.Chrome, azuretls.Firefox, azuretls.Opera, azuretls.Safari, azuretls.Edge, azuretls.Ios}
+
+// Config configures a shell
+type Config struct {
+	// FingerprintURL is requested by the fingerprint command
+	FingerprintURL string
+	// HistoryFile keeps the entered commands across shells, when set
+	HistoryFile string
+}
+
+type command struct {
+	name     string
+	usage    string
+	help     string
+	run      func(s *Shell, args []string) error
+	complete func(s *Shell) []string
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "help", help: "List the commands", run: (*Shell).help},
+		{name: "create", usage: "[browser]", help: "Create a new session, replacing the current one", run: (*Shell).create,
+			complete: func(*Shell) []string { return browsers }},
+		{name: "profiles", help: "List the profiles of the server", run: (*Shell).listProfiles},
+		{name: "profile", usage: "<name>", help: "Create a new session from a profile", run: (*Shell).profile,
+			complete: (*Shell).profileNames},
+		{name: "get", usage: "<url>", help: "Request a URL with the session", run: (*Shell).get,
+			complete: (*Shell).visitedURLs},
+		{name: "headers", help: "Show the headers of the last response", run: (*Shell).headers},
+		{name: "body", help: "Show the full body of the last response", run: (*Shell).body},
+		{name: "cookies", usage: "[url]", help: "Show the cookies the session sends to a URL, the last one by default", run: (*Shell).cookies,
+			complete: (*Shell).visitedURLs},
+		{name: "fingerprint", usage: "[url]", help: "Show the TLS and HTTP/2 fingerprints of the session", run: (*Shell).fingerprint},
+		{name: "exit", help: "Leave the shell"},
+	}
+}
+
+// Shell is an interactive prompt driving a session over the WebSocket API
+type Shell struct {
+	client *Client
+	config Config
+	out    io.Writer
+
+	sessionID string
+	last      *common.ServerResponse
+	visited   []string
+	profiles  []string
+
+	notifications []string
+	mu            sync.Mutex
+}
+
+func New(client *Client, config Config, out io.Writer) *Shell {
+	if config.FingerprintURL == "" {
+		config.FingerprintURL = DefaultFingerprintURL
+	}
+
+	s := &Shell{
+		client: client,
+		config: config,
+		out:    out,
+	}
+	client.Notify = s.notify
+
+	return s
+}
+
+// Run creates a session and executes the commands read from in until exit
+// or the end of the input
+func (s *Shell) Run(in io.Reader) error {
+	editor := NewEditor(in, s.out)
+	editor.Complete = s.Complete
+	editor.History = loadHistory(s.config.HistoryFile)
+
+	if err := s.create(nil); err != nil {
+		return err
+	}
+	s.profileNames()
+
+	if editor.Interactive() {
+		fmt.Fprintln(s.out, `Type "help" for the commands, Tab completes them`)
+	}
+
+	for {
+		s.flushNotifications()
+
+		editor.Prompt = s.prompt()
+		line, err := editor.ReadLine()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if editor.Interactive() && editor.AddHistory(line) {
+			appendHistory(s.config.HistoryFile, line)
+		}
+
+		fields := strings.Fields(line)
+		if fields[0] == "exit" || fields[0] == "quit" {
+			return nil
+		}
+		if err := s.Execute(fields[0], fields[1:]); err != nil {
+			fmt.Fprintf(s.out, "Error: %v\n", err)
+		}
+	}
+}
+
+// Execute runs a command
+func (s *Shell) Execute(name string, args []string) error {
+	for _, cmd := range commands {
+		if cmd.name == name && cmd.run != nil {
+			return cmd.run(s, args)
+		}
+	}
+	return fmt.Errorf("unknown command %q, type help for the commands", name)
+}
+
+// Complete returns the completions of the last word of a line: command
+// names for the first word, and the arguments of the command otherwise
+func (s *Shell) Complete(line string) []string {
+	fields := strings.Fields(line)
+	if strings.HasSuffix(line, " ") || len(fields) == 0 {
+		fields = append(fields, "")
+	}
+	word := fields[len(fields)-1]
+
+	var candidates []string
+	if len(fields) == 1 {
+		for _, cmd := range commands {
+			candidates = append(candidates, cmd.name)
+		}
+	} else if len(fields) == 2 {
+		for _, cmd := range commands {
+			if cmd.name == fields[0] && cmd.complete != nil {
+				candidates = cmd.complete(s)
+			}
+		}
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+func (s *Shell) prompt() string {
+	session := s.sessionID
+	if len(session) > 8 {
+		session = session[:8]
+	}
+	return fmt.Sprintf("azuretls (%s)> ", session)
+}
+
+// notify records the messages the server sends on its own, printed before
+// the next prompt
+func (s *Shell) notify(message *ws.WSMessage) {
+	var text string
+
+	switch message.Type {
+	case ws.KeepaliveFailedMsg:
+		var event common.KeepaliveEvent
+		_ = json.Unmarshal(message.Payload, &event)
+		text = fmt.Sprintf("Keepalive of %s failed: %s", event.URL, keepaliveFailure(event))
+	case ws.SessionRotatedMsg, ws.DownloadProgressMsg, ws.SessionMessage:
+		// Rotations are reported with the response of their request
+		return
+	default:
+		text = fmt.Sprintf("Server sent %s: %s", message.Type, message.Payload)
+	}
+
+	s.mu.Lock()
+	s.notifications = append(s.notifications, text)
+	s.mu.Unlock()
+}
+
+func (s *Shell) flushNotifications() {
+	s.mu.Lock()
+	notifications := s.notifications
+	s.notifications = nil
+	s.mu.Unlock()
+
+	for _, text := range notifications {
+		fmt.Fprintln(s.out, text)
+	}
+}
+
+func keepaliveFailure(event common.KeepaliveEvent) string {
+	if event.Error != "" {
+		return event.Error
+	}
+	return fmt.Sprintf("status %d", event.StatusCode)
+}
+
+func (s *Shell) help([]string) error {
+	tw := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "%s %s\t%s\n", cmd.name, cmd.usage, cmd.help)
+	}
+	return tw.Flush()
+}
+
+func (s *Shell) create(args []string) error {
+	var config common.SessionConfig
+	if len(args) > 0 {
+		config.Browser = args[0]
+	}
+	return s.newSession(config)
+}
+
+func (s *Shell) profile(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: profile <name>")
+	}
+	return s.newSession(common.SessionConfig{Profile: args[0]})
+}
+
+// newSession replaces the session of the shell, starting without cookies
+func (s *Shell) newSession(config common.SessionConfig) error {
+	var created struct {
+		SessionID string `json:"session_id"`
+	}
+	if err := s.client.Call(ws.CreateSessionMsg, config, &created); err != nil {
+		return err
+	}
+
+	s.sessionID = created.SessionID
+	s.last = nil
+
+	description := "default browser"
+	switch {
+	case config.Profile != "":
+		description = "profile " + config.Profile
+	case config.Browser != "":
+		description = config.Browser
+	}
+	fmt.Fprintf(s.out, "Session %s created (%s)\n", created.SessionID, description)
+	return nil
+}
+
+func (s *Shell) listProfiles([]string) error {
+	var result struct {
+		Profiles []common.Profile `json:"profiles"`
+	}
+	if err := s.client.Call(ws.ListProfilesMsg, nil, &result); err != nil {
+		return err
+	}
+
+	if len(result.Profiles) == 0 {
+		fmt.Fprintln(s.out, "No profiles")
+		return nil
+	}
+
+	s.profiles = s.profiles[:0]
+	tw := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+	for _, p := range result.Profiles {
+		s.profiles = append(s.profiles, p.Name)
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", p.Name, p.Browser, p.Description)
+	}
+	return tw.Flush()
+}
+
+// profileNames lists the profiles for completion, fetched once
+func (s *Shell) profileNames() []string {
+	if s.profiles != nil {
+		return s.profiles
+	}
+
+	var result struct {
+		Profiles []common.Profile `json:"profiles"`
+	}
+	if err := s.client.Call(ws.ListProfilesMsg, nil, &result); err != nil {
+		return nil
+	}
+
+	s.profiles = make([]string, 0, len(result.Profiles))
+	for _, p := range result.Profiles {
+		s.profiles = append(s.profiles, p.Name)
+	}
+	return s.profiles
+}
+
+func (s *Shell) visitedURLs() []string {
+	return s.visited
+}
+
+// request sends a GET request with the session, recording its cookies
+func (s *Shell) request(target string) (*common.ServerResponse, time.Duration, error) {
+	target = normalizeURL(target)
+
+	start := time.Now()
+	var resp common.ServerResponse
+	req := common.ServerRequest{
+		Method:  http.MethodGet,
+		URL:     target,
+		Options: common.RequestOptions{IncludeHeaders: true},
+	}
+	if err := s.client.Call(ws.RequestMessage, req, &resp); err != nil {
+		return nil, 0, err
+	}
+	elapsed := time.Since(start)
+
+	if rotation := resp.Rotation; rotation != nil {
+		s.sessionID = rotation.SessionID
+		fmt.Fprintf(s.out, "Session rotated (%s), now %s\n", rotation.Reason, rotation.SessionID)
+	}
+	return &resp, elapsed, nil
+}
+
+func (s *Shell) get(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: get <url>")
+	}
+
+	resp, elapsed, err := s.request(args[0])
+	if err != nil {
+		return err
+	}
+	s.last = resp
+
+	if !slices.Contains(s.visited, resp.URL) {
+		s.visited = append(s.visited, resp.URL)
+	}
+
+	fmt.Fprintf(s.out, "%s  %s  (%d bytes, %dms)\n", resp.Status, resp.URL, len(resp.Body), elapsed.Milliseconds())
+	if resp.RateLimit != nil && resp.RateLimit.Limited {
+		fmt.Fprintln(s.out, "Rate limited")
+	}
+
+	if body := strings.TrimRight(resp.Body, "\n"); body != "" {
+		if len(body) > bodyPreview {
+			body = body[:bodyPreview] + "\n... (body shows the full body)"
+		}
+		fmt.Fprintln(s.out, body)
+	}
+	return nil
+}
+
+func (s *Shell) headers([]string) error {
+	if s.last == nil {
+		return fmt.Errorf("no response yet")
+	}
+
+	names := make([]string, 0, len(s.last.Headers))
+	for name := range s.last.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(s.out, s.last.Status)
+	for _, name := range names {
+		for _, value := range s.last.Headers[name] {
+			fmt.Fprintf(s.out, "%s: %s\n", name, value)
+		}
+	}
+	return nil
+}
+
+func (s *Shell) body([]string) error {
+	if s.last == nil {
+		return fmt.Errorf("no response yet")
+	}
+
+	fmt.Fprintln(s.out, strings.TrimRight(s.last.Body, "\n"))
+	return nil
+}
+
+// cookies shows the cookies of the session jar for a URL, the last one
+// requested by default
+func (s *Shell) cookies(args []string) error {
+	var target string
+	switch {
+	case len(args) > 0:
+		target = normalizeURL(args[0])
+	case s.last != nil:
+		target = s.last.URL
+	default:
+		return fmt.Errorf("usage: cookies [url]")
+	}
+
+	var result struct {
+		Cookies []common.Cookie `json:"cookies"`
+	}
+	if err := s.client.Call(ws.GetCookiesMsg, map[string]string{"url": target}, &result); err != nil {
+		return err
+	}
+
+	if len(result.Cookies) == 0 {
+		fmt.Fprintf(s.out, "No cookies for %s\n", target)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+	for _, cookie := range result.Cookies {
+		fmt.Fprintf(tw, "%s\t%s\n", cookie.Name, cookie.Value)
+	}
+	return tw.Flush()
+}
+
+// fingerprint requests a fingerprint echo service, such as the echo-server
+// command, and shows the fingerprints it reports
+func (s *Shell) fingerprint(args []string) error {
+	target := s.config.FingerprintURL
+	if len(args) > 0 {
+		target = args[0]
+	}
+
+	resp, _, err := s.request(target)
+	if err != nil {
+		return err
+	}
+
+	// Echo services report the fingerprints in similar layouts, the ones of
+	// the echo-server command and tls.peet.ws being covered
+	var report struct {
+		HTTPVersion string `json:"http_version"`
+		Protocol    string `json:"protocol"`
+		TLS         struct {
+			JA3     string `json:"ja3"`
+			JA3Hash string `json:"ja3_hash"`
+			JA4     string `json:"ja4"`
+		} `json:"tls"`
+		HTTP2 struct {
+			Akamai     string `json:"akamai_fingerprint"`
+			AkamaiHash string `json:"akamai_fingerprint_hash"`
+		} `json:"http2"`
+		Akamai     string `json:"akamai_fingerprint"`
+		AkamaiHash string `json:"akamai_fingerprint_hash"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &report); err != nil || report.TLS.JA3 == "" {
+		fmt.Fprintf(s.out, "%s\n%s\n", resp.Status, resp.Body)
+		return nil
+	}
+
+	if report.Akamai == "" {
+		report.Akamai, report.AkamaiHash = report.HTTP2.Akamai, report.HTTP2.AkamaiHash
+	}
+	protocol := report.Protocol
+	if protocol == "" {
+		protocol = report.HTTPVersion
+	}
+
+	tw := tabwriter.NewWriter(s.out, 0, 0, 2, ' ', 0)
+	for _, row := range [][2]string{
+		{"Protocol", protocol},
+		{"JA3", report.TLS.JA3},
+		{"JA3 hash", report.TLS.JA3Hash},
+		{"JA4", report.TLS.JA4},
+		{"Akamai", report.Akamai},
+		{"Akamai hash", report.AkamaiHash},
+	} {
+		if row[1] != "" {
+			fmt.Fprintf(tw, "%s\t%s\n", row[0], row[1])
+		}
+	}
+	return tw.Flush()
+}
+
+func loadHistory(path string) []string {
+	if path == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var history []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			history = append(history, line)
+		}
+	}
+
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+	return history
+}
+
+func appendHistory(path, line string) {
+	if path == "" {
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	_, _ = fmt.Fprintln(f, line)
+}
+
+// normalizeURL defaults URLs typed without scheme to HTTPS
+func normalizeURL(target string) string {
+	if !strings.Contains(target, "://") {
+		return "https://" + target
+	}
+	return target
+}
@@ -0,0 +1,174 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/rules"
+	"github.com/Noooste/azuretls-client"
+)
+
+const (
+	awsAlgorithm       = "AWS4-HMAC-SHA256"
+	awsTimeFormat      = "20060102T150405Z"
+	awsDateFormat      = "20060102"
+	awsUnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+func validateAWS(options *common.AWSSigV4Options) error {
+	switch {
+	case options.AccessKeyID == "" || options.SecretAccessKey == "":
+		return fmt.Errorf("sign: aws access_key_id and secret_access_key required")
+	case options.Region == "" || options.Service == "":
+		return fmt.Errorf("sign: aws region and service required")
+	}
+	return nil
+}
+
+// signAWS signs a request with AWS Signature Version 4. The host, the
+// content type and every x-amz-* header are signed, the other headers being
+// left out as azuretls and proxies may change them.
+func signAWS(req *azuretls.Request, session *azuretls.Session, u *url.URL, options *common.AWSSigV4Options, now time.Time) error {
+	payloadHash := awsUnsignedPayload
+	if !options.UnsignedPayload {
+		b, err := body(req)
+		switch {
+		case errors.Is(err, ErrStreamedBody):
+		case err != nil:
+			return err
+		default:
+			payloadHash = sha256Hex(b)
+		}
+	}
+
+	now = now.UTC()
+	amzDate := now.Format(awsTimeFormat)
+	scope := strings.Join([]string{now.Format(awsDateFormat), options.Region, options.Service, "aws4_request"}, "/")
+
+	rules.SetHeader(req, session, "X-Amz-Date", amzDate)
+	if options.SessionToken != "" {
+		rules.SetHeader(req, session, "X-Amz-Security-Token", options.SessionToken)
+	}
+	// Like the AWS SDKs, only S3 is sent the payload hash
+	if options.Service == "s3" {
+		rules.SetHeader(req, session, "X-Amz-Content-Sha256", payloadHash)
+	}
+
+	signed := map[string]string{"host": u.Host}
+	for _, h := range rules.Headers(req, session) {
+		if len(h) < 2 {
+			continue
+		}
+		name := strings.ToLower(h[0])
+		if name != "content-type" && !strings.HasPrefix(name, "x-amz-") {
+			continue
+		}
+
+		value := strings.Join(strings.Fields(h[1]), " ")
+		if previous, exists := signed[name]; exists {
+			value = previous + "," + value
+		}
+		signed[name] = value
+	}
+
+	names := make([]string, 0, len(signed))
+	for name := range signed {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + signed[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		method(req),
+		awsCanonicalURI(u, options.Service),
+		awsCanonicalQuery(u),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{awsAlgorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := []byte("AWS4" + options.SecretAccessKey)
+	for _, part := range []string{now.Format(awsDateFormat), options.Region, options.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	rules.SetHeader(req, session, "Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsAlgorithm, options.AccessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+// awsCanonicalURI encodes the path once for S3 and twice for the other
+// services
+func awsCanonicalURI(u *url.URL, service string) string {
+	path := u.Path
+	if path == "" {
+		return "/"
+	}
+
+	path = awsEscape(path, false)
+	if service != "s3" {
+		path = awsEscape(path, false)
+	}
+	return path
+}
+
+func awsCanonicalQuery(u *url.URL) string {
+	query, _ := url.ParseQuery(u.RawQuery)
+
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var pairs []string
+	for _, key := range keys {
+		values := slices.Clone(query[key])
+		slices.Sort(values)
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(key, true)+"="+awsEscape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes every byte but the unreserved characters of
+// RFC 3986, and slashes unless encodeSlash is set
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,181 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/rules"
+	"github.com/Noooste/azuretls-client"
+)
+
+// placeholderPattern matches the {placeholders} of HMAC templates
+var placeholderPattern = regexp.MustCompile(`\{([a-z_0-9]+(?:\.[^{}]+)?)\}`)
+
+// placeholders lists the values HMAC templates may refer to, besides
+// {header.Name}
+var placeholders = map[string]bool{
+	"method":       true,
+	"url":          true,
+	"host":         true,
+	"path":         true,
+	"query":        true,
+	"body":         true,
+	"body_sha256":  true,
+	"timestamp":    true,
+	"timestamp_ms": true,
+	"date":         true,
+	"nonce":        true,
+}
+
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"":       sha256.New,
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"sha512": sha512.New,
+}
+
+func validateHMAC(options *common.HMACSignOptions) error {
+	if options.Key == "" && len(options.KeyB64) == 0 {
+		return fmt.Errorf("sign: hmac key or key_b64 required")
+	}
+	if options.StringToSign == "" {
+		return fmt.Errorf("sign: hmac string_to_sign required")
+	}
+	if (options.Header == "") == (options.Query == "") {
+		return fmt.Errorf("sign: exactly one of hmac header and query must be set")
+	}
+	if _, ok := hmacAlgorithms[options.Algorithm]; !ok {
+		return fmt.Errorf("sign: unknown hmac algorithm %q, expected sha256, sha1 or sha512", options.Algorithm)
+	}
+	if options.Encoding != "" && options.Encoding != "hex" && options.Encoding != "base64" {
+		return fmt.Errorf("sign: unknown hmac encoding %q, expected hex or base64", options.Encoding)
+	}
+	if options.HeaderValue != "" && !strings.Contains(options.HeaderValue, "{signature}") {
+		return fmt.Errorf("sign: hmac header_value must contain {signature}")
+	}
+
+	templates := []string{options.StringToSign}
+	for _, value := range options.Headers {
+		templates = append(templates, value)
+	}
+	for _, template := range templates {
+		if err := validateTemplate(template, false); err != nil {
+			return err
+		}
+	}
+	return validateTemplate(options.HeaderValue, true)
+}
+
+func validateTemplate(template string, signature bool) error {
+	for _, match := range placeholderPattern.FindAllStringSubmatch(template, -1) {
+		name := match[1]
+		if placeholders[name] || strings.HasPrefix(name, "header.") || (signature && name == "signature") {
+			continue
+		}
+		return fmt.Errorf("sign: unknown placeholder {%s}", name)
+	}
+	return nil
+}
+
+// signHMAC sets the headers of the recipe, then signs the string rendered
+// from the request and places the signature
+func signHMAC(req *azuretls.Request, session *azuretls.Session, u *url.URL, options *common.HMACSignOptions, now time.Time) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	values := map[string]string{
+		"method":       method(req),
+		"url":          req.Url,
+		"host":         u.Host,
+		"path":         u.EscapedPath(),
+		"query":        u.RawQuery,
+		"timestamp":    strconv.FormatInt(now.Unix(), 10),
+		"timestamp_ms": strconv.FormatInt(now.UnixMilli(), 10),
+		"date":         now.UTC().Format(time.RFC3339),
+		"nonce":        hex.EncodeToString(nonce),
+	}
+	if values["path"] == "" {
+		values["path"] = "/"
+	}
+
+	render := func(template string) (string, error) {
+		var err error
+		rendered := placeholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+			name := placeholder[1 : len(placeholder)-1]
+			if value, ok := values[name]; ok {
+				return value
+			}
+			if headerName, found := strings.CutPrefix(name, "header."); found {
+				return header(req, session, headerName)
+			}
+
+			// The body is only read when the template needs it
+			b, bodyErr := body(req)
+			if bodyErr != nil {
+				err = bodyErr
+				return ""
+			}
+			values["body"], values["body_sha256"] = string(b), sha256Hex(b)
+			return values[name]
+		})
+		return rendered, err
+	}
+
+	for name, template := range options.Headers {
+		value, err := render(template)
+		if err != nil {
+			return err
+		}
+		rules.SetHeader(req, session, name, value)
+	}
+
+	stringToSign, err := render(options.StringToSign)
+	if err != nil {
+		return err
+	}
+
+	key := []byte(options.Key)
+	if len(options.KeyB64) > 0 {
+		key = options.KeyB64
+	}
+	mac := hmac.New(hmacAlgorithms[options.Algorithm], key)
+	mac.Write([]byte(stringToSign))
+
+	signature := hex.EncodeToString(mac.Sum(nil))
+	if options.Encoding == "base64" {
+		signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	if options.Query != "" {
+		param := url.QueryEscape(options.Query) + "=" + url.QueryEscape(signature)
+		if u.RawQuery == "" {
+			u.RawQuery = param
+		} else {
+			u.RawQuery += "&" + param
+		}
+		req.Url = u.String()
+		return nil
+	}
+
+	value := signature
+	if options.HeaderValue != "" {
+		value = strings.ReplaceAll(options.HeaderValue, "{signature}", signature)
+	}
+	rules.SetHeader(req, session, options.Header, value)
+	return nil
+}
@@ -0,0 +1,119 @@
+// Package signing signs requests for APIs authenticating them with a
+// signature: AWS Signature Version 4, or an HMAC over a string built from
+// the request.
+package signing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/rules"
+	"github.com/Noooste/azuretls-client"
+)
+
+// ErrStreamedBody is returned when a signature covers a streamed body,
+// which is only read as it is sent
+var ErrStreamedBody = errors.New("the body of a streamed request cannot be signed")
+
+// Validate checks that exactly one signature is set, with what it needs
+func Validate(options *common.SignOptions) error {
+	if options == nil {
+		return nil
+	}
+
+	switch {
+	case options.AWS != nil && options.HMAC != nil:
+		return fmt.Errorf("sign: only one of aws and hmac can be set")
+	case options.AWS != nil:
+		return validateAWS(options.AWS)
+	case options.HMAC != nil:
+		return validateHMAC(options.HMAC)
+	default:
+		return fmt.Errorf("sign: one of aws or hmac must be set")
+	}
+}
+
+// Sign adds the signature of a request to its headers, or to its URL for
+// HMAC signatures placed in a query parameter. The session headers are
+// materialized into the request, as rules do, so that every header sent
+// can be signed.
+func Sign(req *azuretls.Request, session *azuretls.Session, options *common.SignOptions, now time.Time) error {
+	if options == nil {
+		return nil
+	}
+
+	u, err := url.Parse(req.Url)
+	if err != nil {
+		return fmt.Errorf("sign: invalid url: %w", err)
+	}
+
+	switch {
+	case options.AWS != nil:
+		return signAWS(req, session, u, options.AWS, now)
+	case options.HMAC != nil:
+		return signHMAC(req, session, u, options.HMAC, now)
+	}
+	return nil
+}
+
+// Secrets returns the headers and the query parameter carrying the
+// signature or credentials of signed requests, for them to be redacted
+func Secrets(options *common.SignOptions) (headers []string, query string) {
+	switch {
+	case options == nil:
+	case options.AWS != nil:
+		headers = []string{"Authorization", "X-Amz-Security-Token"}
+	case options.HMAC != nil && options.HMAC.Query != "":
+		query = options.HMAC.Query
+	case options.HMAC != nil:
+		headers = []string{options.HMAC.Header}
+	}
+	return headers, query
+}
+
+// body returns the body of a request, or ErrStreamedBody
+func body(req *azuretls.Request) ([]byte, error) {
+	switch b := req.Body.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []byte(b), nil
+	case []byte:
+		return b, nil
+	case io.Reader:
+		return nil, ErrStreamedBody
+	default:
+		return nil, fmt.Errorf("sign: unsupported body type %T", b)
+	}
+}
+
+// method returns the method of a request, azuretls sending GET by default
+func method(req *azuretls.Request) string {
+	if req.Method == "" {
+		return http.MethodGet
+	}
+	return strings.ToUpper(req.Method)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// header returns the value of a request header, session headers included
+func header(req *azuretls.Request, session *azuretls.Session, name string) string {
+	for _, h := range rules.Headers(req, session) {
+		if len(h) > 1 && strings.EqualFold(h[0], name) {
+			return h[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,191 @@
+package top
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+const (
+	// ClearScreen moves the cursor home and clears the terminal
+	ClearScreen = "\033[H\033[2J"
+
+	barWidth = 30
+)
+
+// Client polls the admin endpoints of a running server
+type Client struct {
+	BaseURL string
+	APIKey  string
+
+	HTTPClient *http.Client
+}
+
+// Snapshot is the state of the server at one poll
+type Snapshot struct {
+	Time     time.Time
+	Stats    common.AdminStats
+	Sessions []common.SessionInfo
+}
+
+// Fetch gets the current stats and sessions of the server
+func (c *Client) Fetch(ctx context.Context) (*Snapshot, error) {
+	snapshot := &Snapshot{Time: time.Now()}
+
+	if err := c.get(ctx, "/api/v1/admin/stats", &snapshot.Stats); err != nil {
+		return nil, err
+	}
+
+	var sessions struct {
+		Sessions []common.SessionInfo `json:"sessions"`
+	}
+	if err := c.get(ctx, "/api/v1/admin/sessions", &sessions); err != nil {
+		return nil, err
+	}
+	snapshot.Sessions = sessions.Sessions
+
+	return snapshot, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, target any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(c.BaseURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&errResp)
+		if errResp.Error == "" {
+			errResp.Error = resp.Status
+		}
+		return fmt.Errorf("%s: %s", path, errResp.Error)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(target)
+}
+
+// Render writes a screen describing cur. Throughputs are computed against
+// prev, and shown as "-" on the first poll or when the server restarted in
+// between. At most maxRows hosts and sessions are listed, 0 listing them all.
+func Render(w io.Writer, server string, prev, cur *Snapshot, maxRows int) {
+	stats := cur.Stats
+	requests := stats.Requests
+	if requests == nil {
+		requests = &common.RequestStats{}
+	}
+
+	var elapsed float64
+	var prevRequests *common.RequestStats
+	if prev != nil && prev.Stats.Requests != nil && prev.Stats.Requests.Requests <= requests.Requests {
+		elapsed = cur.Time.Sub(prev.Time).Seconds()
+		prevRequests = prev.Stats.Requests
+	}
+
+	throughput := func(current, previous uint64) string {
+		if prevRequests == nil || elapsed <= 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f", float64(current-previous)/elapsed)
+	}
+
+	fmt.Fprintf(w, "azuretls top - %s - %s\n\n", server, cur.Time.Format("15:04:05"))
+
+	fmt.Fprintf(w, "Sessions: %d", stats.Sessions)
+	if pool := stats.SessionPool; pool != nil {
+		fmt.Fprintf(w, " (pool %d idle / %d)", pool.Idle, pool.Size)
+	}
+	fmt.Fprintf(w, "   WebSocket connections: %d\n", stats.WebSocketConnections)
+
+	var prevTotal uint64
+	if prevRequests != nil {
+		prevTotal = prevRequests.Requests
+	}
+	fmt.Fprintf(w, "Requests: %d (%s/s)   Errors: %d (%s)\n",
+		requests.Requests, throughput(requests.Requests, prevTotal), requests.Errors, percent(requests.ErrorRate))
+
+	fmt.Fprintf(w, "Limiter:  %s %d/%d\n\n", bar(stats.Limiter.InFlight, stats.Limiter.Capacity), stats.Limiter.InFlight, stats.Limiter.Capacity)
+
+	previousHosts := make(map[string]uint64)
+	if prevRequests != nil {
+		for _, host := range prevRequests.Hosts {
+			previousHosts[host.Host] = host.Requests
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tREQUESTS\tREQ/S\tERRORS\tERROR%")
+	for _, host := range limit(requests.Hosts, maxRows) {
+		rate := "-"
+		if previous, ok := previousHosts[host.Host]; ok && previous <= host.Requests {
+			rate = throughput(host.Requests, previous)
+		} else if prevRequests != nil {
+			// The host was first seen since the previous poll
+			rate = throughput(host.Requests, 0)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%s\n", host.Host, host.Requests, rate, host.Errors, percent(host.ErrorRate))
+	}
+	if more := len(requests.Hosts) - maxRows; maxRows > 0 && more > 0 {
+		fmt.Fprintf(tw, "... %d more\t\t\t\t\n", more)
+	}
+	_ = tw.Flush()
+
+	fmt.Fprintln(w)
+
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION\tBROWSER\tPROXY\tTAGS")
+	for _, session := range limit(cur.Sessions, maxRows) {
+		id := session.ID
+		if session.Pooled {
+			id += " (pooled)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", id, session.Browser, session.Proxy, strings.Join(session.Tags, ","))
+	}
+	if more := len(cur.Sessions) - maxRows; maxRows > 0 && more > 0 {
+		fmt.Fprintf(tw, "... %d more\t\t\t\n", more)
+	}
+	_ = tw.Flush()
+}
+
+func limit[T any](items []T, maxRows int) []T {
+	if maxRows > 0 && len(items) > maxRows {
+		return items[:maxRows]
+	}
+	return items
+}
+
+func percent(rate float64) string {
+	return fmt.Sprintf("%.1f%%", rate*100)
+}
+
+// bar draws the saturation of the limiter
+func bar(used, capacity int) string {
+	filled := 0
+	if capacity > 0 {
+		filled = min(used*barWidth/capacity, barWidth)
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(" ", barWidth-filled) + "]"
+}
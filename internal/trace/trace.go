@@ -0,0 +1,203 @@
+package trace
+
+import (
+	"context"
+	nethttptrace "net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-client"
+	"github.com/Noooste/fhttp/httptrace"
+)
+
+type recorderKey struct{}
+
+// hop collects the events of one request of a redirect chain
+type hop struct {
+	start, end                 time.Time
+	dnsStart, dnsDone          time.Time
+	connectStart, connectDone  time.Time
+	gotConn, wroteRequest      time.Time
+	firstByte                  time.Time
+	reused                     bool
+	method, url, protocol, err string
+	statusCode                 int
+}
+
+// Recorder collects the timings of the requests sent with its context,
+// redirects included. Sessions must be set up with Install.
+type Recorder struct {
+	hops []*hop
+	// pending receives the events of the request in flight
+	pending *hop
+	mu      sync.Mutex
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// FromContext returns the recorder of a request context, or nil
+func FromContext(ctx context.Context) *Recorder {
+	recorder, _ := ctx.Value(recorderKey{}).(*Recorder)
+	return recorder
+}
+
+// WithContext returns a context recording the requests made with it
+func (r *Recorder) WithContext(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, recorderKey{}, r)
+
+	// net reports connections through the standard trace, and fhttp the
+	// rest of the request through its own
+	ctx = nethttptrace.WithClientTrace(ctx, &nethttptrace.ClientTrace{
+		DNSStart: func(nethttptrace.DNSStartInfo) { r.DNSStart() },
+		DNSDone:  func(nethttptrace.DNSDoneInfo) { r.DNSDone() },
+		ConnectStart: func(string, string) {
+			r.record(func(h *hop) {
+				if h.connectStart.IsZero() {
+					h.connectStart = time.Now()
+				}
+			})
+		},
+		ConnectDone: func(string, string, error) {
+			r.record(func(h *hop) { h.connectDone = time.Now() })
+		},
+	})
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			r.record(func(h *hop) {
+				h.gotConn = time.Now()
+				h.reused = info.Reused
+			})
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			r.record(func(h *hop) { h.wroteRequest = time.Now() })
+		},
+		GotFirstResponseByte: func() {
+			r.record(func(h *hop) { h.firstByte = time.Now() })
+		},
+	})
+}
+
+// DNSStart records the start of a name resolution, for resolvers not
+// reporting to the standard trace
+func (r *Recorder) DNSStart() {
+	r.record(func(h *hop) {
+		if h.dnsStart.IsZero() {
+			h.dnsStart = time.Now()
+		}
+	})
+}
+
+// DNSDone records the end of a name resolution
+func (r *Recorder) DNSDone() {
+	r.record(func(h *hop) { h.dnsDone = time.Now() })
+}
+
+func (r *Recorder) record(event func(*hop)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pending == nil {
+		r.pending = &hop{}
+	}
+	event(r.pending)
+}
+
+// finish closes the request in flight once its response is read
+func (r *Recorder) finish(ctx *azuretls.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h := r.pending
+	if h == nil {
+		h = &hop{}
+	}
+	r.pending = nil
+
+	h.start = ctx.RequestStartTime
+	h.end = time.Now()
+	h.method = ctx.Request.Method
+	h.url = ctx.Request.Url
+
+	if ctx.Response != nil && ctx.Response.HttpResponse != nil {
+		h.statusCode = ctx.Response.StatusCode
+		h.protocol = ctx.Response.HttpResponse.Proto
+	}
+	if ctx.Err != nil {
+		h.err = ctx.Err.Error()
+	}
+
+	r.hops = append(r.hops, h)
+}
+
+// Install makes a session report the end of each request, redirects
+// included, to the recorder of the request context
+func Install(session *azuretls.Session) {
+	callback := session.CallbackWithContext
+
+	session.CallbackWithContext = func(ctx *azuretls.Context) {
+		if callback != nil {
+			callback(ctx)
+		}
+
+		if ctx.Request == nil || ctx.Request.Context() == nil {
+			return
+		}
+		if recorder := FromContext(ctx.Request.Context()); recorder != nil {
+			recorder.finish(ctx)
+		}
+	}
+}
+
+// Result returns the timings of the requests recorded so far
+func (r *Recorder) Result() *common.RequestTrace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := &common.RequestTrace{Hops: make([]common.TraceHop, 0, len(r.hops))}
+	if len(r.hops) == 0 {
+		return result
+	}
+
+	origin := r.hops[0].start
+	for _, h := range r.hops {
+		traced := common.TraceHop{
+			Method:     h.method,
+			URL:        h.url,
+			StatusCode: h.statusCode,
+			Protocol:   h.protocol,
+			Error:      h.err,
+			Reused:     h.reused,
+			Start:      milliseconds(origin, h.start),
+			DNS:        milliseconds(h.dnsStart, h.dnsDone),
+			Connect:    milliseconds(h.connectStart, h.connectDone),
+			TTFB:       milliseconds(h.wroteRequest, h.firstByte),
+			Download:   milliseconds(h.firstByte, h.end),
+			Total:      milliseconds(h.start, h.end),
+		}
+
+		// azuretls performs the handshake while dialing, where fhttp cannot
+		// see it: it is what happens between the connection and its use
+		if !h.reused && strings.HasPrefix(h.url, "https://") {
+			traced.TLS = milliseconds(h.connectDone, h.gotConn)
+		}
+
+		result.Hops = append(result.Hops, traced)
+	}
+
+	result.Total = milliseconds(origin, r.hops[len(r.hops)-1].end)
+	return result
+}
+
+// milliseconds returns the duration between two events, 0 when one did not
+// happen
+func milliseconds(from, to time.Time) float64 {
+	if from.IsZero() || to.IsZero() || to.Before(from) {
+		return 0
+	}
+	return float64(to.Sub(from).Microseconds()) / 1000
+}
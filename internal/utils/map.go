@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"strings"
@@ -70,3 +71,42 @@ func (om *OrderedMap) UnmarshalJSON(data []byte) error {
 
 	return nil
 }
+
+// MarshalJSON writes the keys in their original order
+func (om OrderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	for i, key := range om.Keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+
+		encodedKey, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		encodedValue, err := json.Marshal(om.Values[key])
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		buf.Write(encodedValue)
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Set sets the value of a key, appended to the keys when new
+func (om *OrderedMap) Set(key string, value any) {
+	if om.Values == nil {
+		om.Values = make(map[string]any)
+	}
+	if _, exists := om.Values[key]; !exists {
+		om.Keys = append(om.Keys, key)
+	}
+	om.Values[key] = value
+}
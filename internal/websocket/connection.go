@@ -14,10 +14,10 @@ import (
 )
 
 const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512 * 1024 // 512KB
+	writeWait             = 10 * time.Second
+	pongWait              = 60 * time.Second
+	pingPeriod            = (pongWait * 9) / 10
+	defaultMaxMessageSize = 512 * 1024 // 512KB
 )
 
 type MessageHandler func(*WSConnection, *WSMessage) error
@@ -26,9 +26,17 @@ type ConnectionHandler struct {
 	connManager    *ConnectionManager
 	messageHandler MessageHandler
 	upgrader       websocket.Upgrader
+	maxMessageSize int64
 }
 
-func NewConnectionHandler(connManager *ConnectionManager, messageHandler MessageHandler) *ConnectionHandler {
+// NewConnectionHandler creates a connection handler closing the connections
+// sending messages larger than maxMessageSize bytes, 512KB when not
+// positive
+func NewConnectionHandler(connManager *ConnectionManager, messageHandler MessageHandler, maxMessageSize int64) *ConnectionHandler {
+	if maxMessageSize <= 0 {
+		maxMessageSize = defaultMaxMessageSize
+	}
+
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
@@ -41,6 +49,7 @@ func NewConnectionHandler(connManager *ConnectionManager, messageHandler Message
 		connManager:    connManager,
 		messageHandler: messageHandler,
 		upgrader:       upgrader,
+		maxMessageSize: maxMessageSize,
 	}
 }
 
@@ -67,7 +76,7 @@ func (h *ConnectionHandler) readPump(ctx context.Context, conn *WSConnection) {
 		_ = conn.Close()
 	}(conn)
 
-	conn.conn.SetReadLimit(maxMessageSize)
+	conn.conn.SetReadLimit(h.maxMessageSize)
 	_ = conn.conn.SetReadDeadline(time.Now().Add(pongWait))
 	conn.conn.SetPongHandler(func(string) error {
 		_ = conn.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -92,12 +101,25 @@ func (h *ConnectionHandler) readPump(ctx context.Context, conn *WSConnection) {
 			break
 		}
 
+		conn.messages.Add(1)
+		conn.touch()
+
 		if message.Type == PongMessage {
 			continue
 		}
 
 		if h.messageHandler != nil {
-			if err := h.messageHandler(conn, &message); err != nil {
+			if !h.connManager.beginMessage() {
+				_ = conn.SendError(message.ID, "server is shutting down")
+				continue
+			}
+
+			conn.inFlight.Add(1)
+			err := h.messageHandler(conn, &message)
+			conn.inFlight.Add(-1)
+			h.connManager.endMessage()
+
+			if err != nil {
 				log.Printf("Message handler error (session: %s): %v", conn.SessionID(), err)
 
 				errorMsg := WSMessage{
@@ -2,8 +2,12 @@ package websocket
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	http "net/http"
+	"time"
 
+	"github.com/Noooste/azuretls-api/internal/auth"
 	"github.com/Noooste/azuretls-api/internal/common"
 	"github.com/Noooste/azuretls-api/internal/controller"
 	"github.com/Noooste/azuretls-api/internal/protocol"
@@ -14,6 +18,7 @@ type WSHandler struct {
 	controller  *controller.SessionController
 	connManager *ConnectionManager
 	connHandler *ConnectionHandler
+	persisted   *persistedSessions
 	upgrader    websocket.Upgrader
 	jsonEncoder protocol.MessageEncoder
 }
@@ -22,7 +27,7 @@ func NewWSHandler(server common.Server) *WSHandler {
 	connManager := NewConnectionManager()
 
 	handler := &WSHandler{
-		controller:  controller.NewSessionController(server.GetSessionManager()),
+		controller:  controller.NewSessionController(server),
 		connManager: connManager,
 		jsonEncoder: protocol.GetJSONEncoder(),
 		upgrader: websocket.Upgrader{
@@ -34,11 +39,22 @@ func NewWSHandler(server common.Server) *WSHandler {
 		},
 	}
 
-	handler.connHandler = NewConnectionHandler(connManager, handler.handleMessage)
+	handler.connHandler = NewConnectionHandler(connManager, handler.handleMessage, server.GetConfig().WSMaxMessageSize)
+	handler.persisted = newPersistedSessions(server.GetConfig().WSPersistTTL, handler.controller.DeleteSession)
+
+	if keepalives := server.GetKeepaliveScheduler(); keepalives != nil {
+		keepalives.Subscribe(handler.notifyKeepaliveFailure)
+	}
+
 	return handler
 }
 
 func (h *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.connManager.Draining() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		common.LogError("WebSocket upgrade error: %v", err)
@@ -46,12 +62,24 @@ func (h *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	wsConn := NewWSConnection(conn, "")
+	wsConn.apiKey = auth.FromContext(r.Context())
+	wsConn.remoteAddr = r.RemoteAddr
 
-	ctx := r.Context()
+	// The request context is canceled once ServeHTTP returns, while the
+	// connection outlives it until closed
+	ctx := context.WithoutCancel(r.Context())
 	go func() {
 		defer func() {
 			if sessionID := wsConn.SessionID(); sessionID != "" {
-				_ = h.controller.DeleteSession(sessionID)
+				// Pooled sessions outlive the connection that acquired them
+				if h.controller.IsPooledSession(sessionID) {
+					_ = h.controller.ReleaseSession(sessionID, false)
+				} else if wsConn.Persist() {
+					common.LogDebug("WebSocket connection closed, keeping persisted session %s", sessionID)
+					h.persisted.leave(sessionID)
+				} else {
+					_ = h.controller.DeleteSession(sessionID)
+				}
 			}
 		}()
 
@@ -87,6 +115,30 @@ func (h *WSHandler) handleMessage(conn *WSConnection, message *WSMessage) error
 		return h.handleGetIP(conn, message)
 	case HealthMsg:
 		return h.handleHealth(conn, message)
+	case GetDNSCacheMsg:
+		return h.handleGetDNSCache(conn, message)
+	case FlushDNSCacheMsg:
+		return h.handleFlushDNSCache(conn, message)
+	case ClearTLSTicketsMsg:
+		return h.handleClearTLSTickets(conn, message)
+	case GetConnectionsMsg:
+		return h.handleGetConnections(conn, message)
+	case AcquireSessionMsg:
+		return h.handleAcquireSession(conn, message)
+	case ReleaseSessionMsg:
+		return h.handleReleaseSession(conn, message)
+	case ListProfilesMsg:
+		return h.handleListProfiles(conn, message)
+	case SetKeepaliveMsg:
+		return h.handleSetKeepalive(conn, message)
+	case ClearKeepaliveMsg:
+		return h.handleClearKeepalive(conn, message)
+	case GetCookiesMsg:
+		return h.handleGetCookies(conn, message)
+	case DetachSessionMsg:
+		return h.handleDetachSession(conn, message)
+	case AttachSessionMsg:
+		return h.handleAttachSession(conn, message)
 	default:
 		common.LogWarn("WebSocket: Unknown message type: %s", message.Type)
 		return conn.SendError(message.ID, "Unknown message type")
@@ -100,12 +152,34 @@ func (h *WSHandler) handleRequestMessage(conn *WSConnection, message *WSMessage)
 		return conn.SendError(message.ID, "Invalid request payload: "+err.Error())
 	}
 
+	if err := conn.apiKey.CheckRequestOptions(&serverReq.Options); err != nil {
+		return conn.SendError(message.ID, err.Error())
+	}
+
 	if message.ID != "" {
 		serverReq.ID = message.ID
 	}
 
+	if serverReq.Options.Download != nil {
+		serverReq.OnProgress = func(status common.DownloadStatus) {
+			if err := conn.SendMessage(DownloadProgressMsg, message.ID, status); err != nil {
+				common.LogDebug("WebSocket handleRequestMessage: Failed to send download progress: %v", err)
+			}
+		}
+	}
+
 	serverResp := h.controller.ExecuteRequest(conn.SessionID(), &serverReq)
 
+	// The connection follows its session when it is rotated
+	if rotation := serverResp.Rotation; rotation != nil {
+		conn.SetSessionID(rotation.SessionID)
+		h.connManager.UpdateSessionMapping(conn, rotation.PreviousSessionID, rotation.SessionID)
+
+		if err := conn.SendMessage(SessionRotatedMsg, message.ID, rotation); err != nil {
+			common.LogDebug("WebSocket handleRequestMessage: Failed to send session rotation: %v", err)
+		}
+	}
+
 	// If the response contains an error, send it as an error message
 	if serverResp.Error != "" {
 		common.LogError("WebSocket handleRequestMessage: Request failed for session %s: %s (URL: %s, Method: %s)",
@@ -128,33 +202,124 @@ func (h *WSHandler) GetConnectionManager() *ConnectionManager {
 	return h.connManager
 }
 
-func (h *WSHandler) CloseAllConnections() {
-	h.connManager.CloseAll()
+func (h *WSHandler) CloseAllConnections(notice CloseNotice, timeout time.Duration) {
+	h.connManager.CloseAll(notice, timeout)
 }
 
 func (h *WSHandler) handleCreateSession(conn *WSConnection, message *WSMessage) error {
-	var config common.SessionConfig
+	// persist keeps the session once the connection closes
+	var payload struct {
+		common.SessionConfig
+		Persist bool `json:"persist,omitempty"`
+	}
 	if len(message.Payload) > 0 {
-		if err := h.jsonEncoder.Decode(bytes.NewReader(message.Payload), &config); err != nil {
+		if err := h.jsonEncoder.Decode(bytes.NewReader(message.Payload), &payload); err != nil {
 			common.LogError("WebSocket handleCreateSession: Invalid session config: %v", err)
 			return conn.SendError(message.ID, "Invalid session config: "+err.Error())
 		}
 	}
 
-	sessionID, _, err := h.controller.CreateSession(&config)
+	sessionConfig := &payload.SessionConfig
+	if conn.apiKey != nil {
+		sessionConfig = conn.apiKey.SessionConfig(sessionConfig)
+	}
+
+	if jar := sessionConfig.CookieJar; jar != "" && !conn.apiKey.ReachesCookieJar(jar, h.controller) {
+		common.LogWarn("WebSocket handleCreateSession: Rejected access of API key %s to cookie jar %q", conn.apiKey.Name(), jar)
+		return conn.SendError(message.ID, "Failed to create session: "+common.ErrCookieJarNotFound.Error())
+	}
+
+	sessionID, _, err := h.controller.CreateSession(sessionConfig)
 	if err != nil {
 		common.LogError("WebSocket handleCreateSession: Failed to create session: %v", err)
 		return conn.SendError(message.ID, "Failed to create session: "+err.Error())
 	}
 
+	if conn.apiKey != nil {
+		h.controller.ClaimSession(sessionID, conn.apiKey.ID())
+	}
+
 	oldSessionID := conn.SessionID()
 	conn.SetSessionID(sessionID)
+	conn.SetPersist(payload.Persist)
 	h.connManager.UpdateSessionMapping(conn, oldSessionID, sessionID)
 
-	response := map[string]string{
+	response := map[string]any{
 		"session_id": sessionID,
 		"status":     "created",
 	}
+	if payload.Persist {
+		response["persist"] = true
+	}
+
+	return conn.SendResponse(message.ID, response)
+}
+
+// handleDetachSession unbinds the session from the connection without
+// deleting it, for REST consumers or another connection to take over
+func (h *WSHandler) handleDetachSession(conn *WSConnection, message *WSMessage) error {
+	sessionID := conn.SessionID()
+	if sessionID == "" {
+		common.LogWarn("WebSocket handleDetachSession: No active session")
+		return conn.SendError(message.ID, "No active session")
+	}
+
+	if h.controller.IsPooledSession(sessionID) {
+		return conn.SendError(message.ID, "Pooled sessions are released with release_session")
+	}
+
+	conn.SetSessionID("")
+	conn.SetPersist(false)
+	h.connManager.UpdateSessionMapping(conn, sessionID, "")
+	h.persisted.leave(sessionID)
+
+	response := map[string]string{
+		"session_id": sessionID,
+		"status":     "detached",
+	}
+
+	return conn.SendResponse(message.ID, response)
+}
+
+// handleAttachSession binds the connection to an existing session, e.g.
+// one persisted by a previous connection or created over REST. The session
+// outlives the connection.
+func (h *WSHandler) handleAttachSession(conn *WSConnection, message *WSMessage) error {
+	var payload struct {
+		SessionID string `json:"session_id"`
+	}
+	if err := h.jsonEncoder.Decode(bytes.NewReader(message.Payload), &payload); err != nil {
+		common.LogError("WebSocket handleAttachSession: Invalid attach payload: %v", err)
+		return conn.SendError(message.ID, "Invalid attach payload: "+err.Error())
+	}
+
+	// The sessions of other API keys are reported as not found
+	_, err := h.controller.GetSession(payload.SessionID)
+	if err == nil && conn.apiKey != nil && !conn.apiKey.Admin() && !h.controller.OwnsSession(conn.apiKey.ID(), payload.SessionID) {
+		err = errors.New("session not found")
+	}
+	if err != nil {
+		common.LogWarn("WebSocket handleAttachSession: Failed to attach session %s: %v", payload.SessionID, err)
+		return conn.SendError(message.ID, "Failed to attach session: "+err.Error())
+	}
+	if h.controller.IsPooledSession(payload.SessionID) {
+		return conn.SendError(message.ID, "Pooled sessions are acquired with acquire_session")
+	}
+
+	oldSessionID := conn.SessionID()
+	if oldSessionID != "" && oldSessionID != payload.SessionID {
+		return conn.SendError(message.ID, "Connection already has a session, detach or delete it first")
+	}
+
+	h.persisted.take(payload.SessionID)
+	conn.SetSessionID(payload.SessionID)
+	conn.SetPersist(true)
+	h.connManager.UpdateSessionMapping(conn, oldSessionID, payload.SessionID)
+
+	response := map[string]string{
+		"session_id": payload.SessionID,
+		"status":     "attached",
+	}
 
 	return conn.SendResponse(message.ID, response)
 }
@@ -173,6 +338,7 @@ func (h *WSHandler) handleDeleteSession(conn *WSConnection, message *WSMessage)
 
 	oldSessionID := conn.SessionID()
 	conn.SetSessionID("")
+	conn.SetPersist(false)
 	h.connManager.UpdateSessionMapping(conn, oldSessionID, "")
 
 	return conn.SendSuccess(message.ID)
@@ -185,6 +351,10 @@ func (h *WSHandler) handleApplyJA3(conn *WSConnection, message *WSMessage) error
 		return conn.SendError(message.ID, "No active session")
 	}
 
+	if err := conn.apiKey.CheckSessionChange(); err != nil {
+		return conn.SendError(message.ID, err.Error())
+	}
+
 	var payload struct {
 		JA3       string `json:"ja3"`
 		Navigator string `json:"navigator,omitempty"`
@@ -210,6 +380,10 @@ func (h *WSHandler) handleApplyHTTP2(conn *WSConnection, message *WSMessage) err
 		return conn.SendError(message.ID, "No active session")
 	}
 
+	if err := conn.apiKey.CheckSessionChange(); err != nil {
+		return conn.SendError(message.ID, err.Error())
+	}
+
 	var payload struct {
 		Fingerprint string `json:"fingerprint"`
 	}
@@ -234,6 +408,10 @@ func (h *WSHandler) handleApplyHTTP3(conn *WSConnection, message *WSMessage) err
 		return conn.SendError(message.ID, "No active session")
 	}
 
+	if err := conn.apiKey.CheckSessionChange(); err != nil {
+		return conn.SendError(message.ID, err.Error())
+	}
+
 	var payload struct {
 		Fingerprint string `json:"fingerprint"`
 	}
@@ -258,6 +436,10 @@ func (h *WSHandler) handleSetProxy(conn *WSConnection, message *WSMessage) error
 		return conn.SendError(message.ID, "No active session")
 	}
 
+	if err := conn.apiKey.CheckSessionChange(); err != nil {
+		return conn.SendError(message.ID, err.Error())
+	}
+
 	var payload struct {
 		Proxy string `json:"proxy"`
 	}
@@ -282,6 +464,10 @@ func (h *WSHandler) handleClearProxy(conn *WSConnection, message *WSMessage) err
 		return conn.SendError(message.ID, "No active session")
 	}
 
+	if err := conn.apiKey.CheckSessionChange(); err != nil {
+		return conn.SendError(message.ID, err.Error())
+	}
+
 	if err := h.controller.ClearProxy(sessionID); err != nil {
 		common.LogError("WebSocket handleClearProxy: Failed to clear proxy for session %s: %v", sessionID, err)
 		return conn.SendError(message.ID, "Failed to clear proxy: "+err.Error())
@@ -290,6 +476,56 @@ func (h *WSHandler) handleClearProxy(conn *WSConnection, message *WSMessage) err
 	return conn.SendSuccess(message.ID)
 }
 
+func (h *WSHandler) handleSetKeepalive(conn *WSConnection, message *WSMessage) error {
+	sessionID := conn.SessionID()
+	if sessionID == "" {
+		common.LogWarn("WebSocket handleSetKeepalive: No active session")
+		return conn.SendError(message.ID, "No active session")
+	}
+
+	var config common.KeepaliveConfig
+	if err := h.jsonEncoder.Decode(bytes.NewReader(message.Payload), &config); err != nil {
+		common.LogError("WebSocket handleSetKeepalive: Invalid keepalive payload for session %s: %v", sessionID, err)
+		return conn.SendError(message.ID, "Invalid keepalive payload: "+err.Error())
+	}
+
+	status, err := h.controller.SetKeepalive(sessionID, config)
+	if err != nil {
+		common.LogError("WebSocket handleSetKeepalive: Failed to set keepalive for session %s: %v", sessionID, err)
+		return conn.SendError(message.ID, "Failed to set keepalive: "+err.Error())
+	}
+
+	return conn.SendResponse(message.ID, status)
+}
+
+func (h *WSHandler) handleClearKeepalive(conn *WSConnection, message *WSMessage) error {
+	sessionID := conn.SessionID()
+	if sessionID == "" {
+		common.LogWarn("WebSocket handleClearKeepalive: No active session")
+		return conn.SendError(message.ID, "No active session")
+	}
+
+	if err := h.controller.DeleteKeepalive(sessionID); err != nil {
+		common.LogError("WebSocket handleClearKeepalive: Failed to clear keepalive for session %s: %v", sessionID, err)
+		return conn.SendError(message.ID, "Failed to clear keepalive: "+err.Error())
+	}
+
+	return conn.SendSuccess(message.ID)
+}
+
+// notifyKeepaliveFailure sends a failed keepalive to the connection bound to
+// its session, if any
+func (h *WSHandler) notifyKeepaliveFailure(event common.KeepaliveEvent) {
+	conn, exists := h.connManager.GetConnectionBySession(event.SessionID)
+	if !exists {
+		return
+	}
+
+	if err := conn.SendMessage(KeepaliveFailedMsg, "", event); err != nil {
+		common.LogDebug("WebSocket: Failed to send keepalive failure: %v", err)
+	}
+}
+
 func (h *WSHandler) handleAddPins(conn *WSConnection, message *WSMessage) error {
 	sessionID := conn.SessionID()
 	if sessionID == "" {
@@ -346,14 +582,38 @@ func (h *WSHandler) handleGetIP(conn *WSConnection, message *WSMessage) error {
 		return conn.SendError(message.ID, "No active session")
 	}
 
-	ip, err := h.controller.GetIP(sessionID)
+	info, err := h.controller.GetIP(sessionID)
 	if err != nil {
 		common.LogError("WebSocket handleGetIP: Failed to get IP for session %s: %v", sessionID, err)
 		return conn.SendError(message.ID, "Failed to get IP: "+err.Error())
 	}
 
-	response := map[string]string{
-		"ip": ip,
+	return conn.SendResponse(message.ID, info)
+}
+
+func (h *WSHandler) handleGetCookies(conn *WSConnection, message *WSMessage) error {
+	sessionID := conn.SessionID()
+	if sessionID == "" {
+		common.LogWarn("WebSocket handleGetCookies: No active session")
+		return conn.SendError(message.ID, "No active session")
+	}
+
+	var payload struct {
+		URL string `json:"url"`
+	}
+	if err := h.jsonEncoder.Decode(bytes.NewReader(message.Payload), &payload); err != nil {
+		common.LogError("WebSocket handleGetCookies: Invalid cookies payload for session %s: %v", sessionID, err)
+		return conn.SendError(message.ID, "Invalid cookies payload: "+err.Error())
+	}
+
+	cookies, err := h.controller.GetCookies(sessionID, payload.URL)
+	if err != nil {
+		common.LogWarn("WebSocket handleGetCookies: Failed to get cookies for session %s: %v", sessionID, err)
+		return conn.SendError(message.ID, "Failed to get cookies: "+err.Error())
+	}
+
+	response := map[string]any{
+		"cookies": cookies,
 	}
 
 	return conn.SendResponse(message.ID, response)
@@ -363,3 +623,164 @@ func (h *WSHandler) handleHealth(conn *WSConnection, message *WSMessage) error {
 	response := h.controller.GetHealthInfo()
 	return conn.SendResponse(message.ID, response)
 }
+
+func (h *WSHandler) handleGetDNSCache(conn *WSConnection, message *WSMessage) error {
+	sessionID := conn.SessionID()
+	if sessionID == "" {
+		common.LogWarn("WebSocket handleGetDNSCache: No active session")
+		return conn.SendError(message.ID, "No active session")
+	}
+
+	entries, err := h.controller.GetDNSCache(sessionID)
+	if err != nil {
+		common.LogError("WebSocket handleGetDNSCache: Failed to get DNS cache for session %s: %v", sessionID, err)
+		return conn.SendError(message.ID, "Failed to get DNS cache: "+err.Error())
+	}
+
+	response := map[string]any{
+		"entries": entries,
+	}
+
+	return conn.SendResponse(message.ID, response)
+}
+
+func (h *WSHandler) handleFlushDNSCache(conn *WSConnection, message *WSMessage) error {
+	sessionID := conn.SessionID()
+	if sessionID == "" {
+		common.LogWarn("WebSocket handleFlushDNSCache: No active session")
+		return conn.SendError(message.ID, "No active session")
+	}
+
+	flushed, err := h.controller.FlushDNSCache(sessionID)
+	if err != nil {
+		common.LogError("WebSocket handleFlushDNSCache: Failed to flush DNS cache for session %s: %v", sessionID, err)
+		return conn.SendError(message.ID, "Failed to flush DNS cache: "+err.Error())
+	}
+
+	response := map[string]any{
+		"status":  "success",
+		"flushed": flushed,
+	}
+
+	return conn.SendResponse(message.ID, response)
+}
+
+func (h *WSHandler) handleClearTLSTickets(conn *WSConnection, message *WSMessage) error {
+	sessionID := conn.SessionID()
+	if sessionID == "" {
+		common.LogWarn("WebSocket handleClearTLSTickets: No active session")
+		return conn.SendError(message.ID, "No active session")
+	}
+
+	cleared, err := h.controller.ClearTLSTickets(sessionID)
+	if err != nil {
+		common.LogError("WebSocket handleClearTLSTickets: Failed to clear TLS tickets for session %s: %v", sessionID, err)
+		return conn.SendError(message.ID, "Failed to clear TLS tickets: "+err.Error())
+	}
+
+	response := map[string]any{
+		"status":  "success",
+		"cleared": cleared,
+	}
+
+	return conn.SendResponse(message.ID, response)
+}
+
+func (h *WSHandler) handleGetConnections(conn *WSConnection, message *WSMessage) error {
+	sessionID := conn.SessionID()
+	if sessionID == "" {
+		common.LogWarn("WebSocket handleGetConnections: No active session")
+		return conn.SendError(message.ID, "No active session")
+	}
+
+	connections, err := h.controller.GetConnections(sessionID)
+	if err != nil {
+		common.LogError("WebSocket handleGetConnections: Failed to get connections for session %s: %v", sessionID, err)
+		return conn.SendError(message.ID, "Failed to get connections: "+err.Error())
+	}
+
+	response := map[string]any{
+		"connections": connections,
+	}
+
+	return conn.SendResponse(message.ID, response)
+}
+
+func (h *WSHandler) handleAcquireSession(conn *WSConnection, message *WSMessage) error {
+	// Pooled sessions are created without the defaults of the key
+	if err := conn.apiKey.CheckSessionChange(); err != nil {
+		return conn.SendError(message.ID, err.Error())
+	}
+
+	sessionID, err := h.controller.AcquireSession()
+	if err != nil {
+		common.LogWarn("WebSocket handleAcquireSession: Failed to acquire session: %v", err)
+		return conn.SendError(message.ID, "Failed to acquire session: "+err.Error())
+	}
+
+	if conn.apiKey != nil {
+		h.controller.ClaimSession(sessionID, conn.apiKey.ID())
+	}
+
+	oldSessionID := conn.SessionID()
+	if h.controller.IsPooledSession(oldSessionID) {
+		if err := h.controller.ReleaseSession(oldSessionID, false); err != nil {
+			common.LogWarn("WebSocket handleAcquireSession: Failed to release previous session %s: %v", oldSessionID, err)
+		}
+	}
+
+	conn.SetSessionID(sessionID)
+	conn.SetPersist(false)
+	h.connManager.UpdateSessionMapping(conn, oldSessionID, sessionID)
+
+	response := map[string]any{
+		"session_id": sessionID,
+		"status":     "acquired",
+		"pool":       h.controller.PoolStats(),
+	}
+
+	return conn.SendResponse(message.ID, response)
+}
+
+func (h *WSHandler) handleReleaseSession(conn *WSConnection, message *WSMessage) error {
+	sessionID := conn.SessionID()
+	if sessionID == "" {
+		common.LogWarn("WebSocket handleReleaseSession: No active session")
+		return conn.SendError(message.ID, "No active session")
+	}
+
+	var payload struct {
+		Discard bool `json:"discard,omitempty"`
+	}
+
+	if len(message.Payload) > 0 {
+		if err := h.jsonEncoder.Decode(bytes.NewReader(message.Payload), &payload); err != nil {
+			common.LogError("WebSocket handleReleaseSession: Invalid release payload for session %s: %v", sessionID, err)
+			return conn.SendError(message.ID, "Invalid release payload: "+err.Error())
+		}
+	}
+
+	if err := h.controller.ReleaseSession(sessionID, payload.Discard); err != nil {
+		common.LogError("WebSocket handleReleaseSession: Failed to release session %s: %v", sessionID, err)
+		return conn.SendError(message.ID, "Failed to release session: "+err.Error())
+	}
+
+	conn.SetSessionID("")
+	h.connManager.UpdateSessionMapping(conn, sessionID, "")
+
+	return conn.SendSuccess(message.ID)
+}
+
+func (h *WSHandler) handleListProfiles(conn *WSConnection, message *WSMessage) error {
+	profiles, err := h.controller.ListProfiles()
+	if err != nil {
+		common.LogWarn("WebSocket handleListProfiles: Failed to list profiles: %v", err)
+		return conn.SendError(message.ID, "Failed to list profiles: "+err.Error())
+	}
+
+	response := map[string]any{
+		"profiles": profiles,
+	}
+
+	return conn.SendResponse(message.ID, response)
+}
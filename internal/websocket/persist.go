@@ -0,0 +1,75 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+// defaultPersistTTL is how long persisted sessions are kept without a
+// connection when the config sets no TTL
+const defaultPersistTTL = time.Hour
+
+// persistedSessions deletes the persisted sessions left without a
+// connection once their TTL elapses, unless a connection attaches them
+// again
+type persistedSessions struct {
+	ttl    time.Duration
+	delete func(sessionID string) error
+
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+func newPersistedSessions(ttl time.Duration, delete func(sessionID string) error) *persistedSessions {
+	if ttl <= 0 {
+		ttl = defaultPersistTTL
+	}
+
+	return &persistedSessions{
+		ttl:    ttl,
+		delete: delete,
+		timers: make(map[string]*time.Timer),
+	}
+}
+
+// leave starts the TTL of a session no connection holds anymore
+func (p *persistedSessions) leave(sessionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if timer, exists := p.timers[sessionID]; exists {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(p.ttl, func() {
+		p.mu.Lock()
+		// The session was attached, or left again, meanwhile
+		if p.timers[sessionID] != timer {
+			p.mu.Unlock()
+			return
+		}
+		delete(p.timers, sessionID)
+		p.mu.Unlock()
+
+		if err := p.delete(sessionID); err != nil {
+			common.LogDebug("Persisted session %s already gone on expiry: %v", sessionID, err)
+			return
+		}
+		common.LogInfo("Deleted persisted session %s, left without a connection for %s", sessionID, p.ttl)
+	})
+	p.timers[sessionID] = timer
+}
+
+// take stops the TTL of a session a connection attached
+func (p *persistedSessions) take(sessionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if timer, exists := p.timers[sessionID]; exists {
+		timer.Stop()
+		delete(p.timers, sessionID)
+	}
+}
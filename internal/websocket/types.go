@@ -2,34 +2,61 @@ package websocket
 
 import (
 	"encoding/json"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Noooste/azuretls-api/internal/auth"
+	"github.com/Noooste/azuretls-api/internal/common"
 	"github.com/gorilla/websocket"
 )
 
 type WSMessageType string
 
 const (
-	RequestMessage   WSMessageType = "request"
-	ResponseMessage  WSMessageType = "response"
-	ErrorMessage     WSMessageType = "error"
-	PingMessage      WSMessageType = "ping"
-	PongMessage      WSMessageType = "pong"
-	SessionMessage   WSMessageType = "session"
-	CreateSessionMsg WSMessageType = "create_session"
-	DeleteSessionMsg WSMessageType = "delete_session"
-	ApplyJA3Msg      WSMessageType = "apply_ja3"
-	ApplyHTTP2Msg    WSMessageType = "apply_http2"
-	ApplyHTTP3Msg    WSMessageType = "apply_http3"
-	SetProxyMsg      WSMessageType = "set_proxy"
-	ClearProxyMsg    WSMessageType = "clear_proxy"
-	AddPinsMsg       WSMessageType = "add_pins"
-	ClearPinsMsg     WSMessageType = "clear_pins"
-	GetIPMsg         WSMessageType = "get_ip"
-	HealthMsg        WSMessageType = "health"
+	RequestMessage      WSMessageType = "request"
+	ResponseMessage     WSMessageType = "response"
+	ErrorMessage        WSMessageType = "error"
+	PingMessage         WSMessageType = "ping"
+	PongMessage         WSMessageType = "pong"
+	SessionMessage      WSMessageType = "session"
+	CreateSessionMsg    WSMessageType = "create_session"
+	DeleteSessionMsg    WSMessageType = "delete_session"
+	ApplyJA3Msg         WSMessageType = "apply_ja3"
+	ApplyHTTP2Msg       WSMessageType = "apply_http2"
+	ApplyHTTP3Msg       WSMessageType = "apply_http3"
+	SetProxyMsg         WSMessageType = "set_proxy"
+	ClearProxyMsg       WSMessageType = "clear_proxy"
+	AddPinsMsg          WSMessageType = "add_pins"
+	ClearPinsMsg        WSMessageType = "clear_pins"
+	GetIPMsg            WSMessageType = "get_ip"
+	HealthMsg           WSMessageType = "health"
+	GetDNSCacheMsg      WSMessageType = "get_dns_cache"
+	FlushDNSCacheMsg    WSMessageType = "flush_dns_cache"
+	ClearTLSTicketsMsg  WSMessageType = "clear_tls_tickets"
+	GetConnectionsMsg   WSMessageType = "get_connections"
+	AcquireSessionMsg   WSMessageType = "acquire_session"
+	ReleaseSessionMsg   WSMessageType = "release_session"
+	ListProfilesMsg     WSMessageType = "list_profiles"
+	DownloadProgressMsg WSMessageType = "download_progress"
+	SessionRotatedMsg   WSMessageType = "session_rotated"
+	SetKeepaliveMsg     WSMessageType = "set_keepalive"
+	ClearKeepaliveMsg   WSMessageType = "clear_keepalive"
+	KeepaliveFailedMsg  WSMessageType = "keepalive_failed"
+	GetCookiesMsg       WSMessageType = "get_cookies"
+	DetachSessionMsg    WSMessageType = "detach_session"
+	AttachSessionMsg    WSMessageType = "attach_session"
+	ShutdownMsg         WSMessageType = "shutdown"
 )
 
+// CloseNotice tells the clients why their connection is closed and, for
+// clustered deployments, where to reconnect
+type CloseNotice struct {
+	Reason      string `json:"reason"`
+	ReconnectTo string `json:"reconnect_to,omitempty"`
+}
+
 type WSMessage struct {
 	Type    WSMessageType   `json:"type"`
 	ID      string          `json:"id,omitempty"`
@@ -39,17 +66,35 @@ type WSMessage struct {
 type WSConnection struct {
 	conn      *websocket.Conn
 	sessionID string
+	// persist keeps the session once the connection closes
+	persist   bool
+	apiKey    *auth.Key
 	mu        sync.Mutex
 	closed    bool
 	closeChan chan struct{}
+
+	remoteAddr   string
+	connectedAt  time.Time
+	messages     atomic.Uint64
+	messagesSent atomic.Uint64
+	inFlight     atomic.Int64
+	lastActivity atomic.Int64 // Unix nanoseconds
 }
 
 func NewWSConnection(conn *websocket.Conn, sessionID string) *WSConnection {
-	return &WSConnection{
-		conn:      conn,
-		sessionID: sessionID,
-		closeChan: make(chan struct{}),
+	c := &WSConnection{
+		conn:        conn,
+		sessionID:   sessionID,
+		closeChan:   make(chan struct{}),
+		connectedAt: time.Now().UTC(),
 	}
+	c.touch()
+	return c
+}
+
+// touch records activity on the connection
+func (c *WSConnection) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
 }
 
 func (c *WSConnection) WriteJSON(v any) error {
@@ -61,7 +106,13 @@ func (c *WSConnection) WriteJSON(v any) error {
 	}
 
 	_ = c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
-	return c.conn.WriteJSON(v)
+	if err := c.conn.WriteJSON(v); err != nil {
+		return err
+	}
+
+	c.messagesSent.Add(1)
+	c.touch()
+	return nil
 }
 
 func (c *WSConnection) ReadJSON(v any) error {
@@ -86,6 +137,18 @@ func (c *WSConnection) Close() error {
 	return c.conn.Close()
 }
 
+// CloseWithReason sends a close frame with the given code and reason before
+// closing the connection
+func (c *WSConnection) CloseWithReason(code int, reason string) error {
+	c.mu.Lock()
+	if !c.closed {
+		_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	}
+	c.mu.Unlock()
+
+	return c.Close()
+}
+
 func (c *WSConnection) IsClosed() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -102,6 +165,19 @@ func (c *WSConnection) SetSessionID(sessionID string) {
 	c.sessionID = sessionID
 }
 
+// Persist reports whether the session of the connection outlives it
+func (c *WSConnection) Persist() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.persist
+}
+
+func (c *WSConnection) SetPersist(persist bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.persist = persist
+}
+
 func (c *WSConnection) CloseChan() <-chan struct{} {
 	return c.closeChan
 }
@@ -110,6 +186,10 @@ type ConnectionManager struct {
 	connections  map[string]*WSConnection
 	sessionConns map[string]*WSConnection
 	mu           sync.RWMutex
+
+	// handlers counts the messages being handled, waited for by CloseAll
+	handlers sync.WaitGroup
+	draining bool
 }
 
 func NewConnectionManager() *ConnectionManager {
@@ -180,14 +260,115 @@ func (cm *ConnectionManager) ListConnections() []string {
 	return connIDs
 }
 
-func (cm *ConnectionManager) CloseAll() {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
+// CloseConnection force-closes a connection with a policy violation close
+// frame holding the reason, its session being deleted like on disconnect
+func (cm *ConnectionManager) CloseConnection(connID, reason string) error {
+	conn, exists := cm.GetConnection(connID)
+	if !exists {
+		return common.ErrConnectionNotFound
+	}
 
+	common.LogInfo("WebSocket: Force-closing connection %s (session: %s): %s", connID, conn.SessionID(), reason)
+	err := conn.CloseWithReason(websocket.ClosePolicyViolation, reason)
+	cm.RemoveConnection(connID)
+	return err
+}
+
+// Describe returns the open connections, oldest first
+func (cm *ConnectionManager) Describe() []common.ConnectionInfo {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	connections := make([]common.ConnectionInfo, 0, len(cm.connections))
+	for id, conn := range cm.connections {
+		conn.mu.Lock()
+		sessionID := conn.sessionID
+		conn.mu.Unlock()
+
+		info := common.ConnectionInfo{
+			ID:           id,
+			RemoteAddr:   conn.remoteAddr,
+			SessionID:    sessionID,
+			ConnectedAt:  conn.connectedAt,
+			LastActivity: time.Unix(0, conn.lastActivity.Load()).UTC(),
+			Messages:     conn.messages.Load(),
+			MessagesSent: conn.messagesSent.Load(),
+			InFlight:     conn.inFlight.Load(),
+		}
+		if conn.apiKey != nil {
+			info.APIKey = conn.apiKey.Name()
+		}
+		connections = append(connections, info)
+	}
+
+	sort.Slice(connections, func(i, k int) bool {
+		return connections[i].ConnectedAt.Before(connections[k].ConnectedAt)
+	})
+	return connections
+}
+
+// Draining reports whether CloseAll was called, new connections being
+// rejected from then on
+func (cm *ConnectionManager) Draining() bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+	return cm.draining
+}
+
+// beginMessage registers a message being handled, returning false once the
+// connections are closing
+func (cm *ConnectionManager) beginMessage() bool {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	if cm.draining {
+		return false
+	}
+	cm.handlers.Add(1)
+	return true
+}
+
+func (cm *ConnectionManager) endMessage() {
+	cm.handlers.Done()
+}
+
+// CloseAll closes the connections gracefully: the clients are sent a
+// shutdown message holding the notice, the messages being handled get up to
+// timeout to complete, then the connections are closed with a going away
+// close frame. Messages received in the meantime are answered with an error.
+func (cm *ConnectionManager) CloseAll(notice CloseNotice, timeout time.Duration) {
+	cm.mu.Lock()
+	cm.draining = true
+	connections := make([]*WSConnection, 0, len(cm.connections))
 	for _, conn := range cm.connections {
-		_ = conn.Close()
+		connections = append(connections, conn)
+	}
+	cm.mu.Unlock()
+
+	for _, conn := range connections {
+		if err := conn.SendMessage(ShutdownMsg, "", notice); err != nil {
+			common.LogDebug("WebSocket CloseAll: Failed to send shutdown notice (session: %s): %v", conn.SessionID(), err)
+		}
 	}
 
+	done := make(chan struct{})
+	go func() {
+		cm.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		common.LogWarn("WebSocket CloseAll: Closing connections with messages still being handled after %s", timeout)
+	}
+
+	for _, conn := range connections {
+		_ = conn.CloseWithReason(websocket.CloseGoingAway, notice.Reason)
+	}
+
+	cm.mu.Lock()
 	cm.connections = make(map[string]*WSConnection)
 	cm.sessionConns = make(map[string]*WSConnection)
+	cm.mu.Unlock()
 }
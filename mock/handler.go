@@ -0,0 +1,647 @@
+// Package mock provides a local HTTP target implementing the scenarios
+// integration tests usually rely on httpbin.org for: request echo,
+// redirects, cookies, compressed and chunked bodies, slow responses and
+// rate limiting.
+package mock
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gorilla/mux"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	maxDelay      = 10 * time.Second
+	maxBytes      = 10 * 1024 * 1024
+	maxRedirects  = 100
+	maxStreamSize = 1000
+)
+
+// EchoResponse describes the request received by the mock target
+type EchoResponse struct {
+	Method   string              `json:"method"`
+	URL      string              `json:"url"`
+	Protocol string              `json:"protocol"`
+	Args     url.Values          `json:"args"`
+	Headers  map[string][]string `json:"headers"`
+	Cookies  map[string]string   `json:"cookies,omitempty"`
+	Body     string              `json:"body,omitempty"`
+	JSON     any                 `json:"json,omitempty"`
+	Origin   string              `json:"origin"`
+	Encoding string              `json:"encoding,omitempty"`
+}
+
+type rateLimitWindow struct {
+	count   int
+	resetAt time.Time
+}
+
+// Handler serves the mock scenarios
+type Handler struct {
+	router *mux.Router
+
+	rateLimits map[string]*rateLimitWindow
+	mu         sync.Mutex
+
+	rangeRequests atomic.Int64
+}
+
+// NewHandler creates a handler serving the mock scenarios:
+//
+//	/get, /post, /put, /patch, /delete, /anything/*  echo the request
+//	/headers, /user-agent, /ip                       echo parts of the request
+//	/status/{code}                                   respond with the given status
+//	/redirect/{n}, /redirect-to?url=&status_code=    redirect n times or to a URL
+//	/cookies, /cookies/set?k=v, /cookies/delete?k    inspect and manage cookies
+//	/gzip, /deflate, /brotli, /zstd                  compressed echo bodies
+//	/encoding                                        echo compressed as negotiated by Accept-Encoding
+//	/stream/{n}                                      n chunked JSON lines
+//	/delay/{seconds}, /drip?numbytes=&duration=      slow responses
+//	/rate-limit/{n}?window=&key=                     429 after n requests per window
+//	/bytes/{n}, /html, /json                         fixed bodies
+//	/latin1?meta=true                                ISO-8859-1 text, or HTML declaring it in a meta tag
+//	/range/{n}?flaky=true&changing=true&delay=       n bytes supporting range requests
+func NewHandler() *Handler {
+	h := &Handler{
+		router:     mux.NewRouter(),
+		rateLimits: make(map[string]*rateLimitWindow),
+	}
+
+	r := h.router
+	r.HandleFunc("/get", h.Echo).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/post", h.Echo).Methods(http.MethodPost)
+	r.HandleFunc("/put", h.Echo).Methods(http.MethodPut)
+	r.HandleFunc("/patch", h.Echo).Methods(http.MethodPatch)
+	r.HandleFunc("/delete", h.Echo).Methods(http.MethodDelete)
+	r.HandleFunc("/anything", h.Echo)
+	r.PathPrefix("/anything/").HandlerFunc(h.Echo)
+
+	r.HandleFunc("/headers", h.Headers)
+	r.HandleFunc("/user-agent", h.UserAgent)
+	r.HandleFunc("/ip", h.IP)
+
+	r.HandleFunc("/status/{code:[0-9]+}", h.Status)
+	r.HandleFunc("/redirect/{n:[0-9]+}", h.Redirect)
+	r.HandleFunc("/redirect-to", h.RedirectTo)
+
+	r.HandleFunc("/cookies", h.Cookies)
+	r.HandleFunc("/cookies/set", h.SetCookies)
+	r.HandleFunc("/cookies/delete", h.DeleteCookies)
+
+	r.HandleFunc("/gzip", h.Compressed("gzip"))
+	r.HandleFunc("/deflate", h.Compressed("deflate"))
+	r.HandleFunc("/brotli", h.Compressed("br"))
+	r.HandleFunc("/zstd", h.Compressed("zstd"))
+	r.HandleFunc("/encoding", h.Negotiated)
+
+	r.HandleFunc("/stream/{n:[0-9]+}", h.Stream)
+	r.HandleFunc("/trailers", h.Trailers)
+	r.HandleFunc("/delay/{seconds}", h.Delay)
+	r.HandleFunc("/drip", h.Drip)
+	r.HandleFunc("/rate-limit/{n:[0-9]+}", h.RateLimit)
+
+	r.HandleFunc("/bytes/{n:[0-9]+}", h.Bytes)
+	r.HandleFunc("/html", h.HTML)
+	r.HandleFunc("/challenge", h.Challenge)
+	r.HandleFunc("/json", h.JSON)
+	r.HandleFunc("/latin1", h.Latin1)
+	r.HandleFunc("/range/{n:[0-9]+}", h.Range)
+
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.router.ServeHTTP(w, r)
+}
+
+// Echo answers with a description of the request
+func (h *Handler) Echo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newEchoResponse(r))
+}
+
+func (h *Handler) Headers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"headers": requestHeaders(r)})
+}
+
+func (h *Handler) UserAgent(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"user-agent": r.UserAgent()})
+}
+
+func (h *Handler) IP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"origin": origin(r)})
+}
+
+// Status responds with the requested status code. Redirect statuses point
+// to /get.
+func (h *Handler) Status(w http.ResponseWriter, r *http.Request) {
+	code, _ := strconv.Atoi(mux.Vars(r)["code"])
+	if code < 100 || code > 599 {
+		writeError(w, http.StatusBadRequest, "invalid status code")
+		return
+	}
+
+	if code >= 300 && code < 400 {
+		w.Header().Set("Location", "/get")
+	}
+	if code == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "1")
+	}
+
+	w.WriteHeader(code)
+}
+
+// Redirect redirects n times before landing on /get
+func (h *Handler) Redirect(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(mux.Vars(r)["n"])
+	if n < 1 || n > maxRedirects {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("redirect count must be between 1 and %d", maxRedirects))
+		return
+	}
+
+	location := "/get"
+	if n > 1 {
+		location = "/redirect/" + strconv.Itoa(n-1)
+	}
+
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// RedirectTo redirects to the url query parameter with an optional status_code
+func (h *Handler) RedirectTo(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("url")
+	if target == "" {
+		writeError(w, http.StatusBadRequest, "url is required")
+		return
+	}
+
+	code := http.StatusFound
+	if value := r.URL.Query().Get("status_code"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 300 || parsed > 399 {
+			writeError(w, http.StatusBadRequest, "status_code must be a 3xx code")
+			return
+		}
+		code = parsed
+	}
+
+	w.Header().Set("Location", target)
+	w.WriteHeader(code)
+}
+
+func (h *Handler) Cookies(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"cookies": requestCookies(r)})
+}
+
+// SetCookies sets every query parameter as a cookie and redirects to /cookies
+func (h *Handler) SetCookies(w http.ResponseWriter, r *http.Request) {
+	for name, values := range r.URL.Query() {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: values[0], Path: "/"})
+	}
+
+	http.Redirect(w, r, "/cookies", http.StatusFound)
+}
+
+// DeleteCookies expires every cookie named in the query and redirects to /cookies
+func (h *Handler) DeleteCookies(w http.ResponseWriter, r *http.Request) {
+	for name := range r.URL.Query() {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1, Expires: time.Unix(0, 0)})
+	}
+
+	http.Redirect(w, r, "/cookies", http.StatusFound)
+}
+
+// Compressed returns a handler echoing the request with the given content encoding
+func (h *Handler) Compressed(encoding string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := newEchoResponse(r)
+		response.Encoding = encoding
+
+		body, err := json.Marshal(response)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", encoding)
+		w.WriteHeader(http.StatusOK)
+
+		var writer io.WriteCloser
+		switch encoding {
+		case "gzip":
+			writer = gzip.NewWriter(w)
+		case "deflate":
+			// HTTP deflate is the zlib format (RFC 9110)
+			writer = zlib.NewWriter(w)
+		case "br":
+			writer = brotli.NewWriter(w)
+		case "zstd":
+			writer, _ = zstd.NewWriter(w)
+		}
+
+		_, _ = writer.Write(body)
+		_ = writer.Close()
+	}
+}
+
+// Negotiated echoes the request compressed with the first encoding of its
+// Accept-Encoding header the mock supports, uncompressed when there is none
+func (h *Handler) Negotiated(w http.ResponseWriter, r *http.Request) {
+	for _, value := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		encoding, _, _ := strings.Cut(strings.TrimSpace(value), ";")
+		switch encoding {
+		case "gzip", "deflate", "br", "zstd":
+			h.Compressed(encoding)(w, r)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, newEchoResponse(r))
+}
+
+// Stream writes n JSON lines, flushing each one as a separate chunk
+func (h *Handler) Stream(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(mux.Vars(r)["n"])
+	n = min(n, maxStreamSize)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	response := newEchoResponse(r)
+
+	for i := 0; i < n; i++ {
+		if err := encoder.Encode(map[string]any{"id": i, "url": response.URL, "args": response.Args}); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// Trailers echoes the request as a chunked body followed by the query
+// arguments as trailers, e.g. /trailers?Grpc-Status=0
+func (h *Handler) Trailers(w http.ResponseWriter, r *http.Request) {
+	args := r.URL.Query()
+	for name := range args {
+		w.Header().Add("Trailer", name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	_ = json.NewEncoder(w).Encode(newEchoResponse(r))
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	for name, values := range args {
+		w.Header()[http.CanonicalHeaderKey(name)] = values
+	}
+}
+
+// Delay waits the given number of seconds (up to 10) before echoing the request
+func (h *Handler) Delay(w http.ResponseWriter, r *http.Request) {
+	seconds, err := strconv.ParseFloat(mux.Vars(r)["seconds"], 64)
+	if err != nil || seconds < 0 {
+		writeError(w, http.StatusBadRequest, "invalid delay")
+		return
+	}
+
+	if !sleep(r, min(time.Duration(seconds*float64(time.Second)), maxDelay)) {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newEchoResponse(r))
+}
+
+// Drip writes numbytes bytes spread evenly over duration seconds, after an
+// initial delay
+func (h *Handler) Drip(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	numBytes := queryInt(query, "numbytes", 10)
+	duration := queryFloat(query, "duration", 2)
+	delay := queryFloat(query, "delay", 0)
+	code := queryInt(query, "code", http.StatusOK)
+
+	if numBytes < 1 || numBytes > maxBytes || duration < 0 || delay < 0 || code < 100 || code > 599 {
+		writeError(w, http.StatusBadRequest, "invalid drip parameters")
+		return
+	}
+
+	if !sleep(r, min(time.Duration(delay*float64(time.Second)), maxDelay)) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(numBytes))
+	w.WriteHeader(code)
+
+	flusher, _ := w.(http.Flusher)
+	interval := min(time.Duration(duration*float64(time.Second)), maxDelay) / time.Duration(numBytes)
+
+	for i := 0; i < numBytes; i++ {
+		if _, err := w.Write([]byte("*")); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if i < numBytes-1 && !sleep(r, interval) {
+			return
+		}
+	}
+}
+
+// RateLimit lets n requests through per window (seconds, default 60) and
+// answers 429 afterwards. Requests are counted per key query parameter.
+func (h *Handler) RateLimit(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(mux.Vars(r)["n"])
+	window := time.Duration(queryFloat(r.URL.Query(), "window", 60) * float64(time.Second))
+	key := fmt.Sprintf("%d|%s", limit, r.URL.Query().Get("key"))
+
+	h.mu.Lock()
+	now := time.Now()
+	state, exists := h.rateLimits[key]
+	if !exists || !now.Before(state.resetAt) {
+		state = &rateLimitWindow{resetAt: now.Add(window)}
+		h.rateLimits[key] = state
+	}
+	state.count++
+	count, resetAt := state.count, state.resetAt
+	h.mu.Unlock()
+
+	remaining := max(limit-count, 0)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(resetAt.Unix(), 10))
+
+	if count > limit {
+		retryAfter := int(time.Until(resetAt).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newEchoResponse(r))
+}
+
+// Bytes writes n random bytes
+func (h *Handler) Bytes(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(mux.Vars(r)["n"])
+	if n > maxBytes {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("at most %d bytes can be requested", maxBytes))
+		return
+	}
+
+	body := make([]byte, n)
+	_, _ = rand.Read(body)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(n))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// Challenge imitates the interstitial page of a bot protection
+func (h *Handler) Challenge(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cf-Mitigated", "challenge")
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = io.WriteString(w, `<!DOCTYPE html>
+<html>
+<head><title>Just a moment...</title></head>
+<body><div id="challenge-platform"></div></body>
+</html>
+`)
+}
+
+func (h *Handler) HTML(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, `<!DOCTYPE html>
+<html>
+<head><title>azuretls mock</title></head>
+<body>
+<h1 id="title">azuretls mock</h1>
+<ul class="items">
+<li class="item"><a href="/get?item=1">First</a> <span class="price">$19.99</span></li>
+<li class="item"><a href="/get?item=2">Second</a> <span class="price">$5.00</span></li>
+</ul>
+<form id="login" action="/post" method="post">
+<input type="hidden" name="csrf_token" value="mock-csrf-token">
+<input type="text" name="username">
+</form>
+</body>
+</html>
+`)
+}
+
+func (h *Handler) JSON(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"slideshow": map[string]any{
+			"title":  "Sample Slide Show",
+			"author": "azuretls",
+			"slides": []map[string]any{
+				{"title": "Wake up", "type": "all"},
+				{"title": "Overview", "type": "all", "items": []string{"Why", "Who"}},
+			},
+		},
+	})
+}
+
+// RangeBody returns the n bytes served by /range/{n}
+func RangeBody(n int) []byte {
+	body := make([]byte, n)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+	return body
+}
+
+// Range serves RangeBody(n), honoring Range and If-Range headers. With
+// flaky=true every other request is aborted halfway through the body, with
+// changing=true the ETag changes on every request, and delay (seconds)
+// slows down every request.
+func (h *Handler) Range(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(mux.Vars(r)["n"])
+	if n > maxBytes {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("at most %d bytes can be requested", maxBytes))
+		return
+	}
+
+	if delay, err := strconv.ParseFloat(r.URL.Query().Get("delay"), 64); err == nil && delay > 0 {
+		if !sleep(r, min(time.Duration(delay*float64(time.Second)), maxDelay)) {
+			return
+		}
+	}
+
+	count := h.rangeRequests.Add(1)
+	body := RangeBody(n)
+
+	etag := fmt.Sprintf(`"range-%d"`, n)
+	if r.URL.Query().Get("changing") == "true" {
+		etag = fmt.Sprintf(`"range-%d-%d"`, n, count)
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if r.URL.Query().Get("flaky") == "true" && count%2 == 0 {
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(body[:n/2])
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// Latin1Text is the text served ISO-8859-1 encoded by /latin1
+const Latin1Text = "Café crème, naïve façade"
+
+// Latin1 serves Latin1Text encoded in ISO-8859-1, declared in the
+// Content-Type header or, with meta=true, only in a meta tag of an HTML page
+func (h *Handler) Latin1(w http.ResponseWriter, r *http.Request) {
+	text := Latin1Text
+	if r.URL.Query().Get("meta") == "true" {
+		w.Header().Set("Content-Type", "text/html")
+		text = `<html><head><meta charset="iso-8859-1"><title>` + text + `</title></head></html>`
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=iso-8859-1")
+	}
+
+	body := make([]byte, 0, len(text))
+	for _, char := range text {
+		body = append(body, byte(char))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+func newEchoResponse(r *http.Request) *EchoResponse {
+	response := &EchoResponse{
+		Method:   r.Method,
+		URL:      requestURL(r),
+		Protocol: r.Proto,
+		Args:     r.URL.Query(),
+		Headers:  requestHeaders(r),
+		Cookies:  requestCookies(r),
+		Origin:   origin(r),
+	}
+
+	if r.Body != nil {
+		body, _ := io.ReadAll(io.LimitReader(r.Body, maxBytes))
+		response.Body = string(body)
+
+		var decoded any
+		if len(body) > 0 && json.Unmarshal(body, &decoded) == nil {
+			response.JSON = decoded
+		}
+	}
+
+	return response
+}
+
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+func requestHeaders(r *http.Request) map[string][]string {
+	headers := make(map[string][]string, len(r.Header)+1)
+	for key, values := range r.Header {
+		headers[key] = values
+	}
+	headers["Host"] = []string{r.Host}
+	return headers
+}
+
+func requestCookies(r *http.Request) map[string]string {
+	cookies := r.Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+
+	values := make(map[string]string, len(cookies))
+	for _, cookie := range cookies {
+		values[cookie.Name] = cookie.Value
+	}
+	return values
+}
+
+func origin(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// sleep waits for d, returning false if the client went away first
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func queryInt(query url.Values, name string, fallback int) int {
+	if value, err := strconv.Atoi(query.Get(name)); err == nil {
+		return value
+	}
+	return fallback
+}
+
+func queryFloat(query url.Values, name string, fallback float64) float64 {
+	if value, err := strconv.ParseFloat(query.Get(name), 64); err == nil {
+		return value
+	}
+	return fallback
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, message string) {
+	writeJSON(w, statusCode, map[string]any{
+		"error":  message,
+		"status": statusCode,
+	})
+}
@@ -0,0 +1,21 @@
+package mock
+
+import (
+	"net/http/httptest"
+)
+
+// NewServer starts a plain HTTP mock target on a random loopback port.
+// The caller must Close it when done.
+func NewServer() *httptest.Server {
+	return httptest.NewServer(NewHandler())
+}
+
+// NewTLSServer starts an HTTPS mock target, with HTTP/2 enabled, on a random
+// loopback port. Its certificate is self-signed, so clients must skip
+// verification or trust the server's Certificate().
+func NewTLSServer() *httptest.Server {
+	server := httptest.NewUnstartedServer(NewHandler())
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	return server
+}
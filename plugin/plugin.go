@@ -0,0 +1,173 @@
+// Package plugin writes external plugins for the azuretls API server. A
+// plugin is an executable placed in the -plugins_dir directory, started and
+// restarted by the server, which calls it over HTTP on the loopback
+// interface:
+//
+//	func main() {
+//		err := plugin.Serve(plugin.Plugin{
+//			Version: "1.0.0",
+//			MutateRequest: func(req *plugin.MutateRequest) error {
+//				req.Request.Headers.Set("X-Signature", sign(req.Request.Body))
+//				return nil
+//			},
+//		})
+//		if err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+//
+// Plugins may be written in any language following the protocol described
+// in this package, the standard output of a plugin being reserved for its
+// handshake and logged otherwise.
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/plugins"
+)
+
+type (
+	Request              = common.ServerRequest
+	MutateRequest        = plugins.MutateRequest
+	AuthenticateRequest  = plugins.AuthenticateRequest
+	AuthenticateResponse = plugins.AuthenticateResponse
+)
+
+// KeyNameHeader holds the name of the API key of the requests sent to the
+// custom endpoints, when authenticated
+const KeyNameHeader = plugins.KeyNameHeader
+
+// ErrNotStarted is returned by Serve when the executable was not started by
+// the server
+var ErrNotStarted = errors.New("plugins must be started by the azuretls API server from its plugins directory")
+
+// Plugin lists what a plugin provides, the nil fields being left out
+type Plugin struct {
+	Version string
+
+	// Endpoints serves the custom endpoints, mounted on
+	// /api/v1/plugins/{name}/ where name is the file name of the plugin
+	// without extension. They see the path below the prefix, with the
+	// X-Request-ID and KeyNameHeader headers set and the API key removed.
+	Endpoints http.Handler
+
+	// MutateRequest changes the outgoing requests before they are sent,
+	// ahead of the request rules. Errors fail the request. It is called
+	// for dry runs too, with DryRun set.
+	MutateRequest func(req *MutateRequest) error
+
+	// Authenticate accepts or rejects the API requests, before API key
+	// authentication. Returning an empty response leaves the request to
+	// the next auth provider and the API keys, while errors reject it.
+	// The X-API-Key header is removed from the request.
+	Authenticate func(req *AuthenticateRequest) (AuthenticateResponse, error)
+}
+
+func (p Plugin) manifest() plugins.Manifest {
+	manifest := plugins.Manifest{Version: p.Version, Capabilities: []string{}}
+	if p.Endpoints != nil {
+		manifest.Capabilities = append(manifest.Capabilities, plugins.CapabilityEndpoints)
+	}
+	if p.MutateRequest != nil {
+		manifest.Capabilities = append(manifest.Capabilities, plugins.CapabilityMutateRequest)
+	}
+	if p.Authenticate != nil {
+		manifest.Capabilities = append(manifest.Capabilities, plugins.CapabilityAuthenticate)
+	}
+	return manifest
+}
+
+// Serve runs the plugin until the server closes its standard input
+func Serve(p Plugin) error {
+	if os.Getenv(plugins.MagicEnv) != "1" {
+		return ErrNotStarted
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: Handler(p, os.Getenv(plugins.TokenEnv))}
+
+	go func() {
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		_ = server.Shutdown(context.Background())
+	}()
+
+	fmt.Printf("%s|%d|%s\n", plugins.HandshakePrefix, plugins.ProtocolVersion, listener.Addr())
+
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Handler serves the protocol of a plugin, rejecting the calls without the
+// token. Serve uses it with the token given by the server.
+func Handler(p Plugin, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /manifest", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, p.manifest(), http.StatusOK)
+	})
+
+	if p.MutateRequest != nil {
+		mux.HandleFunc("POST /mutate_request", func(w http.ResponseWriter, r *http.Request) {
+			var req MutateRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, plugins.ErrorResponse{Error: err.Error()}, http.StatusBadRequest)
+				return
+			}
+			if err := p.MutateRequest(&req); err != nil {
+				writeJSON(w, plugins.ErrorResponse{Error: err.Error()}, http.StatusUnprocessableEntity)
+				return
+			}
+			writeJSON(w, plugins.MutateResponse{Request: req.Request}, http.StatusOK)
+		})
+	}
+
+	if p.Authenticate != nil {
+		mux.HandleFunc("POST /authenticate", func(w http.ResponseWriter, r *http.Request) {
+			var req AuthenticateRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, plugins.ErrorResponse{Error: err.Error()}, http.StatusBadRequest)
+				return
+			}
+			resp, err := p.Authenticate(&req)
+			if err != nil {
+				writeJSON(w, plugins.ErrorResponse{Error: err.Error()}, http.StatusUnprocessableEntity)
+				return
+			}
+			writeJSON(w, resp, http.StatusOK)
+		})
+	}
+
+	if p.Endpoints != nil {
+		mux.Handle("/endpoints/", http.StripPrefix("/endpoints", p.Endpoints))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" || r.Header.Get(plugins.TokenHeader) != token {
+			writeJSON(w, plugins.ErrorResponse{Error: "invalid plugin token"}, http.StatusUnauthorized)
+			return
+		}
+		r.Header.Del(plugins.TokenHeader)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, value any, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
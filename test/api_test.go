@@ -0,0 +1,323 @@
+package test_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/shell"
+	ws "github.com/Noooste/azuretls-api/internal/websocket"
+	"github.com/Noooste/azuretls-api/mock"
+	"github.com/Noooste/azuretls-client"
+)
+
+func TestEmbeddedHandler(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+
+	handler := newAPIHandler(t, config, nil)
+	defer handler.(io.Closer).Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/tls/", http.StripPrefix("/tls", handler))
+	mux.HandleFunc("/own", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "own route")
+	})
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	resp, err := http.Get(server.URL + "/tls/health")
+	if err != nil {
+		t.Fatalf("Failed to get health: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200 for the mounted health check, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post(server.URL+"/tls/api/v1/request", "application/json",
+		strings.NewReader(`{"method": "GET", "url": "`+target.URL+`/get"}`))
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	var serverResp common.ServerResponse
+	json.NewDecoder(resp.Body).Decode(&serverResp)
+	resp.Body.Close()
+	if serverResp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a stateless request through the mounted API, got %+v", serverResp)
+	}
+
+	// WebSocket connections outlive the request that upgraded them
+	client, err := shell.Dial(server.URL+"/tls", "")
+	if err != nil {
+		t.Fatalf("Failed to connect over WebSocket: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.Call(ws.CreateSessionMsg, nil, nil); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if err := client.Call(ws.RequestMessage, common.ServerRequest{Method: http.MethodGet, URL: target.URL + "/get"}, &serverResp); err != nil || serverResp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a session request over WebSocket, got %+v (%v)", serverResp, err)
+	}
+
+	resp, err = http.Get(server.URL + "/own")
+	if err != nil {
+		t.Fatalf("Failed to get own route: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "own route" {
+		t.Errorf("Expected the routes of the service to be kept, got %q", body)
+	}
+}
+
+// quotaSessionManager wraps the default session manager, refusing sessions
+// beyond a quota
+type quotaSessionManager struct {
+	api.SessionManager
+	quota int
+	// startErr fails Start
+	startErr error
+
+	started, stopped bool
+	mu               sync.Mutex
+}
+
+func (m *quotaSessionManager) CreateSessionWithConfig(sessionID string, config *api.SessionConfig) (*azuretls.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.ListSessions()) >= m.quota {
+		return nil, errors.New("session quota exceeded")
+	}
+	return m.SessionManager.CreateSessionWithConfig(sessionID, config)
+}
+
+func (m *quotaSessionManager) Start(config api.Config, profiles api.ProfileCatalog) error {
+	m.started = true
+	if m.startErr != nil {
+		return m.startErr
+	}
+	return m.SessionManager.(api.SessionManagerLifecycle).Start(config, profiles)
+}
+
+func (m *quotaSessionManager) Stop() error {
+	m.stopped = true
+	return m.SessionManager.(api.SessionManagerLifecycle).Stop()
+}
+
+func TestCustomSessionManager(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "chrome.json"), `{"browser": "chrome", "user_agent": "Custom/1.0"}`)
+
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.ProfilesDir = dir
+
+	manager := &quotaSessionManager{SessionManager: api.NewSessionManager(), quota: 1}
+	handler := newAPIHandler(t, config, manager)
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	if !manager.started {
+		t.Error("Expected the session manager to be started")
+	}
+
+	createSession := func() int {
+		resp, err := http.Post(server.URL+"/api/v1/session/create", "application/json", strings.NewReader(`{"profile": "chrome"}`))
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The profile catalog reaches the wrapped manager through Start
+	if code := createSession(); code != http.StatusCreated {
+		t.Errorf("Expected status 201 for the first session, got %d", code)
+	}
+	if code := createSession(); code == http.StatusCreated {
+		t.Error("Expected the quota to refuse the second session")
+	}
+
+	if err := handler.(io.Closer).Close(); err != nil {
+		t.Errorf("Failed to close: %v", err)
+	}
+	if !manager.stopped || len(manager.ListSessions()) != 0 {
+		t.Errorf("Expected the sessions to be deleted and the manager stopped, got %v", manager.ListSessions())
+	}
+}
+
+func TestSessionManagerStartError(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+
+	manager := &quotaSessionManager{SessionManager: api.NewSessionManager(), startErr: errors.New("storage unreachable")}
+	if _, err := api.Handler(config, manager); err == nil || !strings.Contains(err.Error(), "storage unreachable") {
+		t.Errorf("Expected the handler to fail with the session manager, got %v", err)
+	}
+	if _, err := api.NewServer(config, manager); err == nil || !strings.Contains(err.Error(), "storage unreachable") {
+		t.Errorf("Expected the server to fail with the session manager, got %v", err)
+	}
+}
+
+func TestServerStartWaitsForShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.Host = "127.0.0.1"
+	config.Port = port
+
+	manager := &quotaSessionManager{SessionManager: api.NewSessionManager(), quota: 1}
+	server, err := api.NewServer(config, manager)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+
+	started := make(chan error, 1)
+	go func() {
+		started <- server.Start()
+	}()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d/health", port)
+	for i := 0; ; i++ {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatalf("Server did not start: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	server.Stop()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf("Start failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected Start to return after Stop")
+	}
+
+	// Start returns once the server is closed, not as soon as it stops
+	// listening
+	if !manager.stopped {
+		t.Error("Expected the session manager to be stopped when Start returns")
+	}
+}
+
+func TestMiddlewares(t *testing.T) {
+	var registered atomic.Int64
+	api.RegisterMiddleware(api.MiddlewareConfig{
+		Name:  "test-counter",
+		Stage: api.BeforeAuth,
+		Middleware: func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				registered.Add(1)
+				next.ServeHTTP(w, r)
+			})
+		},
+	})
+
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.APIKeys = []api.APIKeyConfig{{Key: "secret", Name: "tenant-a"}}
+	config.Middlewares = []api.MiddlewareConfig{
+		{
+			// Registered after auth, the tenant middleware still runs last
+			Name:  "tenant",
+			Stage: api.AfterAuth,
+			Middleware: func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					name, _ := api.APIKeyName(r)
+					w.Header().Set("X-Tenant", name)
+					w.Header().Set("X-Seen-Request-ID", api.RequestID(r))
+					next.ServeHTTP(w, r)
+				})
+			},
+		},
+		{
+			// Exchanges a site-specific token for the API key
+			Name:  "token-adapter",
+			Stage: api.BeforeAuth,
+			Middleware: func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if _, ok := api.APIKeyName(r); ok {
+						t.Error("Expected no API key before authentication")
+					}
+					if r.Header.Get("X-Site-Token") == "site-token" {
+						r.Header.Set("X-API-Key", "secret")
+					}
+					next.ServeHTTP(w, r)
+				})
+			},
+		},
+	}
+
+	handler := newAPIHandler(t, config, nil)
+	defer handler.(io.Closer).Close()
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	create := func(token string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/v1/session/create", strings.NewReader(`{}`))
+		req.Header.Set("X-Site-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := create("site-token")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected the adapter to authenticate the request, got status %d", resp.StatusCode)
+	}
+	if tenant := resp.Header.Get("X-Tenant"); tenant != "tenant-a" {
+		t.Errorf("Expected the tenant of the API key, got %q", tenant)
+	}
+	if id := resp.Header.Get("X-Seen-Request-ID"); id == "" || id != resp.Header.Get("X-Request-ID") {
+		t.Errorf("Expected middlewares to see the request ID %q, got %q", resp.Header.Get("X-Request-ID"), id)
+	}
+
+	resp = create("wrong-token")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without a valid token, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("X-Tenant") != "" {
+		t.Error("Expected rejected requests to skip the middlewares after auth")
+	}
+
+	if registered.Load() != 2 {
+		t.Errorf("Expected the registered middleware to see 2 requests, got %d", registered.Load())
+	}
+}
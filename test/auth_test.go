@@ -0,0 +1,353 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/auth"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/rotation"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func TestAPIKeySessionDefaults(t *testing.T) {
+	keyring := auth.NewKeyring([]common.APIKeyConfig{
+		{
+			Key: "tenant-a",
+			Defaults: common.SessionConfig{
+				Browser:   "firefox",
+				TimeoutMs: 5000,
+				Headers:   map[string]string{"accept-language": "en-US", "x-tenant": "a"},
+			},
+			Proxies: []string{"http://proxy-1:8080", "http://proxy-2:8080"},
+		},
+		{
+			Key:      "tenant-b",
+			Defaults: common.SessionConfig{Browser: "chrome", Proxy: "http://egress:8080"},
+			Enforce:  true,
+		},
+	}, "")
+
+	key, exists := keyring.Lookup("tenant-a")
+	if !exists {
+		t.Fatal("Expected tenant-a to be found")
+	}
+
+	config := key.SessionConfig(&common.SessionConfig{
+		Browser: "chrome",
+		Headers: map[string]string{"accept-language": "fr-FR"},
+	})
+	if config.Browser != "chrome" || config.TimeoutMs != 5000 {
+		t.Errorf("Expected client browser and default timeout, got %+v", config)
+	}
+	if config.Headers["accept-language"] != "fr-FR" || config.Headers["x-tenant"] != "a" {
+		t.Errorf("Expected merged headers with client precedence, got %v", config.Headers)
+	}
+	if config.Proxy != "http://proxy-1:8080" {
+		t.Errorf("Expected the first pooled proxy, got %q", config.Proxy)
+	}
+	if next := key.SessionConfig(nil); next.Proxy != "http://proxy-2:8080" {
+		t.Errorf("Expected the second pooled proxy, got %q", next.Proxy)
+	}
+	if explicit := key.SessionConfig(&common.SessionConfig{Proxy: "http://mine:8080"}); explicit.Proxy != "http://mine:8080" {
+		t.Errorf("Expected the client proxy to be kept, got %q", explicit.Proxy)
+	}
+
+	key, _ = keyring.Lookup("tenant-b")
+	config = key.SessionConfig(&common.SessionConfig{Browser: "safari", Proxy: "http://mine:8080", MaxRedirects: 3})
+	if config.Browser != "chrome" || config.Proxy != "http://egress:8080" || config.MaxRedirects != 3 {
+		t.Errorf("Expected enforced defaults, got %+v", config)
+	}
+
+	if _, exists := keyring.Lookup(""); exists {
+		t.Error("Expected the empty token to be rejected")
+	}
+}
+
+func TestAPIKeyEnforcedSessionConfig(t *testing.T) {
+	defaults := common.SessionConfig{
+		Profile:          "chrome-windows",
+		Browser:          "chrome",
+		Proxy:            "http://egress:8080",
+		ProxyAuth:        &common.ProxyAuthConfig{Scheme: common.ProxyAuthNTLM, Username: `CORP\egress`, Password: "key"},
+		Bandwidth:        &common.BandwidthConfig{DownloadBytesPerSec: 1 << 20},
+		MaxConnectionAge: &common.ConnectionAgeConfig{Seconds: 60},
+	}
+	keyring := auth.NewKeyring([]common.APIKeyConfig{
+		{Key: "enforced", Defaults: defaults, Enforce: true},
+		{Key: "pooled", Proxies: []string{"http://pool:8080"}, Enforce: true},
+	}, "")
+
+	key, _ := keyring.Lookup("enforced")
+	config := key.SessionConfig(&common.SessionConfig{
+		ProxyAuth:        &common.ProxyAuthConfig{Scheme: common.ProxyAuthNTLM, Username: "mallory", Password: "mine"},
+		Bandwidth:        &common.BandwidthConfig{},
+		MaxConnectionAge: &common.ConnectionAgeConfig{Seconds: 3600},
+		Rotation: &common.RotationPolicy{
+			MaxRequests: 2,
+			Browsers:    []string{"firefox"},
+			Profiles:    []string{"safari-mac"},
+			Proxies:     []string{"http://mine:8080"},
+		},
+	})
+	if config.ProxyAuth != defaults.ProxyAuth {
+		t.Errorf("Expected the proxy credentials of the key, got %+v", config.ProxyAuth)
+	}
+	if config.Bandwidth != defaults.Bandwidth {
+		t.Errorf("Expected the bandwidth of the key, got %+v", config.Bandwidth)
+	}
+	if config.MaxConnectionAge != defaults.MaxConnectionAge {
+		t.Errorf("Expected the connection age of the key, got %+v", config.MaxConnectionAge)
+	}
+	if config.Rotation == nil || config.Rotation.MaxRequests != 2 {
+		t.Fatalf("Expected the rotation policy to be kept, got %+v", config.Rotation)
+	}
+
+	// Replacements keep the browser, profile and proxy of the key
+	rotator := rotation.NewRotator()
+	rotator.Track("enforced", config)
+	replacement, _ := rotator.Replacement("enforced")
+	if replacement.Browser != "chrome" || replacement.Profile != "chrome-windows" || replacement.Proxy != "http://egress:8080" {
+		t.Errorf("Expected the replacement to keep the enforced settings, got %+v", replacement)
+	}
+
+	// The proxy pool of a key is enforced along with no proxy credentials
+	key, _ = keyring.Lookup("pooled")
+	config = key.SessionConfig(&common.SessionConfig{
+		Proxy:     "http://mine:8080",
+		ProxyAuth: &common.ProxyAuthConfig{Scheme: common.ProxyAuthNTLM, Username: "mallory", Password: "mine"},
+	})
+	if config.Proxy != "http://pool:8080" || config.ProxyAuth != nil {
+		t.Errorf("Expected the pooled proxy without client credentials, got %q and %+v", config.Proxy, config.ProxyAuth)
+	}
+}
+
+func TestRESTAPIKeyAuthentication(t *testing.T) {
+	server := NewTestServerWithConfig(&common.ServerConfig{
+		MaxConcurrentRequests: 100,
+		APIKeys:               []common.APIKeyConfig{{Key: "secret", Name: "tests"}},
+	})
+	defer server.Close()
+
+	createSession := func(setAuth func(r *http.Request), query string) int {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/v1/session/create"+query, bytes.NewReader([]byte("{}")))
+		req.Header.Set("Content-Type", "application/json")
+		if setAuth != nil {
+			setAuth(req)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := createSession(nil, ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without a key, got %d", status)
+	}
+	if status := createSession(func(r *http.Request) { r.Header.Set("X-API-Key", "wrong") }, ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 with a wrong key, got %d", status)
+	}
+	if status := createSession(func(r *http.Request) { r.Header.Set("X-API-Key", "secret") }, ""); status != http.StatusCreated {
+		t.Errorf("Expected status 201 with X-API-Key, got %d", status)
+	}
+	if status := createSession(func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, ""); status != http.StatusCreated {
+		t.Errorf("Expected status 201 with a bearer token, got %d", status)
+	}
+	if status := createSession(nil, "?api_key=secret"); status != http.StatusCreated {
+		t.Errorf("Expected status 201 with the api_key parameter, got %d", status)
+	}
+
+	resp, err := http.Get(server.URL + "/health")
+	if err != nil {
+		t.Fatalf("Failed to make health request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected health checks to skip authentication, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "/health/deep")
+	if err != nil {
+		t.Fatalf("Failed to make deep health request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 for the deep health check without a key, got %d", resp.StatusCode)
+	}
+}
+
+func TestAPIKeySessionIsolation(t *testing.T) {
+	server := NewTestServerWithConfig(&common.ServerConfig{
+		MaxConcurrentRequests: 100,
+		APIKeys: []common.APIKeyConfig{
+			{Key: "tenant-a", Name: "a"},
+			{Key: "tenant-b", Name: "b", Defaults: common.SessionConfig{Browser: "chrome"}, Enforce: true},
+			{Key: "root", Name: "root", Admin: true},
+		},
+		SessionPool: common.SessionPoolConfig{Size: 1},
+	})
+	defer server.Close()
+
+	send := func(key, method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", key)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send %s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	create := func(key string) string {
+		status, body := send(key, http.MethodPost, "/api/v1/session/create", "{}")
+		if status != http.StatusCreated {
+			t.Fatalf("Failed to create session with key %s: %d %s", key, status, body)
+		}
+		var created map[string]string
+		json.Unmarshal([]byte(body), &created)
+		return created["session_id"]
+	}
+
+	sessionA := create("tenant-a")
+	cookies := "/api/v1/session/" + sessionA + "/cookies?url=https://example.com"
+
+	if status, body := send("tenant-a", http.MethodGet, cookies, ""); status != http.StatusOK {
+		t.Errorf("Expected the owner to reach its session, got %d: %s", status, body)
+	}
+	if status, _ := send("tenant-b", http.MethodGet, cookies, ""); status != http.StatusNotFound {
+		t.Errorf("Expected status 404 for the session of another key, got %d", status)
+	}
+	if status, _ := send("tenant-b", http.MethodDelete, "/api/v1/session/"+sessionA, ""); status != http.StatusNotFound {
+		t.Errorf("Expected status 404 deleting the session of another key, got %d", status)
+	}
+	if status, body := send("root", http.MethodGet, cookies, ""); status != http.StatusOK {
+		t.Errorf("Expected admin keys to reach every session, got %d: %s", status, body)
+	}
+
+	sessionB := create("tenant-b")
+	enforced := map[string][2]string{
+		"proxy":     {http.MethodPost, "/api/v1/session/" + sessionB + "/proxy"},
+		"clear":     {http.MethodDelete, "/api/v1/session/" + sessionB + "/proxy"},
+		"ja3":       {http.MethodPost, "/api/v1/session/" + sessionB + "/ja3"},
+		"http2":     {http.MethodPost, "/api/v1/session/" + sessionB + "/http2"},
+		"cookiejar": {http.MethodDelete, "/api/v1/session/" + sessionB + "/cookiejar"},
+		"acquire":   {http.MethodPost, "/api/v1/session/acquire"},
+	}
+	for name, route := range enforced {
+		if status, body := send("tenant-b", route[0], route[1], "{}"); status != http.StatusForbidden {
+			t.Errorf("Expected status 403 for %s with an enforcing key, got %d: %s", name, status, body)
+		}
+	}
+
+	request := `{"method": "GET", "url": "http://127.0.0.1:1/", "options": {"proxy": "http://mine:8080"}}`
+	if status, body := send("tenant-b", http.MethodPost, "/api/v1/session/"+sessionB+"/request", request); status != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a per-request proxy with an enforcing key, got %d: %s", status, body)
+	}
+	if status, body := send("tenant-b", http.MethodPost, "/api/v1/request", request); status != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a stateless per-request proxy with an enforcing key, got %d: %s", status, body)
+	}
+	if status, body := send("tenant-b", http.MethodPost, "/api/v1/session/"+sessionB+"/downloads", request); status != http.StatusForbidden {
+		t.Errorf("Expected status 403 for a download through a per-request proxy with an enforcing key, got %d: %s", status, body)
+	}
+
+	status, body := send("tenant-a", http.MethodPost, "/api/v1/session/acquire", "")
+	if status != http.StatusOK {
+		t.Fatalf("Failed to acquire session: %d %s", status, body)
+	}
+	var acquired map[string]any
+	json.Unmarshal([]byte(body), &acquired)
+	pooled, _ := acquired["session_id"].(string)
+
+	if status, _ := send("tenant-b", http.MethodGet, "/api/v1/session/"+pooled+"/cookies", ""); status != http.StatusNotFound {
+		t.Errorf("Expected status 404 for the acquired session of another key, got %d", status)
+	}
+	if status, body := send("tenant-a", http.MethodPost, "/api/v1/session/"+pooled+"/release", "{}"); status != http.StatusOK {
+		t.Errorf("Expected the holder to release its session, got %d: %s", status, body)
+	}
+	if status, _ := send("tenant-a", http.MethodGet, "/api/v1/session/"+pooled+"/cookies", ""); status != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a released session, got %d", status)
+	}
+}
+
+func TestAPIKeyConcurrencyLimits(t *testing.T) {
+	server := NewTestServerWithConfig(&common.ServerConfig{
+		MaxConcurrentRequests:       10,
+		MaxConcurrentRequestsPerKey: 1,
+		APIKeys: []common.APIKeyConfig{
+			{Key: "busy", Name: "busy"},
+			{Key: "other", Name: "other", Admin: true, MaxConcurrentRequests: 5},
+		},
+	})
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	send := func(key, path string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/v1/request",
+			bytes.NewReader([]byte(`{"method": "GET", "url": "`+target.URL+path+`"}`)))
+		req.Header.Set("X-API-Key", key)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	done := make(chan int)
+	go func() {
+		status, _ := send("busy", "/delay/0.5")
+		done <- status
+	}()
+	time.Sleep(150 * time.Millisecond)
+
+	if status, body := send("busy", "/get"); status != http.StatusTooManyRequests || !strings.Contains(body, "API key") {
+		t.Errorf("Expected status 429 over the limit of the key, got %d: %s", status, body)
+	}
+	if status, body := send("other", "/get"); status != http.StatusOK {
+		t.Errorf("Expected the other key unaffected, got %d: %s", status, body)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/admin/stats", nil)
+	req.Header.Set("X-API-Key", "other")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	var stats common.AdminStats
+	json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+
+	if busy := stats.Limiter.Keys["busy"]; busy.InFlight != 1 || busy.Capacity != 1 {
+		t.Errorf("Unexpected stats of the busy key %+v", busy)
+	}
+	if other := stats.Limiter.Keys["other"]; other.InFlight != 0 || other.Capacity != 5 {
+		t.Errorf("Unexpected stats of the other key %+v", other)
+	}
+	if stats.Limiter.InFlight != 1 || stats.Limiter.Capacity != 10 {
+		t.Errorf("Unexpected global limiter stats %+v", stats.Limiter)
+	}
+
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("Expected the first request to complete, got %d", status)
+	}
+	if status, body := send("busy", "/get"); status != http.StatusOK {
+		t.Errorf("Expected the slot of the key released, got %d: %s", status, body)
+	}
+}
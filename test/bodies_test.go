@@ -0,0 +1,108 @@
+package test_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func TestOutOfBandBodies(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.BodyRefTTL = 500 * time.Millisecond
+
+	handler := newAPIHandler(t, config, nil)
+	defer handler.(io.Closer).Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	send := func(method, path string, header map[string]string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send %s %s: %v", method, path, err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, data
+	}
+
+	request := func() common.ServerResponse {
+		body := `{"method": "GET", "url": "` + target.URL + `/get", "options": {"body_ref": true}}`
+		resp, err := http.Post(server.URL+"/api/v1/request", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var serverResp common.ServerResponse
+		json.NewDecoder(resp.Body).Decode(&serverResp)
+		if serverResp.BodyRef == "" || serverResp.Body != "" || serverResp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected a body reference instead of the body, got %+v", serverResp)
+		}
+		return serverResp
+	}
+
+	serverResp := request()
+	ref := serverResp.BodyRef
+
+	resp, data := send(http.MethodGet, "/api/v1/bodies/"+ref, nil)
+	var echo mock.EchoResponse
+	if err := json.Unmarshal(data, &echo); err != nil || resp.StatusCode != http.StatusOK || echo.Method != http.MethodGet {
+		t.Fatalf("Expected the stored body, got %d: %s", resp.StatusCode, data)
+	}
+	if int64(len(data)) != serverResp.BodySize || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		t.Errorf("Unexpected body of %d bytes (%d announced) and content type %q", len(data), serverResp.BodySize, resp.Header.Get("Content-Type"))
+	}
+
+	t.Run("range", func(t *testing.T) {
+		resp, part := send(http.MethodGet, "/api/v1/bodies/"+ref, map[string]string{"Range": "bytes=2-9"})
+		if resp.StatusCode != http.StatusPartialContent || string(part) != string(data[2:10]) {
+			t.Errorf("Expected bytes 2-9, got %d: %q", resp.StatusCode, part)
+		}
+	})
+
+	t.Run("conditional", func(t *testing.T) {
+		etag := resp.Header.Get("ETag")
+		if resp, _ := send(http.MethodGet, "/api/v1/bodies/"+ref, map[string]string{"If-None-Match": etag}); resp.StatusCode != http.StatusNotModified {
+			t.Errorf("Expected status 304 for a matching ETag, got %d", resp.StatusCode)
+		}
+		if resp, _ := send(http.MethodGet, "/api/v1/bodies/"+ref, map[string]string{"If-None-Match": `"other"`}); resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200 for another ETag, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		ref := request().BodyRef
+		if resp, _ := send(http.MethodDelete, "/api/v1/bodies/"+ref, nil); resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", resp.StatusCode)
+		}
+		if resp, _ := send(http.MethodGet, "/api/v1/bodies/"+ref, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected the deleted body gone, got %d", resp.StatusCode)
+		}
+		if resp, _ := send(http.MethodGet, "/api/v1/bodies/../../etc/passwd", nil); resp.StatusCode == http.StatusOK {
+			t.Errorf("Expected an invalid reference rejected, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		time.Sleep(config.BodyRefTTL + 100*time.Millisecond)
+		if resp, _ := send(http.MethodGet, "/api/v1/bodies/"+ref, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected the expired body gone, got %d", resp.StatusCode)
+		}
+	})
+}
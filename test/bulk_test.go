@@ -0,0 +1,108 @@
+package test_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/common"
+)
+
+func TestBulkSessions(t *testing.T) {
+	config := api.DefaultConfig()
+	config.AdminKey = testAdminKey
+	config.LogLevel = "error"
+	config.MaxSessions = 3
+
+	server := httptest.NewServer(newAPIHandler(t, config, nil))
+	defer server.Close()
+
+	type bulkResponse struct {
+		Sessions []common.BulkSessionResult `json:"sessions"`
+		Created  int                        `json:"created"`
+		Failed   int                        `json:"failed"`
+		Error    string                     `json:"error"`
+	}
+
+	bulk := func(contentType, body string) (int, bulkResponse) {
+		resp, err := http.Post(server.URL+"/api/v1/sessions/bulk", contentType, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create sessions: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var response bulkResponse
+		data, _ := io.ReadAll(resp.Body)
+		json.Unmarshal(data, &response)
+		return resp.StatusCode, response
+	}
+
+	proxies := func() map[string]string {
+		resp, err := http.Get(server.URL + "/api/v1/admin/sessions?api_key=" + testAdminKey)
+		if err != nil {
+			t.Fatalf("Failed to list sessions: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var listed struct {
+			Sessions []common.SessionInfo `json:"sessions"`
+		}
+		json.NewDecoder(resp.Body).Decode(&listed)
+
+		proxies := make(map[string]string)
+		for _, session := range listed.Sessions {
+			proxies[session.ID] = session.Proxy
+		}
+		return proxies
+	}
+
+	t.Run("json", func(t *testing.T) {
+		status, response := bulk("application/json", `{"browser": "firefox", "proxies": ["http://proxy-1:8080", "http://proxy-2:8080"]}`)
+		if status != http.StatusCreated || response.Created != 2 || response.Failed != 0 || len(response.Sessions) != 2 {
+			t.Fatalf("Expected 2 sessions created, got %d: %+v", status, response)
+		}
+
+		sessions := proxies()
+		for i, result := range response.Sessions {
+			if expected := []string{"http://proxy-1:8080", "http://proxy-2:8080"}[i]; result.Proxy != expected || sessions[result.SessionID] != expected {
+				t.Errorf("Expected session %q to use %s, got %+v", result.SessionID, expected, result)
+			}
+		}
+
+		for _, result := range response.Sessions {
+			req, _ := http.NewRequest(http.MethodDelete, server.URL+"/api/v1/session/"+result.SessionID, nil)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		body := "proxy\n# staging proxies\nhttp://proxy-3:8080,eu\nhttp://proxy-4:8080\n"
+		status, response := bulk("text/csv", body)
+		if status != http.StatusCreated || response.Created != 2 {
+			t.Fatalf("Expected 2 sessions created, got %d: %+v", status, response)
+		}
+		if response.Sessions[0].Proxy != "http://proxy-3:8080" || response.Sessions[1].Proxy != "http://proxy-4:8080" {
+			t.Errorf("Unexpected proxies %+v", response.Sessions)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for name, body := range map[string]string{
+			"empty":     `{"proxies": []}`,
+			"proxy":     `{"proxy": "http://proxy:8080", "proxies": ["http://proxy-1:8080"]}`,
+			"blank":     `{"proxies": ["http://proxy-1:8080", ""]}`,
+			"too many":  `{"proxies": ["http://a:1", "http://b:1", "http://c:1", "http://d:1"]}`,
+			"malformed": `{"proxies": "http://proxy:8080"}`,
+		} {
+			if status, response := bulk("application/json", body); status != http.StatusBadRequest {
+				t.Errorf("%s: expected 400, got %d: %+v", name, status, response)
+			}
+		}
+	})
+}
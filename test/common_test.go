@@ -2,49 +2,139 @@ package test_test
 
 import (
 	"fmt"
+	"net/http"
 	"net/url"
+	"sync"
+	"testing"
 
+	"github.com/Noooste/azuretls-api/api"
 	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/trace"
 	"github.com/Noooste/azuretls-client"
+	"github.com/Noooste/fhttp/cookiejar"
 )
 
+// testAdminKey is the admin key of the test servers
+const testAdminKey = "test-admin-key"
+
 type TestAPIServer struct {
 	sessionManager common.SessionManager
+	sessionPool    common.SessionPool
+	profiles       common.ProfileCatalog
+	downloads      common.DownloadManager
+	monitor        common.Monitor
+	rotator        common.SessionRotator
+	keepalives     common.KeepaliveScheduler
+	prober         common.Prober
+	owners         common.SessionOwners
+	config         *common.ServerConfig
 }
 
 func (t *TestAPIServer) GetSessionManager() common.SessionManager {
 	return t.sessionManager
 }
 
+func (t *TestAPIServer) GetSessionPool() common.SessionPool {
+	return t.sessionPool
+}
+
+func (t *TestAPIServer) GetProfileCatalog() common.ProfileCatalog {
+	return t.profiles
+}
+
+func (t *TestAPIServer) GetDownloadManager() common.DownloadManager {
+	return t.downloads
+}
+
+func (t *TestAPIServer) GetMonitor() common.Monitor {
+	return t.monitor
+}
+
+func (t *TestAPIServer) GetSessionRotator() common.SessionRotator {
+	return t.rotator
+}
+
+func (t *TestAPIServer) GetKeepaliveScheduler() common.KeepaliveScheduler {
+	return t.keepalives
+}
+
+func (t *TestAPIServer) GetProber() common.Prober {
+	return t.prober
+}
+
+func (t *TestAPIServer) GetPluginManager() common.PluginManager {
+	return nil
+}
+
+func (t *TestAPIServer) GetScriptRunner() common.ScriptRunner {
+	return nil
+}
+
+func (t *TestAPIServer) GetRequestScheduler() common.RequestScheduler {
+	return nil
+}
+
+func (t *TestAPIServer) GetBodyStore() common.BodyStore {
+	return nil
+}
+
+func (t *TestAPIServer) GetCookieJars() common.CookieJarRegistry {
+	return nil
+}
+
+func (t *TestAPIServer) GetSessionOwners() common.SessionOwners {
+	return t.owners
+}
+
 func (t *TestAPIServer) GetConfig() common.ServerConfig {
+	if t.config != nil {
+		return *t.config
+	}
 	return common.ServerConfig{
 		MaxConcurrentRequests: 100,
+		AdminKey:              testAdminKey,
 	}
 }
 
 // MockSessionManager implements common.SessionManager for testing
 type MockSessionManager struct {
+	mu       sync.RWMutex
 	sessions map[string]*azuretls.Session
+	history  map[string][]common.SentRequest
 }
 
 func (m *MockSessionManager) CreateSession(sessionID string) (*azuretls.Session, error) {
 	session := azuretls.NewSession()
+	trace.Install(session)
+
+	m.mu.Lock()
 	m.sessions[sessionID] = session
+	m.mu.Unlock()
 	return session, nil
 }
 
 func (m *MockSessionManager) CreateSessionWithConfig(sessionID string, config *common.SessionConfig) (*azuretls.Session, error) {
 	session := azuretls.NewSession()
+	trace.Install(session)
+
+	m.mu.Lock()
 	m.sessions[sessionID] = session
+	m.mu.Unlock()
 	return session, nil
 }
 
 func (m *MockSessionManager) GetSession(sessionID string) (*azuretls.Session, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	session, exists := m.sessions[sessionID]
 	return session, exists
 }
 
 func (m *MockSessionManager) DeleteSession(sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if session, exists := m.sessions[sessionID]; exists {
 		session.Close()
 	}
@@ -53,6 +143,9 @@ func (m *MockSessionManager) DeleteSession(sessionID string) error {
 }
 
 func (m *MockSessionManager) ListSessions() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	sessions := make([]string, 0, len(m.sessions))
 	for id := range m.sessions {
 		sessions = append(sessions, id)
@@ -61,6 +154,9 @@ func (m *MockSessionManager) ListSessions() []string {
 }
 
 func (m *MockSessionManager) CleanupSessions() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	for _, session := range m.sessions {
 		session.Close()
 	}
@@ -69,19 +165,22 @@ func (m *MockSessionManager) CleanupSessions() error {
 }
 
 func (m *MockSessionManager) GetSessionCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	return len(m.sessions)
 }
 
 func (m *MockSessionManager) GetHealthInfo() map[string]interface{} {
 	return map[string]interface{}{
 		"status":        "healthy",
-		"session_count": len(m.sessions),
+		"session_count": m.GetSessionCount(),
 		"uptime":        "test",
 	}
 }
 
 func (m *MockSessionManager) ExecuteRequest(sessionID string, req *common.ServerRequest) *common.ServerResponse {
-	_, exists := m.sessions[sessionID]
+	_, exists := m.GetSession(sessionID)
 	if !exists || sessionID == "" {
 		return &common.ServerResponse{
 			StatusCode: 500,
@@ -104,7 +203,7 @@ func (m *MockSessionManager) ExecuteStatelessRequest(req *common.ServerRequest)
 }
 
 func (m *MockSessionManager) ApplyJA3(sessionID, ja3, navigator string) error {
-	_, exists := m.sessions[sessionID]
+	_, exists := m.GetSession(sessionID)
 	if !exists {
 		return fmt.Errorf("session not found")
 	}
@@ -113,7 +212,7 @@ func (m *MockSessionManager) ApplyJA3(sessionID, ja3, navigator string) error {
 }
 
 func (m *MockSessionManager) ApplyHTTP2(sessionID, fingerprint string) error {
-	_, exists := m.sessions[sessionID]
+	_, exists := m.GetSession(sessionID)
 	if !exists {
 		return fmt.Errorf("session not found")
 	}
@@ -122,7 +221,7 @@ func (m *MockSessionManager) ApplyHTTP2(sessionID, fingerprint string) error {
 }
 
 func (m *MockSessionManager) ApplyHTTP3(sessionID, fingerprint string) error {
-	_, exists := m.sessions[sessionID]
+	_, exists := m.GetSession(sessionID)
 	if !exists {
 		return fmt.Errorf("session not found")
 	}
@@ -131,7 +230,7 @@ func (m *MockSessionManager) ApplyHTTP3(sessionID, fingerprint string) error {
 }
 
 func (m *MockSessionManager) SetProxy(sessionID, proxy string) error {
-	session, exists := m.sessions[sessionID]
+	session, exists := m.GetSession(sessionID)
 	if !exists {
 		return fmt.Errorf("session not found")
 	}
@@ -139,7 +238,7 @@ func (m *MockSessionManager) SetProxy(sessionID, proxy string) error {
 }
 
 func (m *MockSessionManager) ClearProxy(sessionID string) error {
-	session, exists := m.sessions[sessionID]
+	session, exists := m.GetSession(sessionID)
 	if !exists {
 		return fmt.Errorf("session not found")
 	}
@@ -147,8 +246,20 @@ func (m *MockSessionManager) ClearProxy(sessionID string) error {
 	return nil
 }
 
+func (m *MockSessionManager) ResetSession(sessionID string) error {
+	session, exists := m.GetSession(sessionID)
+	if !exists {
+		return fmt.Errorf("session not found")
+	}
+	session.CookieJar, _ = cookiejar.New(nil)
+	session.ClearProxy()
+	session.OrderedHeaders = make(azuretls.OrderedHeaders, 0)
+	session.Header = nil
+	return nil
+}
+
 func (m *MockSessionManager) AddPins(sessionID, urlStr string, pins []string) error {
-	session, exists := m.sessions[sessionID]
+	session, exists := m.GetSession(sessionID)
 	if !exists {
 		return fmt.Errorf("session not found")
 	}
@@ -160,7 +271,7 @@ func (m *MockSessionManager) AddPins(sessionID, urlStr string, pins []string) er
 }
 
 func (m *MockSessionManager) ClearPins(sessionID, urlStr string) error {
-	session, exists := m.sessions[sessionID]
+	session, exists := m.GetSession(sessionID)
 	if !exists {
 		return fmt.Errorf("session not found")
 	}
@@ -171,11 +282,88 @@ func (m *MockSessionManager) ClearPins(sessionID, urlStr string) error {
 	return session.ClearPins(parsedURL)
 }
 
-func (m *MockSessionManager) GetIP(sessionID string) (string, error) {
-	_, exists := m.sessions[sessionID]
+func (m *MockSessionManager) GetIP(sessionID string) (*common.IPInfo, error) {
+	_, exists := m.GetSession(sessionID)
 	if !exists {
-		return "", fmt.Errorf("session not found")
+		return nil, fmt.Errorf("session not found")
 	}
 	// Mock implementation - return a fixed IP for testing
-	return "192.168.1.1", nil
+	return &common.IPInfo{IP: "192.168.1.1"}, nil
+}
+
+func (m *MockSessionManager) GetDNSCache(sessionID string) ([]common.DNSCacheEntry, error) {
+	_, exists := m.GetSession(sessionID)
+	if !exists {
+		return nil, fmt.Errorf("session not found")
+	}
+	// Mock implementation - return a fixed entry for testing
+	return []common.DNSCacheEntry{
+		{Host: "example.com", Addresses: []string{"93.184.216.34"}, TTLSeconds: 60},
+	}, nil
+}
+
+func (m *MockSessionManager) FlushDNSCache(sessionID string) (int, error) {
+	_, exists := m.GetSession(sessionID)
+	if !exists {
+		return 0, fmt.Errorf("session not found")
+	}
+	return 1, nil
+}
+
+func (m *MockSessionManager) GetConnections(sessionID string) ([]common.SessionConnection, error) {
+	_, exists := m.GetSession(sessionID)
+	if !exists {
+		return nil, fmt.Errorf("session not found")
+	}
+	return []common.SessionConnection{}, nil
+}
+
+// ClearTLSTickets fails for every session, mock sessions never resuming
+func (m *MockSessionManager) ClearTLSTickets(sessionID string) (int, error) {
+	_, exists := m.GetSession(sessionID)
+	if !exists {
+		return 0, fmt.Errorf("session not found")
+	}
+	return 0, common.ErrTLSResumptionDisabled
+}
+
+func (m *MockSessionManager) GetSessionTags(sessionID string) ([]string, error) {
+	if _, exists := m.GetSession(sessionID); !exists {
+		return nil, fmt.Errorf("session with ID %s not found", sessionID)
+	}
+	return nil, nil
+}
+
+func (m *MockSessionManager) RecordRequest(sessionID string, req common.SentRequest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.sessions[sessionID]; !exists {
+		return
+	}
+	if m.history == nil {
+		m.history = make(map[string][]common.SentRequest)
+	}
+	m.history[sessionID] = append([]common.SentRequest{req}, m.history[sessionID]...)
+}
+
+func (m *MockSessionManager) GetRequestHistory(sessionID string) ([]common.SentRequest, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, exists := m.sessions[sessionID]; !exists {
+		return nil, fmt.Errorf("session with ID %s not found", sessionID)
+	}
+	return m.history[sessionID], nil
+}
+
+// newAPIHandler creates the API handler, failing the test on error
+func newAPIHandler(t *testing.T, config api.Config, sessionManager api.SessionManager) http.Handler {
+	t.Helper()
+
+	handler, err := api.Handler(config, sessionManager)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+	return handler
 }
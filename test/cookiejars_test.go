@@ -0,0 +1,245 @@
+package test_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func TestSharedCookieJars(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.APIKeys = []api.APIKeyConfig{
+		{Key: "user", Name: "user"},
+		{Key: "shared", Name: "shared", Defaults: common.SessionConfig{CookieJar: "identity"}},
+	}
+
+	server := httptest.NewServer(newAPIHandler(t, config, nil))
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	send := func(method, path, key, body string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("X-API-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send %s %s: %v", method, path, err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, data
+	}
+
+	createSession := func(body string) string {
+		_, data := send(http.MethodPost, "/api/v1/session/create", "user", body)
+		var created struct {
+			SessionID string `json:"session_id"`
+		}
+		json.Unmarshal(data, &created)
+		if created.SessionID == "" {
+			t.Fatalf("Failed to create session: %s", data)
+		}
+		return created.SessionID
+	}
+
+	setCookie := func(sessionID, value string) {
+		body := `{"method": "GET", "url": "` + target.URL + `/cookies/set?token=` + value + `"}`
+		if resp, data := send(http.MethodPost, "/api/v1/session/"+sessionID+"/request", "user", body); resp.StatusCode != http.StatusOK {
+			t.Fatalf("Failed to set cookie: %s", data)
+		}
+	}
+
+	// token returns the token cookie sent to the target, from the cookies
+	// endpoint of a session or jar
+	token := func(path string) string {
+		_, data := send(http.MethodGet, path+"?url="+url.QueryEscape(target.URL+"/"), "user", "")
+		var result struct {
+			Cookies []common.Cookie `json:"cookies"`
+		}
+		json.Unmarshal(data, &result)
+		for _, cookie := range result.Cookies {
+			if cookie.Name == "token" {
+				return cookie.Value
+			}
+		}
+		return ""
+	}
+
+	if resp, data := send(http.MethodPost, "/api/v1/cookiejars", "user", `{"name": "identity"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d: %s", resp.StatusCode, data)
+	}
+	if resp, _ := send(http.MethodPost, "/api/v1/cookiejars", "user", `{"name": "identity"}`); resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 for an existing jar, got %d", resp.StatusCode)
+	}
+
+	first := createSession(`{"browser": "chrome", "cookie_jar": "identity"}`)
+	second := createSession(`{"browser": "firefox"}`)
+	if resp, data := send(http.MethodPut, "/api/v1/session/"+second+"/cookiejar", "user", `{"name": "identity"}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to bind session: %d %s", resp.StatusCode, data)
+	}
+
+	setCookie(first, "abc")
+	if got := token("/api/v1/session/" + second + "/cookies"); got != "abc" {
+		t.Errorf("Expected the cookie set by the first session shared, got %q", got)
+	}
+	if got := token("/api/v1/cookiejars/identity/cookies"); got != "abc" {
+		t.Errorf("Expected the cookie in the jar, got %q", got)
+	}
+
+	_, data := send(http.MethodGet, "/api/v1/cookiejars/identity", "user", "")
+	var info common.CookieJarInfo
+	json.Unmarshal(data, &info)
+	if len(info.Sessions) != 2 {
+		t.Errorf("Expected both sessions bound, got %+v", info)
+	}
+
+	t.Run("stateless", func(t *testing.T) {
+		_, data := send(http.MethodPost, "/api/v1/request", "shared", `{"method": "GET", "url": "`+target.URL+`/cookies"}`)
+		var serverResp common.ServerResponse
+		json.Unmarshal(data, &serverResp)
+		if !strings.Contains(serverResp.Body, `"token":"abc"`) {
+			t.Errorf("Expected the stateless request to send the jar cookie, got %s", data)
+		}
+	})
+
+	t.Run("detach", func(t *testing.T) {
+		if resp, _ := send(http.MethodDelete, "/api/v1/session/"+second+"/cookiejar", "user", ""); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+		}
+		if resp, _ := send(http.MethodDelete, "/api/v1/session/"+second+"/cookiejar", "user", ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404 for an unbound session, got %d", resp.StatusCode)
+		}
+
+		// The detached session keeps a copy, no longer seeing the jar changes
+		setCookie(first, "def")
+		if got := token("/api/v1/session/" + second + "/cookies"); got != "abc" {
+			t.Errorf("Expected the detached session to keep its copy, got %q", got)
+		}
+		setCookie(second, "xyz")
+		if got := token("/api/v1/cookiejars/identity/cookies"); got != "def" {
+			t.Errorf("Expected the jar unaffected by the detached session, got %q", got)
+		}
+	})
+
+	t.Run("rebind while requesting", func(t *testing.T) {
+		send(http.MethodPost, "/api/v1/cookiejars", "user", `{"name": "racing"}`)
+		sessionID := createSession(`{"browser": "chrome"}`)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 5; j++ {
+					setCookie(sessionID, "race")
+				}
+			}()
+		}
+
+		for i := 0; i < 10; i++ {
+			send(http.MethodPut, "/api/v1/session/"+sessionID+"/cookiejar", "user", `{"name": "racing"}`)
+			send(http.MethodDelete, "/api/v1/session/"+sessionID+"/cookiejar", "user", "")
+		}
+		wg.Wait()
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if resp, _ := send(http.MethodDelete, "/api/v1/cookiejars/identity", "user", ""); resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected status 204, got %d", resp.StatusCode)
+		}
+		if got := token("/api/v1/session/" + first + "/cookies"); got != "def" {
+			t.Errorf("Expected the bound session to keep a copy, got %q", got)
+		}
+
+		_, data := send(http.MethodGet, "/api/v1/session/"+first+"/cookiejar", "user", "")
+		if !strings.Contains(string(data), `"cookie_jar":""`) {
+			t.Errorf("Expected the session unbound, got %s", data)
+		}
+
+		if resp, _ := send(http.MethodPost, "/api/v1/session/create", "user", `{"cookie_jar": "identity"}`); resp.StatusCode == http.StatusCreated {
+			t.Errorf("Expected creating a session with a missing jar to fail")
+		}
+	})
+}
+
+func TestSharedCookieJarOwners(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.APIKeys = []api.APIKeyConfig{
+		{Key: "tenant-a", Name: "a"},
+		{Key: "tenant-b", Name: "b"},
+		{Key: "root", Name: "root", Admin: true},
+	}
+
+	server := httptest.NewServer(newAPIHandler(t, config, nil))
+	defer server.Close()
+
+	send := func(key, method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", key)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send %s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	if status, body := send("tenant-a", http.MethodPost, "/api/v1/cookiejars", `{"name": "account-a"}`); status != http.StatusCreated {
+		t.Fatalf("Failed to create cookie jar: %d %s", status, body)
+	}
+
+	if _, body := send("tenant-b", http.MethodGet, "/api/v1/cookiejars", ""); strings.Contains(body, "account-a") {
+		t.Errorf("Expected the jar of another key to be left out of the list, got %s", body)
+	}
+	if _, body := send("tenant-a", http.MethodGet, "/api/v1/cookiejars", ""); !strings.Contains(body, "account-a") {
+		t.Errorf("Expected the owner to list its jar, got %s", body)
+	}
+
+	foreign := map[string][2]string{
+		"get":     {http.MethodGet, "/api/v1/cookiejars/account-a"},
+		"cookies": {http.MethodGet, "/api/v1/cookiejars/account-a/cookies?url=https://example.com/"},
+		"delete":  {http.MethodDelete, "/api/v1/cookiejars/account-a"},
+	}
+	for name, route := range foreign {
+		if status, body := send("tenant-b", route[0], route[1], ""); status != http.StatusNotFound {
+			t.Errorf("Expected status 404 for %s of the jar of another key, got %d: %s", name, status, body)
+		}
+	}
+
+	status, body := send("tenant-b", http.MethodPost, "/api/v1/session/create", "{}")
+	if status != http.StatusCreated {
+		t.Fatalf("Failed to create session: %d %s", status, body)
+	}
+	var created map[string]string
+	json.Unmarshal([]byte(body), &created)
+
+	bind := "/api/v1/session/" + created["session_id"] + "/cookiejar"
+	if status, body := send("tenant-b", http.MethodPut, bind, `{"name": "account-a"}`); status != http.StatusNotFound {
+		t.Errorf("Expected status 404 binding the jar of another key, got %d: %s", status, body)
+	}
+	if status, body := send("tenant-b", http.MethodPost, "/api/v1/session/create", `{"cookie_jar": "account-a"}`); status != http.StatusNotFound {
+		t.Errorf("Expected status 404 creating a session with the jar of another key, got %d: %s", status, body)
+	}
+
+	if status, body := send("root", http.MethodGet, "/api/v1/cookiejars/account-a", ""); status != http.StatusOK {
+		t.Errorf("Expected admin keys to reach every jar, got %d: %s", status, body)
+	}
+	if status, body := send("tenant-a", http.MethodDelete, "/api/v1/cookiejars/account-a", ""); status != http.StatusNoContent {
+		t.Errorf("Expected the owner to delete its jar, got %d: %s", status, body)
+	}
+}
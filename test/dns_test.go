@@ -0,0 +1,298 @@
+package test_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/certs"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/dns"
+	internal_server "github.com/Noooste/azuretls-api/internal/server"
+	"github.com/Noooste/azuretls-client"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startFakeDNSServer answers every A query with 192.0.2.10 and the given TTL
+func startFakeDNSServer(t *testing.T, ttl uint32, queries *int32) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(queries, 1)
+
+			response, err := fakeDNSAnswer(buf[:n], ttl)
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(response, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// fakeDNSAnswer answers an A query with 192.0.2.10 and the given TTL, and
+// other queries with no record
+func fakeDNSAnswer(query []byte, ttl uint32) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true})
+	_ = builder.StartQuestions()
+	_ = builder.Question(question)
+	_ = builder.StartAnswers()
+	if question.Type == dnsmessage.TypeA {
+		_ = builder.AResource(
+			dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: ttl},
+			dnsmessage.AResource{A: [4]byte{192, 0, 2, 10}},
+		)
+	}
+	return builder.Finish()
+}
+
+// startFakeDoTServer answers framed queries over TLS like startFakeDNSServer
+func startFakeDoTServer(t *testing.T, ttl uint32) (string, *x509.CertPool) {
+	cert, err := certs.SelfSigned("dns.test")
+	if err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var length [2]byte
+					if _, err := io.ReadFull(conn, length[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(length[:]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+
+					response, err := fakeDNSAnswer(query, ttl)
+					if err != nil {
+						return
+					}
+					_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), pool
+}
+
+func TestDNSWireResolverTTL(t *testing.T) {
+	var queries int32
+	server := startFakeDNSServer(t, 120, &queries)
+
+	resolver := dns.NewUDPResolver(server)
+	ips, ttl, err := resolver.LookupIP(context.Background(), "target.test")
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.10")) {
+		t.Errorf("Expected [192.0.2.10], got %v", ips)
+	}
+
+	if ttl != 120*time.Second {
+		t.Errorf("Expected TTL 120s, got %v", ttl)
+	}
+}
+
+func TestDNSCacheRespectsTTL(t *testing.T) {
+	var queries int32
+	server := startFakeDNSServer(t, 60, &queries)
+
+	cache := dns.NewCache(dns.NewUDPResolver(server))
+	for i := 0; i < 3; i++ {
+		if _, err := cache.LookupIP(context.Background(), "target.test"); err != nil {
+			t.Fatalf("Failed to resolve: %v", err)
+		}
+	}
+
+	// One A and one AAAA query for the first lookup only
+	if got := atomic.LoadInt32(&queries); got != 2 {
+		t.Errorf("Expected 2 DNS queries, got %d", got)
+	}
+
+	entries := cache.Entries()
+	if len(entries) != 1 || entries[0].Host != "target.test" {
+		t.Fatalf("Expected a single cached entry for target.test, got %+v", entries)
+	}
+
+	if flushed := cache.Flush(); flushed != 1 {
+		t.Errorf("Expected 1 flushed entry, got %d", flushed)
+	}
+
+	if _, err := cache.LookupIP(context.Background(), "target.test"); err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if got := atomic.LoadInt32(&queries); got != 4 {
+		t.Errorf("Expected 4 DNS queries after flush, got %d", got)
+	}
+}
+
+func TestDNSCacheSkipsZeroTTL(t *testing.T) {
+	var queries int32
+	server := startFakeDNSServer(t, 0, &queries)
+
+	cache := dns.NewCache(dns.NewUDPResolver(server))
+	if _, err := cache.LookupIP(context.Background(), "target.test"); err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+
+	if entries := cache.Entries(); len(entries) != 0 {
+		t.Errorf("Expected no cached entries for a zero TTL, got %+v", entries)
+	}
+}
+
+func TestDNSTLSResolver(t *testing.T) {
+	server, pool := startFakeDoTServer(t, 120)
+
+	resolver := dns.NewTLSResolver(&tls.Config{ServerName: "localhost", RootCAs: pool}, server)
+	ips, ttl, err := resolver.LookupIP(context.Background(), "target.test")
+	if err != nil {
+		t.Fatalf("Failed to resolve: %v", err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("192.0.2.10")) || ttl != 120*time.Second {
+		t.Errorf("Expected [192.0.2.10] for 120s, got %v for %v", ips, ttl)
+	}
+
+	// A certificate mismatch fails the lookup rather than falling back to
+	// the plaintext system resolver, which knows localhost
+	resolver = dns.NewTLSResolver(&tls.Config{ServerName: "dns.example", RootCAs: pool}, server)
+	if ips, _, err := resolver.LookupIP(context.Background(), "localhost"); err == nil {
+		t.Errorf("Expected the lookup to fail on the certificate, got %v", ips)
+	}
+}
+
+func TestSessionManagerDoTRefusesBypass(t *testing.T) {
+	manager := internal_server.NewSessionManager()
+	dot := &common.DoTConfig{Address: "127.0.0.1"}
+
+	// Proxies and HTTP/3 resolve names on their own, outside the resolver
+	invalid := []*common.SessionConfig{
+		{DoT: dot, Proxy: "http://127.0.0.1:8080"},
+		{DoT: dot, QUIC: &common.QUICConfig{}},
+	}
+	for i, config := range invalid {
+		if _, err := manager.CreateSessionWithConfig(fmt.Sprintf("dot-invalid-%d", i), config); err == nil {
+			t.Errorf("Expected config %d to be refused along dot", i)
+		}
+	}
+
+	session, err := manager.CreateSessionWithConfig("dot", &common.SessionConfig{DoT: dot})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if err := manager.SetProxy("dot", "http://127.0.0.1:8080"); err == nil {
+		t.Error("Expected setting a proxy on a dot session to be refused")
+	}
+	if _, err := session.Do(&azuretls.Request{Method: http.MethodGet, Url: "https://target.test/", ForceHTTP3: true}); err == nil || !strings.Contains(err.Error(), "DNS over TLS") {
+		t.Errorf("Expected an HTTP/3 request to be refused, got %v", err)
+	}
+	session.Proxy = "http://127.0.0.1:8080"
+	if _, err := session.Get("https://target.test/"); err == nil || !strings.Contains(err.Error(), "DNS over TLS") {
+		t.Errorf("Expected a proxied request to be refused, got %v", err)
+	}
+	if session.Proxy != "http://127.0.0.1:8080" {
+		t.Errorf("Expected the session left untouched by the refused request, got %q", session.Proxy)
+	}
+
+	// The resolver of the server serves direct connections, sessions with
+	// a proxy or HTTP/3 resolving names on their own
+	manager.SetDNSResolver(dns.NewTLSResolver(&tls.Config{ServerName: "localhost"}, "127.0.0.1:853"))
+	for i, config := range []*common.SessionConfig{{Proxy: "http://127.0.0.1:8080"}, {QUIC: &common.QUICConfig{}}} {
+		if _, err := manager.CreateSessionWithConfig(fmt.Sprintf("server-dot-%d", i), config); err != nil {
+			t.Errorf("Expected config %d to be accepted along the resolver of the server, got %v", i, err)
+		}
+	}
+	if err := manager.SetProxy("server-dot-1", "http://127.0.0.1:8080"); err != nil {
+		t.Errorf("Expected setting a proxy to be accepted along the resolver of the server, got %v", err)
+	}
+}
+
+func TestDoTSessionRefusesProxyOption(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	server := httptest.NewServer(newAPIHandler(t, config, nil))
+	defer server.Close()
+
+	created, err := http.Post(server.URL+"/api/v1/session/create", "application/json", strings.NewReader(`{"dot": {"address": "127.0.0.1:1"}}`))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	var result map[string]string
+	_ = json.NewDecoder(created.Body).Decode(&result)
+	created.Body.Close()
+	sessionID := result["session_id"]
+	if sessionID == "" {
+		t.Fatalf("Failed to create session: %v", result)
+	}
+
+	// The proxy option is refused before it reaches the session, whose
+	// later requests are not refused
+	for _, body := range []string{
+		`{"method": "GET", "url": "http://target.test/", "options": {"proxy": "http://127.0.0.1:8080"}}`,
+		`{"method": "GET", "url": "http://target.test/"}`,
+	} {
+		resp, err := http.Post(server.URL+"/api/v1/session/"+sessionID+"/request", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		var serverResp common.ServerResponse
+		_ = json.NewDecoder(resp.Body).Decode(&serverResp)
+		resp.Body.Close()
+
+		proxied := strings.Contains(body, "proxy")
+		if refused := strings.Contains(serverResp.Error, "DNS over TLS"); refused != proxied {
+			t.Errorf("Expected the request to be refused only with a proxy (%t), got %q", proxied, serverResp.Error)
+		}
+	}
+}
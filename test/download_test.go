@@ -0,0 +1,415 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func downloadRequest(t *testing.T, server *TestServer, url string, download *common.DownloadOptions) (*common.ServerResponse, int) {
+	serverReq := common.ServerRequest{
+		URL:     url,
+		Method:  http.MethodGet,
+		Options: common.RequestOptions{Download: download},
+	}
+	body, _ := json.Marshal(serverReq)
+
+	resp, err := http.Post(server.URL+"/api/v1/request", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make stateless request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var serverResp common.ServerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&serverResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return &serverResp, resp.StatusCode
+}
+
+func TestDownloadRanges(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	resp, status := downloadRequest(t, server, target.URL+"/range/100000", &common.DownloadOptions{ChunkSize: 16384})
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", status, resp.Error)
+	}
+
+	body, _ := base64.StdEncoding.DecodeString(resp.BodyB64)
+	if !bytes.Equal(body, mock.RangeBody(100000)) {
+		t.Errorf("Expected the assembled body, got %d bytes", len(body))
+	}
+
+	download := resp.Download
+	if download == nil || !download.Complete || !download.Ranged || download.Chunks != 7 || download.Total != 100000 {
+		t.Fatalf("Expected a complete download of 7 ranges, got %+v", download)
+	}
+	if download.ETag != `"range-100000"` {
+		t.Errorf("Expected the ETag to be reported, got %q", download.ETag)
+	}
+	if resp.StatusCode != http.StatusOK || len(resp.Headers["Content-Range"]) > 0 {
+		t.Errorf("Expected the assembled response to look like a 200, got %d and %v", resp.StatusCode, resp.Headers)
+	}
+
+	// Servers ignoring ranges answer in a single response
+	resp, _ = downloadRequest(t, server, target.URL+"/get", &common.DownloadOptions{ChunkSize: 16})
+	if resp.Download == nil || !resp.Download.Complete || resp.Download.Ranged || !strings.Contains(resp.Body, `"method"`) {
+		t.Errorf("Expected a complete download without ranges, got %+v", resp.Download)
+	}
+
+	// Errors are returned as is
+	resp, _ = downloadRequest(t, server, target.URL+"/status/404", &common.DownloadOptions{})
+	if resp.StatusCode != http.StatusNotFound || resp.Download != nil {
+		t.Errorf("Expected the 404 to be returned as is, got %d and %+v", resp.StatusCode, resp.Download)
+	}
+}
+
+func TestDownloadCookiesAndTrace(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	content := mock.RangeBody(20000)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "chunk", Value: "1"})
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer target.Close()
+
+	body, _ := json.Marshal(common.ServerRequest{
+		URL:     target.URL,
+		Method:  http.MethodGet,
+		Options: common.RequestOptions{Download: &common.DownloadOptions{ChunkSize: 8192}, Trace: true},
+	})
+	httpResp, err := http.Post(server.URL+"/api/v1/request", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer httpResp.Body.Close()
+
+	var resp common.ServerResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if resp.Download == nil || !resp.Download.Complete || resp.Download.Chunks != 3 {
+		t.Fatalf("Expected a complete download of 3 ranges, got %+v (%s)", resp.Download, resp.Error)
+	}
+	if len(resp.Cookies) != 1 || resp.Cookies[0].Name != "chunk" {
+		t.Errorf("Expected the cookie of the first range, got %+v", resp.Cookies)
+	}
+	if resp.Trace == nil || len(resp.Trace.Hops) != 3 {
+		t.Errorf("Expected a traced hop per range, got %+v", resp.Trace)
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	resp, status := downloadRequest(t, server, target.URL+"/range/50000?flaky=true", &common.DownloadOptions{ChunkSize: 10000})
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", status, resp.Error)
+	}
+
+	body, _ := base64.StdEncoding.DecodeString(resp.BodyB64)
+	if !bytes.Equal(body, mock.RangeBody(50000)) {
+		t.Errorf("Expected the assembled body, got %d bytes", len(body))
+	}
+	if resp.Download == nil || resp.Download.Retries == 0 {
+		t.Errorf("Expected interrupted chunks to be retried, got %+v", resp.Download)
+	}
+
+	resp, status = downloadRequest(t, server, target.URL+"/range/50000?changing=true", &common.DownloadOptions{ChunkSize: 10000})
+	if status != http.StatusInternalServerError || !strings.Contains(resp.Error, "changed") {
+		t.Errorf("Expected a changing resource to fail the download, got %d: %s", status, resp.Error)
+	}
+	if resp.Download == nil || resp.Download.Downloaded != 10000 {
+		t.Errorf("Expected the progress made to be reported, got %+v", resp.Download)
+	}
+}
+
+func TestDownloadSaveAs(t *testing.T) {
+	dir := t.TempDir()
+
+	server := NewTestServerWithConfig(&common.ServerConfig{MaxConcurrentRequests: 100, DownloadDir: dir})
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	resp, status := downloadRequest(t, server, target.URL+"/range/30000", &common.DownloadOptions{ChunkSize: 8192, SaveAs: "range.bin"})
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", status, resp.Error)
+	}
+
+	path := filepath.Join(dir, "range.bin")
+	if resp.Download == nil || resp.Download.Path != path || resp.BodyB64 != "" {
+		t.Errorf("Expected the download to be saved without body, got %+v", resp.Download)
+	}
+	if saved, err := os.ReadFile(path); err != nil || !bytes.Equal(saved, mock.RangeBody(30000)) {
+		t.Errorf("Expected the saved file to hold the resource (%v)", err)
+	}
+
+	// Existing files are left alone
+	resp, status = downloadRequest(t, server, target.URL+"/range/10", &common.DownloadOptions{SaveAs: "range.bin"})
+	if status != http.StatusInternalServerError || !strings.Contains(resp.Error, "exists") {
+		t.Errorf("Expected an existing file to be rejected, got %d: %s", status, resp.Error)
+	}
+	if saved, _ := os.ReadFile(path); len(saved) != 30000 {
+		t.Errorf("Expected the existing file to be kept, got %d bytes", len(saved))
+	}
+
+	resp, status = downloadRequest(t, server, target.URL+"/range/10", &common.DownloadOptions{SaveAs: "../escape.bin"})
+	if status != http.StatusInternalServerError || !strings.Contains(resp.Error, "invalid download file name") {
+		t.Errorf("Expected paths outside the download directory to be rejected, got %d: %s", status, resp.Error)
+	}
+}
+
+func downloadCall(t *testing.T, method, url string, payload any) (*http.Response, common.DownloadJob) {
+	var body io.Reader
+	if payload != nil {
+		data, _ := json.Marshal(payload)
+		body = bytes.NewReader(data)
+	}
+
+	req, _ := http.NewRequest(method, url, body)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to call %s %s: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+
+	var job common.DownloadJob
+	_ = json.NewDecoder(resp.Body).Decode(&job)
+	return resp, job
+}
+
+func waitForDownload(t *testing.T, url string, state string) common.DownloadJob {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, job := downloadCall(t, http.MethodGet, url, nil)
+		if job.State == state {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected download to be %s, got %+v", state, job)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func createDownloadSession(t *testing.T, server *TestServer) string {
+	resp, err := http.Post(server.URL+"/api/v1/session/create", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode create session response: %v", err)
+	}
+	return result["session_id"]
+}
+
+func TestDownloadManager(t *testing.T) {
+	server := NewTestServerWithConfig(&common.ServerConfig{MaxConcurrentRequests: 100, BodyStoreDir: t.TempDir()})
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	sessionID := createDownloadSession(t, server)
+	downloads := server.URL + "/api/v1/session/" + sessionID + "/downloads"
+
+	resp, job := downloadCall(t, http.MethodPost, downloads, common.ServerRequest{
+		URL:     target.URL + "/range/40000?delay=0.05",
+		Method:  http.MethodGet,
+		Options: common.RequestOptions{Download: &common.DownloadOptions{ChunkSize: 4000}},
+	})
+	if resp.StatusCode != http.StatusAccepted || job.ID == "" || job.State != common.DownloadRunning {
+		t.Fatalf("Expected the download to start, got %d and %+v", resp.StatusCode, job)
+	}
+	download := downloads + "/" + job.ID
+
+	// The artifact is not available before completion
+	resp, _ = downloadCall(t, http.MethodGet, download+"/content", nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 for a running download, got %d", resp.StatusCode)
+	}
+
+	resp, job = downloadCall(t, http.MethodPost, download+"/pause", nil)
+	if resp.StatusCode != http.StatusOK || job.State != common.DownloadPaused {
+		t.Fatalf("Expected the download to be paused, got %d and %+v", resp.StatusCode, job)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	_, paused := downloadCall(t, http.MethodGet, download, nil)
+	if paused.Progress.Downloaded != job.Progress.Downloaded || paused.Progress.Complete {
+		t.Errorf("Expected a paused download not to progress, got %+v then %+v", job.Progress, paused.Progress)
+	}
+
+	resp, _ = downloadCall(t, http.MethodPost, download+"/pause", nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 when pausing a paused download, got %d", resp.StatusCode)
+	}
+
+	resp, job = downloadCall(t, http.MethodPost, download+"/resume", nil)
+	if resp.StatusCode != http.StatusOK || job.State != common.DownloadRunning {
+		t.Fatalf("Expected the download to be resumed, got %d and %+v", resp.StatusCode, job)
+	}
+
+	job = waitForDownload(t, download, common.DownloadCompleted)
+	if job.Progress.Downloaded != 40000 || job.ContentType != "application/octet-stream" {
+		t.Errorf("Expected a complete download, got %+v", job)
+	}
+
+	contentResp, err := http.Get(download + "/content")
+	if err != nil {
+		t.Fatalf("Failed to get the artifact: %v", err)
+	}
+	content, _ := io.ReadAll(contentResp.Body)
+	contentResp.Body.Close()
+	if contentResp.StatusCode != http.StatusOK || !bytes.Equal(content, mock.RangeBody(40000)) {
+		t.Errorf("Expected the artifact, got %d with %d bytes", contentResp.StatusCode, len(content))
+	}
+
+	// The artifact supports range requests
+	req, _ := http.NewRequest(http.MethodGet, download+"/content", nil)
+	req.Header.Set("Range", "bytes=100-199")
+	contentResp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to get a range of the artifact: %v", err)
+	}
+	content, _ = io.ReadAll(contentResp.Body)
+	contentResp.Body.Close()
+	if contentResp.StatusCode != http.StatusPartialContent || !bytes.Equal(content, mock.RangeBody(40000)[100:200]) {
+		t.Errorf("Expected a range of the artifact, got %d with %d bytes", contentResp.StatusCode, len(content))
+	}
+
+	listResp, err := http.Get(downloads)
+	if err != nil {
+		t.Fatalf("Failed to list downloads: %v", err)
+	}
+	var list struct {
+		Downloads []common.DownloadJob `json:"downloads"`
+	}
+	_ = json.NewDecoder(listResp.Body).Decode(&list)
+	listResp.Body.Close()
+	if len(list.Downloads) != 1 || list.Downloads[0].ID != job.ID {
+		t.Errorf("Expected the download to be listed, got %+v", list.Downloads)
+	}
+
+	resp, _ = downloadCall(t, http.MethodDelete, download, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204 when canceling a download, got %d", resp.StatusCode)
+	}
+	resp, _ = downloadCall(t, http.MethodGet, download+"/content", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a canceled download, got %d", resp.StatusCode)
+	}
+
+	// Other sessions cannot see the download
+	otherID := createDownloadSession(t, server)
+	_, job = downloadCall(t, http.MethodPost, downloads, common.ServerRequest{URL: target.URL + "/range/100", Method: http.MethodGet})
+	waitForDownload(t, downloads+"/"+job.ID, common.DownloadCompleted)
+	resp, _ = downloadCall(t, http.MethodGet, server.URL+"/api/v1/session/"+otherID+"/downloads/"+job.ID, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for the download of another session, got %d", resp.StatusCode)
+	}
+}
+
+func TestDownloadManagerFailures(t *testing.T) {
+	server := NewTestServerWithConfig(&common.ServerConfig{MaxConcurrentRequests: 100, BodyStoreDir: t.TempDir()})
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	sessionID := createDownloadSession(t, server)
+	downloads := server.URL + "/api/v1/session/" + sessionID + "/downloads"
+
+	_, job := downloadCall(t, http.MethodPost, downloads, common.ServerRequest{URL: target.URL + "/status/404", Method: http.MethodGet})
+	job = waitForDownload(t, downloads+"/"+job.ID, common.DownloadFailed)
+	if job.StatusCode != http.StatusNotFound || job.Error == "" {
+		t.Errorf("Expected the 404 to fail the download, got %+v", job)
+	}
+
+	resp, _ := downloadCall(t, http.MethodPost, downloads+"/"+job.ID+"/resume", nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status 409 when resuming a failed download, got %d", resp.StatusCode)
+	}
+
+	// Deleting the session cancels its downloads
+	_, job = downloadCall(t, http.MethodPost, downloads, common.ServerRequest{
+		URL:     target.URL + "/range/40000?delay=0.05",
+		Method:  http.MethodGet,
+		Options: common.RequestOptions{Download: &common.DownloadOptions{ChunkSize: 1000}},
+	})
+	resp, _ = downloadCall(t, http.MethodDelete, server.URL+"/api/v1/session/"+sessionID, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected the session to be deleted, got %d", resp.StatusCode)
+	}
+	resp, _ = downloadCall(t, http.MethodGet, downloads+"/"+job.ID, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the downloads of a deleted session to be canceled, got %d", resp.StatusCode)
+	}
+
+	// Downloads are disabled without body store
+	disabled := NewTestServer()
+	defer disabled.Close()
+
+	resp, _ = downloadCall(t, http.MethodGet, disabled.URL+"/api/v1/session/"+createDownloadSession(t, disabled)+"/downloads", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 without download manager, got %d", resp.StatusCode)
+	}
+}
+
+func TestDownloadManagerExpiry(t *testing.T) {
+	storeDir := t.TempDir()
+	server := NewTestServerWithConfig(&common.ServerConfig{
+		MaxConcurrentRequests: 100,
+		BodyStoreDir:          storeDir,
+		DownloadTTL:           200 * time.Millisecond,
+	})
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	downloads := server.URL + "/api/v1/session/" + createDownloadSession(t, server) + "/downloads"
+
+	_, job := downloadCall(t, http.MethodPost, downloads, common.ServerRequest{URL: target.URL + "/range/100", Method: http.MethodGet})
+	waitForDownload(t, downloads+"/"+job.ID, common.DownloadCompleted)
+	if _, err := os.Stat(filepath.Join(storeDir, job.ID)); err != nil {
+		t.Fatalf("Expected the artifact to be stored: %v", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+
+	resp, _ := downloadCall(t, http.MethodGet, downloads+"/"+job.ID, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an expired download, got %d", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(storeDir, job.ID)); !os.IsNotExist(err) {
+		t.Errorf("Expected the artifact of an expired download to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/echo"
+	"github.com/Noooste/azuretls-client"
+)
+
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+
+	srv, err := echo.NewServer(echo.Config{})
+	if err != nil {
+		t.Fatalf("Failed to create echo server: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	go func() {
+		_ = srv.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+
+	return "https://" + listener.Addr().String()
+}
+
+func echoRequest(t *testing.T, url string, forceHTTP1 bool) *echo.Report {
+	t.Helper()
+
+	session := azuretls.NewSession()
+	defer session.Close()
+	session.InsecureSkipVerify = true
+
+	resp, err := session.Do(&azuretls.Request{
+		Method: "GET",
+		Url:    url,
+		OrderedHeaders: azuretls.OrderedHeaders{
+			{"x-first", "1"},
+			{"user-agent", "echo-test"},
+			{"x-second", "2"},
+		},
+		ForceHTTP1: forceHTTP1,
+	})
+	if err != nil {
+		t.Fatalf("Failed to request echo server: %v", err)
+	}
+
+	var report echo.Report
+	if err := json.Unmarshal(resp.Body, &report); err != nil {
+		t.Fatalf("Failed to decode echo report: %v", err)
+	}
+
+	return &report
+}
+
+func headerNames(headers [][]string) string {
+	names := make([]string, len(headers))
+	for i, header := range headers {
+		names[i] = strings.ToLower(header[0])
+	}
+	return strings.Join(names, ",")
+}
+
+func TestEchoServerHTTP2(t *testing.T) {
+	url := startEchoServer(t)
+	report := echoRequest(t, url+"/fingerprint?x=1", false)
+
+	if report.Protocol != "HTTP/2.0" || report.Path != "/fingerprint?x=1" {
+		t.Errorf("Unexpected protocol %q or path %q", report.Protocol, report.Path)
+	}
+
+	if !strings.HasPrefix(headerNames(report.Headers), "x-first,user-agent,x-second") {
+		t.Errorf("Unexpected header order %s", headerNames(report.Headers))
+	}
+
+	if report.HTTP2 == nil || len(report.HTTP2.Settings) == 0 {
+		t.Fatal("Expected HTTP/2 settings in report")
+	}
+
+	if strings.Join(report.HTTP2.PseudoHeaderOrder, ",") != ":method,:authority,:scheme,:path" {
+		t.Errorf("Unexpected pseudo-header order %v", report.HTTP2.PseudoHeaderOrder)
+	}
+
+	if !strings.HasSuffix(report.Akamai, "|m,a,s,p") || len(report.AkamaiHash) != 32 {
+		t.Errorf("Unexpected Akamai fingerprint %q", report.Akamai)
+	}
+
+	if report.TLS == nil || !strings.HasPrefix(report.TLS.JA4, "t13i") || report.TLS.NegotiatedProtocol != "h2" {
+		t.Errorf("Unexpected TLS report %+v", report.TLS)
+	}
+}
+
+func TestEchoServerHTTP1(t *testing.T) {
+	url := startEchoServer(t)
+	report := echoRequest(t, url+"/", true)
+
+	if report.Protocol != "HTTP/1.1" || report.HTTP2 != nil {
+		t.Errorf("Expected an HTTP/1.1 report, got %q", report.Protocol)
+	}
+
+	if !strings.HasPrefix(headerNames(report.Headers), "x-first,user-agent,x-second") {
+		t.Errorf("Unexpected header order %s", headerNames(report.Headers))
+	}
+
+	if alpn := report.TLS.ClientHello.ALPN; len(alpn) != 1 || alpn[0] != "http/1.1" {
+		t.Errorf("Expected http/1.1 ALPN, got %v", alpn)
+	}
+}
+
+func TestEchoServerMatchesDryRun(t *testing.T) {
+	url := startEchoServer(t)
+	report := echoRequest(t, url+"/", false)
+
+	server := NewTestServer()
+	defer server.Close()
+
+	body, _ := json.Marshal(common.ServerRequest{
+		URL:     url + "/",
+		Method:  "GET",
+		Options: common.RequestOptions{DryRun: true},
+	})
+
+	resp, err := http.Post(server.URL+"/api/v1/request", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make dry-run request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result common.ServerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if result.DryRun == nil || result.DryRun.ClientHello == nil {
+		t.Fatalf("Expected a ClientHello summary, got error %q", result.Error)
+	}
+
+	// JA4 sorts extensions, so it is stable across Chrome's extension shuffling
+	if result.DryRun.ClientHello.JA4 != report.TLS.JA4 {
+		t.Errorf("Dry-run JA4 %s does not match observed JA4 %s", result.DryRun.ClientHello.JA4, report.TLS.JA4)
+	}
+}
+
+func TestEchoServerALPN(t *testing.T) {
+	url := startEchoServer(t)
+
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+
+	server := httptest.NewServer(newAPIHandler(t, config, nil))
+	defer server.Close()
+
+	body, _ := json.Marshal(common.SessionConfig{InsecureSkipVerify: true})
+	resp, err := http.Post(server.URL+"/api/v1/session/create", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+
+	send := func(options common.RequestOptions) (common.ServerResponse, *echo.Report) {
+		body, _ := json.Marshal(common.ServerRequest{URL: url + "/", Method: "GET", Options: options})
+		resp, err := http.Post(server.URL+"/api/v1/session/"+created["session_id"]+"/request", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var result common.ServerResponse
+		json.NewDecoder(resp.Body).Decode(&result)
+		if result.Error != "" {
+			return result, nil
+		}
+
+		var report echo.Report
+		if err := json.Unmarshal([]byte(result.Body), &report); err != nil {
+			t.Fatalf("Failed to decode echo report: %v", err)
+		}
+		return result, &report
+	}
+
+	result, baseline := send(common.RequestOptions{})
+	if result.Protocol != "HTTP/2.0" || baseline == nil || !slices.Equal(baseline.TLS.ClientHello.ALPN, []string{"h2", "http/1.1"}) {
+		t.Fatalf("Unexpected default request %q: %+v", result.Protocol, result.Error)
+	}
+
+	result, report := send(common.RequestOptions{ALPN: []string{"http/1.1"}})
+	if result.Protocol != "HTTP/1.1" || report == nil || report.TLS.NegotiatedProtocol != "http/1.1" {
+		t.Fatalf("Expected HTTP/1.1 to be negotiated, got %q: %s", result.Protocol, result.Error)
+	}
+	if !slices.Equal(report.TLS.ClientHello.ALPN, []string{"http/1.1"}) {
+		t.Errorf("Expected only http/1.1 to be offered, got %v", report.TLS.ClientHello.ALPN)
+	}
+
+	// A new connection offering h2 alone keeps the HTTP/2 fingerprint
+	result, report = send(common.RequestOptions{ALPN: []string{"h2"}})
+	if result.Protocol != "HTTP/2.0" || report == nil || !slices.Equal(report.TLS.ClientHello.ALPN, []string{"h2"}) {
+		t.Fatalf("Expected h2 to be offered alone, got %q: %s", result.Protocol, result.Error)
+	}
+	if report.Akamai != baseline.Akamai {
+		t.Errorf("Expected HTTP/2 fingerprint %s, got %s", baseline.Akamai, report.Akamai)
+	}
+
+	// The fork is kept for the next requests with the same protocols
+	result, again := send(common.RequestOptions{ALPN: []string{"h2"}})
+	if again == nil || again.RemoteAddr != report.RemoteAddr {
+		t.Errorf("Expected the connection of the fork to be reused, got %+v (%s)", again, result.Error)
+	}
+
+	result, report = send(common.RequestOptions{})
+	if report == nil || !slices.Equal(report.TLS.ClientHello.ALPN, []string{"h2", "http/1.1"}) {
+		t.Errorf("Expected the session offer to be left untouched, got %+v (%s)", report, result.Error)
+	}
+
+	// Concurrent requests offering the same protocols share the fork
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result, report := send(common.RequestOptions{ALPN: []string{"http/1.1"}}); report == nil || result.Protocol != "HTTP/1.1" {
+				t.Errorf("Expected HTTP/1.1 to be negotiated concurrently, got %q: %s", result.Protocol, result.Error)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for name, options := range map[string]common.RequestOptions{
+		"force_http1": {ALPN: []string{"h2"}, ForceHTTP1: true},
+		"empty":       {ALPN: []string{""}},
+	} {
+		if result, _ := send(options); !strings.Contains(result.Error, "alpn") {
+			t.Errorf("%s: expected an alpn error, got %q", name, result.Error)
+		}
+	}
+}
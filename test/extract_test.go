@@ -0,0 +1,182 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func extractRequest(t *testing.T, server *TestServer, url string, extract *common.ExtractOptions) (*common.ServerResponse, int) {
+	serverReq := common.ServerRequest{
+		URL:     url,
+		Method:  http.MethodGet,
+		Options: common.RequestOptions{Extract: extract},
+	}
+	body, _ := json.Marshal(serverReq)
+
+	resp, err := http.Post(server.URL+"/api/v1/request", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make stateless request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var serverResp common.ServerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&serverResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return &serverResp, resp.StatusCode
+}
+
+func TestExtractJSONPath(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	resp, status := extractRequest(t, server, target.URL+"/json", &common.ExtractOptions{
+		JSONPath: map[string]string{
+			"title":   "$.slideshow.title",
+			"first":   "$.slideshow.slides[0].title",
+			"titles":  "$.slideshow.slides[*].title",
+			"missing": "$.slideshow.missing",
+		},
+		DropBody: true,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", status, resp.Error)
+	}
+
+	if resp.Extracted["title"] != "Sample Slide Show" || resp.Extracted["first"] != "Wake up" {
+		t.Errorf("Unexpected definite values: %v", resp.Extracted)
+	}
+	if titles, ok := resp.Extracted["titles"].([]any); !ok || len(titles) != 2 || titles[1] != "Overview" {
+		t.Errorf("Expected a list of titles, got %v", resp.Extracted["titles"])
+	}
+	if value, exists := resp.Extracted["missing"]; !exists || value != nil {
+		t.Errorf("Expected a null missing value, got %v", value)
+	}
+	if resp.Body != "" {
+		t.Errorf("Expected the body to be dropped, got %d bytes", len(resp.Body))
+	}
+
+	resp, _ = extractRequest(t, server, target.URL+"/html", &common.ExtractOptions{
+		JSONPath: map[string]string{"title": "$.title"},
+	})
+	if resp.ExtractErrors["title"] == "" || resp.Body == "" {
+		t.Errorf("Expected an extraction error and the body for HTML, got %+v", resp)
+	}
+
+	resp, status = extractRequest(t, server, target.URL+"/json", &common.ExtractOptions{
+		JSONPath: map[string]string{"broken": "$.["},
+	})
+	if status != http.StatusInternalServerError || resp.Error == "" {
+		t.Errorf("Expected an error for an invalid expression, got %d", status)
+	}
+}
+
+func TestExtractRegex(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	resp, status := extractRequest(t, server, target.URL+"/html", &common.ExtractOptions{
+		Regex: map[string]string{
+			"csrf":    `name="csrf_token" value="([^"]+)"`,
+			"title":   `<title>[^<]*</title>`,
+			"missing": `data-missing="(\w+)"`,
+		},
+		DropBody: true,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", status, resp.Error)
+	}
+
+	if resp.Extracted["csrf"] != "mock-csrf-token" {
+		t.Errorf("Expected the CSRF token, got %v", resp.Extracted["csrf"])
+	}
+	if resp.Extracted["title"] != "<title>azuretls mock</title>" {
+		t.Errorf("Expected the whole match, got %v", resp.Extracted["title"])
+	}
+	if value, exists := resp.Extracted["missing"]; !exists || value != nil {
+		t.Errorf("Expected a null value without match, got %v", value)
+	}
+
+	resp, _ = extractRequest(t, server, target.URL+"/html", &common.ExtractOptions{
+		Regex: map[string]string{"prices": `\$(?P<dollars>\d+)\.(?P<cents>\d+)`},
+		All:   true,
+	})
+	prices, ok := resp.Extracted["prices"].([]any)
+	if !ok || len(prices) != 2 {
+		t.Fatalf("Expected two prices, got %v", resp.Extracted["prices"])
+	}
+	if first, ok := prices[0].(map[string]any); !ok || first["dollars"] != "19" || first["cents"] != "99" {
+		t.Errorf("Expected named groups, got %v", prices[0])
+	}
+
+	resp, status = extractRequest(t, server, target.URL+"/html", &common.ExtractOptions{
+		Regex: map[string]string{"broken": `(`},
+	})
+	if status != http.StatusInternalServerError || resp.Error == "" {
+		t.Errorf("Expected an error for an invalid pattern, got %d", status)
+	}
+}
+
+func TestExtractCSS(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	resp, status := extractRequest(t, server, target.URL+"/html", &common.ExtractOptions{
+		CSS: map[string]string{
+			"title":    "title",
+			"csrf":     `form#login input[name="csrf_token"]::attr(value)`,
+			"price":    "span.price::text",
+			"missing":  "table td",
+			"no_attr":  "title::attr(href)",
+			"username": "#login input[type=text]::attr(name)",
+		},
+		DropBody: true,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", status, resp.Error)
+	}
+
+	expected := map[string]any{
+		"title":    "azuretls mock",
+		"csrf":     "mock-csrf-token",
+		"price":    "$19.99",
+		"missing":  nil,
+		"no_attr":  nil,
+		"username": "username",
+	}
+	for name, value := range expected {
+		if actual, exists := resp.Extracted[name]; !exists || actual != value {
+			t.Errorf("Expected %s to be %v, got %v", name, value, actual)
+		}
+	}
+
+	resp, _ = extractRequest(t, server, target.URL+"/html", &common.ExtractOptions{
+		CSS: map[string]string{"prices": ".price"},
+		All: true,
+	})
+	prices, ok := resp.Extracted["prices"].([]any)
+	if !ok || len(prices) != 2 || prices[0] != "$19.99" || prices[1] != "$5.00" {
+		t.Errorf("Expected both prices, got %v", resp.Extracted["prices"])
+	}
+
+	resp, status = extractRequest(t, server, target.URL+"/html", &common.ExtractOptions{
+		CSS: map[string]string{"broken": "div[["},
+	})
+	if status != http.StatusInternalServerError || resp.Error == "" {
+		t.Errorf("Expected an error for an invalid selector, got %d", status)
+	}
+}
@@ -0,0 +1,189 @@
+package test_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const chromeUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36"
+
+// captureClientHello returns the TLS record holding the ClientHello sent
+// by a crypto/tls client
+func captureClientHello(t *testing.T) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go tls.Client(client, &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}}).Handshake()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatalf("Failed to read ClientHello record: %v", err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatalf("Failed to read ClientHello record: %v", err)
+	}
+	client.Close()
+
+	return record
+}
+
+// captureHTTP2Frames returns the frames Chrome sends to open a connection
+// and its first request
+func captureHTTP2Frames(t *testing.T) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(http2.ClientPreface)
+
+	framer := http2.NewFramer(&buf, nil)
+	framer.WriteSettings(
+		http2.Setting{ID: http2.SettingHeaderTableSize, Val: 65536},
+		http2.Setting{ID: http2.SettingEnablePush, Val: 0},
+		http2.Setting{ID: http2.SettingInitialWindowSize, Val: 6291456},
+		http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: 262144},
+	)
+	framer.WriteWindowUpdate(0, 15663105)
+
+	var block bytes.Buffer
+	encoder := hpack.NewEncoder(&block)
+	for _, field := range [][]string{
+		{":method", "GET"}, {":authority", "example.com"}, {":scheme", "https"}, {":path", "/"},
+		{"user-agent", chromeUserAgent}, {"accept", "text/html"}, {"cookie", "a=b"}, {"accept-language", "en-US"},
+	} {
+		encoder.WriteField(hpack.HeaderField{Name: field[0], Value: field[1]})
+	}
+	if err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: block.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+		Priority:      http2.PriorityParam{Weight: 255, Exclusive: true},
+	}); err != nil {
+		t.Fatalf("Failed to write HEADERS frame: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestDeriveFingerprint(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+
+	server := httptest.NewServer(newAPIHandler(t, config, nil))
+	defer server.Close()
+
+	derive := func(query string, body any) (int, common.DerivedFingerprint) {
+		data, _ := json.Marshal(body)
+		resp, err := http.Post(server.URL+"/api/v1/fingerprint/derive"+query, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to derive fingerprint: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var derived common.DerivedFingerprint
+		json.NewDecoder(resp.Body).Decode(&derived)
+		return resp.StatusCode, derived
+	}
+
+	har := map[string]any{
+		"log": map[string]any{
+			"entries": []any{
+				map[string]any{"request": map[string]any{"method": "GET", "url": "data:image/png;base64,", "headers": []any{}}},
+				map[string]any{"request": map[string]any{
+					"method":      "GET",
+					"url":         "https://example.com/",
+					"httpVersion": "http/2.0",
+					"headers": []map[string]string{
+						{"name": ":method", "value": "GET"},
+						{"name": ":authority", "value": "example.com"},
+						{"name": ":scheme", "value": "https"},
+						{"name": ":path", "value": "/"},
+						{"name": "sec-ch-ua-platform", "value": `"Windows"`},
+						{"name": "User-Agent", "value": chromeUserAgent},
+						{"name": "cookie", "value": "session=1"},
+						{"name": "accept", "value": "*/*"},
+					},
+				}},
+			},
+		},
+	}
+
+	t.Run("har", func(t *testing.T) {
+		status, derived := derive("", har)
+		if status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+
+		expected := [][]string{{"sec-ch-ua-platform", `"Windows"`}, {"user-agent", chromeUserAgent}, {"accept", "*/*"}}
+		profile := derived.Profile
+		if !slices.EqualFunc(profile.OrderedHeaders, expected, slices.Equal) {
+			t.Errorf("Expected ordered headers %v, got %v", expected, profile.OrderedHeaders)
+		}
+		if profile.UserAgent != chromeUserAgent || profile.Navigator != "chrome" || profile.Browser != "chrome" {
+			t.Errorf("Unexpected profile %+v", profile)
+		}
+		if strings.Join(derived.PseudoHeaderOrder, ",") != ":method,:authority,:scheme,:path" {
+			t.Errorf("Unexpected pseudo-header order %v", derived.PseudoHeaderOrder)
+		}
+		if profile.JA3 != "" || profile.HTTP2 != "" {
+			t.Errorf("Expected no TLS nor HTTP/2 fingerprint from a HAR alone, got %+v", profile)
+		}
+
+		if status, _ := derive("?url=https://example.com/missing", har); status != http.StatusUnprocessableEntity {
+			t.Errorf("Expected 422 for a URL missing from the HAR, got %d", status)
+		}
+	})
+
+	t.Run("captures", func(t *testing.T) {
+		status, derived := derive("", map[string]string{
+			"client_hello": hex.EncodeToString(captureClientHello(t)),
+			"http2_frames": hex.EncodeToString(captureHTTP2Frames(t)),
+		})
+		if status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+
+		hello := derived.ClientHello
+		if hello == nil || hello.ServerName != "example.com" || !slices.Equal(hello.ALPN, []string{"h2", "http/1.1"}) || !strings.HasPrefix(hello.JA4, "t13d") {
+			t.Fatalf("Unexpected ClientHello %+v", hello)
+		}
+		if derived.Profile.JA3 != hello.JA3 || !strings.HasPrefix(derived.Profile.JA3, "771,") {
+			t.Errorf("Expected the profile JA3 to be %q, got %q", hello.JA3, derived.Profile.JA3)
+		}
+
+		if expected := "1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p"; derived.Profile.HTTP2 != expected || derived.AkamaiHash == "" {
+			t.Errorf("Expected HTTP/2 fingerprint %q, got %q", expected, derived.Profile.HTTP2)
+		}
+		if len(derived.Profile.OrderedHeaders) != 3 || derived.Profile.UserAgent != chromeUserAgent {
+			t.Errorf("Expected the headers of the HEADERS frame, got %v", derived.Profile.OrderedHeaders)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for name, body := range map[string]map[string]string{
+			"empty":        {},
+			"hex":          {"client_hello": "zz"},
+			"client hello": {"client_hello": "0102"},
+			"frames":       {"http2_frames": "00"},
+		} {
+			if status, _ := derive("", body); status != http.StatusUnprocessableEntity {
+				t.Errorf("%s: expected 422, got %d", name, status)
+			}
+		}
+	})
+}
@@ -0,0 +1,191 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	internal_websocket "github.com/Noooste/azuretls-api/internal/websocket"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func putKeepalive(t *testing.T, server *TestServer, sessionID string, config common.KeepaliveConfig) int {
+	t.Helper()
+
+	body, _ := json.Marshal(config)
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/api/v1/session/"+sessionID+"/keepalive", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to set keepalive: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRESTKeepalive(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	t.Run("refreshes cookies", func(t *testing.T) {
+		sessionID := createTestSession(t, server)
+
+		if status := putKeepalive(t, server, sessionID, common.KeepaliveConfig{
+			URL:             target.URL + "/cookies/set?token=fresh",
+			IntervalSeconds: 1,
+		}); status != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", status)
+		}
+
+		time.Sleep(1500 * time.Millisecond)
+
+		var status common.KeepaliveStatus
+		if code := adminGet(t, server.URL, "/api/v1/session/"+sessionID+"/keepalive", "", &status); code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", code)
+		}
+		if status.Runs != 1 || status.LastStatusCode != http.StatusOK || status.Failures != 0 || status.Method != http.MethodGet {
+			t.Errorf("Unexpected keepalive status: %+v", status)
+		}
+
+		body, _ := json.Marshal(common.ServerRequest{Method: http.MethodGet, URL: target.URL + "/cookies"})
+		resp, err := http.Post(server.URL+"/api/v1/session/"+sessionID+"/request", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var serverResp common.ServerResponse
+		_ = json.NewDecoder(resp.Body).Decode(&serverResp)
+		if !strings.Contains(serverResp.Body, "fresh") {
+			t.Errorf("Expected the keepalive cookie to be sent, got %s", serverResp.Body)
+		}
+	})
+
+	t.Run("waits for idle sessions", func(t *testing.T) {
+		sessionID := createTestSession(t, server)
+		putKeepalive(t, server, sessionID, common.KeepaliveConfig{URL: target.URL + "/get", IntervalSeconds: 1})
+
+		for range 6 {
+			time.Sleep(250 * time.Millisecond)
+			sessionRequest(t, server, sessionID, target.URL+"/get")
+		}
+
+		var status common.KeepaliveStatus
+		adminGet(t, server.URL, "/api/v1/session/"+sessionID+"/keepalive", "", &status)
+		if status.Runs != 0 {
+			t.Errorf("Expected no keepalive of a busy session, got %d runs", status.Runs)
+		}
+	})
+
+	t.Run("reports failures", func(t *testing.T) {
+		sessionID := createTestSession(t, server)
+		putKeepalive(t, server, sessionID, common.KeepaliveConfig{URL: target.URL + "/status/500", IntervalSeconds: 1})
+
+		time.Sleep(1500 * time.Millisecond)
+
+		var status common.KeepaliveStatus
+		adminGet(t, server.URL, "/api/v1/session/"+sessionID+"/keepalive", "", &status)
+		if status.Failures != 1 || status.ConsecutiveFailures != 1 || len(status.Events) != 1 {
+			t.Fatalf("Expected one failure, got %+v", status)
+		}
+		if event := status.Events[0]; event.StatusCode != http.StatusInternalServerError || event.SessionID != sessionID || event.Error == "" {
+			t.Errorf("Unexpected failure event: %+v", event)
+		}
+	})
+
+	t.Run("management", func(t *testing.T) {
+		sessionID := createTestSession(t, server)
+		path := "/api/v1/session/" + sessionID + "/keepalive"
+
+		for _, config := range []common.KeepaliveConfig{
+			{URL: target.URL + "/get"},
+			{URL: "ftp://example.com/", IntervalSeconds: 60},
+		} {
+			if status := putKeepalive(t, server, sessionID, config); status != http.StatusBadRequest {
+				t.Errorf("Expected status 400 for %+v, got %d", config, status)
+			}
+		}
+		if status := putKeepalive(t, server, "unknown", common.KeepaliveConfig{URL: target.URL + "/get", IntervalSeconds: 60}); status != http.StatusNotFound {
+			t.Errorf("Expected status 404 for an unknown session, got %d", status)
+		}
+		if status := adminGet(t, server.URL, path, "", nil); status != http.StatusNotFound {
+			t.Errorf("Expected status 404 without keepalive, got %d", status)
+		}
+
+		putKeepalive(t, server, sessionID, common.KeepaliveConfig{URL: target.URL + "/get", IntervalSeconds: 60})
+
+		req, _ := http.NewRequest(http.MethodDelete, server.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to delete keepalive: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("Expected status 204, got %d", resp.StatusCode)
+		}
+		if status := adminGet(t, server.URL, path, "", nil); status != http.StatusNotFound {
+			t.Errorf("Expected status 404 once deleted, got %d", status)
+		}
+	})
+}
+
+func TestWebSocketKeepaliveFailure(t *testing.T) {
+	server := NewWebSocketTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	client, err := NewWebSocketTestClient(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.SendMessage(internal_websocket.CreateSessionMsg, "create", nil); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if _, err := client.ReadMessage(); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	if err := client.SendMessage(internal_websocket.SetKeepaliveMsg, "keepalive", common.KeepaliveConfig{
+		URL:             target.URL + "/status/503",
+		IntervalSeconds: 1,
+	}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if response, err := client.ReadMessage(); err != nil || response.Type != internal_websocket.ResponseMessage {
+		t.Fatalf("Expected the keepalive status, got %+v (%v)", response, err)
+	}
+
+	message, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read event: %v", err)
+	}
+	if message.Type != internal_websocket.KeepaliveFailedMsg {
+		t.Fatalf("Expected a keepalive_failed event, got %s", message.Type)
+	}
+
+	var event common.KeepaliveEvent
+	_ = json.Unmarshal(message.Payload, &event)
+	if event.StatusCode != http.StatusServiceUnavailable || event.ConsecutiveFailures != 1 {
+		t.Errorf("Unexpected failure event: %+v", event)
+	}
+
+	if err := client.SendMessage(internal_websocket.ClearKeepaliveMsg, "clear", nil); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	if response, err := client.ReadMessage(); err != nil || response.Type != internal_websocket.ResponseMessage {
+		t.Errorf("Expected the keepalive to be cleared, got %+v (%v)", response, err)
+	}
+}
@@ -0,0 +1,475 @@
+package test_test
+
+import (
+	"bufio"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/kerberos"
+)
+
+func TestKerberosNFold(t *testing.T) {
+	// RFC 3961 test vectors
+	tests := []struct {
+		input string
+		bits  int
+		want  string
+	}{
+		{"012345", 64, "be072631276b1955"},
+		{"password", 56, "78a07b6caf85fa"},
+		{"password", 168, "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{"kerberos", 128, "6b65726265726f737b9b5b2b93132b93"},
+	}
+
+	for _, tt := range tests {
+		if got := hex.EncodeToString(kerberos.NFold([]byte(tt.input), tt.bits)); got != tt.want {
+			t.Errorf("%d-fold(%q) = %s, expected %s", tt.bits, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestKerberosStringToKey(t *testing.T) {
+	// RFC 3962 test vectors. RFC 8009 ones are left out, its encryption
+	// types not being offered to the KDC.
+	gClef := string(rune(0x1d11e))
+	tests := []struct {
+		etype      int32
+		iterations uint32
+		password   string
+		salt       string
+		want       string
+	}{
+		{kerberos.AES128CTSHMACSHA196, 1, "password", "ATHENA.MIT.EDUraeburn", "42263c6e89f4fc28b8df68ee09799f15"},
+		{kerberos.AES256CTSHMACSHA196, 1, "password", "ATHENA.MIT.EDUraeburn", "fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161"},
+		{kerberos.AES128CTSHMACSHA196, 2, "password", "ATHENA.MIT.EDUraeburn", "c651bf29e2300ac27fa469d693bdda13"},
+		{kerberos.AES256CTSHMACSHA196, 2, "password", "ATHENA.MIT.EDUraeburn", "a2e16d16b36069c135d5e9d2e25f896102685618b95914b467c67622225824ff"},
+		{kerberos.AES128CTSHMACSHA196, 1200, "password", "ATHENA.MIT.EDUraeburn", "4c01cd46d632d01e6dbe230a01ed642a"},
+		{kerberos.AES256CTSHMACSHA196, 1200, "password", "ATHENA.MIT.EDUraeburn", "55a6ac740ad17b4846941051e1e8b0a7548d93b0ab30a8bc3ff16280382b8c2a"},
+		{kerberos.AES128CTSHMACSHA196, 5, "password", "\x12\x34\x56\x78\x78\x56\x34\x12", "e9b23d52273747dd5c35cb55be619d8e"},
+		{kerberos.AES256CTSHMACSHA196, 5, "password", "\x12\x34\x56\x78\x78\x56\x34\x12", "97a4e786be20d81a382d5ebc96d5909cabcdadc87ca48f574504159f16c36e31"},
+		{kerberos.AES128CTSHMACSHA196, 1200, strings.Repeat("X", 64), "pass phrase equals block size", "59d1bb789a828b1aa54ef9c2883f69ed"},
+		{kerberos.AES256CTSHMACSHA196, 1200, strings.Repeat("X", 64), "pass phrase equals block size", "89adee3608db8bc71f1bfbfe459486b05618b70cbae22092534e56c553ba4b34"},
+		{kerberos.AES128CTSHMACSHA196, 1200, strings.Repeat("X", 65), "pass phrase exceeds block size", "cb8005dc5f90179a7f02104c0018751d"},
+		{kerberos.AES256CTSHMACSHA196, 1200, strings.Repeat("X", 65), "pass phrase exceeds block size", "d78c5c9cb872a8c9dad4697f0bb5b2d21496c82beb2caeda2112fceea057401b"},
+		{kerberos.AES128CTSHMACSHA196, 50, gClef, "EXAMPLE.COMpianist", "f149c1f2e154a73452d43e7fe62a56e5"},
+		{kerberos.AES256CTSHMACSHA196, 50, gClef, "EXAMPLE.COMpianist", "4b6d9839f84406df1f09cc166db4b83c571848b784a3d6bdc346589a3e393f9e"},
+	}
+
+	for _, tt := range tests {
+		params := binary.BigEndian.AppendUint32(nil, tt.iterations)
+		key, err := kerberos.StringToKey(tt.etype, tt.password, tt.salt, params)
+		if err != nil {
+			t.Fatalf("StringToKey failed: %v", err)
+		}
+		if got := hex.EncodeToString(key.Value); got != tt.want {
+			t.Errorf("Key of etype %d for %q salted with %q, %d iterations = %s, expected %s", tt.etype, tt.password, tt.salt, tt.iterations, got, tt.want)
+		}
+	}
+
+	if _, err := kerberos.StringToKey(23, "password", "salt", nil); !errors.Is(err, kerberos.ErrUnsupportedEType) {
+		t.Errorf("Expected RC4 to be unsupported, got %v", err)
+	}
+}
+
+func TestKerberosCTS(t *testing.T) {
+	// RFC 3962 test vectors, with the key "chicken teriyaki"
+	key := []byte("chicken teriyaki")
+	plaintext := "I would like the General Gau's Chicken, please, and wonton soup."
+	tests := []struct {
+		size int
+		want string
+	}{
+		{17, "c6353568f2bf8cb4d8a580362da7ff7f97"},
+		{31, "fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5"},
+		{32, "39312523a78662d5be7fcbcc98ebf5a897687268d6ecccc0c07b25e25ecfe584"},
+		{47, "97687268d6ecccc0c07b25e25ecfe584b3fffd940c16a18c1b5549d2f838029e39312523a78662d5be7fcbcc98ebf5"},
+		{48, "97687268d6ecccc0c07b25e25ecfe5849dad8bbb96c4cdc03bc103e1a194bbd839312523a78662d5be7fcbcc98ebf5a8"},
+		{64, "97687268d6ecccc0c07b25e25ecfe58439312523a78662d5be7fcbcc98ebf5a84807efe836ee89a526730dbc2f7bc8409dad8bbb96c4cdc03bc103e1a194bbd8"},
+	}
+
+	for _, tt := range tests {
+		ciphertext, err := kerberos.EncryptCTS(key, []byte(plaintext[:tt.size]))
+		if err != nil {
+			t.Fatalf("EncryptCTS failed: %v", err)
+		}
+		if got := hex.EncodeToString(ciphertext); got != tt.want {
+			t.Errorf("Encryption of %d bytes = %s, expected %s", tt.size, got, tt.want)
+		}
+
+		decrypted, err := kerberos.DecryptCTS(key, ciphertext)
+		if err != nil || string(decrypted) != plaintext[:tt.size] {
+			t.Errorf("Decryption of %d bytes returned %q, %v", tt.size, decrypted, err)
+		}
+	}
+}
+
+func TestKerberosEncrypt(t *testing.T) {
+	for _, etype := range kerberos.SupportedETypes {
+		key, err := kerberos.NewKey(etype)
+		if err != nil {
+			t.Fatalf("Failed to create key: %v", err)
+		}
+
+		// Lengths around the block size exercise the ciphertext stealing
+		for _, size := range []int{0, 1, 15, 16, 17, 31, 32, 100} {
+			plaintext := []byte(strings.Repeat("k", size))
+			ciphertext, err := key.Encrypt(kerberos.UsageTicket, plaintext)
+			if err != nil {
+				t.Fatalf("Encrypt failed: %v", err)
+			}
+
+			decrypted, err := key.Decrypt(kerberos.UsageTicket, ciphertext)
+			if err != nil || string(decrypted) != string(plaintext) {
+				t.Errorf("Decrypt of %d bytes returned %q, %v", size, decrypted, err)
+			}
+			if _, err := key.Decrypt(kerberos.UsageASRepEncPart, ciphertext); !errors.Is(err, kerberos.ErrIntegrity) {
+				t.Errorf("Expected a decryption with another usage to fail, got %v", err)
+			}
+		}
+	}
+}
+
+// fakeKDC issues tickets to alice@CORP.EXAMPLE.COM, whose password is
+// secret, for the services it has keys for. It counts the exchanges.
+type fakeKDC struct {
+	addr     string
+	tgtKey   kerberos.Key
+	services map[string]kerberos.Key
+	userKey  kerberos.Key
+
+	asExchanges  int32
+	tgsExchanges int32
+}
+
+const fakeKerberosRealm = "CORP.EXAMPLE.COM"
+
+func startFakeKDC(t *testing.T, services ...string) *fakeKDC {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	kdc := &fakeKDC{addr: listener.Addr().String(), services: make(map[string]kerberos.Key)}
+	if kdc.tgtKey, err = kerberos.NewKey(kerberos.AES256CTSHMACSHA196); err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	for _, service := range services {
+		if kdc.services[service], err = kerberos.NewKey(kerberos.AES256CTSHMACSHA196); err != nil {
+			t.Fatalf("Failed to create key: %v", err)
+		}
+	}
+	if kdc.userKey, err = kerberos.StringToKey(kerberos.AES256CTSHMACSHA196, "secret", fakeKerberosRealm+"alice", nil); err != nil {
+		t.Fatalf("Failed to derive key: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go kdc.serve(conn)
+		}
+	}()
+
+	return kdc
+}
+
+func (kdc *fakeKDC) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var length [4]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return
+	}
+
+	var req kerberos.KDCReq
+	tag, err := kerberos.Unmarshal(msg, &req, kerberos.TagASReq, kerberos.TagTGSReq)
+	if err != nil {
+		return
+	}
+	var body kerberos.KDCReqBody
+	if _, err := asn1.Unmarshal(req.ReqBody.Bytes, &body); err != nil {
+		return
+	}
+
+	var resp []byte
+	if tag == kerberos.TagASReq {
+		atomic.AddInt32(&kdc.asExchanges, 1)
+		resp, err = kdc.asReply(req, body)
+	} else {
+		atomic.AddInt32(&kdc.tgsExchanges, 1)
+		resp, err = kdc.tgsReply(req, body)
+	}
+
+	var krbErr *kerberos.KRBError
+	if errors.As(err, &krbErr) {
+		krbErr.PVNO, krbErr.MsgType = 5, kerberos.TagKRBError
+		krbErr.STime, krbErr.Realm = time.Now().UTC().Truncate(time.Second), fakeKerberosRealm
+		krbErr.SName = body.SName
+		resp, err = kerberos.Marshal(*krbErr, kerberos.TagKRBError)
+	}
+	if err != nil {
+		return
+	}
+
+	_, _ = conn.Write(binary.BigEndian.AppendUint32(nil, uint32(len(resp))))
+	_, _ = conn.Write(resp)
+}
+
+// asReply answers an AS-REQ, requiring pre-authentication with an
+// encrypted timestamp
+func (kdc *fakeKDC) asReply(req kerberos.KDCReq, body kerberos.KDCReqBody) ([]byte, error) {
+	if body.Realm != fakeKerberosRealm || strings.Join(body.CName.NameString, "/") != "alice" {
+		return nil, &kerberos.KRBError{ErrorCode: 6}
+	}
+
+	var timestamp []byte
+	for _, pa := range req.PAData {
+		if pa.Type == kerberos.PAEncTimestamp {
+			timestamp = pa.Value
+		}
+	}
+	if timestamp == nil {
+		info, _ := asn1.Marshal([]kerberos.ETypeInfo2Entry{{EType: kerberos.AES256CTSHMACSHA196, Salt: fakeKerberosRealm + "alice"}})
+		methods, _ := asn1.Marshal([]kerberos.PAData{{Type: kerberos.PAETypeInfo2, Value: info}})
+		return nil, &kerberos.KRBError{ErrorCode: kerberos.ErrPreauthRequired, EData: methods}
+	}
+
+	var encrypted kerberos.EncryptedData
+	if _, err := asn1.Unmarshal(timestamp, &encrypted); err != nil {
+		return nil, err
+	}
+	plain, err := kdc.userKey.Decrypt(kerberos.UsageASReqTimestamp, encrypted.Cipher)
+	if err != nil {
+		return nil, &kerberos.KRBError{ErrorCode: kerberos.ErrPreauthFailed}
+	}
+	var ts kerberos.PAEncTSEnc
+	if _, err := asn1.Unmarshal(plain, &ts); err != nil || time.Since(ts.Timestamp).Abs() > 5*time.Minute {
+		return nil, &kerberos.KRBError{ErrorCode: kerberos.ErrPreauthFailed}
+	}
+
+	return kdc.reply(kerberos.TagASRep, body, kdc.tgtKey, kdc.userKey, kerberos.UsageASRepEncPart)
+}
+
+// tgsReply answers a TGS-REQ authenticated with a ticket granting ticket,
+// whose authenticator must checksum the request body
+func (kdc *fakeKDC) tgsReply(req kerberos.KDCReq, body kerberos.KDCReqBody) ([]byte, error) {
+	if len(req.PAData) != 1 || req.PAData[0].Type != kerberos.PATGSReq {
+		return nil, &kerberos.KRBError{ErrorCode: 16}
+	}
+
+	ticket, authenticator, err := acceptAPReq(req.PAData[0].Value, kdc.tgtKey, kerberos.UsageTGSReqAuthenticator)
+	if err != nil {
+		return nil, &kerberos.KRBError{ErrorCode: 31}
+	}
+
+	sum, err := ticket.Key.Checksum(kerberos.UsageTGSReqChecksum, req.ReqBody.Bytes)
+	if err != nil || string(sum) != string(authenticator.Checksum.Checksum) {
+		return nil, &kerberos.KRBError{ErrorCode: 31}
+	}
+
+	key, ok := kdc.services[strings.Join(body.SName.NameString, "/")]
+	if !ok {
+		return nil, &kerberos.KRBError{ErrorCode: 7}
+	}
+	return kdc.reply(kerberos.TagTGSRep, body, key, ticket.Key, kerberos.UsageTGSRepEncPart)
+}
+
+// reply issues a ticket encrypted with serviceKey, its session key being
+// sent encrypted with replyKey
+func (kdc *fakeKDC) reply(tag int, body kerberos.KDCReqBody, serviceKey, replyKey kerberos.Key, usage uint32) ([]byte, error) {
+	sessionKey, err := kerberos.NewKey(kerberos.AES256CTSHMACSHA196)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	end := now.Add(time.Hour)
+	cname := kerberos.PrincipalName{NameType: kerberos.NameTypePrincipal, NameString: []string{"alice"}}
+
+	encTicket, err := kerberos.Marshal(kerberos.EncTicketPart{
+		Flags:    asn1.BitString{Bytes: make([]byte, 4), BitLength: 32},
+		Key:      sessionKey,
+		CRealm:   fakeKerberosRealm,
+		CName:    cname,
+		AuthTime: now,
+		EndTime:  end,
+	}, kerberos.TagEncTicketPart)
+	if err != nil {
+		return nil, err
+	}
+	ticketCipher, err := serviceKey.Encrypt(kerberos.UsageTicket, encTicket)
+	if err != nil {
+		return nil, err
+	}
+	ticket, err := kerberos.Marshal(kerberos.Ticket{
+		TktVNO:  5,
+		Realm:   fakeKerberosRealm,
+		SName:   body.SName,
+		EncPart: kerberos.EncryptedData{EType: serviceKey.Type, Cipher: ticketCipher},
+	}, kerberos.TagTicket)
+	if err != nil {
+		return nil, err
+	}
+
+	encPart, err := kerberos.Marshal(kerberos.EncKDCRepPart{
+		Key:      sessionKey,
+		Nonce:    body.Nonce,
+		Flags:    asn1.BitString{Bytes: make([]byte, 4), BitLength: 32},
+		AuthTime: now,
+		EndTime:  end,
+		SRealm:   fakeKerberosRealm,
+		SName:    body.SName,
+	}, kerberos.TagEncASRepPart)
+	if err != nil {
+		return nil, err
+	}
+	repCipher, err := replyKey.Encrypt(usage, encPart)
+	if err != nil {
+		return nil, err
+	}
+
+	return kerberos.Marshal(kerberos.KDCRep{
+		PVNO:    5,
+		MsgType: tag,
+		CRealm:  fakeKerberosRealm,
+		CName:   cname,
+		Ticket:  kerberos.Field(5, ticket),
+		EncPart: kerberos.EncryptedData{EType: replyKey.Type, Cipher: repCipher},
+	}, tag)
+}
+
+// acceptAPReq decrypts the ticket of an AP-REQ with the service key, then
+// the authenticator with the session key of the ticket
+func acceptAPReq(msg []byte, serviceKey kerberos.Key, usage uint32) (*kerberos.EncTicketPart, *kerberos.Authenticator, error) {
+	var apReq kerberos.APReq
+	if _, err := kerberos.Unmarshal(msg, &apReq, kerberos.TagAPReq); err != nil {
+		return nil, nil, err
+	}
+
+	var ticket kerberos.Ticket
+	if _, err := kerberos.Unmarshal(apReq.Ticket.Bytes, &ticket, kerberos.TagTicket); err != nil {
+		return nil, nil, err
+	}
+	plain, err := serviceKey.Decrypt(kerberos.UsageTicket, ticket.EncPart.Cipher)
+	if err != nil {
+		return nil, nil, err
+	}
+	encTicket := new(kerberos.EncTicketPart)
+	if _, err := kerberos.Unmarshal(plain, encTicket, kerberos.TagEncTicketPart); err != nil {
+		return nil, nil, err
+	}
+
+	plain, err = encTicket.Key.Decrypt(usage, apReq.Authenticator.Cipher)
+	if err != nil {
+		return nil, nil, err
+	}
+	authenticator := new(kerberos.Authenticator)
+	if _, err := kerberos.Unmarshal(plain, authenticator, kerberos.TagAuthenticator); err != nil {
+		return nil, nil, err
+	}
+	if authenticator.CRealm != encTicket.CRealm || strings.Join(authenticator.CName.NameString, "/") != strings.Join(encTicket.CName.NameString, "/") {
+		return nil, nil, fmt.Errorf("authenticator of another client")
+	}
+	return encTicket, authenticator, nil
+}
+
+// startFakeNegotiateProxy tunnels CONNECT requests carrying a SPNEGO token
+// with a Kerberos ticket for the service key. It counts the tunnels opened.
+func startFakeNegotiateProxy(t *testing.T, serviceKey kerberos.Key, tunnels *int32) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeNegotiateProxy(conn, serviceKey, tunnels)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveFakeNegotiateProxy(conn net.Conn, serviceKey kerberos.Key, tunnels *int32) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+
+	scheme, token, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	decoded, _ := base64.StdEncoding.DecodeString(token)
+	if scheme != "Negotiate" || acceptNegotiate(decoded, serviceKey) != nil {
+		fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Negotiate\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return
+	}
+
+	target, err := net.Dial("tcp", req.Host)
+	if err != nil {
+		fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+		return
+	}
+	defer target.Close()
+
+	atomic.AddInt32(tunnels, 1)
+	fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+	go io.Copy(target, reader)
+	_, _ = io.Copy(conn, target)
+}
+
+// acceptNegotiate checks a SPNEGO token offering Kerberos, whose mechanism
+// token is an AP-REQ
+func acceptNegotiate(token []byte, serviceKey kerberos.Key) error {
+	mech, inner, err := kerberos.ParseInitialContextToken(token)
+	if err != nil || !mech.Equal(kerberos.OIDSPNEGO) {
+		return fmt.Errorf("not a SPNEGO token")
+	}
+
+	var init kerberos.NegTokenInit
+	if _, err := asn1.UnmarshalWithParams(inner, &init, "explicit,tag:0"); err != nil {
+		return err
+	}
+	if len(init.MechTypes) == 0 || !init.MechTypes[0].Equal(kerberos.OIDKerberos) {
+		return fmt.Errorf("kerberos not offered")
+	}
+
+	mech, inner, err = kerberos.ParseInitialContextToken(init.MechToken)
+	if err != nil || !mech.Equal(kerberos.OIDKerberos) || len(inner) < 2 || inner[0] != 1 || inner[1] != 0 {
+		return fmt.Errorf("not a Kerberos AP-REQ")
+	}
+
+	_, authenticator, err := acceptAPReq(inner[2:], serviceKey, kerberos.UsageAPReqAuthenticator)
+	if err != nil {
+		return err
+	}
+	if authenticator.Checksum.Type != kerberos.GSSAPIChecksum {
+		return fmt.Errorf("authenticator without GSS-API checksum")
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-client"
+)
+
+// mapSessionManager implements the session manager from scratch with the
+// types of the api package alone, as an embedding service outside this
+// module would
+type mapSessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*azuretls.Session
+	configs  map[string]api.SessionConfig
+	history  map[string][]api.SentRequest
+	started  bool
+}
+
+var (
+	_ api.SessionManager          = (*mapSessionManager)(nil)
+	_ api.SessionManagerLifecycle = (*mapSessionManager)(nil)
+)
+
+var errNoSession = errors.New("session not found")
+
+func newMapSessionManager() *mapSessionManager {
+	return &mapSessionManager{
+		sessions: make(map[string]*azuretls.Session),
+		configs:  make(map[string]api.SessionConfig),
+		history:  make(map[string][]api.SentRequest),
+	}
+}
+
+func (m *mapSessionManager) Start(config api.Config, profiles api.ProfileCatalog) error {
+	m.started = true
+	return nil
+}
+
+func (m *mapSessionManager) Stop() error {
+	return nil
+}
+
+func (m *mapSessionManager) CreateSession(sessionID string) (*azuretls.Session, error) {
+	return m.CreateSessionWithConfig(sessionID, nil)
+}
+
+func (m *mapSessionManager) CreateSessionWithConfig(sessionID string, config *api.SessionConfig) (*azuretls.Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.sessions[sessionID]; exists {
+		return nil, errors.New("session already exists")
+	}
+
+	session := azuretls.NewSession()
+	if config != nil {
+		if config.Browser != "" {
+			session.Browser = config.Browser
+		}
+		m.configs[sessionID] = *config
+	}
+	m.sessions[sessionID] = session
+	return session, nil
+}
+
+func (m *mapSessionManager) GetSession(sessionID string) (*azuretls.Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, exists := m.sessions[sessionID]
+	return session, exists
+}
+
+func (m *mapSessionManager) session(sessionID string) (*azuretls.Session, error) {
+	if session, exists := m.GetSession(sessionID); exists {
+		return session, nil
+	}
+	return nil, errNoSession
+}
+
+func (m *mapSessionManager) DeleteSession(sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, exists := m.sessions[sessionID]
+	if !exists {
+		return errNoSession
+	}
+	session.Close()
+	delete(m.sessions, sessionID)
+	delete(m.configs, sessionID)
+	delete(m.history, sessionID)
+	return nil
+}
+
+func (m *mapSessionManager) ListSessions() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]string, 0, len(m.sessions))
+	for id := range m.sessions {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (m *mapSessionManager) CleanupSessions() error {
+	for _, id := range m.ListSessions() {
+		_ = m.DeleteSession(id)
+	}
+	return nil
+}
+
+func (m *mapSessionManager) ApplyJA3(sessionID, ja3, navigator string) error {
+	session, err := m.session(sessionID)
+	if err != nil {
+		return err
+	}
+	return session.ApplyJa3(ja3, navigator)
+}
+
+func (m *mapSessionManager) ApplyHTTP2(sessionID, fingerprint string) error {
+	session, err := m.session(sessionID)
+	if err != nil {
+		return err
+	}
+	return session.ApplyHTTP2(fingerprint)
+}
+
+func (m *mapSessionManager) ApplyHTTP3(sessionID, fingerprint string) error {
+	session, err := m.session(sessionID)
+	if err != nil {
+		return err
+	}
+	return session.ApplyHTTP3(fingerprint)
+}
+
+func (m *mapSessionManager) SetProxy(sessionID, proxy string) error {
+	session, err := m.session(sessionID)
+	if err != nil {
+		return err
+	}
+	return session.SetProxy(proxy)
+}
+
+func (m *mapSessionManager) ClearProxy(sessionID string) error {
+	session, err := m.session(sessionID)
+	if err != nil {
+		return err
+	}
+	session.ClearProxy()
+	return nil
+}
+
+func (m *mapSessionManager) AddPins(sessionID, urlStr string, pins []string) error {
+	session, err := m.session(sessionID)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+	return session.AddPins(u, pins)
+}
+
+func (m *mapSessionManager) ClearPins(sessionID, urlStr string) error {
+	session, err := m.session(sessionID)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+	return session.ClearPins(u)
+}
+
+func (m *mapSessionManager) GetIP(sessionID string) (*api.IPInfo, error) {
+	return nil, errors.New("not supported")
+}
+
+func (m *mapSessionManager) GetDNSCache(sessionID string) ([]api.DNSCacheEntry, error) {
+	if _, err := m.session(sessionID); err != nil {
+		return nil, err
+	}
+	return []api.DNSCacheEntry{}, nil
+}
+
+func (m *mapSessionManager) FlushDNSCache(sessionID string) (int, error) {
+	_, err := m.session(sessionID)
+	return 0, err
+}
+
+func (m *mapSessionManager) ClearTLSTickets(sessionID string) (int, error) {
+	_, err := m.session(sessionID)
+	return 0, err
+}
+
+func (m *mapSessionManager) GetConnections(sessionID string) ([]api.SessionConnection, error) {
+	if _, err := m.session(sessionID); err != nil {
+		return nil, err
+	}
+	return []api.SessionConnection{{Host: "example.test:443", Protocol: "HTTP/2.0"}}, nil
+}
+
+func (m *mapSessionManager) GetSessionTags(sessionID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.sessions[sessionID]; !exists {
+		return nil, errNoSession
+	}
+	return m.configs[sessionID].Tags, nil
+}
+
+func (m *mapSessionManager) RecordRequest(sessionID string, req api.SentRequest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if config := m.configs[sessionID]; config.History {
+		m.history[sessionID] = append([]api.SentRequest{req}, m.history[sessionID]...)
+	}
+}
+
+func (m *mapSessionManager) GetRequestHistory(sessionID string) ([]api.SentRequest, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.sessions[sessionID]; !exists {
+		return nil, errNoSession
+	}
+	return m.history[sessionID], nil
+}
+
+func TestSessionManagerFromScratch(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+
+	manager := newMapSessionManager()
+	handler := newAPIHandler(t, config, manager)
+	defer handler.(io.Closer).Close()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	if !manager.started {
+		t.Fatal("Expected the manager to be started")
+	}
+
+	sessionConfig := api.SessionConfig{
+		Tags:     []string{"scratch"},
+		QUIC:     &api.QUICConfig{},
+		Rotation: &api.RotationPolicy{},
+		Dial:     &api.DialConfig{},
+	}
+	body, _ := json.Marshal(sessionConfig)
+	created, err := http.Post(server.URL+"/api/v1/session/create", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	var result map[string]string
+	_ = json.NewDecoder(created.Body).Decode(&result)
+	created.Body.Close()
+	sessionID := result["session_id"]
+	if _, exists := manager.GetSession(sessionID); !exists {
+		t.Fatalf("Expected the session to be created by the manager, got %v", result)
+	}
+
+	resp, err := http.Get(server.URL + "/api/v1/session/" + sessionID + "/connections")
+	if err != nil {
+		t.Fatalf("Failed to get connections: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var connections struct {
+		Connections []api.SessionConnection `json:"connections"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&connections)
+	if len(connections.Connections) != 1 || connections.Connections[0].Host != "example.test:443" {
+		t.Errorf("Expected the connections of the manager, got %d: %+v", resp.StatusCode, connections)
+	}
+}
@@ -0,0 +1,156 @@
+package test_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/mock"
+	"github.com/Noooste/azuretls-client"
+)
+
+func TestMockEcho(t *testing.T) {
+	target := mock.NewServer()
+	defer target.Close()
+
+	session := azuretls.NewSession()
+	defer session.Close()
+
+	resp, err := session.Post(target.URL+"/post?a=1", `{"key":"value"}`)
+	if err != nil {
+		t.Fatalf("Failed to request mock target: %v", err)
+	}
+
+	var echo mock.EchoResponse
+	if err := json.Unmarshal(resp.Body, &echo); err != nil {
+		t.Fatalf("Failed to decode echo response: %v", err)
+	}
+
+	if echo.Method != http.MethodPost || echo.Args.Get("a") != "1" {
+		t.Errorf("Unexpected method %q or args %v", echo.Method, echo.Args)
+	}
+
+	if decoded, ok := echo.JSON.(map[string]any); !ok || decoded["key"] != "value" {
+		t.Errorf("Expected JSON body to be echoed, got %v", echo.JSON)
+	}
+}
+
+func TestMockRedirectsAndCookies(t *testing.T) {
+	target := mock.NewTLSServer()
+	defer target.Close()
+
+	session := azuretls.NewSession()
+	defer session.Close()
+	session.InsecureSkipVerify = true
+
+	resp, err := session.Get(target.URL + "/redirect/3")
+	if err != nil {
+		t.Fatalf("Failed to follow redirects: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.HasSuffix(resp.Url, "/get") {
+		t.Errorf("Expected to land on /get, got %d at %s", resp.StatusCode, resp.Url)
+	}
+
+	resp, err = session.Get(target.URL + "/cookies/set?flavor=chocolate")
+	if err != nil {
+		t.Fatalf("Failed to set cookies: %v", err)
+	}
+
+	var cookies struct {
+		Cookies map[string]string `json:"cookies"`
+	}
+	if err := json.Unmarshal(resp.Body, &cookies); err != nil {
+		t.Fatalf("Failed to decode cookies: %v", err)
+	}
+	if cookies.Cookies["flavor"] != "chocolate" {
+		t.Errorf("Expected cookie to be sent back, got %v", cookies.Cookies)
+	}
+}
+
+func TestMockCompressedBodies(t *testing.T) {
+	// fhttp deadlocks when decoding zlib deflate bodies over HTTP/1.1, use HTTP/2
+	target := mock.NewTLSServer()
+	defer target.Close()
+
+	session := azuretls.NewSession()
+	defer session.Close()
+	session.InsecureSkipVerify = true
+
+	for _, path := range []string{"/gzip", "/deflate", "/brotli", "/zstd"} {
+		resp, err := session.Get(target.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to request %s: %v", path, err)
+		}
+
+		var echo mock.EchoResponse
+		if err := json.Unmarshal(resp.Body, &echo); err != nil {
+			t.Errorf("Failed to decode %s body: %v", path, err)
+			continue
+		}
+		if echo.Encoding == "" {
+			t.Errorf("Expected %s to report its encoding", path)
+		}
+	}
+}
+
+func TestMockStreamAndDelay(t *testing.T) {
+	target := mock.NewServer()
+	defer target.Close()
+
+	session := azuretls.NewSession()
+	defer session.Close()
+
+	resp, err := session.Get(target.URL + "/stream/5")
+	if err != nil {
+		t.Fatalf("Failed to request stream: %v", err)
+	}
+	if lines := strings.Count(string(resp.Body), "\n"); lines != 5 {
+		t.Errorf("Expected 5 streamed lines, got %d", lines)
+	}
+
+	_, err = session.Do(&azuretls.Request{
+		Method:  http.MethodGet,
+		Url:     target.URL + "/delay/2",
+		TimeOut: 200 * time.Millisecond,
+	})
+	if err == nil {
+		t.Error("Expected slow response to time out")
+	}
+
+	for _, code := range []string{"0", "99", "600"} {
+		resp, err = session.Get(target.URL + "/drip?numbytes=1&duration=0&code=" + code)
+		if err != nil {
+			t.Fatalf("Failed to request drip: %v", err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for drip code %s, got %d", code, resp.StatusCode)
+		}
+	}
+}
+
+func TestMockRateLimit(t *testing.T) {
+	target := mock.NewServer()
+	defer target.Close()
+
+	session := azuretls.NewSession()
+	defer session.Close()
+
+	var statuses []int
+	for i := 0; i < 3; i++ {
+		resp, err := session.Get(target.URL + "/rate-limit/2?key=test")
+		if err != nil {
+			t.Fatalf("Failed to request rate-limited endpoint: %v", err)
+		}
+		statuses = append(statuses, resp.StatusCode)
+
+		if resp.StatusCode == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Error("Expected Retry-After on 429 responses")
+		}
+	}
+
+	if statuses[0] != 200 || statuses[1] != 200 || statuses[2] != 429 {
+		t.Errorf("Expected 200, 200, 429, got %v", statuses)
+	}
+}
@@ -0,0 +1,230 @@
+package test_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/mock"
+	"github.com/Noooste/azuretls-api/plugin"
+)
+
+// TestMain lets the test binary run as the plugin of TestPlugins
+func TestMain(m *testing.M) {
+	if os.Getenv("AZURETLS_TEST_PLUGIN") == "1" {
+		if err := plugin.Serve(testPlugin()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func testPlugin() plugin.Plugin {
+	return plugin.Plugin{
+		Version: "1.2.3",
+		MutateRequest: func(req *plugin.MutateRequest) error {
+			if strings.Contains(req.Request.URL, "forbidden") {
+				return fmt.Errorf("target not allowed")
+			}
+			signature := "signed:" + req.Request.Method
+			if req.DryRun {
+				signature = "dry:" + req.Request.Method
+			}
+			req.Request.Headers.Set("X-Signature", signature)
+			return nil
+		},
+		Authenticate: func(req *plugin.AuthenticateRequest) (plugin.AuthenticateResponse, error) {
+			switch req.Header.Get("X-Site-Token") {
+			case "good":
+				return plugin.AuthenticateResponse{APIKey: "secret"}, nil
+			case "banned":
+				return plugin.AuthenticateResponse{Deny: "token banned"}, nil
+			case "broken":
+				return plugin.AuthenticateResponse{}, fmt.Errorf("provider down")
+			}
+			if req.Header.Get("X-API-Key") != "" {
+				return plugin.AuthenticateResponse{Deny: "api key forwarded"}, nil
+			}
+			return plugin.AuthenticateResponse{}, nil
+		},
+		Endpoints: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"path":       r.URL.Path,
+				"key":        r.Header.Get(plugin.KeyNameHeader),
+				"request_id": r.Header.Get("X-Request-ID"),
+				"api_key":    r.Header.Get("X-API-Key") + r.Header.Get("Authorization") + r.URL.Query().Get("api_key"),
+			})
+		}),
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test plugin is a shell script")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Failed to locate the test binary: %v", err)
+	}
+
+	dir := t.TempDir()
+	script := fmt.Sprintf("#!/bin/sh\nAZURETLS_TEST_PLUGIN=1 exec %q\n", executable)
+	if err := os.WriteFile(filepath.Join(dir, "signer.sh"), []byte(script), 0o755); err != nil {
+		t.Fatalf("Failed to write plugin: %v", err)
+	}
+	writeFile(t, filepath.Join(dir, "README.txt"), "not executable, not a plugin")
+
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.PluginsDir = dir
+	config.APIKeys = []api.APIKeyConfig{{Key: "secret", Name: "tenant-a", Admin: true}}
+
+	handler := newAPIHandler(t, config, nil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	send := func(method, path, token, body string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("X-Site-Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send %s %s: %v", method, path, err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, data
+	}
+
+	resp, data := send(http.MethodGet, "/api/v1/admin/plugins", "good", "")
+	var list struct {
+		Plugins []common.PluginInfo `json:"plugins"`
+	}
+	json.Unmarshal(data, &list)
+	if resp.StatusCode != http.StatusOK || len(list.Plugins) != 1 {
+		t.Fatalf("Expected one plugin listed, got %d: %s", resp.StatusCode, data)
+	}
+	if p := list.Plugins[0]; p.Name != "signer" || !p.Running || p.Version != "1.2.3" || len(p.Capabilities) != 3 {
+		t.Errorf("Unexpected plugin %+v", p)
+	}
+
+	t.Run("auth", func(t *testing.T) {
+		if resp, _ := send(http.MethodGet, "/api/v1/admin/plugins", "", ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 without a token, got %d", resp.StatusCode)
+		}
+
+		resp, data := send(http.MethodGet, "/api/v1/admin/plugins", "banned", "")
+		if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(string(data), "token banned") {
+			t.Errorf("Expected the plugin to reject the request, got %d: %s", resp.StatusCode, data)
+		}
+
+		// A failing provider rejects the request rather than leaving it to
+		// the next one
+		resp, data = send(http.MethodGet, "/api/v1/admin/plugins", "broken", "")
+		if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(string(data), "auth provider unavailable") {
+			t.Errorf("Expected the failing provider to reject the request, got %d: %s", resp.StatusCode, data)
+		}
+
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/admin/plugins", nil)
+		req.Header.Set("X-API-Key", "secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send request: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected the API key to be kept from the provider, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("mutate_request", func(t *testing.T) {
+		_, data := send(http.MethodPost, "/api/v1/request", "good", `{"method": "GET", "url": "`+target.URL+`/get"}`)
+
+		var serverResp common.ServerResponse
+		json.Unmarshal(data, &serverResp)
+		var echo mock.EchoResponse
+		json.Unmarshal([]byte(serverResp.Body), &echo)
+		if got := echo.Headers["X-Signature"]; len(got) != 1 || got[0] != "signed:GET" {
+			t.Errorf("Expected the header set by the plugin, got %v (%s)", got, data)
+		}
+
+		// Plugins know dry runs, to skip their side effects
+		_, data = send(http.MethodPost, "/api/v1/request", "good", `{"method": "GET", "url": "`+target.URL+`/get", "options": {"dry_run": true}}`)
+		json.Unmarshal(data, &serverResp)
+		if serverResp.DryRun == nil || !slices.ContainsFunc(serverResp.DryRun.Headers, func(header []string) bool {
+			return len(header) == 2 && header[0] == "X-Signature" && header[1] == "dry:GET"
+		}) {
+			t.Errorf("Expected the plugin to mutate the dry run as such, got %s", data)
+		}
+
+		_, data = send(http.MethodPost, "/api/v1/request", "good", `{"method": "GET", "url": "`+target.URL+`/forbidden"}`)
+		json.Unmarshal(data, &serverResp)
+		if !strings.Contains(serverResp.Error, "target not allowed") {
+			t.Errorf("Expected the plugin error to fail the request, got %q", serverResp.Error)
+		}
+	})
+
+	t.Run("endpoints", func(t *testing.T) {
+		resp, data := send(http.MethodGet, "/api/v1/plugins/signer/hello/world", "good", "")
+
+		var echo map[string]string
+		json.Unmarshal(data, &echo)
+		if resp.StatusCode != http.StatusOK || echo["path"] != "/hello/world" || echo["key"] != "tenant-a" {
+			t.Errorf("Unexpected endpoint response %d: %s", resp.StatusCode, data)
+		}
+		if echo["request_id"] == "" || echo["request_id"] != resp.Header.Get("X-Request-ID") {
+			t.Errorf("Expected the request ID to reach the plugin, got %q", echo["request_id"])
+		}
+
+		for _, header := range []string{"X-API-Key", "Authorization"} {
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/plugins/signer/hello?api_key=secret", nil)
+			req.Header.Set(header, "Bearer secret")
+			if header == "X-API-Key" {
+				req.Header.Set(header, "secret")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Failed to send request: %v", err)
+			}
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			var echo map[string]string
+			json.Unmarshal(data, &echo)
+			if resp.StatusCode != http.StatusOK || echo["api_key"] != "" {
+				t.Errorf("Expected the API key to be kept from the endpoint, got %d: %s", resp.StatusCode, data)
+			}
+		}
+
+		if resp, _ := send(http.MethodGet, "/api/v1/plugins/missing/hello", "good", ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected status 404 for an unknown plugin, got %d", resp.StatusCode)
+		}
+	})
+
+	// Plugins exit once their input is closed
+	start := time.Now()
+	if err := handler.(io.Closer).Close(); err != nil {
+		t.Errorf("Failed to close: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Expected the plugin to exit on close, took %s", elapsed)
+	}
+}
@@ -0,0 +1,182 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/metrics"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func addProbe(t *testing.T, server *TestServer, probe common.Probe) int {
+	t.Helper()
+
+	body, _ := json.Marshal(probe)
+	resp, err := http.Post(server.URL+"/api/v1/admin/probes?api_key="+testAdminKey, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to add probe: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// checkedProbe waits for the first check of a probe
+func checkedProbe(t *testing.T, server *TestServer, name string) common.ProbeStatus {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var status common.ProbeStatus
+		if code := adminGet(t, server.URL, "/api/v1/admin/probes/"+name, testAdminKey, &status); code != http.StatusOK {
+			t.Fatalf("Expected status 200 for probe %s, got %d", name, code)
+		}
+		if status.Last != nil {
+			return status
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("Probe %s was not checked", name)
+	return common.ProbeStatus{}
+}
+
+func TestProbes(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	probes := []common.Probe{
+		{Name: "healthy", URL: target.URL + "/get", Browser: "firefox"},
+		{Name: "challenged", URL: target.URL + "/challenge"},
+		{Name: "forbidden", URL: target.URL + "/status/403", ExpectStatus: []int{403}},
+	}
+	for _, probe := range probes {
+		if code := addProbe(t, server, probe); code != http.StatusOK {
+			t.Fatalf("Expected status 200 adding %s, got %d", probe.Name, code)
+		}
+	}
+	defer func() {
+		for _, probe := range probes {
+			req, _ := http.NewRequest(http.MethodDelete, server.URL+"/api/v1/admin/probes/"+probe.Name+"?api_key="+testAdminKey, nil)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	healthy := checkedProbe(t, server, "healthy")
+	if !healthy.Last.Healthy || healthy.Last.StatusCode != http.StatusOK || healthy.Last.Challenge || healthy.HealthySince == nil {
+		t.Errorf("Expected a healthy probe, got %+v", healthy.Last)
+	}
+	if healthy.Method != http.MethodGet || healthy.IntervalSeconds != 60 || healthy.Checks != 1 {
+		t.Errorf("Expected the probe defaults to be filled, got %+v", healthy)
+	}
+
+	challenged := checkedProbe(t, server, "challenged")
+	if challenged.Last.Healthy || !challenged.Last.Challenge || challenged.Challenges != 1 || challenged.Failures != 1 {
+		t.Errorf("Expected a challenge to be detected, got %+v", challenged)
+	}
+
+	if forbidden := checkedProbe(t, server, "forbidden"); !forbidden.Last.Healthy {
+		t.Errorf("Expected an expected status to be healthy, got %+v", forbidden.Last)
+	}
+
+	var list struct {
+		Probes []common.ProbeStatus `json:"probes"`
+	}
+	adminGet(t, server.URL, "/api/v1/admin/probes", testAdminKey, &list)
+	if len(list.Probes) != 3 || list.Probes[0].Name != "challenged" || list.Probes[2].Name != "healthy" {
+		t.Errorf("Expected the probes sorted by name, got %+v", list.Probes)
+	}
+
+	resp, err := http.Get(server.URL + "/metrics?api_key=" + testAdminKey)
+	if err != nil {
+		t.Fatalf("Failed to get metrics: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != metrics.ContentType {
+		t.Errorf("Unexpected content type: %s", resp.Header.Get("Content-Type"))
+	}
+	for _, expected := range []string{
+		"# TYPE azuretls_probe_up gauge",
+		`azuretls_probe_up{probe="healthy",url="` + target.URL + `/get"} 1`,
+		`azuretls_probe_up{probe="challenged",url="` + target.URL + `/challenge"} 0`,
+		`azuretls_probe_challenge{probe="challenged",url="` + target.URL + `/challenge"} 1`,
+		`azuretls_probe_status_code{probe="forbidden",url="` + target.URL + `/status/403"} 403`,
+		"# TYPE azuretls_probe_checks_total counter",
+	} {
+		if !strings.Contains(string(body), expected+"\n") {
+			t.Errorf("Expected %q in metrics:\n%s", expected, body)
+		}
+	}
+}
+
+func TestProbeManagement(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	for _, probe := range []common.Probe{
+		{URL: "https://example.com/"},
+		{Name: "ftp", URL: "ftp://example.com/"},
+		{Name: "negative", URL: "https://example.com/", IntervalSeconds: -1},
+	} {
+		if code := addProbe(t, server, probe); code != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %+v, got %d", probe, code)
+		}
+	}
+
+	if code := adminGet(t, server.URL, "/api/v1/admin/probes/unknown", testAdminKey, nil); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for an unknown probe, got %d", code)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+"/api/v1/admin/probes/unknown?api_key="+testAdminKey, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to delete probe: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404 deleting an unknown probe, got %d", resp.StatusCode)
+	}
+
+	// The restricted admin endpoints need an admin key
+	keyed := NewTestServerWithConfig(&common.ServerConfig{
+		MaxConcurrentRequests: 10,
+		APIKeys:               []common.APIKeyConfig{{Key: "user-key"}},
+	})
+	defer keyed.Close()
+
+	if code := adminGet(t, keyed.URL, "/metrics", "user-key", nil); code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for metrics with a user key, got %d", code)
+	}
+}
+
+func TestMetricsWriter(t *testing.T) {
+	var buffer bytes.Buffer
+	m := metrics.NewWriter(&buffer)
+
+	m.Metric("empty", metrics.Gauge, "Skipped.")
+	m.Metric("sample", metrics.Counter, "A sample.",
+		metrics.Sample{Labels: map[string]string{"b": `quote " slash \`, "a": "line\nbreak"}, Value: 1.5},
+		metrics.Sample{Value: 2},
+	)
+	_ = m.Flush()
+
+	expected := "# HELP sample A sample.\n" +
+		"# TYPE sample counter\n" +
+		`sample{a="line\nbreak",b="quote \" slash \\"} 1.5` + "\n" +
+		"sample 2\n"
+	if buffer.String() != expected {
+		t.Errorf("Unexpected metrics:\n%s", buffer.String())
+	}
+}
@@ -0,0 +1,395 @@
+package test_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/proxyauth"
+	internal_server "github.com/Noooste/azuretls-api/internal/server"
+	"github.com/Noooste/azuretls-client"
+	"golang.org/x/crypto/md4"
+)
+
+// startFakeNTLMProxy tunnels CONNECT requests once the client proved, with
+// NTLMv2, to know the password of CORP\alice. It counts the tunnels opened.
+func startFakeNTLMProxy(t *testing.T, password string, tunnels *int32) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeNTLMProxy(conn, nonce, password, tunnels)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func serveFakeNTLMProxy(conn net.Conn, nonce []byte, password string, tunnels *int32) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+
+		scheme, token, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+		msg, _ := base64.StdEncoding.DecodeString(token)
+		if len(msg) < 12 || (scheme != "NTLM" && scheme != "Negotiate") {
+			fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: NTLM\r\nContent-Length: 0\r\n\r\n")
+			continue
+		}
+
+		switch msg[8] {
+		case 1:
+			// Target info holding the domain name and the end of list
+			targetInfo := append([]byte{2, 0, 8, 0}, fakeNTLMString("CORP")...)
+			targetInfo = append(targetInfo, 0, 0, 0, 0)
+
+			challenge := make([]byte, 48)
+			copy(challenge, "NTLMSSP\x00")
+			challenge[8] = 2
+			binary.LittleEndian.PutUint32(challenge[20:], 0xa2898205)
+			copy(challenge[24:], nonce)
+			binary.LittleEndian.PutUint16(challenge[40:], uint16(len(targetInfo)))
+			binary.LittleEndian.PutUint16(challenge[42:], uint16(len(targetInfo)))
+			binary.LittleEndian.PutUint32(challenge[44:], 48)
+			challenge = append(challenge, targetInfo...)
+
+			// The body must be read before the next request
+			fmt.Fprintf(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: %s %s\r\nContent-Length: 6\r\n\r\ndenied",
+				scheme, base64.StdEncoding.EncodeToString(challenge))
+
+		case 3:
+			field := func(at int) []byte {
+				length := binary.LittleEndian.Uint16(msg[at:])
+				offset := binary.LittleEndian.Uint32(msg[at+4:])
+				return msg[offset : offset+uint32(length)]
+			}
+			ntResponse, domain, user := field(20), field(28), field(36)
+
+			hash := md4.New()
+			hash.Write(fakeNTLMString(password))
+			key := hmac.New(md5.New, hash.Sum(nil))
+			key.Write(fakeNTLMString(strings.ToUpper(decodeNTLMString(user)) + decodeNTLMString(domain)))
+
+			proof := hmac.New(md5.New, key.Sum(nil))
+			proof.Write(nonce)
+			proof.Write(ntResponse[16:])
+
+			if decodeNTLMString(user) != "alice" || decodeNTLMString(domain) != "CORP" || !bytes.Equal(proof.Sum(nil), ntResponse[:16]) {
+				fmt.Fprint(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+				return
+			}
+
+			target, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				fmt.Fprint(conn, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\n\r\n")
+				return
+			}
+			defer target.Close()
+
+			atomic.AddInt32(tunnels, 1)
+			fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+			go io.Copy(target, reader)
+			_, _ = io.Copy(conn, target)
+			return
+
+		default:
+			return
+		}
+	}
+}
+
+func fakeNTLMString(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	encoded := make([]byte, 2*len(units))
+	for i, unit := range units {
+		binary.LittleEndian.PutUint16(encoded[2*i:], unit)
+	}
+	return encoded
+}
+
+func decodeNTLMString(b []byte) string {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		units[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(units))
+}
+
+func TestNTLMv2Responses(t *testing.T) {
+	// MS-NLMP 4.2.4 test vectors
+	key := proxyauth.NTOWFv2("User", "Password", "Domain")
+	if got := hex.EncodeToString(key); got != "0c868a403bfd7a93a3001ef22ef02e3f" {
+		t.Errorf("NTOWFv2 = %s, expected 0c868a403bfd7a93a3001ef22ef02e3f", got)
+	}
+
+	// The AV_PAIRs of the NetBIOS domain and server names, then MsvAvEOL
+	targetInfo, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	clientChallenge, _ := hex.DecodeString("aaaaaaaaaaaaaaaa")
+
+	nt, lm := proxyauth.NTLMv2Responses(key, serverChallenge, clientChallenge, make([]byte, 8), targetInfo)
+	if got := hex.EncodeToString(nt[:16]); got != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Errorf("NTProofStr = %s, expected 68cd0ab851e51c96aabc927bebef6a1c", got)
+	}
+	if got := hex.EncodeToString(lm); got != "86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa" {
+		t.Errorf("LMv2 response = %s, expected 86c35097ac9cec102554764a57cccc19aaaaaaaaaaaaaaaa", got)
+	}
+}
+
+func TestSessionManagerProxyAuth(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("through proxy"))
+	}))
+	defer target.Close()
+
+	var tunnels int32
+	proxyAddr := startFakeNTLMProxy(t, "secret", &tunnels)
+
+	manager := internal_server.NewSessionManager()
+
+	for _, scheme := range []string{common.ProxyAuthNTLM, common.ProxyAuthNegotiate} {
+		sessionID := "proxy-auth-" + scheme
+		session, err := manager.CreateSessionWithConfig(sessionID, &common.SessionConfig{
+			Proxy:     "http://" + proxyAddr,
+			ProxyAuth: &common.ProxyAuthConfig{Scheme: scheme, Username: `CORP\alice`, Password: "secret"},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+
+		resp, err := session.Get(target.URL)
+		if err != nil {
+			t.Fatalf("Request through the %s proxy failed: %v", scheme, err)
+		}
+		if resp.StatusCode != http.StatusOK || string(resp.Body) != "through proxy" {
+			t.Errorf("Unexpected response through the %s proxy: %d %q", scheme, resp.StatusCode, resp.Body)
+		}
+
+		_ = manager.DeleteSession(sessionID)
+	}
+	if got := atomic.LoadInt32(&tunnels); got != 2 {
+		t.Errorf("Expected 2 tunnels, got %d", got)
+	}
+
+	session, err := manager.CreateSessionWithConfig("proxy-auth-wrong", &common.SessionConfig{
+		Proxy:     "http://" + proxyAddr,
+		ProxyAuth: &common.ProxyAuthConfig{Scheme: common.ProxyAuthNTLM, Username: "alice", Domain: "CORP", Password: "wrong"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if _, err := session.Get(target.URL); err == nil || !strings.Contains(err.Error(), "proxy rejected the credentials") {
+		t.Errorf("Expected the credentials to be rejected, got %v", err)
+	}
+
+	invalid := []*common.SessionConfig{
+		{Proxy: "http://" + proxyAddr, ProxyAuth: &common.ProxyAuthConfig{Scheme: "basic", Username: "alice"}},
+		{Proxy: "http://" + proxyAddr, ProxyAuth: &common.ProxyAuthConfig{Scheme: common.ProxyAuthNTLM}},
+		{Proxy: "socks5://" + proxyAddr, ProxyAuth: &common.ProxyAuthConfig{Scheme: common.ProxyAuthNTLM, Username: "alice"}},
+		{ProxyAuth: &common.ProxyAuthConfig{Scheme: common.ProxyAuthNTLM, Username: "alice"}},
+	}
+	for i, config := range invalid {
+		if _, err := manager.CreateSessionWithConfig(fmt.Sprintf("proxy-auth-invalid-%d", i), config); err == nil {
+			t.Errorf("Expected invalid proxy auth config %d to be rejected", i)
+		}
+	}
+
+	// A proxy only accepting Kerberos answers with a Kerberos token
+	kerberos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Proxy-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString([]byte("\x60\x82kerberos")))
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer kerberos.Close()
+
+	session, err = manager.CreateSessionWithConfig("proxy-auth-kerberos", &common.SessionConfig{
+		Proxy:     kerberos.URL,
+		ProxyAuth: &common.ProxyAuthConfig{Scheme: common.ProxyAuthNegotiate, Username: `CORP\alice`, Password: "secret"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if _, err := session.Get(target.URL); err == nil || !strings.Contains(err.Error(), "set a realm") {
+		t.Errorf("Expected a Kerberos challenge to ask for a realm, got %v", err)
+	}
+}
+
+func TestSessionManagerProxyAuthKerberos(t *testing.T) {
+	// Closing the connections makes every request open a tunnel
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		w.Write([]byte("through proxy"))
+	}))
+	defer target.Close()
+
+	kdc := startFakeKDC(t, "HTTP/127.0.0.1", "HTTP/proxy.corp.example.com")
+
+	var tunnels int32
+	proxyAddr := startFakeNegotiateProxy(t, kdc.services["HTTP/127.0.0.1"], &tunnels)
+
+	manager := internal_server.NewSessionManager()
+	session, err := manager.CreateSessionWithConfig("proxy-auth-kerberos", &common.SessionConfig{
+		Proxy: "http://" + proxyAddr,
+		ProxyAuth: &common.ProxyAuthConfig{
+			Scheme:   common.ProxyAuthNegotiate,
+			Username: `CORP\alice`,
+			Password: "secret",
+			Realm:    "corp.example.com",
+			KDC:      kdc.addr,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer manager.DeleteSession("proxy-auth-kerberos")
+
+	// The tickets are kept across connections
+	for i := 0; i < 2; i++ {
+		resp, err := session.Get(target.URL)
+		if err != nil {
+			t.Fatalf("Request through the Kerberos proxy failed: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK || string(resp.Body) != "through proxy" {
+			t.Errorf("Unexpected response through the Kerberos proxy: %d %q", resp.StatusCode, resp.Body)
+		}
+	}
+	if got := atomic.LoadInt32(&tunnels); got != 2 {
+		t.Errorf("Expected 2 tunnels, got %d", got)
+	}
+	if as, tgs := atomic.LoadInt32(&kdc.asExchanges), atomic.LoadInt32(&kdc.tgsExchanges); as != 2 || tgs != 1 {
+		t.Errorf("Expected a pre-authenticated AS exchange and a single TGS exchange, got %d and %d", as, tgs)
+	}
+
+	// A ticket for another service is refused by the proxy
+	session, err = manager.CreateSessionWithConfig("proxy-auth-kerberos-spn", &common.SessionConfig{
+		Proxy: "http://" + proxyAddr,
+		ProxyAuth: &common.ProxyAuthConfig{
+			Scheme:   common.ProxyAuthNegotiate,
+			Username: "alice",
+			Password: "secret",
+			Realm:    "CORP.EXAMPLE.COM",
+			KDC:      kdc.addr,
+			SPN:      "HTTP/proxy.corp.example.com",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer manager.DeleteSession("proxy-auth-kerberos-spn")
+	if _, err := session.Get(target.URL); err == nil || !strings.Contains(err.Error(), "proxy rejected the credentials") {
+		t.Errorf("Expected the ticket to be rejected, got %v", err)
+	}
+
+	// A wrong password fails the pre-authentication
+	session, err = manager.CreateSessionWithConfig("proxy-auth-kerberos-wrong", &common.SessionConfig{
+		Proxy: "http://" + proxyAddr,
+		ProxyAuth: &common.ProxyAuthConfig{
+			Scheme:   common.ProxyAuthNegotiate,
+			Username: "alice",
+			Password: "wrong",
+			Realm:    "CORP.EXAMPLE.COM",
+			KDC:      kdc.addr,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer manager.DeleteSession("proxy-auth-kerberos-wrong")
+	if _, err := session.Get(target.URL); err == nil || !strings.Contains(err.Error(), "kerberos error 24") {
+		t.Errorf("Expected the pre-authentication to fail, got %v", err)
+	}
+
+	invalid := []*common.ProxyAuthConfig{
+		{Scheme: common.ProxyAuthNTLM, Username: "alice", Password: "secret", Realm: "CORP.EXAMPLE.COM"},
+		{Scheme: common.ProxyAuthNegotiate, Username: "alice", Password: "secret", KDC: kdc.addr},
+		{Scheme: common.ProxyAuthNegotiate, Username: "alice", Realm: "CORP.EXAMPLE.COM"},
+	}
+	for i, config := range invalid {
+		if _, err := manager.CreateSessionWithConfig(fmt.Sprintf("proxy-auth-kerberos-invalid-%d", i), &common.SessionConfig{
+			Proxy:     "http://" + proxyAddr,
+			ProxyAuth: config,
+		}); err == nil {
+			t.Errorf("Expected invalid Kerberos config %d to be rejected", i)
+		}
+	}
+}
+
+func TestSessionManagerProxyUserAgent(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("through proxy"))
+	}))
+	defer target.Close()
+
+	userAgents := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents <- r.Header.Get("User-Agent")
+
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+
+		conn, buffered, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		fmt.Fprint(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+
+		go io.Copy(upstream, buffered)
+		_, _ = io.Copy(conn, upstream)
+	}))
+	defer proxy.Close()
+
+	manager := internal_server.NewSessionManager()
+	session, err := manager.CreateSessionWithConfig("proxy-user-agent", &common.SessionConfig{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer manager.DeleteSession("proxy-user-agent")
+
+	// The CONNECT request carries the User-Agent of the request, rather
+	// than the one of the session
+	resp, err := session.Do(&azuretls.Request{
+		Method:         http.MethodGet,
+		Url:            target.URL,
+		OrderedHeaders: azuretls.OrderedHeaders{{"User-Agent", "custom/1.0"}},
+	})
+	if err != nil {
+		t.Fatalf("Request through the proxy failed: %v", err)
+	}
+	if string(resp.Body) != "through proxy" {
+		t.Errorf("Unexpected response through the proxy: %d %q", resp.StatusCode, resp.Body)
+	}
+	if got := <-userAgents; got != "custom/1.0" {
+		t.Errorf("Expected the CONNECT request to carry the request User-Agent, got %q", got)
+	}
+}
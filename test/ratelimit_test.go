@@ -0,0 +1,169 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/ratelimit"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func TestRateLimitParse(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		header    map[string]string
+		status    int
+		expectNil bool
+		limited   bool
+		limit     int
+		remaining int
+		resetAt   time.Time
+		delayMs   int64
+	}{
+		{
+			name:      "no headers",
+			status:    http.StatusOK,
+			expectNil: true,
+		},
+		{
+			name:      "Retry-After on a redirect",
+			header:    map[string]string{"Retry-After": "5"},
+			status:    http.StatusMovedPermanently,
+			expectNil: true,
+		},
+		{
+			name:    "429 with Retry-After seconds",
+			header:  map[string]string{"Retry-After": "3"},
+			status:  http.StatusTooManyRequests,
+			limited: true,
+			delayMs: 3000,
+		},
+		{
+			name:    "503 with Retry-After date",
+			header:  map[string]string{"Retry-After": now.Add(90 * time.Second).Format(http.TimeFormat)},
+			status:  http.StatusServiceUnavailable,
+			delayMs: 90000,
+		},
+		{
+			name: "X-RateLimit with Unix reset",
+			header: map[string]string{
+				"X-RateLimit-Limit":     "100",
+				"X-RateLimit-Remaining": "10",
+				"X-RateLimit-Reset":     "1704110460",
+			},
+			status:    http.StatusOK,
+			limit:     100,
+			remaining: 10,
+			resetAt:   now.Add(time.Minute),
+			delayMs:   6000,
+		},
+		{
+			name: "exhausted IETF headers with delta reset",
+			header: map[string]string{
+				"RateLimit-Limit":     "100, 100;w=60",
+				"RateLimit-Remaining": "0",
+				"RateLimit-Reset":     "20",
+			},
+			status:  http.StatusOK,
+			limit:   100,
+			resetAt: now.Add(20 * time.Second),
+			delayMs: 20000,
+		},
+		{
+			name:      "structured RateLimit header",
+			header:    map[string]string{"RateLimit": "limit=50, remaining=25, reset=50"},
+			status:    http.StatusOK,
+			limit:     50,
+			remaining: 25,
+			resetAt:   now.Add(50 * time.Second),
+			delayMs:   2000,
+		},
+		{
+			name:    "429 without hints",
+			status:  http.StatusTooManyRequests,
+			limited: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			for key, value := range tt.header {
+				header.Set(key, value)
+			}
+
+			rateLimit := ratelimit.Parse(header, tt.status, now)
+			if tt.expectNil {
+				if rateLimit != nil {
+					t.Fatalf("Expected no rate limit, got %+v", rateLimit)
+				}
+				return
+			}
+			if rateLimit == nil {
+				t.Fatal("Expected a rate limit")
+			}
+
+			if rateLimit.Limited != tt.limited || rateLimit.SuggestedDelayMs != tt.delayMs {
+				t.Errorf("Expected limited=%v delay=%d, got %+v", tt.limited, tt.delayMs, rateLimit)
+			}
+			if tt.limit != 0 && (rateLimit.Limit == nil || *rateLimit.Limit != tt.limit) {
+				t.Errorf("Expected limit %d, got %v", tt.limit, rateLimit.Limit)
+			}
+			if tt.limit != 0 && (rateLimit.Remaining == nil || *rateLimit.Remaining != tt.remaining) {
+				t.Errorf("Expected %d remaining, got %v", tt.remaining, rateLimit.Remaining)
+			}
+			if !tt.resetAt.IsZero() && (rateLimit.ResetAt == nil || !rateLimit.ResetAt.Equal(tt.resetAt)) {
+				t.Errorf("Expected reset at %s, got %v", tt.resetAt, rateLimit.ResetAt)
+			}
+		})
+	}
+}
+
+func TestRESTRateLimit(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	send := func() common.ServerResponse {
+		body, _ := json.Marshal(common.ServerRequest{
+			Method:  http.MethodGet,
+			URL:     target.URL + "/rate-limit/1?window=30",
+			Options: common.RequestOptions{Fields: []string{"status_code", "rate_limit"}},
+		})
+		resp, err := http.Post(server.URL+"/api/v1/request", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var serverResp common.ServerResponse
+		if err := json.NewDecoder(resp.Body).Decode(&serverResp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return serverResp
+	}
+
+	first := send()
+	if first.StatusCode != http.StatusOK || first.RateLimit == nil || first.RateLimit.Limited {
+		t.Fatalf("Expected an allowed request with rate limit info, got %+v", first)
+	}
+	if first.RateLimit.Remaining == nil || *first.RateLimit.Remaining != 0 || first.RateLimit.ResetAt == nil {
+		t.Errorf("Expected no request left before the reset, got %+v", first.RateLimit)
+	}
+
+	second := send()
+	if second.StatusCode != http.StatusTooManyRequests || second.RateLimit == nil || !second.RateLimit.Limited {
+		t.Fatalf("Expected a limited request, got %+v", second)
+	}
+	if delay := second.RateLimit.SuggestedDelayMs; delay < 1000 || delay > 31000 {
+		t.Errorf("Expected the Retry-After delay, got %d ms", delay)
+	}
+}
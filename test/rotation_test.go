@@ -0,0 +1,239 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/rotation"
+	internal_websocket "github.com/Noooste/azuretls-api/internal/websocket"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+// createRotatingSession creates a session with a rotation policy
+func createRotatingSession(t *testing.T, server *TestServer, policy common.RotationPolicy) string {
+	t.Helper()
+
+	body, _ := json.Marshal(common.SessionConfig{Rotation: &policy})
+	resp, err := http.Post(server.URL+"/api/v1/session/create", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]string
+	_ = json.NewDecoder(resp.Body).Decode(&result)
+	return result["session_id"]
+}
+
+func sessionRequest(t *testing.T, server *TestServer, sessionID, url string) common.ServerResponse {
+	t.Helper()
+
+	body, _ := json.Marshal(common.ServerRequest{
+		Method:  http.MethodGet,
+		URL:     url,
+		Options: common.RequestOptions{Fields: []string{"status_code"}},
+	})
+	resp, err := http.Post(server.URL+"/api/v1/session/"+sessionID+"/request", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var serverResp common.ServerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&serverResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return serverResp
+}
+
+func TestRESTSessionRotation(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	t.Run("max requests", func(t *testing.T) {
+		sessionID := createRotatingSession(t, server, common.RotationPolicy{MaxRequests: 2})
+
+		if resp := sessionRequest(t, server, sessionID, target.URL+"/get"); resp.Rotation != nil {
+			t.Fatalf("Expected no rotation after the first request, got %+v", resp.Rotation)
+		}
+
+		resp := sessionRequest(t, server, sessionID, target.URL+"/get")
+		if resp.StatusCode != http.StatusOK || resp.Rotation == nil {
+			t.Fatalf("Expected a rotation after the second request, got %+v", resp)
+		}
+		if resp.Rotation.Reason != common.RotationMaxRequests || resp.Rotation.PreviousSessionID != sessionID || resp.Rotation.SessionID == sessionID {
+			t.Errorf("Unexpected rotation: %+v", resp.Rotation)
+		}
+
+		// The previous session is gone and the replacement keeps the policy
+		if resp := sessionRequest(t, server, sessionID, target.URL+"/get"); resp.Error == "" {
+			t.Errorf("Expected the rotated session to be deleted")
+		}
+
+		replacementID := resp.Rotation.SessionID
+		if resp := sessionRequest(t, server, replacementID, target.URL+"/get"); resp.Error != "" || resp.Rotation != nil {
+			t.Errorf("Expected the replacement to serve one request, got %+v", resp)
+		}
+		if resp := sessionRequest(t, server, replacementID, target.URL+"/get"); resp.Rotation == nil {
+			t.Errorf("Expected the replacement to rotate in turn")
+		}
+	})
+
+	t.Run("challenge", func(t *testing.T) {
+		sessionID := createRotatingSession(t, server, common.RotationPolicy{OnChallenge: true})
+
+		if resp := sessionRequest(t, server, sessionID, target.URL+"/status/403"); resp.Rotation != nil {
+			t.Fatalf("Expected no rotation on a plain 403, got %+v", resp.Rotation)
+		}
+
+		resp := sessionRequest(t, server, sessionID, target.URL+"/challenge")
+		if resp.StatusCode != http.StatusForbidden || resp.Rotation == nil || resp.Rotation.Reason != common.RotationChallenge {
+			t.Fatalf("Expected a rotation on the challenge page, got %+v", resp)
+		}
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		sessionID := createRotatingSession(t, server, common.RotationPolicy{MaxAgeSeconds: 1})
+
+		if resp := sessionRequest(t, server, sessionID, target.URL+"/get"); resp.Rotation != nil {
+			t.Fatalf("Expected no rotation of a new session, got %+v", resp.Rotation)
+		}
+
+		time.Sleep(1100 * time.Millisecond)
+
+		// The request is sent with the replacement
+		resp := sessionRequest(t, server, sessionID, target.URL+"/get")
+		if resp.StatusCode != http.StatusOK || resp.Rotation == nil || resp.Rotation.Reason != common.RotationMaxAge {
+			t.Fatalf("Expected the request to be sent by a replacement, got %+v", resp)
+		}
+	})
+
+	t.Run("dry runs", func(t *testing.T) {
+		sessionID := createRotatingSession(t, server, common.RotationPolicy{MaxRequests: 1})
+
+		body, _ := json.Marshal(common.ServerRequest{
+			Method:  http.MethodGet,
+			URL:     target.URL + "/get",
+			Options: common.RequestOptions{DryRun: true},
+		})
+		resp, err := http.Post(server.URL+"/api/v1/session/"+sessionID+"/request", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp := sessionRequest(t, server, sessionID, target.URL+"/get"); resp.Error != "" || resp.Rotation == nil {
+			t.Errorf("Expected dry runs not to count, got %+v", resp)
+		}
+	})
+}
+
+func TestRotatorReplacement(t *testing.T) {
+	rotator := rotation.NewRotator()
+	rotator.Track("first", &common.SessionConfig{
+		Browser:   "chrome",
+		UserAgent: "custom",
+		Tags:      []string{"scraper"},
+		Rotation: &common.RotationPolicy{
+			MaxRequests: 1,
+			Browsers:    []string{"chrome", "firefox"},
+			Proxies:     []string{"http://a:1", "http://b:1", "http://c:1"},
+		},
+	})
+
+	expected := []struct{ browser, proxy string }{
+		{"firefox", "http://b:1"},
+		{"chrome", "http://c:1"},
+		{"firefox", "http://a:1"},
+	}
+
+	sessionID := "first"
+	for i, want := range expected {
+		config, ok := rotator.Replacement(sessionID)
+		if !ok {
+			t.Fatalf("Expected a replacement config for %s", sessionID)
+		}
+		if config.Browser != want.browser || config.Proxy != want.proxy || config.UserAgent != "" || len(config.Tags) != 1 {
+			t.Errorf("Replacement %d: expected %s through %s, got %+v", i, want.browser, want.proxy, config)
+		}
+
+		replacementID := sessionID + "+"
+		if !rotator.Replace(sessionID, replacementID) {
+			t.Fatalf("Expected %s to be replaced", sessionID)
+		}
+		if rotator.Replace(sessionID, "other") {
+			t.Errorf("Expected a session to be replaced only once")
+		}
+		sessionID = replacementID
+	}
+
+	rotator.Forget(sessionID)
+	if reason := rotator.Due(sessionID, &common.ServerResponse{StatusCode: http.StatusOK}); reason != "" {
+		t.Errorf("Expected forgotten sessions never to be due, got %s", reason)
+	}
+}
+
+func TestWebSocketSessionRotation(t *testing.T) {
+	server := NewWebSocketTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	client, err := NewWebSocketTestClient(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.SendMessage(internal_websocket.CreateSessionMsg, "create", common.SessionConfig{
+		Rotation: &common.RotationPolicy{MaxRequests: 1},
+	}); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	created, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	var session map[string]string
+	_ = json.Unmarshal(created.Payload, &session)
+
+	request := common.ServerRequest{Method: http.MethodGet, URL: target.URL + "/get"}
+	if err := client.SendMessage(internal_websocket.RequestMessage, "req-1", request); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+
+	event, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read event: %v", err)
+	}
+	if event.Type != internal_websocket.SessionRotatedMsg || event.ID != "req-1" {
+		t.Fatalf("Expected a session_rotated event, got %s", event.Type)
+	}
+
+	var rotated common.SessionRotation
+	_ = json.Unmarshal(event.Payload, &rotated)
+	if rotated.PreviousSessionID != session["session_id"] || rotated.SessionID == "" || rotated.Reason != common.RotationMaxRequests {
+		t.Errorf("Unexpected rotation event: %+v", rotated)
+	}
+
+	if response, err := client.ReadMessage(); err != nil || response.Type != internal_websocket.ResponseMessage {
+		t.Fatalf("Expected the response after the event, got %+v (%v)", response, err)
+	}
+
+	// The connection now uses the replacement
+	if err := client.SendMessage(internal_websocket.RequestMessage, "req-2", request); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	if event, err := client.ReadMessage(); err != nil || event.Type != internal_websocket.SessionRotatedMsg {
+		t.Fatalf("Expected the replacement to rotate in turn, got %+v (%v)", event, err)
+	}
+}
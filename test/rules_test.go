@@ -0,0 +1,146 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/rules"
+	"github.com/Noooste/azuretls-api/mock"
+	"github.com/Noooste/azuretls-client"
+)
+
+func TestRulesEngine(t *testing.T) {
+	engine, err := rules.NewEngine([]common.Rule{
+		{
+			Name:          "api",
+			Match:         common.RuleMatch{Host: "*.example.com", PathPrefix: "/v1/"},
+			SetHeaders:    map[string]string{"accept": "application/json"},
+			AddHeaders:    map[string]string{"x-client": "rules"},
+			RemoveHeaders: []string{"x-debug"},
+			Options:       &common.RequestOptions{TimeoutMs: 2500},
+		},
+		{
+			Match:      common.RuleMatch{Tag: "legacy", Method: "post"},
+			RewriteURL: &common.URLRewrite{Pattern: `/v1/`, Replacement: "/v2/"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+
+	session := azuretls.NewSession()
+	defer session.Close()
+
+	req := &azuretls.Request{
+		Method: http.MethodPost,
+		Url:    "https://api.example.com/v1/items",
+		OrderedHeaders: azuretls.OrderedHeaders{
+			{"Accept", "*/*"},
+			{"x-debug", "1"},
+			{"accept", "text/html"},
+			{"x-client", "mine"},
+		},
+	}
+	options := &common.RequestOptions{}
+
+	applied, err := engine.Apply(req, session, options, []string{"legacy"})
+	if err != nil {
+		t.Fatalf("Failed to apply rules: %v", err)
+	}
+
+	if strings.Join(applied, ",") != "api,rule-2" {
+		t.Errorf("Expected rules api and rule-2 to apply, got %v", applied)
+	}
+	if req.Url != "https://api.example.com/v2/items" {
+		t.Errorf("Expected rewritten URL, got %s", req.Url)
+	}
+	if options.TimeoutMs != 2500 {
+		t.Errorf("Expected rule timeout, got %d", options.TimeoutMs)
+	}
+
+	expected := [][]string{{"Accept", "application/json"}, {"x-client", "mine"}}
+	if len(req.OrderedHeaders) != len(expected) {
+		t.Fatalf("Expected headers %v, got %v", expected, req.OrderedHeaders)
+	}
+	for i, header := range expected {
+		if strings.Join(req.OrderedHeaders[i], ":") != strings.Join(header, ":") {
+			t.Errorf("Expected header %v at %d, got %v", header, i, req.OrderedHeaders[i])
+		}
+	}
+
+	// Conditions are ANDed, so an untagged session skips the rewrite
+	req = &azuretls.Request{Method: http.MethodPost, Url: "https://example.com/v1/items"}
+	applied, _ = engine.Apply(req, session, &common.RequestOptions{}, nil)
+	if len(applied) != 0 || req.Url != "https://example.com/v1/items" {
+		t.Errorf("Expected no rule to apply, got %v and %s", applied, req.Url)
+	}
+
+	if _, err := rules.NewEngine([]common.Rule{{RewriteURL: &common.URLRewrite{Pattern: "("}}}); err == nil {
+		t.Error("Expected an error for an invalid URL pattern")
+	}
+}
+
+func TestInvalidRulesFailStartup(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.Rules = []common.Rule{{Match: common.RuleMatch{Host: "["}}}
+
+	if _, err := api.Handler(config, nil); err == nil || !strings.Contains(err.Error(), "invalid request rules") {
+		t.Errorf("Expected invalid rules to fail the handler creation, got %v", err)
+	}
+}
+
+func TestRESTRequestRules(t *testing.T) {
+	target := mock.NewServer()
+	defer target.Close()
+
+	server := NewTestServerWithConfig(&common.ServerConfig{
+		MaxConcurrentRequests: 100,
+		Rules: []common.Rule{{
+			Name:       "inject",
+			Match:      common.RuleMatch{Host: "127.0.0.1", PathPrefix: "/anything"},
+			RewriteURL: &common.URLRewrite{Pattern: `/anything$`, Replacement: "/headers"},
+			SetHeaders: map[string]string{"X-Injected": "yes"},
+		}},
+	})
+	defer server.Close()
+
+	sessionID := createTestSession(t, server)
+
+	serverReq := common.ServerRequest{
+		URL:    target.URL + "/anything",
+		Method: http.MethodGet,
+	}
+	body, _ := json.Marshal(serverReq)
+
+	resp, err := http.Post(server.URL+"/api/v1/session/"+sessionID+"/request", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make session request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var serverResp common.ServerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&serverResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if len(serverResp.AppliedRules) != 1 || serverResp.AppliedRules[0] != "inject" {
+		t.Errorf("Expected rule inject to apply, got %v", serverResp.AppliedRules)
+	}
+	if !strings.HasSuffix(serverResp.URL, "/headers") {
+		t.Errorf("Expected the rewritten URL, got %s", serverResp.URL)
+	}
+
+	var echo mock.EchoResponse
+	if err := json.Unmarshal([]byte(serverResp.Body), &echo); err != nil {
+		t.Fatalf("Failed to decode echo response: %v", err)
+	}
+	if values := echo.Headers["X-Injected"]; len(values) != 1 || values[0] != "yes" {
+		t.Errorf("Expected the injected header, got %v", echo.Headers)
+	}
+}
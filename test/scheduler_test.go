@@ -0,0 +1,131 @@
+package test_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func TestRequestPriority(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.MaxOutgoingRequests = 1
+	config.AdminKey = testAdminKey
+	config.QueueTimeout = 5 * time.Second
+
+	server := httptest.NewServer(newAPIHandler(t, config, nil))
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	request := func(path, priority string) common.ServerResponse {
+		body := `{"method": "GET", "url": "` + target.URL + path + `", "options": {"priority": "` + priority + `"}}`
+		resp, err := http.Post(server.URL+"/api/v1/request", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Errorf("Failed to send request: %v", err)
+			return common.ServerResponse{}
+		}
+		defer resp.Body.Close()
+
+		var serverResp common.ServerResponse
+		json.NewDecoder(resp.Body).Decode(&serverResp)
+		return serverResp
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		if serverResp := request("/get", "urgent"); !strings.Contains(serverResp.Error, "invalid priority") {
+			t.Errorf("Expected an invalid priority error, got %q", serverResp.Error)
+		}
+	})
+
+	t.Run("order", func(t *testing.T) {
+		var (
+			wg    sync.WaitGroup
+			mu    sync.Mutex
+			order []string
+		)
+		send := func(path, priority string) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if serverResp := request(path, priority); serverResp.Error != "" {
+					t.Errorf("Request %s failed: %s", priority, serverResp.Error)
+				}
+				mu.Lock()
+				order = append(order, priority)
+				mu.Unlock()
+			}()
+		}
+
+		// The first request holds the only slot while the others queue
+		send("/delay/0.5", "normal")
+		time.Sleep(100 * time.Millisecond)
+		send("/get", "low")
+		time.Sleep(50 * time.Millisecond)
+		send("/get", "high")
+		time.Sleep(50 * time.Millisecond)
+
+		resp, err := http.Get(server.URL + "/api/v1/admin/stats?api_key=" + testAdminKey)
+		if err != nil {
+			t.Fatalf("Failed to get stats: %v", err)
+		}
+		var stats common.AdminStats
+		json.NewDecoder(resp.Body).Decode(&stats)
+		resp.Body.Close()
+		if s := stats.Scheduler; s == nil || s.InFlight != 1 || s.Capacity != 1 || s.Waiting["high"] != 1 || s.Waiting["low"] != 1 {
+			t.Errorf("Unexpected scheduler stats %+v", s)
+		}
+
+		wg.Wait()
+		if strings.Join(order, ",") != "normal,high,low" {
+			t.Errorf("Expected the high priority request served first, got %v", order)
+		}
+	})
+}
+
+func TestRequestQueueTimeout(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.MaxOutgoingRequests = 1
+	config.AdminKey = testAdminKey
+	config.QueueTimeout = 200 * time.Millisecond
+
+	server := httptest.NewServer(newAPIHandler(t, config, nil))
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	go http.Post(server.URL+"/api/v1/request", "application/json", strings.NewReader(`{"method": "GET", "url": "`+target.URL+`/delay/1"}`))
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := http.Post(server.URL+"/api/v1/request", "application/json", strings.NewReader(`{"method": "GET", "url": "`+target.URL+`/get"}`))
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(data), common.ErrQueueTimeout.Error()) {
+		t.Errorf("Expected the request to time out in the queue, got %d: %s", resp.StatusCode, data)
+	}
+
+	resp, err = http.Get(server.URL + "/metrics?api_key=" + testAdminKey)
+	if err != nil {
+		t.Fatalf("Failed to get metrics: %v", err)
+	}
+	data, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(data), "azuretls_scheduler_timeouts_total 1") {
+		t.Errorf("Expected the timeout counted in the metrics, got:\n%s", data)
+	}
+}
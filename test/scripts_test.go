@@ -0,0 +1,251 @@
+package test_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+const signerScript = `
+function on_request(req)
+  req.headers["X-Signature"] = azuretls.hmac_sha256("secret", req.method .. " " .. req.url)
+  req.headers["X-Debug"] = nil
+end
+
+function on_response(resp)
+  local echo = azuretls.json_decode(resp.body)
+  resp.data.method = echo.method
+  resp.data.status = resp.status_code
+  resp.body = "redacted"
+end
+`
+
+func TestScripts(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "signer.lua"), signerScript)
+
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.ScriptsDir = dir
+	config.BodyStoreDir = t.TempDir()
+	config.AdminKey = testAdminKey
+	config.ScriptLimits = common.ScriptLimits{Timeout: 200 * time.Millisecond}
+	config.Rules = []common.Rule{{
+		Name:    "tag",
+		Match:   common.RuleMatch{PathPrefix: "/anything"},
+		Scripts: []string{"tagger"},
+	}}
+
+	server := httptest.NewServer(newAPIHandler(t, config, nil))
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	send := func(method, path, body string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", testAdminKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send %s %s: %v", method, path, err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, data
+	}
+
+	putScript := func(name, source string) *http.Response {
+		body, _ := json.Marshal(map[string]string{"source": source})
+		resp, _ := send(http.MethodPut, "/api/v1/admin/scripts/"+name, string(body))
+		return resp
+	}
+
+	request := func(path, body string) common.ServerResponse {
+		_, data := send(http.MethodPost, path, body)
+		var serverResp common.ServerResponse
+		if err := json.Unmarshal(data, &serverResp); err != nil {
+			t.Fatalf("Failed to decode response %s: %v", data, err)
+		}
+		return serverResp
+	}
+
+	t.Run("management", func(t *testing.T) {
+		resp, data := send(http.MethodGet, "/api/v1/admin/scripts", "")
+		var list struct {
+			Scripts []common.ScriptInfo `json:"scripts"`
+		}
+		json.Unmarshal(data, &list)
+		if resp.StatusCode != http.StatusOK || len(list.Scripts) != 1 || list.Scripts[0].Name != "signer" {
+			t.Fatalf("Expected the script of the directory, got %d: %s", resp.StatusCode, data)
+		}
+		if hooks := list.Scripts[0].Hooks; len(hooks) != 2 {
+			t.Errorf("Expected both hooks detected, got %v", hooks)
+		}
+
+		if resp := putScript("broken", "function on_request(req"); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for a syntax error, got %d", resp.StatusCode)
+		}
+		if resp, _ := send(http.MethodGet, "/api/v1/admin/scripts/broken", ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected the broken script not stored, got %d", resp.StatusCode)
+		}
+	})
+
+	// session creates a session running the given scripts
+	session := func(config string) string {
+		_, data := send(http.MethodPost, "/api/v1/session/create", config)
+		var created struct {
+			SessionID string `json:"session_id"`
+		}
+		json.Unmarshal(data, &created)
+		if created.SessionID == "" {
+			t.Fatalf("Failed to create session: %s", data)
+		}
+		return created.SessionID
+	}
+
+	t.Run("session", func(t *testing.T) {
+		sessionID := session(`{"scripts": ["signer"]}`)
+
+		serverResp := request("/api/v1/session/"+sessionID+"/request", `{"method": "GET", "url": "`+target.URL+`/get"}`)
+		if serverResp.Body != "redacted" {
+			t.Errorf("Expected the body replaced by on_response, got %q", serverResp.Body)
+		}
+		if serverResp.ScriptData["method"] != "GET" || serverResp.ScriptData["status"] != float64(200) {
+			t.Errorf("Unexpected script data %v", serverResp.ScriptData)
+		}
+
+		// Unknown scripts are rejected, detaching all is allowed
+		if resp, _ := send(http.MethodPut, "/api/v1/session/"+sessionID+"/scripts", `{"scripts": ["missing"]}`); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for an unknown script, got %d", resp.StatusCode)
+		}
+		if resp, _ := send(http.MethodPut, "/api/v1/session/"+sessionID+"/scripts", `{"scripts": []}`); resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected the scripts detached, got %d", resp.StatusCode)
+		}
+		serverResp = request("/api/v1/session/"+sessionID+"/request", `{"method": "GET", "url": "`+target.URL+`/get"}`)
+		if serverResp.Body == "redacted" || serverResp.ScriptData != nil {
+			t.Errorf("Expected no script to run once detached, got %+v", serverResp)
+		}
+	})
+
+	t.Run("signing", func(t *testing.T) {
+		putScript("echo", `function on_response(resp) resp.data.echo = azuretls.json_decode(resp.body) end`)
+
+		// Scripts run in order, echo seeing the body left by signer
+		serverResp := request("/api/v1/session/"+session(`{"scripts": ["signer", "echo"]}`)+"/request", `{"method": "POST", "url": "`+target.URL+`/post", "body": "{}"}`)
+		if _, exists := serverResp.ScriptData["echo"]; exists || !strings.Contains(serverResp.ScriptErrors["echo"], "json_decode") {
+			t.Errorf("Expected echo to fail decoding the redacted body, got %+v", serverResp)
+		}
+
+		serverResp = request("/api/v1/session/"+session(`{"scripts": ["echo", "signer"]}`)+"/request", `{"method": "POST", "url": "`+target.URL+`/post", "body": "{}", "headers": {"X-Debug": "1"}}`)
+		echo, _ := serverResp.ScriptData["echo"].(map[string]any)
+		if echo == nil {
+			t.Fatalf("Expected the echoed request in the script data, got %+v", serverResp)
+		}
+
+		headers, _ := echo["headers"].(map[string]any)
+		if _, exists := headers["X-Debug"]; exists {
+			t.Errorf("Expected the header removed by signer, got %v", headers)
+		}
+		signature, _ := headers["X-Signature"].([]any)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte("POST " + target.URL + "/post"))
+		if len(signature) != 1 || signature[0] != hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Expected the signature set by signer, got %v", signature)
+		}
+	})
+
+	t.Run("downloads", func(t *testing.T) {
+		putScript("ranger", `
+function on_request(req) req.url = string.gsub(req.url, "/get$", "/range/1000") end
+function on_response(resp) resp.data.status = resp.status_code end`)
+
+		// Managed downloads go through the hooks of the session too
+		downloads := "/api/v1/session/" + session(`{"scripts": ["ranger"]}`) + "/downloads"
+		resp, data := send(http.MethodPost, downloads, `{"method": "GET", "url": "`+target.URL+`/get"}`)
+		var job common.DownloadJob
+		json.Unmarshal(data, &job)
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("Expected the download to start, got %d: %s", resp.StatusCode, data)
+		}
+
+		deadline := time.Now().Add(10 * time.Second)
+		for job.State == common.DownloadRunning && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+			_, data = send(http.MethodGet, downloads+"/"+job.ID, "")
+			json.Unmarshal(data, &job)
+		}
+		if job.State != common.DownloadCompleted || job.Progress.Downloaded != 1000 {
+			t.Fatalf("Expected the download of the URL set by on_request, got %+v", job)
+		}
+		if job.ScriptData["status"] != float64(200) {
+			t.Errorf("Expected the data of on_response with the download, got %+v", job)
+		}
+	})
+
+	t.Run("rules", func(t *testing.T) {
+		putScript("tagger", `function on_request(req) req.headers["X-Tags"] = table.concat(req.tags, ",") end`)
+
+		serverResp := request("/api/v1/session/"+session(`{"tags": ["a", "b"]}`)+"/request", `{"method": "GET", "url": "`+target.URL+`/anything"}`)
+		var echo mock.EchoResponse
+		json.Unmarshal([]byte(serverResp.Body), &echo)
+		if got := echo.Headers["X-Tags"]; len(got) != 1 || got[0] != "a,b" {
+			t.Errorf("Expected the header set by the rule script, got %v (%s)", got, serverResp.Error)
+		}
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		putScript("loop", `function on_request(req) while true do end end`)
+
+		start := time.Now()
+		serverResp := request("/api/v1/session/"+session(`{"scripts": ["loop"]}`)+"/request", `{"method": "GET", "url": "`+target.URL+`/get"}`)
+		if !strings.Contains(serverResp.Error, "time limit exceeded") {
+			t.Errorf("Expected the time limit to fail the request, got %q", serverResp.Error)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("Expected the script stopped after its time limit, took %s", elapsed)
+		}
+
+		putScript("escape", `function on_request(req) os.exit(1) end`)
+		serverResp = request("/api/v1/session/"+session(`{"scripts": ["escape"]}`)+"/request", `{"method": "GET", "url": "`+target.URL+`/get"}`)
+		if serverResp.Error == "" {
+			t.Errorf("Expected the os library to be unavailable")
+		}
+
+		putScript("cyclic", `function on_request(req) local t = {} t.x = t azuretls.json_encode(t) end`)
+		serverResp = request("/api/v1/session/"+session(`{"scripts": ["cyclic"]}`)+"/request", `{"method": "GET", "url": "`+target.URL+`/get"}`)
+		if !strings.Contains(serverResp.Error, "cyclic table") {
+			t.Errorf("Expected json_encode to reject cyclic tables, got %q", serverResp.Error)
+		}
+
+		putScript("cyclic", `function on_response(resp) resp.data.self = resp.data end`)
+		serverResp = request("/api/v1/session/"+session(`{"scripts": ["cyclic"]}`)+"/request", `{"method": "GET", "url": "`+target.URL+`/get"}`)
+		if !strings.Contains(serverResp.ScriptErrors["cyclic"], "cyclic table") {
+			t.Errorf("Expected cyclic data to be rejected, got %+v", serverResp.ScriptErrors)
+		}
+
+		putScript("repeat", `function on_request(req) string.rep("ab", 4611686018427387904) end`)
+		serverResp = request("/api/v1/session/"+session(`{"scripts": ["repeat"]}`)+"/request", `{"method": "GET", "url": "`+target.URL+`/get"}`)
+		if !strings.Contains(serverResp.Error, "exceeds the limit") {
+			t.Errorf("Expected string.rep to be capped, got %q", serverResp.Error)
+		}
+
+		putScript("failing", `function on_response(resp) error("boom") end`)
+		serverResp = request("/api/v1/session/"+session(`{"scripts": ["failing"]}`)+"/request", `{"method": "GET", "url": "`+target.URL+`/get"}`)
+		if serverResp.StatusCode != http.StatusOK || !strings.Contains(serverResp.ScriptErrors["failing"], "boom") {
+			t.Errorf("Expected the response kept with the script error, got %+v", serverResp)
+		}
+	})
+}
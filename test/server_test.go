@@ -0,0 +1,737 @@
+package test_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/dns"
+	"github.com/Noooste/azuretls-api/internal/profile"
+	"github.com/Noooste/azuretls-api/internal/server"
+	"github.com/Noooste/azuretls-client"
+	fhttp "github.com/Noooste/fhttp"
+	tls "github.com/Noooste/utls"
+)
+
+func TestIPResolverCaching(t *testing.T) {
+	var hits int32
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		_, _ = w.Write([]byte("203.0.113.7\n"))
+	}))
+	defer echo.Close()
+
+	resolver, err := server.NewIPResolver(echo.URL, time.Minute, "")
+	if err != nil {
+		t.Fatalf("Failed to create IP resolver: %v", err)
+	}
+	defer resolver.Close()
+
+	session := azuretls.NewSession()
+	defer session.Close()
+
+	info, err := resolver.Lookup("session-1", session)
+	if err != nil {
+		t.Fatalf("Failed to lookup IP: %v", err)
+	}
+	if info.IP != "203.0.113.7" || info.Cached {
+		t.Errorf("Expected fresh IP '203.0.113.7', got %+v", info)
+	}
+
+	info, err = resolver.Lookup("session-1", session)
+	if err != nil {
+		t.Fatalf("Failed to lookup IP: %v", err)
+	}
+	if !info.Cached {
+		t.Error("Expected second lookup to be served from cache")
+	}
+
+	resolver.Forget("session-1")
+	if _, err := resolver.Lookup("session-1", session); err != nil {
+		t.Fatalf("Failed to lookup IP: %v", err)
+	}
+
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Errorf("Expected 2 requests to the echo service, got %d", got)
+	}
+}
+
+func TestIPResolverInvalidResponse(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<html>blocked</html>"))
+	}))
+	defer echo.Close()
+
+	resolver, err := server.NewIPResolver(echo.URL, time.Minute, "")
+	if err != nil {
+		t.Fatalf("Failed to create IP resolver: %v", err)
+	}
+	defer resolver.Close()
+
+	session := azuretls.NewSession()
+	defer session.Close()
+
+	if _, err := resolver.Lookup("session-1", session); err == nil {
+		t.Error("Expected an error for a non-IP echo response")
+	}
+}
+
+func TestSessionManagerDNSCache(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer target.Close()
+
+	sessionManager := server.NewSessionManager()
+	sessionManager.SetDNSResolver(dns.NewSystemResolver())
+	defer sessionManager.CleanupSessions()
+
+	session, err := sessionManager.CreateSession("session-1")
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	targetURL := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+	if _, err := session.Get(targetURL); err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+
+	entries, err := sessionManager.GetDNSCache("session-1")
+	if err != nil {
+		t.Fatalf("Failed to get DNS cache: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Host != "localhost" {
+		t.Fatalf("Expected a cached entry for localhost, got %+v", entries)
+	}
+
+	flushed, err := sessionManager.FlushDNSCache("session-1")
+	if err != nil {
+		t.Fatalf("Failed to flush DNS cache: %v", err)
+	}
+	if flushed != 1 {
+		t.Errorf("Expected 1 flushed entry, got %d", flushed)
+	}
+}
+
+// staticResolver resolves every name into the same addresses
+type staticResolver []net.IP
+
+func (r staticResolver) LookupIP(context.Context, string) ([]net.IP, time.Duration, error) {
+	return r, time.Minute, nil
+}
+
+func TestSessionDialFamilies(t *testing.T) {
+	serve := func(network, address, family string) net.Listener {
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			t.Skipf("Cannot listen on %s: %v", address, err)
+		}
+		go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(family))
+		}))
+		t.Cleanup(func() { _ = listener.Close() })
+		return listener
+	}
+
+	ipv4 := serve("tcp4", "127.0.0.1:0", "ipv4")
+	port := strconv.Itoa(ipv4.Addr().(*net.TCPAddr).Port)
+
+	sessionManager := server.NewSessionManager()
+	sessionManager.SetDNSResolver(staticResolver{net.ParseIP("127.0.0.1"), net.ParseIP("::1")})
+	defer sessionManager.CleanupSessions()
+
+	get := func(id string, dial *common.DialConfig) string {
+		session, err := sessionManager.CreateSessionWithConfig(id, &common.SessionConfig{Dial: dial})
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		resp, err := session.Get("http://dual.test:" + port + "/")
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		return resp.String()
+	}
+
+	// Nothing listens on IPv6 yet, the preferred family fails over to IPv4
+	if family := get("refused", &common.DialConfig{PreferFamily: common.FamilyIPv6, FallbackDelayMs: 5000}); family != "ipv4" {
+		t.Errorf("Expected the IPv4 fallback once IPv6 failed, got %q", family)
+	}
+
+	serve("tcp6", "[::1]:"+port, "ipv6")
+
+	for name, test := range map[string]struct {
+		dial     *common.DialConfig
+		expected string
+	}{
+		"default":     {nil, "ipv4"},
+		"prefer ipv6": {&common.DialConfig{PreferFamily: common.FamilyIPv6}, "ipv6"},
+		"serial":      {&common.DialConfig{PreferFamily: common.FamilyIPv6, DisableFallback: true}, "ipv6"},
+		"prefer ipv4": {&common.DialConfig{PreferFamily: common.FamilyIPv4}, "ipv4"},
+	} {
+		if family := get(name, test.dial); family != test.expected {
+			t.Errorf("%s: expected a connection over %s, got %q", name, test.expected, family)
+		}
+	}
+
+	if _, err := sessionManager.CreateSessionWithConfig("invalid", &common.SessionConfig{Dial: &common.DialConfig{PreferFamily: "ipx"}}); err == nil {
+		t.Error("Expected an error for an unknown family")
+	}
+}
+
+func TestSessionPoolProfiles(t *testing.T) {
+	sessionManager := server.NewSessionManager()
+	defer sessionManager.CleanupSessions()
+
+	pool := server.NewSessionPool(sessionManager, common.SessionPoolConfig{
+		Size: 3,
+		Profiles: []common.SessionConfig{
+			{Browser: azuretls.Chrome},
+			{Browser: azuretls.Firefox},
+		},
+		Proxies: []string{"http://127.0.0.1:1"},
+	})
+	if err := pool.Fill(); err != nil {
+		t.Fatalf("Failed to fill pool: %v", err)
+	}
+
+	if stats := pool.Stats(); stats.Idle != 3 || stats.InUse != 0 {
+		t.Fatalf("Expected 3 idle sessions, got %+v", stats)
+	}
+
+	var browsers []string
+	for i := 0; i < 3; i++ {
+		sessionID, err := pool.Acquire()
+		if err != nil {
+			t.Fatalf("Failed to acquire session: %v", err)
+		}
+
+		session, exists := sessionManager.GetSession(sessionID)
+		if !exists {
+			t.Fatalf("Pooled session %s is not registered", sessionID)
+		}
+		if session.Proxy != "http://127.0.0.1:1" {
+			t.Errorf("Expected pooled proxy, got %q", session.Proxy)
+		}
+		browsers = append(browsers, session.Browser)
+	}
+
+	expected := []string{azuretls.Chrome, azuretls.Firefox, azuretls.Chrome}
+	if strings.Join(browsers, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected browsers %v, got %v", expected, browsers)
+	}
+
+	if _, err := pool.Acquire(); !errors.Is(err, common.ErrPoolExhausted) {
+		t.Errorf("Expected ErrPoolExhausted, got %v", err)
+	}
+}
+
+func TestSessionPoolReleaseResets(t *testing.T) {
+	sessionManager := server.NewSessionManager()
+	defer sessionManager.CleanupSessions()
+
+	pool := server.NewSessionPool(sessionManager, common.SessionPoolConfig{
+		Size:     1,
+		Profiles: []common.SessionConfig{{Headers: map[string]string{"Accept-Language": "fr-FR"}}},
+		Proxies:  []string{"http://127.0.0.1:1"},
+	})
+	if err := pool.Fill(); err != nil {
+		t.Fatalf("Failed to fill pool: %v", err)
+	}
+
+	sessionID, err := pool.Acquire()
+	if err != nil {
+		t.Fatalf("Failed to acquire session: %v", err)
+	}
+	session, _ := sessionManager.GetSession(sessionID)
+
+	target, _ := url.Parse("https://example.com/")
+	session.CookieJar.SetCookies(target, []*fhttp.Cookie{{Name: "token", Value: "holder-a"}})
+	if err := sessionManager.SetProxy(sessionID, "http://127.0.0.1:2"); err != nil {
+		t.Fatalf("Failed to set proxy: %v", err)
+	}
+	session.Header.Set("Accept-Language", "en-US")
+	session.Header.Set("X-Holder", "a")
+	session.OrderedHeaders = azuretls.OrderedHeaders{{"X-Holder", "a"}}
+
+	if err := pool.Release(sessionID, false); err != nil {
+		t.Fatalf("Failed to release session: %v", err)
+	}
+	if again, err := pool.Acquire(); err != nil || again != sessionID {
+		t.Fatalf("Expected the released session back, got %q: %v", again, err)
+	}
+
+	// The next holder gets a session as the profile created it
+	reset, _ := sessionManager.GetSession(sessionID)
+	if reset == session {
+		t.Error("Expected the released session to be replaced")
+	}
+	session = reset
+	if cookies := session.CookieJar.Cookies(target); len(cookies) != 0 {
+		t.Errorf("Expected the cookies to be dropped, got %v", cookies)
+	}
+	if session.Proxy != "http://127.0.0.1:1" {
+		t.Errorf("Expected the pooled proxy to be restored, got %q", session.Proxy)
+	}
+	if got := session.Header.Get("Accept-Language"); got != "fr-FR" || session.Header.Get("X-Holder") != "" {
+		t.Errorf("Expected the profile headers to be restored, got %v", session.Header)
+	}
+	if len(session.OrderedHeaders) != 0 {
+		t.Errorf("Expected the ordered headers to be dropped, got %v", session.OrderedHeaders)
+	}
+}
+
+func TestSessionManagerForks(t *testing.T) {
+	sessionManager := server.NewSessionManager()
+	defer sessionManager.CleanupSessions()
+
+	if _, err := sessionManager.CreateSession("forked"); err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	created := 0
+	create := func() (*azuretls.Session, error) {
+		created++
+		return azuretls.NewSession(), nil
+	}
+	current := func(*azuretls.Session) bool { return true }
+
+	fork, release, err := sessionManager.Fork("forked", "alpn", create, current)
+	if err != nil {
+		t.Fatalf("Failed to fork session: %v", err)
+	}
+	if again, releaseAgain, _ := sessionManager.Fork("forked", "alpn", create, current); again != fork || created != 1 {
+		t.Errorf("Expected the fork to be kept, created %d forks", created)
+	} else {
+		releaseAgain()
+	}
+
+	// Dropping the forks leaves the requests in flight running
+	if err := sessionManager.ClearProxy("forked"); err != nil {
+		t.Fatalf("Failed to clear proxy: %v", err)
+	}
+	if fork.Context() == nil {
+		t.Fatal("Expected the dropped fork to stay open until released")
+	}
+	release()
+	release()
+	if fork.Context() != nil {
+		t.Error("Expected the dropped fork to be closed once released")
+	}
+
+	fork, release, _ = sessionManager.Fork("forked", "alpn", create, current)
+	release()
+	if replaced, release, _ := sessionManager.Fork("forked", "alpn", create, func(*azuretls.Session) bool { return false }); replaced == fork || created != 3 {
+		t.Errorf("Expected an out of date fork to be replaced, created %d forks", created)
+	} else {
+		release()
+	}
+	if fork.Context() != nil {
+		t.Error("Expected the replaced fork to be closed")
+	}
+}
+
+func TestSessionManagerProfiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "desktop.yaml"), `
+- name: chrome-desktop
+  browser: chrome
+  user_agent: Custom/1.0
+  headers:
+    accept-language: fr-FR
+  http2: "1:65536;2:0;4:6291456;6:262144|15663105|0|m,a,s,p"
+- name: firefox-desktop
+  browser: firefox
+`)
+	writeFile(t, filepath.Join(dir, "notes.txt"), "ignored")
+
+	catalog := profile.NewCatalog(dir)
+	count, err := catalog.Reload()
+	if err != nil {
+		t.Fatalf("Failed to load profiles: %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("Expected 2 profiles, got %d", count)
+	}
+
+	sessionManager := server.NewSessionManager()
+	sessionManager.SetProfileCatalog(catalog)
+	defer sessionManager.CleanupSessions()
+
+	session, err := sessionManager.CreateSessionWithConfig("session-1", &common.SessionConfig{
+		Profile: "chrome-desktop",
+		Headers: map[string]string{"x-custom": "1"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	if session.Browser != azuretls.Chrome || session.UserAgent != "Custom/1.0" {
+		t.Errorf("Expected profile browser and user agent, got %q and %q", session.Browser, session.UserAgent)
+	}
+	if session.Header.Get("accept-language") != "fr-FR" || session.Header.Get("x-custom") != "1" {
+		t.Errorf("Expected merged headers, got %v", session.Header)
+	}
+
+	// Explicit settings take precedence over the profile
+	session, err = sessionManager.CreateSessionWithConfig("session-2", &common.SessionConfig{
+		Profile:   "chrome-desktop",
+		UserAgent: "Override/2.0",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if session.UserAgent != "Override/2.0" {
+		t.Errorf("Expected overridden user agent, got %q", session.UserAgent)
+	}
+
+	if _, err := sessionManager.CreateSessionWithConfig("session-3", &common.SessionConfig{Profile: "missing"}); err == nil {
+		t.Error("Expected an error for an unknown profile")
+	}
+
+	// A broken reload keeps the previous profiles
+	writeFile(t, filepath.Join(dir, "broken.json"), "{")
+	if _, err := catalog.Reload(); err == nil {
+		t.Fatal("Expected an error for an invalid profile file")
+	}
+	if _, exists := catalog.Get("firefox-desktop"); !exists {
+		t.Error("Expected profiles to survive a failed reload")
+	}
+}
+
+func TestSessionManagerQUICConfig(t *testing.T) {
+	sessionManager := server.NewSessionManager()
+	defer sessionManager.CleanupSessions()
+
+	disabled := false
+	session, err := sessionManager.CreateSessionWithConfig("session-1", &common.SessionConfig{
+		QUIC: &common.QUICConfig{
+			IdleTimeoutMs:         60000,
+			InitialMaxStreamsBidi: 10,
+			Datagrams:             &disabled,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	parameters := make(map[uint64]tls.TransportParameter)
+	for _, extension := range session.GetBrowserHTTP3ClientHelloFunc(session.Browser)().Extensions {
+		if extension, ok := extension.(*tls.QUICTransportParametersExtension); ok {
+			for _, parameter := range extension.TransportParameters {
+				parameters[parameter.ID()] = parameter
+			}
+		}
+	}
+
+	if parameters[tls.MaxIdleTimeout(0).ID()] != tls.MaxIdleTimeout(60000) {
+		t.Errorf("Expected the idle timeout to be tuned, got %v", parameters[tls.MaxIdleTimeout(0).ID()])
+	}
+	if parameters[tls.InitialMaxStreamsBidi(0).ID()] != tls.InitialMaxStreamsBidi(10) {
+		t.Errorf("Expected the bidirectional streams to be tuned, got %v", parameters[tls.InitialMaxStreamsBidi(0).ID()])
+	}
+	if _, exists := parameters[tls.MaxDatagramFrameSize(0).ID()]; exists {
+		t.Error("Expected datagram support not to be advertised")
+	}
+	if parameters[tls.InitialMaxStreamsUni(0).ID()] != tls.InitialMaxStreamsUni(103) {
+		t.Errorf("Expected untouched parameters to keep the Chrome defaults, got %v", parameters[tls.InitialMaxStreamsUni(0).ID()])
+	}
+
+	// HTTP/3 connections are never resumed, so 0-RTT cannot be enabled
+	_, err = sessionManager.CreateSessionWithConfig("session-2", &common.SessionConfig{
+		QUIC: &common.QUICConfig{ZeroRTT: true},
+	})
+	if err == nil || !strings.Contains(err.Error(), "zero_rtt is not supported") {
+		t.Errorf("Expected 0-RTT to be rejected, got %v", err)
+	}
+}
+
+func TestSessionManagerTLSResumption(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strconv.FormatBool(r.TLS.DidResume)))
+	}))
+	defer target.Close()
+
+	sessionManager := server.NewSessionManager()
+	defer sessionManager.CleanupSessions()
+
+	resumed := func(session *azuretls.Session) bool {
+		// A new connection is needed for the handshake to happen again
+		if session.Transport != nil {
+			session.Transport.CloseIdleConnections()
+		}
+
+		resp, err := session.Get(target.URL)
+		if err != nil {
+			t.Fatalf("Failed to request target: %v", err)
+		}
+		return string(resp.Body) == "true"
+	}
+
+	session, err := sessionManager.CreateSessionWithConfig("session-1", &common.SessionConfig{
+		InsecureSkipVerify: true,
+		TLSResumption:      true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	if resumed(session) {
+		t.Error("Expected the first connection to perform a full handshake")
+	}
+	if !resumed(session) {
+		t.Error("Expected the second connection to resume the TLS session")
+	}
+
+	cleared, err := sessionManager.ClearTLSTickets("session-1")
+	if err != nil || cleared != 1 {
+		t.Errorf("Expected one ticket to be cleared, got %d (%v)", cleared, err)
+	}
+	if resumed(session) {
+		t.Error("Expected a full handshake after clearing the tickets")
+	}
+
+	session, err = sessionManager.CreateSessionWithConfig("session-2", &common.SessionConfig{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	resumed(session)
+	if resumed(session) {
+		t.Error("Expected sessions to not resume by default")
+	}
+	if _, err := sessionManager.ClearTLSTickets("session-2"); !errors.Is(err, common.ErrTLSResumptionDisabled) {
+		t.Errorf("Expected ErrTLSResumptionDisabled, got %v", err)
+	}
+}
+
+func TestSessionManagerConnections(t *testing.T) {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	target.EnableHTTP2 = true
+	target.StartTLS()
+	defer target.Close()
+
+	plain := httptest.NewServer(target.Config.Handler)
+	defer plain.Close()
+
+	sessionManager := server.NewSessionManager()
+	defer sessionManager.CleanupSessions()
+
+	session, err := sessionManager.CreateSessionWithConfig("session-1", &common.SessionConfig{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	if connections, err := sessionManager.GetConnections("session-1"); err != nil || len(connections) != 0 {
+		t.Fatalf("Expected no connection before the first request, got %+v (%v)", connections, err)
+	}
+
+	for range 3 {
+		if _, err := session.Get(target.URL); err != nil {
+			t.Fatalf("Failed to request target: %v", err)
+		}
+	}
+	if _, err := session.Get(plain.URL); err != nil {
+		t.Fatalf("Failed to request target: %v", err)
+	}
+
+	connections, err := sessionManager.GetConnections("session-1")
+	if err != nil || len(connections) != 2 {
+		t.Fatalf("Expected 2 connections, got %+v (%v)", connections, err)
+	}
+
+	h2, h1 := connections[0], connections[1]
+	if h2.Protocol != "h2" || h2.Requests != 3 || h2.Reused != 2 || !h2.Idle {
+		t.Errorf("Unexpected HTTP/2 connection %+v", h2)
+	}
+	if h1.Protocol != "http/1.1" || h1.Requests != 1 || h1.Reused != 0 || !h1.Idle {
+		t.Errorf("Unexpected HTTP/1.1 connection %+v", h1)
+	}
+	if h2.Host != strings.TrimPrefix(target.URL, "https://") || h2.RemoteAddr == "" {
+		t.Errorf("Unexpected host %q or remote address %q", h2.Host, h2.RemoteAddr)
+	}
+
+	// Connections closed by the target are dropped
+	target.CloseClientConnections()
+	plain.CloseClientConnections()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(connections) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		connections, _ = sessionManager.GetConnections("session-1")
+	}
+	if len(connections) != 0 {
+		t.Errorf("Expected closed connections to be dropped, got %+v", connections)
+	}
+
+	if _, err := sessionManager.GetConnections("missing"); err == nil {
+		t.Error("Expected an error for a missing session")
+	}
+}
+
+func TestSessionManagerBandwidth(t *testing.T) {
+	payload := strings.Repeat("x", 16*1024)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			body, _ := io.ReadAll(r.Body)
+			_, _ = w.Write([]byte(strconv.Itoa(len(body))))
+			return
+		}
+		_, _ = w.Write([]byte(payload))
+	}))
+	defer target.Close()
+
+	manager := server.NewSessionManager()
+
+	timed := func(config *common.SessionConfig, method string, body any) time.Duration {
+		sessionID := common.GenerateSessionID()
+		session, err := manager.CreateSessionWithConfig(sessionID, config)
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		defer manager.DeleteSession(sessionID)
+
+		start := time.Now()
+		resp, err := session.Do(&azuretls.Request{Method: method, Url: target.URL, Body: body})
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Unexpected status %d", resp.StatusCode)
+		}
+		return time.Since(start)
+	}
+
+	// 16 KiB at 16 KiB/s take about a second, less the initial burst
+	limit := &common.BandwidthConfig{UploadBytesPerSec: 16 * 1024, DownloadBytesPerSec: 16 * 1024}
+
+	if elapsed := timed(&common.SessionConfig{}, http.MethodGet, nil); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected an unlimited download to be fast, took %v", elapsed)
+	}
+	if elapsed := timed(&common.SessionConfig{Bandwidth: limit}, http.MethodGet, nil); elapsed < 700*time.Millisecond {
+		t.Errorf("Expected the download to be throttled, took %v", elapsed)
+	}
+	if elapsed := timed(&common.SessionConfig{Bandwidth: limit}, http.MethodPost, payload); elapsed < 700*time.Millisecond {
+		t.Errorf("Expected the upload to be throttled, took %v", elapsed)
+	}
+
+	if _, err := manager.CreateSessionWithConfig("negative", &common.SessionConfig{
+		Bandwidth: &common.BandwidthConfig{DownloadBytesPerSec: -1},
+	}); err == nil {
+		t.Error("Expected a negative bandwidth limit to be rejected")
+	}
+
+	// The server-wide limit is shared by the uploads of the sessions
+	manager.SetBandwidthLimit(16 * 1024)
+	defer manager.SetBandwidthLimit(0)
+
+	start := time.Now()
+	done := make(chan time.Duration, 2)
+	for range 2 {
+		go func() { done <- timed(&common.SessionConfig{}, http.MethodPost, payload) }()
+	}
+	<-done
+	<-done
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("Expected two uploads to share the server-wide limit, took %v", elapsed)
+	}
+	if elapsed := timed(&common.SessionConfig{}, http.MethodGet, nil); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected downloads to be left out of the server-wide limit, took %v", elapsed)
+	}
+
+	// A request timing out stops waiting for the limit
+	sessionID := common.GenerateSessionID()
+	session, err := manager.CreateSessionWithConfig(sessionID, &common.SessionConfig{
+		Bandwidth: &common.BandwidthConfig{UploadBytesPerSec: 1024},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer manager.DeleteSession(sessionID)
+
+	start = time.Now()
+	if _, err := session.Do(&azuretls.Request{Method: http.MethodPost, Url: target.URL, Body: payload, TimeOut: 300 * time.Millisecond}); err == nil {
+		t.Error("Expected the throttled upload to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the timed out upload to stop waiting, took %v", elapsed)
+	}
+}
+
+func TestSessionManagerMaxConnectionAge(t *testing.T) {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("slow") {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte(strconv.FormatBool(r.TLS.DidResume)))
+	}))
+	target.EnableHTTP2 = true
+	target.StartTLS()
+	defer target.Close()
+
+	sessionManager := server.NewSessionManager()
+	defer sessionManager.CleanupSessions()
+
+	retired := func(sessionID string) {
+		connections, _ := sessionManager.GetConnections(sessionID)
+		deadline := time.Now().Add(3 * time.Second)
+		for len(connections) > 0 && time.Now().Before(deadline) {
+			time.Sleep(20 * time.Millisecond)
+			connections, _ = sessionManager.GetConnections(sessionID)
+		}
+		if len(connections) != 0 {
+			t.Fatalf("Expected the connections of %s to be retired, got %+v", sessionID, connections)
+		}
+	}
+
+	for _, renew := range []bool{false, true} {
+		sessionID := "session-renew-" + strconv.FormatBool(renew)
+		session, err := sessionManager.CreateSessionWithConfig(sessionID, &common.SessionConfig{
+			InsecureSkipVerify: true,
+			TLSResumption:      true,
+			MaxConnectionAge:   &common.ConnectionAgeConfig{Seconds: 1, RenewTicket: renew},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+
+		// A request outliving the age keeps its connection until done
+		resp, err := session.Get(target.URL + "/?slow")
+		if err != nil {
+			t.Fatalf("Failed to request target: %v", err)
+		}
+		if string(resp.Body) != "false" {
+			t.Error("Expected the first connection to perform a full handshake")
+		}
+		retired(sessionID)
+
+		resp, err = session.Get(target.URL)
+		if err != nil {
+			t.Fatalf("Failed to request target: %v", err)
+		}
+		if resumed := string(resp.Body) == "true"; resumed == renew {
+			t.Errorf("Expected the new connection to resume: %v, got %v", !renew, resumed)
+		}
+
+		connections, _ := sessionManager.GetConnections(sessionID)
+		if len(connections) != 1 || connections[0].Requests != 1 {
+			t.Errorf("Expected a new connection, got %+v", connections)
+		}
+	}
+
+	if _, err := sessionManager.CreateSessionWithConfig("negative", &common.SessionConfig{
+		MaxConnectionAge: &common.ConnectionAgeConfig{Seconds: -1},
+	}); err == nil {
+		t.Error("Expected a negative connection age to be rejected")
+	}
+}
@@ -0,0 +1,84 @@
+package test_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/shell"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func TestShell(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "chrome-fr.json"), `{"browser": "chrome", "description": "Chrome in French"}`)
+
+	server := NewTestServerWithConfig(&common.ServerConfig{
+		MaxConcurrentRequests: 10,
+		ProfilesDir:           dir,
+	})
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	client, err := shell.Dial(server.URL, "")
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	var out bytes.Buffer
+	sh := shell.New(client, shell.Config{FingerprintURL: target.URL + "/headers"}, &out)
+
+	script := strings.Join([]string{
+		"profiles",
+		"get " + target.URL + "/cookies/set?token=abc",
+		"cookies",
+		"headers",
+		"profile chrome-fr",
+		"cookies " + target.URL + "/",
+		"fingerprint",
+		"bogus",
+		"exit",
+		"get " + target.URL + "/get",
+	}, "\n")
+	if err := sh.Run(strings.NewReader(script)); err != nil {
+		t.Fatalf("Shell failed: %v", err)
+	}
+
+	output := out.String()
+	for _, expected := range []string{
+		"created (default browser)",
+		"chrome-fr  chrome  Chrome in French",
+		"200 OK  " + target.URL + "/cookies",
+		"token  abc",
+		"Content-Type: application/json",
+		"created (profile chrome-fr)",
+		"No cookies for " + target.URL + "/",
+		`Error: unknown command "bogus"`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected %q in the output:\n%s", expected, output)
+		}
+	}
+	if strings.Contains(output, target.URL+"/get") {
+		t.Errorf("Expected the shell to stop at exit:\n%s", output)
+	}
+
+	for line, expected := range map[string][]string{
+		"":                       {"body", "cookies", "create", "exit", "fingerprint", "get", "headers", "help", "profile", "profiles"},
+		"pro":                    {"profile", "profiles"},
+		"profile c":              {"chrome-fr"},
+		"create fi":              {"firefox"},
+		"get " + target.URL[:10]: {target.URL + "/cookies"},
+		"headers x":              nil,
+	} {
+		if completions := sh.Complete(line); !reflect.DeepEqual(completions, expected) {
+			t.Errorf("Expected completions %v for %q, got %v", expected, line, completions)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package test_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/signing"
+	"github.com/Noooste/azuretls-client"
+)
+
+func TestSigningAWSVector(t *testing.T) {
+	session := azuretls.NewSession()
+	defer session.Close()
+
+	// The IAM example of the AWS Signature Version 4 documentation
+	req := &azuretls.Request{
+		Method: http.MethodGet,
+		Url:    "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08",
+		OrderedHeaders: azuretls.OrderedHeaders{
+			{"Content-Type", "application/x-www-form-urlencoded; charset=utf-8"},
+		},
+	}
+	options := &common.SignOptions{AWS: &common.AWSSigV4Options{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:          "us-east-1",
+		Service:         "iam",
+	}}
+
+	if err := signing.Validate(options); err != nil {
+		t.Fatalf("Failed to validate sign options: %v", err)
+	}
+	if err := signing.Sign(req, session, options, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("Failed to sign request: %v", err)
+	}
+
+	headers := map[string]string{}
+	for _, h := range req.OrderedHeaders {
+		headers[strings.ToLower(h[0])] = h[1]
+	}
+
+	if headers["x-amz-date"] != "20150830T123600Z" {
+		t.Errorf("Expected X-Amz-Date 20150830T123600Z, got %q", headers["x-amz-date"])
+	}
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if headers["authorization"] != expected {
+		t.Errorf("Expected Authorization %q, got %q", expected, headers["authorization"])
+	}
+}
+
+func TestSigningValidation(t *testing.T) {
+	cases := map[string]*common.SignOptions{
+		"empty":          {},
+		"both":           {AWS: &common.AWSSigV4Options{}, HMAC: &common.HMACSignOptions{}},
+		"aws no region":  {AWS: &common.AWSSigV4Options{AccessKeyID: "id", SecretAccessKey: "secret", Service: "s3"}},
+		"hmac no key":    {HMAC: &common.HMACSignOptions{StringToSign: "{method}", Header: "X-Signature"}},
+		"hmac no target": {HMAC: &common.HMACSignOptions{Key: "k", StringToSign: "{method}"}},
+		"hmac algorithm": {HMAC: &common.HMACSignOptions{Key: "k", StringToSign: "{method}", Header: "X-Signature", Algorithm: "md5"}},
+		"hmac unknown":   {HMAC: &common.HMACSignOptions{Key: "k", StringToSign: "{verb}", Header: "X-Signature"}},
+		"hmac value":     {HMAC: &common.HMACSignOptions{Key: "k", StringToSign: "{method}", Header: "Authorization", HeaderValue: "HMAC"}},
+	}
+
+	for name, options := range cases {
+		if err := signing.Validate(options); err == nil {
+			t.Errorf("Expected %s sign options to be rejected", name)
+		}
+	}
+}
+
+func TestRESTSignHMAC(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	type signed struct {
+		timestamp, authorization, query string
+	}
+	received := make(chan signed, 2)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- signed{
+			timestamp:     r.Header.Get("X-Timestamp"),
+			authorization: r.Header.Get("Authorization"),
+			query:         r.URL.Query().Get("sig"),
+		}
+	}))
+	defer target.Close()
+
+	send := func(options *common.HMACSignOptions) signed {
+		body, _ := json.Marshal(common.ServerRequest{
+			URL:     target.URL + "/orders?limit=5",
+			Method:  "POST",
+			Body:    `{"side":"buy"}`,
+			Options: common.RequestOptions{Sign: &common.SignOptions{HMAC: options}},
+		})
+
+		resp, err := http.Post(server.URL+"/api/v1/request", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var result common.ServerResponse
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if result.Error != "" {
+			t.Fatalf("Request failed: %s", result.Error)
+		}
+		return <-received
+	}
+
+	sign := func(message string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(message))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	got := send(&common.HMACSignOptions{
+		Key:          "secret",
+		StringToSign: "{header.X-Timestamp}{method}{path}?{query}{body}",
+		Headers:      map[string]string{"X-Timestamp": "{timestamp_ms}"},
+		Header:       "Authorization",
+		HeaderValue:  "HMAC {signature}",
+	})
+	if got.timestamp == "" {
+		t.Fatal("Expected the X-Timestamp header to be set")
+	}
+	expected := "HMAC " + sign(got.timestamp+`POST/orders?limit=5{"side":"buy"}`)
+	if got.authorization != expected {
+		t.Errorf("Expected Authorization %q, got %q", expected, got.authorization)
+	}
+
+	got = send(&common.HMACSignOptions{
+		Key:          "secret",
+		StringToSign: "{method} {path}",
+		Query:        "sig",
+	})
+	if expected := sign("POST /orders"); got.query != expected {
+		t.Errorf("Expected sig query parameter %q, got %q", expected, got.query)
+	}
+}
@@ -0,0 +1,96 @@
+package test_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/top"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func TestTop(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	sessionID := createTestSession(t, server)
+	client := &top.Client{BaseURL: server.URL, APIKey: testAdminKey}
+
+	prev, err := client.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to fetch stats: %v", err)
+	}
+
+	for _, path := range []string{"/get", "/status/500"} {
+		body, _ := json.Marshal(common.ServerRequest{Method: http.MethodGet, URL: target.URL + path})
+		resp, err := http.Post(server.URL+"/api/v1/request", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	cur, err := client.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to fetch stats: %v", err)
+	}
+	if cur.Stats.Requests == nil || cur.Stats.Requests.Requests != 2 || len(cur.Sessions) != 1 {
+		t.Fatalf("Unexpected snapshot: %+v", cur)
+	}
+
+	// A fixed interval keeps the throughput deterministic
+	prev.Time = cur.Time.Add(-2 * time.Second)
+
+	var screen bytes.Buffer
+	top.Render(&screen, server.URL, prev, cur, 10)
+	output := screen.String()
+
+	for _, expected := range []string{
+		"Sessions: 1",
+		"Requests: 2 (1.0/s)",
+		"Errors: 1 (50.0%)",
+		"Limiter:",
+		"127.0.0.1",
+		sessionID,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected %q in the screen:\n%s", expected, output)
+		}
+	}
+
+	// The first poll has no throughput
+	screen.Reset()
+	top.Render(&screen, server.URL, nil, cur, 10)
+	if !strings.Contains(screen.String(), "Requests: 2 (-/s)") {
+		t.Errorf("Expected no throughput without a previous poll:\n%s", screen.String())
+	}
+}
+
+func TestTopAuthentication(t *testing.T) {
+	server := NewTestServerWithConfig(&common.ServerConfig{
+		MaxConcurrentRequests: 100,
+		APIKeys: []common.APIKeyConfig{
+			{Key: "operator", Admin: true},
+			{Key: "client"},
+		},
+	})
+	defer server.Close()
+
+	client := &top.Client{BaseURL: server.URL, APIKey: "client"}
+	if _, err := client.Fetch(context.Background()); err == nil || !strings.Contains(err.Error(), "Admin API key required") {
+		t.Errorf("Expected the admin key error, got %v", err)
+	}
+
+	client.APIKey = "operator"
+	if _, err := client.Fetch(context.Background()); err != nil {
+		t.Errorf("Expected the admin key to be accepted, got %v", err)
+	}
+}
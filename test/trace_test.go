@@ -0,0 +1,97 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func TestRESTTrace(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	target := mock.NewTLSServer()
+	defer target.Close()
+
+	// A host name, for the DNS lookup to be traced
+	targetURL := strings.Replace(target.URL, "127.0.0.1", "localhost", 1)
+
+	serverReq := common.ServerRequest{
+		Method: http.MethodGet,
+		URL:    targetURL + "/redirect/2",
+		Options: common.RequestOptions{
+			Trace:              true,
+			InsecureSkipVerify: true,
+			Fields:             []string{"status_code"},
+		},
+	}
+	body, _ := json.Marshal(serverReq)
+
+	resp, err := http.Post(server.URL+"/api/v1/request", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var serverResp common.ServerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&serverResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	trace := serverResp.Trace
+	if trace == nil || len(trace.Hops) != 3 {
+		t.Fatalf("Expected a trace of 3 hops, got %+v", trace)
+	}
+
+	expected := []struct {
+		path   string
+		status int
+	}{
+		{"/redirect/2", http.StatusFound},
+		{"/redirect/1", http.StatusFound},
+		{"/get", http.StatusOK},
+	}
+	for i, hop := range trace.Hops {
+		if !strings.HasSuffix(hop.URL, expected[i].path) || hop.StatusCode != expected[i].status || hop.Method != http.MethodGet {
+			t.Errorf("Expected hop %d to be %s with %d, got %+v", i, expected[i].path, expected[i].status, hop)
+		}
+		if hop.Total <= 0 || hop.Total < hop.TTFB || (i > 0 && hop.Start < trace.Hops[i-1].Start) {
+			t.Errorf("Expected consistent timings for hop %d, got %+v", i, hop)
+		}
+	}
+
+	first := trace.Hops[0]
+	if first.Reused || first.DNS <= 0 || first.Connect <= 0 || first.TLS <= 0 || first.Protocol == "" {
+		t.Errorf("Expected the first hop to open a connection, got %+v", first)
+	}
+
+	// Redirects to the same host reuse the connection
+	last := trace.Hops[2]
+	if !last.Reused || last.DNS != 0 || last.Connect != 0 || last.TLS != 0 {
+		t.Errorf("Expected the last hop to reuse the connection, got %+v", last)
+	}
+
+	if trace.Total < last.Start+last.Total-0.001 {
+		t.Errorf("Expected the total to cover every hop, got %v", trace.Total)
+	}
+
+	// Requests without trace option do not carry one
+	serverReq.Options.Trace = false
+	body, _ = json.Marshal(serverReq)
+	resp2, err := http.Post(server.URL+"/api/v1/request", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp2.Body.Close()
+
+	var untraced map[string]any
+	_ = json.NewDecoder(resp2.Body).Decode(&untraced)
+	if _, exists := untraced["trace"]; exists {
+		t.Errorf("Expected no trace without the option, got %v", untraced["trace"])
+	}
+}
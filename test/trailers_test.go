@@ -0,0 +1,208 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+func TestRESTTrailers(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	targets := map[string]*httptest.Server{
+		"HTTP/1.1": mock.NewServer(),
+		"HTTP/2":   mock.NewTLSServer(),
+	}
+
+	for name, target := range targets {
+		t.Run(name, func(t *testing.T) {
+			defer target.Close()
+
+			serverReq := common.ServerRequest{
+				Method: http.MethodGet,
+				URL:    target.URL + "/trailers?Grpc-Status=0&Grpc-Message=OK",
+				Options: common.RequestOptions{
+					InsecureSkipVerify: true,
+				},
+			}
+
+			serverResp := postTrailersRequest(t, server.URL, serverReq)
+
+			if serverResp.StatusCode != http.StatusOK || serverResp.Body == "" {
+				t.Fatalf("Expected an echo body, got %d: %s", serverResp.StatusCode, serverResp.Error)
+			}
+			if got := serverResp.Trailers["Grpc-Status"]; len(got) != 1 || got[0] != "0" {
+				t.Errorf("Expected the Grpc-Status trailer, got %v", serverResp.Trailers)
+			}
+			if got := serverResp.Trailers["Grpc-Message"]; len(got) != 1 || got[0] != "OK" {
+				t.Errorf("Expected the Grpc-Message trailer, got %v", serverResp.Trailers)
+			}
+			if _, exists := serverResp.Headers["Grpc-Status"]; exists {
+				t.Errorf("Expected trailers to stay out of the headers, got %v", serverResp.Headers)
+			}
+
+			// Trailers can be selected like any other field
+			serverReq.Options.Fields = []string{"trailers"}
+			body, _ := json.Marshal(serverReq)
+			resp, err := http.Post(server.URL+"/api/v1/request", "application/json", bytes.NewReader(body))
+			if err != nil {
+				t.Fatalf("Failed to make request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			var selected map[string]json.RawMessage
+			_ = json.NewDecoder(resp.Body).Decode(&selected)
+			if _, exists := selected["trailers"]; !exists || len(selected) != 2 {
+				t.Errorf("Expected only the id and trailers, got %v", selected)
+			}
+		})
+	}
+
+	// Responses without trailers do not carry the field
+	target := mock.NewServer()
+	defer target.Close()
+
+	serverResp := postTrailersRequest(t, server.URL, common.ServerRequest{Method: http.MethodGet, URL: target.URL + "/get"})
+	if serverResp.Trailers != nil {
+		t.Errorf("Expected no trailers, got %v", serverResp.Trailers)
+	}
+}
+
+func TestRESTRequestTrailers(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	received := make(chan http.Header, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Trailers are only known once the body has been read
+		body, _ := io.ReadAll(r.Body)
+		received <- r.Trailer
+		_, _ = w.Write([]byte(r.Proto + " " + strings.Join(r.TransferEncoding, ",") + " " + string(body)))
+	})
+
+	targets := map[string]*httptest.Server{
+		"HTTP/1.1": httptest.NewServer(handler),
+		"HTTP/2":   httptest.NewUnstartedServer(handler),
+	}
+	targets["HTTP/2"].EnableHTTP2 = true
+	targets["HTTP/2"].StartTLS()
+
+	for name, target := range targets {
+		t.Run(name, func(t *testing.T) {
+			defer target.Close()
+
+			serverResp := postTrailersRequest(t, server.URL, common.ServerRequest{
+				Method:   http.MethodPost,
+				URL:      target.URL + "/upload",
+				Body:     "data",
+				Trailers: map[string][]string{"Checksum": {"abc"}, "grpc-status": {"0"}},
+				Options: common.RequestOptions{
+					InsecureSkipVerify: true,
+				},
+			})
+			if serverResp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected the request to be sent, got %d: %s", serverResp.StatusCode, serverResp.Error)
+			}
+			if serverResp.Body != "HTTP/1.1 chunked data" {
+				t.Errorf("Expected a chunked HTTP/1.1 body, got %q", serverResp.Body)
+			}
+
+			trailers := <-received
+			if got := trailers.Get("Checksum"); got != "abc" {
+				t.Errorf("Expected the Checksum trailer, got %v", trailers)
+			}
+			if got := trailers.Get("Grpc-Status"); got != "0" {
+				t.Errorf("Expected the Grpc-Status trailer, got %v", trailers)
+			}
+		})
+	}
+
+	// Trailers follow the body, and fail rather than being dropped
+	target := mock.NewServer()
+	defer target.Close()
+
+	for name, serverReq := range map[string]common.ServerRequest{
+		"without body": {Method: http.MethodGet, URL: target.URL + "/get"},
+		"over HTTP/3":  {Method: http.MethodPost, URL: target.URL + "/post", Body: "data", Options: common.RequestOptions{ForceHTTP3: true}},
+		"with alpn":    {Method: http.MethodPost, URL: target.URL + "/post", Body: "data", Options: common.RequestOptions{ALPN: []string{"h2"}}},
+	} {
+		serverReq.Trailers = map[string][]string{"Checksum": {"abc"}}
+		serverResp := postTrailersRequest(t, server.URL, serverReq)
+		if !strings.Contains(serverResp.Error, "trailers") {
+			t.Errorf("Expected a request with trailers %s to fail, got %d: %s", name, serverResp.StatusCode, serverResp.Error)
+		}
+	}
+}
+
+func TestSessionRequestTrailers(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	server := httptest.NewServer(newAPIHandler(t, config, nil))
+	defer server.Close()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = w.Write([]byte(r.Trailer.Get("Checksum")))
+	}))
+	defer target.Close()
+
+	created, err := http.Post(server.URL+"/api/v1/session/create", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	var result map[string]string
+	_ = json.NewDecoder(created.Body).Decode(&result)
+	created.Body.Close()
+	sessionID := result["session_id"]
+	if sessionID == "" {
+		t.Fatalf("Failed to create session: %v", result)
+	}
+
+	// The fork sending trailers is kept for the next requests of the
+	// session, each sending its own
+	for _, checksum := range []string{"abc", "def"} {
+		body, _ := json.Marshal(common.ServerRequest{
+			Method:   http.MethodPost,
+			URL:      target.URL + "/upload",
+			Body:     "data",
+			Trailers: map[string][]string{"Checksum": {checksum}},
+		})
+		resp, err := http.Post(server.URL+"/api/v1/session/"+sessionID+"/request", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		var serverResp common.ServerResponse
+		_ = json.NewDecoder(resp.Body).Decode(&serverResp)
+		resp.Body.Close()
+
+		if serverResp.StatusCode != http.StatusOK || serverResp.Body != checksum {
+			t.Errorf("Expected the target to receive trailer %q, got %d %q: %s", checksum, serverResp.StatusCode, serverResp.Body, serverResp.Error)
+		}
+	}
+}
+
+func postTrailersRequest(t *testing.T, serverURL string, serverReq common.ServerRequest) common.ServerResponse {
+	t.Helper()
+
+	body, _ := json.Marshal(serverReq)
+	resp, err := http.Post(serverURL+"/api/v1/request", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var serverResp common.ServerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&serverResp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	return serverResp
+}
@@ -0,0 +1,199 @@
+package test_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/mock"
+)
+
+// writeUpload writes a multipart upload, calling body to write the body
+// part when set
+func writeUpload(writer *multipart.Writer, serverReq common.ServerRequest, length int, body func(io.Writer)) error {
+	requestPart, err := writer.CreateFormField("request")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(requestPart).Encode(serverReq); err != nil {
+		return err
+	}
+
+	if body != nil {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="body"`)
+		header.Set("Content-Type", "application/octet-stream")
+		if length >= 0 {
+			header.Set("Content-Length", fmt.Sprint(length))
+		}
+
+		bodyPart, err := writer.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		body(bodyPart)
+	}
+
+	return writer.Close()
+}
+
+func upload(t *testing.T, server *TestServer, serverReq common.ServerRequest, length int, body string) (*common.ServerResponse, int) {
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+	err := writeUpload(writer, serverReq, length, func(w io.Writer) {
+		_, _ = io.WriteString(w, body)
+	})
+	if err != nil {
+		t.Fatalf("Failed to write upload: %v", err)
+	}
+
+	resp, err := http.Post(server.URL+"/api/v1/request", writer.FormDataContentType(), &buffer)
+	if err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+
+	// Rejected uploads get an error response instead
+	var serverResp common.ServerResponse
+	if err := json.Unmarshal(data, &serverResp); err != nil {
+		var errorResp struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(data, &errorResp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		serverResp.Error = errorResp.Error
+	}
+	return &serverResp, resp.StatusCode
+}
+
+func TestRESTUpload(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	serverReq := common.ServerRequest{
+		Method:         http.MethodPost,
+		URL:            target.URL + "/post",
+		OrderedHeaders: [][]string{{"Content-Type", "text/plain"}},
+	}
+
+	resp, status := upload(t, server, serverReq, 11, "hello world")
+	if status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", status, resp.Error)
+	}
+
+	var echo mock.EchoResponse
+	if err := json.Unmarshal([]byte(resp.Body), &echo); err != nil {
+		t.Fatalf("Failed to decode echo: %v", err)
+	}
+	if echo.Body != "hello world" || echo.Headers["Content-Type"][0] != "text/plain" {
+		t.Errorf("Expected the body part to be sent, got %q with %v", echo.Body, echo.Headers)
+	}
+
+	// A body part of declared length is sent with its Content-Length
+	sized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "%v %d", r.TransferEncoding, r.ContentLength)
+	}))
+	defer sized.Close()
+
+	resp, _ = upload(t, server, common.ServerRequest{Method: http.MethodPost, URL: sized.URL, Options: common.RequestOptions{ForceHTTP1: true}}, 11, "hello world")
+	if resp.Body != "[] 11" {
+		t.Errorf("Expected the body sent with a Content-Length, got %q", resp.Body)
+	}
+
+	// Without body part, the request is sent without body
+	resp, _ = upload(t, server, common.ServerRequest{Method: http.MethodGet, URL: target.URL + "/get"}, -1, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected a request without body part to succeed, got %d: %s", resp.StatusCode, resp.Error)
+	}
+
+	resp, status = upload(t, server, serverReq, 20, "hello world")
+	if status != http.StatusBadRequest || !strings.Contains(resp.Error, "Content-Length") {
+		t.Errorf("Expected a truncated body part to fail, got %d: %s", status, resp.Error)
+	}
+
+	// A 307 redirect would send the body again
+	serverReq.URL = target.URL + "/redirect-to?status_code=307&url=/post"
+	resp, status = upload(t, server, serverReq, -1, "hello world")
+	if status != http.StatusInternalServerError || !strings.Contains(resp.Error, "cannot be sent twice") {
+		t.Errorf("Expected the replay of a streamed body to fail, got %d: %s", status, resp.Error)
+	}
+
+	serverReq = common.ServerRequest{Method: http.MethodPost, URL: target.URL + "/post", Body: "inline"}
+	resp, status = upload(t, server, serverReq, -1, "hello world")
+	if status != http.StatusBadRequest || !strings.Contains(resp.Error, "body part") {
+		t.Errorf("Expected an inline body with a body part to be rejected, got %d: %s", status, resp.Error)
+	}
+}
+
+func TestRESTUploadStreaming(t *testing.T) {
+	server := NewTestServer()
+	defer server.Close()
+
+	received := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first := make([]byte, 5)
+		if _, err := io.ReadFull(r.Body, first); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		close(received)
+
+		rest, _ := io.ReadAll(r.Body)
+		_, _ = fmt.Fprintf(w, "%s%s %v %d", first, rest, r.TransferEncoding, r.ContentLength)
+	}))
+	defer target.Close()
+
+	reader, pipe := io.Pipe()
+	writer := multipart.NewWriter(pipe)
+
+	go func() {
+		err := writeUpload(writer, common.ServerRequest{Method: http.MethodPost, URL: target.URL, Options: common.RequestOptions{ForceHTTP1: true}}, -1, func(w io.Writer) {
+			_, _ = io.WriteString(w, "first")
+			// The rest of the body is only sent once the target received
+			// the beginning, which would block if the upload was buffered
+			select {
+			case <-received:
+			case <-time.After(5 * time.Second):
+			}
+			_, _ = io.WriteString(w, " and rest")
+		})
+		_ = pipe.CloseWithError(err)
+	}()
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/api/v1/request", reader)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var serverResp common.ServerResponse
+	_ = json.NewDecoder(resp.Body).Decode(&serverResp)
+
+	select {
+	case <-received:
+	default:
+		t.Fatalf("Expected the target to receive the body while it was uploaded, got %d: %s", resp.StatusCode, serverResp.Error)
+	}
+
+	if serverResp.Body != "first and rest [chunked] -1" {
+		t.Errorf("Expected the body to be streamed with chunked encoding, got %q", serverResp.Body)
+	}
+}
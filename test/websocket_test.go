@@ -3,8 +3,11 @@ package test_test
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -12,9 +15,14 @@ import (
 
 	fhttp "net/http"
 
+	"github.com/Noooste/azuretls-api/api"
+	"github.com/Noooste/azuretls-api/internal/auth"
 	"github.com/Noooste/azuretls-api/internal/common"
+	"github.com/Noooste/azuretls-api/internal/keepalive"
 	"github.com/Noooste/azuretls-api/internal/rest"
+	"github.com/Noooste/azuretls-api/internal/rotation"
 	internal_websocket "github.com/Noooste/azuretls-api/internal/websocket"
+	"github.com/Noooste/azuretls-api/mock"
 	"github.com/Noooste/azuretls-client"
 	"github.com/gorilla/websocket"
 )
@@ -28,11 +36,21 @@ type WebSocketTestServer struct {
 }
 
 func NewWebSocketTestServer() *WebSocketTestServer {
+	return newWebSocketTestServerWithConfig(nil)
+}
+
+func newWebSocketTestServerWithConfig(config *common.ServerConfig) *WebSocketTestServer {
 	sessionManager := &MockSessionManager{
 		sessions: make(map[string]*azuretls.Session),
 	}
 
-	server := &TestAPIServer{sessionManager: sessionManager}
+	server := &TestAPIServer{
+		sessionManager: sessionManager,
+		rotator:        rotation.NewRotator(),
+		keepalives:     keepalive.NewScheduler(),
+		owners:         auth.NewOwners(),
+		config:         config,
+	}
 	fhttpRoutes := rest.SetupRoutes(server)
 
 	// Convert fhttp.Handler to net/http.Handler using a compatibility wrapper
@@ -300,12 +318,15 @@ func TestWebSocketRequestMessage(t *testing.T) {
 	}
 	defer client.Close()
 
+	target := mock.NewServer()
+	defer target.Close()
+
 	// Create session first
 	sessionID := createWebSocketSession(t, client)
 
 	// Send request message
 	serverReq := common.ServerRequest{
-		URL:    "https://httpbin.org/get",
+		URL:    target.URL + "/get",
 		Method: "GET",
 	}
 
@@ -896,6 +917,123 @@ func TestWebSocketSessionCleanupOnDisconnect(t *testing.T) {
 	_ = sessionID
 }
 
+func TestWebSocketPersistSession(t *testing.T) {
+	server := NewWebSocketTestServer()
+	defer server.Close()
+
+	mockManager := server.sessionManager.(*MockSessionManager)
+
+	send := func(client *WebSocketTestClient, msgType internal_websocket.WSMessageType, payload any) (*internal_websocket.WSMessage, map[string]any) {
+		if err := client.SendMessage(msgType, string(msgType), payload); err != nil {
+			t.Fatalf("Failed to send %s message: %v", msgType, err)
+		}
+		response, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read %s response: %v", msgType, err)
+		}
+		var result map[string]any
+		_ = json.Unmarshal(response.Payload, &result)
+		return response, result
+	}
+
+	client, err := NewWebSocketTestClient(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+
+	_, created := send(client, internal_websocket.CreateSessionMsg, map[string]any{"persist": true})
+	sessionID, _ := created["session_id"].(string)
+	if sessionID == "" || created["persist"] != true {
+		t.Fatalf("Expected a persisted session, got %v", created)
+	}
+
+	client.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	if _, exists := mockManager.GetSession(sessionID); !exists {
+		t.Fatal("Expected the persisted session to survive the disconnect")
+	}
+
+	client, err = NewWebSocketTestClient(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer client.Close()
+
+	if response, _ := send(client, internal_websocket.AttachSessionMsg, map[string]string{"session_id": "missing"}); response.Type != internal_websocket.ErrorMessage {
+		t.Errorf("Expected an error attaching an unknown session, got %s", response.Type)
+	}
+
+	if _, attached := send(client, internal_websocket.AttachSessionMsg, map[string]string{"session_id": sessionID}); attached["status"] != "attached" {
+		t.Fatalf("Expected the session attached, got %v", attached)
+	}
+
+	if _, detached := send(client, internal_websocket.DetachSessionMsg, nil); detached["session_id"] != sessionID || detached["status"] != "detached" {
+		t.Fatalf("Expected the session detached, got %v", detached)
+	}
+
+	if response, _ := send(client, internal_websocket.DetachSessionMsg, nil); response.Type != internal_websocket.ErrorMessage {
+		t.Errorf("Expected an error detaching without a session, got %s", response.Type)
+	}
+
+	// A session created without persist is still deleted on disconnect
+	sessionID = createWebSocketSession(t, client)
+	client.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	if _, exists := mockManager.GetSession(sessionID); exists {
+		t.Error("Expected the non-persisted session deleted on disconnect")
+	}
+}
+
+func TestWebSocketPersistedSessionTTL(t *testing.T) {
+	server := newWebSocketTestServerWithConfig(&common.ServerConfig{
+		MaxConcurrentRequests: 100,
+		WSPersistTTL:          200 * time.Millisecond,
+	})
+	defer server.Close()
+
+	mockManager := server.sessionManager.(*MockSessionManager)
+
+	send := func(client *WebSocketTestClient, msgType internal_websocket.WSMessageType, payload any) map[string]any {
+		if err := client.SendMessage(msgType, string(msgType), payload); err != nil {
+			t.Fatalf("Failed to send %s message: %v", msgType, err)
+		}
+		response, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read %s response: %v", msgType, err)
+		}
+		var result map[string]any
+		_ = json.Unmarshal(response.Payload, &result)
+		return result
+	}
+
+	client, err := NewWebSocketTestClient(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer client.Close()
+
+	kept, _ := send(client, internal_websocket.CreateSessionMsg, map[string]any{"persist": true})["session_id"].(string)
+	send(client, internal_websocket.DetachSessionMsg, nil)
+	expired, _ := send(client, internal_websocket.CreateSessionMsg, map[string]any{"persist": true})["session_id"].(string)
+	send(client, internal_websocket.DetachSessionMsg, nil)
+
+	// Attaching a session again stops its TTL
+	time.Sleep(100 * time.Millisecond)
+	if attached := send(client, internal_websocket.AttachSessionMsg, map[string]string{"session_id": kept}); attached["status"] != "attached" {
+		t.Fatalf("Expected the session attached, got %v", attached)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if _, exists := mockManager.GetSession(kept); !exists {
+		t.Error("Expected the attached session kept past the TTL")
+	}
+	if _, exists := mockManager.GetSession(expired); exists {
+		t.Error("Expected the session left without a connection deleted after the TTL")
+	}
+}
+
 // Helper function to create a WebSocket session
 func createWebSocketSession(t *testing.T, client *WebSocketTestClient) string {
 	config := common.SessionConfig{
@@ -924,3 +1062,116 @@ func createWebSocketSession(t *testing.T, client *WebSocketTestClient) string {
 
 	return createResult["session_id"]
 }
+
+func TestWebSocketMaxMessageSize(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.WSMaxMessageSize = 1024
+
+	server := httptest.NewServer(newAPIHandler(t, config, nil))
+	defer server.Close()
+
+	client, err := NewWebSocketTestClient(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.SendMessage(internal_websocket.PingMessage, "small", nil); err != nil {
+		t.Fatalf("Failed to send ping message: %v", err)
+	}
+	if response, err := client.ReadMessage(); err != nil || response.Type != internal_websocket.PongMessage {
+		t.Fatalf("Expected a pong to a small message, got %v, %v", response, err)
+	}
+
+	if err := client.SendMessage(internal_websocket.PingMessage, "large", map[string]string{"padding": strings.Repeat("a", 4096)}); err != nil {
+		t.Fatalf("Failed to send large message: %v", err)
+	}
+	if _, err := client.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("Expected the connection closed with status 1009, got %v", err)
+	}
+}
+
+func TestWebSocketGracefulClose(t *testing.T) {
+	config := api.DefaultConfig()
+	config.LogLevel = "error"
+	config.WSDrainTimeout = 5 * time.Second
+	config.WSReconnectTo = "wss://api-2.example.com/ws"
+
+	handler := newAPIHandler(t, config, nil)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	target := mock.NewServer()
+	defer target.Close()
+
+	client, err := NewWebSocketTestClient(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	defer client.Close()
+
+	if err := client.SendMessage(internal_websocket.CreateSessionMsg, "create-session", common.SessionConfig{}); err != nil {
+		t.Fatalf("Failed to send create session message: %v", err)
+	}
+	if response, err := client.ReadMessage(); err != nil || response.Type != internal_websocket.ResponseMessage {
+		t.Fatalf("Failed to create session: %v, %v", response, err)
+	}
+
+	// The request is in flight when the server shuts down
+	if err := client.SendMessage(internal_websocket.RequestMessage, "slow", common.ServerRequest{
+		Method: http.MethodGet,
+		URL:    target.URL + "/delay/0.5",
+	}); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- handler.(io.Closer).Close()
+	}()
+
+	shutdown, err := client.ReadMessage()
+	if err != nil || shutdown.Type != internal_websocket.ShutdownMsg {
+		t.Fatalf("Expected a shutdown message, got %v, %v", shutdown, err)
+	}
+	var notice internal_websocket.CloseNotice
+	json.Unmarshal(shutdown.Payload, &notice)
+	if notice.ReconnectTo != config.WSReconnectTo || notice.Reason == "" {
+		t.Errorf("Unexpected shutdown notice %+v", notice)
+	}
+
+	// Messages sent while draining are rejected
+	if err := client.SendMessage(internal_websocket.PingMessage, "late", nil); err != nil {
+		t.Fatalf("Failed to send ping: %v", err)
+	}
+
+	var responses []string
+	for {
+		message, err := client.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Errorf("Expected a going away close frame, got %v", err)
+			}
+			break
+		}
+		responses = append(responses, fmt.Sprintf("%s:%s", message.ID, message.Type))
+	}
+
+	if !slices.Contains(responses, "slow:response") || !slices.Contains(responses, "late:error") {
+		t.Errorf("Expected the in-flight request to complete and the late ping to be rejected, got %v", responses)
+	}
+
+	if err := <-closed; err != nil {
+		t.Errorf("Failed to close: %v", err)
+	}
+
+	resp, err := http.Get(server.URL + "/ws")
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected new connections to be rejected with 503, got %d", resp.StatusCode)
+		}
+	}
+}